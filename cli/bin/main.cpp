@@ -15,12 +15,17 @@
 // You should have received a copy of the GNU General Public License
 // along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
 
+#include <algorithm>
 #include <atomic>
+#include <cctype>
 #include <filesystem>
+#include <fstream>
 #include <iostream>
 #include <optional>
+#include <sstream>
 #include <string>
 #include <type_traits>
+#include <vector>
 
 #if defined(_WIN32)
 #include <fcntl.h>
@@ -251,6 +256,12 @@ class SessionCallback final : public etcpp::SessionCallback {
 public:
     void onNetworkLost() override { gConnectionActive.store(false); }
     void onNetworkRestored() override { gConnectionActive.store(true); }
+    void onClockSkew(int64_t skewSeconds) override {
+        std::cerr << "Warning: the clock of this computer is off by " << skewSeconds
+                  << " seconds compared to the Proton servers, which can make the login fail. Please correct the date, time and time "
+                     "zone settings of the system, or use --compensate-clock-skew"
+                  << std::endl;
+    }
 };
 
 class CLIAppState final : public TaskAppState {
@@ -334,6 +345,70 @@ std::filesystem::path getBackupPath(cxxopts::ParseResult const& argParseResult,
     }
 }
 
+// Zip, tar and compressed tar archives of a backup can be restored without being extracted first, as well as tar
+// archives encrypted with gpg.
+bool isBackupArchive(std::filesystem::path const& path) {
+    auto name = path.filename().u8string();
+    std::transform(name.begin(), name.end(), name.begin(), [](unsigned char c) { return std::tolower(c); });
+
+    auto hasSuffix = [&name](std::string const& suffix) {
+        return name.size() > suffix.size() && name.compare(name.size() - suffix.size(), suffix.size(), suffix) == 0;
+    };
+
+    if (hasSuffix(".gpg")) {
+        name.resize(name.size() - 4);
+    }
+
+    for (auto const& suffix : {".zip", ".tar", ".tar.gz", ".tgz", ".tar.zst", ".tar.zstd"}) {
+        if (hasSuffix(suffix)) {
+            return true;
+        }
+    }
+
+    return false;
+}
+
+// Backups stored on S3, on a WebDAV server or on an SFTP server are restored from their URL without being downloaded first.
+bool isRemoteBackup(std::filesystem::path const& path) {
+    auto value = path.u8string();
+    std::transform(value.begin(), value.end(), value.begin(), [](unsigned char c) { return std::tolower(c); });
+    return value.rfind("s3://", 0) == 0 || value.rfind("webdav://", 0) == 0 || value.rfind("webdav+http://", 0) == 0 ||
+           value.rfind("sftp://", 0) == 0;
+}
+
+// Reads the passphrase and the armored key file encrypting the backup files on disk. Returns false if the key file
+// cannot be read. Both are empty if the backup is not encrypted at rest.
+bool getEncryptionOptions(cxxopts::ParseResult const& argParseResult, std::string& outPassphrase, std::string& outArmoredKey) {
+    if (argParseResult.count("encryption-passphrase")) {
+        outPassphrase = argParseResult["encryption-passphrase"].as<std::string>();
+    } else if (const char* envValue = std::getenv("ET_ENCRYPTION_PASSPHRASE"); envValue != nullptr) {
+        outPassphrase = envValue;
+    }
+
+    std::string keyPath;
+    if (argParseResult.count("encryption-key")) {
+        keyPath = argParseResult["encryption-key"].as<std::string>();
+    } else if (const char* envValue = std::getenv("ET_ENCRYPTION_KEY"); envValue != nullptr) {
+        keyPath = envValue;
+    }
+
+    if (keyPath.empty()) {
+        return true;
+    }
+
+    std::ifstream file(etcpp::expandCLIPath(std::filesystem::u8path(keyPath)));
+    if (!file) {
+        std::cerr << "Failed to read encryption key '" << keyPath << "'" << std::endl;
+        return false;
+    }
+
+    std::stringstream content;
+    content << file.rdbuf();
+    outArmoredKey = content.str();
+
+    return true;
+}
+
 std::filesystem::path getRestorePath(cxxopts::ParseResult const& argParseResult, bool& outPathCameFromArgOrEnv) {
     std::filesystem::path backupPath;
     outPathCameFromArgOrEnv = false;
@@ -356,9 +431,14 @@ std::filesystem::path getRestorePath(cxxopts::ParseResult const& argParseResult,
     }
 
     while (true) {
-        std::cout << "Please specify the path of the backup folder. E.g.: " << getExampleDir() << std::endl;
+        std::cout << "Please specify the path of the backup folder or archive, or its s3://, webdav:// or sftp:// URL. E.g.: "
+                  << getExampleDir() << std::endl;
         backupPath = readPath("Backup Path");
 
+        if (isRemoteBackup(backupPath)) {
+            return backupPath;
+        }
+
         if (backupPath.is_relative()) {
             backupPath = getOutputPath() / backupPath;
         }
@@ -368,8 +448,8 @@ std::filesystem::path getRestorePath(cxxopts::ParseResult const& argParseResult,
             continue;
         }
 
-        if (!std::filesystem::is_directory(backupPath)) {
-            std::cerr << "The specified path is not a directory" << std::endl;
+        if (!std::filesystem::is_directory(backupPath) && !isBackupArchive(backupPath)) {
+            std::cerr << "The specified path is neither a directory nor a backup archive" << std::endl;
             continue;
         }
 
@@ -418,6 +498,18 @@ std::optional<int> performLogin(etcpp::Session& session, cxxopts::ParseResult& a
                 continue;
             }
 
+            if (loginState != etcpp::Session::LoginState::LoggedOut && loginState != etcpp::Session::LoginState::AwaitingHV) {
+                if (const auto scopes = session.getScopeSummary(); !scopes.empty()) {
+                    std::cout << "The session has been granted the following permissions:\n" << scopes << std::endl;
+
+                    const bool confirmScopes = argParseResult["confirm-scopes"].as<bool>() || (std::getenv("ET_CONFIRM_SCOPES") != nullptr);
+                    if (confirmScopes && !readYesNo("Continue with these permissions?")) {
+                        std::cerr << "Login cancelled, the session permissions were not accepted" << std::endl;
+                        return EXIT_FAILURE;
+                    }
+                }
+            }
+
             numLoginAttempts = 0;
             break;
         }
@@ -441,6 +533,32 @@ std::optional<int> performLogin(etcpp::Session& session, cxxopts::ParseResult& a
             numLoginAttempts = 0;
             break;
         }
+        case etcpp::Session::LoginState::AwaitingFIDO2:
+        {
+            // There is no security key support built in, the challenge is signed by an external WebAuthn tool.
+            std::cout << "\nThis account requires a security key. Sign the challenge below with a WebAuthn tool and "
+                         "paste its assertion as JSON, with base64 ClientData, AuthenticatorData, Signature and CredentialID.\n\n"
+                      << session.getFIDO2ChallengeJSON() << '\n'
+                      << std::endl;
+
+            const auto assertion = readText("Assertion");
+            if (gShouldQuit) {
+                return EXIT_SUCCESS;
+            }
+
+            try {
+                auto task = LoginSessionTask(session, "Submitting security key assertion",
+                                             [&](etcpp::Session& s) -> etcpp::Session::LoginState { return s.loginFIDO2(assertion.c_str()); });
+                loginState = runTask(appState, task);
+            } catch (const etcpp::SessionException& e) {
+                std::cerr << "Failed to submit security key assertion: " << e.what() << std::endl;
+                numLoginAttempts += 1;
+                continue;
+            }
+
+            numLoginAttempts = 0;
+            break;
+        }
         case etcpp::Session::LoginState::AwaitingHV:
         {
             const auto hvUrl = session.getHVSolveURL();
@@ -540,6 +658,248 @@ int performBackup(etcpp::Session& session, cxxopts::ParseResult const& argParseR
         return EXIT_FAILURE;
     }
 
+    std::string autoGenerated = "include";
+    if (argParseResult.count("auto-generated")) {
+        autoGenerated = argParseResult["auto-generated"].as<std::string>();
+    } else if (const char* envValue = std::getenv("ET_AUTO_GENERATED"); envValue != nullptr) {
+        autoGenerated = envValue;
+    }
+
+    try {
+        if (autoGenerated == "exclude") {
+            backupTask->setAutoGeneratedMode(etcpp::AutoGeneratedMode::Exclude);
+        } else if (autoGenerated == "separate") {
+            backupTask->setAutoGeneratedMode(etcpp::AutoGeneratedMode::Separate);
+        } else if (autoGenerated != "include") {
+            std::cerr << "Unknown auto-generated mail mode '" << autoGenerated << "', expected include, exclude or separate" << std::endl;
+            return EXIT_FAILURE;
+        }
+    } catch (const etcpp::BackupException& e) {
+        std::cerr << "Failed to configure export task: " << e.what() << std::endl;
+        return EXIT_FAILURE;
+    }
+
+    std::string format = "eml";
+    if (argParseResult.count("format")) {
+        format = argParseResult["format"].as<std::string>();
+    } else if (const char* envValue = std::getenv("ET_FORMAT"); envValue != nullptr) {
+        format = envValue;
+    }
+
+    try {
+        if (format == "mbox") {
+            backupTask->setOutputFormat(etcpp::OutputFormat::MBox);
+        } else if (format == "maildir") {
+            backupTask->setOutputFormat(etcpp::OutputFormat::Maildir);
+        } else if (format == "pack") {
+            backupTask->setOutputFormat(etcpp::OutputFormat::Pack);
+        } else if (format == "zip") {
+            backupTask->setOutputFormat(etcpp::OutputFormat::Zip);
+        } else if (format == "tar.zst") {
+            backupTask->setOutputFormat(etcpp::OutputFormat::TarZst);
+        } else if (format != "eml") {
+            std::cerr << "Unknown output format '" << format << "', expected eml, mbox, maildir, pack, zip or tar.zst"
+                      << std::endl;
+            return EXIT_FAILURE;
+        }
+    } catch (const etcpp::BackupException& e) {
+        std::cerr << "Failed to configure export task: " << e.what() << std::endl;
+        return EXIT_FAILURE;
+    }
+
+    if (argParseResult.count("incremental") || std::getenv("ET_INCREMENTAL") != nullptr) {
+        try {
+            backupTask->setIncremental(argParseResult.count("tombstones") || std::getenv("ET_TOMBSTONES") != nullptr);
+        } catch (const etcpp::BackupException& e) {
+            std::cerr << "Failed to configure incremental export: " << e.what() << std::endl;
+            return EXIT_FAILURE;
+        }
+    }
+
+    if (argParseResult.count("resume") || std::getenv("ET_RESUME") != nullptr) {
+        try {
+            backupTask->setResume();
+        } catch (const etcpp::BackupException& e) {
+            std::cerr << "Failed to resume export: " << e.what() << std::endl;
+            return EXIT_FAILURE;
+        }
+    }
+
+    std::vector<std::string> mirrors;
+    if (argParseResult.count("mirror")) {
+        mirrors = argParseResult["mirror"].as<std::vector<std::string>>();
+    } else if (const char* envValue = std::getenv("ET_MIRROR"); envValue != nullptr) {
+        std::stringstream stream(envValue);
+        for (std::string mirror; std::getline(stream, mirror, ',');) {
+            mirrors.push_back(mirror);
+        }
+    }
+
+    try {
+        for (const auto& mirror : mirrors) {
+            backupTask->addMirror(mirror);
+        }
+        backupTask->setMirrorParallel(argParseResult.count("mirror-parallel") || std::getenv("ET_MIRROR_PARALLEL") != nullptr);
+    } catch (const etcpp::BackupException& e) {
+        std::cerr << "Failed to configure mirrors: " << e.what() << std::endl;
+        return EXIT_FAILURE;
+    }
+
+    std::string encryptionPassphrase;
+    std::string encryptionKey;
+    if (!getEncryptionOptions(argParseResult, encryptionPassphrase, encryptionKey)) {
+        return EXIT_FAILURE;
+    }
+
+    if (!encryptionPassphrase.empty() || !encryptionKey.empty()) {
+        try {
+            backupTask->setEncryption(encryptionPassphrase, encryptionKey);
+        } catch (const etcpp::BackupException& e) {
+            std::cerr << "Failed to configure encryption: " << e.what() << std::endl;
+            return EXIT_FAILURE;
+        }
+    }
+
+    std::string pathBudget;
+    if (argParseResult.count("path-budget")) {
+        pathBudget = argParseResult["path-budget"].as<std::string>();
+    } else if (const char* envValue = std::getenv("ET_PATH_BUDGET"); envValue != nullptr) {
+        pathBudget = envValue;
+    }
+
+    if (!pathBudget.empty()) {
+        try {
+            backupTask->setPathBudget(pathBudget);
+        } catch (const etcpp::BackupException& e) {
+            std::cerr << "Failed to configure path budget: " << e.what() << std::endl;
+            return EXIT_FAILURE;
+        }
+    }
+
+    if (argParseResult.count("split-by-year") || std::getenv("ET_SPLIT_BY_YEAR") != nullptr) {
+        try {
+            backupTask->setSplitByYear(true);
+        } catch (const etcpp::BackupException& e) {
+            std::cerr << "Failed to configure year split: " << e.what() << std::endl;
+            return EXIT_FAILURE;
+        }
+    }
+
+    std::string preset;
+    if (argParseResult.count("preset")) {
+        preset = argParseResult["preset"].as<std::string>();
+    } else if (const char* envValue = std::getenv("ET_PRESET"); envValue != nullptr) {
+        preset = envValue;
+    }
+
+    if (!preset.empty()) {
+        try {
+            backupTask->setFilterPreset(preset);
+        } catch (const etcpp::BackupException& e) {
+            std::cerr << "Failed to select filter preset: " << e.what() << std::endl;
+            return EXIT_FAILURE;
+        }
+    }
+
+    std::string after;
+    if (argParseResult.count("after")) {
+        after = argParseResult["after"].as<std::string>();
+    } else if (const char* envValue = std::getenv("ET_AFTER"); envValue != nullptr) {
+        after = envValue;
+    }
+
+    std::string before;
+    if (argParseResult.count("before")) {
+        before = argParseResult["before"].as<std::string>();
+    } else if (const char* envValue = std::getenv("ET_BEFORE"); envValue != nullptr) {
+        before = envValue;
+    }
+
+    if (!after.empty() || !before.empty()) {
+        try {
+            backupTask->setDateRange(after, before);
+        } catch (const etcpp::BackupException& e) {
+            std::cerr << "Failed to set date range: " << e.what() << std::endl;
+            return EXIT_FAILURE;
+        }
+    }
+
+    std::string alertWebhook;
+    if (argParseResult.count("alert-webhook")) {
+        alertWebhook = argParseResult["alert-webhook"].as<std::string>();
+    } else if (const char* envValue = std::getenv("ET_ALERT_WEBHOOK"); envValue != nullptr) {
+        alertWebhook = envValue;
+    }
+
+    std::string alertEmail;
+    if (argParseResult.count("alert-email")) {
+        alertEmail = argParseResult["alert-email"].as<std::string>();
+    } else if (const char* envValue = std::getenv("ET_ALERT_EMAIL"); envValue != nullptr) {
+        alertEmail = envValue;
+    }
+
+    int alertMaxDeleted = 1000;
+    if (argParseResult.count("alert-max-deleted")) {
+        alertMaxDeleted = argParseResult["alert-max-deleted"].as<int>();
+    } else if (const char* envValue = std::getenv("ET_ALERT_MAX_DELETED"); envValue != nullptr) {
+        try {
+            alertMaxDeleted = std::stoi(envValue);
+        } catch (const std::exception&) {
+            std::cerr << "Invalid value for ET_ALERT_MAX_DELETED: '" << envValue << "'" << std::endl;
+            return EXIT_FAILURE;
+        }
+    }
+
+    try {
+        backupTask->setSnapshotAlert(alertWebhook, alertEmail, alertMaxDeleted);
+    } catch (const etcpp::BackupException& e) {
+        std::cerr << "Failed to configure snapshot alert: " << e.what() << std::endl;
+        return EXIT_FAILURE;
+    }
+
+    int concurrency = 0;
+    if (argParseResult.count("concurrency")) {
+        concurrency = argParseResult["concurrency"].as<int>();
+    } else if (const char* envValue = std::getenv("ET_CONCURRENCY"); envValue != nullptr) {
+        try {
+            concurrency = std::stoi(envValue);
+        } catch (const std::exception&) {
+            std::cerr << "Invalid value for ET_CONCURRENCY: '" << envValue << "'" << std::endl;
+            return EXIT_FAILURE;
+        }
+    }
+
+    int buildConcurrency = 0;
+    if (argParseResult.count("build-concurrency")) {
+        buildConcurrency = argParseResult["build-concurrency"].as<int>();
+    } else if (const char* envValue = std::getenv("ET_BUILD_CONCURRENCY"); envValue != nullptr) {
+        try {
+            buildConcurrency = std::stoi(envValue);
+        } catch (const std::exception&) {
+            std::cerr << "Invalid value for ET_BUILD_CONCURRENCY: '" << envValue << "'" << std::endl;
+            return EXIT_FAILURE;
+        }
+    }
+
+    try {
+        backupTask->setConcurrency(concurrency);
+        backupTask->setBuildConcurrency(buildConcurrency);
+    } catch (const etcpp::BackupException& e) {
+        std::cerr << "Failed to configure export task: " << e.what() << std::endl;
+        return EXIT_FAILURE;
+    }
+
+    if (argParseResult.count("dry-run") || std::getenv("ET_DRY_RUN") != nullptr) {
+        try {
+            std::cout << backupTask->dryRun() << std::endl;
+        } catch (const etcpp::BackupException& e) {
+            std::cerr << "Failed to plan export: " << e.what() << std::endl;
+            return EXIT_FAILURE;
+        }
+
+        return EXIT_SUCCESS;
+    }
+
     uint64_t expectedSpace = 0;
     try {
         expectedSpace = backupTask->getExpectedDiskUsage();
@@ -600,6 +960,111 @@ int performRestore(etcpp::Session& session, cxxopts::ParseResult const& argParse
         return EXIT_FAILURE;
     }
 
+    const bool transactional = argParseResult["transactional"].as<bool>() || (std::getenv("ET_TRANSACTIONAL") != nullptr);
+    restoreTask->setTransactional(transactional);
+    const bool alwaysCreateLabels =
+        argParseResult["always-create-labels"].as<bool>() || (std::getenv("ET_ALWAYS_CREATE_LABELS") != nullptr);
+    restoreTask->setAlwaysCreateLabels(alwaysCreateLabels);
+    const bool noImportLabel = argParseResult["no-import-label"].as<bool>() || (std::getenv("ET_NO_IMPORT_LABEL") != nullptr);
+    restoreTask->setImportLabel(!noImportLabel);
+    const bool skipDuplicates = argParseResult["skip-duplicates"].as<bool>() || (std::getenv("ET_SKIP_DUPLICATES") != nullptr);
+    restoreTask->setSkipDuplicates(skipDuplicates);
+    restoreTask->setResume(argParseResult.count("resume") || (std::getenv("ET_RESUME") != nullptr));
+
+    std::string encryptionPassphrase;
+    std::string encryptionKey;
+    if (!getEncryptionOptions(argParseResult, encryptionPassphrase, encryptionKey)) {
+        return EXIT_FAILURE;
+    }
+
+    if (!encryptionPassphrase.empty() || !encryptionKey.empty()) {
+        try {
+            restoreTask->setEncryption(encryptionPassphrase, encryptionKey);
+        } catch (const etcpp::RestoreException& e) {
+            std::cerr << "Failed to configure encryption: " << e.what() << std::endl;
+            return EXIT_FAILURE;
+        }
+    }
+
+    int concurrency = 0;
+    if (argParseResult.count("concurrency")) {
+        concurrency = argParseResult["concurrency"].as<int>();
+    } else if (const char* envValue = std::getenv("ET_CONCURRENCY"); envValue != nullptr) {
+        try {
+            concurrency = std::stoi(envValue);
+        } catch (const std::exception&) {
+            std::cerr << "Invalid value for ET_CONCURRENCY: '" << envValue << "'" << std::endl;
+            return EXIT_FAILURE;
+        }
+    }
+
+    try {
+        restoreTask->setConcurrency(concurrency);
+    } catch (const etcpp::RestoreException& e) {
+        std::cerr << "Failed to configure restore task: " << e.what() << std::endl;
+        return EXIT_FAILURE;
+    }
+
+    double maxFailureRate = 0;
+    int failureWindow = 0;
+    double minThroughput = 0;
+    int throughputWindow = 0;
+    try {
+        if (argParseResult.count("max-failure-rate")) {
+            maxFailureRate = argParseResult["max-failure-rate"].as<double>();
+        } else if (const char* envValue = std::getenv("ET_MAX_FAILURE_RATE"); envValue != nullptr) {
+            maxFailureRate = std::stod(envValue);
+        }
+        if (argParseResult.count("failure-window")) {
+            failureWindow = argParseResult["failure-window"].as<int>();
+        } else if (const char* envValue = std::getenv("ET_FAILURE_WINDOW"); envValue != nullptr) {
+            failureWindow = std::stoi(envValue);
+        }
+        if (argParseResult.count("min-throughput")) {
+            minThroughput = argParseResult["min-throughput"].as<double>();
+        } else if (const char* envValue = std::getenv("ET_MIN_THROUGHPUT"); envValue != nullptr) {
+            minThroughput = std::stod(envValue);
+        }
+        if (argParseResult.count("throughput-window")) {
+            throughputWindow = argParseResult["throughput-window"].as<int>();
+        } else if (const char* envValue = std::getenv("ET_THROUGHPUT_WINDOW"); envValue != nullptr) {
+            throughputWindow = std::stoi(envValue);
+        }
+    } catch (const std::exception&) {
+        std::cerr << "Invalid restore guardrail value" << std::endl;
+        return EXIT_FAILURE;
+    }
+
+    try {
+        restoreTask->setGuardrails(maxFailureRate / 100, failureWindow, minThroughput, throughputWindow);
+    } catch (const etcpp::RestoreException& e) {
+        std::cerr << "Failed to configure restore guardrails: " << e.what() << std::endl;
+        return EXIT_FAILURE;
+    }
+
+    std::string after;
+    if (argParseResult.count("after")) {
+        after = argParseResult["after"].as<std::string>();
+    } else if (const char* envValue = std::getenv("ET_AFTER"); envValue != nullptr) {
+        after = envValue;
+    }
+
+    std::string before;
+    if (argParseResult.count("before")) {
+        before = argParseResult["before"].as<std::string>();
+    } else if (const char* envValue = std::getenv("ET_BEFORE"); envValue != nullptr) {
+        before = envValue;
+    }
+
+    if (!after.empty() || !before.empty()) {
+        try {
+            restoreTask->setDateRange(after, before);
+        } catch (const etcpp::RestoreException& e) {
+            std::cerr << "Failed to set date range: " << e.what() << std::endl;
+            return EXIT_FAILURE;
+        }
+    }
+
     std::cout << "Starting Restore - Path=" << restoreTask->getExportPath() << std::endl;
 
     try {
@@ -607,6 +1072,9 @@ int performRestore(etcpp::Session& session, cxxopts::ParseResult const& argParse
     } catch (const etcpp::RestoreException& e) {
         etcpp::logError("Failed to restore : {}", e.what());
         std::cerr << "Failed to restore: " << e.what() << std::endl;
+        if (restoreTask->wasRolledBack()) {
+            std::cerr << "All imported messages and created labels have been deleted." << std::endl;
+        }
         return EXIT_FAILURE;
     }
     std::cout << "Restore Finished" << std::endl;
@@ -655,15 +1123,178 @@ int main(int argc, const char** argv) {
         cxxopts::Options options("proton-mail-export-cli");
 
         options.add_options()("o,operation", "operation to perform, backup or restore (can also be set with env var ET_OPERATION)",
-                              cxxopts::value<std::string>())("d,dir", "Backup/restore directory (can also be set with env var ET_DIR)",
-                                                             cxxopts::value<std::string>())(
+                              cxxopts::value<std::string>())(
+            "d,dir", "Backup/restore directory, restore also accepts a zip, tar, tar.gz or tar.zst archive, possibly encrypted with gpg (can also be set with env var ET_DIR)",
+            cxxopts::value<std::string>())(
             "p,password", "User's password (can also be set with env var ET_USER_PASSWORD)", cxxopts::value<std::string>())(
             "m,mbox-password", "User's mailbox password when using 2 Password Mode (can also be set with env var ET_USER_MAILBOX_PASSWORD)",
             cxxopts::value<std::string>())("t,totp", "User's TOTP 2FA code (can also be set with env var ET_TOTP_CODE)",
                                            cxxopts::value<std::string>())(
             "u,user", "User's account/email (can also be set with env var ET_USER_EMAIL", cxxopts::value<std::string>())(
             "k, telemetry", "Disable anonymous telemetry statistics (can also be set with env var ET_TELEMETRY_OFF)", cxxopts::value<bool>())(
-            "h,help", "Show help");
+            "transactional",
+            "Restore only: delete all imported messages and created labels if the restore does not fully succeed (can also be set with env "
+            "var ET_TRANSACTIONAL)",
+            cxxopts::value<bool>())("always-create-labels",
+                                    "Restore only: create new labels and folders instead of reusing existing ones with the same name and "
+                                    "hierarchy (can also be set with env var ET_ALWAYS_CREATE_LABELS)",
+                                    cxxopts::value<bool>())(
+            "no-import-label",
+            "Restore only: place the messages in their original folders and labels only, without adding the 'Import' label (can also "
+            "be set with env var ET_NO_IMPORT_LABEL)",
+            cxxopts::value<bool>())(
+            "skip-duplicates",
+            "Restore only: skip the messages already in the account, matched by ID, Message-ID or content (can also be set with env var "
+            "ET_SKIP_DUPLICATES)",
+            cxxopts::value<bool>())(
+            "auto-generated",
+            "Backup only: 'include' newsletters and automatic notifications, 'exclude' them or write them to a 'separate' sub folder (can "
+            "also be set with env var ET_AUTO_GENERATED)",
+            cxxopts::value<std::string>())(
+            "format",
+            "Backup only: write the messages as 'eml' files, to 'mbox' files with one file per label and folder, to 'maildir' "
+            "folders, to 'pack' files or to a single 'zip' or 'tar.zst' archive. Mbox and Maildir backups cannot be restored "
+            "(can also be set with env var ET_FORMAT)",
+            cxxopts::value<std::string>())(
+            "incremental",
+            "Backup only: update the previous incremental backup, only downloading the new and the changed messages (can also be set "
+            "with env var ET_INCREMENTAL)")(
+            "tombstones",
+            "Backup only: record the messages deleted on the server since the previous incremental backup (can also be set with env "
+            "var ET_TOMBSTONES)")(
+            "resume",
+            "Backup and restore only: continue the most recent interrupted backup of the account from its checkpoint, with the same "
+            "options, or the interrupted restore of the backup (can also be set with env var ET_RESUME)")(
+            "mirror",
+            "Backup only: copy the finished backup to this folder as well and verify the copy, can be repeated (can also be set with "
+            "env var ET_MIRROR, comma separated)",
+            cxxopts::value<std::vector<std::string>>())(
+            "mirror-parallel",
+            "Backup only: write the mirrors at the same time instead of one after the other (can also be set with env var "
+            "ET_MIRROR_PARALLEL)")(
+            "encryption-passphrase",
+            "Backup and restore only: encrypt the message and metadata files of the backup on disk with this passphrase, or unlock the "
+            "private key of --encryption-key for the restore (can also be set with env var ET_ENCRYPTION_PASSPHRASE)",
+            cxxopts::value<std::string>())(
+            "encryption-key",
+            "Backup and restore only: armored OpenPGP key file, the backup files are encrypted to its public key and restored with its "
+            "private key (can also be set with env var ET_ENCRYPTION_KEY)",
+            cxxopts::value<std::string>())(
+            "path-budget",
+            "Backup only: shorten the file names so that the paths fit 'windows', 'onedrive', 'udf' or a number of bytes, the "
+            "shortened names are listed in path_truncations.json (can also be set with env var ET_PATH_BUDGET)",
+            cxxopts::value<std::string>())(
+            "split-by-year",
+            "Backup only: write the messages to one folder, or archive, per calendar year. Each year folder is restored "
+            "separately (can also be set with env var ET_SPLIT_BY_YEAR)")(
+            "preset",
+            "Backup only: export the messages selected by a filter preset, e.g. 'starred', 'last-90-days' or 'inbox-sent' (can also be "
+            "set with env var ET_PRESET)",
+            cxxopts::value<std::string>())(
+            "after",
+            "Backup and restore: export or restore only the messages received on or after this date, YYYY-MM-DD or RFC 3339 (can also "
+            "be set with env var ET_AFTER)",
+            cxxopts::value<std::string>())(
+            "before",
+            "Backup and restore: export or restore only the messages received before this date, YYYY-MM-DD or RFC 3339 (can also be "
+            "set with env var ET_BEFORE)",
+            cxxopts::value<std::string>())(
+            "filter-presets",
+            "Backup only: JSON file defining additional filter presets by name (can also be set with env var ET_FILTER_PRESETS)",
+            cxxopts::value<std::string>())(
+            "alert-webhook",
+            "Backup only: URL the changes since the previous backup are posted to when they look anomalous, e.g. a mass deletion (can "
+            "also be set with env var ET_ALERT_WEBHOOK)",
+            cxxopts::value<std::string>())(
+            "alert-email",
+            "Backup only: address the anomalous changes since the previous backup are emailed to, through the SMTP server set with "
+            "env vars ET_SMTP_SERVER (host:port), ET_SMTP_USER, ET_SMTP_PASSWORD and ET_SMTP_FROM (can also be set with env var "
+            "ET_ALERT_EMAIL)",
+            cxxopts::value<std::string>())(
+            "alert-max-deleted",
+            "Backup only: number of messages deleted since the previous backup above which the changes are anomalous (can also be set "
+            "with env var ET_ALERT_MAX_DELETED)",
+            cxxopts::value<int>())(
+            "dry-run",
+            "Backup only: print the JSON plan of the export, the messages and files it would create, without downloading them (can also "
+            "be set with env var ET_DRY_RUN)",
+            cxxopts::value<bool>())(
+            "concurrency",
+            "Backup and restore: number of parallel downloads or import batches, 0 selects a value suited to the plan of the account "
+            "(can also be set with env var ET_CONCURRENCY)",
+            cxxopts::value<int>())(
+            "max-failure-rate",
+            "Restore only: abort the restore when more than this percentage of the last --failure-window messages failed to import, "
+            "e.g. 20. 0 disables it (can also be set with env var ET_MAX_FAILURE_RATE)",
+            cxxopts::value<double>())(
+            "failure-window",
+            "Restore only: number of messages the failure rate of --max-failure-rate is measured over, 500 by default (can also be set "
+            "with env var ET_FAILURE_WINDOW)",
+            cxxopts::value<int>())(
+            "min-throughput",
+            "Restore only: abort the restore when fewer messages per minute than this were imported during the last "
+            "--throughput-window. 0 disables it (can also be set with env var ET_MIN_THROUGHPUT)",
+            cxxopts::value<double>())(
+            "throughput-window",
+            "Restore only: number of minutes the throughput of --min-throughput is measured over, 30 by default (can also be set with "
+            "env var ET_THROUGHPUT_WINDOW)",
+            cxxopts::value<int>())(
+            "build-concurrency",
+            "Backup only: number of messages decrypted and assembled in parallel, 0 selects the default (can also be set with env var "
+            "ET_BUILD_CONCURRENCY)",
+            cxxopts::value<int>())(
+            "audit-recipient-key",
+            "Armored OpenPGP public key the details of the audit log entries are encrypted to, e.g. a compliance officer's key (can also "
+            "be set with env var ET_AUDIT_RECIPIENT_KEY)",
+            cxxopts::value<std::string>())(
+            "confirm-scopes",
+            "Ask to accept the permissions granted to the session before completing the login (can also be set with env var "
+            "ET_CONFIRM_SCOPES)",
+            cxxopts::value<bool>())(
+            "local-passphrase",
+            "Passphrase encrypting the run history of the log folder. Setting it the first time protects the folder, the passphrase is "
+            "then required by every run (can also be set with env var ET_LOCAL_PASSPHRASE)",
+            cxxopts::value<std::string>())(
+            "hold",
+            "Hold mode: never modify the account nor delete a backup, restores are refused (can also be set with env var ET_HOLD)",
+            cxxopts::value<bool>())(
+            "hold-policy",
+            "JSON hold policy file enabling the hold mode. A hold_policy.json file in the log folder is always applied (can also be "
+            "set with env var ET_HOLD_POLICY)",
+            cxxopts::value<std::string>())(
+            "compensate-clock-skew",
+            "Validate the TLS certificates at the time of the Proton servers instead of the local time, when the clock of this computer "
+            "cannot be corrected. Clocks off by more than two days must be corrected (can also be set with env var ET_COMPENSATE_CLOCK_SKEW)",
+            cxxopts::value<bool>())(
+            "ip-version",
+            "IP versions used to connect to the Proton servers: auto (default, tries IPv6 and IPv4 in parallel), ipv4 or ipv6. Use ipv4 "
+            "on networks where the connections hang because of a broken IPv6 connectivity (can also be set with env var ET_IP_VERSION)",
+            cxxopts::value<std::string>())(
+            "api-url",
+            "Base URL of the Proton API, to test against another environment (can also be set with env var ET_API_URL)",
+            cxxopts::value<std::string>())(
+            "api-ca-cert",
+            "PEM file of certificate authorities trusted in addition to those of the system, for the test environments with their "
+            "own authority (can also be set with env var ET_API_CA_CERT)",
+            cxxopts::value<std::string>())(
+            "log-format",
+            "Format of the log file: text (default) or json, one object per line with stable field names for log aggregation tools and "
+            "scripts (can also be set with env var ET_LOG_FORMAT)",
+            cxxopts::value<std::string>())(
+            "log-max-size",
+            "Size in MB after which the log file is rotated, 0 disables the rotation. Defaults to 100 (can also be set with env var "
+            "ET_LOG_MAX_SIZE)",
+            cxxopts::value<int>())(
+            "log-max-files",
+            "Number of log files kept in the log folder, rotated ones and previous runs included. 0 keeps them all. Defaults to 20 (can "
+            "also be set with env var ET_LOG_MAX_FILES)",
+            cxxopts::value<int>())(
+            "log-compress", "Compress the rotated log files with gzip (can also be set with env var ET_LOG_COMPRESS)",
+            cxxopts::value<bool>())(
+            "privacy-logs",
+            "Redact the email addresses, subjects, label names and file paths from the log file, so that it can be attached to a support "
+            "ticket (can also be set with env var ET_PRIVACY_LOGS)",
+            cxxopts::value<bool>())("h,help", "Show help");
 
         auto argParseResult = options.parse(argc, argv);
 
@@ -689,9 +1320,107 @@ int main(int argc, const char** argv) {
             std::cout << "\nSession Log: " << *logPath << '\n' << std::endl;
         }
 
+        std::string auditRecipientKey;
+        if (argParseResult.count("audit-recipient-key")) {
+            auditRecipientKey = argParseResult["audit-recipient-key"].as<std::string>();
+        } else if (const char* envKey = std::getenv("ET_AUDIT_RECIPIENT_KEY"); envKey != nullptr) {
+            auditRecipientKey = envKey;
+        }
+
+        if (!auditRecipientKey.empty()) {
+            globalScope.setAuditRecipientKey(etcpp::expandCLIPath(std::filesystem::u8path(auditRecipientKey)));
+        }
+
+        std::string filterPresets;
+        if (argParseResult.count("filter-presets")) {
+            filterPresets = argParseResult["filter-presets"].as<std::string>();
+        } else if (const char* envPresets = std::getenv("ET_FILTER_PRESETS"); envPresets != nullptr) {
+            filterPresets = envPresets;
+        }
+
+        if (!filterPresets.empty()) {
+            globalScope.loadFilterPresets(etcpp::expandCLIPath(std::filesystem::u8path(filterPresets)));
+        }
+
+        std::string localPassphrase;
+        if (argParseResult.count("local-passphrase")) {
+            localPassphrase = argParseResult["local-passphrase"].as<std::string>();
+        } else if (const char* envPassphrase = std::getenv("ET_LOCAL_PASSPHRASE"); envPassphrase != nullptr) {
+            localPassphrase = envPassphrase;
+        } else if (globalScope.isLocalFilesProtected()) {
+            localPassphrase = readSecret("Passphrase of the local files");
+        }
+
+        if (!localPassphrase.empty()) {
+            globalScope.unlockLocalFiles(localPassphrase);
+        }
+
+        std::string holdPolicy;
+        if (argParseResult.count("hold-policy")) {
+            holdPolicy = argParseResult["hold-policy"].as<std::string>();
+        } else if (const char* envPolicy = std::getenv("ET_HOLD_POLICY"); envPolicy != nullptr) {
+            holdPolicy = envPolicy;
+        }
+
+        if (!holdPolicy.empty()) {
+            globalScope.loadHoldPolicy(etcpp::expandCLIPath(std::filesystem::u8path(holdPolicy)));
+        }
+
+        if (argParseResult["hold"].as<bool>() || (std::getenv("ET_HOLD") != nullptr)) {
+            globalScope.setHoldMode("");
+        }
+
+        if (argParseResult["compensate-clock-skew"].as<bool>() || (std::getenv("ET_COMPENSATE_CLOCK_SKEW") != nullptr)) {
+            globalScope.setClockSkewCompensation(true);
+        }
+
+        // ET_LOG_FORMAT and ET_PRIVACY_LOGS are already applied when the global scope is created.
+        if (argParseResult.count("log-format")) {
+            globalScope.setLogFormat(argParseResult["log-format"].as<std::string>());
+        }
+
+        if (argParseResult["privacy-logs"].as<bool>()) {
+            globalScope.enablePrivacyLogs();
+        }
+
+        if (argParseResult.count("log-max-size") || argParseResult.count("log-max-files") || argParseResult.count("log-compress")) {
+            std::optional<int> maxSizeMB;
+            std::optional<int> maxFiles;
+            std::optional<bool> compress;
+            if (argParseResult.count("log-max-size")) {
+                maxSizeMB = argParseResult["log-max-size"].as<int>();
+            }
+            if (argParseResult.count("log-max-files")) {
+                maxFiles = argParseResult["log-max-files"].as<int>();
+            }
+            if (argParseResult.count("log-compress")) {
+                compress = argParseResult["log-compress"].as<bool>();
+            }
+            globalScope.setLogRotation(maxSizeMB, maxFiles, compress);
+        }
+
+        if (argParseResult.count("ip-version")) {
+            globalScope.setIPPreference(argParseResult["ip-version"].as<std::string>());
+        } else if (const char* envIPVersion = std::getenv("ET_IP_VERSION"); envIPVersion != nullptr) {
+            globalScope.setIPPreference(envIPVersion);
+        }
+
+        if (argParseResult.count("api-ca-cert")) {
+            globalScope.setAPICACert(argParseResult["api-ca-cert"].as<std::string>());
+        } else if (const char* envCACert = std::getenv("ET_API_CA_CERT"); envCACert != nullptr) {
+            globalScope.setAPICACert(envCACert);
+        }
+
+        std::string apiURL = et::DEFAULT_API_URL;
+        if (argParseResult.count("api-url")) {
+            apiURL = argParseResult["api-url"].as<std::string>();
+        } else if (const char* envAPIURL = std::getenv("ET_API_URL"); envAPIURL != nullptr) {
+            apiURL = envAPIURL;
+        }
+
         bool telemetryDisabled = argParseResult["telemetry"].as<bool>() || (std::getenv("ET_TELEMETRY_OFF") != nullptr);
 
-        etcpp::Session session = etcpp::Session(et::DEFAULT_API_URL, telemetryDisabled, std::make_shared<SessionCallback>());
+        etcpp::Session session = etcpp::Session(apiURL.c_str(), telemetryDisabled, std::make_shared<SessionCallback>());
 
         // Unauth telemetry
         session.sendProcessStartTelemetry(argParseResult.count("operation") || (std::getenv("ET_OPERATION") != nullptr),
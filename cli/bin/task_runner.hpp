@@ -15,8 +15,10 @@
 // You should have received a copy of the GNU General Public License
 // along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
 
+#include <algorithm>
 #include <iostream>
 #include <sstream>
+#include <string>
 #include <string_view>
 
 #include "tasks/task.hpp"
@@ -65,7 +67,8 @@ R runTaskWithProgress(const TaskAppState& state, TaskWithProgress<R>& task) {
     auto future = std::async(std::launch::async, [&]() -> R { return task.run(); });
     auto spinner = CliSpinner();
     auto progressBar = CLIProgressBar();
-    const auto progressBarLen = progressBar.value().length();
+    // Length of the longest line printed so far, the shorter lines are padded to erase it.
+    size_t lineLen = std::max(progressBar.value().length(), kNetworkLostText.length());
     do {
         if (state.shouldQuit()) {
             task.cancel();
@@ -76,15 +79,25 @@ R runTaskWithProgress(const TaskAppState& state, TaskWithProgress<R>& task) {
                 continue;
             }
 
+            const int64_t rateLimitedSeconds = task.rateLimitedSeconds();
+
+            std::string line;
             if (state.networkLost()) {
-                std::cout << '\r' << spinner.next() << " " << kNetworkLostText << std::flush;
-                fillSpaces(kNetworkLostText.length(), progressBarLen);
-                std::cout << std::flush;
+                line = std::string(1, spinner.next()) + " " + std::string(kNetworkLostText);
+            } else if (rateLimitedSeconds > 0) {
+                line = std::string(1, spinner.next()) + " Rate limited by proton servers, waiting " + std::to_string(rateLimitedSeconds) +
+                       "s...";
             } else {
-                std::cout << '\r' << progressBar.value();
-                fillSpaces(progressBarLen, kNetworkLostText.length());
-                std::cout << std::flush;
+                line = std::string(progressBar.value());
+                if (const auto details = task.progressDetails(); !details.empty()) {
+                    line += " " + details;
+                }
             }
+
+            std::cout << '\r' << line;
+            fillSpaces(line.length(), lineLen);
+            std::cout << std::flush;
+            lineLen = std::max(lineLen, line.length());
         }
     } while (future.wait_for(std::chrono::milliseconds(0)) != std::future_status::ready);
     std::cout << "\n" << std::flush;
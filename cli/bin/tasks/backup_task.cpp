@@ -26,6 +26,14 @@ void BackupTask::onProgress(float progress) {
     updateProgress(progress);
 }
 
+void BackupTask::onRateLimited(int64_t waitSeconds) {
+    updateRateLimited(waitSeconds);
+}
+
+void BackupTask::onProgressEvent(const etcpp::ProgressEvent& event) {
+    updateDetails(formatProgressDetails(event.bytesPerSecond, event.etaSeconds));
+}
+
 void BackupTask::run() {
     mBackup.start(*this);
 }
@@ -46,6 +46,40 @@ public:
 
     inline uint64_t getExpectedDiskUsage() const { return mBackup.getExpectedDiskUsage(); }
 
+    inline void setAutoGeneratedMode(etcpp::AutoGeneratedMode mode) { mBackup.setAutoGeneratedMode(mode); }
+
+    inline void setOutputFormat(etcpp::OutputFormat format) { mBackup.setOutputFormat(format); }
+
+    inline void setIncremental(bool recordTombstones) { mBackup.setIncremental(recordTombstones); }
+
+    inline void setResume() { mBackup.setResume(); }
+
+    inline void addMirror(const std::filesystem::path& path) { mBackup.addMirror(path); }
+
+    inline void setMirrorParallel(bool parallel) { mBackup.setMirrorParallel(parallel); }
+
+    inline void setPathBudget(const std::string& budget) { mBackup.setPathBudget(budget); }
+
+    inline void setSplitByYear(bool enabled) { mBackup.setSplitByYear(enabled); }
+
+    inline void setEncryption(const std::string& passphrase, const std::string& armoredKey) {
+        mBackup.setEncryption(passphrase, armoredKey);
+    }
+
+    inline void setFilterPreset(const std::string& name) { mBackup.setFilterPreset(name); }
+    inline void setDateRange(const std::string& after, const std::string& before) { mBackup.setDateRange(after, before); }
+
+    inline void setSnapshotAlert(const std::string& webhookURL, const std::string& email, int maxDeleted) {
+        mBackup.setSnapshotAlert(webhookURL, email, maxDeleted);
+    }
+
+    inline void setConcurrency(int concurrency) { mBackup.setConcurrency(concurrency); }
+    inline void setBuildConcurrency(int concurrency) { mBackup.setBuildConcurrency(concurrency); }
+
+    inline std::string dryRun() const { return mBackup.dryRun(); }
+
 private:
     void onProgress(float progress) override;
+    void onRateLimited(int64_t waitSeconds) override;
+    void onProgressEvent(const etcpp::ProgressEvent& event) override;
 };
@@ -26,6 +26,14 @@ void RestoreTask::onProgress(float progress) {
     updateProgress(progress);
 }
 
+void RestoreTask::onRateLimited(int64_t waitSeconds) {
+    updateRateLimited(waitSeconds);
+}
+
+void RestoreTask::onProgressEvent(const etcpp::ProgressEvent& event) {
+    updateDetails(formatProgressDetails(event.bytesPerSecond, event.etaSeconds));
+}
+
 void RestoreTask::run() {
     mRestore.start(*this);
 }
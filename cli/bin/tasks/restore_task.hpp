@@ -47,7 +47,21 @@ public:
     uint64_t getImportedCount() const { return mRestore.getImportedCount(); }
     uint64_t getFailedCount() const { return mRestore.getFailedCount(); }
     uint64_t getSkippedCount() const { return mRestore.getSkippedCount(); }
+    void setTransactional(bool transactional) { mRestore.setTransactional(transactional); }
+    bool wasRolledBack() const { return mRestore.wasRolledBack(); }
+    void setAlwaysCreateLabels(bool alwaysCreate) { mRestore.setAlwaysCreateLabels(alwaysCreate); }
+    void setImportLabel(bool enabled) { mRestore.setImportLabel(enabled); }
+    void setSkipDuplicates(bool enabled) { mRestore.setSkipDuplicates(enabled); }
+    void setResume(bool enabled) { mRestore.setResume(enabled); }
+    void setEncryption(const std::string& passphrase, const std::string& armoredKey) { mRestore.setEncryption(passphrase, armoredKey); }
+    void setConcurrency(int concurrency) { mRestore.setConcurrency(concurrency); }
+    void setGuardrails(double maxFailureRate, int failureWindow, double minThroughput, int throughputWindowMinutes) {
+        mRestore.setGuardrails(maxFailureRate, failureWindow, minThroughput, throughputWindowMinutes);
+    }
+    void setDateRange(const std::string& after, const std::string& before) { mRestore.setDateRange(after, before); }
 
 private:
     void onProgress(float progress) override;
+    void onRateLimited(int64_t waitSeconds) override;
+    void onProgressEvent(const etcpp::ProgressEvent& event) override;
 };
@@ -17,10 +17,13 @@
 
 #pragma once
 
+#include <chrono>
 #include <condition_variable>
 #include <future>
 #include <mutex>
+#include <string>
 #include <thread>
+#include <utility>
 
 template<class R>
 class Task {
@@ -47,6 +50,8 @@ private:
     std::mutex mMutex;
     std::condition_variable mCond;
     float mProgress;
+    std::chrono::steady_clock::time_point mRateLimitedUntil;
+    std::string mDetails;
 
 protected:
     TaskWithProgress() = default;
@@ -60,12 +65,38 @@ public:
         return mProgress;
     }
 
+    /// Returns the number of seconds left before the servers accept the requests again, or 0 if the task is not rate limited.
+    int64_t rateLimitedSeconds() {
+        std::unique_lock lockScope(mMutex);
+        const auto remaining = std::chrono::ceil<std::chrono::seconds>(mRateLimitedUntil - std::chrono::steady_clock::now());
+        return remaining.count() > 0 ? remaining.count() : 0;
+    }
+
+    /// Returns the text displayed next to the progress bar, such as the remaining time.
+    std::string progressDetails() {
+        std::unique_lock lockScope(mMutex);
+        return mDetails;
+    }
+
 protected:
     void updateProgress(float progress) {
         std::unique_lock lockScope(mMutex);
         mProgress = progress;
         mCond.notify_one();
     }
+
+    void updateDetails(std::string details) {
+        std::unique_lock lockScope(mMutex);
+        mDetails = std::move(details);
+    }
+
+    void updateRateLimited(int64_t waitSeconds) {
+        std::unique_lock lockScope(mMutex);
+        const auto until = std::chrono::steady_clock::now() + std::chrono::seconds(waitSeconds);
+        if (until > mRateLimitedUntil) {
+            mRateLimitedUntil = until;
+        }
+    }
 };
 
 class TaskAppState {
@@ -21,6 +21,7 @@
 #include <cmath>
 #include <cstdio>
 #include <fmt/format.h>
+#include <iterator>
 
 #if !defined(_WIN32)
 #include <csignal>
@@ -112,6 +113,37 @@ char CliSpinner::next() {
     return kSpinStates[curIdx];
 }
 
+std::string formatProgressDetails(double bytesPerSecond, int64_t etaSeconds) {
+    std::string result;
+
+    if (bytesPerSecond >= 1.0) {
+        constexpr const char* kUnits[] = {"B/s", "KB/s", "MB/s", "GB/s"};
+        size_t unit = 0;
+        while (bytesPerSecond >= 1024.0 && unit + 1 < std::size(kUnits)) {
+            bytesPerSecond /= 1024.0;
+            unit++;
+        }
+
+        fmt::format_to(std::back_inserter(result), "{:.1f} {}", bytesPerSecond, kUnits[unit]);
+    }
+
+    if (etaSeconds >= 0) {
+        if (!result.empty()) {
+            result += ", ";
+        }
+
+        if (etaSeconds >= 3600) {
+            fmt::format_to(std::back_inserter(result), "ETA {}h{:02}m", etaSeconds / 3600, (etaSeconds % 3600) / 60);
+        } else if (etaSeconds >= 60) {
+            fmt::format_to(std::back_inserter(result), "ETA {}m{:02}s", etaSeconds / 60, etaSeconds % 60);
+        } else {
+            fmt::format_to(std::back_inserter(result), "ETA {}s", etaSeconds);
+        }
+    }
+
+    return result;
+}
+
 CLIProgressBar::CLIProgressBar() {
     update(0);
 }
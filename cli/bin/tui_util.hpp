@@ -17,6 +17,7 @@
 
 #pragma once
 
+#include <cstdint>
 #include <functional>
 #include <string>
 
@@ -39,6 +40,9 @@ public:
     char next();
 };
 
+/// Formats the transfer rate and the remaining time displayed next to the progress bar. A negative etaSeconds is unknown.
+std::string formatProgressDetails(double bytesPerSecond, int64_t etaSeconds);
+
 class CLIProgressBar {
 private:
     int mActiveBars = -1;
@@ -19,6 +19,7 @@
 #define ET_BACKUP_H
 
 #include "etsession.h"
+#include <stdint.h>
 
 typedef struct etBackup etBackup;
 
@@ -36,6 +37,9 @@ typedef enum etBackupMessageType {
 typedef struct etBackupCallbacks {
     void* ptr;
     void (*onProgress)(void* ptr, float progress);
+    void (*onHeartbeat)(void* ptr, cchar_t* stage, int64_t timestampMs, int64_t lastProgressMs);
+    void (*onRateLimited)(void* ptr, int64_t waitSeconds);
+    void (*onProgressEvent)(void* ptr, const etProgressEvent* event);
 } etBackupCallbacks;
 
 #endif // ET_BACKUP_H
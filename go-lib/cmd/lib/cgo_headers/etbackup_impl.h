@@ -26,6 +26,24 @@ inline void etBackupCallbackOnProgress(etBackupCallbacks* cb, float progress) {
     cb->onProgress(cb->ptr, progress);
 }
 
+inline void etBackupCallbackOnHeartbeat(etBackupCallbacks* cb, cchar_t* stage, int64_t timestampMs, int64_t lastProgressMs) {
+    if (cb->onHeartbeat != NULL) {
+        cb->onHeartbeat(cb->ptr, stage, timestampMs, lastProgressMs);
+    }
+}
+
+inline void etBackupCallbackOnRateLimited(etBackupCallbacks* cb, int64_t waitSeconds) {
+    if (cb->onRateLimited != NULL) {
+        cb->onRateLimited(cb->ptr, waitSeconds);
+    }
+}
+
+inline void etBackupCallbackOnProgressEvent(etBackupCallbacks* cb, const etProgressEvent* event) {
+    if (cb->onProgressEvent != NULL) {
+        cb->onProgressEvent(cb->ptr, event);
+    }
+}
+
 #endif // ET_CGO
 
 #endif // ET_BACKUP_IMPL_H
@@ -37,6 +37,10 @@ typedef enum etRestoreMessageType {
 typedef struct etRestoreCallbacks {
     void* ptr;
     void (*onProgress)(void* ptr, float progress);
+    void (*onETA)(void* ptr, int64_t remainingSeconds);
+    void (*onHeartbeat)(void* ptr, cchar_t* stage, int64_t timestampMs, int64_t lastProgressMs);
+    void (*onRateLimited)(void* ptr, int64_t waitSeconds);
+    void (*onProgressEvent)(void* ptr, const etProgressEvent* event);
 } etRestoreCallbacks;
 
 #endif // ET_RESTORE_H
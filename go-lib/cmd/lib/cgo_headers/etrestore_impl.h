@@ -26,6 +26,30 @@ inline void etRestoreCallbackOnProgress(etRestoreCallbacks* cb, float progress)
     cb->onProgress(cb->ptr, progress);
 }
 
+inline void etRestoreCallbackOnETA(etRestoreCallbacks* cb, int64_t remainingSeconds) {
+    if (cb->onETA != NULL) {
+        cb->onETA(cb->ptr, remainingSeconds);
+    }
+}
+
+inline void etRestoreCallbackOnHeartbeat(etRestoreCallbacks* cb, cchar_t* stage, int64_t timestampMs, int64_t lastProgressMs) {
+    if (cb->onHeartbeat != NULL) {
+        cb->onHeartbeat(cb->ptr, stage, timestampMs, lastProgressMs);
+    }
+}
+
+inline void etRestoreCallbackOnRateLimited(etRestoreCallbacks* cb, int64_t waitSeconds) {
+    if (cb->onRateLimited != NULL) {
+        cb->onRateLimited(cb->ptr, waitSeconds);
+    }
+}
+
+inline void etRestoreCallbackOnProgressEvent(etRestoreCallbacks* cb, const etProgressEvent* event) {
+    if (cb->onProgressEvent != NULL) {
+        cb->onProgressEvent(cb->ptr, event);
+    }
+}
+
 #endif // ET_CGO
 
 #endif // ET_RESTORE_IMPL_H
@@ -38,12 +38,33 @@ typedef enum etSessionLoginState {
 	ET_SESSION_LOGIN_STATE_AWAITING_HV,
 	ET_SESSION_LOGIN_STATE_AWAITING_MAILBOX_PASSWORD,
 	ET_SESSION_LOGIN_STATE_LOGGED_IN,
+	ET_SESSION_LOGIN_STATE_AWAITING_FIDO2,
 } etSessionLoginState;
 
+typedef enum etCancelCause {
+	ET_CANCEL_CAUSE_NONE,
+	ET_CANCEL_CAUSE_USER,
+	ET_CANCEL_CAUSE_DEADLINE,
+	ET_CANCEL_CAUSE_FATAL,
+	ET_CANCEL_CAUSE_PARENT,
+} etCancelCause;
+
+typedef struct etProgressEvent {
+    cchar_t* stage;
+    uint64_t processedMessageCount;
+    uint64_t totalMessageCount; // 0 while unknown.
+    uint64_t transferredBytes;  // Downloaded by backups, uploaded by restores.
+    double bytesPerSecond;
+    double messagesPerSecond;
+    int64_t etaSeconds; // -1 while unknown.
+    int64_t timestampMs;
+} etProgressEvent;
+
 typedef struct etSessionCallbacks {
     void *ptr;
     void (*onNetworkLost)(void*);
     void (*onNetworkRestored)(void*);
+    void (*onClockSkew)(void*, int64_t skewSeconds);
 } etSessionCallbacks;
 
 #endif // ET_SESSION_H
\ No newline at end of file
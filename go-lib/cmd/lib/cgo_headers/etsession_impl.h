@@ -34,6 +34,12 @@ inline void etSessionCallbackOnNetworkRestored(etSessionCallbacks* cb) {
     }
 }
 
+inline void etSessionCallbackOnClockSkew(etSessionCallbacks* cb, int64_t skewSeconds) {
+    if (cb->onClockSkew != NULL){
+        cb->onClockSkew(cb->ptr, skewSeconds);
+    }
+}
+
 #endif // ET_CGO
 
 #endif //ET_SESSION_IMPL_H
@@ -25,7 +25,9 @@ package main
 import "C"
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"path/filepath"
 	"runtime/cgo"
 	"sync/atomic"
@@ -33,6 +35,9 @@ import (
 	"unsafe"
 
 	"github.com/ProtonMail/export-tool/internal"
+	"github.com/ProtonMail/export-tool/internal/alert"
+	"github.com/ProtonMail/export-tool/internal/audit"
+	"github.com/ProtonMail/export-tool/internal/history"
 	"github.com/ProtonMail/export-tool/internal/mail"
 	"github.com/ProtonMail/export-tool/internal/session"
 	"github.com/ProtonMail/export-tool/internal/utils"
@@ -103,10 +108,38 @@ func etBackupStart(ptr *C.etBackup, callbacks *C.etBackupCallbacks) C.etBackupSt
 		callbacks: callbacks,
 	}
 
+	ce.exporter.SetChecksumRecipient(etGlobalState.audit.GetRecipient())
+
+	user := ce.csession.s.GetUser()
+	params := audit.BackupParameters(ce.exporter)
+	if err := audit.Record(etGlobalState.audit, audit.NewEntry(audit.EventBackupStarted, user, ce.exporter.GetExportPath(), params)); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
 	ce.csession.s.GetTelemetryService().SendExportStart()
 	startTime := time.Now()
 
-	err := ce.exporter.Run(ce.csession.ctx, reporter)
+	result, err := ce.exporter.Run(ce.csession.ctx, reporter)
+	ce.lastResult = result
+
+	counts := map[string]uint64{
+		"total":       result.TotalMessageCount,
+		"exported":    result.ExportedMessageCount,
+		"excluded":    result.ExcludedMessageCount,
+		"filtered":    result.FilteredMessageCount,
+		"quarantined": uint64(len(result.Quarantined)),
+	}
+
+	entry := audit.NewEntry(audit.EventBackupFinished, user, ce.exporter.GetExportPath(), params)
+	entry.Counts = counts
+	entry.SetOutcome(err)
+	_ = audit.Record(etGlobalState.audit, entry)
+
+	run := history.NewRun(history.OperationBackup, user, ce.exporter.GetExportPath(), params, startTime)
+	run.Finish(counts, err)
+	run.Mailbox = result.MailboxStats
+	recordHistory(run)
 
 	totalMessageCount := reporter.GetTotalMessageCount()
 	processedMessageCount := reporter.GetCurrentMessageCount()
@@ -133,6 +166,348 @@ func etBackupStart(ptr *C.etBackup, callbacks *C.etBackupCallbacks) C.etBackupSt
 	return C.ET_BACKUP_STATUS_OK
 }
 
+//export etBackupSetFilter
+func etBackupSetFilter(ptr *C.etBackup, cFilterJSON *C.cchar_t) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	filter, err := mail.NewFilterFromJSON([]byte(C.GoString(cFilterJSON)))
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	if err := ce.exporter.SetFilter(filter); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupSetFilterPreset
+func etBackupSetFilterPreset(ptr *C.etBackup, cName *C.cchar_t) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	etGlobalState.mutex.Lock()
+	filter, err := getFilterPresets().Get(C.GoString(cName), time.Now())
+	etGlobalState.mutex.Unlock()
+
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	if current := ce.exporter.GetFilter(); current != nil {
+		filter = filter.Merge(*current)
+	}
+
+	if err := ce.exporter.SetFilter(filter); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupSetDateRange
+func etBackupSetDateRange(ptr *C.etBackup, cAfter *C.cchar_t, cBefore *C.cchar_t) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	dateRange, err := newDateRangeFilter(C.GoString(cAfter), C.GoString(cBefore))
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	filter := dateRange
+	if current := ce.exporter.GetFilter(); current != nil {
+		filter = current.Merge(dateRange)
+	}
+
+	if err := ce.exporter.SetFilter(filter); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+// newDateRangeFilter returns the filter selecting the messages received in [after, before). Empty dates are not set.
+func newDateRangeFilter(after, before string) (mail.Filter, error) {
+	var dateRange mail.Filter
+
+	for _, bound := range []struct {
+		date  string
+		value *time.Time
+	}{
+		{after, &dateRange.After},
+		{before, &dateRange.Before},
+	} {
+		if len(bound.date) == 0 {
+			continue
+		}
+
+		t, err := mail.ParseFilterDate(bound.date)
+		if err != nil {
+			return mail.Filter{}, err
+		}
+
+		*bound.value = t
+	}
+
+	return dateRange, nil
+}
+
+//export etBackupSetAutoGeneratedMode
+func etBackupSetAutoGeneratedMode(ptr *C.etBackup, mode C.int) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	switch m := mail.AutoGeneratedMode(mode); m {
+	case mail.AutoGeneratedModeInclude, mail.AutoGeneratedModeExclude, mail.AutoGeneratedModeSeparate:
+		ce.exporter.SetAutoGeneratedMode(m)
+	default:
+		ce.lastError.Set(fmt.Errorf("invalid auto-generated mail mode %v", mode))
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupSetSnapshotAlert
+func etBackupSetSnapshotAlert(ptr *C.etBackup, cWebhookURL *C.cchar_t, cEmail *C.cchar_t, maxDeleted C.int) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	thresholds := mail.DefaultSnapshotThresholds()
+	thresholds.MaxDeleted = int(maxDeleted)
+
+	notifier, err := alert.NewNotifier(C.GoString(cWebhookURL), C.GoString(cEmail))
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	var alertFn mail.SnapshotAlertFunc
+
+	if notifier != nil {
+		alertFn = func(ctx context.Context, diff mail.SnapshotDiff) error {
+			return notifier.Notify(ctx, diff.GetAlertSubject(), diff)
+		}
+	}
+
+	ce.exporter.SetSnapshotAlert(thresholds, alertFn)
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupSetConcurrency
+func etBackupSetConcurrency(ptr *C.etBackup, concurrency C.int) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	if err := ce.exporter.SetConcurrency(int(concurrency)); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupSetBuildConcurrency
+func etBackupSetBuildConcurrency(ptr *C.etBackup, concurrency C.int) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	if err := ce.exporter.SetBuildConcurrency(int(concurrency)); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupSetOutputFormat
+func etBackupSetOutputFormat(ptr *C.etBackup, format C.int) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	switch f := mail.OutputFormat(format); f {
+	case mail.OutputFormatEML, mail.OutputFormatMBox, mail.OutputFormatMaildir, mail.OutputFormatPack,
+		mail.OutputFormatZip, mail.OutputFormatTarZst:
+		ce.exporter.SetOutputFormat(f)
+	default:
+		ce.lastError.Set(fmt.Errorf("invalid output format %v", format))
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupSetIncremental
+func etBackupSetIncremental(ptr *C.etBackup, recordTombstones C.int) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	if err := ce.exporter.SetIncremental(true, recordTombstones != 0); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupSetResume
+func etBackupSetResume(ptr *C.etBackup) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	if err := ce.exporter.SetResume(true); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupAddMirror
+func etBackupAddMirror(ptr *C.etBackup, cPath *C.cchar_t) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	if err := ce.exporter.AddMirror(C.GoString(cPath)); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupSetMirrorParallel
+func etBackupSetMirrorParallel(ptr *C.etBackup, parallel C.int) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	ce.exporter.SetMirrorParallel(parallel != 0)
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupSetSplitByYear
+func etBackupSetSplitByYear(ptr *C.etBackup, enabled C.int) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	ce.exporter.SetSplitByYear(enabled != 0)
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupSetPathBudget
+func etBackupSetPathBudget(ptr *C.etBackup, cBudget *C.cchar_t) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	budget, err := mail.PathBudgetFromString(C.GoString(cBudget))
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	ce.exporter.SetPathBudget(budget)
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupSetEncryption
+func etBackupSetEncryption(ptr *C.etBackup, cPassphrase *C.cchar_t, cArmoredKey *C.cchar_t) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	key, err := newAtRestKey(C.GoString(cPassphrase), C.GoString(cArmoredKey))
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	ce.exporter.SetAtRestEncryption(key)
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+// newAtRestKey returns the key encrypting the backup files on disk. The armored key is used when set, its private key
+// being unlocked with the passphrase if needed.
+func newAtRestKey(passphrase, armoredKey string) (*mail.AtRestKey, error) {
+	if len(armoredKey) == 0 {
+		return mail.NewAtRestPassphrase([]byte(passphrase))
+	}
+
+	return mail.NewAtRestKeyFromArmored(armoredKey, []byte(passphrase))
+}
+
 //export etBackupCancel
 func etBackupCancel(ptr *C.etBackup) C.etBackupStatus {
 	ce, ok := resolveBackup(ptr)
@@ -142,7 +517,24 @@ func etBackupCancel(ptr *C.etBackup) C.etBackupStatus {
 
 	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
 
-	ce.exporter.Cancel()
+	ce.exporter.Cancel(context.Background(), mail.CancelModeImmediate)
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupCancelWithMode
+func etBackupCancelWithMode(ptr *C.etBackup, mode C.int, gracePeriodMs C.uint64_t) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	if err := cancelWithMode(ce.exporter.Cancel, mode, gracePeriodMs); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
 
 	return C.ET_BACKUP_STATUS_OK
 }
@@ -177,6 +569,67 @@ func etBackupGetRequiredDiskSpaceEstimate(ptr *C.etBackup, outSpace *C.uint64_t)
 	return C.ET_BACKUP_STATUS_OK
 }
 
+//export etBackupPredictFilter
+func etBackupPredictFilter(ptr *C.etBackup, cFilterJSON *C.cchar_t, outCount *C.uint64_t, outBytes *C.uint64_t) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	filter, err := mail.NewFilterFromJSON([]byte(C.GoString(cFilterJSON)))
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	prediction, err := ce.exporter.PredictFilter(ce.csession.ctx, filter)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return C.ET_BACKUP_STATUS_CANCELLED
+		}
+
+		ce.lastError.Set(internal.MapError(err))
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	*outCount = C.uint64_t(prediction.MessageCount)
+	*outBytes = C.uint64_t(prediction.EstimatedBytes)
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupDryRun
+func etBackupDryRun(ptr *C.etBackup, outJSON **C.char) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	plan, err := ce.exporter.DryRun(ce.csession.ctx)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return C.ET_BACKUP_STATUS_CANCELLED
+		}
+
+		ce.lastError.Set(internal.MapError(err))
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	data, err := json.Marshal(plan)
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	*outJSON = C.CString(string(data))
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
 //export etBackupGetExportPath
 func etBackupGetExportPath(ptr *C.etBackup, outPath **C.char) C.etBackupStatus {
 	ce, ok := resolveBackup(ptr)
@@ -191,10 +644,45 @@ func etBackupGetExportPath(ptr *C.etBackup, outPath **C.char) C.etBackupStatus {
 	return C.ET_BACKUP_STATUS_OK
 }
 
+//export etBackupGetResult
+func etBackupGetResult(ptr *C.etBackup, outJSON **C.char) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	data, err := json.Marshal(ce.lastResult)
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_BACKUP_STATUS_ERROR
+	}
+
+	*outJSON = C.CString(string(data))
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
+//export etBackupGetCancelCause
+func etBackupGetCancelCause(ptr *C.etBackup, outCause *C.etCancelCause) C.etBackupStatus {
+	ce, ok := resolveBackup(ptr)
+	if !ok {
+		return C.ET_BACKUP_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	*outCause = mapCancelCause(ce.exporter.GetCancelCause())
+
+	return C.ET_BACKUP_STATUS_OK
+}
+
 type cBackup struct {
-	csession  *csession
-	exporter  *mail.ExportTask
-	lastError utils.CLastError
+	csession   *csession
+	exporter   *mail.ExportTask
+	lastError  utils.CLastError
+	lastResult mail.ExportResult
 }
 
 type BackupHandle struct {
@@ -244,6 +732,24 @@ func (m *backupReporter) OnProgress(delta int) {
 	C.etBackupCallbackOnProgress(m.callbacks, C.float(progress))
 }
 
+func (m *backupReporter) OnHeartbeat(heartbeat mail.Heartbeat) {
+	cStage := C.CString(heartbeat.Stage)
+	defer C.free(unsafe.Pointer(cStage))
+
+	C.etBackupCallbackOnHeartbeat(m.callbacks, cStage, C.int64_t(heartbeat.Time.UnixMilli()), C.int64_t(heartbeat.LastProgressTime.UnixMilli()))
+}
+
+func (m *backupReporter) OnRateLimited(wait time.Duration) {
+	C.etBackupCallbackOnRateLimited(m.callbacks, C.int64_t(wait.Seconds()))
+}
+
+func (m *backupReporter) OnProgressEvent(event mail.ProgressEvent) {
+	cEvent := newCProgressEvent(event)
+	defer C.free(unsafe.Pointer(cEvent.stage))
+
+	C.etBackupCallbackOnProgressEvent(m.callbacks, &cEvent)
+}
+
 func (m *backupReporter) GetTotalMessageCount() uint64 {
 	return m.totalMessageCount.Load()
 }
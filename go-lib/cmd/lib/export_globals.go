@@ -24,15 +24,24 @@ package main
 */
 import "C"
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
 	"unsafe"
 
 	"github.com/ProtonMail/export-tool/internal"
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/export-tool/internal/audit"
+	"github.com/ProtonMail/export-tool/internal/history"
+	"github.com/ProtonMail/export-tool/internal/hold"
+	"github.com/ProtonMail/export-tool/internal/keychain"
+	"github.com/ProtonMail/export-tool/internal/mail"
 	"github.com/ProtonMail/export-tool/internal/reporter"
 	"github.com/ProtonMail/export-tool/internal/sentry"
 	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/export-tool/internal/vault"
 	"github.com/sirupsen/logrus"
 )
 
@@ -57,19 +66,54 @@ func etInit(filePath *C.cchar_t, onRecover C.etOnRecoverFn) C.int {
 		return -1
 	}
 
-	path = filepath.Join(path, internal.NewLogFileName())
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	auditLog, err := audit.Open(path)
 	if err != nil {
 		etGlobalState.lastError.Set(err)
 		return -1
 	}
 
-	etGlobalState.clogPath = C.CString(path)
+	// Without a keychain, the signing key is kept in the vault once the local files are unlocked.
+	if keys, err := keychain.New(); err == nil {
+		if err := auditLog.SetKeyStore(keys); err != nil {
+			logrus.WithError(err).Error("Failed to load audit key from the keychain")
+		}
+	}
+
+	etGlobalState.audit = auditLog
+
+	historyStore, err := history.Open(path)
+	if err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
 
-	logrus.SetOutput(file)
-	logrus.SetFormatter(internal.NewLogFormatter())
+	etGlobalState.history = historyStore
+
+	holdPolicy, err := hold.FindPolicy(path)
+	if err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	etGlobalState.hold = holdPolicy
+
+	logFile, err := internal.OpenLogFile(path, internal.GetLogRotationFromEnv())
+	if err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	etGlobalState.file = logFile
+	etGlobalState.clogPath = C.CString(logFile.Path())
+
+	logrus.SetOutput(logFile)
+	logrus.SetFormatter(internal.NewLogFormatter(internal.GetLogFormatFromEnv()))
 	internal.LogPrelude()
 
+	if internal.IsPrivacyLogsEnabledInEnv() {
+		internal.EnableLogRedaction()
+	}
+
 	if onRecover != nil {
 		etGlobalState.onRecoverCB = func() {
 			C.etCallOnRecover(onRecover)
@@ -85,6 +129,294 @@ func etInit(filePath *C.cchar_t, onRecover C.etOnRecoverFn) C.int {
 	return 0
 }
 
+//export etSetAuditRecipientKey
+func etSetAuditRecipientKey(keyPath *C.cchar_t) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	if etGlobalState.audit == nil {
+		return -1
+	}
+
+	recipient, err := audit.LoadRecipientKey(C.GoString(keyPath))
+	if err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	etGlobalState.audit.SetRecipient(recipient)
+
+	return 0
+}
+
+//export etSetHoldMode
+func etSetHoldMode(cReason *C.cchar_t) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	etGlobalState.hold = etGlobalState.hold.Merge(hold.Policy{Enabled: true, Reason: C.GoString(cReason)})
+
+	return 0
+}
+
+//export etLoadHoldPolicy
+func etLoadHoldPolicy(policyPath *C.cchar_t) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	policy, err := hold.LoadPolicy(C.GoString(policyPath))
+	if err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	etGlobalState.hold = etGlobalState.hold.Merge(policy)
+
+	return 0
+}
+
+//export etSetClockSkewCompensation
+func etSetClockSkewCompensation(enabled C.int) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	etGlobalState.connection.CompensateClockSkew = enabled != 0
+
+	return 0
+}
+
+//export etSetLogFormat
+func etSetLogFormat(cFormat *C.cchar_t) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	format, err := internal.LogFormatFromString(C.GoString(cFormat))
+	if err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	internal.SetLogFormat(format)
+
+	return 0
+}
+
+//export etEnablePrivacyLogs
+func etEnablePrivacyLogs() {
+	internal.EnableLogRedaction()
+}
+
+//export etSetLogRotation
+func etSetLogRotation(maxSizeMB C.int, maxFiles C.int, compress C.int) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	if etGlobalState.file == nil {
+		return -1
+	}
+
+	// Negative values keep the current setting, which comes from the env vars.
+	rotation := etGlobalState.file.Rotation()
+	if maxSizeMB >= 0 {
+		rotation.MaxSizeMB = int(maxSizeMB)
+	}
+
+	if maxFiles >= 0 {
+		rotation.MaxFiles = int(maxFiles)
+	}
+
+	if compress >= 0 {
+		rotation.Compress = compress != 0
+	}
+
+	if err := etGlobalState.file.SetRotation(rotation); err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	return 0
+}
+
+//export etSetIPPreference
+func etSetIPPreference(cPreference *C.cchar_t) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	preference, err := apiclient.IPPreferenceFromString(C.GoString(cPreference))
+	if err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	etGlobalState.connection.IPPreference = preference
+
+	return 0
+}
+
+//export etSetProxy
+func etSetProxy(cProxy *C.cchar_t) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	proxy := C.GoString(cProxy)
+	if _, err := apiclient.ParseProxy(proxy); err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	etGlobalState.connection.Proxy = proxy
+
+	return 0
+}
+
+//export etSetAlternativeRouting
+func etSetAlternativeRouting(enabled C.int) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	etGlobalState.connection.DisableAlternativeRouting = enabled == 0
+
+	return 0
+}
+
+//export etSetAPICACert
+func etSetAPICACert(cPath *C.cchar_t) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	etGlobalState.connection.CACertFile = C.GoString(cPath)
+
+	return 0
+}
+
+//export etLocalFilesProtected
+func etLocalFilesProtected(outProtected *C.int) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	if etGlobalState.history == nil {
+		return -1
+	}
+
+	protected, err := vault.IsProtected(filepath.Dir(etGlobalState.history.GetPath()))
+	if err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	*outProtected = 0
+	if protected {
+		*outProtected = 1
+	}
+
+	return 0
+}
+
+//export etUnlockLocalFiles
+func etUnlockLocalFiles(cPassphrase *C.cchar_t) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	if etGlobalState.history == nil {
+		return -1
+	}
+
+	v, err := vault.Open(filepath.Dir(etGlobalState.history.GetPath()), []byte(C.GoString(cPassphrase)))
+	if err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	etGlobalState.history.SetVault(v)
+
+	if etGlobalState.audit != nil && !etGlobalState.audit.HasKey() {
+		keys := vault.NewSecretStore(filepath.Dir(etGlobalState.audit.GetPath()), v)
+		if err := etGlobalState.audit.SetKeyStore(keys); err != nil {
+			etGlobalState.lastError.Set(err)
+			return -1
+		}
+	}
+
+	return 0
+}
+
+//export etHistoryQuery
+func etHistoryQuery(cQueryJSON *C.cchar_t, outJSON **C.char) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	if etGlobalState.history == nil {
+		return -1
+	}
+
+	var query history.Query
+	if queryJSON := C.GoString(cQueryJSON); len(queryJSON) != 0 {
+		if err := json.Unmarshal([]byte(queryJSON), &query); err != nil {
+			etGlobalState.lastError.Set(fmt.Errorf("failed to parse history query: %w", err))
+			return -1
+		}
+	}
+
+	runs, err := etGlobalState.history.Query(query)
+	if err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	if runs == nil {
+		runs = []history.Run{}
+	}
+
+	data, err := json.Marshal(runs)
+	if err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	*outJSON = C.CString(string(data))
+
+	return 0
+}
+
+//export etHistoryAnalyzeGrowth
+func etHistoryAnalyzeGrowth(cAccount *C.cchar_t, outJSON **C.char) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	if etGlobalState.history == nil {
+		return -1
+	}
+
+	report, err := etGlobalState.history.AnalyzeGrowth(C.GoString(cAccount))
+	if err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	*outJSON = C.CString(string(data))
+
+	return 0
+}
+
+//export etLoadFilterPresets
+func etLoadFilterPresets(presetsPath *C.cchar_t) C.int {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	if err := getFilterPresets().RegisterFromFile(C.GoString(presetsPath)); err != nil {
+		etGlobalState.lastError.Set(err)
+		return -1
+	}
+
+	return 0
+}
+
 //export etGetLastError
 func etGetLastError() *C.cchar_t {
 	etGlobalState.mutex.Lock()
@@ -147,13 +479,54 @@ func etClose() {
 
 type globalState struct {
 	mutex       sync.Mutex
-	file        *os.File
+	file        *internal.LogFile
 	lastError   utils.CLastError
 	clogPath    *C.char
+	audit       *audit.Log
+	history     *history.Store
+	presets     *mail.FilterPresets
+	hold        hold.Policy
+	connection  apiclient.ConnectionOptions
 	onRecoverCB func()
 	reporter    reporter.Reporter
 }
 
+// recordHistory appends a finished operation to the run history. Failing to record it is only logged.
+func recordHistory(run history.Run) {
+	if etGlobalState.history == nil {
+		return
+	}
+
+	if err := etGlobalState.history.Append(run); err != nil {
+		logrus.WithError(err).WithField("operation", run.Operation).Error("Failed to write history")
+	}
+}
+
+// getFilterPresets returns the built-in and registered filter presets. The global state must be locked.
+func getFilterPresets() *mail.FilterPresets {
+	if etGlobalState.presets == nil {
+		etGlobalState.presets = mail.NewFilterPresets()
+	}
+
+	return etGlobalState.presets
+}
+
+// getHoldPolicy returns the hold policy sessions are created with.
+func getHoldPolicy() hold.Policy {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	return etGlobalState.hold
+}
+
+// getConnectionOptions returns how the sessions connect to the API servers.
+func getConnectionOptions() apiclient.ConnectionOptions {
+	etGlobalState.mutex.Lock()
+	defer etGlobalState.mutex.Unlock()
+
+	return etGlobalState.connection
+}
+
 func GetGlobalReporter() reporter.Reporter {
 	return etGlobalState.reporter
 }
@@ -25,6 +25,7 @@ package main
 import "C"
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"runtime/cgo"
 	"sync/atomic"
@@ -32,6 +33,8 @@ import (
 	"unsafe"
 
 	"github.com/ProtonMail/export-tool/internal"
+	"github.com/ProtonMail/export-tool/internal/audit"
+	"github.com/ProtonMail/export-tool/internal/history"
 	"github.com/ProtonMail/export-tool/internal/mail"
 	"github.com/ProtonMail/export-tool/internal/session"
 	"github.com/ProtonMail/export-tool/internal/utils"
@@ -52,6 +55,11 @@ func etSessionNewRestore(sessionPtr *C.etSession, cRestorePath *C.cchar_t, outRe
 		return C.ET_SESSION_STATUS_ERROR
 	}
 
+	if err := getHoldPolicy().Check("restoring a backup"); err != nil {
+		cSession.setLastError(err)
+		return C.ET_SESSION_STATUS_ERROR
+	}
+
 	restorePath := C.GoString(cRestorePath)
 	restoreTask, err := mail.NewRestoreTask(cSession.ctx, restorePath, cSession.s)
 	if err != nil {
@@ -104,10 +112,37 @@ func etRestoreStart(ptr *C.etRestore, callbacks *C.etRestoreCallbacks) C.etResto
 		callbacks: callbacks,
 	}
 
+	user := ce.csession.s.GetUser()
+	params := audit.RestoreParameters(ce.restorer)
+	if err := audit.Record(etGlobalState.audit, audit.NewEntry(audit.EventRestoreStarted, user, ce.restorer.GetBackupPath(), params)); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_RESTORE_STATUS_ERROR
+	}
+
 	ce.csession.s.GetTelemetryService().SendRestoreStart()
 	startTime := time.Now()
 
-	err := ce.restorer.Run(reporter)
+	result, err := ce.restorer.Run(reporter)
+	ce.lastResult = result
+
+	counts := map[string]uint64{
+		"importable": uint64(ce.restorer.GetImportableCount()),
+		"imported":   uint64(ce.restorer.GetImportedCount()),
+		"failed":     uint64(ce.restorer.GetFailedCount()),
+		"skipped":    uint64(ce.restorer.GetSkippedCount()),
+		"filtered":   uint64(ce.restorer.GetFilteredCount()),
+		"duplicates": uint64(ce.restorer.GetDuplicateCount()),
+		"resumed":    uint64(ce.restorer.GetResumedCount()),
+	}
+
+	entry := audit.NewEntry(audit.EventRestoreFinished, user, ce.restorer.GetBackupPath(), params)
+	entry.Counts = counts
+	entry.SetOutcome(err)
+	_ = audit.Record(etGlobalState.audit, entry)
+
+	run := history.NewRun(history.OperationRestore, user, ce.restorer.GetBackupPath(), params, startTime)
+	run.Finish(counts, err)
+	recordHistory(run)
 
 	ce.csession.s.GetTelemetryService().SendRestoreFinished(
 		ce.restorer.GetOperationCancelledByUser(),
@@ -139,7 +174,24 @@ func etRestoreCancel(ptr *C.etRestore) C.etRestoreStatus {
 
 	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
 
-	ce.restorer.Cancel()
+	ce.restorer.Cancel(context.Background(), mail.CancelModeImmediate)
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
+//export etRestoreCancelWithMode
+func etRestoreCancelWithMode(ptr *C.etRestore, mode C.int, gracePeriodMs C.uint64_t) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	if err := cancelWithMode(ce.restorer.Cancel, mode, gracePeriodMs); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_RESTORE_STATUS_ERROR
+	}
 
 	return C.ET_RESTORE_STATUS_OK
 }
@@ -168,6 +220,276 @@ func etRestoreGetBackupPath(ptr *C.etRestore, outPath **C.char) C.etRestoreStatu
 	return C.ET_RESTORE_STATUS_OK
 }
 
+//export etRestoreGetLabelPreview
+func etRestoreGetLabelPreview(ptr *C.etRestore, outJSON **C.char) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	plan, err := ce.restorer.PreviewLabels()
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return C.ET_RESTORE_STATUS_CANCELLED
+		}
+
+		ce.lastError.Set(internal.MapError(err))
+		return C.ET_RESTORE_STATUS_ERROR
+	}
+
+	data, err := json.Marshal(plan)
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_RESTORE_STATUS_ERROR
+	}
+
+	*outJSON = C.CString(string(data))
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
+//export etRestoreSetTransactional
+func etRestoreSetTransactional(ptr *C.etRestore, transactional C.int) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	ce.restorer.SetTransactional(transactional == 1)
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
+//export etRestoreSetAlwaysCreateLabels
+func etRestoreSetAlwaysCreateLabels(ptr *C.etRestore, alwaysCreate C.int) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	if alwaysCreate == 1 {
+		ce.restorer.SetLabelReuseMode(mail.LabelReuseModeAlwaysCreate)
+	} else {
+		ce.restorer.SetLabelReuseMode(mail.LabelReuseModeReuseExisting)
+	}
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
+//export etRestoreSetFilter
+func etRestoreSetFilter(ptr *C.etRestore, cFilterJSON *C.cchar_t) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	filter, err := mail.NewFilterFromJSON([]byte(C.GoString(cFilterJSON)))
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_RESTORE_STATUS_ERROR
+	}
+
+	if err := ce.restorer.SetFilter(filter); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_RESTORE_STATUS_ERROR
+	}
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
+//export etRestoreSetDateRange
+func etRestoreSetDateRange(ptr *C.etRestore, cAfter *C.cchar_t, cBefore *C.cchar_t) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	dateRange, err := newDateRangeFilter(C.GoString(cAfter), C.GoString(cBefore))
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_RESTORE_STATUS_ERROR
+	}
+
+	filter := dateRange
+	if current := ce.restorer.GetFilter(); current != nil {
+		filter = current.Merge(dateRange)
+	}
+
+	if err := ce.restorer.SetFilter(filter); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_RESTORE_STATUS_ERROR
+	}
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
+//export etRestoreSetSkipDuplicates
+func etRestoreSetSkipDuplicates(ptr *C.etRestore, enabled C.int) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	ce.restorer.SetSkipDuplicates(enabled == 1)
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
+//export etRestoreSetGuardrails
+func etRestoreSetGuardrails(
+	ptr *C.etRestore,
+	maxFailureRate C.double,
+	failureWindow C.int,
+	minThroughput C.double,
+	throughputWindowMinutes C.int,
+) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	if err := ce.restorer.SetGuardrails(mail.RestoreGuardrails{
+		MaxFailureRate:   float64(maxFailureRate),
+		FailureWindow:    int(failureWindow),
+		MinThroughput:    float64(minThroughput),
+		ThroughputWindow: time.Duration(throughputWindowMinutes) * time.Minute,
+	}); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_RESTORE_STATUS_ERROR
+	}
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
+//export etRestoreSetResume
+func etRestoreSetResume(ptr *C.etRestore, enabled C.int) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	ce.restorer.SetResume(enabled == 1)
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
+//export etRestoreSetEncryption
+func etRestoreSetEncryption(ptr *C.etRestore, cPassphrase *C.cchar_t, cArmoredKey *C.cchar_t) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	key, err := newAtRestKey(C.GoString(cPassphrase), C.GoString(cArmoredKey))
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_RESTORE_STATUS_ERROR
+	}
+
+	ce.restorer.SetAtRestKey(key)
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
+//export etRestoreSetConcurrency
+func etRestoreSetConcurrency(ptr *C.etRestore, concurrency C.int) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	if err := ce.restorer.SetConcurrency(int(concurrency)); err != nil {
+		ce.lastError.Set(err)
+		return C.ET_RESTORE_STATUS_ERROR
+	}
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
+//export etRestoreSetImportLabel
+func etRestoreSetImportLabel(ptr *C.etRestore, enabled C.int) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	ce.restorer.SetImportLabel(enabled == 1)
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
+//export etRestoreGetRolledBack
+func etRestoreGetRolledBack(ptr *C.etRestore, outRolledBack *C.int) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	*outRolledBack = 0
+	if ce.restorer.GetRolledBack() {
+		*outRolledBack = 1
+	}
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
+//export etRestoreVerify
+func etRestoreVerify(ptr *C.etRestore, outJSON **C.char) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	report, err := ce.restorer.Verify()
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return C.ET_RESTORE_STATUS_CANCELLED
+		}
+
+		ce.lastError.Set(internal.MapError(err))
+		return C.ET_RESTORE_STATUS_ERROR
+	}
+
+	data, err := json.Marshal(struct {
+		mail.VerificationReport
+		Complete bool
+	}{VerificationReport: report, Complete: report.IsComplete()})
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_RESTORE_STATUS_ERROR
+	}
+
+	*outJSON = C.CString(string(data))
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
 //export etRestoreGetImportableCount
 func etRestoreGetImportableCount(ptr *C.etRestore, count *C.int64_t) C.etRestoreStatus {
 	ce, ok := resolveRestore(ptr)
@@ -224,10 +546,45 @@ func etRestoreGetSkippedCount(ptr *C.etRestore, count *C.int64_t) C.etRestoreSta
 	return C.ET_RESTORE_STATUS_OK
 }
 
+//export etRestoreGetResult
+func etRestoreGetResult(ptr *C.etRestore, outJSON **C.char) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	data, err := json.Marshal(ce.lastResult)
+	if err != nil {
+		ce.lastError.Set(err)
+		return C.ET_RESTORE_STATUS_ERROR
+	}
+
+	*outJSON = C.CString(string(data))
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
+//export etRestoreGetCancelCause
+func etRestoreGetCancelCause(ptr *C.etRestore, outCause *C.etCancelCause) C.etRestoreStatus {
+	ce, ok := resolveRestore(ptr)
+	if !ok {
+		return C.ET_RESTORE_STATUS_INVALID
+	}
+
+	defer async.HandlePanic(ce.csession.s.GetPanicHandler())
+
+	*outCause = mapCancelCause(ce.restorer.GetCancelCause())
+
+	return C.ET_RESTORE_STATUS_OK
+}
+
 type cRestore struct {
-	csession  *csession
-	restorer  *mail.RestoreTask
-	lastError utils.CLastError
+	csession   *csession
+	restorer   *mail.RestoreTask
+	lastError  utils.CLastError
+	lastResult mail.RestoreResult
 }
 
 type RestoreHandle struct {
@@ -276,3 +633,25 @@ func (m *restoreReporter) OnProgress(delta int) {
 
 	C.etRestoreCallbackOnProgress(m.callbacks, C.float(progress))
 }
+
+func (m *restoreReporter) OnETAUpdate(remaining time.Duration) {
+	C.etRestoreCallbackOnETA(m.callbacks, C.int64_t(remaining.Seconds()))
+}
+
+func (m *restoreReporter) OnHeartbeat(heartbeat mail.Heartbeat) {
+	cStage := C.CString(heartbeat.Stage)
+	defer C.free(unsafe.Pointer(cStage))
+
+	C.etRestoreCallbackOnHeartbeat(m.callbacks, cStage, C.int64_t(heartbeat.Time.UnixMilli()), C.int64_t(heartbeat.LastProgressTime.UnixMilli()))
+}
+
+func (m *restoreReporter) OnRateLimited(wait time.Duration) {
+	C.etRestoreCallbackOnRateLimited(m.callbacks, C.int64_t(wait.Seconds()))
+}
+
+func (m *restoreReporter) OnProgressEvent(event mail.ProgressEvent) {
+	cEvent := newCProgressEvent(event)
+	defer C.free(unsafe.Pointer(cEvent.stage))
+
+	C.etRestoreCallbackOnProgressEvent(m.callbacks, &cEvent)
+}
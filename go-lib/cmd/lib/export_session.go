@@ -25,13 +25,18 @@ package main
 import "C"
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"runtime/cgo"
 	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/ProtonMail/export-tool/internal"
 	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/export-tool/internal/keychain"
+	"github.com/ProtonMail/export-tool/internal/mail"
 	"github.com/ProtonMail/export-tool/internal/sentry"
 	"github.com/ProtonMail/export-tool/internal/session"
 	"github.com/ProtonMail/export-tool/internal/telemetry"
@@ -145,6 +150,101 @@ func etSessionSubmitTOTP(ptr *C.etSession, totp *C.cchar_t, outStatus *C.etSessi
 	})
 }
 
+//export etSessionGetFIDO2Challenge
+func etSessionGetFIDO2Challenge(ptr *C.etSession, outJSON **C.char) C.etSessionStatus {
+	return withSession(ptr, func(_ context.Context, session *session.Session) error {
+		challenge, err := session.GetFIDO2Challenge()
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(challenge)
+		if err != nil {
+			return err
+		}
+
+		*outJSON = C.CString(string(data))
+
+		return nil
+	})
+}
+
+//export etSessionSubmitFIDO2
+func etSessionSubmitFIDO2(ptr *C.etSession, assertionJSON *C.cchar_t, outStatus *C.etSessionLoginState) C.etSessionStatus {
+	return withSession(ptr, func(ctx context.Context, s *session.Session) error {
+		var assertion session.FIDO2Assertion
+		if err := json.Unmarshal([]byte(C.GoString(assertionJSON)), &assertion); err != nil {
+			return fmt.Errorf("invalid security key assertion: %w", err)
+		}
+
+		if err := s.SubmitFIDO2(ctx, assertion); err != nil {
+			return internal.MapError(err)
+		}
+
+		*outStatus = mapLoginState(s.LoginState())
+		return nil
+	})
+}
+
+//export etSessionResumeFromKeychain
+func etSessionResumeFromKeychain(ptr *C.etSession, outResumed *C.int, outStatus *C.etSessionLoginState) C.etSessionStatus {
+	return withSession(ptr, func(ctx context.Context, s *session.Session) error {
+		store, err := keychain.New()
+		if err != nil {
+			return err
+		}
+
+		// The session is persistent even when none is resumed, so that the next login can be saved.
+		s.SetPersistent(true)
+		*outResumed = 0
+
+		persisted, err := session.LoadPersistedSessionFromKeychain(store)
+		if errors.Is(err, keychain.ErrNotFound) {
+			*outStatus = mapLoginState(s.LoginState())
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := s.Resume(ctx, persisted); err != nil {
+			logrus.WithError(err).Warn("Failed to resume saved session")
+		} else {
+			*outResumed = 1
+		}
+
+		*outStatus = mapLoginState(s.LoginState())
+
+		return nil
+	})
+}
+
+//export etSessionSaveToKeychain
+func etSessionSaveToKeychain(ptr *C.etSession) C.etSessionStatus {
+	return withSession(ptr, func(_ context.Context, s *session.Session) error {
+		store, err := keychain.New()
+		if err != nil {
+			return err
+		}
+
+		persisted, err := s.GetPersistedSession()
+		if err != nil {
+			return err
+		}
+
+		if err := session.SavePersistedSessionToKeychain(store, persisted); err != nil {
+			return err
+		}
+
+		s.SetPersistedSessionHandler(func(persisted session.PersistedSession) {
+			if err := session.SavePersistedSessionToKeychain(store, persisted); err != nil {
+				logrus.WithError(err).Error("Failed to save refreshed session")
+			}
+		})
+
+		return nil
+	})
+}
+
 //export etSessionSubmitMailboxPassword
 func etSessionSubmitMailboxPassword(ptr *C.etSession, password *C.cchar_t, passwordLen C.int, outStatus *C.etSessionLoginState) C.etSessionStatus {
 	return withSession(ptr, func(_ context.Context, session *session.Session) error {
@@ -192,6 +292,33 @@ func etSessionGetEmail(ptr *C.etSession, outEmail **C.char) C.etSessionStatus {
 	})
 }
 
+//export etSessionGetScopes
+func etSessionGetScopes(ptr *C.etSession, outJSON **C.char) C.etSessionStatus {
+	return withSession(ptr, func(_ context.Context, s *session.Session) error {
+		scopes := s.GetScopes()
+		if scopes == nil {
+			scopes = []session.Scope{}
+		}
+
+		data, err := json.Marshal(scopes)
+		if err != nil {
+			return err
+		}
+
+		*outJSON = C.CString(string(data))
+
+		return nil
+	})
+}
+
+//export etSessionGetScopeSummary
+func etSessionGetScopeSummary(ptr *C.etSession, outSummary **C.char) C.etSessionStatus {
+	return withSession(ptr, func(_ context.Context, s *session.Session) error {
+		*outSummary = C.CString(session.FormatScopes(s.GetScopes()))
+		return nil
+	})
+}
+
 //export etSessionSetUsingDefaultExportPath
 func etSessionSetUsingDefaultExportPath(ptr *C.etSession, usingDefaultExportPath C.int) C.etSessionStatus {
 	return withSession(ptr, func(_ context.Context, session *session.Session) error {
@@ -245,6 +372,8 @@ func mapLoginState(s session.LoginState) C.etSessionLoginState {
 		return C.ET_SESSION_LOGIN_STATE_AWAITING_HV
 	case session.LoginStateLoggedIn:
 		return C.ET_SESSION_LOGIN_STATE_LOGGED_IN
+	case session.LoginStateAwaitingFIDO2:
+		return C.ET_SESSION_LOGIN_STATE_AWAITING_FIDO2
 	default:
 		return C.ET_SESSION_LOGIN_STATE_LOGGED_OUT
 	}
@@ -285,17 +414,26 @@ func newCSession(apiURL string, telemetryDisabled bool, cb C.etSessionCallbacks)
 
 	defer async.HandlePanic(panicHandler)
 
+	apiURL, err := apiclient.ParseAPIURL(apiURL)
+	if err != nil {
+		return nil, err
+	}
+
 	sessionCb := newCSessionCallback(cb)
-	builder, err := apiclient.NewProtonAPIClientBuilder(apiURL, panicHandler, sessionCb)
+	builder, err := apiclient.NewProtonAPIClientBuilder(apiURL, panicHandler, sessionCb, getConnectionOptions())
 	if err != nil {
 		return nil, err
 	}
 
-	clientBuilder := apiclient.NewAutoRetryClientBuilder(
+	var clientBuilder apiclient.Builder = apiclient.NewAutoRetryClientBuilder(
 		builder,
 		&apiclient.SleepRetryStrategyBuilder{},
 	)
 
+	if getHoldPolicy().Enabled {
+		clientBuilder = apiclient.NewReadOnlyClientBuilder(clientBuilder)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &csession{
@@ -348,4 +486,65 @@ func (c *csessionCallback) OnNetworkLost() {
 	C.etSessionCallbackOnNetworkLost(&c.cb) //nolint:gocritic
 }
 
+func (c *csessionCallback) OnClockSkew(skew time.Duration) {
+	C.etSessionCallbackOnClockSkew(&c.cb, C.int64_t(skew/time.Second)) //nolint:gocritic
+}
+
+// cancelWithMode requests the cancellation of a task. A graceful cancellation is escalated to an immediate one after
+// gracePeriodMs, unless it is 0.
+func cancelWithMode(cancel func(context.Context, mail.CancelMode), mode C.int, gracePeriodMs C.uint64_t) error {
+	switch m := mail.CancelMode(mode); m {
+	case mail.CancelModeImmediate:
+		cancel(context.Background(), m)
+	case mail.CancelModeGraceful:
+		cancel(context.Background(), m)
+
+		if gracePeriodMs != 0 {
+			time.AfterFunc(time.Duration(gracePeriodMs)*time.Millisecond, func() {
+				cancel(context.Background(), mail.CancelModeImmediate)
+			})
+		}
+	default:
+		return fmt.Errorf("invalid cancel mode %v", mode)
+	}
+
+	return nil
+}
+
+func mapCancelCause(cause mail.CancelCause) C.etCancelCause {
+	switch cause {
+	case mail.CancelCauseNone:
+		return C.ET_CANCEL_CAUSE_NONE
+	case mail.CancelCauseUser:
+		return C.ET_CANCEL_CAUSE_USER
+	case mail.CancelCauseDeadline:
+		return C.ET_CANCEL_CAUSE_DEADLINE
+	case mail.CancelCauseFatal:
+		return C.ET_CANCEL_CAUSE_FATAL
+	case mail.CancelCauseParent:
+		return C.ET_CANCEL_CAUSE_PARENT
+	default:
+		return C.ET_CANCEL_CAUSE_NONE
+	}
+}
+
+// newCProgressEvent returns the C representation of the event, whose stage must be freed by the caller.
+func newCProgressEvent(event mail.ProgressEvent) C.etProgressEvent {
+	etaSeconds := int64(-1)
+	if event.ETA >= 0 {
+		etaSeconds = int64(event.ETA.Seconds())
+	}
+
+	return C.etProgressEvent{
+		stage:                 C.CString(event.Stage),
+		processedMessageCount: C.uint64_t(event.ProcessedMessageCount),
+		totalMessageCount:     C.uint64_t(event.TotalMessageCount),
+		transferredBytes:      C.uint64_t(event.TransferredBytes),
+		bytesPerSecond:        C.double(event.BytesPerSecond),
+		messagesPerSecond:     C.double(event.MessagesPerSecond),
+		etaSeconds:            C.int64_t(etaSeconds),
+		timestampMs:           C.int64_t(event.Time.UnixMilli()),
+	}
+}
+
 func main() {}
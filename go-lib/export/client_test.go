@@ -0,0 +1,51 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package export_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ProtonMail/export-tool/export"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_RequiresLogin(t *testing.T) {
+	client, err := export.NewClient(export.Options{TelemetryDisabled: true})
+	require.NoError(t, err)
+	defer client.Close()
+
+	ctx := context.Background()
+
+	require.Equal(t, export.LoginStateLoggedOut, client.LoginState())
+	require.Empty(t, client.Email())
+
+	_, err = client.NewExporter(ctx, t.TempDir(), export.ExportOptions{})
+	require.ErrorIs(t, err, export.ErrNotLoggedIn)
+
+	_, err = client.NewRestorer(ctx, t.TempDir(), export.RestoreOptions{})
+	require.ErrorIs(t, err, export.ErrNotLoggedIn)
+
+	require.ErrorIs(t, client.SubmitMailboxPassword([]byte("password")), export.ErrInvalidLoginState)
+	require.ErrorIs(t, client.Logout(ctx), export.ErrInvalidLoginState)
+}
+
+func TestNewClient_InvalidURL(t *testing.T) {
+	_, err := export.NewClient(export.Options{APIURL: "://proton"})
+	require.Error(t, err)
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"context"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/mail"
+)
+
+// Reporter receives the progress of an Exporter or a Restorer. Its methods are called from several goroutines.
+type Reporter interface {
+	SetMessageTotal(total uint64)
+	SetMessageProcessed(processed uint64)
+	OnProgress(delta int)
+}
+
+// Format is the layout of the exported messages.
+type Format string
+
+const (
+	FormatEML     Format = "eml"     // One EML file and one JSON metadata file per message, the default.
+	FormatMBox    Format = "mbox"    // One mbox file per label.
+	FormatMaildir Format = "maildir" // One Maildir folder per label.
+)
+
+// ExportOptions configure an Exporter. The zero value exports all the messages as EML files into a new folder.
+type ExportOptions struct {
+	Format Format
+
+	// Incremental updates the previous incremental export of the account in the folder instead of creating a new one,
+	// only the new and changed messages are downloaded.
+	Incremental bool
+
+	// Resume continues the interrupted export of the account in the folder from its checkpoint.
+	Resume bool
+
+	// Labels restricts the export to the messages with one of these labels or folders, given by name, path or ID.
+	Labels []string
+
+	// After and Before restrict the export to the messages received in [After, Before), when set.
+	After  time.Time
+	Before time.Time
+
+	// Languages restricts the export to the messages whose body is written in one of these ISO 639-1 languages, e.g.
+	// "en". The bodies of all the messages are then downloaded to detect their language.
+	Languages []string
+
+	// DetectLanguage stores the language detected in each message in its metadata, see mail.DetectLanguage.
+	DetectLanguage bool
+
+	// Concurrency is the number of messages downloaded in parallel, a default suited to the machine if 0.
+	Concurrency int
+
+	// Parity writes Reed-Solomon parity data amounting to this percentage of the size of the export, so that damaged
+	// or lost files can be rebuilt, see mail.RepairExportWithParity. 0 disables it.
+	Parity int
+}
+
+// ExportResult is the report of an export.
+type ExportResult struct {
+	Path           string // Folder of the export.
+	TotalCount     uint64 // Messages of the account matching the options.
+	ExportedCount  uint64
+	UnchangedCount uint64 // Messages of an incremental export that were already up to date.
+	DeletedCount   uint64 // Messages of an incremental export deleted on the server since the previous run.
+	FilteredCount  uint64 // Messages left out by the labels and the dates of the options.
+	Duration       time.Duration
+	Cancelled      bool // Cancel was called, the export can be resumed with ExportOptions.Resume.
+	Empty          bool // The account, or the labels and dates of the options, have no message to export.
+}
+
+// Exporter backs up the messages of an account to a folder.
+type Exporter struct {
+	task *mail.ExportTask
+}
+
+// NewExporter prepares an export in a new folder inside dir, see ExportOptions. The client must be logged in.
+func (c *Client) NewExporter(ctx context.Context, dir string, options ExportOptions) (*Exporter, error) {
+	if err := c.checkLoggedIn(); err != nil {
+		return nil, err
+	}
+
+	task := mail.NewExportTask(ctx, dir, c.session)
+
+	if err := configureExportTask(task, options); err != nil {
+		task.Close()
+		return nil, err
+	}
+
+	return &Exporter{task: task}, nil
+}
+
+func configureExportTask(task *mail.ExportTask, options ExportOptions) error {
+	format := mail.OutputFormatEML
+	if len(options.Format) != 0 {
+		var err error
+		if format, err = mail.OutputFormatFromString(string(options.Format)); err != nil {
+			return err
+		}
+	}
+
+	task.SetOutputFormat(format)
+
+	if err := task.SetFilter(mail.Filter{
+		Labels:    options.Labels,
+		After:     options.After,
+		Before:    options.Before,
+		Languages: options.Languages,
+	}); err != nil {
+		return err
+	}
+
+	task.SetDetectLanguage(options.DetectLanguage)
+
+	if err := task.SetConcurrency(options.Concurrency); err != nil {
+		return err
+	}
+
+	if err := task.SetParity(options.Parity); err != nil {
+		return err
+	}
+
+	if err := task.SetIncremental(options.Incremental, false); err != nil {
+		return err
+	}
+
+	return task.SetResume(options.Resume)
+}
+
+// Path returns the folder the messages are exported to.
+func (e *Exporter) Path() string {
+	return e.task.GetExportPath()
+}
+
+// Run performs the export. The result is also filled when an error is returned. A nil reporter is allowed.
+func (e *Exporter) Run(ctx context.Context, reporter Reporter) (ExportResult, error) {
+	result, err := e.task.Run(ctx, newReporter(reporter))
+
+	return ExportResult{
+		Path:           e.task.GetExportPath(),
+		TotalCount:     result.TotalMessageCount,
+		ExportedCount:  result.ExportedMessageCount,
+		UnchangedCount: result.UnchangedMessageCount,
+		DeletedCount:   result.DeletedMessageCount,
+		FilteredCount:  result.FilteredMessageCount,
+		Duration:       result.Duration,
+		Cancelled:      result.CancelCause == mail.CancelCauseUser,
+		Empty:          result.Status == mail.ExportStatusNothingToExport,
+	}, err
+}
+
+// Cancel stops a running export. A graceful cancellation lets the messages being downloaded finish, it becomes
+// immediate when ctx is done first.
+func (e *Exporter) Cancel(ctx context.Context, graceful bool) {
+	e.task.Cancel(ctx, cancelMode(graceful))
+}
+
+// Close releases the resources of the export, it must be called once Run returned.
+func (e *Exporter) Close() {
+	e.task.Close()
+}
+
+func newReporter(reporter Reporter) mail.Reporter {
+	if reporter == nil {
+		return mail.NullProgressReporter{}
+	}
+
+	return reporter
+}
+
+func cancelMode(graceful bool) mail.CancelMode {
+	if graceful {
+		return mail.CancelModeGraceful
+	}
+
+	return mail.CancelModeImmediate
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"io"
+
+	"github.com/ProtonMail/export-tool/internal/mail"
+)
+
+// Manifest is the inventory of an export folder for external tools, one entry per file with the message it belongs
+// to. Its JSON form follows ManifestSchema, its CSV form has one column per field.
+type Manifest = mail.ExportManifest
+
+type ManifestEntry = mail.ExportManifestEntry
+
+type ManifestFormat = mail.ExportManifestFormat
+
+const (
+	ManifestFormatJSON = mail.ExportManifestFormatJSON
+	ManifestFormatCSV  = mail.ExportManifestFormatCSV
+)
+
+// ManifestSchema is the JSON Schema of the JSON manifests.
+const ManifestSchema = mail.ExportManifestSchema
+
+// BuildManifest returns the manifest of an export folder, written at the end of each export run.
+func BuildManifest(exportDir string) (Manifest, error) {
+	return mail.BuildExportManifest(exportDir)
+}
+
+// WriteManifest writes a manifest as JSON or CSV.
+func WriteManifest(w io.Writer, manifest Manifest, format ManifestFormat) error {
+	return mail.WriteExportManifest(w, manifest, format)
+}
+
+// ReadManifest reads a manifest written by WriteManifest or by another tool following ManifestSchema.
+func ReadManifest(r io.Reader, format ManifestFormat) (Manifest, error) {
+	return mail.ReadExportManifest(r, format)
+}
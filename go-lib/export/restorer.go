@@ -0,0 +1,136 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package export
+
+import (
+	"context"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/mail"
+)
+
+// RestoreOptions configure a Restorer. The zero value imports all the messages of the backup.
+type RestoreOptions struct {
+	// Resume skips the messages imported by a previous interrupted restore of the same backup.
+	Resume bool
+
+	// SkipDuplicates skips the messages already in the account.
+	SkipDuplicates bool
+
+	// Transactional deletes the imported messages and the created labels if the restore does not complete.
+	Transactional bool
+
+	// NoImportLabel does not add the 'Import <date>' label to the imported messages.
+	NoImportLabel bool
+
+	// Labels restricts the restore to the messages with one of these labels or folders of the backup.
+	Labels []string
+
+	// Concurrency is the number of import requests sent in parallel, a default if 0.
+	Concurrency int
+
+	// Guardrails abort the restore when too many messages fail or when it makes too little progress.
+	Guardrails RestoreGuardrails
+}
+
+// RestoreGuardrails abort a restore which is going nowhere, see mail.RestoreGuardrails. The zero value disables them.
+type RestoreGuardrails = mail.RestoreGuardrails
+
+// RestoreResult is the report of a restore.
+type RestoreResult struct {
+	ImportableCount int64
+	ImportedCount   int64
+	FailedCount     int64
+	SkippedCount    int64 // Duplicates and messages imported by a previous run included.
+	DuplicateCount  int64 // Messages already in the account, see RestoreOptions.SkipDuplicates.
+	Duration        time.Duration
+	Cancelled       bool // Cancel was called, the restore can be resumed with RestoreOptions.Resume.
+	RolledBack      bool // The imported messages were deleted, see RestoreOptions.Transactional.
+}
+
+// Restorer imports the messages of a backup into an account.
+type Restorer struct {
+	task *mail.RestoreTask
+}
+
+// NewRestorer prepares the restore of the backup at backupDir, an export folder or an archive of one. The
+// client must be logged in.
+func (c *Client) NewRestorer(ctx context.Context, backupDir string, options RestoreOptions) (*Restorer, error) {
+	if err := c.checkLoggedIn(); err != nil {
+		return nil, err
+	}
+
+	task, err := mail.NewRestoreTask(ctx, backupDir, c.session)
+	if err != nil {
+		return nil, err
+	}
+
+	task.SetResume(options.Resume)
+	task.SetSkipDuplicates(options.SkipDuplicates)
+	task.SetTransactional(options.Transactional)
+	task.SetImportLabel(!options.NoImportLabel)
+
+	if err := task.SetFilter(mail.Filter{Labels: options.Labels}); err != nil {
+		task.Close()
+		return nil, err
+	}
+
+	if err := task.SetConcurrency(options.Concurrency); err != nil {
+		task.Close()
+		return nil, err
+	}
+
+	if err := task.SetGuardrails(options.Guardrails); err != nil {
+		task.Close()
+		return nil, err
+	}
+
+	return &Restorer{task: task}, nil
+}
+
+// Path returns the folder of the backup.
+func (r *Restorer) Path() string {
+	return r.task.GetBackupPath()
+}
+
+// Run performs the restore. The result is also filled when an error is returned. A nil reporter is allowed.
+func (r *Restorer) Run(reporter Reporter) (RestoreResult, error) {
+	result, err := r.task.Run(newReporter(reporter))
+
+	return RestoreResult{
+		ImportableCount: result.ImportableCount,
+		ImportedCount:   result.ImportedCount,
+		FailedCount:     result.FailedCount,
+		SkippedCount:    result.SkippedCount,
+		DuplicateCount:  result.DuplicateCount,
+		Duration:        result.Duration,
+		Cancelled:       result.CancelCause == mail.CancelCauseUser,
+		RolledBack:      result.RolledBack,
+	}, err
+}
+
+// Cancel stops a running restore. A graceful cancellation lets the batch being imported finish, it becomes immediate
+// when ctx is done first.
+func (r *Restorer) Cancel(ctx context.Context, graceful bool) {
+	r.task.Cancel(ctx, cancelMode(graceful))
+}
+
+// Close releases the resources of the restore, it must be called once Run returned.
+func (r *Restorer) Close() {
+	r.task.Close()
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package alert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Environment variables configuring the SMTP server the alert emails are sent through. The credentials are never given
+// on the command line so that they don't leak in the process list or the shell history.
+const (
+	SMTPServerEnvVar   = "ET_SMTP_SERVER" // host:port
+	SMTPUserEnvVar     = "ET_SMTP_USER"
+	SMTPPasswordEnvVar = "ET_SMTP_PASSWORD"
+	SMTPFromEnvVar     = "ET_SMTP_FROM" // Defaults to the user, or to the recipient.
+)
+
+const emailTimeout = 30 * time.Second
+
+var ErrSMTPServerMissing = errors.New("the SMTP server sending the alert emails must be set with " + SMTPServerEnvVar)
+
+type sendMailFunc func(ctx context.Context, server string, auth smtp.Auth, from, to string, msg []byte) error
+
+// Email sends the alerts as JSON in plain text emails. The connection to the SMTP server is upgraded with STARTTLS when
+// the server supports it, and smtp.PlainAuth refuses to send the credentials over plain text to a remote server.
+type Email struct {
+	server string
+	auth   smtp.Auth
+	from   *mail.Address
+	to     *mail.Address
+	now    func() time.Time
+	send   sendMailFunc
+}
+
+func NewEmail(to string) (*Email, error) {
+	recipient, err := mail.ParseAddress(to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid alert email address '%v': %w", to, err)
+	}
+
+	server := os.Getenv(SMTPServerEnvVar)
+	if len(server) == 0 {
+		return nil, ErrSMTPServerMissing
+	}
+
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP server '%v': expected host:port: %w", server, err)
+	}
+
+	user := os.Getenv(SMTPUserEnvVar)
+
+	from := os.Getenv(SMTPFromEnvVar)
+	if len(from) == 0 {
+		from = user
+	}
+
+	sender := recipient
+	if len(from) != 0 {
+		if sender, err = mail.ParseAddress(from); err != nil {
+			return nil, fmt.Errorf("invalid alert email sender '%v': %w", from, err)
+		}
+	}
+
+	var auth smtp.Auth
+	if len(user) != 0 {
+		auth = smtp.PlainAuth("", user, os.Getenv(SMTPPasswordEnvVar), host)
+	}
+
+	return &Email{
+		server: server,
+		auth:   auth,
+		from:   sender,
+		to:     recipient,
+		now:    time.Now,
+		send:   sendMail,
+	}, nil
+}
+
+// Send emails the indented JSON encoding of the event with the given subject.
+func (e *Email) Send(ctx context.Context, subject string, event any) error {
+	body, err := json.MarshalIndent(event, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %w", err)
+	}
+
+	if err := e.send(ctx, e.server, e.auth, e.from.Address, e.to.Address, e.compose(subject, body)); err != nil {
+		return fmt.Errorf("failed to send alert email: %w", err)
+	}
+
+	return nil
+}
+
+func (e *Email) compose(subject string, body []byte) []byte {
+	// Line breaks in the subject would inject headers.
+	subject = strings.NewReplacer("\r", " ", "\n", " ").Replace(subject)
+
+	var msg bytes.Buffer
+
+	fmt.Fprintf(&msg, "From: %v\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %v\r\n", e.to)
+	fmt.Fprintf(&msg, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %v\r\n", e.now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	msg.WriteString("\r\n")
+	msg.Write(bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n")))
+	msg.WriteString("\r\n")
+
+	return msg.Bytes()
+}
+
+func sendMail(ctx context.Context, server string, auth smtp.Auth, from, to string, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, emailTimeout)
+	defer cancel()
+
+	dialer := net.Dialer{}
+
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return err
+	}
+
+	// The SMTP client doesn't take a context, the deadline bounds the whole exchange instead.
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	host, _, _ := net.SplitHostPort(server)
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer func() { _ = client.Close() }()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}); err != nil {
+			return err
+		}
+	}
+
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
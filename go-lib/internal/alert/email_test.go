@@ -0,0 +1,154 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package alert
+
+import (
+	"context"
+	"errors"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type sentEmail struct {
+	server string
+	auth   smtp.Auth
+	from   string
+	to     string
+	msg    string
+}
+
+func stubSendMail(email *Email, err error) *[]sentEmail {
+	var sent []sentEmail
+
+	email.send = func(_ context.Context, server string, auth smtp.Auth, from, to string, msg []byte) error {
+		sent = append(sent, sentEmail{server: server, auth: auth, from: from, to: to, msg: string(msg)})
+		return err
+	}
+
+	return &sent
+}
+
+func TestEmail_Send(t *testing.T) {
+	t.Setenv(SMTPServerEnvVar, "smtp.example.com:587")
+	t.Setenv(SMTPUserEnvVar, "backup@example.com")
+	t.Setenv(SMTPPasswordEnvVar, "secret")
+	t.Setenv(SMTPFromEnvVar, "")
+
+	email, err := NewEmail("Admin <admin@example.com>")
+	require.NoError(t, err)
+
+	email.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+	sent := stubSendMail(email, nil)
+
+	require.NoError(t, email.Send(context.Background(), "1500 deleted\r\nBcc: evil@example.com", map[string]int{"DeletedCount": 1500}))
+	require.Len(t, *sent, 1)
+
+	got := (*sent)[0]
+	require.Equal(t, "smtp.example.com:587", got.server)
+	require.NotNil(t, got.auth)
+	require.Equal(t, "backup@example.com", got.from)
+	require.Equal(t, "admin@example.com", got.to)
+
+	header, body, ok := strings.Cut(got.msg, "\r\n\r\n")
+	require.True(t, ok)
+	require.Contains(t, header, "From: <backup@example.com>\r\n")
+	require.Contains(t, header, "To: \"Admin\" <admin@example.com>\r\n")
+	require.Contains(t, header, "Subject: 1500 deleted  Bcc: evil@example.com\r\n")
+	require.Contains(t, header, "Date: Wed, 01 May 2024 12:00:00 +0000\r\n")
+	require.NotContains(t, header, "\r\nBcc:")
+	require.Equal(t, "{\r\n  \"DeletedCount\": 1500\r\n}\r\n", body)
+
+	*sent = nil
+	email.send = func(context.Context, string, smtp.Auth, string, string, []byte) error { return errors.New("refused") }
+	require.ErrorContains(t, email.Send(context.Background(), "subject", nil), "refused")
+}
+
+func TestEmail_Sender(t *testing.T) {
+	t.Setenv(SMTPServerEnvVar, "localhost:25")
+	t.Setenv(SMTPUserEnvVar, "")
+	t.Setenv(SMTPFromEnvVar, "")
+
+	// Without credentials or sender, the recipient sends the alerts to themselves.
+	email, err := NewEmail("admin@example.com")
+	require.NoError(t, err)
+	require.Nil(t, email.auth)
+	require.Equal(t, "admin@example.com", email.from.Address)
+
+	t.Setenv(SMTPFromEnvVar, "alerts@example.com")
+
+	email, err = NewEmail("admin@example.com")
+	require.NoError(t, err)
+	require.Equal(t, "alerts@example.com", email.from.Address)
+}
+
+func TestNewEmail_Invalid(t *testing.T) {
+	t.Setenv(SMTPServerEnvVar, "")
+	t.Setenv(SMTPUserEnvVar, "")
+	t.Setenv(SMTPFromEnvVar, "")
+
+	_, err := NewEmail("admin@example.com")
+	require.ErrorIs(t, err, ErrSMTPServerMissing)
+
+	t.Setenv(SMTPServerEnvVar, "smtp.example.com")
+
+	_, err = NewEmail("admin@example.com")
+	require.Error(t, err)
+
+	t.Setenv(SMTPServerEnvVar, "smtp.example.com:587")
+
+	_, err = NewEmail("not an address")
+	require.Error(t, err)
+
+	t.Setenv(SMTPFromEnvVar, "not an address")
+
+	_, err = NewEmail("admin@example.com")
+	require.Error(t, err)
+}
+
+func TestNotifier(t *testing.T) {
+	notifier, err := NewNotifier("", "")
+	require.NoError(t, err)
+	require.Nil(t, notifier)
+
+	t.Setenv(SMTPServerEnvVar, "smtp.example.com:587")
+	t.Setenv(SMTPUserEnvVar, "")
+	t.Setenv(SMTPFromEnvVar, "")
+
+	server, requests := newWebhookServer(t)
+
+	notifier, err = NewNotifier(server.URL, "admin@example.com")
+	require.NoError(t, err)
+
+	sent := stubSendMail(notifier.email, errors.New("refused"))
+
+	// The webhook is still notified when the email fails.
+	err = notifier.Notify(context.Background(), "subject", map[string]int{"DeletedCount": 1500})
+	require.ErrorContains(t, err, "refused")
+	require.Len(t, *sent, 1)
+
+	req := <-requests
+	require.NoError(t, req.err)
+	require.Equal(t, 1500, req.body["DeletedCount"])
+
+	_, err = NewNotifier("ftp://example.com", "")
+	require.Error(t, err)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package alert
+
+import (
+	"context"
+	"errors"
+)
+
+// Notifier sends the alerts through every configured channel.
+type Notifier struct {
+	webhook *Webhook
+	email   *Email
+}
+
+// NewNotifier returns a notifier posting to the webhook URL and emailing the address, either of which can be empty.
+// It returns nil if both are.
+func NewNotifier(webhookURL, emailTo string) (*Notifier, error) {
+	var notifier Notifier
+
+	if len(webhookURL) != 0 {
+		webhook, err := NewWebhook(webhookURL)
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.webhook = webhook
+	}
+
+	if len(emailTo) != 0 {
+		email, err := NewEmail(emailTo)
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.email = email
+	}
+
+	if notifier.webhook == nil && notifier.email == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	return &notifier, nil
+}
+
+// Notify sends the event through all the channels, even if some of them fail.
+func (n *Notifier) Notify(ctx context.Context, subject string, event any) error {
+	var errs []error
+
+	if n.webhook != nil {
+		errs = append(errs, n.webhook.Post(ctx, event))
+	}
+
+	if n.email != nil {
+		errs = append(errs, n.email.Send(ctx, subject, event))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type webhookRequest struct {
+	method      string
+	contentType string
+	body        map[string]int
+	err         error
+}
+
+// newWebhookServer records the requests to the returned channel, the assertions must not run in the handler goroutine.
+func newWebhookServer(t *testing.T) (*httptest.Server, <-chan webhookRequest) {
+	requests := make(chan webhookRequest, 8)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := webhookRequest{method: r.Method, contentType: r.Header.Get("Content-Type")}
+		req.err = json.NewDecoder(r.Body).Decode(&req.body)
+
+		if req.body["DeletedCount"] == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+
+		requests <- req
+	}))
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+func TestWebhook_Post(t *testing.T) {
+	server, requests := newWebhookServer(t)
+
+	webhook, err := NewWebhook(server.URL)
+	require.NoError(t, err)
+
+	require.NoError(t, webhook.Post(context.Background(), map[string]int{"DeletedCount": 1500}))
+
+	req := <-requests
+	require.NoError(t, req.err)
+	require.Equal(t, http.MethodPost, req.method)
+	require.Equal(t, "application/json", req.contentType)
+	require.Equal(t, 1500, req.body["DeletedCount"])
+
+	require.Error(t, webhook.Post(context.Background(), map[string]int{}))
+
+	req = <-requests
+	require.NoError(t, req.err)
+	require.Empty(t, req.body)
+
+	_, err = NewWebhook("ftp://example.com")
+	require.Error(t, err)
+}
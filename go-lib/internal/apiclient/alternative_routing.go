@@ -0,0 +1,485 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/gluon/async"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// alternativeRoutingQuery is the TXT record listing the alternative hosts of the API, published by Proton for the
+	// networks blocking the API servers.
+	alternativeRoutingQuery = "dMFYGSLTQOJXXI33ONVQWS3BOMNUA.protonpro.xyz."
+
+	// alternativeRouteDuration is how long an alternative host is used before trying the API servers again.
+	alternativeRouteDuration = 24 * time.Hour
+
+	// alternativeLookupWait throttles the lookups of the alternative hosts while the API servers are unreachable.
+	alternativeLookupWait = 5 * time.Second
+
+	// alternativeLookupTimeout bounds the DoH queries and the pings of the hosts.
+	alternativeLookupTimeout = 20 * time.Second
+)
+
+// DoHProviders are the DNS over HTTPS resolvers queried for the alternative hosts, in order. They are reached
+// directly, the lookup must not depend on the DNS of the network blocking the API servers.
+var DoHProviders = []string{ //nolint:gochecknoglobals
+	"https://dns11.quad9.net/dns-query",
+	"https://dns11.quad9.net:5053/dns-query",
+	"https://dns.google/dns-query",
+}
+
+// trustedAPIPins are the public keys accepted from the alternative hosts, whose certificates are not issued for their
+// random names: those of the API servers and of the alternative hosts themselves.
+var trustedAPIPins = []string{ //nolint:gochecknoglobals
+	// api.protonmail.ch
+	"drtmcR2kFkM8qJClsuWgUzxgBkePfRCkRpqUesyDmeE=", // current
+	"YRGlaY0jyJ4Jw2/4M8FIftwbDIQfh8Sdro96CeEel54=", // hot backup
+	"AfMENBVvOS8MnISprtvyPsjKlPooqh8nMB/pvCrpJpw=", // cold backup
+
+	// proton.me
+	"CT56BhOTmj5ZIPgb/xD5mH8rY3BLo/MlhP7oPyJUEDo=", // current
+	"35Dx28/uzN3LeltkCBQ8RHK0tlNSa2kCpCRGNp34Gxc=", // hot backup
+	"qYIukVc63DEITct8sFT7ebIq5qsWmuscaIKeJx+5J5A=", // cold backup
+
+	// alternative hosts
+	"EU6TS9MO0L/GsDHvVc9D5fChYLNy5JdGYpJw0ccgetM=", // main
+	"iKPIHPnDNqdkvOnTClQ8zQAIKG0XavaPkcEo0LBAABA=", // backup 1
+	"MSlVrBCdL0hKyczvgYVSRNm88RicyY04Q2y5qrBt0xA=", // backup 2
+	"C2UxW0T1Ckl9s+8cXfjXxlEqwAfPM4HiW2y3UdtBeCw=", // backup 3
+}
+
+var errPinMismatch = errors.New("the certificate of the alternative host is not trusted")
+
+// alternativeRouting reaches the API through alternative hosts when the API servers cannot be connected to, as in
+// the countries and networks blocking them. The hosts are listed in a TXT record looked up with DNS over HTTPS. Only
+// the TLS connections are rerouted, the requests are unchanged.
+type alternativeRouting struct {
+	directAddress string
+	tlsConfig     *tls.Config
+	pins          []string
+	panicHandler  async.PanicHandler
+
+	// dial connects to an address, lookup returns the alternative hosts from a DoH provider and canReach pings a
+	// server. They are replaced in the tests.
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+	lookup   func(ctx context.Context, provider string) ([]string, error)
+	canReach func(ctx context.Context, address string) bool
+
+	lock         sync.Mutex
+	routeAddress string // The alternative host in use, empty when connecting to the API servers.
+	routeExpiry  time.Time
+	lastLookup   time.Time
+}
+
+// newAlternativeRouting returns the alternative routing of the API at apiURL. The TLS connections to the API servers
+// are validated with tlsConfig, those to the alternative hosts with the pins of the API.
+func newAlternativeRouting(
+	apiURL string,
+	dialer *dialer,
+	tlsConfig *tls.Config,
+	panicHandler async.PanicHandler,
+) (*alternativeRouting, error) {
+	directAddress, err := addressOfURL(apiURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	r := &alternativeRouting{
+		directAddress: directAddress,
+		tlsConfig:     tlsConfig,
+		pins:          trustedAPIPins,
+		panicHandler:  panicHandler,
+		dial:          dialer.DialContext,
+	}
+
+	r.lookup = r.dohLookup
+	r.canReach = r.ping
+
+	return r, nil
+}
+
+// configureTransport makes the transport connect through the alternative routing. The TLS connections are opened by
+// DialTLSContext, the transport still negotiates HTTP/2 from their state.
+func (r *alternativeRouting) configureTransport(transport *http.Transport) {
+	transport.DialTLSContext = r.DialTLSContext
+}
+
+// DialTLSContext opens a TLS connection to address, through the alternative host when the API servers are unreachable.
+func (r *alternativeRouting) DialTLSContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if address != r.directAddress {
+		return r.dialTLS(ctx, network, address, false)
+	}
+
+	if routeAddress := r.route(); len(routeAddress) != 0 {
+		conn, err := r.dialTLS(ctx, network, routeAddress, true)
+		if err == nil {
+			return conn, nil
+		}
+
+		logrus.WithError(err).WithField("host", routeAddress).Warn("Alternative host unreachable, trying the API servers")
+		r.resetRoute(routeAddress)
+	}
+
+	conn, err := r.dialTLS(ctx, network, address, false)
+	if err == nil || ctx.Err() != nil {
+		return conn, err
+	}
+
+	routeAddress, ok := r.switchRoute(ctx)
+	if !ok {
+		return nil, err
+	}
+
+	return r.dialTLS(ctx, network, routeAddress, true)
+}
+
+// dialTLS connects to address. The certificates of the alternative hosts are checked against the pins, as they are
+// not issued for the names of the hosts.
+func (r *alternativeRouting) dialTLS(ctx context.Context, network, address string, alternative bool) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	rawConn, err := r.dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	config := r.tlsConfig.Clone()
+	config.ServerName = host
+
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	if alternative {
+		config.InsecureSkipVerify = true //nolint:gosec
+		config.VerifyConnection = r.checkPins
+	}
+
+	conn := tls.Client(rawConn, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		_ = rawConn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// checkPins accepts the connections whose certificate chain contains one of the trusted public keys.
+func (r *alternativeRouting) checkPins(state tls.ConnectionState) error {
+	for _, cert := range state.PeerCertificates {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		fingerprint := base64.StdEncoding.EncodeToString(sum[:])
+
+		for _, pin := range r.pins {
+			if pin == fingerprint {
+				return nil
+			}
+		}
+	}
+
+	return errPinMismatch
+}
+
+// route returns the alternative host in use, empty once it expired.
+func (r *alternativeRouting) route() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.routeAddress) != 0 && time.Now().After(r.routeExpiry) {
+		logrus.Info("Alternative routing expired, connecting to the API servers again")
+		r.routeAddress = ""
+	}
+
+	return r.routeAddress
+}
+
+func (r *alternativeRouting) resetRoute(routeAddress string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.routeAddress == routeAddress {
+		r.routeAddress = ""
+	}
+}
+
+// switchRoute looks for a reachable alternative host after the API servers could not be connected to. As in the
+// other Proton clients, the API servers are pinged in parallel with the DoH queries, so that an intermittent failure
+// does not reroute the connections.
+func (r *alternativeRouting) switchRoute(ctx context.Context) (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.routeAddress) != 0 {
+		return r.routeAddress, true
+	}
+
+	if time.Since(r.lastLookup) < alternativeLookupWait {
+		return "", false
+	}
+
+	r.lastLookup = time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, alternativeLookupTimeout)
+	defer cancel()
+
+	var (
+		wg           sync.WaitGroup
+		apiReachable bool
+		hosts        []string
+	)
+
+	wg.Add(2)
+
+	go func() {
+		defer async.HandlePanic(r.panicHandler)
+		defer wg.Done()
+
+		apiReachable = r.canReach(ctx, r.directAddress)
+	}()
+
+	go func() {
+		defer async.HandlePanic(r.panicHandler)
+		defer wg.Done()
+
+		hosts = r.lookupHosts(ctx)
+	}()
+
+	wg.Wait()
+
+	if apiReachable {
+		logrus.Info("The API servers are reachable again, not switching to an alternative host")
+		return "", false
+	}
+
+	for _, host := range hosts {
+		address := net.JoinHostPort(host, "443")
+
+		if r.canReach(ctx, address) {
+			logrus.WithField("host", host).Info("Switching to an alternative host")
+
+			r.routeAddress = address
+			r.routeExpiry = time.Now().Add(alternativeRouteDuration)
+
+			return address, true
+		}
+	}
+
+	logrus.WithField("hosts", len(hosts)).Warn("No reachable alternative host")
+
+	return "", false
+}
+
+// lookupHosts returns the alternative hosts from the first DoH provider answering.
+func (r *alternativeRouting) lookupHosts(ctx context.Context) []string {
+	for _, provider := range DoHProviders {
+		hosts, err := r.lookup(ctx, provider)
+		if err != nil {
+			logrus.WithError(err).WithField("provider", provider).Warn("Failed to look up the alternative hosts")
+			continue
+		}
+
+		return hosts
+	}
+
+	return nil
+}
+
+// ping tells whether the API answers at address, whose certificate is checked as in DialTLSContext.
+func (r *alternativeRouting) ping(ctx context.Context, address string) bool {
+	alternative := address != r.directAddress
+
+	transport := &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return r.dialTLS(ctx, network, address, alternative)
+		},
+		ForceAttemptHTTP2: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	host, _, err := net.SplitHostPort(r.directAddress)
+	if err != nil {
+		return false
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+"/tests/ping", nil)
+	if err != nil {
+		return false
+	}
+
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		logrus.WithError(err).WithField("address", address).Debug("Failed to ping the API")
+		return false
+	}
+
+	_ = res.Body.Close()
+
+	return true
+}
+
+// dohLookup queries the TXT record of the alternative hosts from a DNS over HTTPS provider, see RFC 8484.
+func (r *alternativeRouting) dohLookup(ctx context.Context, provider string) ([]string, error) {
+	query, err := newTXTQuery(alternativeRoutingQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, provider, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	values := req.URL.Query()
+	values.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+	req.URL.RawQuery = values.Encode()
+	req.Header.Set("Accept", "application/dns-message")
+
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert
+	transport.Proxy = nil
+	transport.DialContext = r.dial
+
+	defer transport.CloseIdleConnections()
+
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH provider returned %v", res.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTXTAnswers(body)
+}
+
+// newTXTQuery returns the DNS message in wire format querying the TXT record of name.
+func newTXTQuery(name string) ([]byte, error) {
+	dnsName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsName,
+			Type:  dnsmessage.TypeTXT,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+
+	return msg.Pack()
+}
+
+// parseTXTAnswers returns the strings of the TXT answers of a DNS message in wire format.
+func parseTXTAnswers(data []byte) ([]string, error) {
+	var parser dnsmessage.Parser
+
+	header, err := parser.Start(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS response: %w", err)
+	}
+
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("DNS query failed: %v", header.RCode)
+	}
+
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, fmt.Errorf("invalid DNS response: %w", err)
+	}
+
+	var txts []string
+
+	for {
+		answer, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid DNS response: %w", err)
+		}
+
+		if answer.Type != dnsmessage.TypeTXT {
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, fmt.Errorf("invalid DNS response: %w", err)
+			}
+
+			continue
+		}
+
+		txt, err := parser.TXTResource()
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS response: %w", err)
+		}
+
+		txts = append(txts, txt.TXT...)
+	}
+
+	return txts, nil
+}
+
+// addressOfURL returns the host:port an URL is connected to.
+func addressOfURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	if len(u.Hostname()) == 0 {
+		return "", fmt.Errorf("invalid API URL '%v'", rawURL)
+	}
+
+	if len(u.Port()) != 0 {
+		return u.Host, nil
+	}
+
+	if strings.EqualFold(u.Scheme, "http") {
+		return net.JoinHostPort(u.Hostname(), "80"), nil
+	}
+
+	return net.JoinHostPort(u.Hostname(), "443"), nil
+}
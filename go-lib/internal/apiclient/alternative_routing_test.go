@@ -0,0 +1,150 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ProtonMail/gluon/async"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testAPIURL = "https://mail-api.proton.me"
+
+func TestAlternativeRouting_DoHLookup(t *testing.T) {
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		require.NoError(t, err)
+
+		var parser dnsmessage.Parser
+
+		header, err := parser.Start(query)
+		require.NoError(t, err)
+
+		question, err := parser.Question()
+		require.NoError(t, err)
+		require.Equal(t, alternativeRoutingQuery, question.Name.String())
+		require.Equal(t, dnsmessage.TypeTXT, question.Type)
+
+		builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true})
+		require.NoError(t, builder.StartQuestions())
+		require.NoError(t, builder.Question(question))
+		require.NoError(t, builder.StartAnswers())
+		require.NoError(t, builder.TXTResource(
+			dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET},
+			dnsmessage.TXTResource{TXT: []string{"alt1.example.com", "alt2.example.com"}},
+		))
+
+		response, err := builder.Finish()
+		require.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(response)
+	}))
+	defer doh.Close()
+
+	routing, err := newAlternativeRouting(testAPIURL, newDialer(IPPreferenceAuto), nil, async.NoopPanicHandler{})
+	require.NoError(t, err)
+
+	hosts, err := routing.dohLookup(context.Background(), doh.URL)
+	require.NoError(t, err)
+	require.Equal(t, []string{"alt1.example.com", "alt2.example.com"}, hosts)
+}
+
+func TestAlternativeRouting_SwitchesToReachableHost(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "mail-api.proton.me", r.Host)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	routing := newTestAlternativeRouting(t, server)
+	routing.pins = []string{pinOf(server)}
+
+	res, err := (&http.Client{Transport: newTestRoutingTransport(routing)}).Get(testAPIURL + "/tests/ping") //nolint:noctx
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	require.Equal(t, "alt.example.com:443", routing.route())
+}
+
+func TestAlternativeRouting_RejectsUnpinnedHost(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	routing := newTestAlternativeRouting(t, server)
+	routing.canReach = routing.ping
+
+	_, err := (&http.Client{Transport: newTestRoutingTransport(routing)}).Get(testAPIURL + "/tests/ping") //nolint:noctx
+	require.Error(t, err)
+	require.Empty(t, routing.route())
+}
+
+func TestParseTXTAnswers_RejectsFailedQuery(t *testing.T) {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError})
+	response, err := builder.Finish()
+	require.NoError(t, err)
+
+	_, err = parseTXTAnswers(response)
+	require.Error(t, err)
+}
+
+// newTestAlternativeRouting returns a routing whose API servers are unreachable and whose only alternative host,
+// alt.example.com, is server.
+func newTestAlternativeRouting(t *testing.T, server *httptest.Server) *alternativeRouting {
+	routing, err := newAlternativeRouting(testAPIURL, newDialer(IPPreferenceAuto), nil, async.NoopPanicHandler{})
+	require.NoError(t, err)
+
+	routing.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address != "alt.example.com:443" {
+			return nil, errors.New("blocked")
+		}
+
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}
+	routing.lookup = func(context.Context, string) ([]string, error) {
+		return []string{"alt.example.com"}, nil
+	}
+	routing.canReach = func(_ context.Context, address string) bool {
+		return address == "alt.example.com:443"
+	}
+
+	return routing
+}
+
+func newTestRoutingTransport(routing *alternativeRouting) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert
+	routing.configureTransport(transport)
+
+	return transport
+}
+
+func pinOf(server *httptest.Server) string {
+	sum := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
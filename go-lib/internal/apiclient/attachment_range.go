@@ -0,0 +1,87 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The API client does not expose request headers or response status codes for raw downloads. Byte ranges are instead
+// requested through the context: the RangeTransport adds the Range header to the requests whose context carries a
+// byteRange and records whether the server honoured it.
+
+type byteRangeKey struct{}
+
+// byteRange describes a request for the content of a resource starting at offset.
+type byteRange struct {
+	offset    int64
+	responded bool // Whether the server answered the request.
+	partial   bool // Whether the server answered with the requested range rather than the full content.
+}
+
+var errRangeMismatch = errors.New("server returned an unexpected content range")
+
+func withByteRange(ctx context.Context, r *byteRange) context.Context {
+	return context.WithValue(ctx, byteRangeKey{}, r)
+}
+
+// RangeTransport is an http.RoundTripper that adds byte range support to the requests made with withByteRange.
+type RangeTransport struct {
+	base http.RoundTripper
+}
+
+func NewRangeTransport(base http.RoundTripper) *RangeTransport {
+	return &RangeTransport{base: base}
+}
+
+func (t *RangeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r, ok := req.Context().Value(byteRangeKey{}).(*byteRange)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	if r.offset > 0 {
+		req = req.Clone(req.Context())
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		// Ranges apply to the encoded content, prevent the transport from transparently decompressing it.
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r.responded = true
+	r.partial = false
+
+	if r.offset > 0 && res.StatusCode == http.StatusPartialContent {
+		if !strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", r.offset)) {
+			_ = res.Body.Close()
+			return nil, fmt.Errorf("%w: '%v'", errRangeMismatch, res.Header.Get("Content-Range"))
+		}
+
+		r.partial = true
+	}
+
+	return res, nil
+}
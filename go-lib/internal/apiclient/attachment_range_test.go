@@ -0,0 +1,113 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+// newFlakyAttachmentServer serves content, but interrupts the first download halfway through.
+func newFlakyAttachmentServer(t *testing.T, content []byte, supportsRange bool) (*httptest.Server, *[]string) {
+	var (
+		requests int
+		ranges   []string
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		ranges = append(ranges, r.Header.Get("Range"))
+
+		if requests == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			_, _ = w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+
+		if !supportsRange {
+			r.Header.Del("Range")
+		}
+
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server, &ranges
+}
+
+func expectAttachmentDownloads(client *MockClient, url string) {
+	httpClient := &http.Client{Transport: NewRangeTransport(http.DefaultTransport)}
+
+	client.EXPECT().GetAttachmentInto(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(
+		func(ctx context.Context, _ string, reader io.ReaderFrom) error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return err
+			}
+
+			res, err := httpClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode >= 400 {
+				return &proton.APIError{Status: res.StatusCode}
+			}
+
+			_, err = reader.ReadFrom(res.Body)
+			return err
+		},
+	)
+}
+
+func TestGetAttachmentInto_ResumesWithRange(t *testing.T) {
+	for _, supportsRange := range []bool{true, false} {
+		mockCtrl := gomock.NewController(t)
+		strategy := NewMockRetryStrategy(mockCtrl)
+		mockClient := NewMockClient(mockCtrl)
+
+		content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+		server, ranges := newFlakyAttachmentServer(t, content, supportsRange)
+
+		expectAttachmentDownloads(mockClient, server.URL)
+		strategy.EXPECT().HandleRetry(gomock.Any(), gomock.Any()).Times(1)
+
+		client := NewAutoRetryClient(mockClient, &mockRetryStrategyBuilder{s: strategy})
+
+		var result bytes.Buffer
+		require.NoError(t, client.GetAttachmentInto(context.Background(), "attID", &result))
+		require.Equal(t, content, result.Bytes())
+
+		require.Len(t, *ranges, 2)
+		require.Empty(t, (*ranges)[0])
+		require.Regexp(t, `^bytes=[1-9][0-9]*-$`, (*ranges)[1])
+	}
+}
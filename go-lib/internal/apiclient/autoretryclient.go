@@ -18,6 +18,7 @@
 package apiclient
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
@@ -51,13 +52,34 @@ func (a *AutoRetryClientBuilder) NewClient(
 ) (Client, proton.Auth, error) {
 	retryStrategy := a.retryStrategyBuilder.NewRetryStrategy()
 	for {
-		client, auth, err := a.builder.NewClient(ctx, username, password, hvToken)
+		retryAfter := &retryAfter{}
+
+		client, auth, err := a.builder.NewClient(withRetryAfter(ctx, retryAfter), username, password, hvToken)
+		if err != nil {
+			if !isRetrieableError(err) {
+				return nil, proton.Auth{}, err
+			}
+
+			retryStrategy.HandleRetry(ctx, retryAfter.wrap(err))
+			continue
+		}
+
+		return client, auth, nil
+	}
+}
+
+func (a *AutoRetryClientBuilder) NewClientWithRefresh(ctx context.Context, uid, refreshToken string) (Client, proton.Auth, error) {
+	retryStrategy := a.retryStrategyBuilder.NewRetryStrategy()
+	for {
+		retryAfter := &retryAfter{}
+
+		client, auth, err := a.builder.NewClientWithRefresh(withRetryAfter(ctx, retryAfter), uid, refreshToken)
 		if err != nil {
 			if !isRetrieableError(err) {
 				return nil, proton.Auth{}, err
 			}
 
-			retryStrategy.HandleRetry(ctx)
+			retryStrategy.HandleRetry(ctx, retryAfter.wrap(err))
 			continue
 		}
 
@@ -82,6 +104,10 @@ func NewAutoRetryClient(client Client, builder RetryStrategyBuilder) *AutoRetryC
 	return &AutoRetryClient{client: client, retryStrategyBuilder: builder}
 }
 
+func (arc *AutoRetryClient) AddAuthHandler(handler proton.AuthHandler) {
+	arc.client.AddAuthHandler(handler)
+}
+
 func (arc *AutoRetryClient) Auth2FA(ctx context.Context, req proton.Auth2FAReq) error {
 	return arc.repeatRequest(ctx, func(ctx context.Context, client Client) error {
 		return client.Auth2FA(ctx, req)
@@ -122,6 +148,12 @@ func (arc *AutoRetryClient) CreateLabel(ctx context.Context, req proton.CreateLa
 	})
 }
 
+func (arc *AutoRetryClient) DeleteLabel(ctx context.Context, labelID string) error {
+	return arc.repeatRequest(ctx, func(ctx context.Context, client Client) error {
+		return client.DeleteLabel(ctx, labelID)
+	})
+}
+
 func (arc *AutoRetryClient) GetAddresses(ctx context.Context) ([]proton.Address, error) {
 	return repeatRequestTyped(ctx, arc, func(ctx context.Context, client Client) ([]proton.Address, error) {
 		return client.GetAddresses(ctx)
@@ -168,10 +200,63 @@ func (arc *AutoRetryClient) GetMessageMetadataPage(
 	})
 }
 
+// GetAttachmentInto downloads the attachment. When the download fails after part of the content was received, only the
+// remaining bytes are requested on retry. If the server does not honour the byte range the whole content is downloaded
+// again.
 func (arc *AutoRetryClient) GetAttachmentInto(ctx context.Context, attachmentID string, reader io.ReaderFrom) error {
-	return arc.repeatRequest(ctx, func(ctx context.Context, client Client) error {
-		return client.GetAttachmentInto(ctx, attachmentID, reader)
-	})
+	var (
+		received      bytes.Buffer
+		rangeDisabled bool
+	)
+
+	retryStrategy := arc.retryStrategyBuilder.NewRetryStrategy()
+
+	for {
+		state := &byteRange{}
+		if !rangeDisabled {
+			state.offset = int64(received.Len())
+		}
+
+		var part bytes.Buffer
+
+		retryAfter := &retryAfter{}
+
+		err := arc.client.GetAttachmentInto(withRetryAfter(withByteRange(ctx, state), retryAfter), attachmentID, &part)
+
+		if state.responded {
+			if !state.partial {
+				received.Reset()
+			}
+
+			received.Write(part.Bytes())
+		}
+
+		if err == nil {
+			_, err := reader.ReadFrom(&received)
+			return err
+		}
+
+		if !isRetrieableError(err) {
+			if state.offset == 0 || ctx.Err() != nil {
+				return err
+			}
+
+			logrus.WithError(err).WithField("attID", attachmentID).Debug("Ranged attachment request failed, restarting download")
+			rangeDisabled = true
+			received.Reset()
+
+			continue
+		}
+
+		if received.Len() != 0 {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"attID":    attachmentID,
+				"received": received.Len(),
+			}).Debug("Attachment download interrupted, resuming")
+		}
+
+		retryStrategy.HandleRetry(ctx, retryAfter.wrap(err))
+	}
 }
 
 func (arc *AutoRetryClient) ImportMessages(
@@ -185,16 +270,30 @@ func (arc *AutoRetryClient) ImportMessages(
 	})
 }
 
+func (arc *AutoRetryClient) DeleteMessage(ctx context.Context, messageIDs ...string) error {
+	return arc.repeatRequest(ctx, func(ctx context.Context, client Client) error {
+		return client.DeleteMessage(ctx, messageIDs...)
+	})
+}
+
+func (arc *AutoRetryClient) CreateContacts(ctx context.Context, req proton.CreateContactsReq) ([]proton.CreateContactsRes, error) {
+	return repeatRequestTyped(ctx, arc, func(ctx context.Context, client Client) ([]proton.CreateContactsRes, error) {
+		return client.CreateContacts(ctx, req)
+	})
+}
+
 func (arc *AutoRetryClient) repeatRequest(ctx context.Context, req func(ctx context.Context, client Client) error) error {
 	retryStrategy := arc.retryStrategyBuilder.NewRetryStrategy()
 	for {
-		err := req(ctx, arc.client)
+		retryAfter := &retryAfter{}
+
+		err := req(withRetryAfter(ctx, retryAfter), arc.client)
 		if err != nil {
 			if !isRetrieableError(err) {
 				return err
 			}
 
-			retryStrategy.HandleRetry(ctx)
+			retryStrategy.HandleRetry(ctx, retryAfter.wrap(err))
 			continue
 		}
 
@@ -215,6 +314,12 @@ func repeatRequestTyped[T any](ctx context.Context, arc *AutoRetryClient, req fu
 }
 
 func isRetrieableError(err error) bool {
+	// Checked first as it is wrapped in the proton network error.
+	if interferenceErr := new(NetworkInterferenceError); errors.As(err, &interferenceErr) {
+		logrus.WithError(err).Error("Connection to the API servers is intercepted")
+		return false
+	}
+
 	if netErr := new(proton.NetError); errors.As(err, &netErr) {
 		// Context cancelled is wrapped in the proton network error. Check here to make sure.
 		if errors.Is(netErr.Cause, context.Canceled) {
@@ -255,7 +360,8 @@ type RetryStrategyBuilder interface {
 
 // RetryStrategy is meant to be used in the scope of on goroutine for the lifetime of one specific request.
 type RetryStrategy interface {
-	HandleRetry(ctx context.Context)
+	// HandleRetry waits before the request that failed with err is repeated.
+	HandleRetry(ctx context.Context, err error)
 }
 
 type SleepRetryStrategyBuilder struct{}
@@ -268,17 +374,31 @@ type SleepRetryStrategy struct {
 	index int
 }
 
-func (s *SleepRetryStrategy) HandleRetry(ctx context.Context) {
-	sleepCtx(ctx, s.nextWaitTime())
+// HandleRetry waits for the delay requested by the server if any, and backs off exponentially otherwise. The waits
+// of rate limited requests are reported to the observer of the context, see WithRateLimitObserver.
+func (s *SleepRetryStrategy) HandleRetry(ctx context.Context, err error) {
+	waitTime := s.nextWaitTime(err)
+
+	if isRateLimitError(err) {
+		logrus.WithError(err).WithField("wait", waitTime.String()).Info("Rate limited by the server, waiting before retrying")
+		notifyRateLimited(ctx, waitTime)
+	}
+
+	sleepCtx(ctx, waitTime)
 }
 
-func (s *SleepRetryStrategy) nextWaitTime() time.Duration {
+func (s *SleepRetryStrategy) nextWaitTime(err error) time.Duration {
+	// The jitter prevents the parallel requests rate limited together from being repeated together.
+	if rateLimitErr := new(RateLimitError); errors.As(err, &rateLimitErr) {
+		return rateLimitErr.RetryAfter + jitter(rateLimitErr.RetryAfter/10+time.Second)
+	}
+
 	last := len(expWaitTimes) - 1
 	if s.index >= last {
 		s.index = last
 	}
 
-	nextWaitTime := expWaitTimes[s.index] + jitter(10)
+	nextWaitTime := expWaitTimes[s.index] + jitter(expWaitTimes[s.index]/4)
 
 	s.index++
 
@@ -295,8 +415,9 @@ var expWaitTimes = []time.Duration{
 	600 * time.Second,
 }
 
-func jitter(max int) time.Duration {
-	return time.Duration(rand.Intn(max)) * time.Second //nolint:gosec
+// jitter returns a random duration in [0, max).
+func jitter(max time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(max))) //nolint:gosec
 }
 
 func sleepCtx(ctx context.Context, duration time.Duration) {
@@ -102,7 +102,7 @@ func TestAutoRetryClientRepetition(t *testing.T) {
 
 			call1 := mockClient.EXPECT().GetMessage(gomock.Any(), gomock.Any()).Times(1).Return(proton.Message{}, test.err)
 			if test.expectRetry {
-				strategy.EXPECT().HandleRetry(gomock.Any()).Times(1)
+				strategy.EXPECT().HandleRetry(gomock.Any(), gomock.Any()).Times(1)
 
 				mockClient.EXPECT().GetMessage(gomock.Any(), gomock.Any()).Times(1).After(call1).Return(proton.Message{}, nil)
 			}
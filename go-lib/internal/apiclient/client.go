@@ -27,11 +27,15 @@ import (
 
 type Builder interface {
 	NewClient(ctx context.Context, username string, password []byte, hvToken *proton.APIHVDetails) (Client, proton.Auth, error)
+	// NewClientWithRefresh resumes a session of a previous run from its refresh token, which is then replaced.
+	NewClientWithRefresh(ctx context.Context, uid, refreshToken string) (Client, proton.Auth, error)
 	SendUnauthTelemetry(ctx context.Context, telemetryData proton.SendStatsReq) error
 	Close()
 }
 
 type Client interface {
+	// AddAuthHandler calls handler with the new tokens each time the session is refreshed.
+	AddAuthHandler(handler proton.AuthHandler)
 	Auth2FA(ctx context.Context, req proton.Auth2FAReq) error
 	AuthDelete(ctx context.Context) error
 	GetUserWithHV(ctx context.Context, hv *proton.APIHVDetails) (proton.User, error)
@@ -40,6 +44,7 @@ type Client interface {
 
 	GetLabels(ctx context.Context, labelTypes ...proton.LabelType) ([]proton.Label, error)
 	CreateLabel(ctx context.Context, req proton.CreateLabelReq) (proton.Label, error)
+	DeleteLabel(ctx context.Context, labelID string) error
 	GetAddresses(ctx context.Context) ([]proton.Address, error)
 
 	GetGroupedMessageCount(ctx context.Context) ([]proton.MessageGroupCount, error)
@@ -47,6 +52,9 @@ type Client interface {
 	GetMessageMetadataPage(ctx context.Context, page, pageSize int, filter proton.MessageFilter) ([]proton.MessageMetadata, error)
 	GetAttachmentInto(ctx context.Context, attachmentID string, reader io.ReaderFrom) error
 	ImportMessages(ctx context.Context, addrKR *crypto.KeyRing, workers, buffer int, req ...proton.ImportReq) (proton.ImportResStream, error)
+	DeleteMessage(ctx context.Context, messageIDs ...string) error
+
+	CreateContacts(ctx context.Context, req proton.CreateContactsReq) ([]proton.CreateContactsRes, error)
 
 	// Required for telemetry
 	GetUserSettings(ctx context.Context) (proton.UserSettings, error)
@@ -0,0 +1,223 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// MaxClockSkew is the difference between the local clock and the clock of the servers above which the user is warned.
+// A wrong local clock breaks the validation of the TLS certificates and of the OpenPGP signatures, which surfaces as a
+// failed login.
+const MaxClockSkew = 5 * time.Minute
+
+// MaxCompensatedClockSkew is the largest skew compensated. The time of the servers decides when the certificates are
+// valid: the bound limits how far back an expired certificate could be made valid again.
+const MaxCompensatedClockSkew = 48 * time.Hour
+
+// clockSkewProbeTimeout bounds the request measuring the skew before the first API request, see measureClockSkew.
+const clockSkewProbeTimeout = 15 * time.Second
+
+var ErrClockSkewTooLarge = fmt.Errorf("the clock of this computer differs from the time of the Proton servers by more than %v, "+
+	"correct the date, time and time zone settings of the system", MaxCompensatedClockSkew)
+
+// clockSkew measures the offset of the local clock from the Date header of the API responses. The OpenPGP operations
+// already use the time of the servers, see crypto.UpdateTime. When compensating, the TLS certificates are validated
+// at the time of the servers as well.
+type clockSkew struct {
+	lock         sync.Mutex
+	offset       time.Duration // Server time minus local time.
+	compensation time.Duration // The offset applied when compensating, never more than MaxCompensatedClockSkew.
+	measured     bool
+	reported     bool
+	compensate   bool
+	onSkew       func(skew time.Duration)
+}
+
+func newClockSkew(compensate bool, onSkew func(skew time.Duration)) *clockSkew {
+	return &clockSkew{compensate: compensate, onSkew: onSkew}
+}
+
+// observe is a post request hook recording the skew from the Date header of the response.
+func (c *clockSkew) observe(_ *resty.Client, res *resty.Response) error {
+	serverTime, err := http.ParseTime(res.Header().Get("Date"))
+	if err != nil {
+		return nil //nolint:nilerr // Responses without date are ignored.
+	}
+
+	c.record(serverTime, res.ReceivedAt())
+
+	return nil
+}
+
+// record updates the skew. The user is warned once, the first time the skew exceeds MaxClockSkew. A skew above
+// MaxCompensatedClockSkew is not compensated, the previous compensation is kept.
+func (c *clockSkew) record(serverTime, localTime time.Time) {
+	// The Date header has a resolution of one second.
+	offset := serverTime.Sub(localTime.Truncate(time.Second))
+
+	c.lock.Lock()
+	c.offset = offset
+	c.measured = true
+
+	if absDuration(offset) <= MaxCompensatedClockSkew {
+		c.compensation = offset
+	}
+
+	report := !c.reported && absDuration(offset) > MaxClockSkew
+	if report {
+		c.reported = true
+	}
+	c.lock.Unlock()
+
+	if !report {
+		return
+	}
+
+	logrus.WithField("skew", offset.String()).WithField("compensated", c.compensate).Warn(
+		"The clock of this computer differs significantly from the time of the Proton servers, please correct the date, " +
+			"time and time zone settings of the system")
+
+	if c.onSkew != nil {
+		c.onSkew(offset)
+	}
+}
+
+// get returns the last measured skew.
+func (c *clockSkew) get() (time.Duration, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.offset, c.measured
+}
+
+// now returns the local time, corrected by the skew when compensating.
+func (c *clockSkew) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.compensate {
+		return time.Now()
+	}
+
+	return time.Now().Add(c.compensation)
+}
+
+// configureTransport makes the transport of the API requests validate the TLS certificates at the time of the servers
+// when compensating.
+func (c *clockSkew) configureTransport(transport *http.Transport) {
+	if !c.compensate {
+		return
+	}
+
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, Time: c.now}
+}
+
+// measureClockSkew records the skew before the first API request, whose TLS handshake fails if the local clock is too
+// far off. The handshake of the probe cannot verify the certificates at the local time either: they are verified
+// against roots, nil for the system ones, at the time of the Date header of the response, which is only trusted if
+// they are valid then. ErrClockSkewTooLarge is returned above MaxCompensatedClockSkew.
+func (c *clockSkew) measureClockSkew(ctx context.Context, apiURL string, dialer *dialer, proxy proxyFunc, roots *x509.CertPool) error {
+	ctx, cancel := context.WithTimeout(ctx, clockSkewProbeTimeout)
+	defer cancel()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()      //nolint:forcetypeassert
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = proxy
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(apiURL, "/")+"/tests/ping", nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to measure clock skew: %w", err)
+	}
+
+	localTime := time.Now()
+	_ = res.Body.Close()
+
+	serverTime, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return fmt.Errorf("failed to measure clock skew: %w", err)
+	}
+
+	if res.TLS != nil {
+		if err := verifyCertificatesAt(res.TLS, req.URL.Hostname(), roots, serverTime); err != nil {
+			return fmt.Errorf("failed to measure clock skew, the certificate of the server is not valid at its time: %w", err)
+		}
+	}
+
+	if absDuration(serverTime.Sub(localTime.Truncate(time.Second))) > MaxCompensatedClockSkew {
+		return ErrClockSkewTooLarge
+	}
+
+	c.record(serverTime, localTime)
+
+	return nil
+}
+
+// verifyCertificatesAt verifies the certificate chain of a connection to host at the given time.
+func verifyCertificatesAt(state *tls.ConnectionState, host string, roots *x509.CertPool, at time.Time) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+	})
+
+	return err
+}
+
+// isCertificateTimeError returns whether err is caused by a TLS certificate that is not valid at the local time, which
+// usually means that the local clock is wrong.
+func isCertificateTimeError(err error) bool {
+	var certErr x509.CertificateInvalidError
+
+	return errors.As(err, &certErr) && certErr.Reason == x509.Expired
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+
+	return d
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClockSkew_ReportsOnce(t *testing.T) {
+	var reported []time.Duration
+
+	skew := newClockSkew(false, func(skew time.Duration) { reported = append(reported, skew) })
+
+	local := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	skew.record(local.Add(time.Minute), local)
+	require.Empty(t, reported)
+
+	offset, ok := skew.get()
+	require.True(t, ok)
+	require.Equal(t, time.Minute, offset)
+
+	skew.record(local.Add(-time.Hour), local)
+	skew.record(local.Add(time.Hour), local)
+	require.Equal(t, []time.Duration{-time.Hour}, reported)
+
+	offset, _ = skew.get()
+	require.Equal(t, time.Hour, offset)
+}
+
+func TestClockSkew_Now(t *testing.T) {
+	local := time.Now()
+
+	skew := newClockSkew(false, nil)
+	skew.record(local.Add(24*time.Hour), local)
+	require.WithinDuration(t, time.Now(), skew.now(), time.Minute)
+
+	skew = newClockSkew(true, nil)
+	skew.record(local.Add(24*time.Hour), local)
+	require.WithinDuration(t, time.Now().Add(24*time.Hour), skew.now(), time.Minute)
+}
+
+func TestClockSkew_CompensationBound(t *testing.T) {
+	local := time.Now()
+
+	skew := newClockSkew(true, nil)
+	skew.record(local.Add(time.Hour), local)
+	skew.record(local.Add(-72*time.Hour), local)
+
+	// The skew is reported, the compensation stays within the bound.
+	offset, ok := skew.get()
+	require.True(t, ok)
+	require.Equal(t, -72*time.Hour, offset.Round(time.Hour))
+	require.WithinDuration(t, time.Now().Add(time.Hour), skew.now(), time.Minute)
+}
+
+// newClockSkewServer returns a TLS server whose Date header is offset from the local time, and the roots trusting it.
+func newClockSkewServer(t *testing.T, offset time.Duration) (*httptest.Server, *x509.CertPool) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Date", time.Now().Add(offset).UTC().Format(http.TimeFormat))
+	}))
+	t.Cleanup(server.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	return server, roots
+}
+
+func TestClockSkew_Measure(t *testing.T) {
+	server, roots := newClockSkewServer(t, 24*time.Hour)
+
+	skew := newClockSkew(true, nil)
+	require.NoError(t, skew.measureClockSkew(context.Background(), server.URL, newDialer(IPPreferenceAuto), nil, roots))
+	require.WithinDuration(t, time.Now().Add(24*time.Hour), skew.now(), time.Minute)
+}
+
+func TestClockSkew_Measure_UntrustedCertificate(t *testing.T) {
+	server, _ := newClockSkewServer(t, 24*time.Hour)
+
+	// The Date of a server whose certificate is not trusted is ignored.
+	skew := newClockSkew(true, nil)
+	require.Error(t, skew.measureClockSkew(context.Background(), server.URL, newDialer(IPPreferenceAuto), nil, x509.NewCertPool()))
+
+	_, ok := skew.get()
+	require.False(t, ok)
+	require.WithinDuration(t, time.Now(), skew.now(), time.Minute)
+}
+
+func TestClockSkew_Measure_TooLarge(t *testing.T) {
+	server, roots := newClockSkewServer(t, -30*24*time.Hour)
+
+	skew := newClockSkew(true, nil)
+	err := skew.measureClockSkew(context.Background(), server.URL, newDialer(IPPreferenceAuto), nil, roots)
+	require.ErrorIs(t, err, ErrClockSkewTooLarge)
+	require.WithinDuration(t, time.Now(), skew.now(), time.Minute)
+}
+
+func TestIsCertificateTimeError(t *testing.T) {
+	expired := x509.CertificateInvalidError{Reason: x509.Expired}
+	require.True(t, isCertificateTimeError(fmt.Errorf("handshake: %w", expired)))
+	require.False(t, isCertificateTimeError(x509.CertificateInvalidError{Reason: x509.NotAuthorizedToSign}))
+	require.False(t, isCertificateTimeError(fmt.Errorf("other")))
+}
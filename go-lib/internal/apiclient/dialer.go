@@ -0,0 +1,168 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// IPPreference selects the IP versions used to connect to the API servers.
+type IPPreference int
+
+const (
+	IPPreferenceAuto IPPreference = iota // Both, racing the addresses of the two versions, see newDialer.
+	IPPreferenceIPv4                     // IPv4 only, for the networks whose IPv6 connectivity is broken.
+	IPPreferenceIPv6                     // IPv6 only.
+)
+
+func (p IPPreference) String() string {
+	switch p {
+	case IPPreferenceAuto:
+		return "auto"
+	case IPPreferenceIPv4:
+		return "ipv4"
+	case IPPreferenceIPv6:
+		return "ipv6"
+	default:
+		return "unknown"
+	}
+}
+
+func IPPreferenceFromString(s string) (IPPreference, error) {
+	switch strings.ToLower(s) {
+	case "", "auto":
+		return IPPreferenceAuto, nil
+	case "ipv4", "4":
+		return IPPreferenceIPv4, nil
+	case "ipv6", "6":
+		return IPPreferenceIPv6, nil
+	default:
+		return IPPreferenceAuto, fmt.Errorf("unknown IP version '%v', expected auto, ipv4 or ipv6", s)
+	}
+}
+
+const (
+	// happyEyeballsDelay is the head start given to the first address of the preferred IP version before an address of
+	// the other version is tried in parallel, as recommended by RFC 8305.
+	happyEyeballsDelay = 250 * time.Millisecond
+
+	// dialTimeout bounds the connection to the servers, shared between all their addresses.
+	dialTimeout = 30 * time.Second
+)
+
+// dialer connects to the API servers with the IP versions allowed by its preference, and logs the path of the
+// connections whenever it changes so that the logs show how the servers are reached.
+type dialer struct {
+	dialer     net.Dialer
+	preference IPPreference
+
+	lock     sync.Mutex
+	lastPath string
+}
+
+// newDialer returns a dialer implementing happy eyeballs when both IP versions are allowed: a broken IPv6 route no
+// longer stalls the connections until the system gives up, as IPv4 is tried as well after happyEyeballsDelay.
+func newDialer(preference IPPreference) *dialer {
+	return &dialer{
+		dialer: net.Dialer{
+			Timeout:       dialTimeout,
+			KeepAlive:     30 * time.Second,
+			FallbackDelay: happyEyeballsDelay,
+		},
+		preference: preference,
+	}
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	network = d.restrictNetwork(network)
+	start := time.Now()
+
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"address":    addr,
+			"preference": d.preference.String(),
+			"elapsed":    time.Since(start).String(),
+		}).Warn("Failed to connect to the API servers")
+
+		return nil, err
+	}
+
+	d.recordPath(addr, conn.RemoteAddr(), time.Since(start))
+
+	return conn, nil
+}
+
+// restrictNetwork narrows the TCP networks to the IP version of the preference.
+func (d *dialer) restrictNetwork(network string) string {
+	if network != "tcp" {
+		return network
+	}
+
+	switch d.preference {
+	case IPPreferenceIPv4:
+		return "tcp4"
+	case IPPreferenceIPv6:
+		return "tcp6"
+	case IPPreferenceAuto:
+	}
+
+	return network
+}
+
+func (d *dialer) recordPath(addr string, remote net.Addr, elapsed time.Duration) {
+	path := ipVersionOf(remote)
+
+	d.lock.Lock()
+	changed := path != d.lastPath
+	d.lastPath = path
+	d.lock.Unlock()
+
+	log := logrus.WithFields(logrus.Fields{
+		"address":    addr,
+		"remote":     remote.String(),
+		"preference": d.preference.String(),
+		"elapsed":    elapsed.String(),
+	})
+
+	if changed {
+		log.Infof("Connected to the API servers over %v", path)
+	} else {
+		log.Debugf("Connected to the API servers over %v", path)
+	}
+}
+
+func ipVersionOf(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.Network()
+	}
+
+	if tcpAddr.IP.To4() != nil {
+		return "IPv4"
+	}
+
+	return "IPv6"
+}
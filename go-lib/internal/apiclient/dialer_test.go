@@ -0,0 +1,80 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPPreferenceFromString(t *testing.T) {
+	for _, preference := range []IPPreference{IPPreferenceAuto, IPPreferenceIPv4, IPPreferenceIPv6} {
+		parsed, err := IPPreferenceFromString(preference.String())
+		require.NoError(t, err)
+		require.Equal(t, preference, parsed)
+	}
+
+	parsed, err := IPPreferenceFromString("")
+	require.NoError(t, err)
+	require.Equal(t, IPPreferenceAuto, parsed)
+
+	_, err = IPPreferenceFromString("ipv5")
+	require.Error(t, err)
+}
+
+func TestDialer_RestrictsIPVersion(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			_ = conn.Close()
+		}
+	}()
+
+	for _, preference := range []IPPreference{IPPreferenceAuto, IPPreferenceIPv4} {
+		d := newDialer(preference)
+
+		conn, err := d.DialContext(context.Background(), "tcp", listener.Addr().String())
+		require.NoError(t, err)
+		require.Equal(t, "IPv4", ipVersionOf(conn.RemoteAddr()))
+		require.NoError(t, conn.Close())
+		require.Equal(t, "IPv4", d.lastPath)
+	}
+
+	// An IPv4 address cannot be reached over IPv6.
+	_, err = newDialer(IPPreferenceIPv6).DialContext(context.Background(), "tcp", listener.Addr().String())
+	require.Error(t, err)
+
+	require.Equal(t, "udp", newDialer(IPPreferenceIPv6).restrictNetwork("udp"))
+	require.Equal(t, "tcp6", newDialer(IPPreferenceIPv6).restrictNetwork("tcp"))
+}
+
+func TestIPVersionOf(t *testing.T) {
+	require.Equal(t, "IPv4", ipVersionOf(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}))
+	require.Equal(t, "IPv6", ipVersionOf(&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}))
+}
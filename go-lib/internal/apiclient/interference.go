@@ -0,0 +1,183 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// InterferenceKind tells what stands between the client and the API servers.
+type InterferenceKind int
+
+const (
+	// InterferenceCaptivePortal is a network that answers with its own page until the user signs in, as in hotels and
+	// airports.
+	InterferenceCaptivePortal InterferenceKind = iota
+	// InterferenceTLSInterception is a proxy or security software decrypting the traffic with its own certificate, as
+	// on some corporate networks.
+	InterferenceTLSInterception
+)
+
+func (k InterferenceKind) String() string {
+	switch k {
+	case InterferenceCaptivePortal:
+		return "captive portal"
+	case InterferenceTLSInterception:
+		return "TLS interception"
+	default:
+		return "unknown"
+	}
+}
+
+// NetworkInterferenceError is returned when the connection to the API servers is intercepted. Repeating the request
+// does not help, the user has to act on the network first, see Hint.
+type NetworkInterferenceError struct {
+	Kind   InterferenceKind
+	Detail string // The certificate issuer or the page the request was redirected to, when known.
+	Err    error  // The error of the request, nil for the intercepted responses.
+}
+
+func (e *NetworkInterferenceError) Error() string {
+	var msg string
+
+	switch e.Kind {
+	case InterferenceCaptivePortal:
+		msg = "the network answered instead of the Proton servers, it probably requires signing in through a captive portal"
+	case InterferenceTLSInterception:
+		msg = "the connection to the Proton servers is intercepted by a proxy or security software"
+	default:
+		msg = "the connection to the Proton servers is intercepted"
+	}
+
+	if len(e.Detail) != 0 {
+		msg += " (" + e.Detail + ")"
+	}
+
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+
+	return msg + ". " + e.Hint()
+}
+
+func (e *NetworkInterferenceError) Unwrap() error {
+	return e.Err
+}
+
+// Hint returns what the user can do to reach the servers.
+func (e *NetworkInterferenceError) Hint() string {
+	switch e.Kind {
+	case InterferenceCaptivePortal:
+		return "Open a web browser to sign in to the network, or use another network, then try again"
+	case InterferenceTLSInterception:
+		return "Disable the HTTPS scanning of the antivirus or ask the network administrator to exclude the Proton " +
+			"domains from the TLS inspection, or use another network, then try again"
+	default:
+		return "Use another network, then try again"
+	}
+}
+
+// InterferenceTransport is an http.RoundTripper that turns the symptoms of a captive portal or of a TLS interception
+// into a NetworkInterferenceError. The API never answers with HTML pages nor redirects to other hosts, and its
+// certificates are signed by public authorities.
+type InterferenceTransport struct {
+	base http.RoundTripper
+}
+
+func NewInterferenceTransport(base http.RoundTripper) *InterferenceTransport {
+	return &InterferenceTransport{base: base}
+}
+
+func (t *InterferenceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		if interferenceErr := detectCertificateInterference(err); interferenceErr != nil {
+			return nil, interferenceErr
+		}
+
+		return nil, err
+	}
+
+	if interferenceErr := detectResponseInterference(req, res); interferenceErr != nil {
+		_ = res.Body.Close()
+		return nil, interferenceErr
+	}
+
+	return res, nil
+}
+
+// detectCertificateInterference returns nil if err is not caused by an unexpected certificate.
+func detectCertificateInterference(err error) *NetworkInterferenceError {
+	if authorityErr := new(x509.UnknownAuthorityError); errors.As(err, authorityErr) {
+		var detail string
+		if authorityErr.Cert != nil {
+			detail = "certificate issued by " + authorityErr.Cert.Issuer.String()
+		}
+
+		return &NetworkInterferenceError{Kind: InterferenceTLSInterception, Detail: detail, Err: err}
+	}
+
+	// Captive portals usually answer with the certificate of their own sign in page.
+	if hostnameErr := new(x509.HostnameError); errors.As(err, hostnameErr) {
+		var detail string
+		if hostnameErr.Certificate != nil {
+			detail = "certificate of " + hostnameErr.Certificate.Subject.CommonName
+		}
+
+		return &NetworkInterferenceError{Kind: InterferenceCaptivePortal, Detail: detail, Err: err}
+	}
+
+	return nil
+}
+
+// detectResponseInterference returns nil if res can come from the API servers.
+func detectResponseInterference(req *http.Request, res *http.Response) *NetworkInterferenceError {
+	if res.StatusCode == http.StatusNetworkAuthenticationRequired {
+		return &NetworkInterferenceError{Kind: InterferenceCaptivePortal, Detail: res.Status}
+	}
+
+	if res.StatusCode >= 300 && res.StatusCode < 400 {
+		location, err := res.Location()
+		if err == nil && !strings.EqualFold(location.Hostname(), req.URL.Hostname()) {
+			return &NetworkInterferenceError{Kind: InterferenceCaptivePortal, Detail: "redirected to " + redactURL(location)}
+		}
+
+		return nil
+	}
+
+	// The error pages of the servers in front of the API can be HTML, its successful answers never are.
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if err == nil && mediaType == "text/html" {
+			return &NetworkInterferenceError{Kind: InterferenceCaptivePortal, Detail: fmt.Sprintf("HTML page received from %v", req.URL.Host)}
+		}
+	}
+
+	return nil
+}
+
+// redactURL drops the query of the portal URLs, which can identify the device.
+func redactURL(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + u.EscapedPath()
+}
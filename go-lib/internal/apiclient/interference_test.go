@@ -0,0 +1,138 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterferenceTransport(t *testing.T) {
+	type test struct {
+		name    string
+		handler http.HandlerFunc
+		kind    InterferenceKind
+		detail  string
+	}
+
+	tests := []test{
+		{
+			name: "HTML",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				_, _ = w.Write([]byte("<html>Sign in</html>"))
+			},
+			kind:   InterferenceCaptivePortal,
+			detail: "HTML page received",
+		},
+		{
+			name: "Redirect",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "http://portal.example.com/login?mac=00:11:22", http.StatusFound)
+			},
+			kind:   InterferenceCaptivePortal,
+			detail: "redirected to http://portal.example.com/login",
+		},
+		{
+			name: "NetworkAuthenticationRequired",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusNetworkAuthenticationRequired)
+			},
+			kind:   InterferenceCaptivePortal,
+			detail: "511",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(test.handler)
+			defer server.Close()
+
+			client := &http.Client{Transport: NewInterferenceTransport(http.DefaultTransport)}
+
+			_, err := client.Get(server.URL + "/core/v4/features") //nolint:noctx
+
+			var interferenceErr *NetworkInterferenceError
+			require.ErrorAs(t, err, &interferenceErr)
+			require.Equal(t, test.kind, interferenceErr.Kind)
+			require.Contains(t, interferenceErr.Detail, test.detail)
+			require.NotContains(t, interferenceErr.Error(), "mac=")
+			require.Contains(t, interferenceErr.Error(), interferenceErr.Hint())
+		})
+	}
+}
+
+func TestInterferenceTransport_PassesAPIResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/core/v4/features", http.StatusFound)
+			return
+		}
+
+		if r.URL.Path == "/error" {
+			// The error pages of the proxies in front of the API.
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusBadGateway)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewInterferenceTransport(http.DefaultTransport)}
+
+	for _, path := range []string{"/core/v4/features", "/redirect", "/error"} {
+		res, err := client.Get(server.URL + path) //nolint:noctx
+		require.NoError(t, err, path)
+		require.NoError(t, res.Body.Close())
+	}
+}
+
+func TestInterferenceTransport_UnknownAuthority(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// The default transport does not trust the certificate of the test server.
+	client := &http.Client{Transport: NewInterferenceTransport(http.DefaultTransport)}
+
+	_, err := client.Get(server.URL) //nolint:noctx
+
+	var interferenceErr *NetworkInterferenceError
+	require.ErrorAs(t, err, &interferenceErr)
+	require.Equal(t, InterferenceTLSInterception, interferenceErr.Kind)
+	require.Contains(t, interferenceErr.Detail, "certificate issued by")
+}
+
+func TestIsRetrieableError_Interference(t *testing.T) {
+	err := &proton.NetError{Cause: &NetworkInterferenceError{Kind: InterferenceCaptivePortal}}
+	require.False(t, isRetrieableError(err))
+	require.False(t, isRetrieableError(fmt.Errorf("login: %w", err)))
+	require.True(t, isRetrieableError(&proton.NetError{Cause: errors.New("connection reset")}))
+}
@@ -71,6 +71,22 @@ func (mr *MockBuilderMockRecorder) NewClient(ctx, username, password, hvToken an
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewClient", reflect.TypeOf((*MockBuilder)(nil).NewClient), ctx, username, password, hvToken)
 }
 
+// NewClientWithRefresh mocks base method.
+func (m *MockBuilder) NewClientWithRefresh(ctx context.Context, uid, refreshToken string) (Client, proton.Auth, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NewClientWithRefresh", ctx, uid, refreshToken)
+	ret0, _ := ret[0].(Client)
+	ret1, _ := ret[1].(proton.Auth)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// NewClientWithRefresh indicates an expected call of NewClientWithRefresh.
+func (mr *MockBuilderMockRecorder) NewClientWithRefresh(ctx, uid, refreshToken any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewClientWithRefresh", reflect.TypeOf((*MockBuilder)(nil).NewClientWithRefresh), ctx, uid, refreshToken)
+}
+
 // SendUnauthTelemetry mocks base method.
 func (m *MockBuilder) SendUnauthTelemetry(ctx context.Context, telemetryData proton.SendStatsReq) error {
 	m.ctrl.T.Helper()
@@ -109,6 +125,18 @@ func (m *MockClient) EXPECT() *MockClientMockRecorder {
 	return m.recorder
 }
 
+// AddAuthHandler mocks base method.
+func (m *MockClient) AddAuthHandler(handler proton.AuthHandler) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "AddAuthHandler", handler)
+}
+
+// AddAuthHandler indicates an expected call of AddAuthHandler.
+func (mr *MockClientMockRecorder) AddAuthHandler(handler any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddAuthHandler", reflect.TypeOf((*MockClient)(nil).AddAuthHandler), handler)
+}
+
 // Auth2FA mocks base method.
 func (m *MockClient) Auth2FA(ctx context.Context, req proton.Auth2FAReq) error {
 	m.ctrl.T.Helper()
@@ -149,6 +177,21 @@ func (mr *MockClientMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockClient)(nil).Close))
 }
 
+// CreateContacts mocks base method.
+func (m *MockClient) CreateContacts(ctx context.Context, req proton.CreateContactsReq) ([]proton.CreateContactsRes, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateContacts", ctx, req)
+	ret0, _ := ret[0].([]proton.CreateContactsRes)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateContacts indicates an expected call of CreateContacts.
+func (mr *MockClientMockRecorder) CreateContacts(ctx, req any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateContacts", reflect.TypeOf((*MockClient)(nil).CreateContacts), ctx, req)
+}
+
 // CreateLabel mocks base method.
 func (m *MockClient) CreateLabel(ctx context.Context, req proton.CreateLabelReq) (proton.Label, error) {
 	m.ctrl.T.Helper()
@@ -164,6 +207,39 @@ func (mr *MockClientMockRecorder) CreateLabel(ctx, req any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateLabel", reflect.TypeOf((*MockClient)(nil).CreateLabel), ctx, req)
 }
 
+// DeleteLabel mocks base method.
+func (m *MockClient) DeleteLabel(ctx context.Context, labelID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteLabel", ctx, labelID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteLabel indicates an expected call of DeleteLabel.
+func (mr *MockClientMockRecorder) DeleteLabel(ctx, labelID any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteLabel", reflect.TypeOf((*MockClient)(nil).DeleteLabel), ctx, labelID)
+}
+
+// DeleteMessage mocks base method.
+func (m *MockClient) DeleteMessage(ctx context.Context, messageIDs ...string) error {
+	m.ctrl.T.Helper()
+	varargs := []any{ctx}
+	for _, a := range messageIDs {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "DeleteMessage", varargs...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteMessage indicates an expected call of DeleteMessage.
+func (mr *MockClientMockRecorder) DeleteMessage(ctx any, messageIDs ...any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]any{ctx}, messageIDs...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMessage", reflect.TypeOf((*MockClient)(nil).DeleteMessage), varargs...)
+}
+
 // GetAddresses mocks base method.
 func (m *MockClient) GetAddresses(ctx context.Context) ([]proton.Address, error) {
 	m.ctrl.T.Helper()
@@ -377,13 +453,13 @@ func (m *MockRetryStrategy) EXPECT() *MockRetryStrategyMockRecorder {
 }
 
 // HandleRetry mocks base method.
-func (m *MockRetryStrategy) HandleRetry(ctx context.Context) {
+func (m *MockRetryStrategy) HandleRetry(ctx context.Context, err error) {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "HandleRetry", ctx)
+	m.ctrl.Call(m, "HandleRetry", ctx, err)
 }
 
 // HandleRetry indicates an expected call of HandleRetry.
-func (mr *MockRetryStrategyMockRecorder) HandleRetry(ctx any) *gomock.Call {
+func (mr *MockRetryStrategyMockRecorder) HandleRetry(ctx, err any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleRetry", reflect.TypeOf((*MockRetryStrategy)(nil).HandleRetry), ctx)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleRetry", reflect.TypeOf((*MockRetryStrategy)(nil).HandleRetry), ctx, err)
 }
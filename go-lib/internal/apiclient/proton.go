@@ -19,10 +19,16 @@ package apiclient
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/ProtonMail/export-tool/internal"
 	"github.com/ProtonMail/export-tool/internal/hv"
@@ -39,19 +45,103 @@ var errKillSwitchEnabled = errors.New("killSwitchEnabled")
 type ProtonCallbacks interface {
 	OnNetworkRestored()
 	OnNetworkLost()
+	// OnClockSkew is called once if the local clock differs from the time of the servers by more than MaxClockSkew.
+	OnClockSkew(skew time.Duration)
 }
 
 type ProtonAPIClientBuilder struct {
 	manager  *proton.Manager
 	callback ProtonCallbacks
+	skew     *clockSkew
 }
 
-func NewProtonAPIClientBuilder(apiURL string, panicHandler async.PanicHandler, callbacks ProtonCallbacks) (*ProtonAPIClientBuilder, error) {
+// ConnectionOptions tunes how the API clients connect to the servers.
+type ConnectionOptions struct {
+	// CompensateClockSkew validates the TLS certificates at the time of the servers instead of the local time, so that
+	// a wrong local clock does not prevent logging in. Skews above MaxCompensatedClockSkew are refused.
+	CompensateClockSkew bool
+
+	// IPPreference restricts the IP versions used to reach the servers, for the networks where one of them is broken.
+	IPPreference IPPreference
+
+	// Proxy is the proxy used to reach the servers, see ParseProxy. When empty, the proxies of HTTP_PROXY, HTTPS_PROXY
+	// and ALL_PROXY are used.
+	Proxy string
+
+	// DisableAlternativeRouting never reaches the API through the alternative hosts looked up with DNS over HTTPS
+	// when the Proton servers are blocked, for the users who do not want these third party lookups.
+	DisableAlternativeRouting bool
+
+	// CACertFile is a PEM file of certificate authorities trusted in addition to those of the system, for the test
+	// environments whose API servers have certificates issued by their own authority.
+	CACertFile string
+}
+
+// NewProtonAPIClientBuilder returns a builder of API clients connecting to the servers as configured by options.
+func NewProtonAPIClientBuilder(
+	apiURL string,
+	panicHandler async.PanicHandler,
+	callbacks ProtonCallbacks,
+	options ConnectionOptions,
+) (*ProtonAPIClientBuilder, error) {
 	cookieJar, err := newCookieJar(apiURL)
 	if err != nil {
 		return nil, err
 	}
 
+	skew := newClockSkew(options.CompensateClockSkew, func(skew time.Duration) {
+		if callbacks != nil {
+			callbacks.OnClockSkew(skew)
+		}
+	})
+
+	dialer := newDialer(options.IPPreference)
+
+	proxy, err := newProxyFunc(options.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyURL := proxyOf(apiURL, proxy)
+
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = proxy
+	skew.configureTransport(transport)
+
+	if len(options.CACertFile) != 0 {
+		if err := trustCACerts(transport, options.CACertFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.CompensateClockSkew {
+		var roots *x509.CertPool
+		if transport.TLSClientConfig != nil {
+			roots = transport.TLSClientConfig.RootCAs
+		}
+
+		if err := skew.measureClockSkew(context.Background(), apiURL, dialer, proxy, roots); errors.Is(err, ErrClockSkewTooLarge) {
+			return nil, err
+		} else if err != nil {
+			logrus.WithError(err).Warn("Unable to measure clock skew")
+		}
+	}
+
+	if strings.TrimSuffix(apiURL, "/") != internal.ETDefaultAPIURL {
+		logrus.WithField("url", apiURL).Warn("Using a custom API URL")
+	}
+
+	// The alternative hosts only relay the Proton API, and are pointless behind a proxy.
+	if !options.DisableAlternativeRouting && proxyURL == nil && strings.TrimSuffix(apiURL, "/") == internal.ETDefaultAPIURL {
+		routing, err := newAlternativeRouting(apiURL, dialer, transport.TLSClientConfig, panicHandler)
+		if err != nil {
+			return nil, err
+		}
+
+		routing.configureTransport(transport)
+	}
+
 	b := &ProtonAPIClientBuilder{
 		manager: proton.New(
 			proton.WithHostURL(apiURL),
@@ -59,10 +149,15 @@ func NewProtonAPIClientBuilder(apiURL string, panicHandler async.PanicHandler, c
 			proton.WithLogger(logrus.StandardLogger()),
 			proton.WithPanicHandler(panicHandler),
 			proton.WithCookieJar(cookieJar),
+			proton.WithTransport(NewTracingTransport(NewRangeTransport(NewInterferenceTransport(transport)))),
 		),
 		callback: callbacks,
+		skew:     skew,
 	}
 
+	b.manager.AddPostRequestHook(skew.observe)
+	b.manager.AddPostRequestHook(observeRetryAfter)
+
 	err = b.checkKillSwitch(context.Background())
 	if err != nil {
 		return b, err
@@ -99,17 +194,36 @@ func (p *ProtonAPIClientBuilder) NewClient(ctx context.Context, username string,
 	return p.manager.NewClientWithLoginWithHVToken(ctx, username, password, hvToken)
 }
 
+func (p *ProtonAPIClientBuilder) NewClientWithRefresh(ctx context.Context, uid, refreshToken string) (Client, proton.Auth, error) {
+	return p.manager.NewClientWithRefresh(ctx, uid, refreshToken)
+}
+
 func (p *ProtonAPIClientBuilder) Close() {
 	p.manager.Close()
 }
 
+// GetClockSkew returns the difference between the time of the servers and the local time, measured from the last API
+// response.
+func (p *ProtonAPIClientBuilder) GetClockSkew() (time.Duration, bool) {
+	return p.skew.get()
+}
+
 // checkKillSwitch returns a pre-defined error if the export tool global kill switch is enabled;
-// if the API call fails we assume the kill switch is disabled;
+// if the API call fails we assume the kill switch is disabled, unless the connection is intercepted;
 // no errors are returned if the kill switch is disabled.
 func (p *ProtonAPIClientBuilder) checkKillSwitch(ctx context.Context) error {
 	featureFlagData, err := p.manager.GetFeatures(ctx)
 
 	if err != nil {
+		if interferenceErr := new(NetworkInterferenceError); errors.As(err, &interferenceErr) {
+			return interferenceErr
+		}
+
+		if isCertificateTimeError(err) {
+			logrus.WithError(err).Warn("The TLS certificate of the Proton servers is not valid at the local time, the clock of " +
+				"this computer is probably wrong. Correct it or enable the clock skew compensation")
+		}
+
 		logrus.Info("Unable to retrieve feature flag values")
 		return nil //nolint:nilerr
 	}
@@ -150,6 +264,58 @@ func GetHVData(err error) *proton.APIHVDetails {
 	return hvDetails
 }
 
+// ParseAPIURL validates the base URL of the API, e.g. that of a test environment, and returns it without trailing
+// slash. Empty is the URL of the Proton API.
+func ParseAPIURL(s string) (string, error) {
+	if len(s) == 0 {
+		return internal.ETDefaultAPIURL, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid API URL '%v': %w", s, err)
+	}
+
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", fmt.Errorf("invalid API URL '%v': expected an http or https URL", s)
+	}
+
+	if len(u.Hostname()) == 0 {
+		return "", fmt.Errorf("invalid API URL '%v': missing host", s)
+	}
+
+	if len(u.RawQuery) != 0 || len(u.Fragment) != 0 {
+		return "", fmt.Errorf("invalid API URL '%v': unexpected query", s)
+	}
+
+	return strings.TrimSuffix(s, "/"), nil
+}
+
+// trustCACerts makes the transport trust the authorities of a PEM file on top of those of the system.
+func trustCACerts(transport *http.Transport, caCertFile string) error {
+	pem, err := os.ReadFile(caCertFile) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("failed to read CA certificates: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificate found in '%v'", caCertFile)
+	}
+
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	transport.TLSClientConfig.RootCAs = pool
+
+	return nil
+}
+
 func newCookieJar(apiURL string) (*cookiejar.Jar, error) {
 	url, err := url.Parse(apiURL)
 	if err != nil {
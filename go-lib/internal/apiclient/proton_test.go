@@ -0,0 +1,75 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/export-tool/internal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAPIURL(t *testing.T) {
+	apiURL, err := ParseAPIURL("")
+	require.NoError(t, err)
+	require.Equal(t, internal.ETDefaultAPIURL, apiURL)
+
+	apiURL, err = ParseAPIURL("https://mail-api.blackbox.example/api/")
+	require.NoError(t, err)
+	require.Equal(t, "https://mail-api.blackbox.example/api", apiURL)
+
+	apiURL, err = ParseAPIURL("http://localhost:8080")
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:8080", apiURL)
+
+	for _, invalid := range []string{"://proton", "mail-api.proton.me", "ftp://proton.me", "https://", "https://proton.me/?a=b"} {
+		_, err := ParseAPIURL(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestTrustCACerts(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	caCertFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600))
+
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert
+	defer transport.CloseIdleConnections()
+
+	_, err := (&http.Client{Transport: transport}).Get(server.URL) //nolint:noctx,bodyclose
+	require.Error(t, err)
+
+	require.NoError(t, trustCACerts(transport, caCertFile))
+
+	res, err := (&http.Client{Transport: transport}).Get(server.URL) //nolint:noctx
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	require.NoError(t, os.WriteFile(caCertFile, []byte("not a certificate"), 0o600))
+	require.Error(t, trustCACerts(transport, caCertFile))
+}
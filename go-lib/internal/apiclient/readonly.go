@@ -0,0 +1,87 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+)
+
+// ErrReadOnly is returned by the calls of a ReadOnlyClient that would modify the account.
+var ErrReadOnly = errors.New("the account cannot be modified by a read-only client")
+
+// ReadOnlyClientBuilder creates clients that cannot modify the account, see ReadOnlyClient.
+type ReadOnlyClientBuilder struct {
+	Builder
+}
+
+func NewReadOnlyClientBuilder(builder Builder) *ReadOnlyClientBuilder {
+	return &ReadOnlyClientBuilder{Builder: builder}
+}
+
+func (b *ReadOnlyClientBuilder) NewClient(
+	ctx context.Context,
+	username string,
+	password []byte,
+	hvToken *proton.APIHVDetails,
+) (Client, proton.Auth, error) {
+	client, auth, err := b.Builder.NewClient(ctx, username, password, hvToken)
+	if err != nil {
+		return nil, auth, err
+	}
+
+	return &ReadOnlyClient{Client: client}, auth, nil
+}
+
+func (b *ReadOnlyClientBuilder) NewClientWithRefresh(ctx context.Context, uid, refreshToken string) (Client, proton.Auth, error) {
+	client, auth, err := b.Builder.NewClientWithRefresh(ctx, uid, refreshToken)
+	if err != nil {
+		return nil, auth, err
+	}
+
+	return &ReadOnlyClient{Client: client}, auth, nil
+}
+
+// ReadOnlyClient rejects the calls creating, importing or deleting labels, messages and contacts with ErrReadOnly. Logging in
+// and out is still possible.
+type ReadOnlyClient struct {
+	Client
+}
+
+func (c *ReadOnlyClient) CreateLabel(context.Context, proton.CreateLabelReq) (proton.Label, error) {
+	return proton.Label{}, ErrReadOnly
+}
+
+func (c *ReadOnlyClient) DeleteLabel(context.Context, string) error {
+	return ErrReadOnly
+}
+
+func (c *ReadOnlyClient) ImportMessages(context.Context, *crypto.KeyRing, int, int, ...proton.ImportReq) (proton.ImportResStream, error) {
+	return nil, ErrReadOnly
+}
+
+func (c *ReadOnlyClient) DeleteMessage(context.Context, ...string) error {
+	return ErrReadOnly
+}
+
+func (c *ReadOnlyClient) CreateContacts(context.Context, proton.CreateContactsReq) ([]proton.CreateContactsRes, error) {
+	return nil, ErrReadOnly
+}
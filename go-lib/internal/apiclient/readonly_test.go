@@ -0,0 +1,55 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestReadOnlyClient(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	builder := NewMockBuilder(mockCtrl)
+	client := NewMockClient(mockCtrl)
+
+	builder.EXPECT().NewClient(gomock.Any(), "user", gomock.Any(), gomock.Any()).Return(client, proton.Auth{UID: "uid"}, nil)
+	client.EXPECT().GetLabels(gomock.Any(), proton.LabelTypeLabel).Return([]proton.Label{{ID: "label"}}, nil)
+
+	ctx := context.Background()
+
+	readOnly, auth, err := NewReadOnlyClientBuilder(builder).NewClient(ctx, "user", []byte("password"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "uid", auth.UID)
+
+	labels, err := readOnly.GetLabels(ctx, proton.LabelTypeLabel)
+	require.NoError(t, err)
+	require.Len(t, labels, 1)
+
+	_, err = readOnly.CreateLabel(ctx, proton.CreateLabelReq{Name: "label"})
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.ErrorIs(t, readOnly.DeleteLabel(ctx, "label"), ErrReadOnly)
+	require.ErrorIs(t, readOnly.DeleteMessage(ctx, "message"), ErrReadOnly)
+	_, err = readOnly.ImportMessages(ctx, nil, 1, 1)
+	require.ErrorIs(t, err, ErrReadOnly)
+	_, err = readOnly.CreateContacts(ctx, proton.CreateContactsReq{})
+	require.ErrorIs(t, err, ErrReadOnly)
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/go-resty/resty/v2"
+)
+
+// The API client does not expose the Retry-After header of the responses either. The requests repeated by the
+// AutoRetryClient carry a retryAfter in their context instead, which observeRetryAfter fills from the responses.
+
+type retryAfterKey struct{}
+
+// retryAfter holds the delay requested by the last response of a request. Several requests can share it, for instance
+// the parallel imports of ImportMessages.
+type retryAfter struct {
+	lock  sync.Mutex
+	delay time.Duration
+}
+
+func withRetryAfter(ctx context.Context, r *retryAfter) context.Context {
+	return context.WithValue(ctx, retryAfterKey{}, r)
+}
+
+func (r *retryAfter) set(delay time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.delay = delay
+}
+
+func (r *retryAfter) get() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.delay
+}
+
+// wrap returns err as a RateLimitError if the server requested a delay before the next attempt.
+func (r *retryAfter) wrap(err error) error {
+	if delay := r.get(); delay > 0 {
+		return &RateLimitError{Err: err, RetryAfter: delay}
+	}
+
+	return err
+}
+
+// maxRetryAfter bounds the delay requested by a server, in case of a bogus Retry-After header.
+const maxRetryAfter = 10 * time.Minute
+
+// observeRetryAfter is a post request hook recording the Retry-After header of the 429 and 503 responses.
+func observeRetryAfter(_ *resty.Client, res *resty.Response) error {
+	r, ok := res.Request.Context().Value(retryAfterKey{}).(*retryAfter)
+	if !ok {
+		return nil
+	}
+
+	var delay time.Duration
+
+	if res.StatusCode() == http.StatusTooManyRequests || res.StatusCode() == http.StatusServiceUnavailable {
+		delay, _ = parseRetryAfter(res.Header().Get("Retry-After"), res.ReceivedAt())
+	}
+
+	r.set(delay)
+
+	return nil
+}
+
+// parseRetryAfter accepts both a number of seconds and an HTTP date, as allowed by RFC 9110.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return 0, false
+	}
+
+	var delay time.Duration
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+
+		delay = time.Duration(seconds) * time.Second
+	} else {
+		date, err := http.ParseTime(value)
+		if err != nil {
+			return 0, false
+		}
+
+		delay = date.Sub(now)
+	}
+
+	return max(min(delay, maxRetryAfter), time.Second), true
+}
+
+// RateLimitError wraps the error of a request the server asked to repeat after RetryAfter.
+type RateLimitError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return e.Err
+}
+
+// isRateLimitError returns whether the server is overloaded or throttles the requests of the user.
+func isRateLimitError(err error) bool {
+	if rateLimitErr := new(RateLimitError); errors.As(err, &rateLimitErr) {
+		return true
+	}
+
+	if apiErr := new(proton.APIError); errors.As(err, &apiErr) {
+		return apiErr.Status == http.StatusTooManyRequests || apiErr.Status == http.StatusServiceUnavailable
+	}
+
+	return false
+}
+
+type rateLimitObserverKey struct{}
+
+// WithRateLimitObserver returns a context whose requests call observer with the time they wait before being repeated,
+// every time the servers rate limit them.
+func WithRateLimitObserver(ctx context.Context, observer func(wait time.Duration)) context.Context {
+	return context.WithValue(ctx, rateLimitObserverKey{}, observer)
+}
+
+func notifyRateLimited(ctx context.Context, wait time.Duration) {
+	if observer, ok := ctx.Value(rateLimitObserverKey{}).(func(wait time.Duration)); ok {
+		observer(wait)
+	}
+}
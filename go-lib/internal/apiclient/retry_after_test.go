@@ -0,0 +1,112 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for value, expected := range map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		" 5 ":                           5 * time.Second,
+		"0":                             time.Second,
+		"86400":                         maxRetryAfter,
+		"Mon, 01 Jan 2024 12:00:30 GMT": 30 * time.Second,
+		"Mon, 01 Jan 2024 11:00:00 GMT": time.Second,
+	} {
+		delay, ok := parseRetryAfter(value, now)
+		require.True(t, ok, value)
+		require.Equal(t, expected, delay, value)
+	}
+
+	for _, value := range []string{"", "-1", "soon"} {
+		_, ok := parseRetryAfter(value, now)
+		require.False(t, ok, value)
+	}
+}
+
+func TestObserveRetryAfter(t *testing.T) {
+	status := http.StatusTooManyRequests
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Retry-After", "42")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	client := resty.New().OnAfterResponse(observeRetryAfter)
+
+	r := &retryAfter{}
+	_, err := client.R().SetContext(withRetryAfter(context.Background(), r)).Get(server.URL)
+	require.NoError(t, err)
+	require.Equal(t, 42*time.Second, r.get())
+
+	var rateLimitErr *RateLimitError
+	require.ErrorAs(t, r.wrap(errors.New("failed")), &rateLimitErr)
+	require.Equal(t, 42*time.Second, rateLimitErr.RetryAfter)
+
+	// Only the 429 and 503 responses ask to wait.
+	status = http.StatusInternalServerError
+
+	_, err = client.R().SetContext(withRetryAfter(context.Background(), r)).Get(server.URL)
+	require.NoError(t, err)
+	require.Zero(t, r.get())
+	require.False(t, errors.As(r.wrap(errors.New("failed")), &rateLimitErr))
+}
+
+func TestSleepRetryStrategy_RetryAfter(t *testing.T) {
+	var waits []time.Duration
+
+	ctx, cancel := context.WithCancel(WithRateLimitObserver(context.Background(), func(wait time.Duration) {
+		waits = append(waits, wait)
+	}))
+	cancel()
+
+	strategy := SleepRetryStrategyBuilder{}.NewRetryStrategy()
+
+	// The delay requested by the server is honoured, with a jitter of at most a tenth of it plus one second.
+	strategy.HandleRetry(ctx, &RateLimitError{Err: &proton.APIError{Status: 429}, RetryAfter: 10 * time.Second})
+	require.Len(t, waits, 1)
+	require.GreaterOrEqual(t, waits[0], 10*time.Second)
+	require.Less(t, waits[0], 12*time.Second)
+
+	// Without delay, the rate limited requests back off exponentially.
+	strategy.HandleRetry(ctx, &proton.APIError{Status: 503})
+	strategy.HandleRetry(ctx, &proton.APIError{Status: 503})
+	require.Len(t, waits, 3)
+	require.GreaterOrEqual(t, waits[1], expWaitTimes[0])
+	require.Less(t, waits[1], expWaitTimes[0]*5/4)
+	require.GreaterOrEqual(t, waits[2], expWaitTimes[1])
+	require.Less(t, waits[2], expWaitTimes[1]*5/4)
+
+	// Other errors are not reported as rate limits.
+	strategy.HandleRetry(ctx, &proton.NetError{})
+	require.Len(t, waits, 3)
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package apiclient
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingTransport is an http.RoundTripper recording a client span and the request metrics of each API request. The
+// span ends when the response headers are received, the download of the body is part of the span of the caller.
+type TracingTransport struct {
+	base http.RoundTripper
+}
+
+func NewTracingTransport(base http.RoundTripper) *TracingTransport {
+	return &TracingTransport{base: base}
+}
+
+func (t *TracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracing.Tracer().Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			tracing.MethodKey.String(req.Method),
+			tracing.ServerKey.String(req.URL.Hostname()),
+			attribute.String("url.path", req.URL.Path),
+		),
+	)
+	defer span.End()
+
+	start := time.Now()
+
+	res, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		tracing.RecordRequest(ctx, req.Method, 0, time.Since(start))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		return nil, err
+	}
+
+	tracing.RecordRequest(ctx, req.Method, res.StatusCode, time.Since(start))
+	span.SetAttributes(tracing.StatusKey.Int(res.StatusCode))
+
+	if res.StatusCode >= http.StatusBadRequest {
+		span.SetAttributes(tracing.ErrorTypeKey.String(strconv.Itoa(res.StatusCode)))
+		span.SetStatus(codes.Error, http.StatusText(res.StatusCode))
+	}
+
+	return res, nil
+}
@@ -1,8 +1,11 @@
 package app
 
 import (
+	"fmt"
 	"sync/atomic"
+	"time"
 
+	"github.com/ProtonMail/export-tool/internal/mail"
 	"github.com/schollz/progressbar/v3"
 )
 
@@ -10,6 +13,7 @@ type cliReporter struct {
 	totalMessageCount   atomic.Uint64
 	currentMessageCount atomic.Uint64
 	progressbar         *progressbar.ProgressBar
+	rateLimitedUntil    atomic.Int64 // Unix time in milliseconds.
 }
 
 func newCliReporter() *cliReporter {
@@ -38,3 +42,26 @@ func (m *cliReporter) OnProgress(delta int) {
 	_ = m.currentMessageCount.Add(uint64(delta))
 	_ = m.progressbar.Add(delta)
 }
+
+func (m *cliReporter) OnETAUpdate(remaining time.Duration) {
+	m.progressbar.Describe(fmt.Sprintf("ETA %v", remaining.Round(time.Second)))
+}
+
+func (m *cliReporter) OnRateLimited(wait time.Duration) {
+	m.rateLimitedUntil.Store(time.Now().Add(wait).UnixMilli())
+	m.progressbar.Describe(fmt.Sprintf("Rate limited, waiting %v", wait.Round(time.Second)))
+}
+
+func (m *cliReporter) OnProgressEvent(event mail.ProgressEvent) {
+	// The rate limit description is kept until the wait is over.
+	if event.Time.UnixMilli() < m.rateLimitedUntil.Load() {
+		return
+	}
+
+	description := fmt.Sprintf("%.1f MB/s", event.BytesPerSecond/1024/1024)
+	if event.ETA >= 0 {
+		description += fmt.Sprintf(", ETA %v", event.ETA.Round(time.Second))
+	}
+
+	m.progressbar.Describe(description)
+}
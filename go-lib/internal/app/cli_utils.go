@@ -6,11 +6,27 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"golang.org/x/term"
 )
 
+// errNonInteractive is returned by the prompts of a non-interactive run.
+var errNonInteractive = errors.New("input required in non-interactive mode")
+
+func checkInteractive(prompt string) error {
+	if !state.nonInteractive {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %v", errNonInteractive, strings.TrimSuffix(strings.TrimSpace(prompt), ":"))
+}
+
 func readLine(prompt string) (string, error) {
+	if err := checkInteractive(prompt); err != nil {
+		return "", err
+	}
+
 	if len(prompt) > 0 {
 		fmt.Print(prompt)
 	}
@@ -24,6 +40,10 @@ func readLine(prompt string) (string, error) {
 }
 
 func readPassword(prompt string) ([]byte, error) {
+	if err := checkInteractive(prompt); err != nil {
+		return nil, err
+	}
+
 	if len(prompt) > 0 {
 		fmt.Print(prompt)
 	}
@@ -43,6 +63,10 @@ func waitForReturn() {
 }
 
 func readYesNo(prompt string, retryCount int) (bool, error) {
+	if err := checkInteractive(prompt); err != nil {
+		return false, err
+	}
+
 	reader := bufio.NewReader(os.Stdin)
 	for i := 0; i < retryCount; i++ {
 		fmt.Print(prompt)
@@ -61,3 +85,16 @@ func readYesNo(prompt string, retryCount int) (bool, error) {
 
 	return true, errors.New("too many attempts")
 }
+
+// getLocation returns the time zone of the dates read and printed, local until the options are read.
+func getLocation() *time.Location {
+	if state.location == nil {
+		return time.Local
+	}
+
+	return state.location
+}
+
+func formatTime(t time.Time, layout string) string {
+	return t.In(getLocation()).Format(layout)
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/export-tool/internal/vault"
+	"github.com/urfave/cli/v2"
+)
+
+// appConfigVersion is the version of the configuration file.
+const appConfigVersion = 1
+
+// appConfig holds the settings saved by the calibrate operation. The command line flags and environment variables take
+// precedence over them. The file is sealed with the vault when the local files are protected by a passphrase.
+type appConfig struct {
+	Concurrency      int
+	BuildConcurrency int
+	CalibratedAt     time.Time
+}
+
+func getConfigPath(ctx *cli.Context) (string, error) {
+	if path := ctx.String(flagConfig.Name); len(path) != 0 {
+		return path, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate the user configuration folder: %w", err)
+	}
+
+	return filepath.Join(dir, "proton-mail-export-cli", "config.json"), nil
+}
+
+// loadConfig returns an empty configuration if the file does not exist.
+func loadConfig(ctx *cli.Context) (appConfig, error) {
+	path, err := getConfigPath(ctx)
+	if err != nil {
+		return appConfig{}, err
+	}
+
+	b, err := os.ReadFile(path) //nolint:gosec
+	if errors.Is(err, os.ErrNotExist) {
+		return appConfig{}, nil
+	} else if err != nil {
+		return appConfig{}, fmt.Errorf("failed to read configuration file: %w", err)
+	}
+
+	b, err = vault.Decode(state.vault, b)
+	if err != nil {
+		return appConfig{}, fmt.Errorf("failed to unseal configuration file '%v': %w", path, err)
+	}
+
+	config, err := utils.NewVersionedJSON[appConfig](appConfigVersion, b)
+	if err != nil {
+		return appConfig{}, fmt.Errorf("failed to parse configuration file '%v': %w", path, err)
+	}
+
+	return config.Payload, nil
+}
+
+func saveConfig(ctx *cli.Context, config appConfig) (string, error) {
+	path, err := getConfigPath(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", fmt.Errorf("failed to create configuration folder: %w", err)
+	}
+
+	data, err := utils.GenerateVersionedJSON(appConfigVersion, config)
+	if err != nil {
+		return "", fmt.Errorf("failed to json encode configuration: %w", err)
+	}
+
+	if data, err = vault.Encode(state.vault, data); err != nil {
+		return "", err
+	}
+
+	if err := utils.WriteFileSafe(filepath.Dir(path), path, data, &utils.Sha256IntegrityChecker{}); err != nil {
+		return "", fmt.Errorf("failed to write configuration file: %w", err)
+	}
+
+	return path, nil
+}
+
+// getConcurrency returns the value of flag, or the calibrated value if the flag is not set.
+func getConcurrency(ctx *cli.Context, flag *cli.IntFlag, calibrated int) int {
+	if ctx.IsSet(flag.Name) {
+		return ctx.Int(flag.Name)
+	}
+
+	return calibrated
+}
@@ -1,8 +1,13 @@
 package app
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
+	"runtime"
 
+	"github.com/ProtonMail/export-tool/internal/keychain"
 	"github.com/urfave/cli/v2"
 )
 
@@ -10,27 +15,213 @@ type credentials struct {
 	username     string
 	password     []byte
 	totp         string
+	totpSecret   string // Kept between the attempts, a new code is computed from it.
+	fido2Command string
 	mboxPassword []byte
 	attemptCount int
+	keepUsername bool // The username comes from the accounts file, only the passwords are asked again.
 }
 
-func newCredentialsFromCLI(ctx *cli.Context) *credentials {
-	return &credentials{
+// credentialsFile is the content of the file given with --credentials-file. TOTPSecret is the base32 secret of the
+// authenticator app.
+type credentialsFile struct {
+	Username        string
+	Password        string
+	MailboxPassword string `json:",omitempty"`
+	TOTPSecret      string `json:",omitempty"`
+}
+
+func newCredentialsFromCLI(ctx *cli.Context) (*credentials, error) {
+	creds := &credentials{
 		username:     ctx.String(flagUsername.Name),
 		password:     []byte(ctx.String(flagPassword.Name)),
 		totp:         ctx.String(flagTOTP.Name),
+		totpSecret:   ctx.String(flagTOTPSecret.Name),
+		fido2Command: ctx.String(flagFIDO2Command.Name),
 		mboxPassword: []byte(ctx.String(flagMBoxPassword.Name)),
 	}
+
+	if path := ctx.String(flagCredentialsFile.Name); len(path) != 0 {
+		file, err := loadCredentialsFile(path)
+		if err != nil {
+			return nil, newLoginError(loginErrorCredentialsFile, err)
+		}
+
+		creds.fillFrom(file)
+	}
+
+	if ctx.Bool(flagKeychain.Name) {
+		saved, err := loadKeychainCredentials()
+		if err != nil {
+			return nil, newLoginError(loginErrorKeychain, err)
+		}
+
+		creds.fillFrom(saved)
+	}
+
+	return creds, nil
+}
+
+// fillFrom sets the values which were not given on the command line.
+func (c *credentials) fillFrom(file credentialsFile) {
+	if len(c.username) == 0 {
+		c.username = file.Username
+	}
+
+	if len(c.password) == 0 {
+		c.password = []byte(file.Password)
+	}
+
+	if len(c.mboxPassword) == 0 {
+		c.mboxPassword = []byte(file.MailboxPassword)
+	}
+
+	if len(c.totpSecret) == 0 {
+		c.totpSecret = file.TOTPSecret
+	}
+}
+
+// loadKeychainCredentials returns the credentials saved by saveKeychainCredentials, empty if there are none.
+func loadKeychainCredentials() (credentialsFile, error) {
+	store, err := keychain.New()
+	if err != nil {
+		return credentialsFile{}, err
+	}
+
+	b, err := store.Get(keychain.ItemCredentials)
+	if errors.Is(err, keychain.ErrNotFound) {
+		return credentialsFile{}, nil
+	} else if err != nil {
+		return credentialsFile{}, err
+	}
+
+	var file credentialsFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return credentialsFile{}, fmt.Errorf("failed to parse saved credentials: %w", err)
+	}
+
+	return file, nil
+}
+
+// saveKeychainCredentials saves the credentials of a successful login, the TOTP code is not kept as it expires.
+func saveKeychainCredentials(creds *credentials) error {
+	store, err := keychain.New()
+	if err != nil {
+		return newLoginError(loginErrorKeychain, err)
+	}
+
+	b, err := json.Marshal(credentialsFile{
+		Username:        creds.username,
+		Password:        string(creds.password),
+		MailboxPassword: string(creds.mboxPassword),
+		TOTPSecret:      creds.totpSecret,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := store.Set(keychain.ItemCredentials, b); err != nil {
+		return newLoginError(loginErrorKeychain, err)
+	}
+
+	fmt.Println("Credentials saved in the keychain.")
+
+	return nil
+}
+
+// loadCredentialsFile reads a credentials file, see readSecretFile.
+func loadCredentialsFile(path string) (credentialsFile, error) {
+	b, err := readSecretFile(path, "credentials")
+	if err != nil {
+		return credentialsFile{}, err
+	}
+
+	var file credentialsFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return credentialsFile{}, fmt.Errorf("failed to parse credentials file: %w", err)
+	}
+
+	return file, nil
+}
+
+// readSecretFile reads a file holding passwords, it is refused if other users of the computer can access it. The
+// permissions are not checked on Windows, where they are ACLs. kind names the file in the errors.
+func readSecretFile(path, kind string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v file: %w", kind, err)
+	}
+
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("%v file '%v' can be accessed by other users (%v), restrict it with chmod 600", kind, path, info.Mode().Perm())
+	}
+
+	b, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v file: %w", kind, err)
+	}
+
+	return b, nil
 }
 
 func (c *credentials) nextAttempt() error {
 	if c.attemptCount++; c.attemptCount >= 5 {
 		return errors.New("failed to login: too many attempts")
 	}
-	c.username = ""
+	if !c.keepUsername {
+		c.username = ""
+	}
 	c.password = nil
 	c.totp = ""
 	c.mboxPassword = nil
 
 	return nil
 }
+
+// fail reports a rejected login step. The values are asked again unless the run is non-interactive, nil is returned
+// to retry.
+func (c *credentials) fail(code string, err error) error {
+	if state.nonInteractive {
+		return newLoginError(code, err)
+	}
+
+	printError(err)
+
+	return c.nextAttempt()
+}
+
+// Codes of the login errors, written in the JSON error of a non-interactive run.
+const (
+	loginErrorCredentialsFile         = "credentials-file"
+	loginErrorSessionFile             = "session-file"
+	loginErrorKeychain                = "keychain"
+	loginErrorMissingCredentials      = "missing-credentials"
+	loginErrorInvalidCredentials      = "invalid-credentials"
+	loginErrorTOTPRequired            = "totp-required"
+	loginErrorInvalidTOTP             = "invalid-totp"
+	loginErrorFIDO2Required           = "security-key-required"
+	loginErrorInvalidFIDO2            = "invalid-security-key"
+	loginErrorMailboxPasswordRequired = "mailbox-password-required"
+	loginErrorInvalidMailboxPassword  = "invalid-mailbox-password"
+	loginErrorHumanVerification       = "human-verification-required"
+)
+
+// loginExitCode is the exit code of a non-interactive run failing to login.
+const loginExitCode = 2
+
+type loginError struct {
+	code string
+	err  error
+}
+
+func newLoginError(code string, err error) error {
+	return &loginError{code: code, err: err}
+}
+
+func (l *loginError) Error() string {
+	return l.err.Error()
+}
+
+func (l *loginError) Unwrap() error {
+	return l.err
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ProtonMail/export-tool/internal/alert"
+	"github.com/ProtonMail/export-tool/internal/mail"
+	"github.com/ProtonMail/gluon/async"
+	"github.com/sirupsen/logrus"
+)
+
+// eventWebhookQueueSize is the number of events waiting to be posted above which the new events are dropped.
+const eventWebhookQueueSize = 1024
+
+// eventWebhookPayload is the JSON posted for each event.
+type eventWebhookPayload struct {
+	Event string
+	Data  mail.Event
+}
+
+// startEventWebhook posts the events of the bus to rawURL from its own goroutine, so that a slow server does not slow
+// down the backup. The returned function waits until the queued events were posted. Nothing is posted without a URL.
+func startEventWebhook(rawURL string, events *mail.EventBus, panicHandler async.PanicHandler) (func(), error) {
+	if len(rawURL) == 0 {
+		return func() {}, nil
+	}
+
+	webhook, err := alert.NewWebhook(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		lock    sync.Mutex
+		stopped bool
+	)
+
+	queue := make(chan mail.Event, eventWebhookQueueSize)
+	doneCh := make(chan struct{})
+
+	// An event being published can still be delivered once unsubscribed.
+	unsubscribe := events.Subscribe(func(event mail.Event) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if stopped {
+			return
+		}
+
+		select {
+		case queue <- event:
+		default:
+			logrus.WithField("event", event.EventName()).Warn("Too many events waiting to be posted, dropping event")
+		}
+	})
+
+	go func() {
+		defer async.HandlePanic(panicHandler)
+		defer close(doneCh)
+
+		for event := range queue {
+			if err := webhook.Post(context.Background(), eventWebhookPayload{Event: event.EventName(), Data: event}); err != nil {
+				logrus.WithError(err).WithField("event", event.EventName()).Warn("Failed to post event")
+			}
+		}
+	}()
+
+	return func() {
+		unsubscribe()
+
+		lock.Lock()
+		stopped = true
+		close(queue)
+		lock.Unlock()
+
+		<-doneCh
+	}, nil
+}
@@ -0,0 +1,215 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/export-tool/internal/hold"
+	"github.com/ProtonMail/export-tool/internal/session"
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/gluon/async"
+	"github.com/bradenaw/juniper/parallel"
+	"github.com/urfave/cli/v2"
+)
+
+// accountEntry is an account of the file given with --accounts. The missing passwords are asked interactively, as is
+// the two-factor code.
+type accountEntry struct {
+	Username        string
+	Password        string `json:",omitempty"`
+	MailboxPassword string `json:",omitempty"`
+}
+
+// loadAccounts reads the accounts file, it is refused if other users of the computer can access it as it may hold
+// passwords, see readSecretFile.
+func loadAccounts(path string) ([]accountEntry, error) {
+	b, err := readSecretFile(path, "accounts")
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []accountEntry
+	if err := json.Unmarshal(b, &accounts); err != nil {
+		return nil, fmt.Errorf("failed to parse accounts file: %w", err)
+	}
+
+	if len(accounts) == 0 {
+		return nil, errors.New("the accounts file lists no account")
+	}
+
+	seen := make(map[string]bool, len(accounts))
+
+	for _, account := range accounts {
+		username := strings.ToLower(strings.TrimSpace(account.Username))
+		if len(username) == 0 {
+			return nil, errors.New("an account of the accounts file has no username")
+		}
+
+		if seen[username] {
+			return nil, fmt.Errorf("account %v is listed twice in the accounts file", account.Username)
+		}
+
+		seen[username] = true
+	}
+
+	return accounts, nil
+}
+
+func (a *accountEntry) getCredentials() *credentials {
+	return &credentials{
+		username:     strings.TrimSpace(a.Username),
+		password:     []byte(a.Password),
+		mboxPassword: []byte(a.MailboxPassword),
+		keepUsername: true,
+	}
+}
+
+// accountBackup is the backup of one of the accounts of the accounts file.
+type accountBackup struct {
+	username string
+	session  *session.Session
+	err      error
+}
+
+// runMultiAccountBackup backs up each account of the accounts file to its own sub folder of the target folder. The
+// logins may be interactive, they all happen before the first backup starts. The backup of an account does not stop
+// the others when it fails.
+func runMultiAccountBackup(ctx *cli.Context, panicHandler async.PanicHandler, holdPolicy hold.Policy, options apiclient.ConnectionOptions) error {
+	if len(ctx.String(flagUsername.Name)) != 0 || len(ctx.String(flagShardJob.Name)) != 0 {
+		return fmt.Errorf("--%v cannot be combined with --%v or --%v", flagAccounts.Name, flagUsername.Name, flagShardJob.Name)
+	}
+
+	parallelAccounts := ctx.Int(flagParallelAccounts.Name)
+	if parallelAccounts < 1 {
+		return fmt.Errorf("invalid number of parallel accounts %v", parallelAccounts)
+	}
+
+	accounts, err := loadAccounts(ctx.String(flagAccounts.Name))
+	if err != nil {
+		return err
+	}
+
+	dir, err := getTargetFolder(ctx, operationBackup, "")
+	if err != nil {
+		return err
+	}
+
+	backups := make([]accountBackup, len(accounts))
+
+	for i := range accounts {
+		backups[i].username = strings.TrimSpace(accounts[i].Username)
+		fmt.Printf("Logging in to %v (%v/%v)\n", backups[i].username, i+1, len(accounts))
+
+		s, err := newSession(ctx, panicHandler, holdPolicy, options)
+		if err != nil {
+			return err
+		}
+		defer s.Close(context.Background())
+
+		if err := loginWith(ctx, s, accounts[i].getCredentials()); err != nil {
+			printError(err)
+			backups[i].err = err
+
+			continue
+		}
+
+		backups[i].session = s
+	}
+
+	if err := waitForRunConditions(ctx); err != nil {
+		return err
+	}
+
+	if err := parallel.DoContext(ctx.Context, parallelAccounts, len(backups), func(_ context.Context, i int) error {
+		backup := &backups[i]
+		if backup.err != nil {
+			return nil
+		}
+
+		accountDir := filepath.Join(dir, utils.SafeFileName(backup.username))
+		if err := os.MkdirAll(accountDir, 0o700); err != nil {
+			backup.err = fmt.Errorf("failed to create account folder: %w", err)
+			return nil
+		}
+
+		if parallelAccounts == 1 {
+			fmt.Printf("\nBacking up %v\n", backup.username)
+			backup.err = runBackup(ctx, accountDir, backup.session, newCliReporter())
+		} else {
+			backup.err = runBackup(ctx, accountDir, backup.session, newAccountReporter(backup.username))
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var failed int
+
+	fmt.Println("\nAccounts:")
+
+	for _, backup := range backups {
+		if backup.err != nil {
+			failed++
+			fmt.Printf("  %v: failed: %v\n", backup.username, backup.err)
+		} else {
+			fmt.Printf("  %v: backup finished\n", backup.username)
+		}
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("the backup of %v of the %v accounts failed", failed, len(backups))
+	}
+
+	return nil
+}
+
+// accountReporter prints the progress of an account backed up in parallel with others as a line at every tenth of the
+// backup, the accounts cannot share a progress bar.
+type accountReporter struct {
+	username  string
+	total     atomic.Uint64
+	processed atomic.Uint64
+	printed   atomic.Uint64 // Last tenth printed.
+}
+
+func newAccountReporter(username string) *accountReporter {
+	return &accountReporter{username: username}
+}
+
+func (a *accountReporter) SetMessageTotal(total uint64) {
+	a.total.Store(total)
+	a.printed.Store(0)
+	fmt.Printf("[%v] %v messages to back up\n", a.username, total)
+}
+
+func (a *accountReporter) SetMessageProcessed(total uint64) {
+	a.processed.Store(total)
+	a.print()
+}
+
+func (a *accountReporter) OnProgress(delta int) {
+	a.processed.Add(uint64(delta))
+	a.print()
+}
+
+func (a *accountReporter) print() {
+	total := a.total.Load()
+	if total == 0 {
+		return
+	}
+
+	processed := a.processed.Load()
+	tenth := min(10, processed*10/total)
+
+	if printed := a.printed.Load(); tenth > printed && a.printed.CompareAndSwap(printed, tenth) {
+		fmt.Printf("[%v] %v%% (%v/%v)\n", a.username, tenth*10, processed, total)
+	}
+}
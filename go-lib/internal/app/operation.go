@@ -11,9 +11,25 @@ import (
 )
 
 const (
-	strBackup  = "backup"
-	strRestore = "restore"
-	strUnknown = "unknown"
+	strBackup    = "backup"
+	strRestore   = "restore"
+	strImport    = "import"
+	strShard     = "shard"
+	strMerge     = "merge"
+	strRelocate  = "relocate"
+	strAnnotate  = "annotate"
+	strHistory   = "history"
+	strGrowth    = "growth"
+	strUnpack    = "unpack"
+	strDoctor    = "doctor"
+	strVerify    = "verify"
+	strStarter   = "starter-pack"
+	strRepair    = "repair"
+	strCalibrate = "calibrate"
+	strReadiness = "readiness"
+	strServe     = "serve"
+	strManifest  = "manifest"
+	strUnknown   = "unknown"
 )
 
 type Operation int
@@ -22,6 +38,22 @@ const (
 	operationUnknown Operation = iota
 	operationBackup
 	operationRestore
+	operationShard
+	operationMerge
+	operationRelocate
+	operationAnnotate
+	operationHistory
+	operationGrowth
+	operationImport
+	operationUnpack
+	operationDoctor
+	operationVerify
+	operationStarter
+	operationRepair
+	operationReadiness
+	operationServe
+	operationCalibrate
+	operationManifest
 )
 
 func getOperation(ctx *cli.Context) (Operation, error) {
@@ -62,6 +94,71 @@ func stringToOperation(operation string) (Operation, error) {
 		return operationRestore, nil
 	}
 
+	// Sharding is meant for scripted exports of large mailboxes, it is not offered interactively.
+	if strings.EqualFold(operation, strShard) {
+		return operationShard, nil
+	}
+
+	if strings.EqualFold(operation, strMerge) {
+		return operationMerge, nil
+	}
+
+	if strings.EqualFold(operation, strRelocate) {
+		return operationRelocate, nil
+	}
+
+	if strings.EqualFold(operation, strAnnotate) {
+		return operationAnnotate, nil
+	}
+
+	if strings.EqualFold(operation, strHistory) {
+		return operationHistory, nil
+	}
+
+	if strings.EqualFold(operation, strGrowth) {
+		return operationGrowth, nil
+	}
+
+	if strings.EqualFold(operation, strImport) {
+		return operationImport, nil
+	}
+
+	if strings.EqualFold(operation, strUnpack) {
+		return operationUnpack, nil
+	}
+
+	if strings.EqualFold(operation, strDoctor) {
+		return operationDoctor, nil
+	}
+
+	if strings.EqualFold(operation, strVerify) {
+		return operationVerify, nil
+	}
+
+	if strings.EqualFold(operation, strStarter) {
+		return operationStarter, nil
+	}
+
+	if strings.EqualFold(operation, strRepair) {
+		return operationRepair, nil
+	}
+
+	if strings.EqualFold(operation, strReadiness) {
+		return operationReadiness, nil
+	}
+
+	if strings.EqualFold(operation, strServe) {
+		return operationServe, nil
+	}
+
+	if strings.EqualFold(operation, strCalibrate) {
+		return operationCalibrate, nil
+	}
+
+	if strings.EqualFold(operation, strManifest) {
+		return operationManifest, nil
+	}
+
 	return operationUnknown, fmt.Errorf("unknown operation %s", operation)
 }
 
@@ -71,6 +168,38 @@ func operationToString(operation Operation) string {
 		return strBackup
 	case operationRestore:
 		return strRestore
+	case operationShard:
+		return strShard
+	case operationMerge:
+		return strMerge
+	case operationRelocate:
+		return strRelocate
+	case operationAnnotate:
+		return strAnnotate
+	case operationHistory:
+		return strHistory
+	case operationGrowth:
+		return strGrowth
+	case operationImport:
+		return strImport
+	case operationUnpack:
+		return strUnpack
+	case operationDoctor:
+		return strDoctor
+	case operationVerify:
+		return strVerify
+	case operationStarter:
+		return strStarter
+	case operationRepair:
+		return strRepair
+	case operationReadiness:
+		return strReadiness
+	case operationServe:
+		return strServe
+	case operationCalibrate:
+		return strCalibrate
+	case operationManifest:
+		return strManifest
 	case operationUnknown:
 		return strUnknown
 	default:
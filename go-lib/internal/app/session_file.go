@@ -0,0 +1,135 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/export-tool/internal/keychain"
+	"github.com/ProtonMail/export-tool/internal/session"
+	"github.com/ProtonMail/export-tool/internal/vault"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// sessionStorage keeps the session between the runs, in a file (flagSessionFile) or in the keychain of the operating
+// system (flagKeychain). load returns an error matching isNoSavedSession when no session was saved yet.
+type sessionStorage interface {
+	load() (session.PersistedSession, error)
+	save(persisted session.PersistedSession) error
+}
+
+func isNoSavedSession(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, keychain.ErrNotFound)
+}
+
+// sessionFile keeps the session in a file sealed with the vault of the local files.
+type sessionFile struct {
+	path  string
+	vault *vault.Vault
+}
+
+func (f *sessionFile) load() (session.PersistedSession, error) {
+	return session.LoadPersistedSession(f.path, f.vault)
+}
+
+func (f *sessionFile) save(persisted session.PersistedSession) error {
+	return session.SavePersistedSession(f.path, persisted, f.vault)
+}
+
+// keychainSession keeps the session in the keychain, where the GUI finds it too.
+type keychainSession struct {
+	store keychain.Store
+}
+
+func (k *keychainSession) load() (session.PersistedSession, error) {
+	return session.LoadPersistedSessionFromKeychain(k.store)
+}
+
+func (k *keychainSession) save(persisted session.PersistedSession) error {
+	return session.SavePersistedSessionToKeychain(k.store, persisted)
+}
+
+// newSessionStorageFromCLI returns nil when the session is not kept between the runs.
+func newSessionStorageFromCLI(ctx *cli.Context) (sessionStorage, error) {
+	if ctx.Bool(flagKeychain.Name) {
+		store, err := keychain.New()
+		if err != nil {
+			return nil, newLoginError(loginErrorKeychain, err)
+		}
+
+		return &keychainSession{store: store}, nil
+	}
+
+	path := ctx.String(flagSessionFile.Name)
+	if len(path) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	if state.vault == nil {
+		return nil, newLoginError(loginErrorSessionFile, vault.ErrLocked)
+	}
+
+	return &sessionFile{path: path, vault: state.vault}, nil
+}
+
+// resumeSession logs in with the saved session, it returns false when a full login is needed. A session which could
+// not be resumed, e.g. because it expired or was revoked, is replaced after the login.
+func resumeSession(ctx *cli.Context, s *session.Session, storage sessionStorage) bool {
+	s.SetPersistent(true)
+
+	persisted, err := storage.load()
+	if err != nil {
+		if !isNoSavedSession(err) {
+			logrus.WithError(err).Warn("Failed to load saved session")
+			fmt.Println("The saved session could not be read, logging in again.")
+		}
+
+		return false
+	}
+
+	if username := ctx.String(flagUsername.Name); len(username) != 0 && !isAccount(username, persisted.Email) {
+		logrus.Info("Saved session belongs to another account")
+		return false
+	}
+
+	if err := s.Resume(ctx.Context, persisted); err != nil {
+		logrus.WithError(err).Warn("Failed to resume saved session")
+		fmt.Println("The saved session has expired, logging in again.")
+
+		return false
+	}
+
+	fmt.Printf("Resumed the session of %v.\n", persisted.Email)
+
+	return true
+}
+
+// keepSession saves the session now and each time its tokens are refreshed, the previous refresh token is no longer
+// valid.
+func keepSession(s *session.Session, storage sessionStorage) error {
+	persisted, err := s.GetPersistedSession()
+	if err != nil {
+		return err
+	}
+
+	if err := storage.save(persisted); err != nil {
+		return newLoginError(loginErrorSessionFile, err)
+	}
+
+	s.SetPersistedSessionHandler(func(persisted session.PersistedSession) {
+		if err := storage.save(persisted); err != nil {
+			logrus.WithError(err).Error("Failed to save refreshed session")
+		}
+	})
+
+	return nil
+}
+
+// isAccount tells whether the username given on the command line is the one of email, with or without the domain.
+func isAccount(username, email string) bool {
+	local, _, _ := strings.Cut(email, "@")
+
+	return strings.EqualFold(username, email) || strings.EqualFold(username, local)
+}
@@ -9,6 +9,7 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/ProtonMail/export-tool/internal/mail"
 	"github.com/urfave/cli/v2"
 )
 
@@ -60,6 +61,11 @@ func readTargetFolderFromCLI(operation Operation, username string) (string, erro
 }
 
 func validateTargetFolder(operation Operation, path string) (string, error) {
+	// Remote backups are restored from their URL, and exports relocated to it, see mail.IsRemoteBackup.
+	if (operation == operationRestore || operation == operationRelocate) && mail.IsRemoteBackup(path) {
+		return path, nil
+	}
+
 	if (runtime.GOOS != "windows") && (strings.HasPrefix(path, "~")) {
 		path = strings.Replace(path, "~", os.Getenv("HOME"), 1) // we do not support named home, such as `~john/test`
 	}
@@ -69,19 +75,25 @@ func validateTargetFolder(operation Operation, path string) (string, error) {
 		return "", err
 	}
 
-	if operation == operationBackup {
+	if operation == operationBackup || operation == operationShard || operation == operationMerge || operation == operationRelocate {
 		if err = os.MkdirAll(fullPath, 0o700); err != nil {
 			return "", err
 		}
 	}
 
+	if operation == operationImport {
+		if _, err := os.Stat(fullPath); err != nil {
+			return "", err
+		}
+	}
+
 	if operation == operationRestore {
 		stat, err := os.Stat(fullPath)
 		if err != nil {
 			return "", err
 		}
-		if !stat.IsDir() {
-			return "", errors.New("target folder is not a directory")
+		if !stat.IsDir() && !mail.IsBackupArchive(fullPath) {
+			return "", errors.New("target folder is neither a directory nor a backup archive")
 		}
 	}
 
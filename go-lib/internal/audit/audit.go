@@ -0,0 +1,481 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package audit implements an append-only log of the data-handling operations performed with the export tool.
+//
+// The log is a JSON lines file. Every line holds one entry and its ed25519 signature. Each entry also carries the
+// SHA-256 digest of the previous line, so that removing, reordering or editing lines breaks the chain. The signing key
+// is never stored next to the log, see SetKeyStore. The details of the entries can be encrypted to the OpenPGP key of
+// a third party, see SetRecipient.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal"
+	"github.com/ProtonMail/export-tool/internal/keychain"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	LogFileName = "audit.log"
+
+	// LegacyKeyFileName is the plaintext signing key written next to the log by the previous versions. It is moved to
+	// the key store by SetKeyStore.
+	LegacyKeyFileName = "audit.key"
+)
+
+var (
+	ErrInvalidLog   = errors.New("invalid audit log")
+	ErrNoSigningKey = errors.New("the audit log has no signing key: no keychain is available and the local files are not protected by a passphrase")
+)
+
+type Event string
+
+const (
+	EventBackupStarted   Event = "backup_started"
+	EventBackupFinished  Event = "backup_finished"
+	EventRestoreStarted  Event = "restore_started"
+	EventRestoreFinished Event = "restore_finished"
+	EventImportStarted   Event = "import_started"
+	EventImportFinished  Event = "import_finished"
+)
+
+type Outcome string
+
+const (
+	OutcomeSuccess   Outcome = "success"
+	OutcomeFailed    Outcome = "failed"
+	OutcomeCancelled Outcome = "cancelled"
+)
+
+// Entry describes an operation: who ran it, on which account, with which parameters, when and from which host.
+type Entry struct {
+	Sequence         uint64
+	Time             time.Time
+	Event            Event
+	OSUser           string `json:",omitempty"`
+	Hostname         string `json:",omitempty"`
+	ToolVersion      string
+	AccountID        string            `json:",omitempty"`
+	AccountEmail     string            `json:",omitempty"`
+	Path             string            `json:",omitempty"` // Export or backup directory.
+	Parameters       map[string]string `json:",omitempty"` // Filters and options the operation was run with.
+	Outcome          Outcome           `json:",omitempty"` // Only set for the events that finish an operation.
+	Error            string            `json:",omitempty"`
+	Counts           map[string]uint64 `json:",omitempty"`
+	EncryptedDetails string            `json:",omitempty"` // Armored OpenPGP message replacing the fields above, see details.
+	PrevHash         string            // Hex encoded SHA-256 digest of the previous line, empty for the first entry.
+	PublicKey        string            // Hex encoded ed25519 key the entry is signed with.
+}
+
+// record is a line of the log file. The entry is kept as raw JSON so that the signature can be verified against the
+// exact bytes that were signed.
+type record struct {
+	Entry     json.RawMessage
+	Signature string
+}
+
+// Log appends signed entries to the audit log of a directory. It is safe for concurrent use.
+type Log struct {
+	lock      sync.Mutex
+	path      string
+	key       ed25519.PrivateKey
+	sequence  uint64
+	prevHash  string
+	recipient *crypto.KeyRing
+}
+
+// Open opens the audit log stored in dir. Entries can only be appended once the signing key is loaded with
+// SetKeyStore.
+func Open(dir string) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+
+	l := &Log{
+		path: filepath.Join(dir, LogFileName),
+	}
+
+	last, err := readLastLine(l.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if last != nil {
+		entry, err := parseLine(last)
+		if err != nil {
+			return nil, err
+		}
+
+		l.sequence = entry.Sequence
+		l.prevHash = hashLine(last)
+	}
+
+	return l, nil
+}
+
+func (l *Log) GetPath() string {
+	return l.path
+}
+
+// GetPublicKey returns the key the entries are signed with, nil if no key store is set.
+func (l *Log) GetPublicKey() ed25519.PublicKey {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.getPublicKey()
+}
+
+func (l *Log) getPublicKey() ed25519.PublicKey {
+	if l.key == nil {
+		return nil
+	}
+
+	return l.key.Public().(ed25519.PublicKey) //nolint:forcetypeassert
+}
+
+// SetKeyStore loads the signing key from keys, the keychain of the system or the vault of the local files, and creates
+// it on first use. Keeping it out of the log directory prevents whoever can edit the log from signing it again. A key
+// left next to the log by a previous version is moved to keys, so that the existing entries still verify.
+func (l *Log) SetKeyStore(keys keychain.Store) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	key, err := loadOrCreateKey(keys, filepath.Join(filepath.Dir(l.path), LegacyKeyFileName))
+	if err != nil {
+		return err
+	}
+
+	l.key = key
+
+	return nil
+}
+
+// HasKey returns whether entries can be signed.
+func (l *Log) HasKey() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.key != nil
+}
+
+// SetRecipient encrypts the details of the entries appended from now on to recipient. A nil recipient disables the
+// encryption.
+func (l *Log) SetRecipient(recipient *crypto.KeyRing) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.recipient = recipient
+}
+
+// GetRecipient returns the key the details of the entries are encrypted to, nil if they are not encrypted or the log
+// is nil.
+func (l *Log) GetRecipient() *crypto.KeyRing {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.recipient
+}
+
+// Append completes the entry with the sequence number, time, host and chain information, signs it and appends it to
+// the log.
+func (l *Log) Append(entry Entry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.key == nil {
+		return ErrNoSigningKey
+	}
+
+	entry.Sequence = l.sequence + 1
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	entry.OSUser = currentUser()
+	entry.Hostname = currentHost()
+	entry.ToolVersion = internal.ETVersionString
+	entry.PrevHash = l.prevHash
+	entry.PublicKey = hex.EncodeToString(l.getPublicKey())
+
+	if l.recipient != nil {
+		if err := entry.encryptDetails(l.recipient); err != nil {
+			return err
+		}
+	}
+
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+
+	line, err := json.Marshal(record{
+		Entry:     entryJSON,
+		Signature: hex.EncodeToString(ed25519.Sign(l.key, entryJSON)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %w", err)
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to sync audit log: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+
+	l.sequence = entry.Sequence
+	l.prevHash = hashLine(line)
+
+	return nil
+}
+
+// Record appends entry to log. The operations run without an audit log when log is nil, e.g. in the library before it
+// is initialized.
+func Record(log *Log, entry Entry) error {
+	if log == nil {
+		return nil
+	}
+
+	if err := log.Append(entry); err != nil {
+		logrus.WithError(err).WithField("event", entry.Event).Error("Failed to write audit log")
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+
+	return nil
+}
+
+// Verify checks the signatures and the chain of the log at path and returns its entries. If publicKey is nil, all
+// the entries must be signed with the key of the first one.
+func Verify(path string, publicKey ed25519.PublicKey) ([]Entry, error) {
+	file, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	var entries []Entry
+	var prevHash string
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return entries, fmt.Errorf("%w: line %v: %v", ErrInvalidLog, len(entries)+1, err)
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(rec.Entry, &entry); err != nil {
+			return entries, fmt.Errorf("%w: line %v: %v", ErrInvalidLog, len(entries)+1, err)
+		}
+
+		entryKey, err := hex.DecodeString(entry.PublicKey)
+		if err != nil || len(entryKey) != ed25519.PublicKeySize {
+			return entries, fmt.Errorf("%w: entry %v has an invalid public key", ErrInvalidLog, entry.Sequence)
+		}
+
+		if publicKey == nil {
+			publicKey = entryKey
+		} else if !bytes.Equal(publicKey, entryKey) {
+			return entries, fmt.Errorf("%w: entry %v is signed with an unexpected key", ErrInvalidLog, entry.Sequence)
+		}
+
+		signature, err := hex.DecodeString(rec.Signature)
+		if err != nil || !ed25519.Verify(publicKey, rec.Entry, signature) {
+			return entries, fmt.Errorf("%w: entry %v has an invalid signature", ErrInvalidLog, entry.Sequence)
+		}
+
+		if entry.Sequence != uint64(len(entries))+1 {
+			return entries, fmt.Errorf("%w: expected entry %v, got %v", ErrInvalidLog, len(entries)+1, entry.Sequence)
+		}
+
+		if entry.PrevHash != prevHash {
+			return entries, fmt.Errorf("%w: entry %v does not follow the previous entry", ErrInvalidLog, entry.Sequence)
+		}
+
+		entries = append(entries, entry)
+		prevHash = hashLine(line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return entries, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	return entries, nil
+}
+
+// keyItem is the name of the signing key in the key store.
+const keyItem = keychain.ItemAuditKey
+
+func loadOrCreateKey(keys keychain.Store, legacyPath string) (ed25519.PrivateKey, error) {
+	seed, err := keys.Get(keyItem)
+	if err == nil {
+		if len(seed) != ed25519.SeedSize {
+			return nil, errors.New("invalid audit key in the key store")
+		}
+
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+
+	if !errors.Is(err, keychain.ErrNotFound) {
+		return nil, fmt.Errorf("failed to load audit key: %w", err)
+	}
+
+	seed, err = readLegacyKey(legacyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if seed == nil {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate audit key: %w", err)
+		}
+
+		seed = key.Seed()
+	}
+
+	if err := keys.Set(keyItem, seed); err != nil {
+		return nil, fmt.Errorf("failed to store audit key: %w", err)
+	}
+
+	// The plaintext copy is only removed once the key is stored.
+	if err := os.Remove(legacyPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove legacy audit key: %w", err)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// readLegacyKey returns the seed of the plaintext key at path, nil if there is none.
+func readLegacyKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path) //nolint:gosec
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read legacy audit key: %w", err)
+	}
+
+	seed, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid audit key '%v'", path)
+	}
+
+	return seed, nil
+}
+
+func readLastLine(path string) ([]byte, error) {
+	data, err := os.ReadFile(path) //nolint:gosec
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	return data[bytes.LastIndexByte(data, '\n')+1:], nil
+}
+
+func parseLine(line []byte) (Entry, error) {
+	var rec record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return Entry{}, fmt.Errorf("%w: %v", ErrInvalidLog, err)
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(rec.Entry, &entry); err != nil {
+		return Entry{}, fmt.Errorf("%w: %v", ErrInvalidLog, err)
+	}
+
+	return entry, nil
+}
+
+func hashLine(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+func currentUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+
+	return u.Username
+}
+
+func currentHost() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+
+	return host
+}
+
+// OutcomeFromError returns the outcome of an operation that finished with err.
+func OutcomeFromError(err error) Outcome {
+	switch {
+	case err == nil:
+		return OutcomeSuccess
+	case errors.Is(err, context.Canceled):
+		return OutcomeCancelled
+	default:
+		return OutcomeFailed
+	}
+}
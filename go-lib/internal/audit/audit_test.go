@@ -0,0 +1,188 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/export-tool/internal/keychain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_AppendAndVerify(t *testing.T) {
+	dir := t.TempDir()
+	keys := newMemoryStore()
+
+	log := openLog(t, dir, keys)
+
+	require.NoError(t, log.Append(Entry{
+		Event:        EventBackupStarted,
+		AccountID:    "user-id",
+		AccountEmail: "user@proton.me",
+		Path:         "/backup",
+		Parameters:   map[string]string{"shard": "1/2"},
+	}))
+	require.NoError(t, log.Append(Entry{
+		Event:   EventBackupFinished,
+		Outcome: OutcomeSuccess,
+		Counts:  map[string]uint64{"exported": 10},
+	}))
+
+	// Reopening the log continues the chain with the same key.
+	log = openLog(t, dir, keys)
+	require.NoError(t, log.Append(Entry{Event: EventRestoreStarted}))
+
+	entries, err := Verify(log.GetPath(), log.GetPublicKey())
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, uint64(3), entries[2].Sequence)
+	require.Equal(t, "user@proton.me", entries[0].AccountEmail)
+	require.Equal(t, "1/2", entries[0].Parameters["shard"])
+	require.Equal(t, uint64(10), entries[1].Counts["exported"])
+	require.Empty(t, entries[0].PrevHash)
+	require.NotEmpty(t, entries[1].PrevHash)
+}
+
+func TestVerify_Tampered(t *testing.T) {
+	newLog := func(t *testing.T) (*Log, [][]byte) {
+		log := openLog(t, t.TempDir(), newMemoryStore())
+
+		for _, event := range []Event{EventBackupStarted, EventBackupFinished, EventRestoreStarted} {
+			require.NoError(t, log.Append(Entry{Event: event, AccountEmail: "user@proton.me"}))
+		}
+
+		data, err := os.ReadFile(log.GetPath())
+		require.NoError(t, err)
+
+		return log, bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	}
+
+	write := func(t *testing.T, log *Log, lines [][]byte) {
+		require.NoError(t, os.WriteFile(log.GetPath(), append(bytes.Join(lines, []byte("\n")), '\n'), 0o600))
+	}
+
+	t.Run("edited", func(t *testing.T) {
+		log, lines := newLog(t)
+		lines[1] = bytes.Replace(lines[1], []byte("user@proton.me"), []byte("other@proton.me"), 1)
+		write(t, log, lines)
+
+		_, err := Verify(log.GetPath(), nil)
+		require.ErrorIs(t, err, ErrInvalidLog)
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		log, lines := newLog(t)
+		write(t, log, append(lines[:1], lines[2:]...))
+
+		entries, err := Verify(log.GetPath(), nil)
+		require.ErrorIs(t, err, ErrInvalidLog)
+		require.Len(t, entries, 1)
+	})
+
+	t.Run("other key", func(t *testing.T) {
+		log, _ := newLog(t)
+		other := openLog(t, t.TempDir(), newMemoryStore())
+
+		_, err := Verify(log.GetPath(), other.GetPublicKey())
+		require.ErrorIs(t, err, ErrInvalidLog)
+	})
+}
+
+func TestLog_NoKeyStore(t *testing.T) {
+	log, err := Open(t.TempDir())
+	require.NoError(t, err)
+	require.False(t, log.HasKey())
+
+	require.ErrorIs(t, log.Append(Entry{Event: EventBackupStarted}), ErrNoSigningKey)
+	require.ErrorIs(t, Record(log, Entry{Event: EventBackupStarted}), ErrNoSigningKey)
+	require.NoError(t, Record(nil, Entry{Event: EventBackupStarted}))
+
+	_, err = log.Sign(map[string]string{})
+	require.ErrorIs(t, err, ErrNoSigningKey)
+}
+
+func TestLog_MigrateLegacyKey(t *testing.T) {
+	dir := t.TempDir()
+	_, legacy, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	legacyPath := filepath.Join(dir, LegacyKeyFileName)
+	require.NoError(t, os.WriteFile(legacyPath, []byte(hex.EncodeToString(legacy.Seed())), 0o600))
+
+	keys := newMemoryStore()
+	log := openLog(t, dir, keys)
+
+	// The key is moved to the store, the entries signed before still verify with it.
+	require.Equal(t, legacy.Public(), log.GetPublicKey())
+	require.NoFileExists(t, legacyPath)
+
+	seed, err := keys.Get(keychain.ItemAuditKey)
+	require.NoError(t, err)
+	require.Equal(t, legacy.Seed(), seed)
+}
+
+func TestLog_InvalidLegacyKey(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, LegacyKeyFileName), []byte("not a key"), 0o600))
+
+	log, err := Open(dir)
+	require.NoError(t, err)
+	require.Error(t, log.SetKeyStore(newMemoryStore()))
+}
+
+func openLog(t *testing.T, dir string, keys keychain.Store) *Log {
+	t.Helper()
+
+	log, err := Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, log.SetKeyStore(keys))
+
+	return log
+}
+
+// memoryStore is a keychain kept in memory.
+type memoryStore map[string][]byte
+
+func newMemoryStore() memoryStore {
+	return memoryStore{}
+}
+
+func (s memoryStore) Get(name string) ([]byte, error) {
+	secret, ok := s[name]
+	if !ok {
+		return nil, keychain.ErrNotFound
+	}
+
+	return secret, nil
+}
+
+func (s memoryStore) Set(name string, secret []byte) error {
+	s[name] = secret
+	return nil
+}
+
+func (s memoryStore) Delete(name string) error {
+	delete(s, name)
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidDocument = errors.New("invalid signed document")
+
+// SignedDocument is a JSON document signed with the key of the audit log, such as a report users keep as evidence.
+type SignedDocument struct {
+	Document  json.RawMessage
+	Signature string // Hex encoded ed25519 signature of the compact encoding of Document, it is written indented.
+	PublicKey string // Hex encoded ed25519 key of the audit log.
+}
+
+// Sign encodes v and signs it with the key of the audit log. The result is indented to be readable.
+func (l *Log) Sign(v any) ([]byte, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.key == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	document, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode document: %w", err)
+	}
+
+	data, err := json.MarshalIndent(SignedDocument{
+		Document:  document,
+		Signature: hex.EncodeToString(ed25519.Sign(l.key, document)),
+		PublicKey: hex.EncodeToString(l.getPublicKey()),
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode signed document: %w", err)
+	}
+
+	return data, nil
+}
+
+// VerifyDocument checks the signature of data, written by Sign, and decodes its document into v. If publicKey is nil,
+// the key embedded in the document is trusted.
+func VerifyDocument(data []byte, publicKey ed25519.PublicKey, v any) error {
+	var signed SignedDocument
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+	}
+
+	documentKey, err := hex.DecodeString(signed.PublicKey)
+	if err != nil || len(documentKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: invalid public key", ErrInvalidDocument)
+	}
+
+	if publicKey == nil {
+		publicKey = documentKey
+	} else if !bytes.Equal(publicKey, documentKey) {
+		return fmt.Errorf("%w: signed with an unexpected key", ErrInvalidDocument)
+	}
+
+	var document bytes.Buffer
+	if err := json.Compact(&document, signed.Document); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+	}
+
+	signature, err := hex.DecodeString(signed.Signature)
+	if err != nil || !ed25519.Verify(publicKey, document.Bytes(), signature) {
+		return fmt.Errorf("%w: invalid signature", ErrInvalidDocument)
+	}
+
+	return json.Unmarshal(document.Bytes(), v)
+}
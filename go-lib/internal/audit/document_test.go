@@ -0,0 +1,47 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_SignAndVerifyDocument(t *testing.T) {
+	log := openLog(t, t.TempDir(), newMemoryStore())
+
+	type report struct {
+		Ready bool
+		Note  string
+	}
+
+	data, err := log.Sign(report{Ready: true, Note: "all good"})
+	require.NoError(t, err)
+
+	var decoded report
+	require.NoError(t, VerifyDocument(data, log.GetPublicKey(), &decoded))
+	require.Equal(t, report{Ready: true, Note: "all good"}, decoded)
+
+	tampered := bytes.Replace(data, []byte("true"), []byte("false"), 1)
+	require.ErrorIs(t, VerifyDocument(tampered, nil, &decoded), ErrInvalidDocument)
+
+	other := openLog(t, t.TempDir(), newMemoryStore())
+	require.ErrorIs(t, VerifyDocument(data, other.GetPublicKey(), &decoded), ErrInvalidDocument)
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+)
+
+var ErrNotEncrypted = errors.New("audit entry is not encrypted")
+
+// details are the fields of an entry that identify the operator, the account and the exported data. When the log has
+// a recipient, they are only readable by the holder of the recipient key, e.g. a compliance officer, while the
+// sequence, time and event of the entries remain readable so that the chain can be verified by anyone.
+type details struct {
+	OSUser       string
+	Hostname     string
+	AccountID    string
+	AccountEmail string
+	Path         string
+	Parameters   map[string]string `json:",omitempty"`
+	Outcome      Outcome           `json:",omitempty"`
+	Error        string            `json:",omitempty"`
+	Counts       map[string]uint64 `json:",omitempty"`
+}
+
+// LoadRecipientKey loads the armored OpenPGP public key the audit entries are encrypted to.
+func LoadRecipientKey(path string) (*crypto.KeyRing, error) {
+	armored, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit recipient key: %w", err)
+	}
+
+	key, err := crypto.NewKeyFromArmored(string(armored))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse audit recipient key: %w", err)
+	}
+
+	if !key.CanEncrypt() {
+		return nil, fmt.Errorf("audit recipient key '%v' cannot be used for encryption", key.GetFingerprint())
+	}
+
+	keyRing, err := crypto.NewKeyRing(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audit recipient key ring: %w", err)
+	}
+
+	return keyRing, nil
+}
+
+// encryptDetails replaces the details of the entry with their encryption to recipient.
+func (e *Entry) encryptDetails(recipient *crypto.KeyRing) error {
+	data, err := json.Marshal(details{
+		OSUser:       e.OSUser,
+		Hostname:     e.Hostname,
+		AccountID:    e.AccountID,
+		AccountEmail: e.AccountEmail,
+		Path:         e.Path,
+		Parameters:   e.Parameters,
+		Outcome:      e.Outcome,
+		Error:        e.Error,
+		Counts:       e.Counts,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry details: %w", err)
+	}
+
+	encrypted, err := recipient.Encrypt(crypto.NewPlainMessage(data), nil)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt audit entry details: %w", err)
+	}
+
+	armored, err := encrypted.GetArmored()
+	if err != nil {
+		return fmt.Errorf("failed to armor audit entry details: %w", err)
+	}
+
+	*e = Entry{
+		Sequence:         e.Sequence,
+		Time:             e.Time,
+		Event:            e.Event,
+		ToolVersion:      e.ToolVersion,
+		EncryptedDetails: armored,
+		PrevHash:         e.PrevHash,
+		PublicKey:        e.PublicKey,
+	}
+
+	return nil
+}
+
+// DecryptEntry returns the entry with its details decrypted with keyRing, which must hold the unlocked private key of
+// the recipient.
+func DecryptEntry(entry Entry, keyRing *crypto.KeyRing) (Entry, error) {
+	if len(entry.EncryptedDetails) == 0 {
+		return Entry{}, ErrNotEncrypted
+	}
+
+	encrypted, err := crypto.NewPGPMessageFromArmored(entry.EncryptedDetails)
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to parse audit entry details: %w", err)
+	}
+
+	decrypted, err := keyRing.Decrypt(encrypted, nil, 0)
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to decrypt audit entry details: %w", err)
+	}
+
+	var d details
+	if err := json.Unmarshal(decrypted.GetBinary(), &d); err != nil {
+		return Entry{}, fmt.Errorf("failed to decode audit entry details: %w", err)
+	}
+
+	entry.OSUser = d.OSUser
+	entry.Hostname = d.Hostname
+	entry.AccountID = d.AccountID
+	entry.AccountEmail = d.AccountEmail
+	entry.Path = d.Path
+	entry.Parameters = d.Parameters
+	entry.Outcome = d.Outcome
+	entry.Error = d.Error
+	entry.Counts = d.Counts
+	entry.EncryptedDetails = ""
+
+	return entry, nil
+}
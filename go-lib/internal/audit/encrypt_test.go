@@ -0,0 +1,100 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_EncryptedDetails(t *testing.T) {
+	dir := t.TempDir()
+
+	privateKey, err := crypto.GenerateKey("Compliance", "compliance@example.com", "x25519", 0)
+	require.NoError(t, err)
+
+	publicKey, err := privateKey.GetArmoredPublicKey()
+	require.NoError(t, err)
+
+	keyPath := filepath.Join(dir, "compliance.asc")
+	require.NoError(t, os.WriteFile(keyPath, []byte(publicKey), 0o600))
+
+	recipient, err := LoadRecipientKey(keyPath)
+	require.NoError(t, err)
+
+	log := openLog(t, dir, newMemoryStore())
+
+	require.NoError(t, log.Append(Entry{Event: EventBackupStarted, AccountEmail: "plain@proton.me"}))
+
+	log.SetRecipient(recipient)
+	require.NoError(t, log.Append(Entry{
+		Event:        EventBackupFinished,
+		AccountEmail: "user@proton.me",
+		Path:         "/backup",
+		Outcome:      OutcomeSuccess,
+		Counts:       map[string]uint64{"exported": 10},
+	}))
+
+	data, err := os.ReadFile(log.GetPath())
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "user@proton.me")
+
+	// The chain can be verified without the recipient key.
+	entries, err := Verify(log.GetPath(), log.GetPublicKey())
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "plain@proton.me", entries[0].AccountEmail)
+	require.Equal(t, EventBackupFinished, entries[1].Event)
+	require.Empty(t, entries[1].AccountEmail)
+	require.NotEmpty(t, entries[1].EncryptedDetails)
+
+	_, err = DecryptEntry(entries[0], nil)
+	require.ErrorIs(t, err, ErrNotEncrypted)
+
+	keyRing, err := crypto.NewKeyRing(privateKey)
+	require.NoError(t, err)
+
+	entry, err := DecryptEntry(entries[1], keyRing)
+	require.NoError(t, err)
+	require.Equal(t, "user@proton.me", entry.AccountEmail)
+	require.Equal(t, "/backup", entry.Path)
+	require.Equal(t, OutcomeSuccess, entry.Outcome)
+	require.Equal(t, uint64(10), entry.Counts["exported"])
+	require.Empty(t, entry.EncryptedDetails)
+
+	otherKey, err := crypto.GenerateKey("Other", "other@example.com", "x25519", 0)
+	require.NoError(t, err)
+
+	otherKeyRing, err := crypto.NewKeyRing(otherKey)
+	require.NoError(t, err)
+
+	_, err = DecryptEntry(entries[1], otherKeyRing)
+	require.Error(t, err)
+}
+
+func TestLoadRecipientKey_Invalid(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "key.asc")
+	require.NoError(t, os.WriteFile(keyPath, []byte("not a key"), 0o600))
+
+	_, err := LoadRecipientKey(keyPath)
+	require.Error(t, err)
+}
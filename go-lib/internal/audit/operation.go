@@ -0,0 +1,133 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/mail"
+	"github.com/ProtonMail/go-proton-api"
+)
+
+// NewEntry returns the entry of an operation run on the account of user.
+func NewEntry(event Event, user *proton.User, path string, params map[string]string) Entry {
+	return Entry{
+		Event:        event,
+		AccountID:    user.ID,
+		AccountEmail: user.Email,
+		Path:         path,
+		Parameters:   params,
+	}
+}
+
+// SetOutcome records the result of an operation that finished with err.
+func (e *Entry) SetOutcome(err error) {
+	e.Outcome = OutcomeFromError(err)
+	if err != nil {
+		e.Error = err.Error()
+	}
+}
+
+// BackupParameters returns the options that restrict the messages exported by task.
+func BackupParameters(task *mail.ExportTask) map[string]string {
+	params := map[string]string{
+		"auto_generated": task.GetAutoGeneratedMode().String(),
+		"output_format":  task.GetOutputFormat().String(),
+	}
+
+	if filter := task.GetFilter(); filter != nil {
+		if data, err := json.Marshal(filter); err == nil {
+			params["filter"] = string(data)
+		}
+	}
+
+	if task.GetIncremental() {
+		params["incremental"] = "true"
+	}
+
+	if task.GetResume() {
+		params["resume"] = "true"
+	}
+
+	if task.GetDurable() {
+		params["durable"] = "true"
+	}
+
+	if mirrors := task.GetMirrors(); len(mirrors) != 0 {
+		params["mirrors"] = strings.Join(mirrors, ",")
+	}
+
+	if parity := task.GetParity(); parity != 0 {
+		params["parity"] = strconv.Itoa(parity)
+	}
+
+	if shard := task.GetShard(); shard != nil {
+		params["shard"] = shard.String()
+		params["shard_by"] = shard.Mode.String()
+
+		if shard.Mode == mail.ShardModeDate {
+			if !shard.After.IsZero() {
+				params["shard_after"] = shard.After.UTC().Format(time.RFC3339)
+			}
+			if !shard.Before.IsZero() {
+				params["shard_before"] = shard.Before.UTC().Format(time.RFC3339)
+			}
+		} else {
+			params["shard_first_id"] = shard.FirstID
+			params["shard_last_id"] = shard.LastID
+		}
+	}
+
+	return params
+}
+
+// RestoreParameters returns the options task is run with.
+func RestoreParameters(task *mail.RestoreTask) map[string]string {
+	params := map[string]string{
+		"transactional":        strconv.FormatBool(task.IsTransactional()),
+		"always_create_labels": strconv.FormatBool(task.GetLabelReuseMode() == mail.LabelReuseModeAlwaysCreate),
+		"import_label":         strconv.FormatBool(task.GetImportLabel()),
+		"skip_duplicates":      strconv.FormatBool(task.GetSkipDuplicates()),
+		"resume":               strconv.FormatBool(task.GetResume()),
+		"concurrency":          strconv.Itoa(task.GetConcurrency()),
+	}
+
+	if filter := task.GetFilter(); filter != nil {
+		if data, err := json.Marshal(filter); err == nil {
+			params["filter"] = string(data)
+		}
+	}
+
+	if guardrails := task.GetGuardrails(); guardrails != (mail.RestoreGuardrails{}) {
+		if data, err := json.Marshal(guardrails); err == nil {
+			params["guardrails"] = string(data)
+		}
+	}
+
+	return params
+}
+
+// ImportParameters returns the options task is run with.
+func ImportParameters(task *mail.ImportTask) map[string]string {
+	return map[string]string{
+		"import_label": strconv.FormatBool(task.GetImportLabel()),
+	}
+}
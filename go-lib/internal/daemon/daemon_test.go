@@ -0,0 +1,189 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/export-tool/internal/mail"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRunner struct {
+	stopCh chan struct{}
+	modes  []mail.CancelMode
+}
+
+func newFakeRunner() *fakeRunner {
+	return &fakeRunner{stopCh: make(chan struct{})}
+}
+
+func (r *fakeRunner) starting() error { return nil }
+
+func (r *fakeRunner) run(_ *taskReporter) (mail.CancelCause, error) {
+	<-r.stopCh
+	return mail.CancelCauseUser, mail.ErrCancelledByUser
+}
+
+func (r *fakeRunner) cancel(_ context.Context, mode mail.CancelMode) {
+	r.modes = append(r.modes, mode)
+}
+
+func (r *fakeRunner) path() string { return "/backup" }
+
+func (r *fakeRunner) close() {}
+
+func TestTask_PauseAndCancel(t *testing.T) {
+	tk := newTask("1", TaskRequest{Kind: TaskKindBackup, Folder: "/backup"})
+
+	r := newFakeRunner()
+	tk.start(r)
+	require.Equal(t, TaskStateRunning, tk.getStatus().State)
+	require.Equal(t, "/backup", tk.getStatus().Path)
+
+	events, unsubscribe := tk.subscribe()
+	defer unsubscribe()
+	require.Equal(t, TaskStateRunning, (<-events).State)
+
+	require.NoError(t, tk.cancel(context.Background(), mail.CancelModeGraceful, true))
+	require.Equal(t, TaskStatePausing, (<-events).State)
+	require.Equal(t, []mail.CancelMode{mail.CancelModeGraceful}, r.modes)
+
+	close(r.stopCh)
+	require.Equal(t, TaskStatePaused, tk.finish(r.run(nil)))
+	require.Empty(t, tk.getStatus().Error)
+
+	// A paused task has nothing left to stop and cannot be paused again.
+	require.ErrorIs(t, tk.cancel(context.Background(), mail.CancelModeGraceful, true), ErrInvalidState)
+	require.NoError(t, tk.cancel(context.Background(), mail.CancelModeImmediate, false))
+	require.Equal(t, TaskStateCancelled, tk.getStatus().State)
+}
+
+func TestTask_Cancel(t *testing.T) {
+	tk := newTask("1", TaskRequest{Kind: TaskKindRestore, Folder: "/backup"})
+
+	r := newFakeRunner()
+	tk.start(r)
+
+	require.NoError(t, tk.cancel(context.Background(), mail.CancelModeImmediate, false))
+	require.Equal(t, TaskStateCancelling, tk.getStatus().State)
+
+	close(r.stopCh)
+	require.Equal(t, TaskStateCancelled, tk.finish(r.run(nil)))
+	require.Equal(t, mail.ErrCancelledByUser.Error(), tk.getStatus().Error)
+	require.ErrorIs(t, tk.cancel(context.Background(), mail.CancelModeImmediate, false), ErrInvalidState)
+}
+
+func TestTaskRequest_Validate(t *testing.T) {
+	require.NoError(t, (&TaskRequest{Kind: TaskKindBackup, Folder: "/backup", Incremental: true}).validate())
+	require.NoError(t, (&TaskRequest{Kind: TaskKindRestore, Folder: "/backup"}).validate())
+	require.Error(t, (&TaskRequest{Kind: "import", Folder: "/backup"}).validate())
+	require.Error(t, (&TaskRequest{Kind: TaskKindBackup}).validate())
+	require.Error(t, (&TaskRequest{Kind: TaskKindRestore, Folder: "/backup", Incremental: true}).validate())
+}
+
+func TestHandler_Routes(t *testing.T) {
+	server := &Server{ctx: context.Background(), tasks: make(map[string]*task)}
+
+	paused := newTask("1", TaskRequest{Kind: TaskKindBackup, Folder: "/backup"})
+	paused.status.State = TaskStatePaused
+	server.tasks[paused.id] = paused
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{http.MethodGet, "/tasks", "", http.StatusOK},
+		{http.MethodGet, "/tasks/1", "", http.StatusOK},
+		{http.MethodGet, "/tasks/2", "", http.StatusNotFound},
+		{http.MethodGet, "/status", "", http.StatusNotFound},
+		{http.MethodGet, "/tasks/1/stop", "", http.StatusNotFound},
+		{http.MethodDelete, "/tasks", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/tasks/1/pause", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/tasks", `{"Kind":"import","Folder":"/backup"}`, http.StatusBadRequest},
+		{http.MethodPost, "/tasks", `{"Kind":"backup","Path":"/backup"}`, http.StatusBadRequest},
+		{http.MethodPost, "/tasks/1/pause", "", http.StatusConflict},
+		{http.MethodPost, "/tasks/1/cancel", `{"Mode":"later"}`, http.StatusBadRequest},
+		{http.MethodPost, "/tasks/1/cancel", "", http.StatusOK},
+		{http.MethodPost, "/tasks/1/resume", "", http.StatusConflict},
+	}
+
+	h := newHandler(server)
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+
+		require.Equal(t, test.code, recorder.Code, "%v %v", test.method, test.path)
+
+		if test.code != http.StatusOK {
+			var response ErrorResponse
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+			require.NotEmpty(t, response.Error)
+		}
+	}
+
+	require.Equal(t, TaskStateCancelled, paused.getStatus().State)
+}
+
+func TestListen(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the mode of sockets is not enforced on Windows")
+	}
+
+	// The socket paths are limited to around 100 bytes, shorter than some temporary directories.
+	dir, err := os.MkdirTemp("", "daemon")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "export.sock")
+
+	listener, err := Listen(path)
+	require.NoError(t, err)
+
+	info, err := os.Lstat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSocket|0o600, info.Mode())
+
+	// A socket left by a previous run is replaced.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false) //nolint:forcetypeassert
+	require.NoError(t, listener.Close())
+
+	listener, err = Listen(path)
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+
+	// Any other file is kept.
+	other := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(other, []byte("{}"), 0o600))
+
+	_, err = Listen(other)
+	require.ErrorIs(t, err, ErrNotSocket)
+	require.FileExists(t, other)
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ProtonMail/export-tool/internal/mail"
+	"github.com/sirupsen/logrus"
+)
+
+// maxRequestSize limits the size of the request bodies, they are small JSON objects.
+const maxRequestSize = 64 * 1024
+
+type handler struct {
+	server *Server
+}
+
+func newHandler(s *Server) http.Handler {
+	return &handler{server: s}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if parts[0] != "tasks" || len(parts) > 3 {
+		writeError(w, http.StatusNotFound, errors.New("unknown route"))
+		return
+	}
+
+	// allow lists the methods accepted by the route.
+	var allow string
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, h.server.List())
+		return
+
+	case len(parts) == 1:
+		allow = http.MethodGet + ", " + http.MethodPost
+		if r.Method == http.MethodPost {
+			h.start(w, r)
+			return
+		}
+
+	case len(parts) == 2:
+		allow = http.MethodGet
+		if r.Method == allow {
+			writeResult(w, http.StatusOK)(h.server.GetStatus(parts[1]))
+			return
+		}
+
+	case parts[2] == "events":
+		allow = http.MethodGet
+		if r.Method == allow {
+			h.events(w, r, parts[1])
+			return
+		}
+
+	case parts[2] == "cancel":
+		allow = http.MethodPost
+		if r.Method == allow {
+			h.cancel(w, r, parts[1])
+			return
+		}
+
+	case parts[2] == "pause":
+		allow = http.MethodPost
+		if r.Method == allow {
+			writeResult(w, http.StatusOK)(h.server.Pause(parts[1]))
+			return
+		}
+
+	case parts[2] == "resume":
+		allow = http.MethodPost
+		if r.Method == allow {
+			writeResult(w, http.StatusOK)(h.server.Resume(parts[1]))
+			return
+		}
+
+	default:
+		writeError(w, http.StatusNotFound, errors.New("unknown route"))
+		return
+	}
+
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+}
+
+func (h *handler) start(w http.ResponseWriter, r *http.Request) {
+	var request TaskRequest
+
+	if err := readJSON(r, &request, false); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeResult(w, http.StatusCreated)(h.server.Start(request))
+}
+
+func (h *handler) cancel(w http.ResponseWriter, r *http.Request, id string) {
+	var request CancelRequest
+
+	if err := readJSON(r, &request, true); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	mode, err := cancelModeFromString(request.Mode)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeResult(w, http.StatusOK)(h.server.Cancel(id, mode))
+}
+
+// events streams the status of the task each time it changes, until it stops running or the client disconnects.
+func (h *handler) events(w http.ResponseWriter, r *http.Request, id string) {
+	t, err := h.server.getTask(id)
+	if err != nil {
+		writeError(w, statusCodeFromError(err), err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	ch, unsubscribe := t.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case status := <-ch:
+			if err := encoder.Encode(status); err != nil {
+				return
+			}
+
+			flusher.Flush()
+
+			if !status.State.isActive() {
+				return
+			}
+		}
+	}
+}
+
+func cancelModeFromString(mode string) (mail.CancelMode, error) {
+	switch strings.ToLower(mode) {
+	case "", mail.CancelModeImmediate.String():
+		return mail.CancelModeImmediate, nil
+	case mail.CancelModeGraceful.String():
+		return mail.CancelModeGraceful, nil
+	default:
+		return mail.CancelModeImmediate, fmt.Errorf("unknown cancel mode '%v'", mode)
+	}
+}
+
+// readJSON decodes the body of r into v. An empty body is accepted when optional is set.
+func readJSON(r *http.Request, v any, optional bool) error {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		if optional && errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+
+	return nil
+}
+
+// writeResult returns a function writing the status returned by a Server method, or its error.
+func writeResult(w http.ResponseWriter, code int) func(TaskStatus, error) {
+	return func(status TaskStatus, err error) {
+		if err != nil {
+			writeError(w, statusCodeFromError(err), err)
+			return
+		}
+
+		writeJSON(w, code, status)
+	}
+}
+
+func statusCodeFromError(err error) int {
+	switch {
+	case errors.Is(err, ErrTaskNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrTaskRunning), errors.Is(err, ErrInvalidState):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, ErrorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.WithError(err).Warn("Failed to write response")
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"context"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/mail"
+	"github.com/ProtonMail/export-tool/internal/session"
+)
+
+type backupRunner struct {
+	ctx   context.Context //nolint:containedctx
+	task  *mail.ExportTask
+	hooks Hooks
+	start time.Time
+}
+
+// newBackupRunner creates the export of request. A resumed incremental backup is simply updated again, any other
+// backup continues from its checkpoint.
+func newBackupRunner(
+	ctx context.Context,
+	session *session.Session,
+	hooks Hooks,
+	request TaskRequest,
+	resume bool,
+) (runner, error) {
+	exportTask := mail.NewExportTask(ctx, request.Folder, session)
+
+	if err := exportTask.SetIncremental(request.Incremental, false); err != nil {
+		exportTask.Close()
+		return nil, err
+	}
+
+	if err := exportTask.SetResume(resume && !request.Incremental); err != nil {
+		exportTask.Close()
+		return nil, err
+	}
+
+	return &backupRunner{ctx: ctx, task: exportTask, hooks: hooks}, nil
+}
+
+func (r *backupRunner) starting() error {
+	if r.hooks.BackupStarting == nil {
+		return nil
+	}
+
+	return r.hooks.BackupStarting(r.task)
+}
+
+func (r *backupRunner) run(reporter *taskReporter) (mail.CancelCause, error) {
+	r.start = time.Now()
+
+	result, err := r.task.Run(r.ctx, reporter)
+
+	if r.hooks.BackupFinished != nil {
+		r.hooks.BackupFinished(r.task, result, r.start, err)
+	}
+
+	return result.CancelCause, err
+}
+
+func (r *backupRunner) cancel(ctx context.Context, mode mail.CancelMode) {
+	r.task.Cancel(ctx, mode)
+}
+
+func (r *backupRunner) path() string {
+	return r.task.GetExportPath()
+}
+
+func (r *backupRunner) close() {
+	r.task.Close()
+}
+
+type restoreRunner struct {
+	task  *mail.RestoreTask
+	hooks Hooks
+	start time.Time
+}
+
+func newRestoreRunner(
+	ctx context.Context,
+	session *session.Session,
+	hooks Hooks,
+	request TaskRequest,
+	resume bool,
+) (runner, error) {
+	restoreTask, err := mail.NewRestoreTask(ctx, request.Folder, session)
+	if err != nil {
+		return nil, err
+	}
+
+	restoreTask.SetResume(resume)
+
+	return &restoreRunner{task: restoreTask, hooks: hooks}, nil
+}
+
+func (r *restoreRunner) starting() error {
+	if r.hooks.RestoreStarting == nil {
+		return nil
+	}
+
+	return r.hooks.RestoreStarting(r.task)
+}
+
+func (r *restoreRunner) run(reporter *taskReporter) (mail.CancelCause, error) {
+	r.start = time.Now()
+
+	_, err := r.task.Run(reporter)
+
+	if r.hooks.RestoreFinished != nil {
+		r.hooks.RestoreFinished(r.task, r.start, err)
+	}
+
+	return r.task.GetCancelCause(), err
+}
+
+func (r *restoreRunner) cancel(ctx context.Context, mode mail.CancelMode) {
+	r.task.Cancel(ctx, mode)
+}
+
+func (r *restoreRunner) path() string {
+	return r.task.GetBackupPath()
+}
+
+func (r *restoreRunner) close() {
+	r.task.Close()
+}
+
+// taskReporter forwards the progress of a run to the status of its task.
+type taskReporter struct {
+	task *task
+}
+
+func newTaskReporter(t *task) *taskReporter {
+	return &taskReporter{task: t}
+}
+
+func (r *taskReporter) SetMessageTotal(total uint64) {
+	r.task.update(func(status *TaskStatus) { status.Total = total })
+}
+
+func (r *taskReporter) SetMessageProcessed(processed uint64) {
+	r.task.update(func(status *TaskStatus) { status.Processed = processed })
+}
+
+func (r *taskReporter) OnProgress(delta int) {
+	if delta <= 0 {
+		return
+	}
+
+	r.task.update(func(status *TaskStatus) { status.Processed += uint64(delta) })
+}
+
+func (r *taskReporter) OnProgressEvent(event mail.ProgressEvent) {
+	r.task.update(func(status *TaskStatus) { status.Progress = &event })
+}
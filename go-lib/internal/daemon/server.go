@@ -0,0 +1,331 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package daemon runs the backups and restores of a logged in session on behalf of local clients, such as scripts on a
+// NAS. The control API is HTTP with JSON bodies, served on a local socket that only the owner of the process can open:
+//
+//	GET  /tasks              lists the tasks.
+//	POST /tasks              starts a task, the body is a TaskRequest.
+//	GET  /tasks/{id}         returns the TaskStatus of a task.
+//	GET  /tasks/{id}/events  streams the TaskStatus of a task, one JSON object per line, until it stops running.
+//	POST /tasks/{id}/cancel  cancels a task, the optional body is a CancelRequest.
+//	POST /tasks/{id}/pause   stops a task gracefully, keeping its checkpoint.
+//	POST /tasks/{id}/resume  continues a paused task from its checkpoint.
+//
+// The errors are returned as an ErrorResponse. For instance: curl --unix-socket export.sock http://localhost/tasks.
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/mail"
+	"github.com/ProtonMail/export-tool/internal/session"
+	"github.com/ProtonMail/gluon/async"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrTaskRunning  = errors.New("a task is already running")
+	ErrTaskNotFound = errors.New("task not found")
+	ErrInvalidState = errors.New("invalid task state")
+	ErrNotSocket    = errors.New("file exists and is not a socket")
+)
+
+// Hooks let the application record the tasks, e.g. in the audit log and the run history. An error returned by a
+// starting hook prevents the task from running. All the hooks are optional.
+type Hooks struct {
+	BackupStarting  func(task *mail.ExportTask) error
+	BackupFinished  func(task *mail.ExportTask, result mail.ExportResult, startTime time.Time, err error)
+	RestoreStarting func(task *mail.RestoreTask) error
+	RestoreFinished func(task *mail.RestoreTask, startTime time.Time, err error)
+}
+
+// Server runs the tasks requested through the control API, one at a time.
+type Server struct {
+	ctx          context.Context //nolint:containedctx
+	session      *session.Session
+	hooks        Hooks
+	panicHandler async.PanicHandler
+	log          *logrus.Entry
+
+	lock   sync.Mutex
+	tasks  map[string]*task
+	nextID int
+	wg     sync.WaitGroup
+}
+
+// NewServer creates a server running the tasks of session. The tasks are cancelled when ctx is done.
+func NewServer(ctx context.Context, session *session.Session, hooks Hooks) *Server {
+	return &Server{
+		ctx:          ctx,
+		session:      session,
+		hooks:        hooks,
+		panicHandler: session.GetPanicHandler(),
+		log:          logrus.WithField("daemon", "server"),
+		tasks:        make(map[string]*task),
+	}
+}
+
+// Listen creates the socket of the control API at path. A socket left by a previous run is replaced, any other file is
+// left untouched and is an error.
+func Listen(path string) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil:
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%w: '%v'", ErrNotSocket, path)
+		}
+
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove previous socket: %w", err)
+		}
+
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("failed to check previous socket: %w", err)
+	}
+
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket: %w", err)
+	}
+
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to restrict socket access: %w", err)
+	}
+
+	return listener, nil
+}
+
+// Serve answers the requests received on listener until the context of the server is done. The running task is then
+// cancelled and waited for.
+func (s *Server) Serve(listener net.Listener) error {
+	httpServer := &http.Server{
+		Handler:           newHandler(s),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return s.ctx },
+	}
+
+	go func() {
+		defer async.HandlePanic(s.panicHandler)
+
+		<-s.ctx.Done()
+
+		s.log.Info("Stopping")
+		_ = httpServer.Close()
+	}()
+
+	s.log.WithField("address", listener.Addr().String()).Info("Listening")
+
+	err := httpServer.Serve(listener)
+
+	s.cancelAll()
+	s.wg.Wait()
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// Start creates a task and runs it in the background.
+func (s *Server) Start(request TaskRequest) (TaskStatus, error) {
+	if err := request.validate(); err != nil {
+		return TaskStatus{}, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.hasRunningTask() {
+		return TaskStatus{}, ErrTaskRunning
+	}
+
+	s.nextID++
+
+	t := newTask(strconv.Itoa(s.nextID), request)
+	s.tasks[t.id] = t
+
+	if err := s.run(t, false); err != nil {
+		delete(s.tasks, t.id)
+		return TaskStatus{}, err
+	}
+
+	return t.getStatus(), nil
+}
+
+// Resume continues a paused task from its checkpoint.
+func (s *Server) Resume(id string) (TaskStatus, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t, ok := s.tasks[id]
+	if !ok {
+		return TaskStatus{}, ErrTaskNotFound
+	}
+
+	if state := t.getStatus().State; state != TaskStatePaused {
+		return TaskStatus{}, fmt.Errorf("%w: cannot resume a %v task", ErrInvalidState, state)
+	}
+
+	if s.hasRunningTask() {
+		return TaskStatus{}, ErrTaskRunning
+	}
+
+	if err := s.run(t, true); err != nil {
+		return TaskStatus{}, err
+	}
+
+	return t.getStatus(), nil
+}
+
+// Cancel stops a running task, see mail.CancelMode. A paused task is cancelled right away.
+func (s *Server) Cancel(id string, mode mail.CancelMode) (TaskStatus, error) {
+	t, err := s.getTask(id)
+	if err != nil {
+		return TaskStatus{}, err
+	}
+
+	if err := t.cancel(s.ctx, mode, false); err != nil {
+		return TaskStatus{}, err
+	}
+
+	return t.getStatus(), nil
+}
+
+// Pause stops a running task gracefully. It can be continued with Resume once its state is TaskStatePaused.
+func (s *Server) Pause(id string) (TaskStatus, error) {
+	t, err := s.getTask(id)
+	if err != nil {
+		return TaskStatus{}, err
+	}
+
+	if err := t.cancel(s.ctx, mail.CancelModeGraceful, true); err != nil {
+		return TaskStatus{}, err
+	}
+
+	return t.getStatus(), nil
+}
+
+func (s *Server) GetStatus(id string) (TaskStatus, error) {
+	t, err := s.getTask(id)
+	if err != nil {
+		return TaskStatus{}, err
+	}
+
+	return t.getStatus(), nil
+}
+
+// List returns the status of the tasks, the oldest first.
+func (s *Server) List() []TaskStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	statuses := make([]TaskStatus, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		statuses = append(statuses, t.getStatus())
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].StartTime.Before(statuses[j].StartTime) })
+
+	return statuses
+}
+
+func (s *Server) getTask(id string) (*task, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t, ok := s.tasks[id]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+
+	return t, nil
+}
+
+// hasRunningTask must be called with the lock held.
+func (s *Server) hasRunningTask() bool {
+	for _, t := range s.tasks {
+		if t.getStatus().State.isActive() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// run creates the runner of t and starts it, it must be called with the lock held.
+func (s *Server) run(t *task, resume bool) error {
+	var (
+		r   runner
+		err error
+	)
+
+	switch t.request.Kind {
+	case TaskKindBackup:
+		r, err = newBackupRunner(s.ctx, s.session, s.hooks, t.request, resume)
+	case TaskKindRestore:
+		r, err = newRestoreRunner(s.ctx, s.session, s.hooks, t.request, resume)
+	default:
+		err = fmt.Errorf("unknown task kind '%v'", t.request.Kind)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := r.starting(); err != nil {
+		r.close()
+		return err
+	}
+
+	t.start(r)
+
+	log := s.log.WithFields(logrus.Fields{"task": t.id, "kind": t.request.Kind, "resume": resume})
+	log.Info("Task started")
+
+	s.wg.Add(1)
+
+	go func() {
+		defer async.HandlePanic(s.panicHandler)
+		defer s.wg.Done()
+
+		state := t.finish(r.run(newTaskReporter(t)))
+		log.WithField("state", state).Info("Task stopped")
+	}()
+
+	return nil
+}
+
+func (s *Server) cancelAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, t := range s.tasks {
+		_ = t.cancel(context.Background(), mail.CancelModeImmediate, false)
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build windows
+
+package daemon
+
+import "net"
+
+// listenPrivate creates the socket at path. Windows ignores the mode of sockets, the access is controlled by the ACL
+// inherited from the directory.
+func listenPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/mail"
+)
+
+type TaskKind string
+
+const (
+	TaskKindBackup  TaskKind = "backup"
+	TaskKindRestore TaskKind = "restore"
+)
+
+type TaskState string
+
+const (
+	TaskStateRunning    TaskState = "running"
+	TaskStatePausing    TaskState = "pausing"    // The in-flight messages are finishing before the pause.
+	TaskStateCancelling TaskState = "cancelling" // The in-flight messages are finishing before the cancellation.
+	TaskStatePaused     TaskState = "paused"
+	TaskStateFinished   TaskState = "finished"
+	TaskStateFailed     TaskState = "failed"
+	TaskStateCancelled  TaskState = "cancelled"
+)
+
+// isActive tells whether the task is still running.
+func (s TaskState) isActive() bool {
+	return s == TaskStateRunning || s == TaskStatePausing || s == TaskStateCancelling
+}
+
+// TaskRequest is the body of a request starting a task.
+type TaskRequest struct {
+	Kind        TaskKind
+	Folder      string // Backup: folder the export is created in. Restore: backup directory to restore.
+	Incremental bool   `json:",omitempty"` // Backup only: update the previous incremental backup of Folder.
+}
+
+func (r *TaskRequest) validate() error {
+	if r.Kind != TaskKindBackup && r.Kind != TaskKindRestore {
+		return fmt.Errorf("unknown task kind '%v', expected %v or %v", r.Kind, TaskKindBackup, TaskKindRestore)
+	}
+
+	if len(r.Folder) == 0 {
+		return errors.New("no folder provided")
+	}
+
+	if r.Incremental && r.Kind != TaskKindBackup {
+		return errors.New("only backups can be incremental")
+	}
+
+	return nil
+}
+
+// CancelRequest is the optional body of a cancellation request. Mode is "immediate", the default, or "graceful".
+type CancelRequest struct {
+	Mode string
+}
+
+type ErrorResponse struct {
+	Error string
+}
+
+// TaskStatus describes a task and its latest progress.
+type TaskStatus struct {
+	ID        string
+	Request   TaskRequest
+	State     TaskState
+	Path      string              `json:",omitempty"` // Export directory of a backup, backup directory of a restore.
+	Progress  *mail.ProgressEvent `json:",omitempty"`
+	Processed uint64
+	Total     uint64
+	Error     string `json:",omitempty"`
+	StartTime time.Time
+	EndTime   time.Time `json:",omitempty"`
+	RunCount  int       // Number of times the task was started, resumes included.
+}
+
+// runner is a run of a task, backup or restore.
+type runner interface {
+	// starting is called before the run, an error prevents it.
+	starting() error
+	run(reporter *taskReporter) (mail.CancelCause, error)
+	cancel(ctx context.Context, mode mail.CancelMode)
+	path() string
+	close()
+}
+
+type task struct {
+	id      string
+	request TaskRequest
+
+	lock        sync.Mutex
+	status      TaskStatus
+	runner      runner
+	pausing     bool
+	subscribers map[chan TaskStatus]struct{}
+}
+
+func newTask(id string, request TaskRequest) *task {
+	return &task{
+		id:          id,
+		request:     request,
+		status:      TaskStatus{ID: id, Request: request, StartTime: time.Now().UTC()},
+		subscribers: make(map[chan TaskStatus]struct{}),
+	}
+}
+
+func (t *task) getStatus() TaskStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.status
+}
+
+func (t *task) start(r runner) {
+	t.update(func(status *TaskStatus) {
+		t.runner = r
+		t.pausing = false
+
+		status.State = TaskStateRunning
+		status.Path = r.path()
+		status.Error = ""
+		status.EndTime = time.Time{}
+		status.RunCount++
+	})
+}
+
+// finish records the outcome of the run and returns the new state of the task.
+func (t *task) finish(cause mail.CancelCause, err error) TaskState {
+	var state TaskState
+
+	t.update(func(status *TaskStatus) {
+		t.runner.close()
+
+		switch {
+		case t.pausing && (err == nil || cause == mail.CancelCauseUser):
+			// A backup paused after its last message is finished anyway, resuming it completes the export.
+			status.State = TaskStatePaused
+		case err == nil:
+			status.State = TaskStateFinished
+		case cause == mail.CancelCauseUser || errors.Is(err, context.Canceled):
+			status.State = TaskStateCancelled
+		default:
+			status.State = TaskStateFailed
+		}
+
+		if err != nil && status.State != TaskStatePaused {
+			status.Error = err.Error()
+		}
+
+		status.EndTime = time.Now().UTC()
+		state = status.State
+	})
+
+	return state
+}
+
+// cancel stops the run of the task. A paused task has no run, it is cancelled right away.
+func (t *task) cancel(ctx context.Context, mode mail.CancelMode, pause bool) error {
+	t.lock.Lock()
+
+	switch state := t.status.State; {
+	case state == TaskStatePaused && !pause:
+		t.lock.Unlock()
+		t.update(func(status *TaskStatus) {
+			status.State = TaskStateCancelled
+			status.EndTime = time.Now().UTC()
+		})
+
+		return nil
+
+	case !state.isActive():
+		t.lock.Unlock()
+		return fmt.Errorf("%w: the task is %v", ErrInvalidState, state)
+	}
+
+	r := t.runner
+	t.lock.Unlock()
+
+	t.update(func(status *TaskStatus) {
+		if pause {
+			t.pausing = true
+			status.State = TaskStatePausing
+		} else {
+			t.pausing = false
+			status.State = TaskStateCancelling
+		}
+	})
+
+	r.cancel(ctx, mode)
+
+	return nil
+}
+
+// update changes the status and sends it to the subscribers. The subscribers only receive the latest status, a slow
+// subscriber misses the intermediate ones.
+func (t *task) update(fn func(status *TaskStatus)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	fn(&t.status)
+
+	for ch := range t.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+
+		ch <- t.status
+	}
+}
+
+// subscribe returns a channel receiving the status of the task when it changes, starting with the current one.
+func (t *task) subscribe() (<-chan TaskStatus, func()) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ch := make(chan TaskStatus, 1)
+	ch <- t.status
+
+	t.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+
+		delete(t.subscribers, ch)
+	}
+}
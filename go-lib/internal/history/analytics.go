@@ -0,0 +1,172 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package history
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/mail"
+	"github.com/bradenaw/juniper/xslices"
+)
+
+const (
+	DefaultLargestLabelCount = 10
+	day                      = 24 * time.Hour
+	maxQuotaDays             = 100 * 365
+)
+
+// growthProjectionHorizons are the delays after the most recent backup the size of the mailbox is projected at.
+var growthProjectionHorizons = []time.Duration{30 * day, 90 * day, 365 * day} //nolint:gochecknoglobals
+
+// GrowthPoint is the size of the mailbox recorded by a backup.
+type GrowthPoint struct {
+	Time         time.Time
+	MessageCount uint64
+	MailSpace    uint64
+}
+
+// GrowthReport summarizes the growth of a mailbox over the backups recorded in the history.
+type GrowthReport struct {
+	AccountID      string
+	AccountEmail   string
+	Points         []GrowthPoint     // Oldest first.
+	MessagesPerDay float64           // Least squares slope of the message count, 0 with less than two backups.
+	BytesPerDay    float64           // Least squares slope of the mail storage.
+	LargestLabels  []mail.LabelStats `json:",omitempty"` // Labels of the most recent backup holding the most messages.
+	UsedSpace      uint64            // Storage used by all the products at the most recent backup.
+	MaxSpace       uint64            // Storage quota shared by all the products, 0 if unknown.
+	Projections    []GrowthPoint     `json:",omitempty"` // Expected size of the mailbox if it keeps growing at the same rate.
+
+	// QuotaTime is when the storage quota is expected to be reached, nil if the mailbox does not grow or the quota is
+	// unknown. The other products are assumed not to grow.
+	QuotaTime *time.Time `json:",omitempty"`
+}
+
+// AnalyzeGrowth returns the growth report of an account, given by ID or email address, from the statistics recorded by
+// its backups. If account is empty, the account of the most recent backup with statistics is used. The report has no
+// points if there is no such backup.
+func (s *Store) AnalyzeGrowth(account string) (GrowthReport, error) {
+	runs, err := s.Query(Query{Operation: OperationBackup})
+	if err != nil {
+		return GrowthReport{}, err
+	}
+
+	return analyzeGrowth(runs, account, DefaultLargestLabelCount), nil
+}
+
+// analyzeGrowth builds the growth report from runs, the most recent first. Backups that failed still record the size
+// of the mailbox when they started, they are included.
+func analyzeGrowth(runs []Run, account string, largestLabelCount int) GrowthReport {
+	var report GrowthReport
+	var latest *mail.MailboxStats
+
+	for i := range runs {
+		run := &runs[i]
+		if run.Mailbox == nil {
+			continue
+		}
+
+		if len(report.AccountID) == 0 {
+			if len(account) != 0 && run.AccountID != account && !strings.EqualFold(run.AccountEmail, account) {
+				continue
+			}
+
+			report.AccountID = run.AccountID
+			report.AccountEmail = run.AccountEmail
+			latest = run.Mailbox
+		} else if run.AccountID != report.AccountID {
+			continue
+		}
+
+		report.Points = append(report.Points, GrowthPoint{
+			Time:         run.Mailbox.Time,
+			MessageCount: run.Mailbox.MessageCount,
+			MailSpace:    run.Mailbox.MailSpace,
+		})
+	}
+
+	if latest == nil {
+		return report
+	}
+
+	xslices.Reverse(report.Points)
+
+	report.LargestLabels = latest.Labels[:min(len(latest.Labels), largestLabelCount)]
+	report.UsedSpace = latest.UsedSpace
+	report.MaxSpace = latest.MaxSpace
+
+	report.MessagesPerDay = growthRate(report.Points, func(p GrowthPoint) uint64 { return p.MessageCount })
+	report.BytesPerDay = growthRate(report.Points, func(p GrowthPoint) uint64 { return p.MailSpace })
+
+	last := report.Points[len(report.Points)-1]
+
+	for _, horizon := range growthProjectionHorizons {
+		days := horizon.Hours() / 24
+
+		report.Projections = append(report.Projections, GrowthPoint{
+			Time:         last.Time.Add(horizon),
+			MessageCount: project(last.MessageCount, report.MessagesPerDay, days),
+			MailSpace:    project(last.MailSpace, report.BytesPerDay, days),
+		})
+	}
+
+	if report.MaxSpace != 0 && report.BytesPerDay > 0 {
+		// Quotas that would be reached in more than a century are as good as never reached, and would overflow.
+		if days := math.Max(float64(report.MaxSpace)-float64(report.UsedSpace), 0) / report.BytesPerDay; days < maxQuotaDays {
+			quotaTime := last.Time.Add(time.Duration(days * float64(day)))
+			report.QuotaTime = &quotaTime
+		}
+	}
+
+	return report
+}
+
+// growthRate returns the least squares slope of the values of the points, per day.
+func growthRate(points []GrowthPoint, value func(GrowthPoint) uint64) float64 {
+	if len(points) < 2 {
+		return 0
+	}
+
+	var meanX, meanY float64
+	for _, p := range points {
+		meanX += p.Time.Sub(points[0].Time).Hours() / 24
+		meanY += float64(value(p))
+	}
+
+	meanX /= float64(len(points))
+	meanY /= float64(len(points))
+
+	var covariance, variance float64
+	for _, p := range points {
+		dx := p.Time.Sub(points[0].Time).Hours()/24 - meanX
+		covariance += dx * (float64(value(p)) - meanY)
+		variance += dx * dx
+	}
+
+	if variance == 0 {
+		return 0
+	}
+
+	return covariance / variance
+}
+
+func project(current uint64, perDay, days float64) uint64 {
+	return uint64(math.Max(float64(current)+perDay*days, 0))
+}
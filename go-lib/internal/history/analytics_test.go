@@ -0,0 +1,87 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/mail"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzeGrowth(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	backup := func(user *proton.User, days int, messages, space uint64) Run {
+		run := NewRun(OperationBackup, user, "/backup", nil, start.Add(time.Duration(days)*day))
+		run.Finish(nil, nil)
+		run.Mailbox = &mail.MailboxStats{
+			Time:         run.StartTime,
+			MessageCount: messages,
+			MailSpace:    space,
+			UsedSpace:    space + 1000,
+			MaxSpace:     11000,
+			Labels: []mail.LabelStats{
+				{ID: "0", Name: "Inbox", MessageCount: messages / 2},
+				{ID: "6", Name: "Archive", MessageCount: messages / 4},
+			},
+		}
+
+		return run
+	}
+
+	alice := &proton.User{ID: "alice", Email: "alice@proton.me"}
+	bob := &proton.User{ID: "bob", Email: "bob@proton.me"}
+
+	// Most recent first, as returned by Store.Query.
+	runs := []Run{
+		backup(bob, 25, 10, 100),
+		backup(alice, 20, 300, 3000),
+		NewRun(OperationBackup, alice, "/backup", nil, start.Add(15*day)),
+		backup(alice, 10, 200, 2000),
+		backup(alice, 0, 100, 1000),
+	}
+
+	report := analyzeGrowth(runs, "ALICE@proton.me", 1)
+	require.Equal(t, "alice", report.AccountID)
+	require.Len(t, report.Points, 3)
+	require.Equal(t, start, report.Points[0].Time)
+	require.InDelta(t, 10, report.MessagesPerDay, 1e-9)
+	require.InDelta(t, 100, report.BytesPerDay, 1e-9)
+	require.Equal(t, []mail.LabelStats{{ID: "0", Name: "Inbox", MessageCount: 150}}, report.LargestLabels)
+
+	require.Len(t, report.Projections, 3)
+	require.Equal(t, start.Add(50*day), report.Projections[0].Time)
+	require.Equal(t, uint64(600), report.Projections[0].MessageCount)
+	require.Equal(t, uint64(6000), report.Projections[0].MailSpace)
+
+	// 11000 - 4000 bytes left at 100 bytes per day.
+	require.NotNil(t, report.QuotaTime)
+	require.Equal(t, start.Add(90*day), *report.QuotaTime)
+
+	report = analyzeGrowth(runs, "", DefaultLargestLabelCount)
+	require.Equal(t, "bob", report.AccountID)
+	require.Len(t, report.Points, 1)
+	require.Zero(t, report.MessagesPerDay)
+	require.Nil(t, report.QuotaTime)
+
+	report = analyzeGrowth(runs, "carol", DefaultLargestLabelCount)
+	require.Empty(t, report.Points)
+}
@@ -0,0 +1,396 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package history keeps a local record of the backup and restore runs, with their parameters, results and durations,
+// so that users can check when their last successful backup actually happened.
+//
+// The history is a SQLite database stored next to the audit log, one row per finished run. Unlike the audit log it is
+// neither signed nor chained: it is meant to be queried, not to serve as evidence. When the directory is protected by a
+// passphrase, the runs are encrypted with its vault, see SetVault. Only their operation, outcome and times are then
+// kept in clear, so that they can still be selected by the database.
+package history
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/audit"
+	"github.com/ProtonMail/export-tool/internal/mail"
+	"github.com/ProtonMail/export-tool/internal/vault"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite" // Registers the "sqlite" driver.
+)
+
+const (
+	FileName = "history.sqlite"
+
+	// LegacyFileName is the JSON lines history written by the previous versions. Its runs are still returned by Query,
+	// the new runs are only added to the database.
+	LegacyFileName = "history.jsonl"
+)
+
+// schema creates the table of the runs. The times are Unix times in nanoseconds, data is the JSON encoded run, sealed
+// with the vault of the directory when it is protected.
+const schema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	operation  TEXT NOT NULL,
+	outcome    TEXT NOT NULL,
+	start_time INTEGER NOT NULL,
+	end_time   INTEGER NOT NULL,
+	data       TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS runs_start_time ON runs (start_time);
+`
+
+// busyTimeout is how long a query waits for another process, e.g. the GUI, writing to the database.
+const busyTimeout = 5 * time.Second
+
+type Operation string
+
+const (
+	OperationBackup  Operation = "backup"
+	OperationRestore Operation = "restore"
+	OperationImport  Operation = "import"
+)
+
+// Run describes a finished backup or restore.
+type Run struct {
+	Operation    Operation
+	AccountID    string            `json:",omitempty"`
+	AccountEmail string            `json:",omitempty"`
+	Path         string            `json:",omitempty"` // Export or backup directory.
+	Parameters   map[string]string `json:",omitempty"` // Same as the parameters of the audit log entries.
+	StartTime    time.Time
+	EndTime      time.Time
+	Outcome      audit.Outcome
+	Error        string             `json:",omitempty"`
+	Counts       map[string]uint64  `json:",omitempty"`
+	Mailbox      *mail.MailboxStats `json:",omitempty"` // Only set for backups, see AnalyzeGrowth.
+}
+
+// NewRun returns the run of an operation started at startTime on the account of user.
+func NewRun(operation Operation, user *proton.User, path string, params map[string]string, startTime time.Time) Run {
+	return Run{
+		Operation:    operation,
+		AccountID:    user.ID,
+		AccountEmail: user.Email,
+		Path:         path,
+		Parameters:   params,
+		StartTime:    startTime.UTC(),
+	}
+}
+
+// Finish records the end of a run that finished with err.
+func (r *Run) Finish(counts map[string]uint64, err error) {
+	r.EndTime = time.Now().UTC()
+	r.Counts = counts
+	r.Outcome = audit.OutcomeFromError(err)
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+func (r *Run) GetDuration() time.Duration {
+	return r.EndTime.Sub(r.StartTime)
+}
+
+// Query selects runs of the history. The zero value selects all of them.
+type Query struct {
+	Operation Operation     `json:",omitempty"`
+	AccountID string        `json:",omitempty"`
+	Outcome   audit.Outcome `json:",omitempty"`
+	Since     time.Time     `json:",omitempty"` // Runs started at or after this time.
+	Limit     int           `json:",omitempty"` // Maximum number of runs to return, 0 means no limit.
+}
+
+func (q *Query) matches(run *Run) bool {
+	return (len(q.Operation) == 0 || run.Operation == q.Operation) &&
+		(len(q.AccountID) == 0 || run.AccountID == q.AccountID) &&
+		(len(q.Outcome) == 0 || run.Outcome == q.Outcome) &&
+		(q.Since.IsZero() || !run.StartTime.Before(q.Since))
+}
+
+// where returns the SQL condition selecting the runs of the query, except for the account which is only known once
+// the runs are decrypted.
+func (q *Query) where() (string, []any) {
+	conditions := []string{"1 = 1"}
+
+	var args []any
+
+	if len(q.Operation) != 0 {
+		conditions = append(conditions, "operation = ?")
+		args = append(args, string(q.Operation))
+	}
+
+	if len(q.Outcome) != 0 {
+		conditions = append(conditions, "outcome = ?")
+		args = append(args, string(q.Outcome))
+	}
+
+	if !q.Since.IsZero() {
+		conditions = append(conditions, "start_time >= ?")
+		args = append(args, q.Since.UnixNano())
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// Store appends runs to the history of a directory and queries them. It is safe for concurrent use.
+type Store struct {
+	lock      sync.Mutex
+	path      string
+	protected bool         // The directory is protected by a passphrase, runs cannot be appended until it is unlocked.
+	vault     *vault.Vault // Runs are sealed when set, see SetVault.
+}
+
+// Open opens the history stored in dir. The database is created by the first run appended.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %w", err)
+	}
+
+	protected, err := vault.IsProtected(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{path: filepath.Join(dir, FileName), protected: protected}, nil
+}
+
+func (s *Store) GetPath() string {
+	return s.path
+}
+
+// SetVault encrypts the runs appended from now on with v, and decrypts the encrypted runs when querying. Runs written
+// before the directory was protected stay readable.
+func (s *Store) SetVault(v *vault.Vault) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.vault = v
+	s.protected = true
+}
+
+func (s *Store) Append(run Run) error {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return fmt.Errorf("failed to encode history run: %w", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.protected && s.vault == nil {
+		return vault.ErrLocked
+	}
+
+	if data, err = vault.Encode(s.vault, data); err != nil {
+		return err
+	}
+
+	db, err := s.open(true)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+
+	if _, err := db.Exec(
+		"INSERT INTO runs (operation, outcome, start_time, end_time, data) VALUES (?, ?, ?, ?, ?)",
+		string(run.Operation), string(run.Outcome), run.StartTime.UnixNano(), run.EndTime.UnixNano(), string(data),
+	); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+
+	return nil
+}
+
+// open opens the database, nil if it does not exist and create is not set. The store must be locked.
+func (s *Store) open(create bool) (*sql.DB, error) {
+	if create {
+		// SQLite would create the file readable by everyone, its journals inherit the mode of the file.
+		file, err := os.OpenFile(s.path, os.O_RDONLY|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create history: %w", err)
+		}
+
+		_ = file.Close()
+	} else if _, err := os.Stat(s.path); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open history: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", fmt.Sprintf("%v?_pragma=busy_timeout(%d)", s.path, busyTimeout.Milliseconds()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history: %w", err)
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to open history: %w", err)
+	}
+
+	return db, nil
+}
+
+// Query returns the runs selected by query, the most recent first. The runs of the legacy file that cannot be parsed,
+// e.g. a line cut short by a crash, are skipped.
+func (s *Store) Query(query Query) ([]Run, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	runs, err := s.queryDatabase(query)
+	if err != nil {
+		return nil, err
+	}
+
+	legacyRuns, err := s.queryLegacy(query)
+	if err != nil {
+		return nil, err
+	}
+
+	runs = append(runs, legacyRuns...)
+
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].StartTime.After(runs[j].StartTime)
+	})
+
+	if query.Limit > 0 && len(runs) > query.Limit {
+		runs = runs[:query.Limit]
+	}
+
+	return runs, nil
+}
+
+func (s *Store) queryDatabase(query Query) ([]Run, error) {
+	db, err := s.open(false)
+	if err != nil || db == nil {
+		return nil, err
+	}
+	defer func() { _ = db.Close() }()
+
+	where, args := query.where()
+
+	rows, err := db.Query("SELECT data FROM runs WHERE "+where+" ORDER BY start_time DESC, id DESC", args...) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var runs []Run
+
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to read history: %w", err)
+		}
+
+		run, err := s.parseRun([]byte(data))
+		if err != nil {
+			return nil, err
+		}
+
+		if query.matches(&run) {
+			runs = append(runs, run)
+		}
+
+		if query.Limit > 0 && len(runs) == query.Limit {
+			break
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	return runs, nil
+}
+
+// queryLegacy returns the runs of the legacy file selected by query.
+func (s *Store) queryLegacy(query Query) ([]Run, error) {
+	file, err := os.Open(filepath.Join(filepath.Dir(s.path), LegacyFileName)) //nolint:gosec
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	var runs []Run
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		run, err := s.parseRun(scanner.Bytes())
+		if errors.Is(err, vault.ErrLocked) {
+			return nil, err
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("line", line).Warn("Skipping invalid history line")
+			continue
+		}
+
+		if query.matches(&run) {
+			runs = append(runs, run)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	return runs, nil
+}
+
+// parseRun decodes a run, decrypting it if it is sealed. The store must be locked.
+func (s *Store) parseRun(data []byte) (Run, error) {
+	data, err := vault.Decode(s.vault, data)
+	if err != nil {
+		return Run{}, err
+	}
+
+	var run Run
+	if err := json.Unmarshal(data, &run); err != nil {
+		return Run{}, err
+	}
+
+	return run, nil
+}
+
+// GetLastSuccessful returns the most recent successful run of operation, for the given account if accountID is not
+// empty, or nil if there is none.
+func (s *Store) GetLastSuccessful(operation Operation, accountID string) (*Run, error) {
+	runs, err := s.Query(Query{Operation: operation, AccountID: accountID, Outcome: audit.OutcomeSuccess, Limit: 1})
+	if err != nil || len(runs) == 0 {
+		return nil, err
+	}
+
+	return &runs[0], nil
+}
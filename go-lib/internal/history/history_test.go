@@ -0,0 +1,149 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/audit"
+	"github.com/ProtonMail/export-tool/internal/vault"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_AppendAndQuery(t *testing.T) {
+	store, err := Open(t.TempDir())
+	require.NoError(t, err)
+
+	runs, err := store.Query(Query{})
+	require.NoError(t, err)
+	require.Empty(t, runs)
+
+	alice := &proton.User{ID: "alice", Email: "alice@proton.me"}
+	bob := &proton.User{ID: "bob", Email: "bob@proton.me"}
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	appendRun := func(operation Operation, user *proton.User, startTime time.Time, err error) {
+		run := NewRun(operation, user, "/backup", map[string]string{"incremental": "true"}, startTime)
+		run.Finish(map[string]uint64{"exported": 10}, err)
+		require.NoError(t, store.Append(run))
+	}
+
+	appendRun(OperationBackup, alice, start, nil)
+	appendRun(OperationBackup, bob, start.Add(time.Hour), nil)
+	appendRun(OperationRestore, alice, start.Add(2*time.Hour), nil)
+	appendRun(OperationBackup, alice, start.Add(3*time.Hour), errors.New("network error"))
+
+	runs, err = store.Query(Query{})
+	require.NoError(t, err)
+	require.Len(t, runs, 4)
+	require.Equal(t, audit.OutcomeFailed, runs[0].Outcome)
+	require.Equal(t, "network error", runs[0].Error)
+	require.Equal(t, start, runs[3].StartTime)
+	require.Equal(t, map[string]uint64{"exported": 10}, runs[3].Counts)
+	require.Positive(t, runs[3].GetDuration())
+
+	runs, err = store.Query(Query{Operation: OperationBackup, AccountID: "alice"})
+	require.NoError(t, err)
+	require.Len(t, runs, 2)
+
+	runs, err = store.Query(Query{Since: start.Add(time.Hour), Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, runs, 2)
+	require.Equal(t, start.Add(3*time.Hour), runs[0].StartTime)
+	require.Equal(t, start.Add(2*time.Hour), runs[1].StartTime)
+
+	last, err := store.GetLastSuccessful(OperationBackup, "alice")
+	require.NoError(t, err)
+	require.NotNil(t, last)
+	require.Equal(t, start, last.StartTime)
+
+	last, err = store.GetLastSuccessful(OperationRestore, "bob")
+	require.NoError(t, err)
+	require.Nil(t, last)
+}
+
+func TestStore_Legacy(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := Open(dir)
+	require.NoError(t, err)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	legacy := NewRun(OperationBackup, &proton.User{ID: "alice"}, "/backup", nil, start)
+	legacy.Finish(nil, nil)
+
+	data, err := json.Marshal(legacy)
+	require.NoError(t, err)
+
+	// The second line was cut short by a crash.
+	data = append(data, []byte("\n"+`{"Operation":"backup","Acc`+"\n")...)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, LegacyFileName), data, 0o600))
+
+	run := NewRun(OperationBackup, &proton.User{ID: "alice"}, "/backup", nil, start.Add(time.Hour))
+	run.Finish(nil, nil)
+	require.NoError(t, store.Append(run))
+
+	runs, err := store.Query(Query{})
+	require.NoError(t, err)
+	require.Len(t, runs, 2)
+	require.True(t, runs[0].StartTime.Equal(run.StartTime))
+	require.True(t, runs[1].StartTime.Equal(legacy.StartTime))
+
+	runs, err = store.Query(Query{Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	require.True(t, runs[0].StartTime.Equal(run.StartTime))
+}
+
+func TestStore_Sealed(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := Open(dir)
+	require.NoError(t, err)
+
+	v, err := vault.Open(dir, []byte("hunter2"))
+	require.NoError(t, err)
+	store.SetVault(v)
+
+	run := NewRun(OperationBackup, &proton.User{ID: "alice", Email: "alice@proton.me"}, "/backup", nil, time.Now())
+	run.Finish(nil, nil)
+	require.NoError(t, store.Append(run))
+
+	data, err := os.ReadFile(store.GetPath())
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "alice")
+
+	runs, err := store.Query(Query{})
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	require.Equal(t, "alice@proton.me", runs[0].AccountEmail)
+
+	locked, err := Open(dir)
+	require.NoError(t, err)
+	require.ErrorIs(t, locked.Append(run), vault.ErrLocked)
+
+	_, err = locked.Query(Query{})
+	require.ErrorIs(t, err, vault.ErrLocked)
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package hold implements the hold mode, used for legal or parental holds where the tool must be strictly read-only
+// against the account and must not delete any backup.
+//
+// In hold mode, restores are refused, and the API client rejects every call that would modify the account, see
+// apiclient.ReadOnlyClient. Local operations that delete or rewrite a backup, such as moving it or annotating it, are
+// refused as well. Backups are still allowed.
+package hold
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PolicyFileName is the hold policy looked up in the operation directory, so that deployments can enforce the hold
+// mode without relying on command line options.
+const PolicyFileName = "hold_policy.json"
+
+var ErrHold = errors.New("not allowed in hold mode")
+
+// Policy tells whether the hold mode is enabled. The zero value disables it.
+type Policy struct {
+	Enabled bool
+	Reason  string `json:",omitempty"` // Shown to the user when an operation is refused, e.g. a case reference.
+}
+
+// LoadPolicy reads the JSON encoded policy at path.
+func LoadPolicy(path string) (Policy, error) {
+	data, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return Policy{}, fmt.Errorf("failed to read hold policy: %w", err)
+	}
+
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return Policy{}, fmt.Errorf("failed to parse hold policy: %w", err)
+	}
+
+	return policy, nil
+}
+
+// FindPolicy returns the policy stored in dir, or the zero policy if there is none.
+func FindPolicy(dir string) (Policy, error) {
+	policy, err := LoadPolicy(filepath.Join(dir, PolicyFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return Policy{}, nil
+	}
+
+	return policy, err
+}
+
+// Merge returns the policy enforcing both p and other. A hold cannot be lifted by another policy.
+func (p Policy) Merge(other Policy) Policy {
+	if !other.Enabled {
+		return p
+	}
+
+	if !p.Enabled || len(p.Reason) == 0 {
+		return other
+	}
+
+	return p
+}
+
+// Check returns an error wrapping ErrHold if the hold mode is enabled. operation describes what is refused.
+func (p Policy) Check(operation string) error {
+	if !p.Enabled {
+		return nil
+	}
+
+	if len(p.Reason) != 0 {
+		return fmt.Errorf("%v is %w (%v)", operation, ErrHold, p.Reason)
+	}
+
+	return fmt.Errorf("%v is %w", operation, ErrHold)
+}
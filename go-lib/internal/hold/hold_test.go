@@ -0,0 +1,63 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package hold
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindPolicy(t *testing.T) {
+	dir := t.TempDir()
+
+	policy, err := FindPolicy(dir)
+	require.NoError(t, err)
+	require.False(t, policy.Enabled)
+	require.NoError(t, policy.Check("restoring a backup"))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, PolicyFileName), []byte(`{"Enabled": true, "Reason": "case 1234"}`), 0o600))
+
+	policy, err = FindPolicy(dir)
+	require.NoError(t, err)
+	require.Equal(t, Policy{Enabled: true, Reason: "case 1234"}, policy)
+
+	err = policy.Check("restoring a backup")
+	require.ErrorIs(t, err, ErrHold)
+	require.Equal(t, "restoring a backup is not allowed in hold mode (case 1234)", err.Error())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, PolicyFileName), []byte(`{`), 0o600))
+
+	_, err = FindPolicy(dir)
+	require.Error(t, err)
+}
+
+func TestPolicy_Merge(t *testing.T) {
+	disabled := Policy{}
+	enabled := Policy{Enabled: true}
+	withReason := Policy{Enabled: true, Reason: "case 1234"}
+
+	require.Equal(t, disabled, disabled.Merge(disabled))
+	require.Equal(t, enabled, disabled.Merge(enabled))
+	require.Equal(t, enabled, enabled.Merge(disabled))
+	require.Equal(t, withReason, enabled.Merge(withReason))
+	require.Equal(t, withReason, withReason.Merge(enabled))
+	require.Equal(t, withReason, withReason.Merge(Policy{Enabled: true, Reason: "other"}))
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package idle checks whether the computer can run a backup without bothering its user: on AC power, on an unmetered
+// network and without recent user activity. The detection is platform specific, a condition that cannot be detected
+// on the current platform is considered met.
+package idle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrUnsupported is returned by the detection helpers when the platform does not provide the information.
+var ErrUnsupported = errors.New("not supported on this platform")
+
+// Conditions are the requirements to start a run.
+type Conditions struct {
+	OnACPower bool          // The computer is not running on battery.
+	Unmetered bool          // The network connection is not metered, such as a mobile hotspot.
+	UserIdle  time.Duration // Minimum time since the last user input, 0 disables the check.
+}
+
+func (c Conditions) Enabled() bool {
+	return c.OnACPower || c.Unmetered || c.UserIdle > 0
+}
+
+//nolint:gochecknoglobals
+var (
+	// Replaced by the tests.
+	isOnACPowerFn      = isOnACPower
+	isNetworkMeteredFn = isNetworkMetered
+	getUserIdleTimeFn  = getUserIdleTime
+
+	unsupportedOnce sync.Map
+)
+
+// Check returns the description of the conditions that are not met, empty when the run can start.
+func (c Conditions) Check() []string {
+	var unmet []string
+
+	if c.OnACPower {
+		if onAC, err := isOnACPowerFn(); err != nil {
+			logDetectionError("power source", err)
+		} else if !onAC {
+			unmet = append(unmet, "running on battery")
+		}
+	}
+
+	if c.Unmetered {
+		if metered, err := isNetworkMeteredFn(); err != nil {
+			logDetectionError("metered network", err)
+		} else if metered {
+			unmet = append(unmet, "network connection is metered")
+		}
+	}
+
+	if c.UserIdle > 0 {
+		if idleTime, err := getUserIdleTimeFn(); err != nil {
+			logDetectionError("user activity", err)
+		} else if idleTime < c.UserIdle {
+			unmet = append(unmet, fmt.Sprintf("user active %v ago", idleTime.Truncate(time.Second)))
+		}
+	}
+
+	return unmet
+}
+
+// Wait blocks until the conditions are met or ctx is done. onWait is called with the unmet conditions when they
+// change, it is not called if the conditions are met on the first check.
+func (c Conditions) Wait(ctx context.Context, interval time.Duration, onWait func(unmet []string)) error {
+	var previous string
+
+	for {
+		unmet := c.Check()
+		if len(unmet) == 0 {
+			return nil
+		}
+
+		if current := fmt.Sprint(unmet); current != previous {
+			previous = current
+			logrus.WithField("unmet", unmet).Info("Waiting for the run conditions")
+			onWait(unmet)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// logDetectionError logs once per condition that it is ignored.
+func logDetectionError(condition string, err error) {
+	if _, logged := unsupportedOnce.LoadOrStore(condition, struct{}{}); logged {
+		return
+	}
+
+	logrus.WithError(err).WithField("condition", condition).Warn("Unable to detect run condition, it is ignored")
+}
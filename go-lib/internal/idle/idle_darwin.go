@@ -0,0 +1,64 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build darwin
+
+package idle
+
+import (
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func isOnACPower() (bool, error) {
+	output, err := exec.Command("pmset", "-g", "batt").Output()
+	if err != nil {
+		return false, err
+	}
+
+	return strings.Contains(string(output), "'AC Power'"), nil
+}
+
+func isNetworkMetered() (bool, error) {
+	// Only exposed by the Network framework to the applications that monitor the network path.
+	return false, ErrUnsupported
+}
+
+//nolint:gochecknoglobals
+var hidIdleTimeRegexp = regexp.MustCompile(`"HIDIdleTime" = (\d+)`)
+
+func getUserIdleTime() (time.Duration, error) {
+	output, err := exec.Command("ioreg", "-c", "IOHIDSystem", "-d", "4").Output()
+	if err != nil {
+		return 0, err
+	}
+
+	match := hidIdleTimeRegexp.FindSubmatch(output)
+	if match == nil {
+		return 0, ErrUnsupported
+	}
+
+	ns, err := strconv.ParseInt(string(match[1]), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(ns), nil
+}
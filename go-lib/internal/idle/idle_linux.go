@@ -0,0 +1,127 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+
+package idle
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const powerSupplyDir = "/sys/class/power_supply"
+
+// isOnACPower reads the power supplies of sysfs. A computer without battery, such as a desktop, is on AC power.
+func isOnACPower() (bool, error) {
+	entries, err := os.ReadDir(powerSupplyDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	hasBattery := false
+
+	for _, entry := range entries {
+		supplyType := readSysfsValue(filepath.Join(powerSupplyDir, entry.Name(), "type"))
+
+		switch supplyType {
+		case "Mains", "USB":
+			if readSysfsValue(filepath.Join(powerSupplyDir, entry.Name(), "online")) == "1" {
+				return true, nil
+			}
+
+		case "Battery":
+			// Peripherals such as wireless mice report their batteries too.
+			if readSysfsValue(filepath.Join(powerSupplyDir, entry.Name(), "scope")) != "Device" {
+				hasBattery = true
+			}
+		}
+	}
+
+	return !hasBattery, nil
+}
+
+func readSysfsValue(path string) string {
+	data, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+// isNetworkMetered asks NetworkManager, the only network service exposing the information.
+func isNetworkMetered() (bool, error) {
+	if _, err := exec.LookPath("busctl"); err != nil {
+		return false, ErrUnsupported
+	}
+
+	output, err := exec.Command( //nolint:gosec
+		"busctl", "get-property",
+		"org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager", "org.freedesktop.NetworkManager", "Metered",
+	).Output()
+	if err != nil {
+		return false, ErrUnsupported
+	}
+
+	return parseNetworkManagerMetered(string(output))
+}
+
+// parseNetworkManagerMetered parses the NMMetered value printed by busctl, such as "u 4".
+func parseNetworkManagerMetered(output string) (bool, error) {
+	fields := strings.Fields(output)
+	if len(fields) != 2 || fields[0] != "u" {
+		return false, ErrUnsupported
+	}
+
+	switch fields[1] {
+	case "1", "3": // NM_METERED_YES, NM_METERED_GUESS_YES.
+		return true, nil
+	case "2", "4": // NM_METERED_NO, NM_METERED_GUESS_NO.
+		return false, nil
+	default:
+		return false, ErrUnsupported
+	}
+}
+
+// getUserIdleTime relies on xprintidle, the X11 and Wayland sessions do not provide a common interface.
+func getUserIdleTime() (time.Duration, error) {
+	if _, err := exec.LookPath("xprintidle"); err != nil {
+		return 0, ErrUnsupported
+	}
+
+	output, err := exec.Command("xprintidle").Output()
+	if err != nil {
+		return 0, ErrUnsupported
+	}
+
+	ms, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(ms) * time.Millisecond, nil
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !linux && !darwin && !windows
+
+package idle
+
+import "time"
+
+func isOnACPower() (bool, error) {
+	return false, ErrUnsupported
+}
+
+func isNetworkMetered() (bool, error) {
+	return false, ErrUnsupported
+}
+
+func getUserIdleTime() (time.Duration, error) {
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package idle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func setDetection(t *testing.T, onAC *bool, metered *bool, idleTime *time.Duration) {
+	t.Helper()
+
+	prevAC, prevMetered, prevIdle := isOnACPowerFn, isNetworkMeteredFn, getUserIdleTimeFn
+	t.Cleanup(func() { isOnACPowerFn, isNetworkMeteredFn, getUserIdleTimeFn = prevAC, prevMetered, prevIdle })
+
+	isOnACPowerFn = func() (bool, error) { return *onAC, nil }
+	isNetworkMeteredFn = func() (bool, error) { return *metered, nil }
+	getUserIdleTimeFn = func() (time.Duration, error) { return *idleTime, nil }
+}
+
+func TestConditions_Check(t *testing.T) {
+	onAC, metered, idleTime := false, true, 30*time.Second
+	setDetection(t, &onAC, &metered, &idleTime)
+
+	require.Empty(t, Conditions{}.Check())
+	require.Equal(t, []string{
+		"running on battery",
+		"network connection is metered",
+		"user active 30s ago",
+	}, Conditions{OnACPower: true, Unmetered: true, UserIdle: time.Minute}.Check())
+
+	onAC, metered, idleTime = true, false, 2*time.Minute
+	require.Empty(t, Conditions{OnACPower: true, Unmetered: true, UserIdle: time.Minute}.Check())
+}
+
+func TestConditions_UnsupportedDetectionIsIgnored(t *testing.T) {
+	prev := isOnACPowerFn
+	t.Cleanup(func() { isOnACPowerFn = prev })
+
+	isOnACPowerFn = func() (bool, error) { return false, ErrUnsupported }
+
+	require.Empty(t, Conditions{OnACPower: true}.Check())
+}
+
+func TestConditions_Wait(t *testing.T) {
+	onAC, metered, idleTime := false, false, time.Duration(0)
+	setDetection(t, &onAC, &metered, &idleTime)
+
+	var waits [][]string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := Conditions{OnACPower: true}.Wait(ctx, time.Millisecond, func(unmet []string) { waits = append(waits, unmet) })
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, [][]string{{"running on battery"}}, waits)
+
+	onAC = true
+	require.NoError(t, Conditions{OnACPower: true}.Wait(context.Background(), time.Millisecond, func([]string) {}))
+}
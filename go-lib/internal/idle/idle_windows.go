@@ -0,0 +1,77 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build windows
+
+package idle
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+//nolint:gochecknoglobals
+var (
+	kernel32                 = windows.NewLazySystemDLL("kernel32.dll")
+	user32                   = windows.NewLazySystemDLL("user32.dll")
+	procGetSystemPowerStatus = kernel32.NewProc("GetSystemPowerStatus")
+	procGetTickCount         = kernel32.NewProc("GetTickCount")
+	procGetLastInputInfo     = user32.NewProc("GetLastInputInfo")
+)
+
+type systemPowerStatus struct {
+	ACLineStatus        byte
+	BatteryFlag         byte
+	BatteryLifePercent  byte
+	SystemStatusFlag    byte
+	BatteryLifeTime     uint32
+	BatteryFullLifeTime uint32
+}
+
+type lastInputInfo struct {
+	cbSize uint32
+	dwTime uint32
+}
+
+func isOnACPower() (bool, error) {
+	var status systemPowerStatus
+	if ret, _, err := procGetSystemPowerStatus.Call(uintptr(unsafe.Pointer(&status))); ret == 0 {
+		return false, err
+	}
+
+	// 0 is offline, 1 online and 255 unknown.
+	return status.ACLineStatus != 0, nil
+}
+
+func isNetworkMetered() (bool, error) {
+	// Only exposed by the WinRT NetworkInformation API.
+	return false, ErrUnsupported
+}
+
+func getUserIdleTime() (time.Duration, error) {
+	info := lastInputInfo{cbSize: uint32(unsafe.Sizeof(lastInputInfo{}))}
+	if ret, _, err := procGetLastInputInfo.Call(uintptr(unsafe.Pointer(&info))); ret == 0 {
+		return 0, err
+	}
+
+	tickCount, _, _ := procGetTickCount.Call()
+
+	// Both are milliseconds since boot that wrap around after 49.7 days.
+	return time.Duration(uint32(tickCount)-info.dwTime) * time.Millisecond, nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package keychain stores secrets in the keychain of the operating system: the Keychain on macOS, the Secret Service
+// (libsecret) on Linux and DPAPI on Windows. The items are shared by the CLI and the GUI, which both use the names
+// defined here, so that a login saved by one is reused by the other.
+package keychain
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// Service groups the items of the application in the keychain.
+const Service = "Proton Mail Export"
+
+// The items stored by the application.
+const (
+	ItemSession     = "session"     // The tokens resuming the last session, see session.SavePersistedSessionToKeychain.
+	ItemCredentials = "credentials" // The login credentials saved by the CLI.
+	ItemAuditKey    = "audit-key"   // The seed of the key signing the audit log, see audit.Log.SetKeyStore.
+)
+
+var (
+	ErrNotFound    = errors.New("item not found in the keychain")
+	ErrUnsupported = errors.New("no keychain is available on this system")
+	ErrInvalidName = errors.New("invalid keychain item name")
+)
+
+// Store keeps secrets by name. Its methods return ErrNotFound for missing items.
+type Store interface {
+	Get(name string) ([]byte, error)
+	Set(name string, secret []byte) error
+	Delete(name string) error
+}
+
+// New returns the keychain of the operating system, ErrUnsupported if it has none or it is not available, e.g. on a
+// Linux system without a Secret Service.
+func New() (Store, error) {
+	return newStore()
+}
+
+var itemNameRegexp = regexp.MustCompile(`^[A-Za-z0-9@._+-]+$`)
+
+// validateName restricts the names to characters that need no escaping in the commands of the keychain tools.
+func validateName(name string) error {
+	if !itemNameRegexp.MatchString(name) {
+		return fmt.Errorf("%w: '%v'", ErrInvalidName, name)
+	}
+
+	return nil
+}
+
+// The secrets are stored base64 encoded by the keychains that only accept text.
+func encodeSecret(secret []byte) string {
+	return base64.StdEncoding.EncodeToString(secret)
+}
+
+func decodeSecret(encoded []byte) ([]byte, error) {
+	secret, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode keychain item: %w", err)
+	}
+
+	return secret, nil
+}
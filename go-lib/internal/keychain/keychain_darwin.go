@@ -0,0 +1,91 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package keychain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// notFoundExitCode is returned by the security tool when the item does not exist (errSecItemNotFound).
+const notFoundExitCode = 44
+
+// securityStore uses the login keychain through the security tool.
+type securityStore struct{}
+
+func newStore() (Store, error) {
+	if _, err := exec.LookPath("security"); err != nil {
+		return nil, ErrUnsupported
+	}
+
+	return securityStore{}, nil
+}
+
+func (securityStore) Get(name string) ([]byte, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+
+	output, err := exec.Command("security", "find-generic-password", "-s", Service, "-a", name, "-w").Output() //nolint:gosec
+	if err != nil {
+		return nil, mapSecurityError(err)
+	}
+
+	return decodeSecret(bytes.TrimSpace(output))
+}
+
+func (securityStore) Set(name string, secret []byte) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	// The secret is given on the standard input of the interactive mode, not as an argument visible to the other
+	// processes.
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s \"%v\" -a \"%v\" -w \"%v\"\n", Service, name, encodeSecret(secret)))
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to store keychain item: %w: %s", err, bytes.TrimSpace(output))
+	}
+
+	return nil
+}
+
+func (securityStore) Delete(name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	if err := exec.Command("security", "delete-generic-password", "-s", Service, "-a", name).Run(); err != nil { //nolint:gosec
+		return mapSecurityError(err)
+	}
+
+	return nil
+}
+
+func mapSecurityError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == notFoundExitCode {
+		return ErrNotFound
+	}
+
+	return fmt.Errorf("failed to access keychain: %w", err)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package keychain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// secretToolStore uses the Secret Service of the desktop, e.g. GNOME Keyring or KWallet, through the secret-tool of
+// libsecret.
+type secretToolStore struct{}
+
+func newStore() (Store, error) {
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return nil, ErrUnsupported
+	}
+
+	return secretToolStore{}, nil
+}
+
+func (secretToolStore) Get(name string) ([]byte, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+
+	output, err := exec.Command("secret-tool", "lookup", "service", Service, "account", name).Output() //nolint:gosec
+	if err != nil {
+		// secret-tool exits with 1 and prints nothing when the item does not exist.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) == 0 {
+			return nil, ErrNotFound
+		}
+
+		return nil, fmt.Errorf("failed to access keychain: %w", err)
+	}
+
+	return decodeSecret(bytes.TrimSpace(output))
+}
+
+func (secretToolStore) Set(name string, secret []byte) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("secret-tool", "store", "--label", Service+" "+name, "service", Service, "account", name) //nolint:gosec
+	cmd.Stdin = strings.NewReader(encodeSecret(secret))
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to store keychain item: %w: %s", err, bytes.TrimSpace(output))
+	}
+
+	return nil
+}
+
+func (s secretToolStore) Delete(name string) error {
+	if _, err := s.Get(name); err != nil {
+		return err
+	}
+
+	if output, err := exec.Command("secret-tool", "clear", "service", Service, "account", name).CombinedOutput(); err != nil { //nolint:gosec
+		return fmt.Errorf("failed to delete keychain item: %w: %s", err, bytes.TrimSpace(output))
+	}
+
+	return nil
+}
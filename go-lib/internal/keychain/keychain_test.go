@@ -0,0 +1,44 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package keychain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateName(t *testing.T) {
+	require.NoError(t, validateName(ItemSession))
+	require.NoError(t, validateName("session.foo@proton.me"))
+
+	require.ErrorIs(t, validateName(""), ErrInvalidName)
+	require.ErrorIs(t, validateName(`a" -w "b`), ErrInvalidName)
+	require.ErrorIs(t, validateName("a\nb"), ErrInvalidName)
+}
+
+func TestEncodeSecret(t *testing.T) {
+	secret := []byte{0, 1, 2, '\n', '"', 0xff}
+
+	decoded, err := decodeSecret([]byte(encodeSecret(secret)))
+	require.NoError(t, err)
+	require.Equal(t, secret, decoded)
+
+	_, err = decodeSecret([]byte("not base64!"))
+	require.Error(t, err)
+}
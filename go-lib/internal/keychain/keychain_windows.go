@@ -0,0 +1,116 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package keychain
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"golang.org/x/sys/windows"
+)
+
+// dpapiStore keeps each item in a file of the configuration folder, encrypted with DPAPI so that only the current
+// Windows user can decrypt it.
+type dpapiStore struct {
+	dir string
+}
+
+func newStore() (Store, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+
+	return dpapiStore{dir: filepath.Join(dir, "proton-mail-export-cli", "keychain")}, nil
+}
+
+func (s dpapiStore) getPath(name string) string {
+	return filepath.Join(s.dir, name+".dpapi")
+}
+
+func (s dpapiStore) Get(name string) ([]byte, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+
+	encrypted, err := os.ReadFile(s.getPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read keychain item: %w", err)
+	}
+
+	var out windows.DataBlob
+	if err := windows.CryptUnprotectData(newDataBlob(encrypted), nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, fmt.Errorf("failed to decrypt keychain item: %w", err)
+	}
+
+	return takeDataBlob(&out), nil
+}
+
+func (s dpapiStore) Set(name string, secret []byte) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	var out windows.DataBlob
+	if err := windows.CryptProtectData(newDataBlob(secret), nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return fmt.Errorf("failed to encrypt keychain item: %w", err)
+	}
+
+	encrypted := takeDataBlob(&out)
+
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create keychain folder: %w", err)
+	}
+
+	return utils.WriteFileSafe(s.dir, s.getPath(name), encrypted, nil)
+}
+
+func (s dpapiStore) Delete(name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	if err := os.Remove(s.getPath(name)); errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to delete keychain item: %w", err)
+	}
+
+	return nil
+}
+
+func newDataBlob(data []byte) *windows.DataBlob {
+	if len(data) == 0 {
+		return &windows.DataBlob{}
+	}
+
+	return &windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+}
+
+// takeDataBlob copies the data allocated by DPAPI and frees it.
+func takeDataBlob(blob *windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(blob.Data))) //nolint:errcheck
+
+	return append([]byte(nil), unsafe.Slice(blob.Data, blob.Size)...)
+}
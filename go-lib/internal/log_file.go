@@ -0,0 +1,345 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	logFileSuffix           = "_export.log"
+	compressedLogFileSuffix = logFileSuffix + ".gz"
+
+	DefaultLogMaxSizeMB = 100
+	DefaultLogMaxFiles  = 20
+
+	LogMaxSizeEnvVar  = "ET_LOG_MAX_SIZE"
+	LogMaxFilesEnvVar = "ET_LOG_MAX_FILES"
+	LogCompressEnvVar = "ET_LOG_COMPRESS"
+)
+
+// LogRotation caps the disk space used by the log files.
+type LogRotation struct {
+	MaxSizeMB int  // Size after which the log file is rotated, 0 disables the rotation.
+	MaxFiles  int  // Number of log files kept in the log folder, rotated ones and previous runs included. 0 keeps them all.
+	Compress  bool // Compress the rotated log files with gzip.
+}
+
+func DefaultLogRotation() LogRotation {
+	return LogRotation{MaxSizeMB: DefaultLogMaxSizeMB, MaxFiles: DefaultLogMaxFiles}
+}
+
+// GetLogRotationFromEnv returns the default rotation overridden by the LogMaxSizeEnvVar, LogMaxFilesEnvVar and
+// LogCompressEnvVar env vars. Invalid values are ignored.
+func GetLogRotationFromEnv() LogRotation {
+	rotation := DefaultLogRotation()
+
+	if value, err := strconv.Atoi(os.Getenv(LogMaxSizeEnvVar)); err == nil && value >= 0 {
+		rotation.MaxSizeMB = value
+	}
+
+	if value, err := strconv.Atoi(os.Getenv(LogMaxFilesEnvVar)); err == nil && value >= 0 {
+		rotation.MaxFiles = value
+	}
+
+	if value, err := strconv.ParseBool(os.Getenv(LogCompressEnvVar)); err == nil {
+		rotation.Compress = value
+	}
+
+	return rotation
+}
+
+func (r LogRotation) Validate() error {
+	if r.MaxSizeMB < 0 {
+		return fmt.Errorf("invalid log max size %v, expected a size in MB or 0 to disable the rotation", r.MaxSizeMB)
+	}
+
+	if r.MaxFiles < 0 {
+		return fmt.Errorf("invalid log max files %v, expected a number of files or 0 to keep them all", r.MaxFiles)
+	}
+
+	return nil
+}
+
+func (r LogRotation) maxSize() int64 {
+	return int64(r.MaxSizeMB) * 1024 * 1024
+}
+
+// LogFile is the log file of a session. Once it reaches the maximum size, its content is moved to a numbered file
+// next to it, compressed if requested, and the oldest log files of the folder are removed. The path of the current
+// log file never changes.
+type LogFile struct {
+	lock     sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	rotation LogRotation
+	rotated  int
+
+	cleanupLock sync.Mutex
+	cleanupWG   sync.WaitGroup
+}
+
+// OpenLogFile creates a new log file in dir and removes the oldest log files beyond the retention limit.
+func OpenLogFile(dir string, rotation LogRotation) (*LogFile, error) {
+	if err := rotation.Validate(); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, NewLogFileName())
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	f := &LogFile{path: path, file: file, rotation: rotation}
+
+	if err := pruneLogFiles(dir, path, rotation.MaxFiles); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *LogFile) Path() string {
+	return f.path
+}
+
+func (f *LogFile) Rotation() LogRotation {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.rotation
+}
+
+// SetRotation changes the rotation limits, which apply from the next write.
+func (f *LogFile) SetRotation(rotation LogRotation) error {
+	if err := rotation.Validate(); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.rotation = rotation
+
+	return nil
+}
+
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if maxSize := f.rotation.maxSize(); maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Close closes the log file once the rotated files are compressed. The logger output must have been changed before.
+func (f *LogFile) Close() error {
+	// The cleanup logs its failures, wait for it before taking the lock.
+	f.cleanupWG.Wait()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
+
+// rotate must be called with the lock held. It must not log, the logger writes to this file.
+func (f *LogFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	f.rotated++
+	rotatedPath := strings.TrimSuffix(f.path, logFileSuffix) + fmt.Sprintf(".%v", f.rotated) + logFileSuffix
+
+	renameErr := os.Rename(f.path, rotatedPath)
+
+	// The log file is reopened even if the rename failed so the following lines are not lost.
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if renameErr != nil {
+		flags = os.O_RDWR | os.O_CREATE | os.O_APPEND
+	}
+
+	file, err := os.OpenFile(f.path, flags, 0600) //nolint:gosec
+	if err != nil {
+		f.file = nil
+		return err
+	}
+
+	f.file = file
+	f.size = 0
+
+	if renameErr != nil {
+		return nil
+	}
+
+	rotation := f.rotation
+
+	f.cleanupWG.Add(1)
+
+	go func() {
+		defer f.cleanupWG.Done()
+
+		f.cleanupLock.Lock()
+		defer f.cleanupLock.Unlock()
+
+		if rotation.Compress {
+			if err := compressLogFile(rotatedPath); err != nil {
+				logrus.WithError(err).WithField("path", rotatedPath).Warn("Failed to compress rotated log file")
+			}
+		}
+
+		if err := pruneLogFiles(filepath.Dir(f.path), f.path, rotation.MaxFiles); err != nil {
+			logrus.WithError(err).Warn("Failed to remove old log files")
+		}
+	}()
+
+	return nil
+}
+
+func compressLogFile(path string) (outErr error) {
+	src, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer src.Close() //nolint:errcheck
+
+	dstPath := path + ".gz"
+
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600) //nolint:gosec
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if outErr != nil {
+			_ = os.Remove(dstPath)
+		}
+	}()
+
+	writer := gzip.NewWriter(dst)
+
+	if _, err := io.Copy(writer, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		_ = dst.Close()
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	_ = src.Close()
+
+	return os.Remove(path)
+}
+
+// pruneLogFiles removes the oldest log files of dir so that at most maxFiles remain, the current one included.
+func pruneLogFiles(dir, current string, maxFiles int) error {
+	if maxFiles <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	type logFileInfo struct {
+		path    string
+		modTime int64
+	}
+
+	var files []logFileInfo
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !(strings.HasSuffix(name, logFileSuffix) || strings.HasSuffix(name, compressedLogFileSuffix)) {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		if path == current {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		files = append(files, logFileInfo{path: path, modTime: info.ModTime().UnixNano()})
+	}
+
+	if len(files) < maxFiles {
+		return nil
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].modTime == files[j].modTime {
+			return files[i].path > files[j].path
+		}
+
+		return files[i].modTime > files[j].modTime
+	})
+
+	for _, file := range files[maxFiles-1:] {
+		if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogFile_RotatesAndCompresses(t *testing.T) {
+	dir := t.TempDir()
+
+	logFile, err := OpenLogFile(dir, LogRotation{MaxSizeMB: 1, MaxFiles: 3, Compress: true})
+	require.NoError(t, err)
+
+	line := append(bytes.Repeat([]byte("x"), 1023), '\n')
+	for i := 0; i < 3*1024; i++ {
+		_, err := logFile.Write(line)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, logFile.Close())
+
+	info, err := os.Stat(logFile.Path())
+	require.NoError(t, err)
+	require.LessOrEqual(t, info.Size(), int64(1024*1024))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	base := strings.TrimSuffix(filepath.Base(logFile.Path()), logFileSuffix)
+	require.ElementsMatch(t, []string{
+		base + logFileSuffix,
+		base + ".1" + compressedLogFileSuffix,
+		base + ".2" + compressedLogFileSuffix,
+	}, names)
+}
+
+func TestLogFile_PrunesPreviousRuns(t *testing.T) {
+	dir := t.TempDir()
+
+	for i, name := range []string{"20240101_000000_export.log", "20240102_000000_export.log", "20240103_000000_export.log.gz", "audit.log"} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte("log"), 0o600))
+
+		modTime := time.Now().Add(time.Duration(i-10) * time.Hour)
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+
+	logFile, err := OpenLogFile(dir, LogRotation{MaxFiles: 3})
+	require.NoError(t, err)
+	require.NoError(t, logFile.Close())
+
+	require.NoFileExists(t, filepath.Join(dir, "20240101_000000_export.log"))
+	require.FileExists(t, filepath.Join(dir, "20240102_000000_export.log"))
+	require.FileExists(t, filepath.Join(dir, "20240103_000000_export.log.gz"))
+	require.FileExists(t, filepath.Join(dir, "audit.log"))
+	require.FileExists(t, logFile.Path())
+}
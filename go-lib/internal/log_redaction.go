@@ -0,0 +1,148 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PrivacyLogsEnvVar enables the redaction of the logs from their first line, see EnableLogRedaction.
+const PrivacyLogsEnvVar = "ET_PRIVACY_LOGS"
+
+//nolint:gochecknoglobals
+var (
+	logRedactionOnce sync.Once
+
+	emailRegexp = regexp.MustCompile(`[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}`)
+
+	// Fields holding email addresses, subjects, label and folder names or file paths. Their values are replaced as a
+	// whole, the other fields and the messages only have their email addresses replaced.
+	sensitiveLogFields = map[string]struct{}{
+		"address": {}, "email": {}, "user": {}, "subject": {}, "header": {}, "original": {},
+		"label": {}, "labelName": {}, "folder": {}, "folderName": {},
+		"path": {}, "dstPath": {}, "sourcePath": {}, "backupPath": {}, "exportDir": {}, "export-dir": {}, "tmp-dir": {},
+		"backup-folder": {}, "destination": {}, "mirror": {}, "file": {}, "filename": {},
+	}
+)
+
+// IsPrivacyLogsEnabledInEnv tells whether PrivacyLogsEnvVar is set to a true value.
+func IsPrivacyLogsEnabledInEnv() bool {
+	enabled, err := strconv.ParseBool(os.Getenv(PrivacyLogsEnvVar))
+	return err == nil && enabled
+}
+
+// EnableLogRedaction redacts the email addresses, subjects, label names and file paths of the next log lines, so that
+// the logs can be attached to a support ticket. The redacted values are replaced by a hash that is stable for the
+// lifetime of the process, the same value can be followed across the lines of a log but not guessed. It cannot be
+// disabled.
+func EnableLogRedaction() {
+	logRedactionOnce.Do(func() {
+		logrus.AddHook(newRedactionHook())
+		logrus.Info("Privacy logs enabled, sensitive values are redacted")
+	})
+}
+
+type redactionHook struct {
+	key []byte
+}
+
+func newRedactionHook() *redactionHook {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Errorf("failed to generate log redaction key: %w", err))
+	}
+
+	return &redactionHook{key: key}
+}
+
+func (h *redactionHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *redactionHook) Fire(entry *logrus.Entry) error {
+	entry.Message = h.redactEmails(entry.Message)
+
+	for key, value := range entry.Data {
+		if _, ok := sensitiveLogFields[key]; ok {
+			entry.Data[key] = h.redact(fmt.Sprint(value))
+			continue
+		}
+
+		switch value := value.(type) {
+		case string:
+			entry.Data[key] = h.redactEmails(value)
+
+		case error:
+			entry.Data[key] = h.redactError(value)
+
+		case fmt.Stringer:
+			entry.Data[key] = h.redactEmails(value.String())
+		}
+	}
+
+	return nil
+}
+
+// redactError replaces the file paths and the email addresses of the message of err.
+func (h *redactionHook) redactError(err error) string {
+	message := err.Error()
+
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) && len(pathErr.Path) != 0 {
+		message = strings.ReplaceAll(message, pathErr.Path, h.redact(pathErr.Path))
+	}
+
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		for _, path := range []string{linkErr.Old, linkErr.New} {
+			if len(path) != 0 {
+				message = strings.ReplaceAll(message, path, h.redact(path))
+			}
+		}
+	}
+
+	return h.redactEmails(message)
+}
+
+func (h *redactionHook) redactEmails(s string) string {
+	return emailRegexp.ReplaceAllStringFunc(s, h.redact)
+}
+
+func (h *redactionHook) redact(value string) string {
+	if len(value) == 0 {
+		return value
+	}
+
+	mac := hmac.New(sha256.New, h.key)
+	_, _ = mac.Write([]byte(value))
+
+	return "[redacted:" + hex.EncodeToString(mac.Sum(nil)[:4]) + "]"
+}
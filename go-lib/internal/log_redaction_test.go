@@ -0,0 +1,54 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactionHook(t *testing.T) {
+	hook := newRedactionHook()
+
+	pathErr := &fs.PathError{Op: "open", Path: "/home/alice/backup/labels.json", Err: errors.New("permission denied")}
+
+	entry := logrus.NewEntry(logrus.New()).WithFields(logrus.Fields{
+		"path":      "/home/alice/backup",
+		"messageID": "abc==",
+		"error":     pathErr,
+		"reason":    "rejected by bob@example.com",
+	})
+	entry.Message = "Failed to send to alice@proton.me"
+
+	require.NoError(t, hook.Fire(entry))
+
+	redactedPath := hook.redact("/home/alice/backup")
+	require.Regexp(t, `^\[redacted:[0-9a-f]{8}\]$`, redactedPath)
+	require.Equal(t, redactedPath, entry.Data["path"])
+	require.Equal(t, "abc==", entry.Data["messageID"])
+	require.Equal(t, "open "+hook.redact(pathErr.Path)+": permission denied", entry.Data["error"])
+	require.Equal(t, "rejected by "+hook.redact("bob@example.com"), entry.Data["reason"])
+	require.Equal(t, "Failed to send to "+hook.redact("alice@proton.me"), entry.Message)
+
+	// The hash is keyed per process, it cannot be matched against a list of addresses.
+	require.NotEqual(t, hook.redact("alice@proton.me"), newRedactionHook().redact("alice@proton.me"))
+}
@@ -18,18 +18,78 @@
 package internal
 
 import (
+	"fmt"
+	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// LogFormat selects how the log lines are written.
+type LogFormat int
+
+const (
+	LogFormatText LogFormat = iota // Human readable key=value lines.
+	LogFormatJSON                  // One JSON object per line, for log aggregation tools and scripts.
+)
+
+// LogFormatEnvVar selects the log format from the start of the log, see GetLogFormatFromEnv.
+const LogFormatEnvVar = "ET_LOG_FORMAT"
+
+func (f LogFormat) String() string {
+	switch f {
+	case LogFormatText:
+		return "text"
+	case LogFormatJSON:
+		return "json"
+	default:
+		return "unknown"
+	}
+}
+
+func LogFormatFromString(s string) (LogFormat, error) {
+	switch strings.ToLower(s) {
+	case "", "text":
+		return LogFormatText, nil
+	case "json":
+		return LogFormatJSON, nil
+	default:
+		return LogFormatText, fmt.Errorf("unknown log format '%v', expected text or json", s)
+	}
+}
+
+// GetLogFormatFromEnv returns the format selected by LogFormatEnvVar, text if it is unset or invalid.
+func GetLogFormatFromEnv() LogFormat {
+	format, err := LogFormatFromString(os.Getenv(LogFormatEnvVar))
+	if err != nil {
+		return LogFormatText
+	}
+
+	return format
+}
+
 func NewLogFileName() string {
 	const format = "20060102_150405"
 	return time.Now().Format(format) + "_export.log"
 }
 
-func NewLogFormatter() logrus.Formatter {
+// NewLogFormatter returns the formatter of the log files. The names of the JSON keys are part of the interface with the
+// tools parsing the logs and must not change: "time" in RFC 3339 format with milliseconds, "level", "msg", "error" for
+// the errors and the names of the other fields as is.
+func NewLogFormatter(format LogFormat) logrus.Formatter {
+	if format == LogFormatJSON {
+		return &logrus.JSONFormatter{
+			TimestampFormat: "2006-01-02T15:04:05.000Z07:00",
+			FieldMap: logrus.FieldMap{
+				logrus.FieldKeyTime:  "time",
+				logrus.FieldKeyLevel: "level",
+				logrus.FieldKeyMsg:   "msg",
+			},
+		}
+	}
+
 	return &logrus.TextFormatter{
 		DisableColors:    true,
 		ForceQuote:       true,
@@ -39,6 +99,12 @@ func NewLogFormatter() logrus.Formatter {
 	}
 }
 
+// SetLogFormat changes the format of the next log lines.
+func SetLogFormat(format LogFormat) {
+	logrus.SetFormatter(NewLogFormatter(format))
+	logrus.WithField("format", format.String()).Info("Log format changed")
+}
+
 func LogPrelude() {
 	logrus.SetLevel(logrus.DebugLevel)
 	logrus.
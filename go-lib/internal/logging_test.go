@@ -0,0 +1,60 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogFormatFromString(t *testing.T) {
+	for value, expected := range map[string]LogFormat{"": LogFormatText, "text": LogFormatText, "JSON": LogFormatJSON} {
+		format, err := LogFormatFromString(value)
+		require.NoError(t, err)
+		require.Equal(t, expected, format)
+	}
+
+	_, err := LogFormatFromString("xml")
+	require.Error(t, err)
+}
+
+func TestNewLogFormatter_JSONFieldNames(t *testing.T) {
+	logger := logrus.New()
+	entry := logrus.NewEntry(logger).WithField("messageID", "abc").WithError(errors.New("failed"))
+	entry.Time = time.Date(2024, 3, 1, 10, 20, 30, 456000000, time.UTC)
+	entry.Level = logrus.WarnLevel
+	entry.Message = "Download failed"
+
+	line, err := NewLogFormatter(LogFormatJSON).Format(entry)
+	require.NoError(t, err)
+
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(line, &fields))
+	require.Equal(t, map[string]any{
+		"time":      "2024-03-01T10:20:30.456Z",
+		"level":     "warning",
+		"msg":       "Download failed",
+		"error":     "failed",
+		"messageID": "abc",
+	}, fields)
+}
@@ -0,0 +1,322 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+)
+
+// Annotation
+// ----------
+// An export can be corrected offline before it is restored, e.g. to retag messages or to fix their date. Only the
+// metadata files are patched, the EML files are left untouched: the restore takes the labels, the read state and the
+// flags of a message from its metadata file, and the time is used to order the imports. Every change is recorded in
+// the annotation manifest of the export, with the former and the new value, so the export keeps an audit trail of
+// the edits made after the backup.
+
+const AnnotationManifestVersion = 1
+
+var (
+	ErrEmptyPatch         = errors.New("the patch does not change anything")
+	ErrUnknownLabel       = errors.New("unknown label")
+	ErrMessageNotInBackup = errors.New("message not found in the export")
+)
+
+// MetadataPatch is a correction applied to the metadata of some messages of an export.
+type MetadataPatch struct {
+	MessageIDs   []string
+	AddLabels    []string // Label IDs, names or paths, resolved with the labels file of the export.
+	RemoveLabels []string
+	Time         *int64 // Unix time.
+	Unread       *bool
+	Note         string // Appended to the notes of the messages.
+	Reason       string // Recorded in the annotation manifest.
+}
+
+func (p *MetadataPatch) isEmpty() bool {
+	return len(p.AddLabels) == 0 && len(p.RemoveLabels) == 0 && p.Time == nil && p.Unread == nil && len(p.Note) == 0
+}
+
+// MessageNote is a free text note attached to a message after the export.
+type MessageNote struct {
+	Time time.Time
+	Text string
+}
+
+// AnnotationChange is a change of one field of the metadata of a message.
+type AnnotationChange struct {
+	MessageID string
+	Field     string
+	Old       string
+	New       string
+}
+
+// Annotation records one patch applied to an export.
+type Annotation struct {
+	Time    time.Time
+	Reason  string
+	Changes []AnnotationChange
+}
+
+type AnnotationManifest struct {
+	History []Annotation // Oldest first.
+}
+
+func getAnnotationManifestFileName() string {
+	return "annotations.json"
+}
+
+// LoadAnnotationManifest reads the annotation manifest of an export directory.
+func LoadAnnotationManifest(exportDir string) (AnnotationManifest, error) {
+	b, err := os.ReadFile(filepath.Join(exportDir, getAnnotationManifestFileName())) //nolint:gosec
+	if err != nil {
+		return AnnotationManifest{}, fmt.Errorf("failed to read annotation manifest: %w", err)
+	}
+
+	manifest, err := utils.NewVersionedJSON[AnnotationManifest](AnnotationManifestVersion, b)
+	if err != nil {
+		return AnnotationManifest{}, fmt.Errorf("failed to parse annotation manifest: %w", err)
+	}
+
+	return manifest.Payload, nil
+}
+
+// AnnotateExport applies patch to the metadata files of the export in exportDir and records the changes in the
+// annotation manifest. The returned annotation lists the changes, messages that already matched the patch are not
+// rewritten.
+func AnnotateExport(exportDir string, patch MetadataPatch) (Annotation, error) {
+	log := logrus.WithField("annotate", "mail").WithField("exportDir", exportDir)
+
+	if len(patch.MessageIDs) == 0 {
+		return Annotation{}, errors.New("no message to annotate")
+	}
+
+	if patch.isEmpty() {
+		return Annotation{}, ErrEmptyPatch
+	}
+
+	addLabelIDs, removeLabelIDs, err := resolvePatchLabels(exportDir, &patch)
+	if err != nil {
+		return Annotation{}, err
+	}
+
+	paths := make([]string, 0, len(patch.MessageIDs))
+	for _, id := range patch.MessageIDs {
+		path, err := findMetadataFile(exportDir, id)
+		if err != nil {
+			return Annotation{}, err
+		}
+
+		paths = append(paths, path)
+	}
+
+	tmpDir := filepath.Join(exportDir, "temp")
+	if err := os.MkdirAll(tmpDir, 0o700); err != nil {
+		return Annotation{}, fmt.Errorf("failed to create annotation tmp directory: %w", err)
+	}
+
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.WithError(err).Error("Failed to remove temp directory")
+		}
+	}()
+
+	annotation := Annotation{Time: time.Now().UTC(), Reason: patch.Reason}
+
+	for _, path := range paths {
+		metadata, err := loadMetadataFile(path)
+		if err != nil {
+			return Annotation{}, err
+		}
+
+		changes := applyMetadataPatch(&metadata, &patch, addLabelIDs, removeLabelIDs, annotation.Time)
+		if len(changes) == 0 {
+			continue
+		}
+
+		data, err := metadata.toBytes()
+		if err != nil {
+			return Annotation{}, fmt.Errorf("failed to json encode metadata: %w", err)
+		}
+
+		if err := utils.WriteFileSafe(tmpDir, path, data, &utils.Sha256IntegrityChecker{}); err != nil {
+			return Annotation{}, fmt.Errorf("failed to write '%v': %w", path, err)
+		}
+
+		annotation.Changes = append(annotation.Changes, changes...)
+	}
+
+	if len(annotation.Changes) == 0 {
+		log.Info("All the messages already match the patch")
+		return annotation, nil
+	}
+
+	manifest, err := LoadAnnotationManifest(exportDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Annotation{}, err
+	}
+
+	manifest.History = append(manifest.History, annotation)
+
+	data, err := utils.GenerateVersionedJSON(AnnotationManifestVersion, &manifest)
+	if err != nil {
+		return Annotation{}, fmt.Errorf("failed to json encode annotation manifest: %w", err)
+	}
+
+	if err := utils.WriteFileSafe(tmpDir, filepath.Join(exportDir, getAnnotationManifestFileName()), data, &utils.Sha256IntegrityChecker{}); err != nil {
+		return Annotation{}, fmt.Errorf("failed to write annotation manifest: %w", err)
+	}
+
+	log.WithField("changes", len(annotation.Changes)).Info("Export annotated")
+
+	return annotation, nil
+}
+
+// findMetadataFile returns the path of the metadata file of a message, which is either in the export directory or in
+// its auto-generated sub folder.
+func findMetadataFile(exportDir, id string) (string, error) {
+	for _, dir := range []string{exportDir, filepath.Join(exportDir, getAutoGeneratedDirName())} {
+		path := filepath.Join(dir, getMetadataFileName(id))
+
+		exists, err := fileExists(path)
+		if err != nil {
+			return "", err
+		}
+
+		if exists {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %v", ErrMessageNotInBackup, id)
+}
+
+func resolvePatchLabels(exportDir string, patch *MetadataPatch) ([]string, []string, error) {
+	if len(patch.AddLabels) == 0 && len(patch.RemoveLabels) == 0 {
+		return nil, nil, nil
+	}
+
+	b, err := os.ReadFile(filepath.Join(exportDir, getLabelFileName())) //nolint:gosec
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read labels file: %w", err)
+	}
+
+	labels, err := utils.NewVersionedJSON[[]proton.Label](LabelMetadataVersion, b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse labels file: %w", err)
+	}
+
+	resolve := func(refs []string) ([]string, error) {
+		ids := make([]string, 0, len(refs))
+
+		for _, ref := range refs {
+			id, ok := resolveLabel(labels.Payload, ref)
+			if !ok {
+				return nil, fmt.Errorf("%w: %v", ErrUnknownLabel, ref)
+			}
+
+			ids = append(ids, id)
+		}
+
+		return ids, nil
+	}
+
+	addLabelIDs, err := resolve(patch.AddLabels)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	removeLabelIDs, err := resolve(patch.RemoveLabels)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return addLabelIDs, removeLabelIDs, nil
+}
+
+// resolveLabel matches ref with the ID of a label first, then with its path or name, ignoring the case.
+func resolveLabel(labels []proton.Label, ref string) (string, bool) {
+	for _, label := range labels {
+		if label.ID == ref {
+			return label.ID, true
+		}
+	}
+
+	for _, label := range labels {
+		if strings.EqualFold(strings.Join(label.Path, "/"), ref) || strings.EqualFold(label.Name, ref) {
+			return label.ID, true
+		}
+	}
+
+	return "", false
+}
+
+func applyMetadataPatch(
+	metadata *MessageMetadata,
+	patch *MetadataPatch,
+	addLabelIDs, removeLabelIDs []string,
+	now time.Time,
+) []AnnotationChange {
+	var changes []AnnotationChange
+
+	change := func(field, oldValue, newValue string) {
+		changes = append(changes, AnnotationChange{MessageID: metadata.ID, Field: field, Old: oldValue, New: newValue})
+	}
+
+	for _, id := range removeLabelIDs {
+		if idx := slices.Index(metadata.LabelIDs, id); idx >= 0 {
+			metadata.LabelIDs = slices.Delete(metadata.LabelIDs, idx, idx+1)
+			change("LabelIDs", id, "")
+		}
+	}
+
+	for _, id := range addLabelIDs {
+		if !slices.Contains(metadata.LabelIDs, id) {
+			metadata.LabelIDs = append(metadata.LabelIDs, id)
+			change("LabelIDs", "", id)
+		}
+	}
+
+	if patch.Time != nil && metadata.Time != *patch.Time {
+		change("Time", strconv.FormatInt(metadata.Time, 10), strconv.FormatInt(*patch.Time, 10))
+		metadata.Time = *patch.Time
+	}
+
+	if patch.Unread != nil && bool(metadata.Unread) != *patch.Unread {
+		change("Unread", strconv.FormatBool(bool(metadata.Unread)), strconv.FormatBool(*patch.Unread))
+		metadata.Unread = proton.Bool(*patch.Unread)
+	}
+
+	if len(patch.Note) != 0 {
+		metadata.Notes = append(metadata.Notes, MessageNote{Time: now, Text: patch.Note})
+		change("Notes", "", patch.Note)
+	}
+
+	return changes
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func writeAnnotationTestExport(t *testing.T, dir string, metadata ...MessageMetadata) {
+	labels := []proton.Label{
+		{ID: proton.InboxLabel, Name: "Inbox", Path: []string{"Inbox"}, Type: proton.LabelTypeSystem},
+		{ID: "label-1", Name: "Invoices", Path: []string{"Work", "Invoices"}, Type: proton.LabelTypeLabel},
+	}
+
+	data, err := utils.GenerateVersionedJSON(LabelMetadataVersion, labels)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getLabelFileName()), data, 0o600))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, getAutoGeneratedDirName()), 0o700))
+
+	for i := range metadata {
+		data, err := metadata[i].toBytes()
+		require.NoError(t, err)
+
+		msgDir := dir
+		if metadata[i].AutoGenerated != nil {
+			msgDir = filepath.Join(dir, getAutoGeneratedDirName())
+		}
+
+		require.NoError(t, os.WriteFile(filepath.Join(msgDir, getMetadataFileName(metadata[i].ID)), data, 0o600))
+	}
+}
+
+func TestAnnotateExport(t *testing.T) {
+	dir := t.TempDir()
+
+	msg1 := MessageMetadata{MessageMetadata: proton.MessageMetadata{ID: "msg1", LabelIDs: []string{proton.InboxLabel}, Time: 100, Unread: true}}
+	msg2 := MessageMetadata{
+		MessageMetadata: proton.MessageMetadata{ID: "msg2", LabelIDs: []string{proton.InboxLabel, "label-1"}, Time: 200},
+		AutoGenerated:   &AutoGenerated{},
+	}
+	writeAnnotationTestExport(t, dir, msg1, msg2)
+
+	newTime := int64(300)
+	unread := false
+
+	annotation, err := AnnotateExport(dir, MetadataPatch{
+		MessageIDs:   []string{"msg1", "msg2"},
+		AddLabels:    []string{"work/invoices"},
+		RemoveLabels: []string{"Inbox"},
+		Time:         &newTime,
+		Unread:       &unread,
+		Note:         "Imported from the old archive",
+		Reason:       "Cleanup before restore",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "Cleanup before restore", annotation.Reason)
+	require.Len(t, annotation.Changes, 8)
+
+	patched, err := loadMetadataFile(filepath.Join(dir, getMetadataFileName("msg1")))
+	require.NoError(t, err)
+	require.Equal(t, []string{"label-1"}, patched.LabelIDs)
+	require.Equal(t, int64(300), patched.Time)
+	require.False(t, bool(patched.Unread))
+	require.Len(t, patched.Notes, 1)
+	require.Equal(t, "Imported from the old archive", patched.Notes[0].Text)
+
+	patched, err = loadMetadataFile(filepath.Join(dir, getAutoGeneratedDirName(), getMetadataFileName("msg2")))
+	require.NoError(t, err)
+	require.Equal(t, []string{"label-1"}, patched.LabelIDs)
+
+	manifest, err := LoadAnnotationManifest(dir)
+	require.NoError(t, err)
+	require.Len(t, manifest.History, 1)
+	require.Contains(t, manifest.History[0].Changes, AnnotationChange{MessageID: "msg1", Field: "Time", Old: "100", New: "300"})
+
+	_, err = os.Stat(filepath.Join(dir, "temp"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// A patch that does not change anything is not recorded.
+	annotation, err = AnnotateExport(dir, MetadataPatch{MessageIDs: []string{"msg1"}, Time: &newTime})
+	require.NoError(t, err)
+	require.Empty(t, annotation.Changes)
+
+	manifest, err = LoadAnnotationManifest(dir)
+	require.NoError(t, err)
+	require.Len(t, manifest.History, 1)
+}
+
+func TestAnnotateExportErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeAnnotationTestExport(t, dir, MessageMetadata{MessageMetadata: proton.MessageMetadata{ID: "msg1"}})
+
+	_, err := AnnotateExport(dir, MetadataPatch{MessageIDs: []string{"msg1"}})
+	require.ErrorIs(t, err, ErrEmptyPatch)
+
+	_, err = AnnotateExport(dir, MetadataPatch{MessageIDs: []string{"msg1"}, AddLabels: []string{"Unknown"}})
+	require.ErrorIs(t, err, ErrUnknownLabel)
+
+	_, err = AnnotateExport(dir, MetadataPatch{MessageIDs: []string{"msg1", "msg2"}, Note: "note"})
+	require.ErrorIs(t, err, ErrMessageNotInBackup)
+
+	// Nothing is written when one of the messages is missing.
+	_, err = LoadAnnotationManifest(dir)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
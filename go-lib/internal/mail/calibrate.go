@@ -0,0 +1,310 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/export-tool/internal/session"
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/bradenaw/juniper/parallel"
+	"github.com/sirupsen/logrus"
+)
+
+// Calibration
+// -----------
+// Calibrate times the stages of an export on a sample of the most recent messages of the mailbox. The sample is
+// downloaded once per candidate download concurrency, decrypted and assembled once per candidate build concurrency, and
+// written once to a temporary folder. The recommended concurrency of a stage is the smallest one reaching most of the
+// best measured throughput without being rate limited: larger ones only add load on the servers for no gain. The levels
+// are measured from the smallest to the largest, so the later downloads may benefit from warm server caches and the
+// recommendation errs on the side of the larger values. Nothing is written to the export folder.
+
+var ErrCalibrationEmptyMailbox = errors.New("the mailbox has no message to calibrate with")
+
+// MaxCalibrationSampleSize is the largest sample, the messages are listed with a single metadata request.
+const MaxCalibrationSampleSize = 150
+
+// calibrationThroughputRatio is the share of the best throughput a concurrency must reach to be recommended.
+const calibrationThroughputRatio = 0.9
+
+type CalibrationSpec struct {
+	SampleSize         int
+	DownloadLevels     []int // Concurrencies of the downloads, in increasing order.
+	BuildLevels        []int // Concurrencies of the decryption and assembly, in increasing order.
+	WriteConcurrency   int
+	TemporaryDirectory string // Parent of the folder the sample is written to, the default temporary folder if empty.
+}
+
+// DefaultCalibrationSpec returns the levels suited to the plan of the account, the free plans are not tested beyond
+// twice their default concurrency to stay clear of their rate limits.
+func DefaultCalibrationSpec(tier PlanTier) CalibrationSpec {
+	var downloadLevels []int
+
+	for level := 2; level <= MaxConcurrency && level <= 2*tier.GetConcurrency(); level *= 2 {
+		downloadLevels = append(downloadLevels, level)
+	}
+
+	return CalibrationSpec{
+		SampleSize:       50,
+		DownloadLevels:   downloadLevels,
+		BuildLevels:      []int{1, 2, 4, 8},
+		WriteConcurrency: NumParallelWriters,
+	}
+}
+
+func (c *CalibrationSpec) Validate() error {
+	if c.SampleSize <= 0 || c.SampleSize > MaxCalibrationSampleSize {
+		return fmt.Errorf("invalid calibration sample size %v, expected a value between 1 and %v", c.SampleSize, MaxCalibrationSampleSize)
+	}
+
+	if len(c.DownloadLevels) == 0 || len(c.BuildLevels) == 0 {
+		return fmt.Errorf("calibration requires at least one download and one build concurrency")
+	}
+
+	for _, level := range append(append([]int{c.WriteConcurrency}, c.DownloadLevels...), c.BuildLevels...) {
+		if level <= 0 {
+			return fmt.Errorf("invalid calibration concurrency %v", level)
+		}
+
+		if err := validateConcurrency(level); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CalibrationLevel is the measure of a stage at one concurrency.
+type CalibrationLevel struct {
+	Concurrency int
+	Duration    time.Duration
+	Bytes       uint64
+	RateLimited int // Requests the servers asked to repeat later.
+}
+
+// GetThroughput returns the processed bytes per second.
+func (c *CalibrationLevel) GetThroughput() float64 {
+	if c.Duration <= 0 {
+		return 0
+	}
+
+	return float64(c.Bytes) / c.Duration.Seconds()
+}
+
+type CalibrationReport struct {
+	Time         time.Time
+	MessageCount int
+	Download     []CalibrationLevel
+	Build        []CalibrationLevel
+	Write        CalibrationLevel
+
+	Concurrency      int // Recommended download concurrency.
+	BuildConcurrency int // Recommended build concurrency.
+}
+
+// Calibrate measures the export stages with the levels of spec, see the Calibration section.
+func Calibrate(ctx context.Context, session *session.Session, spec CalibrationSpec) (CalibrationReport, error) {
+	if err := spec.Validate(); err != nil {
+		return CalibrationReport{}, err
+	}
+
+	log := logrus.WithField("calibrate", "mail").WithField("userID", session.GetUser().ID)
+	client := session.GetClient()
+	user := session.GetUser()
+
+	report := CalibrationReport{Time: time.Now().UTC()}
+
+	sample, err := client.GetMessageMetadataPage(ctx, 0, spec.SampleSize, proton.MessageFilter{})
+	if err != nil {
+		return report, fmt.Errorf("failed to list the calibration sample: %w", err)
+	}
+
+	if len(sample) == 0 {
+		return report, ErrCalibrationEmptyMailbox
+	}
+
+	report.MessageCount = len(sample)
+
+	saltedKeyPass, err := session.GetSaltedKeyPass()
+	if err != nil {
+		return report, fmt.Errorf("failed to salt key password: %w", err)
+	}
+
+	addresses, err := client.GetAddresses(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to get user addresses: %w", err)
+	}
+
+	keyRing, err := apiclient.NewUnlockedKeyRing(user, addresses, saltedKeyPass)
+	if err != nil {
+		return report, fmt.Errorf("failed to unlock user keyring:%w", err)
+	}
+	defer keyRing.Close()
+
+	var messages []proton.FullMessage
+
+	for _, concurrency := range spec.DownloadLevels {
+		var rateLimited atomic.Int32
+
+		levelCtx := apiclient.WithRateLimitObserver(ctx, func(time.Duration) { rateLimited.Add(1) })
+		level := CalibrationLevel{Concurrency: concurrency}
+		downloaded := make([]proton.FullMessage, len(sample))
+
+		start := time.Now()
+		if err := parallel.DoContext(levelCtx, concurrency, len(sample), func(ctx context.Context, i int) error {
+			msg, err := downloadMessageAndAttachments(ctx, client, sample[i])
+			if err != nil {
+				return err
+			}
+
+			downloaded[i] = msg
+
+			return nil
+		}); err != nil {
+			return report, fmt.Errorf("failed to download the calibration sample: %w", err)
+		}
+
+		level.Duration = time.Since(start)
+		level.RateLimited = int(rateLimited.Load())
+
+		for i := range downloaded {
+			level.Bytes += getDownloadedSize(&downloaded[i])
+		}
+
+		log.WithFields(logrus.Fields{"concurrency": concurrency, "duration": level.Duration, "rate-limited": level.RateLimited}).Info("Measured downloads")
+
+		report.Download = append(report.Download, level)
+		messages = downloaded
+	}
+
+	buildStage := NewBuildStage(1, log, 0, session.GetPanicHandler(), session.GetReporter(), user.ID)
+
+	var built [][]byte
+
+	for _, concurrency := range spec.BuildLevels {
+		level := CalibrationLevel{Concurrency: concurrency}
+		emls := make([][]byte, len(messages))
+
+		start := time.Now()
+		if err := parallel.DoContext(ctx, concurrency, len(messages), func(_ context.Context, i int) error {
+			kr, ok := keyRing.GetAddrKeyRing(messages[i].AddressID)
+			if !ok {
+				return nil
+			}
+
+			if writer, ok := buildStage.buildMessage(kr, &messages[i]).(*DecryptedAndBuiltMessageWriter); ok {
+				emls[i] = writer.eml.Bytes()
+			}
+
+			return nil
+		}); err != nil {
+			return report, err
+		}
+
+		level.Duration = time.Since(start)
+
+		for _, eml := range emls {
+			level.Bytes += uint64(len(eml))
+		}
+
+		log.WithFields(logrus.Fields{"concurrency": concurrency, "duration": level.Duration}).Info("Measured builds")
+
+		report.Build = append(report.Build, level)
+		built = emls
+	}
+
+	if report.Write, err = calibrateWrite(ctx, spec.TemporaryDirectory, spec.WriteConcurrency, built); err != nil {
+		return report, err
+	}
+
+	report.Concurrency = recommendConcurrency(report.Download)
+	report.BuildConcurrency = recommendConcurrency(report.Build)
+
+	log.WithFields(logrus.Fields{"concurrency": report.Concurrency, "build-concurrency": report.BuildConcurrency}).Info("Calibration finished")
+
+	return report, nil
+}
+
+// calibrateWrite writes the messages to a temporary folder the way the write stage does.
+func calibrateWrite(ctx context.Context, parentDir string, concurrency int, emls [][]byte) (CalibrationLevel, error) {
+	level := CalibrationLevel{Concurrency: concurrency}
+
+	dir, err := os.MkdirTemp(parentDir, "export-tool-calibration-*")
+	if err != nil {
+		return level, fmt.Errorf("failed to create calibration directory: %w", err)
+	}
+
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.WithError(err).Error("Failed to remove calibration directory")
+		}
+	}()
+
+	start := time.Now()
+	if err := parallel.DoContext(ctx, concurrency, len(emls), func(_ context.Context, i int) error {
+		path := filepath.Join(dir, getEMLFileName(fmt.Sprint(i)))
+		if err := utils.WriteFileSafe(dir, path, emls[i], &utils.Sha256IntegrityChecker{}); err != nil {
+			return err
+		}
+
+		return utils.SyncFile(path)
+	}); err != nil {
+		return level, fmt.Errorf("failed to write the calibration sample: %w", err)
+	}
+
+	level.Duration = time.Since(start)
+
+	for _, eml := range emls {
+		level.Bytes += uint64(len(eml))
+	}
+
+	return level, nil
+}
+
+// recommendConcurrency returns the smallest concurrency that was not rate limited and reached most of the best
+// throughput. When every level was rate limited, the smallest one is returned.
+func recommendConcurrency(levels []CalibrationLevel) int {
+	var best float64
+
+	for i := range levels {
+		if levels[i].RateLimited == 0 {
+			best = max(best, levels[i].GetThroughput())
+		}
+	}
+
+	for i := range levels {
+		if levels[i].RateLimited == 0 && levels[i].GetThroughput() >= calibrationThroughputRatio*best {
+			return levels[i].Concurrency
+		}
+	}
+
+	if len(levels) == 0 {
+		return 0
+	}
+
+	return levels[0].Concurrency
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultCalibrationSpec(t *testing.T) {
+	free := DefaultCalibrationSpec(PlanTierFree)
+	require.NoError(t, free.Validate())
+	require.Equal(t, []int{2, 4, 8}, free.DownloadLevels)
+
+	large := DefaultCalibrationSpec(PlanTierLarge)
+	require.NoError(t, large.Validate())
+	require.Equal(t, []int{2, 4, 8, 16, 32}, large.DownloadLevels)
+
+	large.SampleSize = MaxCalibrationSampleSize + 1
+	require.Error(t, large.Validate())
+
+	large.SampleSize = 10
+	large.BuildLevels = []int{0}
+	require.Error(t, large.Validate())
+}
+
+func TestRecommendConcurrency(t *testing.T) {
+	level := func(concurrency int, seconds float64, rateLimited int) CalibrationLevel {
+		return CalibrationLevel{
+			Concurrency: concurrency,
+			Duration:    time.Duration(seconds * float64(time.Second)),
+			Bytes:       100 * MB,
+			RateLimited: rateLimited,
+		}
+	}
+
+	require.Equal(t, 0, recommendConcurrency(nil))
+
+	// The gain beyond 8 is too small to be worth the load.
+	require.Equal(t, 8, recommendConcurrency([]CalibrationLevel{level(2, 40, 0), level(4, 20, 0), level(8, 10.5, 0), level(16, 10, 0)}))
+
+	// The rate limited levels are never recommended.
+	require.Equal(t, 4, recommendConcurrency([]CalibrationLevel{level(2, 40, 0), level(4, 20, 0), level(8, 5, 3)}))
+
+	// Without any level clear of the rate limits, the smallest one is the safest.
+	require.Equal(t, 2, recommendConcurrency([]CalibrationLevel{level(2, 40, 1), level(4, 20, 2)}))
+}
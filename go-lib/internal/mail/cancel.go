@@ -0,0 +1,180 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ProtonMail/gluon/async"
+)
+
+// CancelCause tells why the context of a task was cancelled.
+type CancelCause int
+
+const (
+	CancelCauseNone     CancelCause = iota // The task was not cancelled.
+	CancelCauseUser                        // The user requested the cancellation.
+	CancelCauseDeadline                    // A deadline was exceeded.
+	CancelCauseFatal                       // The task was stopped because of an unrecoverable error.
+	CancelCauseParent                      // The parent context, e.g. the session, was cancelled.
+)
+
+func (c CancelCause) String() string {
+	switch c {
+	case CancelCauseNone:
+		return "none"
+	case CancelCauseUser:
+		return "user"
+	case CancelCauseDeadline:
+		return "deadline"
+	case CancelCauseFatal:
+		return "fatal"
+	case CancelCauseParent:
+		return "parent"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(c))
+	}
+}
+
+var ErrCancelledByUser = errors.New("operation cancelled by user")
+
+// CancelMode selects how a running task stops when it is cancelled.
+type CancelMode int
+
+const (
+	// CancelModeImmediate aborts the in-flight requests and removes the files of the messages that were not completely
+	// written.
+	CancelModeImmediate CancelMode = iota
+	// CancelModeGraceful stops starting new work and lets the in-flight messages finish.
+	CancelModeGraceful
+)
+
+func (m CancelMode) String() string {
+	switch m {
+	case CancelModeImmediate:
+		return "immediate"
+	case CancelModeGraceful:
+		return "graceful"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(m))
+	}
+}
+
+// taskCanceller implements the cancellation modes of a task. A graceful cancellation only signals the task to stop,
+// the task cancels its context with ErrCancelledByUser once the in-flight work is done. It is escalated to an immediate
+// cancellation when the context given with the request is done first.
+type taskCanceller struct {
+	ctxCancel    context.CancelCauseFunc
+	panicHandler async.PanicHandler
+	stopCh       chan struct{}
+	stopOnce     sync.Once
+	doneCh       chan struct{}
+	doneOnce     sync.Once
+}
+
+func newTaskCanceller(ctxCancel context.CancelCauseFunc, panicHandler async.PanicHandler) *taskCanceller {
+	return &taskCanceller{
+		ctxCancel:    ctxCancel,
+		panicHandler: panicHandler,
+		stopCh:       make(chan struct{}),
+		doneCh:       make(chan struct{}),
+	}
+}
+
+// cancel has no effect once the task finished.
+func (t *taskCanceller) cancel(ctx context.Context, mode CancelMode) {
+	select {
+	case <-t.doneCh:
+		return
+	default:
+	}
+
+	if mode != CancelModeGraceful {
+		t.ctxCancel(ErrCancelledByUser)
+		return
+	}
+
+	t.stopOnce.Do(func() { close(t.stopCh) })
+
+	go func() {
+		defer async.HandlePanic(t.panicHandler)
+
+		select {
+		case <-ctx.Done():
+			t.ctxCancel(ErrCancelledByUser)
+		case <-t.doneCh:
+		}
+	}()
+}
+
+// stopping is closed when a graceful cancellation is requested.
+func (t *taskCanceller) stopping() <-chan struct{} {
+	return t.stopCh
+}
+
+func (t *taskCanceller) isStopping() bool {
+	select {
+	case <-t.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish is called when the task finished, the pending graceful cancellations are no longer escalated.
+func (t *taskCanceller) finish() {
+	t.doneOnce.Do(func() { close(t.doneCh) })
+}
+
+// FatalError is used as the cancellation cause of a task that cannot continue.
+type FatalError struct {
+	Err error
+}
+
+func (f *FatalError) Error() string {
+	return fmt.Sprintf("fatal error: %v", f.Err)
+}
+
+func (f *FatalError) Unwrap() error {
+	return f.Err
+}
+
+// getCancelCause maps the cause of the cancellation of ctx to a CancelCause.
+func getCancelCause(ctx context.Context) CancelCause {
+	if ctx.Err() == nil {
+		return CancelCauseNone
+	}
+
+	cause := context.Cause(ctx)
+
+	var fatalErr *FatalError
+
+	switch {
+	case errors.Is(cause, ErrCancelledByUser):
+		return CancelCauseUser
+	case errors.As(cause, &fatalErr):
+		return CancelCauseFatal
+	case errors.Is(cause, context.DeadlineExceeded):
+		return CancelCauseDeadline
+	default:
+		return CancelCauseParent
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ProtonMail/gluon/async"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetCancelCause(t *testing.T) {
+	require.Equal(t, CancelCauseNone, getCancelCause(context.Background()))
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(ErrCancelledByUser)
+	cancel(&FatalError{Err: errors.New("late error")}) // The first cause is kept.
+	require.Equal(t, CancelCauseUser, getCancelCause(ctx))
+
+	ctx, cancel = context.WithCancelCause(context.Background())
+	cancel(&FatalError{Err: errors.New("failed")})
+	require.Equal(t, CancelCauseFatal, getCancelCause(ctx))
+
+	deadlineCtx, deadlineCancel := context.WithTimeout(context.Background(), 0)
+	defer deadlineCancel()
+	ctx, cancel = context.WithCancelCause(deadlineCtx)
+	defer cancel(nil)
+	<-ctx.Done()
+	require.Equal(t, CancelCauseDeadline, getCancelCause(ctx))
+
+	parentCtx, parentCancel := context.WithCancel(context.Background())
+	ctx, cancel = context.WithCancelCause(parentCtx)
+	defer cancel(nil)
+	parentCancel()
+	require.Equal(t, CancelCauseParent, getCancelCause(ctx))
+}
+
+func TestTaskCancellerGraceful(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	canceller := newTaskCanceller(cancel, &async.NoopPanicHandler{})
+	require.False(t, canceller.isStopping())
+
+	graceCtx, graceCancel := context.WithCancel(context.Background())
+	canceller.cancel(graceCtx, CancelModeGraceful)
+	require.True(t, canceller.isStopping())
+	require.NoError(t, ctx.Err())
+
+	// The grace period is over before the task finished.
+	graceCancel()
+	<-ctx.Done()
+	require.Equal(t, CancelCauseUser, getCancelCause(ctx))
+}
+
+func TestTaskCancellerFinished(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	canceller := newTaskCanceller(cancel, &async.NoopPanicHandler{})
+
+	graceCtx, graceCancel := context.WithCancel(context.Background())
+	canceller.cancel(graceCtx, CancelModeGraceful)
+	canceller.finish()
+	graceCancel()
+
+	canceller.cancel(context.Background(), CancelModeImmediate)
+	require.NoError(t, ctx.Err())
+}
+
+func TestTaskCancellerImmediate(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	canceller := newTaskCanceller(cancel, &async.NoopPanicHandler{})
+	canceller.cancel(context.Background(), CancelModeImmediate)
+	require.False(t, canceller.isStopping())
+	require.Equal(t, CancelCauseUser, getCancelCause(ctx))
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"fmt"
+
+	"github.com/ProtonMail/go-proton-api"
+)
+
+// PlanTier groups the Proton plans by the API rate limits their accounts can expect.
+type PlanTier int
+
+const (
+	PlanTierFree PlanTier = iota
+	PlanTierPaid
+	PlanTierLarge // Visionary, Family and the other plans with pooled storage.
+)
+
+const (
+	freePlanMaxSpace  = 5 * 1024 * MB
+	largePlanMaxSpace = 1024 * 1024 * MB
+)
+
+// MaxConcurrency is the largest concurrency that can be selected manually.
+const MaxConcurrency = 32
+
+// DetectPlanTier infers the plan of the account from its storage quota, the API client does not expose the
+// subscription of the account.
+func DetectPlanTier(user *proton.User) PlanTier {
+	switch {
+	case user.MaxSpace < freePlanMaxSpace:
+		return PlanTierFree
+	case user.MaxSpace < largePlanMaxSpace:
+		return PlanTierPaid
+	default:
+		return PlanTierLarge
+	}
+}
+
+func (t PlanTier) String() string {
+	switch t {
+	case PlanTierFree:
+		return "free"
+	case PlanTierPaid:
+		return "paid"
+	case PlanTierLarge:
+		return "large"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(t))
+	}
+}
+
+// GetConcurrency returns the number of parallel downloads that stays clear of the rate limits of the tier.
+func (t PlanTier) GetConcurrency() int {
+	switch t {
+	case PlanTierFree:
+		return 4
+	case PlanTierLarge:
+		return 16
+	default:
+		return NumParallelDownloads
+	}
+}
+
+// GetImportConcurrency returns the number of import batches submitted in parallel that stays clear of the rate limits
+// of the tier. Imports are heavier on the API than downloads, fewer of them run in parallel.
+func (t PlanTier) GetImportConcurrency() int {
+	switch t {
+	case PlanTierFree:
+		return 2
+	case PlanTierLarge:
+		return 8
+	default:
+		return NumParallelImports
+	}
+}
+
+func validateConcurrency(concurrency int) error {
+	if concurrency < 0 || concurrency > MaxConcurrency {
+		return fmt.Errorf("invalid concurrency %v, expected a value between 1 and %v, or 0 to select it automatically", concurrency, MaxConcurrency)
+	}
+
+	return nil
+}
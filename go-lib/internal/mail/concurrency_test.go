@@ -0,0 +1,57 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"testing"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectPlanTier(t *testing.T) {
+	const gib = 1024 * MB
+
+	require.Equal(t, PlanTierFree, DetectPlanTier(&proton.User{MaxSpace: 1 * gib}))
+	require.Equal(t, PlanTierPaid, DetectPlanTier(&proton.User{MaxSpace: 15 * gib}))
+	require.Equal(t, PlanTierPaid, DetectPlanTier(&proton.User{MaxSpace: 500 * gib}))
+	require.Equal(t, PlanTierLarge, DetectPlanTier(&proton.User{MaxSpace: 3 * 1024 * gib}))
+
+	require.Less(t, PlanTierFree.GetConcurrency(), PlanTierPaid.GetConcurrency())
+	require.Less(t, PlanTierPaid.GetConcurrency(), PlanTierLarge.GetConcurrency())
+}
+
+func TestValidateConcurrency(t *testing.T) {
+	require.NoError(t, validateConcurrency(0))
+	require.NoError(t, validateConcurrency(MaxConcurrency))
+	require.Error(t, validateConcurrency(-1))
+	require.Error(t, validateConcurrency(MaxConcurrency+1))
+}
+
+func TestExportTask_SetBuildConcurrency(t *testing.T) {
+	e := &ExportTask{}
+	require.Equal(t, NumParallelBuilders, e.GetBuildConcurrency())
+
+	require.NoError(t, e.SetBuildConcurrency(1))
+	require.Equal(t, 1, e.GetBuildConcurrency())
+	require.Error(t, e.SetBuildConcurrency(MaxConcurrency+1))
+	require.Equal(t, 1, e.GetBuildConcurrency())
+
+	require.NoError(t, e.SetBuildConcurrency(0))
+	require.Equal(t, NumParallelBuilders, e.GetBuildConcurrency())
+}
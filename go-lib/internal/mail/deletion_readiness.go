@@ -0,0 +1,243 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+)
+
+// DeletionReadinessReportVersion is the version of the document of the signed readiness report.
+const DeletionReadinessReportVersion = 1
+
+// ReadinessStatus is the outcome of a check of a DeletionReadinessReport.
+type ReadinessStatus string
+
+const (
+	ReadinessPassed ReadinessStatus = "passed"
+	ReadinessFailed ReadinessStatus = "failed"
+	// ReadinessManual is a check the tool cannot perform, the user has to confirm it.
+	ReadinessManual ReadinessStatus = "manual"
+)
+
+// ReadinessCheck is an item of the checklist of a DeletionReadinessReport.
+type ReadinessCheck struct {
+	Name   string
+	Status ReadinessStatus
+	Detail string `json:",omitempty"`
+}
+
+// DeletionReadinessReport tells whether an export holds everything a user needs before deleting their Proton account.
+// The tool only exports the mail, the contacts and calendars are checked when their folders were added to the export,
+// the settings and keys are listed as manual checks.
+type DeletionReadinessReport struct {
+	Time                 time.Time
+	AccountID            string
+	AccountEmail         string
+	ExportDir            string
+	AccountMessageCount  uint64
+	ExportedMessageCount uint64
+	Checks               []ReadinessCheck
+	Ready                bool // All the checks the tool can perform passed, the manual ones remain to be confirmed.
+}
+
+func (r *DeletionReadinessReport) GetFailedCount() int {
+	var count int
+
+	for _, check := range r.Checks {
+		if check.Status == ReadinessFailed {
+			count++
+		}
+	}
+
+	return count
+}
+
+func getDeletionReadinessFileName() string {
+	return "deletion_readiness.json"
+}
+
+// GetDeletionReadinessPath returns the path of the readiness report of an export directory.
+func GetDeletionReadinessPath(exportDir string) string {
+	return filepath.Join(exportDir, getDeletionReadinessFileName())
+}
+
+// manualReadinessChecks are the data of an account that the tool does not export.
+//
+//nolint:gochecknoglobals
+var manualReadinessChecks = []ReadinessCheck{
+	{Name: "settings", Status: ReadinessManual, Detail: "note the filters, forwarding rules and custom domains of the account settings"},
+	{Name: "keys", Status: ReadinessManual, Detail: "export the private keys from the Encryption and keys settings to read encrypted messages later"},
+}
+
+// CheckDeletionReadiness looks for every message of the account in the export in exportDir, then inspects it, see
+// DiagnoseExport, and verifies it against its checksum manifest, see VerifyExport. The export directory is not
+// modified.
+func CheckDeletionReadiness(ctx context.Context, client apiclient.Client, user *proton.User, exportDir string) (DeletionReadinessReport, error) {
+	log := logrus.WithField("readiness", "mail").WithField("path", exportDir)
+	log.Info("Checking deletion readiness")
+
+	report := DeletionReadinessReport{
+		Time:         time.Now().UTC(),
+		AccountID:    user.ID,
+		AccountEmail: user.Email,
+		ExportDir:    exportDir,
+	}
+
+	doctorReport, err := DiagnoseExport(ctx, exportDir, false)
+	if err != nil {
+		return report, err
+	}
+
+	report.ExportedMessageCount = uint64(doctorReport.MessageCount)
+
+	// The export may hold messages deleted from the account since, the counts cannot be compared.
+	var missingCount uint64
+
+	if err := walkMetadataPages(ctx, client, MetadataPageSize, proton.MessageFilter{Desc: true}, func(page []proton.MessageMetadata) error {
+		for i := range page {
+			if _, ok := doctorReport.exportedIDs[page[i].ID]; !ok {
+				missingCount++
+			}
+		}
+
+		report.AccountMessageCount += uint64(len(page))
+
+		return nil
+	}); err != nil {
+		return report, fmt.Errorf("failed to list the messages of the account: %w", err)
+	}
+
+	integrityCheck, err := checkExportIntegrity(ctx, exportDir, &doctorReport)
+	if err != nil {
+		return report, err
+	}
+
+	report.Checks = append(report.Checks,
+		checkMailCompleteness(report.AccountMessageCount, missingCount),
+		checkLabelsExported(exportDir),
+		integrityCheck,
+		checkBackupFolder(exportDir, "contacts", contactsBackupDir, vCardExtension,
+			"export the contacts as vCard from the Contacts app into the 'contacts' folder of the export"),
+		checkBackupFolder(exportDir, "calendar", calendarBackupDir, iCalendarExtension,
+			"export each calendar as ICS from the Calendar settings into the 'calendar' folder of the export"),
+	)
+	report.Checks = append(report.Checks, manualReadinessChecks...)
+
+	report.Ready = report.GetFailedCount() == 0
+
+	log.WithFields(logrus.Fields{
+		"ready":    report.Ready,
+		"failed":   report.GetFailedCount(),
+		"exported": report.ExportedMessageCount,
+		"total":    report.AccountMessageCount,
+	}).Info("Deletion readiness checked")
+
+	return report, nil
+}
+
+func checkMailCompleteness(accountCount, missingCount uint64) ReadinessCheck {
+	check := ReadinessCheck{Name: "mail"}
+
+	if missingCount == 0 {
+		check.Status = ReadinessPassed
+		check.Detail = fmt.Sprintf("the %v messages of the account are exported", accountCount)
+	} else {
+		check.Status = ReadinessFailed
+		check.Detail = fmt.Sprintf("%v of the %v messages of the account are missing, run an incremental backup", missingCount, accountCount)
+	}
+
+	return check
+}
+
+func checkLabelsExported(exportDir string) ReadinessCheck {
+	check := ReadinessCheck{Name: "labels", Status: ReadinessPassed}
+
+	if _, err := os.Stat(filepath.Join(exportDir, getLabelFileName())); err != nil {
+		check.Status = ReadinessFailed
+
+		if errors.Is(err, os.ErrNotExist) {
+			check.Detail = "the folders and labels were not exported"
+		} else {
+			check.Detail = err.Error()
+		}
+	}
+
+	return check
+}
+
+// checkExportIntegrity fails if the doctor found problems or if the files do not match the checksum manifest.
+func checkExportIntegrity(ctx context.Context, exportDir string, doctorReport *DoctorReport) (ReadinessCheck, error) {
+	check := ReadinessCheck{Name: "integrity", Status: ReadinessPassed}
+
+	if count := len(doctorReport.Issues); count != 0 {
+		check.Status = ReadinessFailed
+		check.Detail = fmt.Sprintf("%v problems found, run the doctor operation for details", count)
+
+		return check, nil
+	}
+
+	verifyReport, err := VerifyExport(ctx, exportDir)
+	if errors.Is(err, os.ErrNotExist) {
+		check.Status = ReadinessFailed
+		check.Detail = "the export has no checksum manifest, run an incremental backup to write it"
+
+		return check, nil
+	} else if err != nil {
+		return check, err
+	}
+
+	if count := verifyReport.GetDamagedCount(); count != 0 {
+		check.Status = ReadinessFailed
+		check.Detail = fmt.Sprintf("%v of the %v files are corrupted or missing, run the verify operation for details", count, verifyReport.FileCount)
+	}
+
+	return check, nil
+}
+
+// checkBackupFolder passes if the folder dir of the export holds files with the extension, which the restore of the
+// backup then imports, see Restorer. The check is left to the user otherwise.
+func checkBackupFolder(exportDir, name, dir, extension, instructions string) ReadinessCheck {
+	entries, err := os.ReadDir(filepath.Join(exportDir, dir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return ReadinessCheck{Name: name, Status: ReadinessFailed, Detail: err.Error()}
+	}
+
+	var count int
+
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), extension) {
+			count++
+		}
+	}
+
+	if count == 0 {
+		return ReadinessCheck{Name: name, Status: ReadinessManual, Detail: instructions}
+	}
+
+	return ReadinessCheck{Name: name, Status: ReadinessPassed, Detail: fmt.Sprintf("%v files in the '%v' folder of the export", count, dir)}
+}
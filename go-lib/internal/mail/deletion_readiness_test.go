@@ -0,0 +1,175 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/bradenaw/juniper/xslices"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+// writeReadinessTestExport writes an export of the messages with the given IDs and its checksum manifest.
+func writeReadinessTestExport(t *testing.T, ids ...string) string {
+	dir := t.TempDir()
+
+	for _, id := range ids {
+		writeTestMetadata(t, MessageMetadata{}, filepath.Join(dir, getMetadataFileName(id)))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, getEMLFileName(id)), []byte("eml"), 0o600))
+	}
+
+	labels, err := utils.GenerateVersionedJSON(LabelMetadataVersion, []string{})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getLabelFileName()), labels, 0o600))
+
+	require.NoError(t, writeChecksumManifest(context.Background(), t.TempDir(), dir, logrus.WithField("test", "readiness")))
+
+	return dir
+}
+
+// expectAccountMessages makes the client list the messages with the given IDs as the mailbox of the account.
+func expectAccountMessages(client *apiclient.MockClient, ids ...string) {
+	client.EXPECT().GetMessageMetadataPage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _, _ int, filter proton.MessageFilter) ([]proton.MessageMetadata, error) {
+			if len(filter.EndID) != 0 {
+				return nil, nil
+			}
+
+			return xslices.Map(ids, func(id string) proton.MessageMetadata { return proton.MessageMetadata{ID: id} }), nil
+		},
+	).Times(2)
+}
+
+func getReadinessStatuses(report *DeletionReadinessReport) map[string]ReadinessStatus {
+	statuses := make(map[string]ReadinessStatus)
+	for _, check := range report.Checks {
+		statuses[check.Name] = check.Status
+	}
+
+	return statuses
+}
+
+func TestCheckDeletionReadiness(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+	user := &proton.User{ID: "user", Email: "user@proton.me"}
+
+	expectAccountMessages(client, "a", "b")
+
+	report, err := CheckDeletionReadiness(context.Background(), client, user, writeReadinessTestExport(t, "a", "b"))
+	require.NoError(t, err)
+	require.True(t, report.Ready)
+	require.Equal(t, uint64(2), report.AccountMessageCount)
+	require.Equal(t, uint64(2), report.ExportedMessageCount)
+	require.Equal(t, map[string]ReadinessStatus{
+		"mail":      ReadinessPassed,
+		"labels":    ReadinessPassed,
+		"integrity": ReadinessPassed,
+		"contacts":  ReadinessManual,
+		"calendar":  ReadinessManual,
+		"settings":  ReadinessManual,
+		"keys":      ReadinessManual,
+	}, getReadinessStatuses(&report))
+
+	// A message is missing and another one has no content.
+	dir := writeReadinessTestExport(t, "a")
+	writeTestMetadata(t, MessageMetadata{}, filepath.Join(dir, getMetadataFileName("b")))
+
+	expectAccountMessages(client, "a", "b")
+
+	report, err = CheckDeletionReadiness(context.Background(), client, user, dir)
+	require.NoError(t, err)
+	require.False(t, report.Ready)
+	require.Equal(t, 2, report.GetFailedCount())
+	require.Equal(t, ReadinessFailed, getReadinessStatuses(&report)["mail"])
+	require.Equal(t, ReadinessFailed, getReadinessStatuses(&report)["integrity"])
+	require.FileExists(t, filepath.Join(dir, getMetadataFileName("b")))
+}
+
+func TestCheckDeletionReadiness_DeletedMessagesDoNotCount(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+	user := &proton.User{ID: "user", Email: "user@proton.me"}
+
+	// The export holds as many messages as the account, but one of them was deleted from the account since and a newer
+	// one is missing.
+	expectAccountMessages(client, "a", "c")
+
+	report, err := CheckDeletionReadiness(context.Background(), client, user, writeReadinessTestExport(t, "a", "b"))
+	require.NoError(t, err)
+	require.False(t, report.Ready)
+	require.Equal(t, ReadinessFailed, getReadinessStatuses(&report)["mail"])
+	require.Equal(t, "1 of the 2 messages of the account are missing, run an incremental backup", report.Checks[0].Detail)
+}
+
+func TestCheckDeletionReadiness_Checksums(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+	user := &proton.User{ID: "user", Email: "user@proton.me"}
+
+	// A file was damaged after the export.
+	dir := writeReadinessTestExport(t, "a")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getEMLFileName("a")), []byte("EML"), 0o600))
+
+	expectAccountMessages(client, "a")
+
+	report, err := CheckDeletionReadiness(context.Background(), client, user, dir)
+	require.NoError(t, err)
+	require.False(t, report.Ready)
+	require.Equal(t, ReadinessPassed, getReadinessStatuses(&report)["mail"])
+	require.Equal(t, ReadinessFailed, getReadinessStatuses(&report)["integrity"])
+
+	// An export without checksum manifest cannot be verified.
+	dir = writeReadinessTestExport(t, "a")
+	require.NoError(t, os.Remove(filepath.Join(dir, getChecksumManifestFileName())))
+
+	expectAccountMessages(client, "a")
+
+	report, err = CheckDeletionReadiness(context.Background(), client, user, dir)
+	require.NoError(t, err)
+	require.False(t, report.Ready)
+	require.Equal(t, ReadinessFailed, getReadinessStatuses(&report)["integrity"])
+}
+
+func TestCheckDeletionReadiness_ContactsAndCalendar(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+	user := &proton.User{ID: "user", Email: "user@proton.me"}
+
+	dir := writeReadinessTestExport(t, "a")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, contactsBackupDir), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, contactsBackupDir, "all.vcf"), []byte("BEGIN:VCARD"), 0o600))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, calendarBackupDir), 0o700))
+
+	expectAccountMessages(client, "a")
+
+	// The folders added after the export are not in the checksum manifest, they are not damage.
+	report, err := CheckDeletionReadiness(context.Background(), client, user, dir)
+	require.NoError(t, err)
+	require.True(t, report.Ready)
+	require.Equal(t, ReadinessPassed, getReadinessStatuses(&report)["contacts"])
+	require.Equal(t, ReadinessManual, getReadinessStatuses(&report)["calendar"])
+}
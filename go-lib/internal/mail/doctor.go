@@ -0,0 +1,657 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Doctor
+// ------
+// DiagnoseExport inspects an export directory for the problems left behind by interrupted runs or by copies between
+// file systems. The problems that can be fixed without losing exported data are fixed when requested, the others are
+// only reported. No export, restore or other operation may run on the directory at the same time.
+
+// DoctorIssueType tells what is wrong with an export directory.
+type DoctorIssueType int
+
+const (
+	DoctorIssueTempFiles         DoctorIssueType = iota // Files left by an interrupted run. Fixed by removing them.
+	DoctorIssueUnindexedPack                            // A pack has no valid index. Fixed by rebuilding the index.
+	DoctorIssueIncompleteMessage                        // A metadata file without its message. Fixed by removing it.
+	DoctorIssueOrphanContent                            // An EML file without metadata file.
+	DoctorIssueJournalMismatch                          // The incremental state does not match the exported messages.
+	DoctorIssueManifestMismatch                         // The shard manifest does not match the exported messages. Fixed by rewriting it.
+	DoctorIssueInterruptedExport                        // The export was interrupted and can be resumed.
+	DoctorIssueVersionMismatch                          // A file was written with another version of its format.
+	DoctorIssueUnreadableFile                           // A JSON file of the export cannot be parsed.
+	DoctorIssueCaseCollision                            // File names differing only by case, which collide on case-insensitive file systems.
+)
+
+func (d DoctorIssueType) String() string {
+	switch d {
+	case DoctorIssueTempFiles:
+		return "temporary files"
+	case DoctorIssueUnindexedPack:
+		return "unindexed pack"
+	case DoctorIssueIncompleteMessage:
+		return "incomplete message"
+	case DoctorIssueOrphanContent:
+		return "orphan content"
+	case DoctorIssueJournalMismatch:
+		return "journal mismatch"
+	case DoctorIssueManifestMismatch:
+		return "manifest mismatch"
+	case DoctorIssueInterruptedExport:
+		return "interrupted export"
+	case DoctorIssueVersionMismatch:
+		return "version mismatch"
+	case DoctorIssueUnreadableFile:
+		return "unreadable file"
+	case DoctorIssueCaseCollision:
+		return "case collision"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(d))
+	}
+}
+
+// DoctorIssue describes a problem found in an export directory.
+type DoctorIssue struct {
+	Type      DoctorIssueType
+	Path      string // Relative to the export directory, with forward slashes.
+	MessageID string `json:",omitempty"`
+	Detail    string `json:",omitempty"`
+	Fixed     bool
+}
+
+// DoctorReport is the outcome of the inspection of an export directory.
+type DoctorReport struct {
+	Issues       []DoctorIssue
+	MessageCount int // Messages found in the export directory, the incomplete ones excluded.
+	Duration     time.Duration
+
+	exportedIDs map[string]struct{} // The IDs of the messages counted in MessageCount.
+}
+
+// GetUnfixedCount returns the number of issues that remain in the export directory.
+func (d *DoctorReport) GetUnfixedCount() int {
+	var count int
+
+	for i := range d.Issues {
+		if !d.Issues[i].Fixed {
+			count++
+		}
+	}
+
+	return count
+}
+
+type exportDoctor struct {
+	exportDir string
+	tmpDir    string
+	fix       bool
+	report    DoctorReport
+	log       *logrus.Entry
+}
+
+// DiagnoseExport inspects exportDir and fixes the issues that can be fixed safely if fix is set.
+func DiagnoseExport(ctx context.Context, exportDir string, fix bool) (DoctorReport, error) {
+	startTime := time.Now()
+
+	if info, err := os.Stat(exportDir); err != nil {
+		return DoctorReport{}, fmt.Errorf("failed to access export directory: %w", err)
+	} else if !info.IsDir() {
+		return DoctorReport{}, fmt.Errorf("'%v' is not a directory", exportDir)
+	}
+
+	d := &exportDoctor{
+		exportDir: exportDir,
+		tmpDir:    filepath.Join(exportDir, "temp"),
+		fix:       fix,
+		log:       logrus.WithField("doctor", "mail").WithField("path", exportDir),
+	}
+
+	d.log.WithField("fix", fix).Info("Inspecting export directory")
+
+	// The temporary files are checked first, the fixes then use the temp directory.
+	if err := d.checkTempFiles(); err != nil {
+		return d.report, err
+	}
+
+	if fix {
+		if err := os.MkdirAll(d.tmpDir, 0o700); err != nil {
+			return d.report, fmt.Errorf("failed to create doctor tmp directory: %w", err)
+		}
+
+		defer func() {
+			if err := os.RemoveAll(d.tmpDir); err != nil {
+				d.log.WithError(err).Error("Failed to remove temp directory")
+			}
+		}()
+	}
+
+	for _, check := range []func(ctx context.Context) error{
+		d.checkPacks,
+		d.checkMessages,
+		d.checkVersions,
+		d.checkCaseCollisions,
+	} {
+		if err := ctx.Err(); err != nil {
+			return d.report, err
+		}
+
+		if err := check(ctx); err != nil {
+			return d.report, err
+		}
+	}
+
+	d.report.Duration = time.Since(startTime)
+
+	d.log.WithField("issues", len(d.report.Issues)).WithField("unfixed", d.report.GetUnfixedCount()).Info("Inspection finished")
+
+	return d.report, nil
+}
+
+func (d *exportDoctor) addIssue(issue DoctorIssue) {
+	d.report.Issues = append(d.report.Issues, issue)
+}
+
+func (d *exportDoctor) checkTempFiles() error {
+	entries, err := os.ReadDir(d.tmpDir)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && len(entries) == 0) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to list temp directory: %w", err)
+	}
+
+	issue := DoctorIssue{Type: DoctorIssueTempFiles, Path: "temp", Detail: fmt.Sprintf("%v files", len(entries))}
+
+	if d.fix {
+		if err := os.RemoveAll(d.tmpDir); err != nil {
+			return fmt.Errorf("failed to remove temp directory: %w", err)
+		}
+
+		issue.Fixed = true
+	}
+
+	d.addIssue(issue)
+
+	return nil
+}
+
+// checkPacks rebuilds the missing indexes of the packs, see loadPackIndex.
+func (d *exportDoctor) checkPacks(_ context.Context) error {
+	fsys := os.DirFS(d.exportDir)
+
+	for _, dir := range d.getMessageDirs() {
+		packDir := path.Join(dir, getPackDirName())
+
+		entries, err := fs.ReadDir(fsys, packDir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to list packs: %w", err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), packExtension) {
+				continue
+			}
+
+			packPath := path.Join(packDir, entry.Name())
+			if _, err := readPackIndexFile(fsys, packPath); err == nil {
+				continue
+			}
+
+			issue := DoctorIssue{Type: DoctorIssueUnindexedPack, Path: packPath}
+
+			if d.fix {
+				index, err := loadPackIndex(fsys, packPath)
+				if err != nil {
+					issue.Detail = err.Error()
+					d.addIssue(issue)
+
+					continue
+				}
+
+				pack := openPack{path: filepath.Join(d.exportDir, filepath.FromSlash(packPath)), index: index}
+				if err := pack.writeIndex(d.tmpDir); err != nil {
+					return err
+				}
+
+				issue.Detail = fmt.Sprintf("index rebuilt with %v files", len(index.Entries))
+				issue.Fixed = true
+			}
+
+			d.addIssue(issue)
+		}
+	}
+
+	return nil
+}
+
+// getMessageDirs returns the folders of the export holding messages, relative to the export directory.
+func (d *exportDoctor) getMessageDirs() []string {
+	dirs := []string{"."}
+
+	if info, err := os.Stat(filepath.Join(d.exportDir, getAutoGeneratedDirName())); err == nil && info.IsDir() {
+		dirs = append(dirs, getAutoGeneratedDirName())
+	}
+
+	return dirs
+}
+
+// checkMessages looks for the messages whose files are incomplete and compares the exported messages with the
+// incremental state, the checkpoint and the shard manifest.
+func (d *exportDoctor) checkMessages(_ context.Context) error {
+	fsys := newPackFS(os.DirFS(d.exportDir))
+
+	// The content of the messages written to mbox files or Maildir folders cannot be matched with their metadata.
+	checkContent := true
+
+	for _, dir := range []string{getMBoxDirName(), getMaildirDirName()} {
+		if _, err := os.Stat(filepath.Join(d.exportDir, dir)); err == nil {
+			checkContent = false
+		}
+	}
+
+	exported := make(map[string]struct{})
+	rootExported := make(map[string]struct{})
+	incomplete := make(map[string]struct{})
+
+	for _, dir := range d.getMessageDirs() {
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			return fmt.Errorf("failed to list '%v': %w", dir, err)
+		}
+
+		names := make(map[string]fs.DirEntry, len(entries))
+		for _, entry := range entries {
+			names[entry.Name()] = entry
+		}
+
+		for _, entry := range entries {
+			if id, ok := strings.CutSuffix(entry.Name(), emlExtension); ok && checkContent && !entry.IsDir() {
+				if _, ok := names[getMetadataFileName(id)]; !ok {
+					d.addIssue(DoctorIssue{Type: DoctorIssueOrphanContent, Path: path.Join(dir, entry.Name()), MessageID: id})
+				}
+
+				continue
+			}
+
+			id, ok := strings.CutSuffix(entry.Name(), jsonMetadataExtension)
+			if !ok || entry.IsDir() {
+				continue
+			}
+
+			_, hasEML := names[getEMLFileName(id)]
+			folder, hasFolder := names[id]
+
+			if checkContent && !hasEML && (!hasFolder || !folder.IsDir()) {
+				incomplete[id] = struct{}{}
+
+				if err := d.fixIncompleteMessage(path.Join(dir, entry.Name()), id); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			exported[id] = struct{}{}
+			if dir == "." {
+				rootExported[id] = struct{}{}
+			}
+		}
+	}
+
+	d.report.MessageCount = len(exported)
+	d.report.exportedIDs = exported
+
+	if err := d.checkIncrementalState(exported, incomplete); err != nil {
+		return err
+	}
+
+	if checkpoint, err := LoadExportCheckpoint(d.exportDir); err == nil {
+		processed := checkpoint.CursorCount + uint64(len(checkpoint.ProcessedIDs))
+
+		d.addIssue(DoctorIssue{
+			Type:   DoctorIssueInterruptedExport,
+			Path:   getCheckpointFileName(),
+			Detail: fmt.Sprintf("interrupted after %v messages on %v, resume the export to complete it", processed, checkpoint.UpdateTime.Format(time.RFC3339)),
+		})
+	}
+
+	return d.checkShardManifest(rootExported)
+}
+
+// fixIncompleteMessage removes the metadata file of a message whose content was not written, so that the next export
+// downloads the message again.
+func (d *exportDoctor) fixIncompleteMessage(metadataPath, id string) error {
+	issue := DoctorIssue{Type: DoctorIssueIncompleteMessage, Path: metadataPath, MessageID: id}
+
+	if d.fix {
+		if err := os.Remove(filepath.Join(d.exportDir, filepath.FromSlash(metadataPath))); err != nil {
+			return fmt.Errorf("failed to remove '%v': %w", metadataPath, err)
+		}
+
+		issue.Fixed = true
+	}
+
+	d.addIssue(issue)
+
+	return nil
+}
+
+// checkIncrementalState removes the incomplete messages from the incremental state, so that the next incremental
+// export downloads them again. The exported messages missing from the state are only reported, the next incremental
+// export downloads them again anyway. The messages of the state missing from the export are not reported: the
+// auto-generated messages excluded from the export are recorded in the state as well.
+func (d *exportDoctor) checkIncrementalState(exported, incomplete map[string]struct{}) error {
+	state, err := LoadIncrementalState(d.exportDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		d.addIssue(DoctorIssue{Type: DoctorIssueUnreadableFile, Path: getIncrementalStateFileName(), Detail: err.Error()})
+		return nil
+	}
+
+	var stale []string
+
+	for id := range incomplete {
+		if _, ok := state.Messages[id]; ok {
+			stale = append(stale, id)
+		}
+	}
+
+	if len(stale) != 0 {
+		sort.Strings(stale)
+
+		issue := DoctorIssue{
+			Type:   DoctorIssueJournalMismatch,
+			Path:   getIncrementalStateFileName(),
+			Detail: fmt.Sprintf("%v incomplete messages recorded as exported", len(stale)),
+		}
+
+		if d.fix {
+			for _, id := range stale {
+				delete(state.Messages, id)
+			}
+
+			if err := writeIncrementalState(d.tmpDir, d.exportDir, &state); err != nil {
+				return err
+			}
+
+			issue.Fixed = true
+		}
+
+		d.addIssue(issue)
+	}
+
+	var missing int
+
+	for id := range exported {
+		if _, ok := state.Messages[id]; !ok {
+			missing++
+		}
+	}
+
+	if missing != 0 {
+		d.addIssue(DoctorIssue{
+			Type:   DoctorIssueJournalMismatch,
+			Path:   getIncrementalStateFileName(),
+			Detail: fmt.Sprintf("%v exported messages are not recorded, the next incremental export downloads them again", missing),
+		})
+	}
+
+	return nil
+}
+
+// checkShardManifest compares the manifest of a shard with the messages of the export folder. The manifest is written
+// again from the exported messages, the shard is no longer complete if messages of the manifest are missing.
+func (d *exportDoctor) checkShardManifest(exported map[string]struct{}) error {
+	manifest, err := LoadShardManifest(d.exportDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		d.addIssue(DoctorIssue{Type: DoctorIssueUnreadableFile, Path: getShardManifestFileName(), Detail: err.Error()})
+		return nil
+	}
+
+	var missing, unlisted int
+
+	listed := make(map[string]struct{}, len(manifest.MessageIDs))
+	for _, id := range manifest.MessageIDs {
+		listed[id] = struct{}{}
+
+		if _, ok := exported[id]; !ok {
+			missing++
+		}
+	}
+
+	for id := range exported {
+		if _, ok := listed[id]; !ok {
+			unlisted++
+		}
+	}
+
+	if missing == 0 && unlisted == 0 {
+		return nil
+	}
+
+	issue := DoctorIssue{
+		Type:   DoctorIssueManifestMismatch,
+		Path:   getShardManifestFileName(),
+		Detail: fmt.Sprintf("%v listed messages are missing, %v exported messages are not listed", missing, unlisted),
+	}
+
+	if d.fix {
+		if err := writeShardManifest(d.tmpDir, d.exportDir, &manifest.Job, manifest.Complete && missing == 0); err != nil {
+			return err
+		}
+
+		issue.Fixed = true
+	}
+
+	d.addIssue(issue)
+
+	return nil
+}
+
+// getExpectedVersion returns the version of the format of the JSON file at filePath written by this version of the
+// tool.
+func getExpectedVersion(filePath string) (int, bool) {
+	name := path.Base(filePath)
+
+	switch {
+	case strings.HasSuffix(name, jsonMetadataExtension):
+		return MessageMetadataVersion, true
+	case strings.HasSuffix(name, packIndexExtension) && path.Base(path.Dir(filePath)) == getPackDirName():
+		return PackIndexVersion, true
+	case name == getArchiveIndexPath(getArchiveFileName(OutputFormatZip)),
+		name == getArchiveIndexPath(getArchiveFileName(OutputFormatTarZst)):
+		return ArchiveIndexVersion, true
+	}
+
+	if path.Dir(filePath) != "." {
+		return 0, false
+	}
+
+	versions := map[string]int{
+		getLabelFileName():               LabelMetadataVersion,
+		getCheckpointFileName():          ExportCheckpointVersion,
+		getIncrementalStateFileName():    IncrementalStateVersion,
+		getProgressFileName():            ProgressFileVersion,
+		getSenderVerificationFileName():  SenderVerificationReportVersion,
+		getSnapshotFileName():            SnapshotVersion,
+		getRelocationManifestFileName():  RelocationManifestVersion,
+		getChecksumManifestFileName():    ChecksumManifestVersion,
+		getStarterPackManifestFileName(): StarterPackManifestVersion,
+		getAnnotationManifestFileName():  AnnotationManifestVersion,
+		getShardManifestFileName():       ShardManifestVersion,
+		getMergeManifestFileName():       ShardMergeManifestVersion,
+	}
+
+	version, ok := versions[name]
+
+	return version, ok
+}
+
+// checkVersions reports the files written with another version of their format. The message metadata files are
+// reported once per version.
+func (d *exportDoctor) checkVersions(ctx context.Context) error {
+	type metadataVersion struct {
+		count   int
+		example string
+	}
+
+	metadataVersions := make(map[int]*metadataVersion)
+
+	if err := fs.WalkDir(os.DirFS(d.exportDir), ".", func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if filePath == "temp" {
+				return fs.SkipDir
+			}
+
+			return nil
+		}
+
+		expected, ok := getExpectedVersion(filePath)
+		if !ok {
+			return nil
+		}
+
+		data, err := os.ReadFile(filepath.Join(d.exportDir, filepath.FromSlash(filePath))) //nolint:gosec
+		if err != nil {
+			return fmt.Errorf("failed to read '%v': %w", filePath, err)
+		}
+
+		var version struct {
+			Version int
+		}
+
+		if err := json.Unmarshal(data, &version); err != nil {
+			d.addIssue(DoctorIssue{Type: DoctorIssueUnreadableFile, Path: filePath, Detail: err.Error()})
+			return nil
+		}
+
+		if version.Version == expected {
+			return nil
+		}
+
+		if strings.HasSuffix(filePath, jsonMetadataExtension) {
+			if _, ok := metadataVersions[version.Version]; !ok {
+				metadataVersions[version.Version] = &metadataVersion{example: filePath}
+			}
+
+			metadataVersions[version.Version].count++
+
+			return nil
+		}
+
+		d.addIssue(DoctorIssue{
+			Type:   DoctorIssueVersionMismatch,
+			Path:   filePath,
+			Detail: fmt.Sprintf("version %v, expected %v", version.Version, expected),
+		})
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to inspect export directory: %w", err)
+	}
+
+	versions := make([]int, 0, len(metadataVersions))
+	for version := range metadataVersions {
+		versions = append(versions, version)
+	}
+
+	sort.Ints(versions)
+
+	for _, version := range versions {
+		d.addIssue(DoctorIssue{
+			Type:   DoctorIssueVersionMismatch,
+			Path:   metadataVersions[version].example,
+			Detail: fmt.Sprintf("%v message metadata files with version %v, expected %v", metadataVersions[version].count, version, MessageMetadataVersion),
+		})
+	}
+
+	return nil
+}
+
+// checkCaseCollisions reports the file names of a folder that only differ by case. Renaming them would break the
+// references to the files, they are only reported.
+func (d *exportDoctor) checkCaseCollisions(ctx context.Context) error {
+	return fs.WalkDir(os.DirFS(d.exportDir), ".", func(dirPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to inspect export directory: %w", err)
+		}
+
+		if !entry.IsDir() {
+			return nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		entries, err := os.ReadDir(filepath.Join(d.exportDir, filepath.FromSlash(dirPath)))
+		if err != nil {
+			return fmt.Errorf("failed to list '%v': %w", dirPath, err)
+		}
+
+		byName := make(map[string][]string, len(entries))
+		for _, child := range entries {
+			key := strings.ToLower(child.Name())
+			byName[key] = append(byName[key], child.Name())
+		}
+
+		for _, child := range entries {
+			names := byName[strings.ToLower(child.Name())]
+			if len(names) < 2 || names[0] != child.Name() {
+				continue
+			}
+
+			d.addIssue(DoctorIssue{
+				Type:   DoctorIssueCaseCollision,
+				Path:   path.Join(dirPath, child.Name()),
+				Detail: strings.Join(names, ", "),
+			})
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func writeDoctorTestExport(t *testing.T) string {
+	dir := t.TempDir()
+
+	writeFile := func(name string, data []byte) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o700))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o600))
+	}
+
+	writeFile(filepath.Join("temp", "export-tool-1"), []byte("partial"))
+
+	for _, id := range []string{"a", "b", "d"} {
+		writeTestMetadata(t, MessageMetadata{}, filepath.Join(dir, getMetadataFileName(id)))
+	}
+
+	writeFile(getEMLFileName("a"), []byte("eml a"))
+	writeFile(getEMLFileName("c"), []byte("eml c"))
+	writeFile(filepath.Join("d", "body.txt"), []byte("body d"))
+	writeFile("Notes.txt", nil)
+	writeFile("notes.txt", nil)
+
+	labels, err := utils.GenerateVersionedJSON(LabelMetadataVersion+1, []string{})
+	require.NoError(t, err)
+	writeFile(getLabelFileName(), labels)
+
+	state, err := utils.GenerateVersionedJSON(IncrementalStateVersion, &IncrementalState{
+		UserID:   "user",
+		Messages: map[string]string{"a": "fa", "b": "fb", "p": "fp"},
+	})
+	require.NoError(t, err)
+	writeFile(getIncrementalStateFileName(), state)
+
+	manifest, err := utils.GenerateVersionedJSON(ShardManifestVersion, &ShardManifest{
+		Job:        ShardJob{UserID: "user", Count: 2},
+		Complete:   true,
+		MessageIDs: []string{"a", "b", "d"},
+	})
+	require.NoError(t, err)
+	writeFile(getShardManifestFileName(), manifest)
+
+	writeTestPacks(t, dir, "p")
+
+	packs, err := filepath.Glob(filepath.Join(dir, getPackDirName(), "*"+packExtension))
+	require.NoError(t, err)
+	require.Len(t, packs, 1)
+	require.NoError(t, os.Remove(getPackIndexPath(packs[0])))
+
+	return dir
+}
+
+func getDoctorIssueTypes(report *DoctorReport, fixed bool) []DoctorIssueType {
+	var types []DoctorIssueType
+
+	for _, issue := range report.Issues {
+		if issue.Fixed == fixed {
+			types = append(types, issue.Type)
+		}
+	}
+
+	return types
+}
+
+func TestDiagnoseExport(t *testing.T) {
+	dir := writeDoctorTestExport(t)
+
+	report, err := DiagnoseExport(context.Background(), dir, false)
+	require.NoError(t, err)
+	require.Empty(t, getDoctorIssueTypes(&report, true))
+	require.ElementsMatch(t, []DoctorIssueType{
+		DoctorIssueTempFiles,
+		DoctorIssueUnindexedPack,
+		DoctorIssueIncompleteMessage,
+		DoctorIssueOrphanContent,
+		DoctorIssueJournalMismatch, // b is incomplete.
+		DoctorIssueJournalMismatch, // d is not recorded.
+		DoctorIssueManifestMismatch,
+		DoctorIssueVersionMismatch,
+		DoctorIssueCaseCollision,
+	}, getDoctorIssueTypes(&report, false))
+
+	require.FileExists(t, filepath.Join(dir, "temp", "export-tool-1"))
+	require.FileExists(t, filepath.Join(dir, getMetadataFileName("b")))
+}
+
+func TestDiagnoseExport_Fix(t *testing.T) {
+	dir := writeDoctorTestExport(t)
+
+	report, err := DiagnoseExport(context.Background(), dir, true)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []DoctorIssueType{
+		DoctorIssueTempFiles,
+		DoctorIssueUnindexedPack,
+		DoctorIssueIncompleteMessage,
+		DoctorIssueJournalMismatch,
+		DoctorIssueManifestMismatch,
+	}, getDoctorIssueTypes(&report, true))
+	require.Equal(t, 4, report.GetUnfixedCount())
+
+	require.NoDirExists(t, filepath.Join(dir, "temp"))
+	require.NoFileExists(t, filepath.Join(dir, getMetadataFileName("b")))
+
+	state, err := LoadIncrementalState(dir)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"a": "fa", "p": "fp"}, state.Messages)
+
+	manifest, err := LoadShardManifest(dir)
+	require.NoError(t, err)
+	require.False(t, manifest.Complete)
+	require.Equal(t, []string{"a", "d", "p"}, manifest.MessageIDs)
+
+	// The remaining issues cannot be fixed.
+	report, err = DiagnoseExport(context.Background(), dir, true)
+	require.NoError(t, err)
+	require.Empty(t, getDoctorIssueTypes(&report, true))
+	require.ElementsMatch(t, []DoctorIssueType{
+		DoctorIssueOrphanContent,
+		DoctorIssueJournalMismatch,
+		DoctorIssueVersionMismatch,
+		DoctorIssueCaseCollision,
+	}, getDoctorIssueTypes(&report, false))
+}
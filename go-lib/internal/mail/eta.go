@@ -0,0 +1,83 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"time"
+)
+
+// etaSmoothingFactor is the weight given to the latest sample. Lower values produce a more stable estimate, higher
+// values adapt faster to changes in the API pacing.
+const etaSmoothingFactor = 0.2
+
+// etaEstimator computes the remaining time of an operation from the observed throughput. The per message duration is
+// recalibrated after every sample using an exponential moving average, so slowdowns caused by rate limiting, retries or
+// batches failing and being imported one by one are reflected in the estimate.
+type etaEstimator struct {
+	total        uint64
+	processed    uint64
+	lastSample   time.Time
+	perMessage   float64 // Smoothed duration per message, in seconds.
+	hasEstimate  bool
+	nowFunc      func() time.Time
+	smoothFactor float64
+}
+
+func newETAEstimator(total uint64, nowFunc func() time.Time) *etaEstimator {
+	return &etaEstimator{
+		total:        total,
+		lastSample:   nowFunc(),
+		nowFunc:      nowFunc,
+		smoothFactor: etaSmoothingFactor,
+	}
+}
+
+// update records that count more messages were processed since the previous sample and returns the estimated
+// remaining time. The second return value is false as long as no estimate is available.
+func (e *etaEstimator) update(count int) (time.Duration, bool) {
+	if count <= 0 {
+		return e.remaining()
+	}
+
+	now := e.nowFunc()
+	elapsed := now.Sub(e.lastSample).Seconds()
+	e.lastSample = now
+	e.processed += uint64(count)
+
+	sample := elapsed / float64(count)
+	if e.hasEstimate {
+		e.perMessage = e.smoothFactor*sample + (1-e.smoothFactor)*e.perMessage
+	} else {
+		e.perMessage = sample
+		e.hasEstimate = true
+	}
+
+	return e.remaining()
+}
+
+func (e *etaEstimator) remaining() (time.Duration, bool) {
+	if !e.hasEstimate {
+		return 0, false
+	}
+
+	if e.processed >= e.total {
+		return 0, true
+	}
+
+	return time.Duration(float64(e.total-e.processed) * e.perMessage * float64(time.Second)), true
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestETAEstimator(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	estimator := newETAEstimator(100, func() time.Time { return now })
+
+	_, ok := estimator.update(0)
+	require.False(t, ok)
+
+	// 10 messages in 10 seconds: 90 remaining at 1s per message.
+	now = now.Add(10 * time.Second)
+	eta, ok := estimator.update(10)
+	require.True(t, ok)
+	require.Equal(t, 90*time.Second, eta)
+
+	// A slow batch (e.g. rate limited or retried one by one) increases the estimate without replacing it.
+	now = now.Add(60 * time.Second)
+	eta, ok = estimator.update(10)
+	require.True(t, ok)
+	require.Equal(t, 80*time.Duration(float64(time.Second)*(0.2*6+0.8*1)), eta)
+
+	now = now.Add(time.Second)
+	eta, ok = estimator.update(80)
+	require.True(t, ok)
+	require.Zero(t, eta)
+}
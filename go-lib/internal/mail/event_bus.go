@@ -0,0 +1,153 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bradenaw/juniper/xslices"
+)
+
+// Event is published on the EventBus of a task while it runs. The events are delivered synchronously from the goroutine
+// publishing them, subscribers must return quickly.
+type Event interface {
+	// EventName identifies the type of the event, e.g. in the JSON sent to a webhook.
+	EventName() string
+}
+
+// MessageExportedEvent is published once the files of a message are on the disk.
+type MessageExportedEvent struct {
+	MessageID string
+	Paths     []string
+	Size      uint64 // Size of the message reported by the API.
+}
+
+func (MessageExportedEvent) EventName() string { return "message-exported" }
+
+// AttachmentSkippedEvent is published when an attachment could not be decrypted, it is exported encrypted next to the
+// message instead of in it.
+type AttachmentSkippedEvent struct {
+	MessageID    string
+	AttachmentID string
+	Name         string
+	Reason       string
+}
+
+func (AttachmentSkippedEvent) EventName() string { return "attachment-skipped" }
+
+// RateLimitedEvent is published when the Proton servers rate limit the task, which waits before repeating the request.
+type RateLimitedEvent struct {
+	Wait time.Duration
+}
+
+func (RateLimitedEvent) EventName() string { return "rate-limited" }
+
+// StageChangedEvent is published when the task enters a new stage, and with the final stage once it ended.
+type StageChangedEvent struct {
+	Stage string
+}
+
+func (StageChangedEvent) EventName() string { return "stage-changed" }
+
+// StageEventReporter can optionally be implemented by a Reporter to receive all the events of the task.
+type StageEventReporter interface {
+	OnEvent(event Event)
+}
+
+// EventBus delivers the events of a task to its subscribers. Publish accepts a nil receiver, tasks without a bus
+// publish nothing.
+type EventBus struct {
+	lock        sync.RWMutex
+	subscribers []eventSubscriber
+	nextID      int
+}
+
+type eventSubscriber struct {
+	id      int
+	handler func(Event)
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe calls handler with every event published until the returned function is called.
+func (b *EventBus) Subscribe(handler func(Event)) (unsubscribe func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	b.subscribers = append(b.subscribers, eventSubscriber{id: id, handler: handler})
+
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		b.subscribers = xslices.Filter(b.subscribers, func(s eventSubscriber) bool { return s.id != id })
+	}
+}
+
+// Publish calls the subscribers in the order they subscribed.
+func (b *EventBus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+
+	// The subscribers are never modified in place, a handler can unsubscribe while the event is delivered.
+	b.lock.RLock()
+	subscribers := b.subscribers
+	b.lock.RUnlock()
+
+	for _, subscriber := range subscribers {
+		subscriber.handler(event)
+	}
+}
+
+// subscribeReporter subscribes the optional interfaces of reporter which are fed from the events.
+func (b *EventBus) subscribeReporter(reporter any) (unsubscribe func()) {
+	var unsubscribes []func()
+
+	if eventReporter, ok := reporter.(StageEventReporter); ok {
+		unsubscribes = append(unsubscribes, b.Subscribe(eventReporter.OnEvent))
+	}
+
+	if rateLimitReporter, ok := reporter.(StageRateLimitReporter); ok {
+		unsubscribes = append(unsubscribes, b.Subscribe(func(event Event) {
+			if rateLimited, ok := event.(RateLimitedEvent); ok {
+				rateLimitReporter.OnRateLimited(rateLimited.Wait)
+			}
+		}))
+	}
+
+	return func() {
+		for _, unsubscribe := range unsubscribes {
+			unsubscribe()
+		}
+	}
+}
+
+// subscribeStage forwards the stage changes to setStage.
+func (b *EventBus) subscribeStage(setStage func(stage string)) (unsubscribe func()) {
+	return b.Subscribe(func(event Event) {
+		if stageChanged, ok := event.(StageChangedEvent); ok {
+			setStage(stageChanged.Stage)
+		}
+	})
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBus_SubscribeUnsubscribe(t *testing.T) {
+	bus := NewEventBus()
+
+	var received []string
+
+	unsubscribeFirst := bus.Subscribe(func(event Event) { received = append(received, "first:"+event.EventName()) })
+	bus.Subscribe(func(event Event) { received = append(received, "second:"+event.EventName()) })
+
+	bus.Publish(StageChangedEvent{Stage: string(ExportStageMessages)})
+	unsubscribeFirst()
+	bus.Publish(MessageExportedEvent{MessageID: "id"})
+
+	require.Equal(t, []string{"first:stage-changed", "second:stage-changed", "second:message-exported"}, received)
+}
+
+func TestEventBus_UnsubscribeWhilePublishing(t *testing.T) {
+	bus := NewEventBus()
+
+	var count int
+
+	var unsubscribe func()
+	unsubscribe = bus.Subscribe(func(Event) {
+		count++
+		unsubscribe()
+	})
+
+	bus.Publish(RateLimitedEvent{})
+	bus.Publish(RateLimitedEvent{})
+
+	require.Equal(t, 1, count)
+}
+
+func TestEventBus_NilBusPublishesNothing(t *testing.T) {
+	var bus *EventBus
+
+	require.NotPanics(t, func() { bus.Publish(StageChangedEvent{}) })
+}
+
+type rateLimitEventReporter struct {
+	NullProgressReporter
+	waits  []time.Duration
+	events []Event
+}
+
+func (r *rateLimitEventReporter) OnRateLimited(wait time.Duration) {
+	r.waits = append(r.waits, wait)
+}
+
+func (r *rateLimitEventReporter) OnEvent(event Event) {
+	r.events = append(r.events, event)
+}
+
+func TestEventBus_SubscribeReporter(t *testing.T) {
+	bus := NewEventBus()
+	reporter := &rateLimitEventReporter{}
+
+	unsubscribe := bus.subscribeReporter(reporter)
+
+	bus.Publish(RateLimitedEvent{Wait: time.Minute})
+	bus.Publish(StageChangedEvent{Stage: string(ExportStageLabels)})
+	unsubscribe()
+	bus.Publish(RateLimitedEvent{Wait: time.Hour})
+
+	require.Equal(t, []time.Duration{time.Minute}, reporter.waits)
+	require.Equal(t, []Event{RateLimitedEvent{Wait: time.Minute}, StageChangedEvent{Stage: string(ExportStageLabels)}}, reporter.events)
+}
+
+func TestEventBus_SubscribeStage(t *testing.T) {
+	bus := NewEventBus()
+
+	var stages []string
+
+	bus.subscribeStage(func(stage string) { stages = append(stages, stage) })
+
+	bus.Publish(MessageExportedEvent{})
+	bus.Publish(StageChangedEvent{Stage: string(ExportStageChecksums)})
+
+	require.Equal(t, []string{string(ExportStageChecksums)}, stages)
+}
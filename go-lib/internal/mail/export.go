@@ -29,9 +29,11 @@ import (
 
 	"github.com/ProtonMail/export-tool/internal/apiclient"
 	"github.com/ProtonMail/export-tool/internal/session"
+	"github.com/ProtonMail/export-tool/internal/tracing"
 	"github.com/ProtonMail/export-tool/internal/utils"
 	"github.com/ProtonMail/gluon/async"
 	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/bradenaw/juniper/xslices"
 	"github.com/pbnjay/memory"
 	"github.com/sirupsen/logrus"
@@ -51,18 +53,59 @@ const MaxBuildMemMB = 512 * MB
 // <email>
 //  |- mail_yyyy_mm_dd_hh:mm:ss
 //      |- labels.json
+//      |- sender_verification.json
+//      |- shard_manifest.json (only when exporting a shard)
+//      |- checkpoint.json (only until the export succeeded)
+//      |- path_truncations.json (only when names were shortened to fit the path budget)
+//      |- encryption.json (only when the export is encrypted at rest, the message files then end with .gpg)
+//      |- checksums.json (and checksums.json.asc with a checksum recipient, see SetChecksumRecipient)
+//      |- parity.json and parity.dat (only with parity data, see SetParity)
 //      |- msg-id.eml
 //      |- msg-id.meta.json
+//
+// With mirrors, the same layout is copied to <mirror>/<email>/mail_yyyy_mm_dd_hh:mm:ss once the export finished.
 
 type ExportTask struct {
-	ctx             context.Context
-	ctxCancel       func()
-	group           *async.Group
-	tmpDir          string
-	exportDir       string
-	session         *session.Session
-	log             *logrus.Entry
-	cancelledByUser bool
+	ctx       context.Context
+	ctxCancel context.CancelCauseFunc
+	canceller *taskCanceller
+	group     *async.Group
+	tmpDir    string
+	exportDir string
+	session   *session.Session
+	log       *logrus.Entry
+	shard     *ShardJob
+	filter    *Filter
+	events    *EventBus
+
+	autoGeneratedMode AutoGeneratedMode
+	detectLanguage    bool
+
+	snapshotThresholds SnapshotThresholds
+	snapshotAlert      SnapshotAlertFunc
+
+	concurrency      int
+	buildConcurrency int
+
+	outputFormat OutputFormat
+
+	mirrors        []string
+	mirrorParallel bool
+
+	incremental      bool
+	recordTombstones bool
+
+	resume bool
+
+	pathBudget PathBudget
+	atRestKey  *AtRestKey
+
+	checksumRecipient *crypto.KeyRing
+
+	parityPercent int
+
+	splitByYear bool
+	durable     bool
 }
 
 func NewExportTask(
@@ -75,16 +118,21 @@ func NewExportTask(
 	// Tmp dir needs to be next to export path to as os.rename doesn't work if export path is on a different volume.
 	tmpDir := filepath.Join(exportPath, "temp")
 
-	ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := context.WithCancelCause(ctx)
 
 	return &ExportTask{
 		ctx:       ctx,
 		ctxCancel: cancel,
+		canceller: newTaskCanceller(cancel, session.GetPanicHandler()),
 		group:     async.NewGroup(ctx, session.GetPanicHandler()),
 		tmpDir:    tmpDir,
 		exportDir: exportPath,
 		session:   session,
 		log:       logrus.WithField("export", "mail").WithField("userID", session.GetUser().ID),
+		events:    NewEventBus(),
+
+		snapshotThresholds: DefaultSnapshotThresholds(),
+		pathBudget:         DefaultPathBudget(),
 	}
 }
 
@@ -93,6 +141,7 @@ type Reporter interface {
 }
 
 func (e *ExportTask) Close() {
+	e.canceller.finish()
 	e.group.CancelAndWait()
 
 	if err := os.RemoveAll(e.tmpDir); err != nil {
@@ -102,16 +151,206 @@ func (e *ExportTask) Close() {
 	}
 }
 
-func (e *ExportTask) Cancel() {
-	e.cancelledByUser = true
-	e.ctxCancel()
+// Cancel stops the export. A graceful cancellation stops listing messages and lets the messages already listed be
+// downloaded and written, it is escalated to an immediate cancellation when ctx is done first.
+func (e *ExportTask) Cancel(ctx context.Context, mode CancelMode) {
+	e.log.WithField("mode", mode).Info("Cancellation requested")
+	e.canceller.cancel(ctx, mode)
 }
 
 func (e *ExportTask) GetRequiredDiskSpaceEstimate(_ context.Context) (uint64, error) {
 	return approximateDiskUsage(e.session.GetUser().ProductUsedSpace.Mail), nil
 }
 
-func (e *ExportTask) Run(ctx context.Context, reporter Reporter) error {
+// SetShard restricts the export to a single shard of the mailbox. A shard manifest is written in the export directory
+// when the export finishes.
+func (e *ExportTask) SetShard(shard *ShardJob) {
+	e.shard = shard
+}
+
+// SetFilter restricts the export to the messages matching the filter. The filter is applied to the message metadata,
+// the messages that do not match are not downloaded. Body keywords require the message bodies: only the attachments of
+// the messages that do not match are not downloaded.
+func (e *ExportTask) SetFilter(filter Filter) error {
+	if err := filter.Validate(); err != nil {
+		return err
+	}
+
+	if filter.IsEmpty() {
+		e.filter = nil
+	} else {
+		e.filter = &filter
+	}
+
+	return nil
+}
+
+// GetFilter returns nil if the export is not filtered.
+func (e *ExportTask) GetFilter() *Filter {
+	return e.filter
+}
+
+// SetAutoGeneratedMode controls whether the messages classified as auto-generated, such as newsletters and
+// notifications, are exported with the other messages, skipped or written to a separate sub folder.
+func (e *ExportTask) SetAutoGeneratedMode(mode AutoGeneratedMode) {
+	e.autoGeneratedMode = mode
+}
+
+func (e *ExportTask) GetAutoGeneratedMode() AutoGeneratedMode {
+	return e.autoGeneratedMode
+}
+
+// SetDetectLanguage enables the detection of the primary language of each message, stored in its metadata and in the
+// message index. It costs a pass over the decrypted body of the messages.
+func (e *ExportTask) SetDetectLanguage(detect bool) {
+	e.detectLanguage = detect
+}
+
+// SetSnapshotAlert calls alert when the mailbox changed anomalously since the previous export in the same folder. Only
+// the exports of the whole mailbox, without shard nor filter, write and compare snapshots.
+func (e *ExportTask) SetSnapshotAlert(thresholds SnapshotThresholds, alert SnapshotAlertFunc) {
+	e.snapshotThresholds = thresholds
+	e.snapshotAlert = alert
+}
+
+// SetConcurrency overrides the number of parallel downloads. With 0, the concurrency is selected from the plan of the
+// account, see DetectPlanTier.
+func (e *ExportTask) SetConcurrency(concurrency int) error {
+	if err := validateConcurrency(concurrency); err != nil {
+		return err
+	}
+
+	e.concurrency = concurrency
+
+	return nil
+}
+
+// GetConcurrency returns the number of parallel downloads the export runs with.
+func (e *ExportTask) GetConcurrency() int {
+	if e.concurrency != 0 {
+		return e.concurrency
+	}
+
+	return DetectPlanTier(e.session.GetUser()).GetConcurrency()
+}
+
+// SetBuildConcurrency overrides the number of messages decrypted and assembled in parallel. With 0, NumParallelBuilders
+// messages are. Lowering it reduces the CPU usage of the export, the memory used by the builders is bounded regardless.
+func (e *ExportTask) SetBuildConcurrency(concurrency int) error {
+	if err := validateConcurrency(concurrency); err != nil {
+		return err
+	}
+
+	e.buildConcurrency = concurrency
+
+	return nil
+}
+
+// GetBuildConcurrency returns the number of messages decrypted and assembled in parallel.
+func (e *ExportTask) GetBuildConcurrency() int {
+	if e.buildConcurrency != 0 {
+		return e.buildConcurrency
+	}
+
+	return NumParallelBuilders
+}
+
+// SetOutputFormat selects whether the messages are written as EML files, appended to mbox files or written to Maildir
+// folders.
+func (e *ExportTask) SetOutputFormat(format OutputFormat) {
+	e.outputFormat = format
+}
+
+func (e *ExportTask) GetOutputFormat() OutputFormat {
+	return e.outputFormat
+}
+
+// Events returns the bus on which the export publishes its events, see Event. The subscribers receive the events of
+// the next runs.
+func (e *ExportTask) Events() *EventBus {
+	return e.events
+}
+
+// GetShard returns nil if the whole mailbox is exported.
+func (e *ExportTask) GetShard() *ShardJob {
+	return e.shard
+}
+
+// PredictFilter returns the number and size of the messages that would be exported with the given filter.
+func (e *ExportTask) PredictFilter(ctx context.Context, filter Filter) (FilterPrediction, error) {
+	return PredictFilter(ctx, e.session.GetClient(), filter, MetadataPageSize)
+}
+
+// Run performs the export and returns its final report. The report is also filled when an error is returned.
+func (e *ExportTask) Run(ctx context.Context, reporter Reporter) (ExportResult, error) {
+	defer e.canceller.finish()
+
+	unsubscribe := e.events.subscribeReporter(reporter)
+	defer unsubscribe()
+
+	ctx = apiclient.WithRateLimitObserver(ctx, func(wait time.Duration) { e.events.Publish(RateLimitedEvent{Wait: wait}) })
+
+	startTime := time.Now()
+	timer := newStageTimer()
+
+	ctx, span := traceTask(ctx, "export", timer)
+
+	var result ExportResult
+
+	progress := newProgressFileReporter(reporter, e.tmpDir, e.exportDir, e.log)
+	progress.bus = e.events
+	progress.heartbeat = startHeartbeat(reporter, HeartbeatInterval, string(ExportStagePreparing), e.session.GetPanicHandler())
+	defer progress.heartbeat.stop()
+
+	progress.events = startProgressEvents(reporter, ProgressEventInterval, string(ExportStagePreparing), e.session.GetPanicHandler())
+	defer progress.events.stop()
+
+	unsubscribeHeartbeat := e.events.subscribeStage(progress.heartbeat.setStage)
+	defer unsubscribeHeartbeat()
+
+	unsubscribeProgressEvents := e.events.subscribeStage(progress.events.setStage)
+	defer unsubscribeProgressEvents()
+
+	err := e.run(ctx, progress, timer, &result)
+	if err == nil {
+		progress.setStage(ExportStageChecksums)
+		timer.measure("checksums", func() { err = writeChecksumManifest(ctx, e.tmpDir, e.exportDir, e.log) })
+	}
+
+	if err == nil {
+		err = writeEncryptedChecksumManifest(e.tmpDir, e.exportDir, e.checksumRecipient)
+	}
+
+	if err == nil && e.parityPercent != 0 {
+		progress.setStage(ExportStageParity)
+		timer.measure("parity", func() { err = writeParity(ctx, e.tmpDir, e.exportDir, e.parityPercent, e.log) })
+	} else if err == nil {
+		err = removeParity(e.exportDir)
+	}
+
+	if err == nil && len(e.mirrors) != 0 {
+		progress.setStage(ExportStageMirroring)
+		timer.measure("mirror", func() { result.Mirrors, err = e.writeMirrors(ctx) })
+	}
+
+	if err != nil && len(result.Failures) == 0 {
+		result.Failures = append(result.Failures, Failure{Reason: err.Error()})
+	}
+
+	result.Duration = time.Since(startTime)
+	result.StageDurations = timer.get()
+	result.CancelCause = e.GetCancelCause()
+	result.setStatus(err)
+
+	progress.finish(err, result.CancelCause)
+
+	recordExportResult(ctx, &result)
+	tracing.End(span, err)
+
+	return result, err
+}
+
+func (e *ExportTask) run(ctx context.Context, reporter *progressFileReporter, timer *stageTimer, result *ExportResult) error {
 	defer e.log.Info("Finished")
 	e.log.WithFields(logrus.Fields{"tmp-dir": e.tmpDir, "export-dir": e.exportDir}).Info("Starting")
 
@@ -125,6 +364,30 @@ func (e *ExportTask) Run(ctx context.Context, reporter Reporter) error {
 		return fmt.Errorf("failed to create export tmp directory: %w", err)
 	}
 
+	names, err := newPathNamer(e.pathBudget, e.exportDir)
+	if err != nil {
+		return err
+	}
+
+	names.setSplitByYear(e.splitByYear)
+
+	if err := names.validate(); err != nil {
+		return err
+	}
+
+	if err := e.checkArchiveOptions(); err != nil {
+		return err
+	}
+
+	if e.splitByYear && e.shard != nil {
+		return ErrSplitByYearNotSupported
+	}
+
+	if err := e.prepareAtRestEncryption(); err != nil {
+		return err
+	}
+
+	reporter.setStage(ExportStagePreparing)
 	reporter.OnProgress(0)
 
 	client := e.session.GetClient()
@@ -137,9 +400,7 @@ func (e *ExportTask) Run(ctx context.Context, reporter Reporter) error {
 		toMB(approximateDiskUsage(user.ProductUsedSpace.Mail)),
 	)
 
-	salts := e.session.GetUserSalts()
-
-	saltedKeyPass, err := salts.SaltForKey(e.session.GetMailboxPassword(), user.Keys.Primary().ID)
+	saltedKeyPass, err := e.session.GetSaltedKeyPass()
 	if err != nil {
 		return fmt.Errorf("failed to salt key password: %w", err)
 	}
@@ -166,8 +427,12 @@ func (e *ExportTask) Run(ctx context.Context, reporter Reporter) error {
 	defer keyRing.Close()
 
 	// Create required folders
-	if err := e.WriteLabelMetadata(ctx, e.tmpDir, e.exportDir); err != nil {
-		return err
+	reporter.setStage(ExportStageLabels)
+
+	var labelErr error
+	timer.measure("labels", func() { labelErr = e.WriteLabelMetadata(ctx, e.tmpDir, e.exportDir) })
+	if labelErr != nil {
+		return labelErr
 	}
 
 	msgCountPerLabel, err := client.GetGroupedMessageCount(ctx)
@@ -175,6 +440,14 @@ func (e *ExportTask) Run(ctx context.Context, reporter Reporter) error {
 		return fmt.Errorf("failed to get message count: %w", err)
 	}
 
+	labels, err := readExportLabels(e.exportDir)
+	if err != nil {
+		e.log.WithError(err).Warn("Failed to read labels, mailbox statistics use label IDs")
+	}
+
+	stats := newMailboxStats(user, msgCountPerLabel, labels, time.Now())
+	result.MailboxStats = &stats
+
 	var totalMessageCount uint64
 	var foundAllMailLabel bool
 
@@ -190,9 +463,42 @@ func (e *ExportTask) Run(ctx context.Context, reporter Reporter) error {
 		return fmt.Errorf("failed to determine total message count")
 	}
 
+	if e.shard != nil {
+		if e.shard.UserID != user.ID {
+			return fmt.Errorf("shard %v was planned for another account", e.shard.String())
+		}
+
+		e.log.WithField("shard", e.shard.String()).Infof("Exporting shard of %v messages", e.shard.MessageCount)
+		totalMessageCount = e.shard.MessageCount
+	}
+
+	if totalMessageCount == 0 {
+		e.log.Info("The account has no message, nothing to export")
+	}
+
+	if e.filter != nil && (len(e.filter.Labels) != 0 || len(e.filter.LabelIDs) != 0) {
+		emptyLabels, allEmpty, err := e.getEmptyLabels(ctx, msgCountPerLabel)
+		if err != nil {
+			return err
+		}
+
+		result.EmptyLabels = emptyLabels
+
+		// There is nothing to list or download. Incremental and resumed exports still list the mailbox to update their
+		// state.
+		if allEmpty && e.shard == nil && !e.incremental && !e.resume {
+			e.log.WithField("labels", emptyLabels).Info("The selected labels have no message, nothing to export")
+			result.TotalMessageCount = totalMessageCount
+			reporter.SetMessageTotal(0)
+
+			return nil
+		}
+	}
+
 	e.log.Infof("Found %v Messages for download", totalMessageCount)
 
 	reporter.SetMessageTotal(totalMessageCount)
+	result.TotalMessageCount = totalMessageCount
 
 	totalMemory := memory.TotalMemory()
 
@@ -209,13 +515,95 @@ func (e *ExportTask) Run(ctx context.Context, reporter Reporter) error {
 		downloadMemMb = MinDownloadMemMB
 	}
 
+	concurrency := e.GetConcurrency()
+	e.log.WithFields(logrus.Fields{
+		"tier":        DetectPlanTier(user),
+		"concurrency": concurrency,
+		"override":    e.concurrency != 0,
+		"builders":    e.GetBuildConcurrency(),
+	}).Info("Selected download concurrency")
+
+	var incremental *incrementalTracker
+	if e.incremental {
+		if incremental, err = e.newIncrementalTracker(); err != nil {
+			return err
+		}
+	}
+
+	var (
+		checkpoint *checkpointTracker
+		resumed    bool
+	)
+
+	if !e.incremental || e.resume {
+		if checkpoint, resumed, err = e.newCheckpointTracker(user.ID); err != nil {
+			return err
+		}
+	}
+
+	if resumed {
+		cursor, cursorCount := checkpoint.getCursor()
+		e.log.WithField("cursor", cursor).Infof("Resuming export after %v messages", cursorCount)
+		reporter.SetMessageProcessed(cursorCount)
+	}
+
 	// Build stages
-	metaStage := NewMetadataStage(client, e.log, MetadataPageSize, NumParallelDownloads)
-	downloadStage := NewDownloadStage(client, NumParallelDownloads, e.log, downloadMemMb, e.session.GetPanicHandler())
-	buildStage := NewBuildStage(NumParallelBuilders, e.log, buildMemMB, e.session.GetPanicHandler(), e.session.GetReporter(), user.ID)
+	metaStage := NewMetadataStage(client, e.log, MetadataPageSize, concurrency)
+	metaStage.SetShard(e.shard)
+	metaStage.SetFilter(e.filter)
+	metaStage.SetCollectMessageIDs(e.shard == nil && e.filter == nil && !resumed)
+	metaStage.setIncrementalTracker(incremental)
+	metaStage.setStopSignal(e.canceller.stopping())
+	metaStage.setCheckpointTracker(checkpoint)
+	downloadStage := NewDownloadStage(client, concurrency, e.log, downloadMemMb, e.session.GetPanicHandler())
+	downloadStage.setCheckpointTracker(checkpoint)
+	reporter.events.setBytesSource(downloadStage.GetDownloadedBytes)
+	if e.filter != nil && e.filter.HasBodyCriteria() {
+		downloadStage.SetBodyMatcher(newBodyMatcher(e.filter, keyRing, e.log), reporter)
+	}
+	buildStage := NewBuildStage(e.GetBuildConcurrency(), e.log, buildMemMB, e.session.GetPanicHandler(), e.session.GetReporter(), user.ID)
+	buildStage.setDetectLanguage(e.detectLanguage)
+	buildStage.setEventBus(e.events)
 	writeStage := NewWriteStage(e.tmpDir, e.exportDir, NumParallelWriters, e.log, reporter, e.session.GetPanicHandler())
+	writeStage.SetAutoGeneratedMode(e.autoGeneratedMode)
+	writeStage.setIncrementalTracker(incremental)
+	writeStage.setCheckpointTracker(checkpoint)
+	writeStage.setPathNamer(names)
+	writeStage.setAtRestKey(e.atRestKey)
+	writeStage.setEventBus(e.events)
+	writeStage.setDurable(e.durable)
+
+	var years *yearDirs
+	if e.splitByYear {
+		years = newYearDirs(e.exportDir, e.autoGeneratedMode == AutoGeneratedModeSeparate)
+		writeStage.setYearDirs(years)
+	}
+
+	if e.outputFormat == OutputFormatPack {
+		writeStage.setLabelFileWriter(newPackWriter(e.tmpDir, PackFileMaxSize))
+	} else if e.outputFormat.isArchive() {
+		archive, err := newArchiveWriter(e.outputFormat, e.tmpDir)
+		if err != nil {
+			return err
+		}
+
+		writeStage.setLabelFileWriter(archive)
+	} else if e.outputFormat != OutputFormatEML {
+		labels, err := client.GetLabels(ctx, proton.LabelTypeFolder, proton.LabelTypeLabel)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve labels: %w", err)
+		}
+
+		labelWriter := newLabelFileWriter(e.outputFormat, labels, names)
+		if maildir, ok := labelWriter.(*maildirWriter); ok {
+			maildir.setRemoveStale(e.incremental)
+		}
+
+		writeStage.setLabelFileWriter(labelWriter)
+	}
 
 	e.log.Debug("Starting message download")
+	reporter.setStage(ExportStageMessages)
 	errReporter := &exportErrReporter{
 		export: e,
 		lock:   sync.Mutex{},
@@ -224,18 +612,24 @@ func (e *ExportTask) Run(ctx context.Context, reporter Reporter) error {
 
 	// start pipeline.
 	e.group.Once(func(ctx context.Context) {
-		// To enable resume features use re-enable this line and delete the one below.
-		// metaStage.Run(ctx, errReporter, NewFileMetadataFileChecker(e.exportDir), reporter)
-		metaStage.Run(ctx, errReporter, &alwaysMissingMetadataFileChecker{}, reporter)
+		// The checkpoint of a resumed export skips the messages processed before the interruption.
+		var mfc MetadataFileChecker = &alwaysMissingMetadataFileChecker{}
+		if resumed {
+			mfc = checkpoint
+		}
+
+		timer.measure("metadata", func() {
+			metaStage.Run(ctx, errReporter, mfc, reporter)
+		})
 	})
 	e.group.Once(func(ctx context.Context) {
-		downloadStage.Run(ctx, metaStage.outputCh, errReporter)
+		timer.measure("download", func() { downloadStage.Run(ctx, metaStage.outputCh, errReporter) })
 	})
 	e.group.Once(func(ctx context.Context) {
-		buildStage.Run(ctx, downloadStage.outputCh, keyRing, errReporter)
+		timer.measure("build", func() { buildStage.Run(ctx, downloadStage.outputCh, keyRing, errReporter) })
 	})
 	e.group.Once(func(ctx context.Context) {
-		writeStage.Run(ctx, buildStage.outputCh, errReporter)
+		timer.measure("write", func() { writeStage.Run(ctx, buildStage.outputCh, errReporter) })
 	})
 
 	// wait for downloads to finish.
@@ -243,20 +637,175 @@ func (e *ExportTask) Run(ctx context.Context, reporter Reporter) error {
 
 	e.log.Debug("Message download finished")
 
+	// The pipeline drained after a graceful cancellation, the export is incomplete.
+	if e.canceller.isStopping() {
+		e.ctxCancel(ErrCancelledByUser)
+	}
+
+	result.ExportedMessageCount = writeStage.GetWrittenCount()
+	result.BytesWritten = writeStage.GetWrittenBytes()
+	result.AutoGeneratedCount = writeStage.GetAutoGeneratedCount()
+	result.ExcludedMessageCount = writeStage.GetExcludedCount()
+	result.FilteredMessageCount = metaStage.GetFilteredCount() + downloadStage.GetFilteredCount()
+	result.Quarantined = buildStage.GetQuarantined()
+
+	senderReport, senderErr := writeStage.WriteSenderVerificationReport()
+	result.Authentication = senderReport.Authentication
+	if senderErr != nil {
+		e.log.WithError(senderErr).Error("Failed to write sender verification report")
+	} else {
+		e.log.WithFields(logrus.Fields{
+			"received":   senderReport.ReceivedCount,
+			"unverified": senderReport.UnverifiedCount,
+			"failed":     senderReport.FailedCount,
+			"suspicious": senderReport.SuspiciousCount,
+		}).Info("Sender verification report written")
+	}
+
+	if count, err := writeStage.WriteMessageIndex(); err != nil {
+		e.log.WithError(err).Error("Failed to write message index")
+	} else if count != 0 {
+		e.log.WithField("messages", count).Info("Message index written")
+	}
+
 	// collect errors.
 	exportError := errReporter.getErrors()
+
+	if err := names.write(e.tmpDir); err != nil {
+		e.log.WithError(err).Error("Failed to write path truncations")
+		exportError = append(exportError, err)
+	} else if count := names.getTruncationCount(); count != 0 {
+		e.log.WithField("budget", e.pathBudget).Infof("Shortened %v names to fit the path budget", count)
+	}
+
+	if years != nil {
+		if err := e.finishYears(years.getYears(), time.Now()); err != nil {
+			e.log.WithError(err).Error("Failed to finish year folders")
+			exportError = append(exportError, err)
+		}
+	}
+
+	if incremental != nil {
+		listingComplete := len(exportError) == 0 && e.ctx.Err() == nil && e.filter == nil
+		state, deleted := incremental.finish(user.ID, listingComplete, e.recordTombstones, time.Now().UTC())
+		if err := writeIncrementalState(e.tmpDir, e.exportDir, &state); err != nil {
+			e.log.WithError(err).Error("Failed to write incremental state")
+			exportError = append(exportError, err)
+		}
+
+		result.UnchangedMessageCount = uint64(incremental.getUnchangedCount())
+		result.DeletedMessageCount = uint64(deleted)
+	}
+
+	if checkpoint != nil {
+		complete := len(exportError) == 0 && e.ctx.Err() == nil
+		if err := checkpoint.finish(complete); err != nil {
+			e.log.WithError(err).Error("Failed to write checkpoint")
+		}
+	}
+
+	if e.shard != nil {
+		complete := len(exportError) == 0 && e.ctx.Err() == nil && senderErr == nil
+		if err := writeShardManifest(e.tmpDir, e.exportDir, e.shard, complete); err != nil {
+			e.log.WithError(err).Error("Failed to write shard manifest")
+			if len(exportError) == 0 {
+				exportError = append(exportError, err)
+			}
+		}
+	}
+
 	if len(exportError) == 0 {
-		return e.ctx.Err()
+		if err := e.ctx.Err(); err != nil {
+			return err
+		}
+
+		// The messages listed before a resumed export was interrupted are not known, the snapshot would be partial.
+		if e.shard == nil && e.filter == nil && !resumed {
+			result.SnapshotDiff = e.compareSnapshot(ctx, &Snapshot{
+				UserID:     user.ID,
+				Time:       time.Now().UTC(),
+				MessageIDs: metaStage.GetMessageIDs(),
+			})
+		}
+
+		return senderErr
 	}
 
 	e.log.Error("Export task ran into the following errors")
 	for i, err := range exportError {
 		e.log.WithError(err).Errorf("Error %v", i)
+		result.Failures = append(result.Failures, Failure{Reason: err.Error()})
 	}
 
 	return exportError[0]
 }
 
+// getEmptyLabels returns the labels selected by the filter without any message, and whether they are all empty.
+func (e *ExportTask) getEmptyLabels(ctx context.Context, counts []proton.MessageGroupCount) ([]string, bool, error) {
+	labels, err := e.session.GetClient().GetLabels(ctx, proton.LabelTypeSystem, proton.LabelTypeFolder, proton.LabelTypeLabel)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to retrieve labels: %w", err)
+	}
+
+	return e.filter.getEmptyLabels(labels, counts)
+}
+
+// compareSnapshot writes the snapshot of the export and compares it with the previous one. Snapshot errors do not fail
+// the export, they are logged.
+func (e *ExportTask) compareSnapshot(ctx context.Context, snapshot *Snapshot) *SnapshotDiff {
+	var (
+		previous     Snapshot
+		previousPath string
+		err          error
+	)
+
+	// An incremental export is updated in place, its previous snapshot is its own.
+	if e.incremental {
+		if previous, err = LoadSnapshot(e.exportDir); err == nil {
+			previousPath = e.exportDir
+		} else if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+	}
+
+	if len(previousPath) == 0 && err == nil {
+		previous, previousPath, err = findPreviousSnapshot(e.exportDir, snapshot.UserID)
+	}
+
+	if err != nil {
+		e.log.WithError(err).Error("Failed to load previous snapshot")
+	}
+
+	if err := writeSnapshot(e.tmpDir, e.exportDir, snapshot); err != nil {
+		e.log.WithError(err).Error("Failed to write snapshot")
+	}
+
+	if len(previousPath) == 0 {
+		return nil
+	}
+
+	diff := CompareSnapshots(&previous, snapshot, e.snapshotThresholds)
+	diff.PreviousPath = previousPath
+
+	e.log.WithFields(logrus.Fields{
+		"previous": previousPath,
+		"added":    diff.AddedCount,
+		"deleted":  diff.DeletedCount,
+	}).Info("Compared with previous snapshot")
+
+	if diff.Anomalous {
+		e.log.Warn("Anomalous changes since previous snapshot")
+
+		if e.snapshotAlert != nil {
+			if err := e.snapshotAlert(ctx, diff); err != nil {
+				e.log.WithError(err).Error("Failed to send snapshot alert")
+			}
+		}
+	}
+
+	return &diff
+}
+
 const LabelMetadataVersion = 1
 
 func (e *ExportTask) WriteLabelMetadata(ctx context.Context, tmpDir, exportPath string) error {
@@ -283,7 +832,12 @@ func (e *ExportTask) GetExportPath() string {
 }
 
 func (e *ExportTask) GetOperationCancelledByUser() bool {
-	return e.cancelledByUser
+	return e.GetCancelCause() == CancelCauseUser
+}
+
+// GetCancelCause returns why the task was cancelled, or CancelCauseNone if it wasn't.
+func (e *ExportTask) GetCancelCause() CancelCause {
+	return getCancelCause(e.ctx)
 }
 
 func getLabelFileName() string {
@@ -302,6 +856,9 @@ func (e *exportErrReporter) ReportStageError(err error) {
 
 	if len(e.errors) == 0 {
 		e.export.log.Debug("Cancelling context due to error")
+		if !errors.Is(err, context.Canceled) {
+			e.export.ctxCancel(&FatalError{Err: err})
+		}
 		e.export.group.Cancel()
 	}
 	e.errors = append(e.errors, err)
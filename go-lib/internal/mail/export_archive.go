@@ -0,0 +1,427 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Archives
+// --------
+// With OutputFormatZip and OutputFormatTarZst, the EML and metadata files of the assembled messages are written to a
+// single archive per export folder instead of separate files:
+//
+// <export>
+//  |- labels.json
+//  |- messages.zip          (or messages.tar.zst)
+//  |- messages.zip.idx
+//  |- msg-id.metadata.json  (messages that could not be assembled keep the regular layout)
+//  |- msg-id/
+//
+// Each message is compressed on its own so that a file can be read without decompressing the whole archive: the zip
+// entries are deflated separately and the tar.zst archive is made of one zstd frame per message, which standard tools
+// read as a single stream. The index written next to the archive once it is complete locates the files, see
+// ArchiveIndex. An archive is only usable once complete, which is why the archive formats do not support resumed and
+// incremental exports.
+
+var ErrArchiveNotSupported = errors.New("archive formats do not support incremental, resumed nor sharded exports")
+var ErrArchiveIncomplete = errors.New("archive has no index, the export writing it was interrupted")
+
+const ArchiveIndexVersion = 1
+
+// getArchiveFileName returns the name of the archive written to each export folder.
+func getArchiveFileName(format OutputFormat) string {
+	return "messages." + format.String()
+}
+
+// getArchiveIndexPath returns the path of the index of the archive at archivePath.
+func getArchiveIndexPath(archivePath string) string {
+	return archivePath + packIndexExtension
+}
+
+// ArchiveIndex lists the files of an archive.
+type ArchiveIndex struct {
+	Entries []ArchiveIndexEntry
+}
+
+type ArchiveIndexEntry struct {
+	Name           string
+	Offset         int64 // Offset of the compressed data: the data of the zip entry or the zstd frame holding the file.
+	CompressedSize int64
+	DataOffset     int64 // Offset of the data in the decompressed zstd frame, always zero in zip archives.
+	Size           int64
+	SHA256         string
+}
+
+// archiveFile is a file to add to an archive.
+type archiveFile struct {
+	name string
+	data []byte
+}
+
+// openArchive is the archive being written in a folder of the export.
+type openArchive struct {
+	file   *os.File
+	path   string
+	offset int64
+	zip    *zip.Writer // Nil for tar.zst archives.
+	index  ArchiveIndex
+}
+
+// archiveWriter writes the assembled messages and their metadata to the archive of their folder. It is safe for
+// concurrent use.
+type archiveWriter struct {
+	lock     sync.Mutex
+	format   OutputFormat
+	tempDir  string
+	encoder  *zstd.Encoder
+	archives map[string]*openArchive // Archive being written by folder.
+	written  map[string]string       // Archive each message was written to, until taken by the write stage.
+}
+
+func newArchiveWriter(format OutputFormat, tempDir string) (*archiveWriter, error) {
+	writer := &archiveWriter{
+		format:   format,
+		tempDir:  tempDir,
+		archives: make(map[string]*openArchive),
+		written:  make(map[string]string),
+	}
+
+	if format == OutputFormatTarZst {
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+
+		writer.encoder = encoder
+	}
+
+	return writer, nil
+}
+
+func (a *archiveWriter) getFilePaths(*proton.MessageMetadata) []string {
+	return []string{getArchiveFileName(a.format)}
+}
+
+func (a *archiveWriter) write(dir string, metadata *MessageMetadata, eml []byte) error {
+	metadataBytes, err := metadata.toBytes()
+	if err != nil {
+		return fmt.Errorf("failed to generate message metadata: %w", err)
+	}
+
+	files := []archiveFile{
+		{name: getEMLFileName(metadata.ID), data: eml},
+		{name: getMetadataFileName(metadata.ID), data: metadataBytes},
+	}
+	modTime := time.Unix(metadata.Time, 0)
+
+	// The files are compressed before taking the lock so that the messages are compressed in parallel.
+	if a.format == OutputFormatZip {
+		compressed := make([][]byte, len(files))
+
+		for i, file := range files {
+			if compressed[i], err = deflate(file.data); err != nil {
+				return err
+			}
+		}
+
+		a.lock.Lock()
+		defer a.lock.Unlock()
+
+		archive, err := a.getArchive(dir)
+		if err != nil {
+			return err
+		}
+
+		for i, file := range files {
+			if err := archive.appendZip(file, compressed[i], modTime); err != nil {
+				return err
+			}
+		}
+	} else {
+		frame, entries, err := a.encodeTarFrame(files, modTime)
+		if err != nil {
+			return err
+		}
+
+		a.lock.Lock()
+		defer a.lock.Unlock()
+
+		archive, err := a.getArchive(dir)
+		if err != nil {
+			return err
+		}
+
+		if err := archive.appendFrame(frame, entries); err != nil {
+			return err
+		}
+	}
+
+	a.written[metadata.ID] = a.archives[dir].path
+
+	return nil
+}
+
+// takeBundlePath returns the archive a message was written to.
+func (a *archiveWriter) takeBundlePath(messageID string) (string, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	path, ok := a.written[messageID]
+	delete(a.written, messageID)
+
+	return path, ok
+}
+
+// getArchive returns the archive of dir, which is created on first use. The lock must be held.
+func (a *archiveWriter) getArchive(dir string) (*openArchive, error) {
+	if archive, ok := a.archives[dir]; ok {
+		return archive, nil
+	}
+
+	path := filepath.Join(dir, getArchiveFileName(a.format))
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive: %w", err)
+	}
+
+	archive := &openArchive{file: file, path: path}
+	if a.format == OutputFormatZip {
+		archive.zip = zip.NewWriter(&offsetWriter{archive: archive})
+	}
+
+	a.archives[dir] = archive
+
+	return archive, nil
+}
+
+// encodeTarFrame returns the zstd frame holding the tar entries of files, and the entries of the index with their
+// offset in the frame.
+func (a *archiveWriter) encodeTarFrame(files []archiveFile, modTime time.Time) ([]byte, []ArchiveIndexEntry, error) {
+	var buffer bytes.Buffer
+
+	writer := tar.NewWriter(&buffer)
+	entries := make([]ArchiveIndexEntry, 0, len(files))
+
+	for _, file := range files {
+		if err := writer.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.name,
+			Size:     int64(len(file.data)),
+			Mode:     0o600,
+			ModTime:  modTime,
+		}); err != nil {
+			return nil, nil, fmt.Errorf("failed to write tar header: %w", err)
+		}
+
+		entries = append(entries, newArchiveIndexEntry(file, int64(buffer.Len())))
+
+		if _, err := writer.Write(file.data); err != nil {
+			return nil, nil, fmt.Errorf("failed to write tar entry: %w", err)
+		}
+
+		if err := writer.Flush(); err != nil {
+			return nil, nil, fmt.Errorf("failed to write tar entry: %w", err)
+		}
+	}
+
+	return a.encoder.EncodeAll(buffer.Bytes(), nil), entries, nil
+}
+
+// close completes the archives and writes their index.
+func (a *archiveWriter) close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var result error
+
+	for dir, archive := range a.archives {
+		if err := a.seal(archive); err != nil && result == nil {
+			result = err
+		}
+
+		delete(a.archives, dir)
+	}
+
+	if a.encoder != nil {
+		if err := a.encoder.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+// seal writes the end of the archive, then syncs and closes it and writes its index.
+func (a *archiveWriter) seal(archive *openArchive) error {
+	var err error
+
+	if archive.zip != nil {
+		err = archive.zip.Close()
+	} else {
+		// The end of a tar archive is marked by two empty blocks.
+		_, err = archive.file.Write(a.encoder.EncodeAll(make([]byte, 2*512), nil))
+	}
+
+	if err == nil {
+		err = archive.file.Sync()
+	}
+
+	if err != nil {
+		_ = archive.file.Close()
+		return fmt.Errorf("failed to complete archive '%v': %w", archive.path, err)
+	}
+
+	if err := archive.file.Close(); err != nil {
+		return fmt.Errorf("failed to close archive '%v': %w", archive.path, err)
+	}
+
+	data, err := utils.GenerateVersionedJSON(ArchiveIndexVersion, &archive.index)
+	if err != nil {
+		return fmt.Errorf("failed to json encode archive index: %w", err)
+	}
+
+	indexPath := getArchiveIndexPath(archive.path)
+	if err := utils.WriteFileSafe(a.tempDir, indexPath, data, &utils.Sha256IntegrityChecker{}); err != nil {
+		return fmt.Errorf("failed to write '%v': %w", indexPath, err)
+	}
+
+	return nil
+}
+
+// appendZip adds a deflated file to the zip archive.
+func (o *openArchive) appendZip(file archiveFile, compressed []byte, modTime time.Time) error {
+	writer, err := o.zip.CreateRaw(&zip.FileHeader{
+		Name:               file.name,
+		Method:             zip.Deflate,
+		Modified:           modTime,
+		CRC32:              crc32.ChecksumIEEE(file.data),
+		CompressedSize64:   uint64(len(compressed)),
+		UncompressedSize64: uint64(len(file.data)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write archive '%v': %w", o.path, err)
+	}
+
+	// The header is flushed to learn the offset of the data.
+	if err := o.zip.Flush(); err != nil {
+		return fmt.Errorf("failed to write archive '%v': %w", o.path, err)
+	}
+
+	entry := newArchiveIndexEntry(file, 0)
+	entry.Offset = o.offset
+	entry.CompressedSize = int64(len(compressed))
+
+	if _, err := writer.Write(compressed); err != nil {
+		return fmt.Errorf("failed to write archive '%v': %w", o.path, err)
+	}
+
+	if err := o.zip.Flush(); err != nil {
+		return fmt.Errorf("failed to write archive '%v': %w", o.path, err)
+	}
+
+	o.index.Entries = append(o.index.Entries, entry)
+
+	return nil
+}
+
+// appendFrame adds a zstd frame holding the tar entries of files to the tar.zst archive.
+func (o *openArchive) appendFrame(frame []byte, entries []ArchiveIndexEntry) error {
+	if _, err := o.file.Write(frame); err != nil {
+		return fmt.Errorf("failed to write archive '%v': %w", o.path, err)
+	}
+
+	for _, entry := range entries {
+		entry.Offset = o.offset
+		entry.CompressedSize = int64(len(frame))
+		o.index.Entries = append(o.index.Entries, entry)
+	}
+
+	o.offset += int64(len(frame))
+
+	return nil
+}
+
+func newArchiveIndexEntry(file archiveFile, dataOffset int64) ArchiveIndexEntry {
+	hash := sha256.Sum256(file.data)
+
+	return ArchiveIndexEntry{
+		Name:       file.name,
+		DataOffset: dataOffset,
+		Size:       int64(len(file.data)),
+		SHA256:     hex.EncodeToString(hash[:]),
+	}
+}
+
+// offsetWriter writes to the file of a zip archive and tracks the offset in the file.
+type offsetWriter struct {
+	archive *openArchive
+}
+
+func (w *offsetWriter) Write(b []byte) (int, error) {
+	n, err := w.archive.file.Write(b)
+	w.archive.offset += int64(n)
+
+	return n, err
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	writer, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create deflate writer: %w", err)
+	}
+
+	if _, err := writer.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// checkArchiveOptions returns ErrArchiveNotSupported if the options of the export cannot be combined with an archive
+// format.
+func (e *ExportTask) checkArchiveOptions() error {
+	if e.outputFormat.isArchive() && (e.shard != nil || e.incremental || e.resume) {
+		return ErrArchiveNotSupported
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestArchive(t *testing.T, format OutputFormat, dir string, ids ...string) string {
+	writer, err := newArchiveWriter(format, t.TempDir())
+	require.NoError(t, err)
+
+	for _, id := range ids {
+		metadata := MessageMetadata{MessageMetadata: proton.MessageMetadata{ID: id, Subject: "subject " + id}}
+		require.NoError(t, writer.write(dir, &metadata, []byte("Subject: "+id+"\r\n\r\nBody\r\n")))
+
+		archivePath, ok := writer.takeBundlePath(id)
+		require.True(t, ok)
+		require.Equal(t, filepath.Join(dir, getArchiveFileName(format)), archivePath)
+	}
+
+	require.NoError(t, writer.close())
+
+	return filepath.Join(dir, getArchiveFileName(format))
+}
+
+func TestArchiveWriter(t *testing.T) {
+	for _, format := range []OutputFormat{OutputFormatZip, OutputFormatTarZst} {
+		t.Run(format.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			archivePath := writeTestArchive(t, format, dir, "msg-1", "msg-2", "msg-3")
+			require.FileExists(t, getArchiveIndexPath(archivePath))
+
+			fsys := newPackFS(os.DirFS(dir))
+
+			for _, id := range []string{"msg-1", "msg-2", "msg-3"} {
+				eml, err := fs.ReadFile(fsys, getEMLFileName(id))
+				require.NoError(t, err)
+				require.Equal(t, "Subject: "+id+"\r\n\r\nBody\r\n", string(eml))
+
+				metadata, err := loadMetadataFileFS(fsys, getMetadataFileName(id))
+				require.NoError(t, err)
+				require.Equal(t, "subject "+id, metadata.Subject)
+			}
+
+			entries, err := fs.ReadDir(fsys, ".")
+			require.NoError(t, err)
+			require.Len(t, entries, 8)
+		})
+	}
+}
+
+func TestArchiveWriter_StandardTools(t *testing.T) {
+	dir := t.TempDir()
+
+	zipReader, err := zip.OpenReader(writeTestArchive(t, OutputFormatZip, dir, "msg-1", "msg-2"))
+	require.NoError(t, err)
+	defer zipReader.Close() //nolint:errcheck
+
+	var zipNames []string
+
+	for _, file := range zipReader.File {
+		reader, err := file.Open()
+		require.NoError(t, err)
+		_, err = io.ReadAll(reader)
+		require.NoError(t, err, file.Name)
+		require.NoError(t, reader.Close())
+
+		zipNames = append(zipNames, file.Name)
+	}
+
+	expected := []string{
+		getEMLFileName("msg-1"), getMetadataFileName("msg-1"),
+		getEMLFileName("msg-2"), getMetadataFileName("msg-2"),
+	}
+	require.Equal(t, expected, zipNames)
+
+	file, err := os.Open(writeTestArchive(t, OutputFormatTarZst, dir, "msg-1", "msg-2"))
+	require.NoError(t, err)
+	defer file.Close() //nolint:errcheck
+
+	decoder, err := zstd.NewReader(file)
+	require.NoError(t, err)
+	defer decoder.Close()
+
+	var tarNames []string
+
+	tarReader := tar.NewReader(decoder)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(t, err)
+
+		tarNames = append(tarNames, header.Name)
+	}
+
+	require.Equal(t, expected, tarNames)
+}
+
+func TestArchiveWriter_Incomplete(t *testing.T) {
+	dir := t.TempDir()
+	archivePath := writeTestArchive(t, OutputFormatZip, dir, "msg-1")
+	require.NoError(t, os.Remove(getArchiveIndexPath(archivePath)))
+
+	_, err := fs.ReadFile(newPackFS(os.DirFS(dir)), getEMLFileName("msg-1"))
+	require.ErrorIs(t, err, ErrArchiveIncomplete)
+}
+
+func TestExportTask_ArchiveOptions(t *testing.T) {
+	task := &ExportTask{outputFormat: OutputFormatTarZst}
+	require.NoError(t, task.checkArchiveOptions())
+
+	task.incremental = true
+	require.ErrorIs(t, task.checkArchiveOptions(), ErrArchiveNotSupported)
+
+	task = &ExportTask{outputFormat: OutputFormatPack, resume: true}
+	require.NoError(t, task.checkArchiveOptions())
+}
@@ -0,0 +1,359 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+)
+
+const AtRestEncryptionVersion = 1
+
+// sealedExtension is appended to the names of the files encrypted at rest. The files are OpenPGP messages, they can be
+// decrypted with gpg as well.
+const sealedExtension = ".gpg"
+
+var (
+	ErrAtRestNotSupported = errors.New("encryption at rest only supports the eml format and exports that are not sharded")
+	ErrAtRestMismatch     = errors.New("the encryption at rest does not match the one of the export")
+	ErrAtRestKeyRequired  = errors.New("the backup is encrypted at rest, its passphrase or private key is required")
+)
+
+const (
+	AtRestMethodPassphrase = "passphrase"
+	AtRestMethodPublicKey  = "public-key"
+)
+
+// AtRestEncryptionInfo is written to the encryption.json file of the exports encrypted at rest. It holds no secret.
+type AtRestEncryptionInfo struct {
+	Method      string
+	Fingerprint string `json:",omitempty"` // Fingerprint of the recipient key of the public key method.
+}
+
+func getAtRestEncryptionFileName() string {
+	return "encryption.json"
+}
+
+// LoadAtRestEncryptionInfo reads the encryption of an export, it fails with os.ErrNotExist if the export is not
+// encrypted at rest.
+func LoadAtRestEncryptionInfo(exportDir string) (AtRestEncryptionInfo, error) {
+	b, err := os.ReadFile(filepath.Join(exportDir, getAtRestEncryptionFileName())) //nolint:gosec
+	if err != nil {
+		return AtRestEncryptionInfo{}, fmt.Errorf("failed to read encryption info: %w", err)
+	}
+
+	return parseAtRestEncryptionInfo(b)
+}
+
+func parseAtRestEncryptionInfo(b []byte) (AtRestEncryptionInfo, error) {
+	info, err := utils.NewVersionedJSON[AtRestEncryptionInfo](AtRestEncryptionVersion, b)
+	if err != nil {
+		return AtRestEncryptionInfo{}, fmt.Errorf("failed to parse encryption info: %w", err)
+	}
+
+	return info.Payload, nil
+}
+
+// AtRestKey encrypts the message and metadata files of an export on disk, and decrypts them for the restore. Each file
+// is an OpenPGP message with its own session key, encrypted with a passphrase or to a public key.
+type AtRestKey struct {
+	passphrase []byte
+	keyRing    *crypto.KeyRing
+	canDecrypt bool
+}
+
+// NewAtRestPassphrase returns a key encrypting the files with passphrase.
+func NewAtRestPassphrase(passphrase []byte) (*AtRestKey, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("the encryption passphrase cannot be empty")
+	}
+
+	return &AtRestKey{passphrase: passphrase, canDecrypt: true}, nil
+}
+
+// NewAtRestKeyFromArmored returns a key encrypting the files to an OpenPGP key. The files can only be decrypted with a
+// private key, which is unlocked with passphrase if needed.
+func NewAtRestKeyFromArmored(armored string, passphrase []byte) (*AtRestKey, error) {
+	key, err := crypto.NewKeyFromArmored(armored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse encryption key: %w", err)
+	}
+
+	if !key.CanEncrypt() {
+		return nil, fmt.Errorf("key '%v' cannot be used for encryption", key.GetFingerprint())
+	}
+
+	canDecrypt := key.IsPrivate()
+
+	if locked, err := key.IsLocked(); canDecrypt && err == nil && locked {
+		if key, err = key.Unlock(passphrase); err != nil {
+			return nil, fmt.Errorf("failed to unlock encryption key: %w", err)
+		}
+	}
+
+	keyRing, err := crypto.NewKeyRing(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create encryption key ring: %w", err)
+	}
+
+	return &AtRestKey{keyRing: keyRing, canDecrypt: canDecrypt}, nil
+}
+
+func (k *AtRestKey) getInfo() AtRestEncryptionInfo {
+	if k.keyRing == nil {
+		return AtRestEncryptionInfo{Method: AtRestMethodPassphrase}
+	}
+
+	return AtRestEncryptionInfo{Method: AtRestMethodPublicKey, Fingerprint: k.keyRing.GetKeys()[0].GetFingerprint()}
+}
+
+// matches returns whether the key can be used for an export with the given encryption.
+func (k *AtRestKey) matches(info AtRestEncryptionInfo) bool {
+	own := k.getInfo()
+
+	return own.Method == info.Method && strings.EqualFold(own.Fingerprint, info.Fingerprint)
+}
+
+// seal returns a writer encrypting the data written to w with a new session key.
+func (k *AtRestKey) seal(w io.Writer) (io.WriteCloser, error) {
+	sessionKey, err := crypto.GenerateSessionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var keyPacket []byte
+	if k.keyRing != nil {
+		keyPacket, err = k.keyRing.EncryptSessionKey(sessionKey)
+	} else {
+		keyPacket, err = crypto.EncryptSessionKeyWithPassword(sessionKey, k.passphrase)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt session key: %w", err)
+	}
+
+	if _, err := w.Write(keyPacket); err != nil {
+		return nil, err
+	}
+
+	return sessionKey.EncryptStream(w, &crypto.PlainMessageMetadata{IsBinary: true}, nil)
+}
+
+// open decrypts a file encrypted by seal.
+func (k *AtRestKey) open(data []byte) ([]byte, error) {
+	if !k.canDecrypt {
+		return nil, fmt.Errorf("a public key cannot decrypt the backup, use the private key")
+	}
+
+	split, err := crypto.NewPGPMessage(data).SplitMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse encrypted file: %w", err)
+	}
+
+	var sessionKey *crypto.SessionKey
+	if k.keyRing != nil {
+		sessionKey, err = k.keyRing.DecryptSessionKey(split.KeyPacket)
+	} else {
+		sessionKey, err = crypto.DecryptSessionKeyWithPassword(split.KeyPacket, k.passphrase)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt session key: %w", err)
+	}
+
+	plain, err := sessionKey.Decrypt(split.DataPacket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt file: %w", err)
+	}
+
+	return plain.GetBinary(), nil
+}
+
+// SetAtRestEncryption encrypts the message and metadata files and the sender verification report of the export with key,
+// see AtRestKey. The encrypted files get the .gpg extension, the other reports and the labels file are not encrypted.
+// Nil disables the encryption.
+func (e *ExportTask) SetAtRestEncryption(key *AtRestKey) {
+	e.atRestKey = key
+}
+
+func (e *ExportTask) GetAtRestEncryption() *AtRestKey {
+	return e.atRestKey
+}
+
+// prepareAtRestEncryption checks that the encryption matches the one of the previous runs of an incremental or resumed
+// export, and records it in the export folder.
+func (e *ExportTask) prepareAtRestEncryption() error {
+	info, err := LoadAtRestEncryptionInfo(e.exportDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	encrypted := err == nil
+
+	if e.atRestKey == nil {
+		if encrypted {
+			return fmt.Errorf("%w: '%v' is encrypted at rest", ErrAtRestMismatch, e.exportDir)
+		}
+
+		return nil
+	}
+
+	if e.shard != nil || e.outputFormat != OutputFormatEML {
+		return ErrAtRestNotSupported
+	}
+
+	if encrypted {
+		if !e.atRestKey.matches(info) {
+			return fmt.Errorf("%w: '%v' is encrypted with the %v method", ErrAtRestMismatch, e.exportDir, info.Method)
+		}
+
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(e.exportDir, getLabelFileName())); err == nil {
+		return fmt.Errorf("%w: '%v' is not encrypted at rest", ErrAtRestMismatch, e.exportDir)
+	}
+
+	data, err := utils.GenerateVersionedJSON(AtRestEncryptionVersion, e.atRestKey.getInfo())
+	if err != nil {
+		return fmt.Errorf("failed to json encode encryption info: %w", err)
+	}
+
+	return utils.WriteFileSafe(e.tmpDir, filepath.Join(e.exportDir, getAtRestEncryptionFileName()), data, &utils.Sha256IntegrityChecker{})
+}
+
+// SetAtRestKey decrypts the files of a backup encrypted at rest, see ExportTask.SetAtRestEncryption.
+func (r *RestoreTask) SetAtRestKey(key *AtRestKey) {
+	if key == nil {
+		return
+	}
+
+	r.atRestKey = key
+	r.backupFS = newSealedFS(r.backupFS, key)
+
+	if stream, ok := r.backupCloser.(*streamTarFS); ok {
+		stream.setKey(key)
+	}
+}
+
+// checkAtRestEncryption fails if the backup is encrypted at rest and the key does not match its encryption.
+func (r *RestoreTask) checkAtRestEncryption() error {
+	data, err := fs.ReadFile(r.backupFS, path.Join(r.backupDir, getAtRestEncryptionFileName()))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read encryption info: %w", err)
+	}
+
+	info, err := parseAtRestEncryptionInfo(data)
+	if err != nil {
+		return err
+	}
+
+	if r.atRestKey == nil {
+		return ErrAtRestKeyRequired
+	}
+
+	if !r.atRestKey.matches(info) {
+		return fmt.Errorf("%w: the backup is encrypted with the %v method", ErrAtRestMismatch, info.Method)
+	}
+
+	return nil
+}
+
+// sealedFS shows the files encrypted at rest as the regular files they were encrypted from, so that an encrypted
+// export is read like any other export. Files are decrypted when they are opened.
+type sealedFS struct {
+	fsys fs.FS
+	key  *AtRestKey
+}
+
+func newSealedFS(fsys fs.FS, key *AtRestKey) *sealedFS {
+	return &sealedFS{fsys: fsys, key: key}
+}
+
+func (s *sealedFS) Open(name string) (fs.File, error) {
+	file, err := s.fsys.Open(name)
+	if !errors.Is(err, fs.ErrNotExist) || name == "." {
+		return file, err
+	}
+
+	sealed, readErr := fs.ReadFile(s.fsys, name+sealedExtension)
+	if readErr != nil {
+		return nil, err
+	}
+
+	data, err := s.key.open(sealed)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &packedFile{info: packedFileInfo{name: path.Base(name), size: int64(len(data))}, reader: bytes.NewReader(data)}, nil
+}
+
+// Stat does not decrypt the file, the size of an encrypted file is the one of its encryption.
+func (s *sealedFS) Stat(name string) (fs.FileInfo, error) {
+	info, err := fs.Stat(s.fsys, name)
+	if !errors.Is(err, fs.ErrNotExist) || name == "." {
+		return info, err
+	}
+
+	sealedInfo, sealedErr := fs.Stat(s.fsys, name+sealedExtension)
+	if sealedErr != nil {
+		return nil, err
+	}
+
+	return packedFileInfo{name: path.Base(name), size: sealedInfo.Size()}, nil
+}
+
+// ReadDir lists the encrypted files under the names they were encrypted from.
+func (s *sealedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, entry := range entries {
+		plainName, ok := strings.CutSuffix(entry.Name(), sealedExtension)
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		entries[i] = fs.FileInfoToDirEntry(packedFileInfo{name: plainName, size: info.Size()})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, nil
+}
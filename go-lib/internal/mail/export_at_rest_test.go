@@ -0,0 +1,174 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/gluon/async"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAtRestKey_Passphrase(t *testing.T) {
+	key, err := NewAtRestPassphrase([]byte("secret"))
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	writer := DecryptedAndBuiltMessageWriter{msg: proton.FullMessage{Message: proton.Message{MessageMetadata: proton.MessageMetadata{ID: "msg"}}}}
+	writer.eml.WriteString("Subject: hello\r\n\r\nbody")
+
+	files := newMessageFiles(t.TempDir())
+	files.atRest = key
+
+	require.NoError(t, writer.WriteMessage(dir, files, logrus.WithField("t", "t"), &utils.Sha256IntegrityChecker{}))
+
+	sealed, err := os.ReadFile(filepath.Join(dir, "msg.eml"+sealedExtension))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(sealed, []byte("hello")))
+
+	_, err = os.Stat(filepath.Join(dir, "msg.eml"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	fsys := newSealedFS(os.DirFS(dir), key)
+
+	data, err := fs.ReadFile(fsys, "msg.eml")
+	require.NoError(t, err)
+	require.Equal(t, writer.eml.Bytes(), data)
+
+	entries, err := fs.ReadDir(fsys, ".")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "msg.eml", entries[0].Name())
+
+	wrong, err := NewAtRestPassphrase([]byte("wrong"))
+	require.NoError(t, err)
+
+	_, err = fs.ReadFile(newSealedFS(os.DirFS(dir), wrong), "msg.eml")
+	require.Error(t, err)
+
+	_, err = NewAtRestPassphrase(nil)
+	require.Error(t, err)
+}
+
+func TestAtRestKey_PublicKey(t *testing.T) {
+	privateKey, err := crypto.GenerateKey("test", "test@example.com", "x25519", 0)
+	require.NoError(t, err)
+
+	lockedKey, err := privateKey.Lock([]byte("key passphrase"))
+	require.NoError(t, err)
+
+	armoredPrivate, err := lockedKey.Armor()
+	require.NoError(t, err)
+
+	armoredPublic, err := privateKey.GetArmoredPublicKey()
+	require.NoError(t, err)
+
+	recipient, err := NewAtRestKeyFromArmored(armoredPublic, nil)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, utils.WriteFileSealed(t.TempDir(), filepath.Join(dir, "file.gpg"), []byte("content"), recipient.seal, true, true))
+
+	sealed, err := os.ReadFile(filepath.Join(dir, "file.gpg"))
+	require.NoError(t, err)
+
+	_, err = recipient.open(sealed)
+	require.Error(t, err)
+
+	_, err = NewAtRestKeyFromArmored(armoredPrivate, []byte("wrong"))
+	require.Error(t, err)
+
+	decryptor, err := NewAtRestKeyFromArmored(armoredPrivate, []byte("key passphrase"))
+	require.NoError(t, err)
+	require.True(t, decryptor.matches(recipient.getInfo()))
+
+	data, err := decryptor.open(sealed)
+	require.NoError(t, err)
+	require.Equal(t, []byte("content"), data)
+}
+
+func TestRestoreTask_CheckAtRestEncryption(t *testing.T) {
+	dir := t.TempDir()
+
+	key, err := NewAtRestPassphrase([]byte("secret"))
+	require.NoError(t, err)
+
+	data, err := utils.GenerateVersionedJSON(AtRestEncryptionVersion, key.getInfo())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getAtRestEncryptionFileName()), data, 0o600))
+
+	restore := &RestoreTask{ctx: context.Background(), backupFS: os.DirFS(dir), backupDir: "."}
+	require.ErrorIs(t, restore.checkAtRestEncryption(), ErrAtRestKeyRequired)
+
+	restore.SetAtRestKey(key)
+	require.NoError(t, restore.checkAtRestEncryption())
+
+	privateKey, err := crypto.GenerateKey("test", "test@example.com", "x25519", 0)
+	require.NoError(t, err)
+
+	armored, err := privateKey.Armor()
+	require.NoError(t, err)
+
+	other, err := NewAtRestKeyFromArmored(armored, nil)
+	require.NoError(t, err)
+
+	restore = &RestoreTask{ctx: context.Background(), backupFS: os.DirFS(dir), backupDir: "."}
+	restore.SetAtRestKey(other)
+	require.ErrorIs(t, restore.checkAtRestEncryption(), ErrAtRestMismatch)
+}
+
+func TestWriteStage_SenderVerificationReportAtRest(t *testing.T) {
+	key, err := NewAtRestPassphrase([]byte("secret"))
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	stage := NewWriteStage(t.TempDir(), dir, 1, logrus.WithField("test", "test"), &NullProgressReporter{}, &async.NoopPanicHandler{})
+	stage.setAtRestKey(key)
+
+	metadata := NewMessageMetadata(MessageWriterTypeDecryptedAndBuilt, &proton.Message{
+		MessageMetadata: proton.MessageMetadata{ID: "msg", Sender: &mail.Address{Address: "news@example.com"}, Flags: proton.MessageFlagReceived},
+	})
+	stage.senders.add(&metadata)
+
+	report, err := stage.WriteSenderVerificationReport()
+	require.NoError(t, err)
+	require.Equal(t, 1, report.UnverifiedCount)
+
+	require.NoFileExists(t, filepath.Join(dir, getSenderVerificationFileName()))
+
+	sealed, err := os.ReadFile(filepath.Join(dir, getSenderVerificationFileName()+sealedExtension))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(sealed, []byte("news@example.com")))
+
+	data, err := fs.ReadFile(newSealedFS(os.DirFS(dir), key), getSenderVerificationFileName())
+	require.NoError(t, err)
+
+	decoded, err := utils.NewVersionedJSON[SenderVerificationReport](SenderVerificationReportVersion, data)
+	require.NoError(t, err)
+	require.Equal(t, report.Senders, decoded.Payload.Senders)
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/gluon/rfc822"
+)
+
+// Authentication summary
+// ----------------------
+// The received messages carry the Authentication-Results header written by the Proton servers when they accepted the
+// message, and the Received headers of the servers it went through. Only the topmost Authentication-Results header is
+// trusted, the ones below it were written before the message reached Proton and may be forged. The origin of a message
+// is the first server outside of private networks that handed it over, recorded as its /24 (IPv4) or /48 (IPv6)
+// network. No address is kept for the messages themselves, only the aggregated counts.
+
+// maxOriginNetworks is the number of networks listed in an AuthenticationSummary.
+const maxOriginNetworks = 10
+
+// AuthenticationCounts are the results of one authentication method over the received messages.
+type AuthenticationCounts struct {
+	Pass    int
+	Fail    int // Includes softfail.
+	Other   int // Neutral, none, policy and the temporary or permanent errors.
+	Missing int // No result for the method.
+}
+
+// GetPassRate returns the share of the messages that passed, between 0 and 1.
+func (a *AuthenticationCounts) GetPassRate() float64 {
+	total := a.Pass + a.Fail + a.Other + a.Missing
+	if total == 0 {
+		return 0
+	}
+
+	return float64(a.Pass) / float64(total)
+}
+
+func (a *AuthenticationCounts) add(result string) {
+	switch result {
+	case "pass":
+		a.Pass++
+	case "fail", "softfail":
+		a.Fail++
+	case "":
+		a.Missing++
+	default:
+		a.Other++
+	}
+}
+
+// OriginNetwork is a network the received messages were sent from.
+type OriginNetwork struct {
+	Network      string
+	MessageCount int
+}
+
+// AuthenticationSummary aggregates the authentication results and origins of the received messages.
+type AuthenticationSummary struct {
+	ReceivedCount int
+	SPF           AuthenticationCounts
+	DKIM          AuthenticationCounts
+	DMARC         AuthenticationCounts
+	UnknownOrigin int             // Messages without a public address in their Received headers.
+	Networks      []OriginNetwork `json:",omitempty"` // The networks sending the most messages first.
+}
+
+// authenticationResultRegExp matches the method results of an Authentication-Results header, see RFC 8601.
+var authenticationResultRegExp = regexp.MustCompile(`(?i)\b(spf|dkim|dmarc)\s*=\s*([a-z]+)`)
+
+// receivedFromRegExp matches the address of the sending server in the from clause of a Received header.
+var receivedFromRegExp = regexp.MustCompile(`(?i)^\s*from\s[^;]*?\[(?:ipv6:)?([0-9a-f.:]+)\]`)
+
+type messageAuthentication struct {
+	spf, dkim, dmarc string
+	origin           netip.Prefix // Invalid when unknown.
+}
+
+// parseMessageAuthentication reads the authentication results and the origin of a message from its headers.
+func parseMessageAuthentication(header string) messageAuthentication {
+	var result messageAuthentication
+
+	h, err := rfc822.NewHeader([]byte(header))
+	if err != nil {
+		return result
+	}
+
+	var authenticationRead, originRead bool
+
+	h.Entries(func(key, val string) {
+		switch {
+		case strings.EqualFold(key, "Authentication-Results") && !authenticationRead:
+			authenticationRead = true
+
+			for _, match := range authenticationResultRegExp.FindAllStringSubmatch(val, -1) {
+				value := strings.ToLower(match[2])
+
+				switch strings.ToLower(match[1]) {
+				case "spf":
+					result.spf = mergeAuthenticationResult(result.spf, value)
+				case "dkim":
+					result.dkim = mergeAuthenticationResult(result.dkim, value)
+				case "dmarc":
+					result.dmarc = mergeAuthenticationResult(result.dmarc, value)
+				}
+			}
+		case strings.EqualFold(key, "Received") && !originRead:
+			match := receivedFromRegExp.FindStringSubmatch(val)
+			if match == nil {
+				return
+			}
+
+			addr, err := netip.ParseAddr(match[1])
+			if err != nil || !isPublicAddr(addr) {
+				return
+			}
+
+			originRead = true
+			result.origin = getOriginNetwork(addr)
+		}
+	})
+
+	return result
+}
+
+// mergeAuthenticationResult keeps the pass of a method reported several times, e.g. one DKIM result per signature.
+func mergeAuthenticationResult(previous, result string) string {
+	if previous == "pass" {
+		return previous
+	}
+
+	return result
+}
+
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	return addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
+
+func getOriginNetwork(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}
+	}
+
+	return prefix
+}
+
+// authenticationCollector aggregates the authentication summary. It is not safe for concurrent use, see
+// senderVerificationCollector.
+type authenticationCollector struct {
+	summary  AuthenticationSummary
+	networks map[netip.Prefix]int
+}
+
+func newAuthenticationCollector() *authenticationCollector {
+	return &authenticationCollector{networks: make(map[netip.Prefix]int)}
+}
+
+func (c *authenticationCollector) add(header string) {
+	result := parseMessageAuthentication(header)
+
+	c.summary.ReceivedCount++
+	c.summary.SPF.add(result.spf)
+	c.summary.DKIM.add(result.dkim)
+	c.summary.DMARC.add(result.dmarc)
+
+	if result.origin.IsValid() {
+		c.networks[result.origin]++
+	} else {
+		c.summary.UnknownOrigin++
+	}
+}
+
+// merge adds the counts of another summary. Only its top networks are known, the merged networks are approximate.
+func (c *authenticationCollector) merge(summary *AuthenticationSummary) {
+	c.summary.ReceivedCount += summary.ReceivedCount
+	c.summary.UnknownOrigin += summary.UnknownOrigin
+
+	for _, counts := range []struct{ dst, src *AuthenticationCounts }{
+		{&c.summary.SPF, &summary.SPF},
+		{&c.summary.DKIM, &summary.DKIM},
+		{&c.summary.DMARC, &summary.DMARC},
+	} {
+		counts.dst.Pass += counts.src.Pass
+		counts.dst.Fail += counts.src.Fail
+		counts.dst.Other += counts.src.Other
+		counts.dst.Missing += counts.src.Missing
+	}
+
+	for _, network := range summary.Networks {
+		if prefix, err := netip.ParsePrefix(network.Network); err == nil {
+			c.networks[prefix] += network.MessageCount
+		}
+	}
+}
+
+func (c *authenticationCollector) get() *AuthenticationSummary {
+	if c.summary.ReceivedCount == 0 {
+		return nil
+	}
+
+	summary := c.summary
+	summary.Networks = make([]OriginNetwork, 0, len(c.networks))
+
+	for network, count := range c.networks {
+		summary.Networks = append(summary.Networks, OriginNetwork{Network: network.String(), MessageCount: count})
+	}
+
+	sort.Slice(summary.Networks, func(i, j int) bool {
+		if summary.Networks[i].MessageCount != summary.Networks[j].MessageCount {
+			return summary.Networks[i].MessageCount > summary.Networks[j].MessageCount
+		}
+
+		return summary.Networks[i].Network < summary.Networks[j].Network
+	})
+
+	if len(summary.Networks) > maxOriginNetworks {
+		summary.Networks = summary.Networks[:maxOriginNetworks]
+	}
+
+	return &summary
+}
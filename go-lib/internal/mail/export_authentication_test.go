@@ -0,0 +1,84 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMessageAuthentication(t *testing.T) {
+	header := "Received: from mail.protonmail.ch (mail.protonmail.ch [185.70.40.10])\r\n" +
+		"\tby example.protonmail.ch; Mon, 1 Jan 2024 10:00:00 +0000\r\n" +
+		"Authentication-Results: mail.protonmail.ch; dmarc=pass (p=reject dis=none) header.from=example.com\r\n" +
+		"Authentication-Results: mail.protonmail.ch; spf=softfail smtp.mailfrom=example.com\r\n" +
+		"Authentication-Results: mail.protonmail.ch; dkim=fail header.d=example.com; dkim=pass header.d=example.com\r\n" +
+		"Received: from relay.example.com (relay.example.com [10.0.0.1])\r\n" +
+		"Subject: Hello\r\n\r\n"
+
+	// Only the topmost Authentication-Results header is trusted.
+	result := parseMessageAuthentication(header)
+	require.Equal(t, "pass", result.dmarc)
+	require.Empty(t, result.spf)
+	require.Empty(t, result.dkim)
+	require.Equal(t, netip.MustParsePrefix("185.70.40.0/24"), result.origin)
+
+	header = "Authentication-Results: mx.proton.me; spf=pass smtp.mailfrom=example.com; dkim=fail header.d=a.com; " +
+		"dkim=pass header.d=example.com; dmarc=fail\r\n" +
+		"Received: from localhost (localhost [127.0.0.1])\r\n" +
+		"Received: from [IPv6:2001:db8:1234:5678::1] by relay\r\n\r\n"
+
+	result = parseMessageAuthentication(header)
+	require.Equal(t, "pass", result.spf)
+	require.Equal(t, "pass", result.dkim)
+	require.Equal(t, "fail", result.dmarc)
+	require.Equal(t, netip.MustParsePrefix("2001:db8:1234::/48"), result.origin)
+
+	require.False(t, parseMessageAuthentication("").origin.IsValid())
+}
+
+func TestAuthenticationCollector(t *testing.T) {
+	collector := newAuthenticationCollector()
+	require.Nil(t, collector.get())
+
+	collector.add("Authentication-Results: mx; spf=pass; dkim=pass; dmarc=pass\r\nReceived: from a (a [203.0.113.5])\r\n\r\n")
+	collector.add("Authentication-Results: mx; spf=pass; dkim=none; dmarc=fail\r\nReceived: from b (b [203.0.113.9])\r\n\r\n")
+	collector.add("Received: from c (c [198.51.100.1])\r\n\r\n")
+	collector.add("Subject: no headers of interest\r\n\r\n")
+
+	summary := collector.get()
+	require.NotNil(t, summary)
+	require.Equal(t, 4, summary.ReceivedCount)
+	require.Equal(t, AuthenticationCounts{Pass: 2, Missing: 2}, summary.SPF)
+	require.Equal(t, AuthenticationCounts{Pass: 1, Other: 1, Missing: 2}, summary.DKIM)
+	require.Equal(t, AuthenticationCounts{Pass: 1, Fail: 1, Missing: 2}, summary.DMARC)
+	require.InDelta(t, 0.5, summary.SPF.GetPassRate(), 0.001)
+	require.Equal(t, 1, summary.UnknownOrigin)
+	require.Equal(t, []OriginNetwork{{Network: "203.0.113.0/24", MessageCount: 2}, {Network: "198.51.100.0/24", MessageCount: 1}}, summary.Networks)
+
+	merged := newAuthenticationCollector()
+	merged.merge(summary)
+	merged.merge(summary)
+
+	mergedSummary := merged.get()
+	require.Equal(t, 8, mergedSummary.ReceivedCount)
+	require.Equal(t, 4, mergedSummary.SPF.Pass)
+	require.Equal(t, []OriginNetwork{{Network: "203.0.113.0/24", MessageCount: 4}, {Network: "198.51.100.0/24", MessageCount: 2}}, mergedSummary.Networks)
+}
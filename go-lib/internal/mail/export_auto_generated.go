@@ -0,0 +1,145 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ProtonMail/gluon/rfc822"
+)
+
+// AutoGeneratedKind describes why a message is considered to be sent by a machine rather than a person.
+type AutoGeneratedKind int
+
+const (
+	AutoGeneratedNewsletter   AutoGeneratedKind = iota // Mailing list or bulk mail: List-Id, List-Unsubscribe, Precedence: bulk.
+	AutoGeneratedNotification                          // Automatic notification: Auto-Submitted: auto-generated, Precedence: junk.
+	AutoGeneratedAutoReply                             // Vacation or out of office reply: Auto-Submitted: auto-replied.
+)
+
+func (k AutoGeneratedKind) String() string {
+	switch k {
+	case AutoGeneratedNewsletter:
+		return "newsletter"
+	case AutoGeneratedNotification:
+		return "notification"
+	case AutoGeneratedAutoReply:
+		return "auto-reply"
+	default:
+		return "unknown"
+	}
+}
+
+// AutoGenerated is the classification of an auto-generated message stored in the message metadata.
+type AutoGenerated struct {
+	Kind    AutoGeneratedKind
+	Headers []string // Names of the headers the classification is based on.
+}
+
+// AutoGeneratedMode controls how the export handles auto-generated messages.
+type AutoGeneratedMode int
+
+const (
+	AutoGeneratedModeInclude  AutoGeneratedMode = iota // Export them with the other messages.
+	AutoGeneratedModeExclude                           // Do not export them.
+	AutoGeneratedModeSeparate                          // Export them in the auto-generated sub folder.
+)
+
+func (m AutoGeneratedMode) String() string {
+	switch m {
+	case AutoGeneratedModeInclude:
+		return "include"
+	case AutoGeneratedModeExclude:
+		return "exclude"
+	case AutoGeneratedModeSeparate:
+		return "separate"
+	default:
+		return "unknown"
+	}
+}
+
+func AutoGeneratedModeFromString(s string) (AutoGeneratedMode, error) {
+	switch strings.ToLower(s) {
+	case "include":
+		return AutoGeneratedModeInclude, nil
+	case "exclude":
+		return AutoGeneratedModeExclude, nil
+	case "separate":
+		return AutoGeneratedModeSeparate, nil
+	default:
+		return AutoGeneratedModeInclude, fmt.Errorf("unknown auto-generated mail mode '%v'", s)
+	}
+}
+
+// getAutoGeneratedDirName returns the sub folder of the export folder the auto-generated messages are written to with
+// AutoGeneratedModeSeparate.
+func getAutoGeneratedDirName() string {
+	return "auto-generated"
+}
+
+// classifyAutoGenerated inspects the headers of a message, see RFC 3834 and RFC 2369. It returns nil for the messages
+// that appear to be written by a person.
+func classifyAutoGenerated(header string) *AutoGenerated {
+	if len(header) == 0 {
+		return nil
+	}
+
+	h, err := rfc822.NewHeader([]byte(header))
+	if err != nil {
+		return nil
+	}
+
+	result := &AutoGenerated{}
+
+	autoSubmitted := strings.ToLower(strings.TrimSpace(h.Get("Auto-Submitted")))
+	if len(autoSubmitted) != 0 && autoSubmitted != "no" {
+		result.Headers = append(result.Headers, "Auto-Submitted")
+
+		if strings.HasPrefix(autoSubmitted, "auto-replied") {
+			result.Kind = AutoGeneratedAutoReply
+		} else {
+			result.Kind = AutoGeneratedNotification
+		}
+
+		return result
+	}
+
+	for _, key := range []string{"List-Unsubscribe", "List-Id"} {
+		if h.Has(key) {
+			result.Headers = append(result.Headers, key)
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(h.Get("Precedence"))) {
+	case "bulk", "list":
+		result.Headers = append(result.Headers, "Precedence")
+	case "junk":
+		if len(result.Headers) == 0 {
+			return &AutoGenerated{Kind: AutoGeneratedNotification, Headers: []string{"Precedence"}}
+		}
+	}
+
+	if len(result.Headers) == 0 {
+		return nil
+	}
+
+	result.Kind = AutoGeneratedNewsletter
+
+	return result
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/gluon/async"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestClassifyAutoGenerated(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		kind    AutoGeneratedKind
+		headers []string
+	}{
+		{name: "no header", header: ""},
+		{name: "person", header: "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: Hi\r\n\r\n"},
+		{name: "auto-submitted no", header: "From: alice@example.com\r\nAuto-Submitted: no\r\n\r\n"},
+		{
+			name:    "notification",
+			header:  "From: noreply@example.com\r\nAuto-Submitted: auto-generated\r\n\r\n",
+			kind:    AutoGeneratedNotification,
+			headers: []string{"Auto-Submitted"},
+		},
+		{
+			name:    "auto-reply",
+			header:  "From: alice@example.com\r\nAuto-Submitted: Auto-Replied; owner-email=\"alice@example.com\"\r\n\r\n",
+			kind:    AutoGeneratedAutoReply,
+			headers: []string{"Auto-Submitted"},
+		},
+		{
+			name:    "newsletter",
+			header:  "From: news@example.com\r\nList-Unsubscribe: <mailto:unsubscribe@example.com>\r\nList-Id: <news.example.com>\r\nPrecedence: bulk\r\n\r\n",
+			kind:    AutoGeneratedNewsletter,
+			headers: []string{"List-Unsubscribe", "List-Id", "Precedence"},
+		},
+		{
+			name:    "junk",
+			header:  "From: robot@example.com\r\nPrecedence: junk\r\n\r\n",
+			kind:    AutoGeneratedNotification,
+			headers: []string{"Precedence"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := classifyAutoGenerated(test.header)
+			if test.headers == nil {
+				require.Nil(t, result)
+				return
+			}
+
+			require.NotNil(t, result)
+			require.Equal(t, test.kind, result.Kind)
+			require.Equal(t, test.headers, result.Headers)
+		})
+	}
+}
+
+func TestWriteStage_AutoGeneratedMode(t *testing.T) {
+	newMessage := func(id, header string) MessageWriter {
+		return &DecryptedAndBuiltMessageWriter{
+			msg: proton.FullMessage{Message: proton.Message{
+				MessageMetadata: proton.MessageMetadata{ID: id},
+				Header:          header,
+			}},
+			eml: *bytes.NewBufferString(header),
+		}
+	}
+
+	for _, mode := range []AutoGeneratedMode{AutoGeneratedModeInclude, AutoGeneratedModeExclude, AutoGeneratedModeSeparate} {
+		t.Run(mode.String(), func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			reporter := NewMockReporter(mockCtrl)
+			reporter.EXPECT().OnProgress(gomock.Any()).AnyTimes()
+			errReporter := NewMockStageErrorReporter(mockCtrl)
+
+			dir := t.TempDir()
+			stage := NewWriteStage(t.TempDir(), dir, 2, logrus.WithField("test", "test"), reporter, &async.NoopPanicHandler{})
+			stage.SetAutoGeneratedMode(mode)
+
+			inputs := make(chan BuildStageOutput, 1)
+			inputs <- BuildStageOutput{messages: []MessageWriter{
+				newMessage("human", "From: alice@example.com\r\n\r\n"),
+				newMessage("newsletter", "From: news@example.com\r\nList-Unsubscribe: <mailto:u@example.com>\r\n\r\n"),
+			}}
+			close(inputs)
+
+			stage.Run(context.Background(), inputs, errReporter)
+
+			require.Equal(t, uint64(1), stage.GetAutoGeneratedCount())
+			require.FileExists(t, filepath.Join(dir, getMetadataFileName("human")))
+
+			rootPath := filepath.Join(dir, getMetadataFileName("newsletter"))
+			separatePath := filepath.Join(dir, getAutoGeneratedDirName(), getMetadataFileName("newsletter"))
+
+			switch mode {
+			case AutoGeneratedModeInclude:
+				require.Equal(t, uint64(2), stage.GetWrittenCount())
+				require.FileExists(t, rootPath)
+			case AutoGeneratedModeExclude:
+				require.Equal(t, uint64(1), stage.GetWrittenCount())
+				require.Equal(t, uint64(1), stage.GetExcludedCount())
+				require.NoFileExists(t, rootPath)
+				require.NoDirExists(t, filepath.Join(dir, getAutoGeneratedDirName()))
+			case AutoGeneratedModeSeparate:
+				require.Equal(t, uint64(2), stage.GetWrittenCount())
+				require.NoFileExists(t, rootPath)
+				require.FileExists(t, separatePath)
+				require.FileExists(t, filepath.Join(dir, getAutoGeneratedDirName(), "newsletter"+emlExtension))
+
+				b, err := os.ReadFile(separatePath) //nolint:gosec
+				require.NoError(t, err)
+				require.Contains(t, string(b), `"AutoGenerated"`)
+			}
+		})
+	}
+}
+
+func TestAutoGeneratedModeFromString(t *testing.T) {
+	mode, err := AutoGeneratedModeFromString("Separate")
+	require.NoError(t, err)
+	require.Equal(t, AutoGeneratedModeSeparate, mode)
+
+	_, err = AutoGeneratedModeFromString("humans")
+	require.Error(t, err)
+}
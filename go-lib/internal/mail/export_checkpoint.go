@@ -0,0 +1,312 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Checkpoints
+// -----------
+// The metadata stage lists the messages page by page, newest first, and the following stages process the messages of
+// several pages concurrently. The checkpoint records the cursor of the listing, the last message of the last page whose
+// messages were all processed, and the messages processed after the cursor. A resumed export lists the messages from
+// the cursor and skips the processed ones. The checkpoint is written periodically while the export runs and removed
+// once it succeeded.
+//
+// A message is processed once written, or once it is known it will not be written, e.g. because it does not match the
+// filter. A message written right before a crash can be written again, which duplicates it in mbox files.
+
+const ExportCheckpointVersion = 1
+
+// checkpointInterval is the minimum time between two writes of the checkpoint caused by message progress.
+const checkpointInterval = 5 * time.Second
+
+var ErrResumeNotSupported = errors.New("incremental exports are resumed by the next incremental run")
+
+var ErrCheckpointMismatch = errors.New("the checkpoint was created with other export options")
+
+type ExportCheckpoint struct {
+	UserID       string
+	OutputFormat OutputFormat
+	Shard        string   `json:",omitempty"`
+	Cursor       string   // ID of the last listed message of the last page whose messages were all processed.
+	CursorCount  uint64   // Number of messages up to the cursor.
+	ProcessedIDs []string // Messages processed after the cursor.
+	UpdateTime   time.Time
+}
+
+func getCheckpointFileName() string {
+	return "checkpoint.json"
+}
+
+// LoadExportCheckpoint reads the checkpoint of an export directory.
+func LoadExportCheckpoint(exportDir string) (ExportCheckpoint, error) {
+	b, err := os.ReadFile(filepath.Join(exportDir, getCheckpointFileName())) //nolint:gosec
+	if err != nil {
+		return ExportCheckpoint{}, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	checkpoint, err := utils.NewVersionedJSON[ExportCheckpoint](ExportCheckpointVersion, b)
+	if err != nil {
+		return ExportCheckpoint{}, fmt.Errorf("failed to parse checkpoint: %w", err)
+	}
+
+	return checkpoint.Payload, nil
+}
+
+// findResumableExport returns the most recent export of userID next to exportDir that has a checkpoint. The returned
+// path is empty if there is none.
+func findResumableExport(exportDir, userID string) (string, error) {
+	return findPreviousExport(exportDir, func(path string) (bool, error) {
+		checkpoint, err := LoadExportCheckpoint(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		return checkpoint.UserID == userID, nil
+	})
+}
+
+type checkpointPage struct {
+	lastID  string
+	ids     []string // All the messages of the page, including the skipped ones.
+	pending int
+}
+
+// checkpointTracker follows the processed messages of an export and writes its checkpoint. It implements
+// MetadataFileChecker to skip the messages processed before the export was resumed. It is safe for concurrent use.
+type checkpointTracker struct {
+	lock       sync.Mutex
+	checkpoint ExportCheckpoint
+	previous   map[string]struct{} // Processed after the cursor before the export was resumed.
+	processed  map[string]struct{} // Processed after the cursor since the export was resumed.
+	pages      []*checkpointPage   // Pages listed after the cursor, in listing order.
+	pendingIDs map[string]*checkpointPage
+	tmpDir     string
+	exportDir  string
+	log        *logrus.Entry
+	lastWrite  time.Time
+	now        func() time.Time
+}
+
+func newCheckpointTracker(checkpoint ExportCheckpoint, tmpDir, exportDir string, log *logrus.Entry) *checkpointTracker {
+	previous := make(map[string]struct{}, len(checkpoint.ProcessedIDs))
+	for _, id := range checkpoint.ProcessedIDs {
+		previous[id] = struct{}{}
+	}
+
+	return &checkpointTracker{
+		checkpoint: checkpoint,
+		previous:   previous,
+		processed:  make(map[string]struct{}),
+		pendingIDs: make(map[string]*checkpointPage),
+		tmpDir:     tmpDir,
+		exportDir:  exportDir,
+		log:        log,
+		lastWrite:  time.Now(),
+		now:        time.Now,
+	}
+}
+
+// getCursor returns the message the listing resumes from and the number of messages up to it.
+func (c *checkpointTracker) getCursor() (string, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.checkpoint.Cursor, c.checkpoint.CursorCount
+}
+
+func (c *checkpointTracker) HasMessage(id string) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.previous[id]
+
+	return ok, nil
+}
+
+// listPage records a page of ids, whose last message is lastID, before its pending messages are passed to the next
+// stage. The other messages of the page were skipped by the metadata stage.
+func (c *checkpointTracker) listPage(lastID string, ids, pending []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	page := &checkpointPage{lastID: lastID, ids: ids, pending: len(pending)}
+	for _, id := range pending {
+		c.pendingIDs[id] = page
+	}
+
+	c.pages = append(c.pages, page)
+	c.advance()
+}
+
+func (c *checkpointTracker) markProcessed(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.processed[id] = struct{}{}
+
+	if page, ok := c.pendingIDs[id]; ok {
+		delete(c.pendingIDs, id)
+		page.pending--
+	}
+
+	c.advance()
+
+	if err := c.write(false); err != nil {
+		c.log.WithError(err).Warn("Failed to update checkpoint")
+	}
+}
+
+// advance moves the cursor past the pages whose messages were all processed. The lock must be held.
+func (c *checkpointTracker) advance() {
+	for len(c.pages) != 0 && c.pages[0].pending == 0 {
+		page := c.pages[0]
+		c.pages = c.pages[1:]
+
+		c.checkpoint.Cursor = page.lastID
+		c.checkpoint.CursorCount += uint64(len(page.ids))
+
+		for _, id := range page.ids {
+			delete(c.previous, id)
+			delete(c.processed, id)
+		}
+	}
+}
+
+// finish removes the checkpoint of a complete export and writes it otherwise.
+func (c *checkpointTracker) finish(complete bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !complete {
+		return c.write(true)
+	}
+
+	if err := os.Remove(filepath.Join(c.exportDir, getCheckpointFileName())); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// write updates the checkpoint, at most once per checkpointInterval unless force is set. The lock must be held.
+func (c *checkpointTracker) write(force bool) error {
+	now := c.now()
+	if !force && now.Sub(c.lastWrite) < checkpointInterval {
+		return nil
+	}
+
+	c.lastWrite = now
+	c.checkpoint.UpdateTime = now.UTC()
+
+	c.checkpoint.ProcessedIDs = make([]string, 0, len(c.previous)+len(c.processed))
+	for id := range c.previous {
+		c.checkpoint.ProcessedIDs = append(c.checkpoint.ProcessedIDs, id)
+	}
+
+	for id := range c.processed {
+		if _, ok := c.previous[id]; !ok {
+			c.checkpoint.ProcessedIDs = append(c.checkpoint.ProcessedIDs, id)
+		}
+	}
+
+	sort.Strings(c.checkpoint.ProcessedIDs)
+
+	data, err := utils.GenerateVersionedJSON(ExportCheckpointVersion, &c.checkpoint)
+	if err != nil {
+		return fmt.Errorf("failed to json encode checkpoint: %w", err)
+	}
+
+	if err := utils.WriteFileSafe(c.tmpDir, filepath.Join(c.exportDir, getCheckpointFileName()), data, nil); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// SetResume makes the export continue the most recent interrupted export of the account next to the export path from
+// its checkpoint, instead of creating a new one. A new export is created if there is none. The export must be resumed
+// with the same options, the output format and the shard are checked.
+func (e *ExportTask) SetResume(enabled bool) error {
+	e.resume = enabled
+
+	if !enabled {
+		return nil
+	}
+
+	previous, err := findResumableExport(e.exportDir, e.session.GetUser().ID)
+	if err != nil {
+		return err
+	}
+
+	if len(previous) != 0 {
+		e.exportDir = previous
+		e.tmpDir = filepath.Join(previous, "temp")
+	}
+
+	return nil
+}
+
+func (e *ExportTask) GetResume() bool {
+	return e.resume
+}
+
+// newCheckpointTracker loads the checkpoint of a resumed export. The returned bool is set if the export was resumed.
+func (e *ExportTask) newCheckpointTracker(userID string) (*checkpointTracker, bool, error) {
+	checkpoint := ExportCheckpoint{UserID: userID, OutputFormat: e.outputFormat}
+	if e.shard != nil {
+		checkpoint.Shard = e.shard.String()
+	}
+
+	resumed := false
+
+	if e.resume {
+		if e.incremental {
+			return nil, false, ErrResumeNotSupported
+		}
+
+		previous, err := LoadExportCheckpoint(e.exportDir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, false, err
+		}
+
+		if err == nil {
+			if previous.UserID != checkpoint.UserID || previous.OutputFormat != checkpoint.OutputFormat || previous.Shard != checkpoint.Shard {
+				return nil, false, ErrCheckpointMismatch
+			}
+
+			checkpoint = previous
+			resumed = true
+		}
+	}
+
+	return newCheckpointTracker(checkpoint, e.tmpDir, e.exportDir, e.log), resumed, nil
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestCheckpointTracker(t *testing.T) {
+	dir := t.TempDir()
+	tmpDir := filepath.Join(dir, "temp")
+	require.NoError(t, os.MkdirAll(tmpDir, 0o700))
+
+	tracker := newCheckpointTracker(ExportCheckpoint{UserID: "user"}, tmpDir, dir, logrus.WithField("test", "test"))
+
+	// Message b was filtered out by the metadata stage.
+	tracker.listPage("c", []string{"a", "b", "c"}, []string{"a", "c"})
+	tracker.listPage("e", []string{"d", "e"}, []string{"d", "e"})
+
+	tracker.markProcessed("e")
+	tracker.markProcessed("a")
+	cursor, count := tracker.getCursor()
+	require.Empty(t, cursor)
+	require.Zero(t, count)
+
+	tracker.markProcessed("c")
+	cursor, count = tracker.getCursor()
+	require.Equal(t, "c", cursor)
+	require.Equal(t, uint64(3), count)
+
+	require.NoError(t, tracker.finish(false))
+
+	checkpoint, err := LoadExportCheckpoint(dir)
+	require.NoError(t, err)
+	require.Equal(t, "user", checkpoint.UserID)
+	require.Equal(t, "c", checkpoint.Cursor)
+	require.Equal(t, []string{"e"}, checkpoint.ProcessedIDs)
+
+	// The resumed export skips the processed messages until the cursor moves past them.
+	tracker = newCheckpointTracker(checkpoint, tmpDir, dir, logrus.WithField("test", "test"))
+	skip, err := tracker.HasMessage("e")
+	require.NoError(t, err)
+	require.True(t, skip)
+
+	tracker.listPage("e", []string{"d", "e"}, []string{"d"})
+	tracker.markProcessed("d")
+	cursor, count = tracker.getCursor()
+	require.Equal(t, "e", cursor)
+	require.Equal(t, uint64(5), count)
+
+	skip, err = tracker.HasMessage("e")
+	require.NoError(t, err)
+	require.False(t, skip)
+
+	require.NoError(t, tracker.finish(true))
+	_, err = LoadExportCheckpoint(dir)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFindResumableExport(t *testing.T) {
+	root := t.TempDir()
+
+	for dir, userID := range map[string]string{"mail_20240101_000000": "user", "mail_20240102_000000": "other"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0o700))
+
+		tracker := newCheckpointTracker(ExportCheckpoint{UserID: userID}, t.TempDir(), filepath.Join(root, dir), logrus.WithField("test", "test"))
+		require.NoError(t, tracker.finish(false))
+	}
+
+	path, err := findResumableExport(filepath.Join(root, "mail_20240103_000000"), "user")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(root, "mail_20240101_000000"), path)
+
+	path, err = findResumableExport(filepath.Join(root, "mail_20240103_000000"), "unknown")
+	require.NoError(t, err)
+	require.Empty(t, path)
+}
+
+func TestMetadataStage_RunResumed(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+	errReporter := NewMockStageErrorReporter(mockCtrl)
+	reporter := NewMockReporter(mockCtrl)
+
+	const pageSize = 2
+
+	all := testMetadata(10)
+
+	// The listing restarts from the cursor.
+	for i := 3; i < len(all); i++ {
+		client.EXPECT().GetMessageMetadataPage(gomock.Any(), gomock.Eq(0), gomock.Eq(pageSize), gomock.Eq(proton.MessageFilter{
+			EndID: all[i].ID,
+			Desc:  true,
+		})).Return(all[i:min(i+pageSize, len(all))], nil)
+	}
+
+	reporter.EXPECT().OnProgress(1)
+
+	checkpoint := newCheckpointTracker(ExportCheckpoint{
+		UserID:       "user",
+		Cursor:       all[3].ID,
+		CursorCount:  4,
+		ProcessedIDs: []string{all[5].ID},
+	}, t.TempDir(), t.TempDir(), logrus.WithField("test", "test"))
+
+	metadata := NewMetadataStage(client, logrus.WithField("test", "test"), pageSize, 1)
+	metadata.setCheckpointTracker(checkpoint)
+
+	go func() {
+		metadata.Run(context.Background(), errReporter, checkpoint, reporter)
+	}()
+
+	result := make([]proton.MessageMetadata, 0, 5)
+	for out := range metadata.outputCh {
+		result = append(result, out...)
+	}
+
+	require.Equal(t, append(append([]proton.MessageMetadata{}, all[4]), all[6:]...), result)
+
+	for _, m := range result {
+		checkpoint.markProcessed(m.ID)
+	}
+
+	cursor, count := checkpoint.getCursor()
+	require.Equal(t, all[9].ID, cursor)
+	require.Equal(t, uint64(len(all)), count)
+}
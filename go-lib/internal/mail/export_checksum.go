@@ -0,0 +1,333 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/sirupsen/logrus"
+)
+
+// Checksums
+// ---------
+// A successful export run ends by writing the checksum manifest, which lists the size and SHA-256 digest of every file
+// of the export directory. VerifyExport hashes the files again, possibly years later, and reports those that were
+// corrupted or lost since. The files of an incremental export whose size and modification time did not change since
+// the previous run keep their digest instead of being read again. The files rewritten after the manifest, the progress
+// file, the relocation manifest and the parity data, are not listed. When the export has a checksum recipient, e.g.
+// the compliance officer the audit log is encrypted to, the manifest is also written encrypted to their key, so that
+// they hold a copy of the digests which cannot be rewritten along with the files of the export.
+
+const ChecksumManifestVersion = 1
+
+type ChecksumFile struct {
+	Path    string // Relative to the export directory, with forward slashes.
+	Size    int64
+	ModTime time.Time
+	SHA256  string
+}
+
+type ChecksumManifest struct {
+	Time  time.Time
+	Files []ChecksumFile
+}
+
+func getChecksumManifestFileName() string {
+	return "checksums.json"
+}
+
+func getEncryptedChecksumManifestFileName() string {
+	return "checksums.json.asc"
+}
+
+// LoadChecksumManifest reads the checksum manifest of an export directory.
+func LoadChecksumManifest(exportDir string) (ChecksumManifest, error) {
+	b, err := os.ReadFile(filepath.Join(exportDir, getChecksumManifestFileName())) //nolint:gosec
+	if err != nil {
+		return ChecksumManifest{}, fmt.Errorf("failed to read checksum manifest: %w", err)
+	}
+
+	manifest, err := utils.NewVersionedJSON[ChecksumManifest](ChecksumManifestVersion, b)
+	if err != nil {
+		return ChecksumManifest{}, fmt.Errorf("failed to parse checksum manifest: %w", err)
+	}
+
+	return manifest.Payload, nil
+}
+
+// isChecksummedFile returns whether the file at rel, relative to the export directory, is listed in the manifest.
+func isChecksummedFile(rel string) bool {
+	switch rel {
+	case getChecksumManifestFileName(), getEncryptedChecksumManifestFileName(), getProgressFileName(),
+		getRelocationManifestFileName(), getParityManifestFileName(), getParityDataFileName():
+		return false
+	}
+
+	return true
+}
+
+// walkChecksummedFiles calls fn for the files of exportDir listed in the checksum manifest.
+func walkChecksummedFiles(ctx context.Context, exportDir string, fn func(rel, path string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(exportDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(exportDir, path)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+
+		if entry.IsDir() {
+			if rel == "temp" {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !entry.Type().IsRegular() || !isChecksummedFile(rel) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		return fn(rel, path, info)
+	})
+}
+
+// writeChecksumManifest hashes the files of the export and writes the checksum manifest.
+func writeChecksumManifest(ctx context.Context, tmpDir, exportDir string, log *logrus.Entry) error {
+	previous := make(map[string]ChecksumFile)
+
+	if manifest, err := LoadChecksumManifest(exportDir); err == nil {
+		for _, file := range manifest.Files {
+			previous[file.Path] = file
+		}
+	}
+
+	manifest := ChecksumManifest{Time: time.Now().UTC()}
+	reused := 0
+
+	if err := walkChecksummedFiles(ctx, exportDir, func(rel, path string, info fs.FileInfo) error {
+		file := ChecksumFile{Path: rel, Size: info.Size(), ModTime: info.ModTime().UTC()}
+
+		if old, ok := previous[rel]; ok && old.Size == file.Size && old.ModTime.Equal(file.ModTime) {
+			file.SHA256 = old.SHA256
+			reused++
+		} else {
+			hashed, err := hashFile(path)
+			if err != nil {
+				return err
+			}
+
+			file.Size = hashed.Size
+			file.SHA256 = hashed.SHA256
+		}
+
+		manifest.Files = append(manifest.Files, file)
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to hash export: %w", err)
+	}
+
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+
+	data, err := utils.GenerateVersionedJSON(ChecksumManifestVersion, &manifest)
+	if err != nil {
+		return fmt.Errorf("failed to json encode checksum manifest: %w", err)
+	}
+
+	if err := utils.WriteFileSafe(tmpDir, filepath.Join(exportDir, getChecksumManifestFileName()), data, &utils.Sha256IntegrityChecker{}); err != nil {
+		return fmt.Errorf("failed to write checksum manifest: %w", err)
+	}
+
+	log.WithField("files", len(manifest.Files)).WithField("unchanged", reused).Info("Wrote checksum manifest")
+
+	return nil
+}
+
+// writeEncryptedChecksumManifest writes the checksum manifest encrypted to recipient next to it. The copy of a previous
+// run is removed if recipient is nil.
+func writeEncryptedChecksumManifest(tmpDir, exportDir string, recipient *crypto.KeyRing) error {
+	path := filepath.Join(exportDir, getEncryptedChecksumManifestFileName())
+
+	if recipient == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove previous encrypted checksum manifest: %w", err)
+		}
+
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(exportDir, getChecksumManifestFileName())) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("failed to read checksum manifest: %w", err)
+	}
+
+	encrypted, err := recipient.Encrypt(crypto.NewPlainMessage(data), nil)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt checksum manifest: %w", err)
+	}
+
+	armored, err := encrypted.GetArmored()
+	if err != nil {
+		return fmt.Errorf("failed to armor checksum manifest: %w", err)
+	}
+
+	if err := utils.WriteFileSafe(tmpDir, path, []byte(armored), &utils.Sha256IntegrityChecker{}); err != nil {
+		return fmt.Errorf("failed to write encrypted checksum manifest: %w", err)
+	}
+
+	return nil
+}
+
+// SetChecksumRecipient writes the checksum manifest encrypted to recipient as well, see Checksums. Nil disables it.
+func (e *ExportTask) SetChecksumRecipient(recipient *crypto.KeyRing) {
+	e.checksumRecipient = recipient
+}
+
+// VerifyIssueType tells what is wrong with a file listed in the checksum manifest.
+type VerifyIssueType int
+
+const (
+	VerifyIssueCorrupted VerifyIssueType = iota // The content of the file does not match its checksum.
+	VerifyIssueMissing                          // The file is listed in the manifest but does not exist.
+	VerifyIssueUnlisted                         // The file exists but is not listed, it was added after the manifest.
+)
+
+func (v VerifyIssueType) String() string {
+	switch v {
+	case VerifyIssueCorrupted:
+		return "corrupted"
+	case VerifyIssueMissing:
+		return "missing"
+	case VerifyIssueUnlisted:
+		return "unlisted"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(v))
+	}
+}
+
+type VerifyIssue struct {
+	Type     VerifyIssueType
+	Path     string // Relative to the export directory, with forward slashes.
+	Detail   string `json:",omitempty"`
+	Repaired bool   `json:",omitempty"` // The file was rebuilt from the parity data, see RepairExportWithParity.
+}
+
+// VerifyReport is the outcome of the verification of an export directory.
+type VerifyReport struct {
+	ManifestTime time.Time
+	FileCount    int // Files listed in the manifest.
+	Issues       []VerifyIssue
+	Duration     time.Duration
+}
+
+// GetDamagedCount returns the number of corrupted or missing files which were not repaired.
+func (v *VerifyReport) GetDamagedCount() int {
+	var count int
+
+	for i := range v.Issues {
+		if v.Issues[i].Type != VerifyIssueUnlisted && !v.Issues[i].Repaired {
+			count++
+		}
+	}
+
+	return count
+}
+
+// VerifyExport hashes the files of exportDir again and compares them with its checksum manifest. The directory is not
+// modified.
+func VerifyExport(ctx context.Context, exportDir string) (VerifyReport, error) {
+	startTime := time.Now()
+	log := logrus.WithField("verify", "mail").WithField("path", exportDir)
+
+	manifest, err := LoadChecksumManifest(exportDir)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	report := VerifyReport{ManifestTime: manifest.Time, FileCount: len(manifest.Files)}
+
+	listed := make(map[string]ChecksumFile, len(manifest.Files))
+	for _, file := range manifest.Files {
+		listed[file.Path] = file
+	}
+
+	log.WithField("files", len(listed)).Info("Verifying export")
+
+	if err := walkChecksummedFiles(ctx, exportDir, func(rel, path string, _ fs.FileInfo) error {
+		file, ok := listed[rel]
+		if !ok {
+			report.Issues = append(report.Issues, VerifyIssue{Type: VerifyIssueUnlisted, Path: rel})
+			return nil
+		}
+
+		delete(listed, rel)
+
+		hashed, err := hashFile(path)
+		if err != nil {
+			report.Issues = append(report.Issues, VerifyIssue{Type: VerifyIssueCorrupted, Path: rel, Detail: err.Error()})
+			return nil //nolint:nilerr // Unreadable files are reported.
+		}
+
+		if hashed.Size != file.Size || hashed.SHA256 != file.SHA256 {
+			report.Issues = append(report.Issues, VerifyIssue{
+				Type:   VerifyIssueCorrupted,
+				Path:   rel,
+				Detail: fmt.Sprintf("expected %v bytes with SHA-256 %v, found %v bytes with SHA-256 %v", file.Size, file.SHA256, hashed.Size, hashed.SHA256),
+			})
+		}
+
+		return nil
+	}); err != nil {
+		return report, fmt.Errorf("failed to verify export: %w", err)
+	}
+
+	for rel := range listed {
+		report.Issues = append(report.Issues, VerifyIssue{Type: VerifyIssueMissing, Path: rel})
+	}
+
+	sort.Slice(report.Issues, func(i, j int) bool { return report.Issues[i].Path < report.Issues[j].Path })
+
+	report.Duration = time.Since(startTime)
+
+	log.WithField("issues", len(report.Issues)).WithField("damaged", report.GetDamagedCount()).Info("Verification finished")
+
+	return report, nil
+}
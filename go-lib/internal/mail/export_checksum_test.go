@@ -0,0 +1,134 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyExport(t *testing.T) {
+	dir := t.TempDir()
+	tmpDir := filepath.Join(dir, "temp")
+	log := logrus.WithField("test", "test")
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "2024"), 0o700))
+	require.NoError(t, os.MkdirAll(tmpDir, 0o700))
+
+	for name, content := range map[string]string{
+		getLabelFileName():              "[]",
+		getEMLFileName("msg-1"):         "Subject: 1\r\n\r\n",
+		getEMLFileName("msg-2"):         "Subject: 2\r\n\r\n",
+		"2024/" + getEMLFileName("msg"): "Subject: 3\r\n\r\n",
+		getProgressFileName():           "{}",
+		"temp/leftover":                 "tmp",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(content), 0o600))
+	}
+
+	require.NoError(t, writeChecksumManifest(context.Background(), tmpDir, dir, log))
+
+	manifest, err := LoadChecksumManifest(dir)
+	require.NoError(t, err)
+	require.Len(t, manifest.Files, 4)
+	require.Equal(t, "2024/"+getEMLFileName("msg"), manifest.Files[0].Path)
+
+	report, err := VerifyExport(context.Background(), dir)
+	require.NoError(t, err)
+	require.Equal(t, 4, report.FileCount)
+	require.Empty(t, report.Issues)
+
+	// The progress file is rewritten after the manifest.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getProgressFileName()), []byte(`{"Stage":"finished"}`), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getEMLFileName("msg-1")), []byte("Subject: X\r\n\r\n"), 0o600))
+	require.NoError(t, os.Remove(filepath.Join(dir, getEMLFileName("msg-2"))))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getEMLFileName("msg-3")), []byte("Subject: 3\r\n\r\n"), 0o600))
+
+	report, err = VerifyExport(context.Background(), dir)
+	require.NoError(t, err)
+	require.Equal(t, []VerifyIssue{
+		{Type: VerifyIssueCorrupted, Path: getEMLFileName("msg-1"), Detail: report.Issues[0].Detail},
+		{Type: VerifyIssueMissing, Path: getEMLFileName("msg-2")},
+		{Type: VerifyIssueUnlisted, Path: getEMLFileName("msg-3")},
+	}, report.Issues)
+	require.Equal(t, 2, report.GetDamagedCount())
+
+	// A new run lists the current files.
+	require.NoError(t, writeChecksumManifest(context.Background(), tmpDir, dir, log))
+
+	report, err = VerifyExport(context.Background(), dir)
+	require.NoError(t, err)
+	require.Empty(t, report.Issues)
+}
+
+func TestVerifyExport_NoManifest(t *testing.T) {
+	_, err := VerifyExport(context.Background(), t.TempDir())
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestWriteEncryptedChecksumManifest(t *testing.T) {
+	dir := t.TempDir()
+	tmpDir := filepath.Join(dir, "temp")
+	log := logrus.WithField("test", "test")
+
+	require.NoError(t, os.MkdirAll(tmpDir, 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getEMLFileName("msg-1")), []byte("Subject: 1\r\n\r\n"), 0o600))
+	require.NoError(t, writeChecksumManifest(context.Background(), tmpDir, dir, log))
+
+	key, err := crypto.GenerateKey("Compliance", "compliance@example.com", "x25519", 0)
+	require.NoError(t, err)
+
+	keyRing, err := crypto.NewKeyRing(key)
+	require.NoError(t, err)
+
+	publicKey, err := key.ToPublic()
+	require.NoError(t, err)
+
+	recipient, err := crypto.NewKeyRing(publicKey)
+	require.NoError(t, err)
+
+	require.NoError(t, writeEncryptedChecksumManifest(tmpDir, dir, recipient))
+
+	armored, err := os.ReadFile(filepath.Join(dir, getEncryptedChecksumManifestFileName()))
+	require.NoError(t, err)
+
+	encrypted, err := crypto.NewPGPMessageFromArmored(string(armored))
+	require.NoError(t, err)
+
+	decrypted, err := keyRing.Decrypt(encrypted, nil, 0)
+	require.NoError(t, err)
+
+	manifest, err := os.ReadFile(filepath.Join(dir, getChecksumManifestFileName()))
+	require.NoError(t, err)
+	require.Equal(t, manifest, decrypted.GetBinary())
+
+	// The encrypted copy is not listed in the manifest.
+	report, err := VerifyExport(context.Background(), dir)
+	require.NoError(t, err)
+	require.Empty(t, report.Issues)
+
+	// Without a recipient, the copy of the previous run is removed.
+	require.NoError(t, writeEncryptedChecksumManifest(tmpDir, dir, nil))
+	require.NoFileExists(t, filepath.Join(dir, getEncryptedChecksumManifestFileName()))
+}
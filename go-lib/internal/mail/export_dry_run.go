@@ -0,0 +1,225 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+)
+
+// ExportPlan describes what an export would do with the current settings, see DryRun.
+type ExportPlan struct {
+	ExportPath     string // Destination directory, created by the export.
+	MessageCount   uint64
+	TotalSize      uint64 // Sum of the message sizes reported by the API.
+	EstimatedBytes uint64 // Approximate disk usage of the exported messages.
+	Files          []string
+	Messages       []PlannedMessage
+	Caveats        []string `json:",omitempty"` // Settings the plan cannot account for without downloading messages.
+}
+
+// PlannedMessage is a message an export would write.
+type PlannedMessage struct {
+	ID      string
+	Subject string
+	Time    int64
+	Size    int
+	Files   []string // Paths relative to the export directory.
+}
+
+// DryRun lists the metadata of the mailbox and applies the shard and filter of the export without downloading any
+// message or writing any file. Only one of DryRun and Run may be running at a time.
+func (e *ExportTask) DryRun(ctx context.Context) (ExportPlan, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	plan := ExportPlan{ExportPath: e.exportDir, Files: []string{getLabelFileName(), getSenderVerificationFileName(), getProgressFileName()}}
+
+	if e.atRestKey == nil {
+		plan.Files = append(plan.Files, getMessageIndexFileName())
+	}
+
+	if e.shard != nil {
+		plan.Files = append(plan.Files, getShardManifestFileName())
+	} else if e.filter == nil {
+		plan.Files = append(plan.Files, getSnapshotFileName())
+	}
+
+	if e.filter != nil && e.filter.HasBodyCriteria() {
+		plan.Caveats = append(plan.Caveats, "body keywords and languages are only checked once the messages are downloaded, the plan is an upper bound")
+	}
+
+	switch e.autoGeneratedMode {
+	case AutoGeneratedModeExclude:
+		plan.Caveats = append(plan.Caveats, "auto-generated messages are detected from their headers, the plan includes the messages that will be excluded")
+	case AutoGeneratedModeSeparate:
+		plan.Caveats = append(plan.Caveats, "auto-generated messages are detected from their headers, some planned files will be written to the '"+getAutoGeneratedDirName()+"' folder instead")
+	case AutoGeneratedModeInclude:
+	}
+
+	names, err := newPathNamer(e.pathBudget, e.exportDir)
+	if err != nil {
+		return ExportPlan{}, err
+	}
+
+	names.setSplitByYear(e.splitByYear)
+
+	if err := names.validate(); err != nil {
+		return ExportPlan{}, err
+	}
+
+	if e.atRestKey != nil {
+		if e.shard != nil || e.outputFormat != OutputFormatEML {
+			return ExportPlan{}, ErrAtRestNotSupported
+		}
+
+		plan.Files = append(plan.Files, getAtRestEncryptionFileName())
+	}
+
+	if err := e.checkArchiveOptions(); err != nil {
+		return ExportPlan{}, err
+	}
+
+	if e.splitByYear {
+		if e.shard != nil {
+			return ExportPlan{}, ErrSplitByYearNotSupported
+		}
+
+		plan.Caveats = append(plan.Caveats, "the labels file and the year manifest are also written to each year folder")
+	}
+
+	var labelWriter labelFileWriter
+	if e.outputFormat == OutputFormatPack {
+		labelWriter = newPackWriter(e.tmpDir, PackFileMaxSize)
+	} else if e.outputFormat.isArchive() {
+		labelWriter = &archiveWriter{format: e.outputFormat}
+	} else if e.outputFormat != OutputFormatEML {
+		labels, err := e.session.GetClient().GetLabels(ctx, proton.LabelTypeFolder, proton.LabelTypeLabel)
+		if err != nil {
+			return ExportPlan{}, fmt.Errorf("failed to retrieve labels: %w", err)
+		}
+
+		labelWriter = newLabelFileWriter(e.outputFormat, labels, names)
+	}
+
+	metaStage := NewMetadataStage(e.session.GetClient(), e.log, MetadataPageSize, MetadataPageSize)
+	metaStage.SetShard(e.shard)
+	metaStage.SetFilter(e.filter)
+
+	errReporter := &dryRunErrReporter{cancel: cancel}
+
+	e.group.Once(func(_ context.Context) {
+		metaStage.Run(ctx, errReporter, &alwaysMissingMetadataFileChecker{}, &NullProgressReporter{})
+	})
+
+	for page := range metaStage.outputCh {
+		for i := range page {
+			plan.add(&page[i], labelWriter)
+
+			planned := &plan.Messages[len(plan.Messages)-1]
+			for j := range planned.Files {
+				if e.atRestKey != nil {
+					planned.Files[j] += sealedExtension
+				}
+
+				if e.splitByYear {
+					planned.Files[j] = getYearDirName(time.Unix(page[i].Time, 0).UTC().Year()) + "/" + planned.Files[j]
+				}
+			}
+		}
+	}
+
+	e.group.WaitToFinish()
+
+	if err := errReporter.get(); err != nil {
+		return ExportPlan{}, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return ExportPlan{}, err
+	}
+
+	plan.EstimatedBytes = approximateDiskUsage(plan.TotalSize)
+
+	return plan, nil
+}
+
+// GetFileCount returns the number of files the export would create. Mbox files are shared by several messages.
+func (p *ExportPlan) GetFileCount() int {
+	files := make(map[string]struct{}, len(p.Files)+2*len(p.Messages))
+
+	for _, file := range p.Files {
+		files[file] = struct{}{}
+	}
+
+	for i := range p.Messages {
+		for _, file := range p.Messages[i].Files {
+			files[file] = struct{}{}
+		}
+	}
+
+	return len(files)
+}
+
+// add records a message of the plan, labelWriter is nil if the messages are written as EML files.
+func (p *ExportPlan) add(meta *proton.MessageMetadata, labelWriter labelFileWriter) {
+	files := []string{getMetadataFileName(meta.ID), getEMLFileName(meta.ID)}
+	if _, ok := labelWriter.(bundleWriter); ok {
+		files = labelWriter.getFilePaths(meta)
+	} else if labelWriter != nil {
+		files = append(files[:1], labelWriter.getFilePaths(meta)...)
+	}
+
+	p.MessageCount++
+	p.TotalSize += uint64(meta.Size)
+
+	p.Messages = append(p.Messages, PlannedMessage{
+		ID:      meta.ID,
+		Subject: meta.Subject,
+		Time:    meta.Time,
+		Size:    meta.Size,
+		Files:   files,
+	})
+}
+
+type dryRunErrReporter struct {
+	lock   sync.Mutex
+	err    error
+	cancel context.CancelFunc
+}
+
+func (d *dryRunErrReporter) ReportStageError(err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.err == nil {
+		d.err = err
+		d.cancel()
+	}
+}
+
+func (d *dryRunErrReporter) get() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.err
+}
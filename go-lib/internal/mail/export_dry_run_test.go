@@ -0,0 +1,82 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestExportPlan_Add(t *testing.T) {
+	plan := ExportPlan{Files: []string{getLabelFileName()}}
+
+	for _, meta := range testMetadata(3) {
+		meta.Size = 100
+		plan.add(&meta, nil)
+	}
+
+	require.Equal(t, uint64(3), plan.MessageCount)
+	require.Equal(t, uint64(300), plan.TotalSize)
+	require.Equal(t, 7, plan.GetFileCount())
+	require.Equal(t, []string{getMetadataFileName(plan.Messages[0].ID), getEMLFileName(plan.Messages[0].ID)}, plan.Messages[0].Files)
+}
+
+func TestExportTask_DryRun(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+
+	metadata := testMetadata(3)
+	for i := range metadata {
+		metadata[i].Size = 1000 * (i + 1)
+		metadata[i].Subject = fmt.Sprintf("Message %v", i)
+	}
+
+	encodeMetadataExpectations(client, metadata, MetadataPageSize)
+
+	exportPath := t.TempDir()
+	task := NewExportTask(context.Background(), exportPath, newMockSession(t, mockCtrl, client))
+	defer task.Close()
+
+	plan, err := task.DryRun(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, task.exportDir, plan.ExportPath)
+	require.Equal(t, uint64(3), plan.MessageCount)
+	require.Equal(t, uint64(6000), plan.TotalSize)
+	require.Equal(t, approximateDiskUsage(6000), plan.EstimatedBytes)
+	require.Len(t, plan.Messages, 3)
+
+	for i, message := range plan.Messages {
+		require.Equal(t, metadata[i].ID, message.ID)
+		require.Equal(t, metadata[i].Subject, message.Subject)
+		require.Equal(t, metadata[i].Size, message.Size)
+		require.Equal(t, []string{getMetadataFileName(message.ID), getEMLFileName(message.ID)}, message.Files)
+	}
+
+	require.Equal(t, len(plan.Files)+6, plan.GetFileCount())
+
+	// Nothing was written, not even the export folder.
+	entries, err := os.ReadDir(exportPath)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
@@ -0,0 +1,300 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+)
+
+const IncrementalStateVersion = 1
+
+var ErrIncrementalNotSupported = errors.New("incremental exports do not support shards nor the mbox and pack formats")
+
+// IncrementalState records the messages of an incremental export, so that the next run only downloads the new and the
+// changed messages. The API does not report when a message was last modified, changes are detected from a fingerprint
+// of the mutable metadata of the message.
+type IncrementalState struct {
+	UserID     string
+	LastRun    time.Time
+	Messages   map[string]string // Message ID to fingerprint.
+	Tombstones []Tombstone       `json:",omitempty"`
+}
+
+// Tombstone records a message that was deleted on the server. The files of the message are kept in the export.
+type Tombstone struct {
+	MessageID string
+	DeletedAt time.Time // Time of the export run that noticed the deletion.
+}
+
+func getIncrementalStateFileName() string {
+	return "incremental_state.json"
+}
+
+// LoadIncrementalState reads the incremental state of an export directory.
+func LoadIncrementalState(exportDir string) (IncrementalState, error) {
+	b, err := os.ReadFile(filepath.Join(exportDir, getIncrementalStateFileName())) //nolint:gosec
+	if err != nil {
+		return IncrementalState{}, fmt.Errorf("failed to read incremental state: %w", err)
+	}
+
+	state, err := utils.NewVersionedJSON[IncrementalState](IncrementalStateVersion, b)
+	if err != nil {
+		return IncrementalState{}, fmt.Errorf("failed to parse incremental state: %w", err)
+	}
+
+	return state.Payload, nil
+}
+
+// findIncrementalExport returns the most recent export of userID next to exportDir that has an incremental state. The
+// returned path is empty if there is none.
+func findIncrementalExport(exportDir, userID string) (string, error) {
+	return findPreviousExport(exportDir, func(path string) (bool, error) {
+		state, err := LoadIncrementalState(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		return state.UserID == userID, nil
+	})
+}
+
+// findPreviousExport returns the most recent export next to exportDir selected by match. The returned path is empty if
+// there is none.
+func findPreviousExport(exportDir string, match func(path string) (bool, error)) (string, error) {
+	entries, err := os.ReadDir(filepath.Dir(exportDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to list previous exports: %w", err)
+	}
+
+	// Export directory names embed their creation time, the most recent ones come last.
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "mail_") {
+			continue
+		}
+
+		path := filepath.Join(filepath.Dir(exportDir), entry.Name())
+
+		ok, err := match(path)
+		if err != nil {
+			return "", err
+		}
+
+		if ok {
+			return path, nil
+		}
+	}
+
+	return "", nil
+}
+
+// incrementalFingerprint hashes the metadata that changes when the message is read, moved, labelled,
+// replied to or, for drafts, edited.
+func incrementalFingerprint(meta *proton.MessageMetadata) string {
+	labelIDs := append([]string{}, meta.LabelIDs...)
+	sort.Strings(labelIDs)
+
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		strings.Join(labelIDs, ","),
+		strconv.FormatBool(bool(meta.Unread)),
+		strconv.FormatBool(bool(meta.IsReplied)),
+		strconv.FormatBool(bool(meta.IsRepliedAll)),
+		strconv.FormatBool(bool(meta.IsForwarded)),
+		strconv.FormatInt(int64(meta.Flags), 10),
+		strconv.FormatInt(meta.Time, 10),
+		strconv.Itoa(meta.Size),
+		strconv.Itoa(meta.NumAttachments),
+		meta.Subject,
+	}, "\x00")))
+
+	return hex.EncodeToString(sum[:16])
+}
+
+// incrementalTracker follows the messages of an incremental export run. The metadata stage skips the messages that
+// are up to date and the write stage records the messages it wrote. It is safe for concurrent use.
+type incrementalTracker struct {
+	lock      sync.Mutex
+	previous  IncrementalState
+	current   map[string]string // Messages known to be exported and up to date.
+	listed    map[string]struct{}
+	unchanged int
+}
+
+func newIncrementalTracker(previous IncrementalState) *incrementalTracker {
+	if previous.Messages == nil {
+		previous.Messages = make(map[string]string)
+	}
+
+	return &incrementalTracker{
+		previous: previous,
+		current:  make(map[string]string, len(previous.Messages)),
+		listed:   make(map[string]struct{}, len(previous.Messages)),
+	}
+}
+
+// isUpToDate returns true if the message was exported by a previous run and did not change since.
+func (t *incrementalTracker) isUpToDate(meta *proton.MessageMetadata) bool {
+	fingerprint := incrementalFingerprint(meta)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.listed[meta.ID] = struct{}{}
+
+	if t.previous.Messages[meta.ID] != fingerprint {
+		return false
+	}
+
+	t.current[meta.ID] = fingerprint
+	t.unchanged++
+
+	return true
+}
+
+func (t *incrementalTracker) markWritten(meta *proton.MessageMetadata) {
+	fingerprint := incrementalFingerprint(meta)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.current[meta.ID] = fingerprint
+}
+
+func (t *incrementalTracker) getUnchangedCount() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.unchanged
+}
+
+// finish returns the state to persist and the number of new tombstones. The messages of the previous state that were
+// not listed are deleted on the server if the listing was complete, they are kept otherwise. Changed messages that
+// could not be written are left out so that the next run downloads them again.
+func (t *incrementalTracker) finish(userID string, listingComplete, recordTombstones bool, now time.Time) (IncrementalState, int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	state := IncrementalState{
+		UserID:     userID,
+		LastRun:    now,
+		Messages:   make(map[string]string, len(t.current)),
+		Tombstones: t.previous.Tombstones,
+	}
+
+	for id, fingerprint := range t.current {
+		state.Messages[id] = fingerprint
+	}
+
+	deleted := 0
+
+	for id, fingerprint := range t.previous.Messages {
+		if _, ok := t.listed[id]; ok {
+			continue
+		}
+
+		if !listingComplete {
+			state.Messages[id] = fingerprint
+			continue
+		}
+
+		deleted++
+
+		if recordTombstones {
+			state.Tombstones = append(state.Tombstones, Tombstone{MessageID: id, DeletedAt: now})
+		}
+	}
+
+	sort.Slice(state.Tombstones, func(i, j int) bool {
+		if !state.Tombstones[i].DeletedAt.Equal(state.Tombstones[j].DeletedAt) {
+			return state.Tombstones[i].DeletedAt.Before(state.Tombstones[j].DeletedAt)
+		}
+
+		return state.Tombstones[i].MessageID < state.Tombstones[j].MessageID
+	})
+
+	return state, deleted
+}
+
+func writeIncrementalState(tmpDir, exportDir string, state *IncrementalState) error {
+	data, err := utils.GenerateVersionedJSON(IncrementalStateVersion, state)
+	if err != nil {
+		return fmt.Errorf("failed to json encode incremental state: %w", err)
+	}
+
+	return utils.WriteFileSafe(tmpDir, filepath.Join(exportDir, getIncrementalStateFileName()), data, &utils.Sha256IntegrityChecker{})
+}
+
+// SetIncremental makes the export update the most recent incremental export of the account next to the export path,
+// instead of creating a new one. Only the new and the changed messages are downloaded. When recordTombstones is set,
+// the messages deleted on the server are listed in the incremental state. The first incremental export is a full
+// export that creates the state.
+func (e *ExportTask) SetIncremental(enabled, recordTombstones bool) error {
+	e.incremental = enabled
+	e.recordTombstones = recordTombstones
+
+	if !enabled {
+		return nil
+	}
+
+	previous, err := findIncrementalExport(e.exportDir, e.session.GetUser().ID)
+	if err != nil {
+		return err
+	}
+
+	if len(previous) != 0 {
+		e.exportDir = previous
+		e.tmpDir = filepath.Join(previous, "temp")
+	}
+
+	return nil
+}
+
+func (e *ExportTask) GetIncremental() bool {
+	return e.incremental
+}
+
+// newIncrementalTracker loads the state of the export directory, which is empty on the first run.
+func (e *ExportTask) newIncrementalTracker() (*incrementalTracker, error) {
+	if e.shard != nil || e.outputFormat == OutputFormatMBox || e.outputFormat == OutputFormatPack {
+		return nil, ErrIncrementalNotSupported
+	}
+
+	state, err := LoadIncrementalState(e.exportDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return newIncrementalTracker(state), nil
+}
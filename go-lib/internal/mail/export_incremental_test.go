@@ -0,0 +1,160 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/bradenaw/juniper/xslices"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestIncrementalTracker(t *testing.T) {
+	messages := testMetadata(4)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tracker := newIncrementalTracker(IncrementalState{})
+	for i := range messages {
+		require.False(t, tracker.isUpToDate(&messages[i]))
+		tracker.markWritten(&messages[i])
+	}
+
+	state, deleted := tracker.finish("user", true, true, now)
+	require.Len(t, state.Messages, 4)
+	require.Zero(t, deleted)
+
+	// Message 0 changed, messages 1 and 2 are unchanged, message 3 was deleted and a new message was received.
+	messages[0].Unread = !messages[0].Unread
+	messages = append(messages[:3], testMetadata(6)[5])
+
+	tracker = newIncrementalTracker(state)
+	require.False(t, tracker.isUpToDate(&messages[0]))
+	require.True(t, tracker.isUpToDate(&messages[1]))
+	require.True(t, tracker.isUpToDate(&messages[2]))
+	require.False(t, tracker.isUpToDate(&messages[3]))
+	tracker.markWritten(&messages[0])
+	tracker.markWritten(&messages[3])
+	require.Equal(t, 2, tracker.getUnchangedCount())
+
+	next, deleted := tracker.finish("user", true, true, now)
+	require.Equal(t, 1, deleted)
+	require.Len(t, next.Messages, 4)
+	require.Equal(t, []Tombstone{{MessageID: testMetadata(4)[3].ID, DeletedAt: now}}, next.Tombstones)
+	require.NotEqual(t, state.Messages[messages[0].ID], next.Messages[messages[0].ID])
+
+	// An incomplete listing keeps the messages that were not listed.
+	tracker = newIncrementalTracker(state)
+	require.True(t, tracker.isUpToDate(&messages[1]))
+
+	next, deleted = tracker.finish("user", false, true, now)
+	require.Zero(t, deleted)
+	require.Empty(t, next.Tombstones)
+	require.Equal(t, state.Messages, next.Messages)
+}
+
+func TestFindIncrementalExport(t *testing.T) {
+	root := t.TempDir()
+
+	for _, dir := range []string{"mail_20240101_000000", "mail_20240102_000000", "mail_20240103_000000"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0o700))
+	}
+
+	for dir, userID := range map[string]string{"mail_20240101_000000": "user", "mail_20240102_000000": "other"} {
+		require.NoError(t, writeIncrementalState(t.TempDir(), filepath.Join(root, dir), &IncrementalState{UserID: userID}))
+	}
+
+	path, err := findIncrementalExport(filepath.Join(root, "mail_20240104_000000"), "user")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(root, "mail_20240101_000000"), path)
+
+	path, err = findIncrementalExport(filepath.Join(root, "mail_20240104_000000"), "unknown")
+	require.NoError(t, err)
+	require.Empty(t, path)
+
+	state, err := LoadIncrementalState(filepath.Join(root, "mail_20240102_000000"))
+	require.NoError(t, err)
+	require.Equal(t, "other", state.UserID)
+}
+
+func TestMetadataStage_RunIncremental(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+	errReporter := NewMockStageErrorReporter(mockCtrl)
+	reporter := NewMockReporter(mockCtrl)
+
+	const pageSize = 2
+
+	all := testMetadata(10)
+	encodeMetadataExpectations(client, all, pageSize)
+
+	previous := IncrementalState{Messages: make(map[string]string)}
+	for i := 0; i < len(all); i += 2 {
+		previous.Messages[all[i].ID] = incrementalFingerprint(&all[i])
+	}
+
+	reporter.EXPECT().OnProgress(1).Times(5)
+
+	metadata := NewMetadataStage(client, logrus.WithField("test", "test"), pageSize, 1)
+	metadata.setIncrementalTracker(newIncrementalTracker(previous))
+
+	go func() {
+		metadata.Run(context.Background(), errReporter, &alwaysMissingMetadataFileChecker{}, reporter)
+	}()
+
+	result := make([]proton.MessageMetadata, 0, 5)
+	for out := range metadata.outputCh {
+		result = append(result, out...)
+	}
+
+	require.Equal(t, xslices.Filter(all, func(m proton.MessageMetadata) bool {
+		_, ok := previous.Messages[m.ID]
+		return !ok
+	}), result)
+}
+
+func TestMaildirWriter_RemoveStale(t *testing.T) {
+	dir := t.TempDir()
+
+	writer := newMaildirWriter([]proton.Label{{ID: "l1", Name: "Work", Path: []string{"Work"}, Type: proton.LabelTypeFolder}}, nil)
+	writer.setRemoveStale(true)
+
+	metadata := MessageMetadata{MessageMetadata: proton.MessageMetadata{ID: "msg-id", LabelIDs: []string{proton.InboxLabel}, Unread: true}}
+	require.NoError(t, writer.write(dir, &metadata, []byte("Subject: test\r\n\r\n")))
+
+	// The message was read and moved to another folder.
+	metadata.Unread = false
+	metadata.LabelIDs = []string{"l1"}
+	require.NoError(t, writer.write(dir, &metadata, []byte("Subject: test\r\n\r\n")))
+
+	inbox, err := os.ReadDir(filepath.Join(dir, getMaildirDirName(), "cur"))
+	require.NoError(t, err)
+	require.Empty(t, inbox)
+
+	work, err := os.ReadDir(filepath.Join(dir, getMaildirDirName(), ".Work", "cur"))
+	require.NoError(t, err)
+	require.Len(t, work, 1)
+	require.Equal(t, getMaildirFileName(&metadata.MessageMetadata), work[0].Name())
+}
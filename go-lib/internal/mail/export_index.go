@@ -0,0 +1,441 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	_ "modernc.org/sqlite" // Registers the "sqlite" driver, implemented in Go so that no cgo toolchain is needed.
+)
+
+// Message index
+// -------------
+// Every export run writes an index listing the ID, subject, sender, date, labels and files of each exported message, so
+// that the export can be searched without opening every metadata file. It is a SQLite database that any SQLite client
+// can query, for instance:
+//
+//	SELECT m.time, m.sender, m.subject, f.path FROM messages m JOIN labels l ON l.message_id = m.id
+//	JOIN files f ON f.message_id = m.id WHERE l.label = 'Inbox' AND m.subject LIKE '%invoice%';
+//
+// The entries of the messages that the run did not write, those unchanged since the previous incremental run or written
+// before an interruption, are kept from the previous index as long as their files still exist. Exports encrypted at
+// rest have no index since it would reveal the metadata of the messages.
+
+const MessageIndexVersion = 2
+
+// messageIndexSchema creates the tables of the index. The times are Unix times, the labels and files are listed in
+// their order.
+const messageIndexSchema = `
+CREATE TABLE info (key TEXT PRIMARY KEY, value TEXT NOT NULL);
+CREATE TABLE messages (
+	id          TEXT PRIMARY KEY,
+	subject     TEXT NOT NULL,
+	sender      TEXT NOT NULL,
+	sender_name TEXT NOT NULL,
+	time        INTEGER NOT NULL,
+	size        INTEGER NOT NULL,
+	language    TEXT NOT NULL,
+	snippet     TEXT NOT NULL
+);
+CREATE TABLE labels (
+	message_id TEXT NOT NULL REFERENCES messages (id),
+	position   INTEGER NOT NULL,
+	label      TEXT NOT NULL,
+	PRIMARY KEY (message_id, position)
+);
+CREATE TABLE files (
+	message_id TEXT NOT NULL REFERENCES messages (id),
+	position   INTEGER NOT NULL,
+	path       TEXT NOT NULL,
+	PRIMARY KEY (message_id, position)
+);
+CREATE INDEX messages_time ON messages (time);
+CREATE INDEX messages_sender ON messages (sender);
+CREATE INDEX labels_label ON labels (label);
+CREATE INDEX files_path ON files (path);
+`
+
+type MessageIndexEntry struct {
+	ID         string
+	Subject    string
+	Sender     string // Address of the sender.
+	SenderName string `json:",omitempty"`
+	Time       time.Time
+	Labels     []string // Paths of the folders and labels, the aggregated system labels (all mail...) are left out.
+	Size       int
+	Language   string   `json:",omitempty"` // ISO 639-1 code, when detected during the export.
+	Snippet    string   `json:",omitempty"` // Start of the body as plain text.
+	Files      []string // Relative to the export directory, with forward slashes.
+}
+
+type MessageIndex struct {
+	Time     time.Time
+	Messages []MessageIndexEntry // Sorted by date, then ID.
+}
+
+func getMessageIndexFileName() string {
+	return "messages_index.sqlite"
+}
+
+// getLegacyMessageIndexFileName is the JSON index written by the previous versions. It is read until the next export
+// run replaces it.
+func getLegacyMessageIndexFileName() string {
+	return "messages_index.json"
+}
+
+const legacyMessageIndexVersion = 1
+
+// LoadMessageIndex reads the message index of an export directory.
+func LoadMessageIndex(exportDir string) (MessageIndex, error) {
+	path := filepath.Join(exportDir, getMessageIndexFileName())
+
+	// Opening a missing database would create it.
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return loadLegacyMessageIndex(exportDir)
+	} else if err != nil {
+		return MessageIndex{}, fmt.Errorf("failed to read message index: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", path+"?_pragma=query_only(1)")
+	if err != nil {
+		return MessageIndex{}, fmt.Errorf("failed to open message index: %w", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	index, err := readMessageIndex(db)
+	if err != nil {
+		return MessageIndex{}, fmt.Errorf("failed to read message index: %w", err)
+	}
+
+	return index, nil
+}
+
+func loadLegacyMessageIndex(exportDir string) (MessageIndex, error) {
+	b, err := os.ReadFile(filepath.Join(exportDir, getLegacyMessageIndexFileName())) //nolint:gosec
+	if err != nil {
+		return MessageIndex{}, fmt.Errorf("failed to read message index: %w", err)
+	}
+
+	index, err := utils.NewVersionedJSON[MessageIndex](legacyMessageIndexVersion, b)
+	if err != nil {
+		return MessageIndex{}, fmt.Errorf("failed to parse message index: %w", err)
+	}
+
+	return index.Payload, nil
+}
+
+func readMessageIndex(db *sql.DB) (MessageIndex, error) {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return MessageIndex{}, err
+	}
+
+	if version != MessageIndexVersion {
+		return MessageIndex{}, fmt.Errorf("%w: got %v, expected %v", utils.ErrVersionDoesNotMatch, version, MessageIndexVersion)
+	}
+
+	var index MessageIndex
+
+	var indexTime string
+	if err := db.QueryRow("SELECT value FROM info WHERE key = 'time'").Scan(&indexTime); err != nil {
+		return MessageIndex{}, err
+	}
+
+	if err := index.Time.UnmarshalText([]byte(indexTime)); err != nil {
+		return MessageIndex{}, err
+	}
+
+	rows, err := db.Query("SELECT id, subject, sender, sender_name, time, size, language, snippet FROM messages ORDER BY time, id")
+	if err != nil {
+		return MessageIndex{}, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	positions := make(map[string]int)
+
+	for rows.Next() {
+		var entry MessageIndexEntry
+		var unixTime int64
+
+		if err := rows.Scan(&entry.ID, &entry.Subject, &entry.Sender, &entry.SenderName, &unixTime, &entry.Size, &entry.Language, &entry.Snippet); err != nil {
+			return MessageIndex{}, err
+		}
+
+		entry.Time = time.Unix(unixTime, 0).UTC()
+		positions[entry.ID] = len(index.Messages)
+		index.Messages = append(index.Messages, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return MessageIndex{}, err
+	}
+
+	for _, list := range []struct {
+		table string
+		add   func(entry *MessageIndexEntry, value string)
+	}{
+		{"labels", func(entry *MessageIndexEntry, value string) { entry.Labels = append(entry.Labels, value) }},
+		{"files", func(entry *MessageIndexEntry, value string) { entry.Files = append(entry.Files, value) }},
+	} {
+		if err := readMessageIndexList(db, list.table, func(id, value string) {
+			if i, ok := positions[id]; ok {
+				list.add(&index.Messages[i], value)
+			}
+		}); err != nil {
+			return MessageIndex{}, err
+		}
+	}
+
+	return index, nil
+}
+
+// readMessageIndexList calls fn with the values of the labels or files table, in their order.
+func readMessageIndexList(db *sql.DB, table string, fn func(id, value string)) error {
+	column := map[string]string{"labels": "label", "files": "path"}[table]
+
+	rows, err := db.Query("SELECT message_id, " + column + " FROM " + table + " ORDER BY message_id, position") //nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var id, value string
+		if err := rows.Scan(&id, &value); err != nil {
+			return err
+		}
+
+		fn(id, value)
+	}
+
+	return rows.Err()
+}
+
+// writeMessageIndex writes index to a new database at path.
+func writeMessageIndex(path string, index *MessageIndex) (err error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec(messageIndexSchema); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", MessageIndexVersion)); err != nil {
+		return err
+	}
+
+	indexTime, err := index.Time.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("INSERT INTO info (key, value) VALUES ('time', ?)", string(indexTime)); err != nil {
+		return err
+	}
+
+	insertMessage, err := tx.Prepare("INSERT INTO messages (id, subject, sender, sender_name, time, size, language, snippet) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	insertLabel, err := tx.Prepare("INSERT INTO labels (message_id, position, label) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	insertFile, err := tx.Prepare("INSERT INTO files (message_id, position, path) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range index.Messages {
+		if _, err := insertMessage.Exec(entry.ID, entry.Subject, entry.Sender, entry.SenderName, entry.Time.Unix(), entry.Size, entry.Language, entry.Snippet); err != nil {
+			return err
+		}
+
+		for i, label := range entry.Labels {
+			if _, err := insertLabel.Exec(entry.ID, i, label); err != nil {
+				return err
+			}
+		}
+
+		for i, file := range entry.Files {
+			if _, err := insertFile.Exec(entry.ID, i, file); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// messageIndexCollector gathers the index entries of the messages written by an export run. It is safe for concurrent
+// use.
+type messageIndexCollector struct {
+	lock      sync.Mutex
+	exportDir string
+	entries   map[string]MessageIndexEntry // The labels are IDs until write resolves them.
+}
+
+func newMessageIndexCollector(exportDir string) *messageIndexCollector {
+	return &messageIndexCollector{
+		exportDir: exportDir,
+		entries:   make(map[string]MessageIndexEntry),
+	}
+}
+
+// add records a message and the absolute paths of the files it was written to.
+func (c *messageIndexCollector) add(metadata *MessageMetadata, paths []string) {
+	entry := MessageIndexEntry{
+		ID:       metadata.ID,
+		Subject:  metadata.Subject,
+		Time:     time.Unix(metadata.Time, 0).UTC(),
+		Labels:   metadata.LabelIDs,
+		Size:     metadata.Size,
+		Language: metadata.Language,
+		Snippet:  metadata.Snippet,
+	}
+
+	if metadata.Sender != nil {
+		entry.Sender = metadata.Sender.Address
+		entry.SenderName = metadata.Sender.Name
+	}
+
+	for _, path := range paths {
+		if rel, err := filepath.Rel(c.exportDir, path); err == nil {
+			entry.Files = append(entry.Files, filepath.ToSlash(rel))
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries[entry.ID] = entry
+}
+
+// write merges the collected entries with the previous index and writes it. It returns the number of indexed messages.
+func (c *messageIndexCollector) write(tmpDir string, labels []proton.Label) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	names := make(map[string]string, len(mboxSystemLabelNames)+len(labels))
+	for id, name := range mboxSystemLabelNames {
+		names[id] = name
+	}
+
+	for _, label := range labels {
+		names[label.ID] = getLabelPathName(label, "/")
+	}
+
+	index := MessageIndex{Time: time.Now().UTC()}
+
+	for _, entry := range c.entries {
+		labelIDs := entry.Labels
+		entry.Labels = nil
+
+		for _, id := range labelIDs {
+			if name, ok := names[id]; ok {
+				entry.Labels = append(entry.Labels, name)
+			}
+		}
+
+		index.Messages = append(index.Messages, entry)
+	}
+
+	if previous, err := LoadMessageIndex(c.exportDir); err == nil {
+		exists := make(map[string]bool)
+
+		for _, entry := range previous.Messages {
+			if _, ok := c.entries[entry.ID]; ok || len(entry.Files) == 0 {
+				continue
+			}
+
+			// The mbox and Maildir messages share files, each is only checked once.
+			file := entry.Files[len(entry.Files)-1]
+			if _, ok := exists[file]; !ok {
+				_, err := os.Stat(filepath.Join(c.exportDir, filepath.FromSlash(file)))
+				exists[file] = err == nil
+			}
+
+			if exists[file] {
+				index.Messages = append(index.Messages, entry)
+			}
+		}
+	}
+
+	sort.Slice(index.Messages, func(i, j int) bool {
+		if !index.Messages[i].Time.Equal(index.Messages[j].Time) {
+			return index.Messages[i].Time.Before(index.Messages[j].Time)
+		}
+
+		return index.Messages[i].ID < index.Messages[j].ID
+	})
+
+	// The database is written next to the export and moved in place once complete, as WriteFileSafe does.
+	file, err := os.CreateTemp(tmpDir, "export-tool-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create tmp file: %w", err)
+	}
+
+	tmpPath := file.Name()
+	defer func() { _ = os.Remove(tmpPath) }()
+
+	if err := file.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close tmp file: %w", err)
+	}
+
+	if err := writeMessageIndex(tmpPath, &index); err != nil {
+		return 0, fmt.Errorf("failed to write message index: %w", err)
+	}
+
+	if err := utils.SyncFile(tmpPath); err != nil {
+		return 0, fmt.Errorf("failed to flush message index: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(c.exportDir, getMessageIndexFileName())); err != nil {
+		return 0, fmt.Errorf("failed to move message index to location: %w", err)
+	}
+
+	if err := os.Remove(filepath.Join(c.exportDir, getLegacyMessageIndexFileName())); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("failed to remove legacy message index: %w", err)
+	}
+
+	return len(index.Messages), nil
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"database/sql"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageIndexCollector(t *testing.T) {
+	exportDir := t.TempDir()
+	tmpDir := t.TempDir()
+
+	newMetadata := func(id string, time int64, labelIDs ...string) *MessageMetadata {
+		metadata := NewMessageMetadata(MessageWriterTypeDecryptedAndBuilt, &proton.Message{
+			MessageMetadata: proton.MessageMetadata{
+				ID:       id,
+				Subject:  "Subject " + id,
+				Sender:   &mail.Address{Name: "Sender", Address: "sender@proton.me"},
+				Time:     time,
+				LabelIDs: labelIDs,
+				Size:     100,
+			},
+		})
+
+		return &metadata
+	}
+
+	writeMessage := func(id string) []string {
+		paths := []string{
+			filepath.Join(exportDir, getMetadataFileName(id)),
+			filepath.Join(exportDir, getEMLFileName(id)),
+		}
+
+		for _, path := range paths {
+			require.NoError(t, os.WriteFile(path, []byte(id), 0o600))
+		}
+
+		return paths
+	}
+
+	labels := []proton.Label{{ID: "label", Name: "Child", Path: []string{"Parent", "Child"}}}
+
+	collector := newMessageIndexCollector(exportDir)
+	collector.add(newMetadata("2", 20, proton.InboxLabel, proton.AllMailLabel, "label"), writeMessage("2"))
+	collector.add(newMetadata("1", 10, proton.SentLabel), writeMessage("1"))
+
+	count, err := collector.write(tmpDir, labels)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	index, err := LoadMessageIndex(exportDir)
+	require.NoError(t, err)
+	require.Equal(t, []MessageIndexEntry{
+		{
+			ID:         "1",
+			Subject:    "Subject 1",
+			Sender:     "sender@proton.me",
+			SenderName: "Sender",
+			Time:       time.Unix(10, 0).UTC(),
+			Labels:     []string{"Sent"},
+			Size:       100,
+			Files:      []string{"1.metadata.json", "1.eml"},
+		},
+		{
+			ID:         "2",
+			Subject:    "Subject 2",
+			Sender:     "sender@proton.me",
+			SenderName: "Sender",
+			Time:       time.Unix(20, 0).UTC(),
+			Labels:     []string{"Inbox", "Parent/Child"},
+			Size:       100,
+			Files:      []string{"2.metadata.json", "2.eml"},
+		},
+	}, index.Messages)
+
+	// The next run keeps the entries of the messages it did not write as long as their files exist.
+	require.NoError(t, os.Remove(filepath.Join(exportDir, getEMLFileName("1"))))
+
+	collector = newMessageIndexCollector(exportDir)
+	collector.add(newMetadata("3", 5), writeMessage("3"))
+
+	count, err = collector.write(tmpDir, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	index, err = LoadMessageIndex(exportDir)
+	require.NoError(t, err)
+	require.Len(t, index.Messages, 2)
+	require.Equal(t, "3", index.Messages[0].ID)
+	require.Empty(t, index.Messages[0].Labels)
+	require.Equal(t, "2", index.Messages[1].ID)
+	require.Equal(t, []string{"Inbox", "Parent/Child"}, index.Messages[1].Labels)
+}
+
+func TestMessageIndex_SQL(t *testing.T) {
+	exportDir := t.TempDir()
+
+	collector := newMessageIndexCollector(exportDir)
+	for _, id := range []string{"1", "2"} {
+		metadata := NewMessageMetadata(MessageWriterTypeDecryptedAndBuilt, &proton.Message{
+			MessageMetadata: proton.MessageMetadata{ID: id, Subject: "Invoice " + id, LabelIDs: []string{proton.InboxLabel}},
+		})
+		collector.add(&metadata, []string{filepath.Join(exportDir, getEMLFileName(id))})
+	}
+
+	_, err := collector.write(t.TempDir(), nil)
+	require.NoError(t, err)
+
+	// The index can be searched with any SQLite client.
+	db, err := sql.Open("sqlite", filepath.Join(exportDir, getMessageIndexFileName()))
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	var path string
+	require.NoError(t, db.QueryRow(
+		"SELECT f.path FROM messages m JOIN labels l ON l.message_id = m.id JOIN files f ON f.message_id = m.id "+
+			"WHERE l.label = 'Inbox' AND m.subject LIKE '%2'",
+	).Scan(&path))
+	require.Equal(t, getEMLFileName("2"), path)
+}
+
+func TestMessageIndex_Legacy(t *testing.T) {
+	exportDir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(exportDir, getEMLFileName("1")), []byte("1"), 0o600))
+
+	legacy, err := utils.GenerateVersionedJSON(legacyMessageIndexVersion, MessageIndex{Messages: []MessageIndexEntry{
+		{ID: "1", Subject: "Legacy", Files: []string{getEMLFileName("1")}},
+	}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(exportDir, getLegacyMessageIndexFileName()), legacy, 0o600))
+
+	index, err := LoadMessageIndex(exportDir)
+	require.NoError(t, err)
+	require.Equal(t, "Legacy", index.Messages[0].Subject)
+
+	// The next run moves the entries to the database.
+	count, err := newMessageIndexCollector(exportDir).write(t.TempDir(), nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	require.NoFileExists(t, filepath.Join(exportDir, getLegacyMessageIndexFileName()))
+
+	index, err = LoadMessageIndex(exportDir)
+	require.NoError(t, err)
+	require.Equal(t, "Legacy", index.Messages[0].Subject)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/proton-bridge/v3/pkg/message"
+)
+
+// maxTransferAttempts is the number of times an attachment is downloaded before accepting a transfer that does not
+// match the size reported by the API.
+const maxTransferAttempts = 3
+
+var ErrTransferIntegrity = errors.New("transfer integrity check failed")
+
+// AttachmentIntegrity records the outcome of the integrity checks of an attachment.
+type AttachmentIntegrity struct {
+	ID              string
+	Size            int64  // Size of the downloaded encrypted data.
+	ExpectedSize    int64  // Size reported by the API.
+	SHA256          string // Digest of the downloaded encrypted data.
+	DecryptionError string `json:",omitempty"` // Set when decryption failed, e.g. because the integrity tag did not match.
+}
+
+// MessageIntegrity records the outcome of the integrity checks performed while a message was downloaded and decrypted.
+type MessageIntegrity struct {
+	Verified        bool   // All the sizes match and all the parts could be decrypted.
+	BodySHA256      string // Digest of the downloaded encrypted body.
+	BodyError       string `json:",omitempty"`
+	Attachments     []AttachmentIntegrity
+	EncryptedOnly   bool     `json:",omitempty"` // The message could not be decrypted, only the transfer was checked.
+	SizeMismatchIDs []string `json:",omitempty"`
+}
+
+// verifyAttachmentTransfer checks that the downloaded data has the size reported by the API. A shorter or longer
+// transfer means that the download was truncated or corrupted.
+func verifyAttachmentTransfer(attachment *proton.Attachment, data []byte) error {
+	if attachment.Size > 0 && int64(len(data)) != attachment.Size {
+		return fmt.Errorf("%w: attachment '%v' is %v bytes, expected %v", ErrTransferIntegrity, attachment.ID, len(data), attachment.Size)
+	}
+
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// newTransferIntegrity checks the downloaded, still encrypted, content of a message.
+func newTransferIntegrity(msg *proton.FullMessage) *MessageIntegrity {
+	result := &MessageIntegrity{
+		BodySHA256:  sha256Hex([]byte(msg.Body)),
+		Attachments: make([]AttachmentIntegrity, len(msg.Attachments)),
+	}
+
+	for i := range msg.Attachments {
+		attachment := &msg.Attachments[i]
+
+		var data []byte
+		if i < len(msg.AttData) {
+			data = msg.AttData[i]
+		}
+
+		result.Attachments[i] = AttachmentIntegrity{
+			ID:           attachment.ID,
+			Size:         int64(len(data)),
+			ExpectedSize: attachment.Size,
+			SHA256:       sha256Hex(data),
+		}
+
+		if verifyAttachmentTransfer(attachment, data) != nil {
+			result.SizeMismatchIDs = append(result.SizeMismatchIDs, attachment.ID)
+		}
+	}
+
+	result.Verified = len(result.SizeMismatchIDs) == 0
+
+	return result
+}
+
+// newMessageIntegrity checks the downloaded content of a message and the outcome of its decryption. OpenPGP
+// decryption fails if the integrity tag of the encrypted data does not match.
+func newMessageIntegrity(decrypted *message.DecryptedMessage, msg *proton.FullMessage) *MessageIntegrity {
+	result := newTransferIntegrity(msg)
+
+	if decrypted.BodyErr != nil {
+		result.BodyError = decrypted.BodyErr.Error()
+		result.Verified = false
+	}
+
+	for i := range decrypted.Attachments {
+		if i < len(result.Attachments) && decrypted.Attachments[i].Err != nil {
+			result.Attachments[i].DecryptionError = decrypted.Attachments[i].Err.Error()
+			result.Verified = false
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,265 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/ProtonMail/gluon/rfc822"
+)
+
+// MaxLanguageSampleRunes is the number of letters of a message looked at to detect its language.
+const MaxLanguageSampleRunes = 4096
+
+// minLanguageStopwords is the number of stopwords below which the language of a text in latin script is unknown.
+const minLanguageStopwords = 3
+
+// languageStopwords are frequent words specific enough to tell apart the languages written in latin script.
+//
+//nolint:gochecknoglobals
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "is", "are", "you", "that", "with", "for", "this", "have", "was", "will", "not", "your", "from", "would"},
+	"fr": {"le", "la", "les", "et", "est", "vous", "que", "une", "pour", "dans", "avec", "pas", "nous", "sur", "des", "merci"},
+	"de": {"der", "die", "und", "ist", "nicht", "sie", "ich", "mit", "das", "den", "ein", "eine", "auf", "für", "wir", "danke"},
+	"es": {"el", "los", "las", "es", "que", "y", "una", "por", "para", "con", "del", "usted", "muy", "gracias", "pero", "como"},
+	"it": {"il", "di", "che", "è", "non", "per", "una", "sono", "della", "con", "gli", "anche", "questo", "grazie", "ciao", "molto"},
+	"pt": {"o", "os", "não", "uma", "para", "com", "você", "está", "muito", "obrigado", "mas", "isso", "são", "pelo", "ao", "também"},
+	"nl": {"de", "het", "een", "en", "is", "niet", "van", "ik", "je", "dat", "met", "voor", "zijn", "wij", "bedankt", "ook"},
+	"sv": {"och", "att", "det", "är", "som", "en", "på", "för", "med", "inte", "jag", "till", "har", "vi", "tack", "också"},
+	"pl": {"i", "w", "nie", "się", "na", "że", "jest", "do", "to", "jak", "ale", "dla", "dziękuję", "czy", "już", "tak"},
+}
+
+//nolint:gochecknoglobals
+var languageStopwordSets = func() map[string]map[string]bool {
+	sets := make(map[string]map[string]bool, len(languageStopwords))
+
+	for language, words := range languageStopwords {
+		sets[language] = make(map[string]bool, len(words))
+		for _, word := range words {
+			sets[language][word] = true
+		}
+	}
+
+	return sets
+}()
+
+// DetectLanguage returns the ISO 639-1 code of the primary language of a text, or an empty string when it cannot be
+// told. The script of the letters decides the languages not written in latin script. The others are told apart by
+// their most frequent words, so short texts are often unknown.
+func DetectLanguage(text string) string {
+	scripts := make(map[string]int)
+	letters := 0
+
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+
+		if letters++; letters > MaxLanguageSampleRunes {
+			break
+		}
+
+		scripts[getScriptLanguage(r)]++
+	}
+
+	if letters == 0 {
+		return ""
+	}
+
+	script, count := "", 0
+	for s, c := range scripts {
+		if c > count || (c == count && s < script) {
+			script, count = s, c
+		}
+	}
+
+	switch script {
+	case "other":
+		return ""
+	case "latin":
+		return detectLatinLanguage(text)
+	case "zh":
+		// Japanese mixes kanji with kana.
+		if kana := scripts["ja"]; kana*10 >= letters {
+			return "ja"
+		}
+	case "ru":
+		if strings.ContainsAny(strings.ToLower(text), "іїєґ") {
+			return "uk"
+		}
+	}
+
+	return script
+}
+
+// getScriptLanguage returns the language of the script of a letter, "latin" for the latin script.
+func getScriptLanguage(r rune) string {
+	switch {
+	case unicode.Is(unicode.Latin, r):
+		return "latin"
+	case unicode.Is(unicode.Hiragana, r), unicode.Is(unicode.Katakana, r):
+		return "ja"
+	case unicode.Is(unicode.Han, r):
+		return "zh"
+	case unicode.Is(unicode.Hangul, r):
+		return "ko"
+	case unicode.Is(unicode.Cyrillic, r):
+		return "ru"
+	case unicode.Is(unicode.Greek, r):
+		return "el"
+	case unicode.Is(unicode.Arabic, r):
+		return "ar"
+	case unicode.Is(unicode.Hebrew, r):
+		return "he"
+	case unicode.Is(unicode.Thai, r):
+		return "th"
+	case unicode.Is(unicode.Devanagari, r):
+		return "hi"
+	default:
+		return "other"
+	}
+}
+
+func detectLatinLanguage(text string) string {
+	if len(text) > MaxLanguageSampleRunes*4 {
+		text = text[:MaxLanguageSampleRunes*4]
+	}
+
+	scores := make(map[string]int, len(languageStopwords))
+
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		for language, stopwords := range languageStopwordSets {
+			if stopwords[word] {
+				scores[language]++
+			}
+		}
+	}
+
+	best, bestScore, secondScore := "", 0, 0
+	for language, score := range scores {
+		switch {
+		case score > bestScore || (score == bestScore && language < best):
+			best, bestScore, secondScore = language, score, max(bestScore, secondScore)
+		case score > secondScore:
+			secondScore = score
+		}
+	}
+
+	// The languages sharing many words, such as Spanish and Portuguese, need a clear winner.
+	if bestScore < minLanguageStopwords || bestScore*4 < secondScore*5 {
+		return ""
+	}
+
+	return best
+}
+
+//nolint:gochecknoglobals
+var htmlTagRegexp = regexp.MustCompile(`(?s)<(script|style)\b.*?</(script|style)>|<[^>]*>`)
+
+// getBodyText returns the text of a decrypted message body of the given MIME type, without the HTML markup. The body
+// of MIME messages is parsed for its first text part.
+func getBodyText(body []byte, mimeType rfc822.MIMEType) string {
+	switch mimeType {
+	case rfc822.TextPlain:
+		return string(body)
+	case rfc822.TextHTML:
+		return stripHTML(string(body))
+	case rfc822.MultipartMixed:
+		msg, err := mail.ReadMessage(bytes.NewReader(body))
+		if err != nil {
+			return ""
+		}
+
+		return getPartText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body, 0)
+	default:
+		return ""
+	}
+}
+
+func getPartText(contentType, encoding string, body io.Reader, depth int) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = string(rfc822.TextPlain)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= 8 {
+			return ""
+		}
+
+		reader := multipart.NewReader(body, params["boundary"])
+
+		var htmlText string
+
+		for {
+			part, err := reader.NextRawPart()
+			if err != nil {
+				return htmlText
+			}
+
+			text := getPartText(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part, depth+1)
+			if len(text) == 0 {
+				continue
+			}
+
+			if partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); partType != string(rfc822.TextHTML) {
+				return text
+			}
+
+			if len(htmlText) == 0 {
+				htmlText = text
+			}
+		}
+	}
+
+	if mediaType != string(rfc822.TextPlain) && mediaType != string(rfc822.TextHTML) {
+		return ""
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(body, MaxLanguageSampleRunes*8))
+	if err != nil && len(b) == 0 {
+		return ""
+	}
+
+	if mediaType == string(rfc822.TextHTML) {
+		return stripHTML(string(b))
+	}
+
+	return string(b)
+}
+
+func stripHTML(text string) string {
+	return html.UnescapeString(htmlTagRegexp.ReplaceAllString(text, " "))
+}
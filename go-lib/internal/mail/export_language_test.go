@@ -0,0 +1,76 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/gluon/rfc822"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	for text, language := range map[string]string{
+		"Hello, thank you for your message. I will have a look at the report and come back to you with the answers.":  "en",
+		"Bonjour, merci pour votre message. Nous allons regarder le rapport et nous vous répondrons dans la journée.": "fr",
+		"Hallo, danke für die Nachricht. Ich werde mir den Bericht ansehen und wir melden uns, wenn es nicht passt.":  "de",
+		"Hola, gracias por el mensaje. Vamos a revisar el informe y le responderemos con los detalles del pedido.":    "es",
+		"Здравствуйте, спасибо за ваше письмо.":                                                                       "ru",
+		"Дякую за ваш лист, їх буде розглянуто.":                                                                      "uk",
+		"お問い合わせいただきありがとうございます。":                                                                                       "ja",
+		"感谢您的来信，我们会尽快回复。":                                                                                             "zh",
+		"문의해 주셔서 감사합니다.":                                                                                              "ko",
+		"Ευχαριστούμε για το μήνυμά σας.":                                                                             "el",
+		"Ok":        "",
+		"12345 !!!": "",
+	} {
+		require.Equal(t, language, DetectLanguage(text), text)
+	}
+}
+
+func TestGetBodyText(t *testing.T) {
+	require.Equal(t, "plain", getBodyText([]byte("plain"), rfc822.TextPlain))
+	require.Equal(t, []string{"Tom", "&", "Jerry"}, strings.Fields(getBodyText([]byte("<p>Tom &amp; <b>Jerry</b></p><style>p {}</style>"), rfc822.TextHTML)))
+
+	mime := "Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html\r\n\r\n" +
+		"<p>html</p>\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		"cGxhaW4g\r\ndGV4dA==\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/pdf\r\n\r\n" +
+		"%PDF\r\n" +
+		"--outer--\r\n"
+
+	require.Equal(t, "plain text", getBodyText([]byte(mime), rfc822.MultipartMixed))
+}
+
+func TestFilter_ValidateLanguages(t *testing.T) {
+	require.NoError(t, (&Filter{Languages: []string{"en", "fr"}}).Validate())
+	require.Error(t, (&Filter{Languages: []string{"EN"}}).Validate())
+	require.Error(t, (&Filter{Languages: []string{"english"}}).Validate())
+	require.Error(t, (&Filter{Languages: []string{"en"}, ExpandConversations: true}).Validate())
+	require.True(t, (&Filter{Languages: []string{"en"}}).HasBodyCriteria())
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"golang.org/x/exp/slices"
+)
+
+// getMaildirDirName returns the sub folder of the export folder holding the Maildir++ folders.
+func getMaildirDirName() string {
+	return "maildir"
+}
+
+// maildirSystemLabelNames are the folder names of the system labels. The inbox is the root Maildir. Starred is
+// represented by the flagged flag instead of a folder.
+var maildirSystemLabelNames = map[string]string{ //nolint:gochecknoglobals
+	proton.InboxLabel:   "",
+	proton.TrashLabel:   ".Trash",
+	proton.SpamLabel:    ".Spam",
+	proton.ArchiveLabel: ".Archive",
+	proton.SentLabel:    ".Sent",
+	proton.DraftsLabel:  ".Drafts",
+	proton.OutboxLabel:  ".Outbox",
+}
+
+// maildirFallbackName is the folder of the messages that are not in any of the labels with a folder.
+const maildirFallbackName = ".All Mail"
+
+// maildirFolderMarker is the file Maildir++ expects in every sub folder.
+const maildirFolderMarker = "maildirfolder"
+
+// maildirInfoSeparator separates the unique name of a message from its flags. Colons are not allowed in Windows file
+// names, where mail clients use an exclamation mark instead.
+func maildirInfoSeparator() string {
+	if runtime.GOOS == "windows" {
+		return "!"
+	}
+
+	return ":"
+}
+
+// maildirWriter writes a copy of each message to the Maildir++ folder of each of its labels, so that the export can be
+// used as is by Dovecot or notmuch. Label paths become dot separated folders, the dots of label names being replaced.
+// Messages are converted to LF line endings, written to tmp and moved to cur. It is safe for concurrent use.
+type maildirWriter struct {
+	folderByID map[string]string // Label ID to folder name, relative to the maildir root.
+
+	lock    sync.Mutex
+	created map[string]struct{}
+
+	removeStale bool
+}
+
+func newMaildirWriter(labels []proton.Label, names *pathNamer) *maildirWriter {
+	folderByID := make(map[string]string, len(maildirSystemLabelNames)+len(labels))
+	for id, name := range maildirSystemLabelNames {
+		folderByID[id] = name
+	}
+
+	assignLabelFileNames(labels, folderByID, []string{maildirFallbackName}, func(label proton.Label, suffix string) string {
+		components := append([]string{}, label.Path...)
+		if len(components) == 0 {
+			components = []string{label.Name}
+		}
+
+		for i := range components {
+			components[i] = strings.ReplaceAll(utils.SafeFileName(components[i]), ".", "_")
+		}
+
+		// Room is left for the messages, see getMaildirFileName.
+		return names.fitLabelName(getMaildirDirName(), "."+strings.Join(components, ".")+suffix, len("/cur/")+maxMaildirFileNameBytes, false)
+	})
+
+	return &maildirWriter{
+		folderByID: folderByID,
+		created:    make(map[string]struct{}),
+	}
+}
+
+// getFolders returns the folders of the message, the fallback folder if none of its labels has a folder.
+func (m *maildirWriter) getFolders(labelIDs []string) []string {
+	var folders []string
+
+	for _, id := range labelIDs {
+		if folder, ok := m.folderByID[id]; ok && !slices.Contains(folders, folder) {
+			folders = append(folders, folder)
+		}
+	}
+
+	if len(folders) == 0 {
+		folders = append(folders, maildirFallbackName)
+	}
+
+	return folders
+}
+
+func (m *maildirWriter) getFilePaths(metadata *proton.MessageMetadata) []string {
+	name := getMaildirFileName(metadata)
+
+	var paths []string
+	for _, folder := range m.getFolders(metadata.LabelIDs) {
+		paths = append(paths, path.Join(getMaildirDirName(), folder, "cur", name))
+	}
+
+	return paths
+}
+
+// setRemoveStale deletes the copies a previous export wrote of a message, when its flags or its folders changed. This
+// is needed when an export is updated in place, see ExportTask.SetIncremental.
+func (m *maildirWriter) setRemoveStale(removeStale bool) {
+	m.removeStale = removeStale
+}
+
+func (m *maildirWriter) write(dir string, metadata *MessageMetadata, eml []byte) error {
+	name := getMaildirFileName(&metadata.MessageMetadata)
+	eml = bytes.ReplaceAll(eml, []byte("\r\n"), []byte("\n"))
+
+	folders := m.getFolders(metadata.LabelIDs)
+
+	if m.removeStale {
+		if err := m.removeStaleCopies(dir, &metadata.MessageMetadata, folders); err != nil {
+			return err
+		}
+	}
+
+	for _, folder := range folders {
+		folderPath := filepath.Join(dir, getMaildirDirName(), folder)
+		if err := m.createFolder(folderPath, len(folder) != 0); err != nil {
+			return err
+		}
+
+		tmpPath := filepath.Join(folderPath, "tmp", name)
+		if err := os.WriteFile(tmpPath, eml, 0o600); err != nil {
+			return fmt.Errorf("failed to write maildir message: %w", err)
+		}
+
+		if err := os.Rename(tmpPath, filepath.Join(folderPath, "cur", name)); err != nil {
+			return fmt.Errorf("failed to move maildir message: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// removeStaleCopies deletes the copies of the message with other flags than the current ones, or in folders the message
+// is not in anymore.
+func (m *maildirWriter) removeStaleCopies(dir string, metadata *proton.MessageMetadata, folders []string) error {
+	name := getMaildirFileName(metadata)
+
+	allFolders := map[string]struct{}{maildirFallbackName: {}}
+	for _, folder := range m.folderByID {
+		allFolders[folder] = struct{}{}
+	}
+
+	for folder := range allFolders {
+		matches, err := filepath.Glob(filepath.Join(dir, getMaildirDirName(), folder, "cur", getMaildirUniqueName(metadata)+maildirInfoSeparator()+"*"))
+		if err != nil {
+			return fmt.Errorf("failed to list maildir messages: %w", err)
+		}
+
+		for _, match := range matches {
+			if filepath.Base(match) == name && slices.Contains(folders, folder) {
+				continue
+			}
+
+			if err := os.Remove(match); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove stale maildir message: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// createFolder creates the cur, new and tmp folders of a Maildir, and the folder marker of sub folders.
+func (m *maildirWriter) createFolder(folderPath string, isSubFolder bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.created[folderPath]; ok {
+		return nil
+	}
+
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(folderPath, sub), 0o700); err != nil {
+			return fmt.Errorf("failed to create maildir folder: %w", err)
+		}
+	}
+
+	if isSubFolder {
+		if err := os.WriteFile(filepath.Join(folderPath, maildirFolderMarker), nil, 0o600); err != nil {
+			return fmt.Errorf("failed to create maildir folder marker: %w", err)
+		}
+	}
+
+	m.created[folderPath] = struct{}{}
+
+	return nil
+}
+
+func (m *maildirWriter) close() error {
+	return nil
+}
+
+// getMaildirFileName returns the unique name of the message followed by its flags. The name is stable so that an
+// export that is run again overwrites the messages instead of duplicating them.
+func getMaildirFileName(metadata *proton.MessageMetadata) string {
+	return getMaildirUniqueName(metadata) + maildirInfoSeparator() + "2," + getMaildirFlags(metadata)
+}
+
+func getMaildirUniqueName(metadata *proton.MessageMetadata) string {
+	return fmt.Sprintf("%v.%v.proton", metadata.Time, utils.SafeFileName(metadata.ID))
+}
+
+// getMaildirFlags returns the flags of the message, in ASCII order as the Maildir specification requires.
+func getMaildirFlags(metadata *proton.MessageMetadata) string {
+	var flags strings.Builder
+
+	if slices.Contains(metadata.LabelIDs, proton.DraftsLabel) || slices.Contains(metadata.LabelIDs, proton.AllDraftsLabel) {
+		flags.WriteByte('D')
+	}
+
+	if slices.Contains(metadata.LabelIDs, proton.StarredLabel) {
+		flags.WriteByte('F')
+	}
+
+	if metadata.IsForwarded {
+		flags.WriteByte('P')
+	}
+
+	if metadata.IsReplied || metadata.IsRepliedAll {
+		flags.WriteByte('R')
+	}
+
+	if !metadata.Unread {
+		flags.WriteByte('S')
+	}
+
+	return flags.String()
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMaildirFlags(t *testing.T) {
+	require.Equal(t, "", getMaildirFlags(&proton.MessageMetadata{Unread: true}))
+	require.Equal(t, "S", getMaildirFlags(&proton.MessageMetadata{}))
+	require.Equal(t, "DFPRS", getMaildirFlags(&proton.MessageMetadata{
+		LabelIDs:    []string{proton.StarredLabel, proton.AllDraftsLabel},
+		IsForwarded: true,
+		IsReplied:   true,
+	}))
+	require.Equal(t, "R", getMaildirFlags(&proton.MessageMetadata{Unread: true, IsRepliedAll: true}))
+}
+
+func TestMaildirWriter(t *testing.T) {
+	dir := t.TempDir()
+
+	writer := newMaildirWriter([]proton.Label{
+		{ID: "l1", Name: "Work", Path: []string{"Work"}, Type: proton.LabelTypeFolder},
+		{ID: "l2", Name: "v1.2", Path: []string{"Work", "v1.2"}, Type: proton.LabelTypeFolder},
+		{ID: "l3", Name: "sent", Path: []string{"sent"}, Type: proton.LabelTypeLabel},
+	}, nil)
+
+	require.Equal(t, []string{"", ".Work"}, writer.getFolders([]string{proton.InboxLabel, proton.AllMailLabel, proton.StarredLabel, "l1"}))
+	require.Equal(t, []string{".Work.v1_2"}, writer.getFolders([]string{"l2"}))
+	require.NotEqual(t, ".sent", writer.getFolders([]string{"l3"})[0])
+	require.Equal(t, []string{maildirFallbackName}, writer.getFolders([]string{proton.AllMailLabel}))
+
+	metadata := MessageMetadata{MessageMetadata: proton.MessageMetadata{
+		ID:       "msg-id",
+		LabelIDs: []string{proton.InboxLabel, proton.StarredLabel, "l2"},
+		Time:     1704164645,
+	}}
+
+	require.NoError(t, writer.write(dir, &metadata, []byte("Subject: test\r\n\r\nBody\r\n")))
+	require.NoError(t, writer.close())
+
+	paths := writer.getFilePaths(&metadata.MessageMetadata)
+	require.Equal(t, []string{
+		"maildir/cur/1704164645.msg-id.proton" + maildirInfoSeparator() + "2,FS",
+		"maildir/.Work.v1_2/cur/1704164645.msg-id.proton" + maildirInfoSeparator() + "2,FS",
+	}, paths)
+
+	for _, path := range paths {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+		require.NoError(t, err)
+		require.Equal(t, "Subject: test\n\nBody\n", string(data))
+	}
+
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		require.DirExists(t, filepath.Join(dir, getMaildirDirName(), sub))
+		require.DirExists(t, filepath.Join(dir, getMaildirDirName(), ".Work.v1_2", sub))
+	}
+
+	require.NoFileExists(t, filepath.Join(dir, getMaildirDirName(), maildirFolderMarker))
+	require.FileExists(t, filepath.Join(dir, getMaildirDirName(), ".Work.v1_2", maildirFolderMarker))
+
+	entries, err := os.ReadDir(filepath.Join(dir, getMaildirDirName(), "tmp"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
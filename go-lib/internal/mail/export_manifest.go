@@ -0,0 +1,382 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export manifest
+// ---------------
+// The export manifest is the inventory of an export directory for external tools, such as the data governance systems
+// ingesting the inventories of the backups. It joins the checksum manifest, which lists every file, with the message
+// index, which tells the message each file belongs to, and is written as JSON or CSV with one row per file. Both
+// formats follow ExportManifestSchema and use the same field names. Unlike the other files of the export, its layout is
+// a published interface: fields are only ever added, and a change of meaning bumps ExportManifestSchemaID.
+//
+// A manifest loaded back, e.g. one ingested years ago, is compared with the current content of the export with
+// CompareExportManifest.
+
+const ExportManifestSchemaID = "urn:proton:mail-export:manifest:1"
+
+// ExportManifestSchema is the JSON Schema of the JSON export manifest. The CSV manifest has a header row with the
+// field names of the entries, in the order of exportManifestColumns, the labels being separated by semicolons.
+const ExportManifestSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "` + ExportManifestSchemaID + `",
+  "title": "Proton Mail export manifest",
+  "type": "object",
+  "required": ["schema", "generated", "checksum_time", "entries"],
+  "properties": {
+    "schema": {"const": "` + ExportManifestSchemaID + `"},
+    "generated": {"type": "string", "format": "date-time"},
+    "checksum_time": {"type": "string", "format": "date-time"},
+    "entries": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["path", "size", "sha256", "modified"],
+        "properties": {
+          "path": {"type": "string", "description": "Relative to the export directory, with forward slashes"},
+          "size": {"type": "integer", "minimum": 0},
+          "sha256": {"type": "string", "pattern": "^[0-9a-f]{64}$"},
+          "modified": {"type": "string", "format": "date-time"},
+          "message_id": {"type": "string"},
+          "subject": {"type": "string"},
+          "sender": {"type": "string"},
+          "date": {"type": "string", "format": "date-time"},
+          "labels": {"type": "array", "items": {"type": "string"}}
+        }
+      }
+    }
+  }
+}
+`
+
+// ExportManifestFormat is the file format of an export manifest.
+type ExportManifestFormat int
+
+const (
+	ExportManifestFormatJSON ExportManifestFormat = iota
+	ExportManifestFormatCSV
+)
+
+func (f ExportManifestFormat) String() string {
+	switch f {
+	case ExportManifestFormatJSON:
+		return "json"
+	case ExportManifestFormatCSV:
+		return "csv"
+	default:
+		return "unknown"
+	}
+}
+
+// ExportManifestFormatFromString parses a format name. When empty, the format is deduced from the extension of path,
+// JSON by default.
+func ExportManifestFormatFromString(s, path string) (ExportManifestFormat, error) {
+	if len(s) == 0 {
+		s = strings.TrimPrefix(filepath.Ext(path), ".")
+	}
+
+	switch strings.ToLower(s) {
+	case "", "json":
+		return ExportManifestFormatJSON, nil
+	case "csv":
+		return ExportManifestFormatCSV, nil
+	default:
+		return ExportManifestFormatJSON, fmt.Errorf("unknown manifest format '%v', expected json or csv", s)
+	}
+}
+
+// ExportManifestEntry is a file of the export. The message fields are empty for the files which are not part of a
+// message, and for the exports without message index, such as those encrypted at rest.
+type ExportManifestEntry struct {
+	Path      string     `json:"path"`
+	Size      int64      `json:"size"`
+	SHA256    string     `json:"sha256"`
+	Modified  time.Time  `json:"modified"`
+	MessageID string     `json:"message_id,omitempty"`
+	Subject   string     `json:"subject,omitempty"`
+	Sender    string     `json:"sender,omitempty"`
+	Date      *time.Time `json:"date,omitempty"`
+	Labels    []string   `json:"labels,omitempty"`
+}
+
+type ExportManifest struct {
+	Schema       string                `json:"schema"`
+	Generated    time.Time             `json:"generated"`
+	ChecksumTime time.Time             `json:"checksum_time"` // When the files were last hashed, at the end of an export run.
+	Entries      []ExportManifestEntry `json:"entries"`       // Sorted by path.
+}
+
+var errInvalidExportManifest = errors.New("invalid export manifest")
+
+// exportManifestColumns are the columns of the CSV manifest.
+var exportManifestColumns = []string{ //nolint:gochecknoglobals
+	"path", "size", "sha256", "modified", "message_id", "subject", "sender", "date", "labels",
+}
+
+// BuildExportManifest returns the manifest of an export directory from its checksum manifest and message index. The
+// files are not read again, VerifyExport checks that they still match.
+func BuildExportManifest(exportDir string) (ExportManifest, error) {
+	checksums, err := LoadChecksumManifest(exportDir)
+	if err != nil {
+		return ExportManifest{}, err
+	}
+
+	messages := make(map[string]*MessageIndexEntry)
+
+	if index, err := LoadMessageIndex(exportDir); err == nil {
+		for i := range index.Messages {
+			for _, file := range index.Messages[i].Files {
+				messages[file] = &index.Messages[i]
+			}
+		}
+	}
+
+	manifest := ExportManifest{
+		Schema:       ExportManifestSchemaID,
+		Generated:    time.Now().UTC(),
+		ChecksumTime: checksums.Time,
+		Entries:      make([]ExportManifestEntry, 0, len(checksums.Files)),
+	}
+
+	for _, file := range checksums.Files {
+		entry := ExportManifestEntry{Path: file.Path, Size: file.Size, SHA256: file.SHA256, Modified: file.ModTime}
+
+		if message, ok := messages[file.Path]; ok {
+			date := message.Time
+
+			entry.MessageID = message.ID
+			entry.Subject = message.Subject
+			entry.Sender = message.Sender
+			entry.Date = &date
+			entry.Labels = message.Labels
+		}
+
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+
+	sort.Slice(manifest.Entries, func(i, j int) bool { return manifest.Entries[i].Path < manifest.Entries[j].Path })
+
+	return manifest, nil
+}
+
+// WriteExportManifest writes a manifest in the given format.
+func WriteExportManifest(w io.Writer, manifest ExportManifest, format ExportManifestFormat) error {
+	switch format {
+	case ExportManifestFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(manifest)
+
+	case ExportManifestFormatCSV:
+		writer := csv.NewWriter(w)
+
+		if err := writer.Write(exportManifestColumns); err != nil {
+			return err
+		}
+
+		for _, entry := range manifest.Entries {
+			date := ""
+			if entry.Date != nil {
+				date = entry.Date.UTC().Format(time.RFC3339)
+			}
+
+			if err := writer.Write([]string{
+				entry.Path,
+				strconv.FormatInt(entry.Size, 10),
+				entry.SHA256,
+				entry.Modified.UTC().Format(time.RFC3339Nano),
+				entry.MessageID,
+				entry.Subject,
+				entry.Sender,
+				date,
+				strings.Join(entry.Labels, ";"),
+			}); err != nil {
+				return err
+			}
+		}
+
+		writer.Flush()
+
+		return writer.Error()
+
+	default:
+		return fmt.Errorf("unknown manifest format %v", format)
+	}
+}
+
+// ReadExportManifest reads a manifest written by WriteExportManifest or by a tool following ExportManifestSchema. The
+// CSV manifests have no schema field, they follow the schema of their columns.
+func ReadExportManifest(r io.Reader, format ExportManifestFormat) (ExportManifest, error) {
+	var manifest ExportManifest
+
+	switch format {
+	case ExportManifestFormatJSON:
+		if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+			return ExportManifest{}, fmt.Errorf("%w: %w", errInvalidExportManifest, err)
+		}
+
+		if manifest.Schema != ExportManifestSchemaID {
+			return ExportManifest{}, fmt.Errorf("%w: unsupported schema '%v', expected '%v'",
+				errInvalidExportManifest, manifest.Schema, ExportManifestSchemaID)
+		}
+
+	case ExportManifestFormatCSV:
+		entries, err := readExportManifestCSV(r)
+		if err != nil {
+			return ExportManifest{}, fmt.Errorf("%w: %w", errInvalidExportManifest, err)
+		}
+
+		manifest = ExportManifest{Schema: ExportManifestSchemaID, Entries: entries}
+
+	default:
+		return ExportManifest{}, fmt.Errorf("unknown manifest format %v", format)
+	}
+
+	for _, entry := range manifest.Entries {
+		if len(entry.Path) == 0 || entry.Size < 0 || len(entry.SHA256) != 64 {
+			return ExportManifest{}, fmt.Errorf("%w: invalid entry '%v'", errInvalidExportManifest, entry.Path)
+		}
+	}
+
+	return manifest, nil
+}
+
+// readExportManifestCSV reads the rows of a CSV manifest. The columns are found by name, so that columns added later
+// and reordered columns are accepted.
+func readExportManifestCSV(r io.Reader) ([]ExportManifestEntry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the header: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+
+	for _, name := range exportManifestColumns[:4] {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column '%v'", name)
+		}
+	}
+
+	var entries []ExportManifestEntry
+
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return row[i]
+			}
+
+			return ""
+		}
+
+		entry := ExportManifestEntry{
+			Path:      field("path"),
+			SHA256:    field("sha256"),
+			MessageID: field("message_id"),
+			Subject:   field("subject"),
+			Sender:    field("sender"),
+		}
+
+		if entry.Size, err = strconv.ParseInt(field("size"), 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid size of '%v': %w", entry.Path, err)
+		}
+
+		if entry.Modified, err = time.Parse(time.RFC3339Nano, field("modified")); err != nil {
+			return nil, fmt.Errorf("invalid modification time of '%v': %w", entry.Path, err)
+		}
+
+		if date := field("date"); len(date) != 0 {
+			parsed, err := time.Parse(time.RFC3339, date)
+			if err != nil {
+				return nil, fmt.Errorf("invalid date of '%v': %w", entry.Path, err)
+			}
+
+			entry.Date = &parsed
+		}
+
+		if labels := field("labels"); len(labels) != 0 {
+			entry.Labels = strings.Split(labels, ";")
+		}
+
+		entries = append(entries, entry)
+	}
+}
+
+// CompareExportManifest compares a loaded manifest with the manifest of the export as it is now. The files of the
+// loaded manifest which changed since are reported as corrupted, those which no longer exist as missing and the files
+// added since as unlisted.
+func CompareExportManifest(loaded, current ExportManifest) []VerifyIssue {
+	files := make(map[string]ExportManifestEntry, len(current.Entries))
+	for _, entry := range current.Entries {
+		files[entry.Path] = entry
+	}
+
+	var issues []VerifyIssue
+
+	for _, entry := range loaded.Entries {
+		file, ok := files[entry.Path]
+		if !ok {
+			issues = append(issues, VerifyIssue{Type: VerifyIssueMissing, Path: entry.Path})
+			continue
+		}
+
+		delete(files, entry.Path)
+
+		if file.Size != entry.Size || !strings.EqualFold(file.SHA256, entry.SHA256) {
+			issues = append(issues, VerifyIssue{
+				Type:   VerifyIssueCorrupted,
+				Path:   entry.Path,
+				Detail: fmt.Sprintf("expected %v bytes with SHA-256 %v, found %v bytes with SHA-256 %v", entry.Size, entry.SHA256, file.Size, file.SHA256),
+			})
+		}
+	}
+
+	for path := range files {
+		issues = append(issues, VerifyIssue{Type: VerifyIssueUnlisted, Path: path})
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].Path < issues[j].Path })
+
+	return issues
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportManifest_RoundTrip(t *testing.T) {
+	dir := newManifestTestExport(t)
+
+	manifest, err := BuildExportManifest(dir)
+	require.NoError(t, err)
+	require.Equal(t, ExportManifestSchemaID, manifest.Schema)
+	require.Len(t, manifest.Entries, 4) // With the message index.
+
+	eml := manifest.Entries[2]
+	require.Equal(t, getEMLFileName("msg-1"), eml.Path)
+	require.Equal(t, "msg-1", eml.MessageID)
+	require.Equal(t, "Hello, world", eml.Subject)
+	require.Equal(t, []string{"Inbox"}, eml.Labels)
+	require.NotNil(t, eml.Date)
+	require.Empty(t, manifest.Entries[0].MessageID)
+
+	for _, format := range []ExportManifestFormat{ExportManifestFormatJSON, ExportManifestFormatCSV} {
+		var buffer bytes.Buffer
+		require.NoError(t, WriteExportManifest(&buffer, manifest, format))
+
+		loaded, err := ReadExportManifest(&buffer, format)
+		require.NoError(t, err, format)
+		require.Len(t, loaded.Entries, len(manifest.Entries))
+		require.Equal(t, manifest.Entries[2].Subject, loaded.Entries[2].Subject)
+		require.True(t, manifest.Entries[2].Date.Equal(*loaded.Entries[2].Date))
+		require.Empty(t, CompareExportManifest(loaded, manifest), format)
+	}
+}
+
+func TestExportManifest_Compare(t *testing.T) {
+	dir := newManifestTestExport(t)
+
+	loaded, err := BuildExportManifest(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getEMLFileName("msg-1")), []byte("Subject: X\r\n\r\n"), 0o600))
+	require.NoError(t, os.Remove(filepath.Join(dir, getMetadataFileName("msg-1"))))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getEMLFileName("msg-2")), []byte("Subject: 2\r\n\r\n"), 0o600))
+	require.NoError(t, writeChecksumManifest(context.Background(), filepath.Join(dir, "temp"), dir, logrus.WithField("test", "test")))
+
+	current, err := BuildExportManifest(dir)
+	require.NoError(t, err)
+
+	issues := CompareExportManifest(loaded, current)
+	require.Equal(t, []VerifyIssue{
+		{Type: VerifyIssueCorrupted, Path: getEMLFileName("msg-1"), Detail: issues[0].Detail},
+		{Type: VerifyIssueMissing, Path: getMetadataFileName("msg-1")},
+		{Type: VerifyIssueUnlisted, Path: getEMLFileName("msg-2")},
+	}, issues)
+}
+
+func TestReadExportManifest_CSV(t *testing.T) {
+	// The columns are found by name, the unknown ones are ignored.
+	csv := "sha256,path,extra,size,modified\n" +
+		strings.Repeat("a", 64) + ",a.eml,x,12,2024-05-01T10:00:00Z\n"
+
+	manifest, err := ReadExportManifest(strings.NewReader(csv), ExportManifestFormatCSV)
+	require.NoError(t, err)
+	require.Len(t, manifest.Entries, 1)
+	require.Equal(t, "a.eml", manifest.Entries[0].Path)
+	require.Equal(t, int64(12), manifest.Entries[0].Size)
+	require.Nil(t, manifest.Entries[0].Date)
+
+	_, err = ReadExportManifest(strings.NewReader("path,size\na.eml,12\n"), ExportManifestFormatCSV)
+	require.ErrorIs(t, err, errInvalidExportManifest)
+
+	_, err = ReadExportManifest(strings.NewReader(`{"schema":"urn:other","entries":[]}`), ExportManifestFormatJSON)
+	require.ErrorIs(t, err, errInvalidExportManifest)
+}
+
+func TestExportManifestFormatFromString(t *testing.T) {
+	format, err := ExportManifestFormatFromString("", "inventory.CSV")
+	require.NoError(t, err)
+	require.Equal(t, ExportManifestFormatCSV, format)
+
+	format, err = ExportManifestFormatFromString("json", "inventory.csv")
+	require.NoError(t, err)
+	require.Equal(t, ExportManifestFormatJSON, format)
+
+	_, err = ExportManifestFormatFromString("xml", "")
+	require.Error(t, err)
+}
+
+// newManifestTestExport returns an export directory with the label file and the files of a message, its checksum
+// manifest and its message index.
+func newManifestTestExport(t *testing.T) string {
+	dir := t.TempDir()
+	tmpDir := filepath.Join(dir, "temp")
+	log := logrus.WithField("test", "test")
+
+	require.NoError(t, os.MkdirAll(tmpDir, 0o700))
+
+	for name, content := range map[string]string{
+		getLabelFileName():           "[]",
+		getEMLFileName("msg-1"):      "Subject: Hello, world\r\n\r\n",
+		getMetadataFileName("msg-1"): "{}",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+	}
+
+	index := newMessageIndexCollector(dir)
+	index.add(&MessageMetadata{MessageMetadata: proton.MessageMetadata{
+		ID:       "msg-1",
+		Subject:  "Hello, world",
+		Time:     1714557600,
+		LabelIDs: []string{proton.InboxLabel},
+	}}, []string{filepath.Join(dir, getEMLFileName("msg-1")), filepath.Join(dir, getMetadataFileName("msg-1"))})
+
+	_, err := index.write(tmpDir, nil)
+	require.NoError(t, err)
+	require.NoError(t, writeChecksumManifest(context.Background(), tmpDir, dir, log))
+
+	return dir
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+)
+
+const mboxExtension = ".mbox"
+
+// getMBoxDirName returns the sub folder of the export folder the mbox files are written to.
+func getMBoxDirName() string {
+	return "mbox"
+}
+
+// mboxSystemLabelNames are the file names of the system labels. The aggregated labels (all mail, all drafts...) are
+// left out, their messages are all in another label.
+var mboxSystemLabelNames = map[string]string{ //nolint:gochecknoglobals
+	proton.InboxLabel:   "Inbox",
+	proton.TrashLabel:   "Trash",
+	proton.SpamLabel:    "Spam",
+	proton.ArchiveLabel: "Archive",
+	proton.SentLabel:    "Sent",
+	proton.DraftsLabel:  "Drafts",
+	proton.OutboxLabel:  "Outbox",
+	proton.StarredLabel: "Starred",
+}
+
+// mboxFallbackName is the file of the messages that are not in any of the labels with a file.
+const mboxFallbackName = "All Mail"
+
+// mboxWriter appends the messages to the mbox file of each of their labels, in the mboxrd format. Messages are
+// converted to LF line endings as mail clients expect. The mbox files are not written atomically: a message is
+// appended at once but an interrupted export can leave a partial message at the end of a file. It is safe for
+// concurrent use.
+type mboxWriter struct {
+	lock       sync.Mutex
+	fileByName map[string]string   // Label ID to mbox file name.
+	files      map[string]*os.File // Mbox path to open file.
+}
+
+// newMBoxWriter assigns an mbox file name to each label. Names are derived from the label paths, labels whose names
+// collide get a suffix derived from their ID.
+func newMBoxWriter(labels []proton.Label, names *pathNamer) *mboxWriter {
+	fileByName := make(map[string]string, len(mboxSystemLabelNames)+len(labels))
+	for id, name := range mboxSystemLabelNames {
+		fileByName[id] = name + mboxExtension
+	}
+
+	assignLabelFileNames(labels, fileByName, []string{mboxFallbackName + mboxExtension}, func(label proton.Label, suffix string) string {
+		return names.fitLabelName(getMBoxDirName(), utils.SafeFileName(getLabelPathName(label, ".")+suffix+mboxExtension), 0, true)
+	})
+
+	return &mboxWriter{
+		fileByName: fileByName,
+		files:      make(map[string]*os.File),
+	}
+}
+
+func (m *mboxWriter) getFilePaths(metadata *proton.MessageMetadata) []string {
+	names := m.getFileNames(metadata.LabelIDs)
+	for i := range names {
+		names[i] = getMBoxDirName() + "/" + names[i]
+	}
+
+	return names
+}
+
+func (m *mboxWriter) getFileNames(labelIDs []string) []string {
+	var names []string
+
+	for _, id := range labelIDs {
+		if name, ok := m.fileByName[id]; ok {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		names = append(names, mboxFallbackName+mboxExtension)
+	}
+
+	return names
+}
+
+// write appends the EML of a message to the mbox files of its labels in dir.
+func (m *mboxWriter) write(dir string, metadata *MessageMetadata, eml []byte) error {
+	entry := formatMBoxEntry(metadata, eml)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, name := range m.getFileNames(metadata.LabelIDs) {
+		file, err := m.getFile(filepath.Join(dir, getMBoxDirName(), name))
+		if err != nil {
+			return err
+		}
+
+		if _, err := file.Write(entry); err != nil {
+			return fmt.Errorf("failed to write mbox '%v': %w", file.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// getFile returns the open mbox file at path. The lock must be held.
+func (m *mboxWriter) getFile(path string) (*os.File, error) {
+	if file, ok := m.files[path]; ok {
+		return file, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create mbox directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mbox: %w", err)
+	}
+
+	m.files[path] = file
+
+	return file, nil
+}
+
+// close flushes and closes all the mbox files.
+func (m *mboxWriter) close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var result error
+
+	for path, file := range m.files {
+		if err := file.Sync(); err != nil && result == nil {
+			result = fmt.Errorf("failed to sync mbox '%v': %w", path, err)
+		}
+
+		if err := file.Close(); err != nil && result == nil {
+			result = fmt.Errorf("failed to close mbox '%v': %w", path, err)
+		}
+	}
+
+	m.files = make(map[string]*os.File)
+
+	return result
+}
+
+// formatMBoxEntry returns the 'From ' separator line followed by the message, with the lines starting with any
+// number of '>' followed by 'From ' quoted with an additional '>' (mboxrd).
+func formatMBoxEntry(metadata *MessageMetadata, eml []byte) []byte {
+	sender := "MAILER-DAEMON"
+	if metadata.Sender != nil && len(metadata.Sender.Address) != 0 && !strings.ContainsAny(metadata.Sender.Address, " \t") {
+		sender = metadata.Sender.Address
+	}
+
+	var buffer bytes.Buffer
+
+	buffer.WriteString("From " + sender + " " + time.Unix(metadata.Time, 0).UTC().Format(time.ANSIC) + "\n")
+
+	eml = bytes.ReplaceAll(eml, []byte("\r\n"), []byte("\n"))
+
+	for len(eml) != 0 {
+		line, rest, _ := bytes.Cut(eml, []byte("\n"))
+		eml = rest
+
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			buffer.WriteByte('>')
+		}
+
+		buffer.Write(line)
+		buffer.WriteByte('\n')
+	}
+
+	// Messages are separated by an empty line.
+	buffer.WriteByte('\n')
+
+	return buffer.Bytes()
+}
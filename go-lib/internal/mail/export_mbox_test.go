@@ -0,0 +1,97 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatMBoxEntry(t *testing.T) {
+	metadata := MessageMetadata{MessageMetadata: proton.MessageMetadata{
+		Sender: &mail.Address{Address: "alice@proton.me"},
+		Time:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix(),
+	}}
+
+	entry := formatMBoxEntry(&metadata, []byte("Subject: test\r\n\r\nFrom here\r\n>From there\r\nFromage"))
+
+	require.Equal(t, "From alice@proton.me Tue Jan  2 03:04:05 2024\n"+
+		"Subject: test\n\n>From here\n>>From there\nFromage\n\n", string(entry))
+}
+
+func TestMBoxWriter(t *testing.T) {
+	dir := t.TempDir()
+
+	writer := newMBoxWriter([]proton.Label{
+		{ID: "l1", Name: "Work", Path: []string{"Work"}, Type: proton.LabelTypeFolder},
+		{ID: "l2", Name: "Child", Path: []string{"Work", "Child"}, Type: proton.LabelTypeFolder},
+		{ID: "l3", Name: "inbox", Path: []string{"inbox"}, Type: proton.LabelTypeLabel},
+	}, nil)
+
+	require.Equal(t, []string{"Inbox.mbox", "Work.mbox"}, writer.getFileNames([]string{proton.InboxLabel, proton.AllMailLabel, "l1"}))
+	require.Equal(t, []string{"Work.Child.mbox"}, writer.getFileNames([]string{"l2"}))
+	require.NotEqual(t, "inbox.mbox", writer.getFileNames([]string{"l3"})[0])
+	require.Equal(t, []string{"All Mail.mbox"}, writer.getFileNames([]string{proton.AllMailLabel}))
+
+	for _, labelIDs := range [][]string{{proton.InboxLabel}, {proton.InboxLabel, "l1"}} {
+		metadata := MessageMetadata{MessageMetadata: proton.MessageMetadata{LabelIDs: labelIDs}}
+		require.NoError(t, writer.write(dir, &metadata, []byte("Subject: test\r\n\r\nBody\r\n")))
+	}
+
+	require.NoError(t, writer.close())
+
+	inbox, err := os.ReadFile(filepath.Join(dir, getMBoxDirName(), "Inbox.mbox"))
+	require.NoError(t, err)
+	require.Equal(t, 2, countMBoxMessages(inbox))
+
+	work, err := os.ReadFile(filepath.Join(dir, getMBoxDirName(), "Work.mbox"))
+	require.NoError(t, err)
+	require.Equal(t, 1, countMBoxMessages(work))
+}
+
+func TestOutputFormatFromString(t *testing.T) {
+	format, err := OutputFormatFromString("MBOX")
+	require.NoError(t, err)
+	require.Equal(t, OutputFormatMBox, format)
+
+	format, err = OutputFormatFromString("maildir")
+	require.NoError(t, err)
+	require.Equal(t, OutputFormatMaildir, format)
+
+	_, err = OutputFormatFromString("pst")
+	require.Error(t, err)
+}
+
+func countMBoxMessages(data []byte) int {
+	count := 0
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("From ")) {
+			count++
+		}
+	}
+
+	return count
+}
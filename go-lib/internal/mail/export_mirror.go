@@ -0,0 +1,147 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/gluon/async"
+)
+
+var ErrInvalidMirror = errors.New("invalid mirror destination")
+
+// MirrorResult is the outcome of copying a finished export to one of the mirrors, see ExportTask.AddMirror.
+type MirrorResult struct {
+	Path      string
+	FileCount int
+	Duration  time.Duration
+	Error     string `json:",omitempty"`
+}
+
+// AddMirror copies the export to dir, a local folder or an s3://bucket/path URL, once it finished successfully, so that
+// a single run yields several copies. Each mirror is written with RelocateExport and is verified independently of the
+// others.
+func (e *ExportTask) AddMirror(dir string) error {
+	if len(dir) == 0 {
+		return fmt.Errorf("%w: empty path", ErrInvalidMirror)
+	}
+
+	abs, err := getMirrorLocation(dir)
+	if err != nil {
+		return fmt.Errorf("%w '%v': %v", ErrInvalidMirror, dir, err) //nolint:errorlint
+	}
+
+	for _, mirror := range e.mirrors {
+		if mirror == abs {
+			return fmt.Errorf("%w '%v': listed more than once", ErrInvalidMirror, dir)
+		}
+	}
+
+	e.mirrors = append(e.mirrors, abs)
+
+	return nil
+}
+
+// SetMirrorParallel writes the mirrors at the same time instead of one after the other.
+func (e *ExportTask) SetMirrorParallel(parallel bool) {
+	e.mirrorParallel = parallel
+}
+
+func (e *ExportTask) GetMirrors() []string {
+	return e.mirrors
+}
+
+// getMirrorLocation returns the absolute path of a local mirror, or the URL of an S3 mirror without trailing slash.
+func getMirrorLocation(dir string) (string, error) {
+	if !IsRemoteBackup(dir) {
+		return filepath.Abs(dir)
+	}
+
+	target, err := newS3RelocationTarget(dir)
+	if err != nil {
+		return "", err
+	}
+
+	return target.getLocation(), nil
+}
+
+// getMirrorPath returns the path of the export in the mirror dir, which keeps the <email>/mail_... layout.
+func (e *ExportTask) getMirrorPath(dir string) string {
+	if IsRemoteBackup(dir) {
+		return dir + "/" + filepath.Base(filepath.Dir(e.exportDir)) + "/" + filepath.Base(e.exportDir)
+	}
+
+	return filepath.Join(dir, filepath.Base(filepath.Dir(e.exportDir)), filepath.Base(e.exportDir))
+}
+
+// writeMirrors copies the export to all the mirrors and returns the first mirror error. A failing mirror does not stop
+// the others.
+func (e *ExportTask) writeMirrors(ctx context.Context) ([]MirrorResult, error) {
+	results := make([]MirrorResult, len(e.mirrors))
+	errs := make([]error, len(e.mirrors))
+
+	mirror := func(i int) {
+		path := e.getMirrorPath(e.mirrors[i])
+		log := e.log.WithField("mirror", path)
+
+		log.Info("Writing mirror")
+
+		report, err := RelocateExport(ctx, e.exportDir, path, false)
+		results[i] = MirrorResult{Path: path, FileCount: len(report.Manifest.Files), Duration: report.Duration}
+
+		if err != nil {
+			log.WithError(err).Error("Failed to write mirror")
+			results[i].Error = err.Error()
+			errs[i] = fmt.Errorf("failed to write mirror '%v': %w", path, err)
+		}
+	}
+
+	if e.mirrorParallel {
+		var wg sync.WaitGroup
+
+		for i := range e.mirrors {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+				defer async.HandlePanic(e.session.GetPanicHandler())
+
+				mirror(i)
+			}(i)
+		}
+
+		wg.Wait()
+	} else {
+		for i := range e.mirrors {
+			mirror(i)
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return results, err
+		}
+	}
+
+	return results, nil
+}
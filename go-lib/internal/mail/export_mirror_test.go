@@ -0,0 +1,108 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportTask_WriteMirrors(t *testing.T) {
+	root := t.TempDir()
+	exportDir := filepath.Join(root, "export", "user@proton.me", "mail_20240102_030405")
+
+	require.NoError(t, os.MkdirAll(filepath.Join(exportDir, "temp"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(exportDir, "msg.eml"), []byte("Subject: test\r\n\r\nBody"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(exportDir, "msg.metadata.json"), []byte("{}"), 0o600))
+
+	task := &ExportTask{exportDir: exportDir, log: logrus.WithField("export", "mail")}
+
+	mirrors := []string{filepath.Join(root, "mirror1"), filepath.Join(root, "mirror2")}
+	for _, mirror := range mirrors {
+		require.NoError(t, task.AddMirror(mirror))
+	}
+
+	require.ErrorIs(t, task.AddMirror(mirrors[0]), ErrInvalidMirror)
+	require.ErrorIs(t, task.AddMirror(""), ErrInvalidMirror)
+
+	results, err := task.writeMirrors(context.Background())
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	for i, result := range results {
+		require.Empty(t, result.Error)
+		require.Equal(t, 2, result.FileCount)
+		require.Equal(t, filepath.Join(mirrors[i], "user@proton.me", "mail_20240102_030405"), result.Path)
+
+		data, err := os.ReadFile(filepath.Join(result.Path, "msg.eml"))
+		require.NoError(t, err)
+		require.Equal(t, "Subject: test\r\n\r\nBody", string(data))
+
+		_, err = LoadRelocationManifest(result.Path)
+		require.NoError(t, err)
+	}
+
+	// A mirror inside the export fails without preventing the other mirrors.
+	task = &ExportTask{exportDir: exportDir, log: logrus.WithField("export", "mail")}
+	require.NoError(t, task.AddMirror(filepath.Join(exportDir, "nested")))
+	require.NoError(t, task.AddMirror(filepath.Join(root, "mirror3")))
+
+	results, err = task.writeMirrors(context.Background())
+	require.ErrorIs(t, err, ErrRelocationOverlap)
+	require.NotEmpty(t, results[0].Error)
+	require.Empty(t, results[1].Error)
+}
+
+func TestExportTask_WriteMirrors_S3(t *testing.T) {
+	server := &testRemoteServer{files: make(map[string]string), gets: make(map[string]int)}
+	httpServer := httptest.NewServer(http.HandlerFunc(server.serveS3))
+	defer httpServer.Close()
+
+	t.Setenv(RemoteS3EndpointEnvVar, httpServer.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	exportDir := filepath.Join(t.TempDir(), "user@proton.me", "mail_20240102_030405")
+
+	require.NoError(t, os.MkdirAll(exportDir, 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(exportDir, "msg.eml"), []byte("Subject: test\r\n\r\nBody"), 0o600))
+
+	task := &ExportTask{exportDir: exportDir, log: logrus.WithField("export", "mail")}
+
+	require.NoError(t, task.AddMirror("s3://bucket/mirror/"))
+	require.ErrorIs(t, task.AddMirror("s3://bucket/mirror"), ErrInvalidMirror)
+	require.ErrorIs(t, task.AddMirror("webdav://host/mirror"), ErrInvalidMirror)
+	require.ErrorIs(t, task.AddMirror("s3://key:secret@bucket/mirror"), ErrInvalidMirror)
+
+	results, err := task.writeMirrors(context.Background())
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Empty(t, results[0].Error)
+	require.Equal(t, 1, results[0].FileCount)
+	require.Equal(t, "s3://bucket/mirror/user@proton.me/mail_20240102_030405", results[0].Path)
+
+	require.Equal(t, "Subject: test\r\n\r\nBody", server.files["mirror/user@proton.me/mail_20240102_030405/msg.eml"])
+	require.Contains(t, server.files, "mirror/user@proton.me/mail_20240102_030405/"+getRelocationManifestFileName())
+}
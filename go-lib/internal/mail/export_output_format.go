@@ -0,0 +1,161 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/go-proton-api"
+)
+
+// OutputFormat controls how the exported messages are written.
+type OutputFormat int
+
+const (
+	OutputFormatEML     OutputFormat = iota // One EML file per message.
+	OutputFormatMBox                        // One mbox file per label and folder, see mboxWriter.
+	OutputFormatMaildir                     // One Maildir++ folder per label and folder, see maildirWriter.
+	OutputFormatPack                        // Messages appended to large pack files, see packWriter.
+	OutputFormatZip                         // One zip archive per export folder, see archiveWriter.
+	OutputFormatTarZst                      // One zstd compressed tar archive per export folder, see archiveWriter.
+)
+
+func (f OutputFormat) String() string {
+	switch f {
+	case OutputFormatEML:
+		return "eml"
+	case OutputFormatMBox:
+		return "mbox"
+	case OutputFormatMaildir:
+		return "maildir"
+	case OutputFormatPack:
+		return "pack"
+	case OutputFormatZip:
+		return "zip"
+	case OutputFormatTarZst:
+		return "tar.zst"
+	default:
+		return "unknown"
+	}
+}
+
+func OutputFormatFromString(s string) (OutputFormat, error) {
+	switch strings.ToLower(s) {
+	case "eml":
+		return OutputFormatEML, nil
+	case "mbox":
+		return OutputFormatMBox, nil
+	case "maildir":
+		return OutputFormatMaildir, nil
+	case "pack":
+		return OutputFormatPack, nil
+	case "zip":
+		return OutputFormatZip, nil
+	case "tar.zst":
+		return OutputFormatTarZst, nil
+	default:
+		return OutputFormatEML, fmt.Errorf("unknown output format '%v'", s)
+	}
+}
+
+// isArchive returns whether the messages are written to a single archive per export folder.
+func (f OutputFormat) isArchive() bool {
+	return f == OutputFormatZip || f == OutputFormatTarZst
+}
+
+// labelFileWriter writes the assembled messages to files shared by the messages of a label, instead of one EML file
+// per message.
+type labelFileWriter interface {
+	// getFilePaths returns the files the message is written to, relative to the export folder and with forward slashes.
+	getFilePaths(metadata *proton.MessageMetadata) []string
+	write(dir string, metadata *MessageMetadata, eml []byte) error
+	close() error
+}
+
+// bundleWriter is a labelFileWriter that also stores the metadata files of the messages, in files shared by the
+// messages of all the labels, see packWriter and archiveWriter.
+type bundleWriter interface {
+	labelFileWriter
+	// takeBundlePath returns the file a message was written to.
+	takeBundlePath(messageID string) (string, bool)
+}
+
+// newLabelFileWriter returns nil for the formats that write one EML file per message. The pack and archive writers do
+// not depend on the labels, see newPackWriter and newArchiveWriter. names shortens the label names that do not fit the path budget.
+func newLabelFileWriter(format OutputFormat, labels []proton.Label, names *pathNamer) labelFileWriter {
+	switch format {
+	case OutputFormatMBox:
+		return newMBoxWriter(labels, names)
+	case OutputFormatMaildir:
+		return newMaildirWriter(labels, names)
+	case OutputFormatEML, OutputFormatPack, OutputFormatZip, OutputFormatTarZst:
+	}
+
+	return nil
+}
+
+// assignLabelFileNames adds a file name for each user label to fileByID, which holds the names of the system labels.
+// Names colliding with a name already assigned or reserved, ignoring case, are built again with a suffix derived from
+// the label ID.
+func assignLabelFileNames(
+	labels []proton.Label,
+	fileByID map[string]string,
+	reserved []string,
+	getFileName func(label proton.Label, suffix string) string,
+) {
+	taken := make(map[string]struct{}, len(fileByID)+len(reserved)+len(labels))
+
+	for _, name := range fileByID {
+		taken[strings.ToLower(name)] = struct{}{}
+	}
+
+	for _, name := range reserved {
+		taken[strings.ToLower(name)] = struct{}{}
+	}
+
+	labels = append([]proton.Label{}, labels...)
+	sort.Slice(labels, func(i, j int) bool { return labels[i].ID < labels[j].ID })
+
+	for _, label := range labels {
+		if label.Type == proton.LabelTypeSystem {
+			continue
+		}
+
+		fileName := getFileName(label, "")
+		if _, ok := taken[strings.ToLower(fileName)]; ok {
+			sum := sha256.Sum256([]byte(label.ID))
+			fileName = getFileName(label, "_"+hex.EncodeToString(sum[:4]))
+		}
+
+		fileByID[label.ID] = fileName
+		taken[strings.ToLower(fileName)] = struct{}{}
+	}
+}
+
+// getLabelPathName joins the path of the label with separator.
+func getLabelPathName(label proton.Label, separator string) string {
+	if len(label.Path) == 0 {
+		return label.Name
+	}
+
+	return strings.Join(label.Path, separator)
+}
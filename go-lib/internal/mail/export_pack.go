@@ -0,0 +1,430 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+)
+
+// Pack files
+// ----------
+// With OutputFormatPack, the EML and metadata files of the assembled messages are appended to large pack files instead
+// of being written as separate files, which keeps the file count low on file systems that handle millions of small
+// files poorly:
+//
+// <export>
+//  |- labels.json
+//  |- packs
+//  |   |- pack-<random>.pack
+//  |   |- pack-<random>.idx
+//  |- msg-id.metadata.json  (messages that could not be assembled keep the regular layout)
+//  |- msg-id/
+//
+// A pack starts with packMagic followed by entries made of the length of the file name (uint16), the file name, the
+// length of the data (uint64), the SHA-256 of the data and the data, integers being big endian. The EML file of a
+// message is appended before its metadata file, the metadata marks the message as complete. Packs are sealed once they
+// reach PackFileMaxSize or at the end of the export and their index is then written next to them. The index only
+// speeds up reading: the packs of an interrupted export have no index and are scanned instead, see packFS.
+//
+// UnpackExport converts a pack export to the regular layout.
+
+const packExtension = ".pack"
+const packIndexExtension = ".idx"
+
+// PackFileMaxSize is the size above which a new pack is started.
+const PackFileMaxSize = 256 * MB
+
+const PackIndexVersion = 1
+
+const packMagic = "ETPACK1\n"
+
+// getPackDirName returns the sub folder of the export folder the packs are written to.
+func getPackDirName() string {
+	return "packs"
+}
+
+// PackIndex lists the files of a pack.
+type PackIndex struct {
+	Entries []PackIndexEntry
+}
+
+type PackIndexEntry struct {
+	Name   string
+	Offset int64 // Offset of the data in the pack.
+	Size   int64
+	SHA256 string
+}
+
+// packEntryHeader returns the header of a pack entry.
+func packEntryHeader(name string, data []byte) []byte {
+	header := make([]byte, 0, 2+len(name)+8+sha256.Size)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(name)))
+	header = append(header, name...)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(data)))
+	hash := sha256.Sum256(data)
+
+	return append(header, hash[:]...)
+}
+
+// openPack is the pack being appended to in a folder of the export.
+type openPack struct {
+	file  *os.File
+	path  string
+	size  int64
+	index PackIndex
+}
+
+// packWriter appends the assembled messages and their metadata to the packs of their folder. It is safe for concurrent
+// use.
+type packWriter struct {
+	lock    sync.Mutex
+	tempDir string
+	maxSize int64
+	packs   map[string]*openPack // Pack being appended to by folder.
+	written map[string]string    // Pack each message was written to, until taken by the write stage, see takeBundlePath.
+
+	plannedSize int64 // Size of the messages planned by the dry run in the current pack.
+	plannedPack string
+}
+
+func newPackWriter(tempDir string, maxSize int64) *packWriter {
+	return &packWriter{
+		tempDir: tempDir,
+		maxSize: maxSize,
+		packs:   make(map[string]*openPack),
+		written: make(map[string]string),
+	}
+}
+
+// getFilePaths returns the pack the dry run expects the message in, based on the size reported by the API.
+func (p *packWriter) getFilePaths(metadata *proton.MessageMetadata) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.plannedPack) == 0 || (p.plannedSize != 0 && p.plannedSize+int64(metadata.Size) > p.maxSize) {
+		p.plannedPack = newPackName()
+		p.plannedSize = 0
+	}
+
+	p.plannedSize += int64(metadata.Size)
+
+	return []string{getPackDirName() + "/" + p.plannedPack + packExtension}
+}
+
+func (p *packWriter) write(dir string, metadata *MessageMetadata, eml []byte) error {
+	metadataBytes, err := metadata.toBytes()
+	if err != nil {
+		return fmt.Errorf("failed to generate message metadata: %w", err)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pack, err := p.getPack(dir, int64(len(eml)+len(metadataBytes)))
+	if err != nil {
+		return err
+	}
+
+	if err := pack.append(getEMLFileName(metadata.ID), eml); err != nil {
+		return err
+	}
+
+	if err := pack.append(getMetadataFileName(metadata.ID), metadataBytes); err != nil {
+		return err
+	}
+
+	p.written[metadata.ID] = pack.path
+
+	return nil
+}
+
+// takeBundlePath returns the pack a message was written to.
+func (p *packWriter) takeBundlePath(messageID string) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	path, ok := p.written[messageID]
+	delete(p.written, messageID)
+
+	return path, ok
+}
+
+// getPack returns the pack of dir that size more bytes can be appended to. The lock must be held.
+func (p *packWriter) getPack(dir string, size int64) (*openPack, error) {
+	pack, ok := p.packs[dir]
+	if ok && (pack.size+size <= p.maxSize || len(pack.index.Entries) == 0) {
+		return pack, nil
+	}
+
+	if ok {
+		delete(p.packs, dir)
+
+		if err := pack.seal(p.tempDir); err != nil {
+			return nil, err
+		}
+	}
+
+	packDir := filepath.Join(dir, getPackDirName())
+	if err := os.MkdirAll(packDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create pack directory: %w", err)
+	}
+
+	path := filepath.Join(packDir, newPackName()+packExtension)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pack: %w", err)
+	}
+
+	if _, err := file.WriteString(packMagic); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to write pack '%v': %w", path, err)
+	}
+
+	pack = &openPack{file: file, path: path, size: int64(len(packMagic))}
+	p.packs[dir] = pack
+
+	return pack, nil
+}
+
+// close seals all the packs.
+func (p *packWriter) close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var result error
+
+	for dir, pack := range p.packs {
+		if err := pack.seal(p.tempDir); err != nil && result == nil {
+			result = err
+		}
+
+		delete(p.packs, dir)
+	}
+
+	return result
+}
+
+func (o *openPack) append(name string, data []byte) error {
+	header := packEntryHeader(name, data)
+
+	if _, err := o.file.Write(append(header, data...)); err != nil {
+		return fmt.Errorf("failed to write pack '%v': %w", o.path, err)
+	}
+
+	o.index.Entries = append(o.index.Entries, PackIndexEntry{
+		Name:   name,
+		Offset: o.size + int64(len(header)),
+		Size:   int64(len(data)),
+		SHA256: hex.EncodeToString(header[len(header)-sha256.Size:]),
+	})
+	o.size += int64(len(header) + len(data))
+
+	return nil
+}
+
+// seal flushes and closes the pack, then writes its index.
+func (o *openPack) seal(tempDir string) error {
+	if err := o.file.Sync(); err != nil {
+		_ = o.file.Close()
+		return fmt.Errorf("failed to sync pack '%v': %w", o.path, err)
+	}
+
+	if err := o.file.Close(); err != nil {
+		return fmt.Errorf("failed to close pack '%v': %w", o.path, err)
+	}
+
+	return o.writeIndex(tempDir)
+}
+
+// writeIndex writes the index next to the pack.
+func (o *openPack) writeIndex(tempDir string) error {
+	data, err := utils.GenerateVersionedJSON(PackIndexVersion, &o.index)
+	if err != nil {
+		return fmt.Errorf("failed to json encode pack index: %w", err)
+	}
+
+	indexPath := getPackIndexPath(o.path)
+	if err := utils.WriteFileSafe(tempDir, indexPath, data, &utils.Sha256IntegrityChecker{}); err != nil {
+		return fmt.Errorf("failed to write '%v': %w", indexPath, err)
+	}
+
+	return nil
+}
+
+func newPackName() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(fmt.Errorf("failed to generate pack name: %w", err))
+	}
+
+	return "pack-" + hex.EncodeToString(id[:])
+}
+
+// getPackIndexPath returns the path of the index of the pack at packPath.
+func getPackIndexPath(packPath string) string {
+	return packPath[:len(packPath)-len(packExtension)] + packIndexExtension
+}
+
+// UnpackReport is the outcome of the conversion of a pack export.
+type UnpackReport struct {
+	PackCount     int
+	FileCount     int // Files extracted during this run.
+	ExistingCount int // Files that were already extracted.
+	Duration      time.Duration
+}
+
+// UnpackExport extracts the files stored in the packs of an export to the regular layout, then removes the packs.
+// The EML file of a message is extracted before its metadata file and the files already present are not extracted
+// again, so an interrupted conversion can be resumed by running it again.
+func UnpackExport(ctx context.Context, exportDir string) (UnpackReport, error) {
+	startTime := time.Now()
+	log := logrus.WithField("unpack", "mail").WithField("path", exportDir)
+
+	if info, err := os.Stat(exportDir); err != nil {
+		return UnpackReport{}, fmt.Errorf("failed to access export directory: %w", err)
+	} else if !info.IsDir() {
+		return UnpackReport{}, fmt.Errorf("'%v' is not a directory", exportDir)
+	}
+
+	fsys := os.DirFS(exportDir)
+
+	var dirs []string
+
+	if err := fs.WalkDir(fsys, ".", func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() && entry.Name() == getPackDirName() {
+			dirs = append(dirs, path.Dir(filePath))
+			return fs.SkipDir
+		}
+
+		return nil
+	}); err != nil {
+		return UnpackReport{}, fmt.Errorf("failed to list export directory: %w", err)
+	}
+
+	if len(dirs) == 0 {
+		return UnpackReport{}, fmt.Errorf("no packs found in '%v'", exportDir)
+	}
+
+	tmpDir := filepath.Join(exportDir, "temp")
+	if err := os.MkdirAll(tmpDir, 0o700); err != nil {
+		return UnpackReport{}, fmt.Errorf("failed to create unpack tmp directory: %w", err)
+	}
+
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.WithError(err).Error("Failed to remove temp directory")
+		}
+	}()
+
+	log.Info("Starting unpack")
+
+	var report UnpackReport
+
+	for _, dir := range dirs {
+		if err := unpackDir(ctx, fsys, exportDir, tmpDir, dir, &report); err != nil {
+			return report, err
+		}
+
+		packDir := filepath.Join(exportDir, filepath.FromSlash(dir), getPackDirName())
+		if err := os.RemoveAll(packDir); err != nil {
+			return report, fmt.Errorf("failed to remove '%v': %w", packDir, err)
+		}
+	}
+
+	report.Duration = time.Since(startTime)
+
+	log.WithField("files", report.FileCount).WithField("existing", report.ExistingCount).Info("Unpack finished")
+
+	return report, nil
+}
+
+// unpackDir extracts the files of the packs of dir, in the order they were written.
+func unpackDir(ctx context.Context, fsys fs.FS, exportDir, tmpDir, dir string, report *UnpackReport) error {
+	packed, err := loadPackedFiles(fsys, dir)
+	if err != nil {
+		return err
+	}
+
+	locations := make([]packLocation, 0, len(packed))
+	packs := make(map[string]struct{})
+
+	for _, location := range packed {
+		locations = append(locations, location)
+		packs[location.packPath] = struct{}{}
+	}
+
+	sort.Slice(locations, func(i, j int) bool {
+		if locations[i].packPath != locations[j].packPath {
+			return locations[i].packPath < locations[j].packPath
+		}
+
+		return locations[i].entry.Offset < locations[j].entry.Offset
+	})
+
+	report.PackCount += len(packs)
+
+	for _, location := range locations {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		dstPath := filepath.Join(exportDir, filepath.FromSlash(dir), location.entry.Name)
+
+		if _, err := os.Stat(dstPath); err == nil {
+			report.ExistingCount++
+			continue
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to access '%v': %w", dstPath, err)
+		}
+
+		data, err := readPackEntry(fsys, location)
+		if err != nil {
+			return err
+		}
+
+		if err := utils.WriteFileSafe(tmpDir, dstPath, data, &utils.Sha256IntegrityChecker{}); err != nil {
+			return fmt.Errorf("failed to write '%v': %w", dstPath, err)
+		}
+
+		report.FileCount++
+	}
+
+	return nil
+}
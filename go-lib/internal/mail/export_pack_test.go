@@ -0,0 +1,165 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestPacks(t *testing.T, dir string, ids ...string) {
+	writer := newPackWriter(t.TempDir(), 64)
+
+	for _, id := range ids {
+		metadata := MessageMetadata{MessageMetadata: proton.MessageMetadata{ID: id, Subject: "subject " + id}}
+		require.NoError(t, writer.write(dir, &metadata, []byte("Subject: "+id+"\r\n\r\nBody\r\n")))
+
+		packPath, ok := writer.takeBundlePath(id)
+		require.True(t, ok)
+		require.FileExists(t, packPath)
+	}
+
+	require.NoError(t, writer.close())
+}
+
+func TestPackWriter(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPacks(t, dir, "msg-1", "msg-2", "msg-3")
+
+	packs, err := filepath.Glob(filepath.Join(dir, getPackDirName(), "*"+packExtension))
+	require.NoError(t, err)
+	require.Len(t, packs, 3)
+
+	for _, pack := range packs {
+		require.FileExists(t, getPackIndexPath(pack))
+	}
+
+	fsys := newPackFS(os.DirFS(dir))
+
+	entries, err := fs.ReadDir(fsys, ".")
+	require.NoError(t, err)
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	require.Equal(t, []string{
+		getEMLFileName("msg-1"), getMetadataFileName("msg-1"),
+		getEMLFileName("msg-2"), getMetadataFileName("msg-2"),
+		getEMLFileName("msg-3"), getMetadataFileName("msg-3"),
+		getPackDirName(),
+	}, names)
+
+	eml, err := fs.ReadFile(fsys, getEMLFileName("msg-2"))
+	require.NoError(t, err)
+	require.Equal(t, "Subject: msg-2\r\n\r\nBody\r\n", string(eml))
+
+	metadata, err := loadMetadataFileFS(fsys, getMetadataFileName("msg-2"))
+	require.NoError(t, err)
+	require.Equal(t, "subject msg-2", metadata.Subject)
+
+	_, err = fsys.Open(getEMLFileName("msg-4"))
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestPackFS_ScanWithoutIndex(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPacks(t, dir, "msg-1", "msg-2")
+
+	packs, err := filepath.Glob(filepath.Join(dir, getPackDirName(), "*"+packExtension))
+	require.NoError(t, err)
+
+	for _, pack := range packs {
+		require.NoError(t, os.Remove(getPackIndexPath(pack)))
+	}
+
+	// An interrupted export leaves a truncated entry at the end of the pack.
+	file, err := os.OpenFile(packs[0], os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = file.Write(packEntryHeader("msg-9.eml", []byte("Subject: truncated"))[:12])
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	fsys := newPackFS(os.DirFS(dir))
+
+	for _, id := range []string{"msg-1", "msg-2"} {
+		metadata, err := loadMetadataFileFS(fsys, getMetadataFileName(id))
+		require.NoError(t, err)
+		require.Equal(t, id, metadata.ID)
+	}
+
+	_, err = fs.Stat(fsys, "msg-9.eml")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestPackFS_Corrupted(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPacks(t, dir, "msg-1")
+
+	packs, err := filepath.Glob(filepath.Join(dir, getPackDirName(), "*"+packExtension))
+	require.NoError(t, err)
+	require.Len(t, packs, 1)
+
+	data, err := os.ReadFile(packs[0])
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(packs[0], []byte(strings.Replace(string(data), "Body", "B0dy", 1)), 0o600))
+
+	_, err = fs.ReadFile(newPackFS(os.DirFS(dir)), getEMLFileName("msg-1"))
+	require.ErrorIs(t, err, ErrPackCorrupted)
+
+	_, err = scanPack(strings.NewReader("not a pack"))
+	require.ErrorIs(t, err, ErrPackCorrupted)
+}
+
+func TestUnpackExport(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPacks(t, dir, "msg-1", "msg-2")
+	writeTestPacks(t, filepath.Join(dir, getAutoGeneratedDirName()), "msg-3")
+
+	// A file extracted by an interrupted run is not extracted again.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getEMLFileName("msg-1")), []byte("Subject: msg-1\r\n\r\nBody\r\n"), 0o600))
+
+	report, err := UnpackExport(context.Background(), dir)
+	require.NoError(t, err)
+	require.Equal(t, 3, report.PackCount)
+	require.Equal(t, 5, report.FileCount)
+	require.Equal(t, 1, report.ExistingCount)
+
+	require.NoDirExists(t, filepath.Join(dir, getPackDirName()))
+	require.NoDirExists(t, filepath.Join(dir, getAutoGeneratedDirName(), getPackDirName()))
+	require.NoDirExists(t, filepath.Join(dir, "temp"))
+
+	eml, err := os.ReadFile(filepath.Join(dir, getAutoGeneratedDirName(), getEMLFileName("msg-3")))
+	require.NoError(t, err)
+	require.Equal(t, "Subject: msg-3\r\n\r\nBody\r\n", string(eml))
+
+	metadata, err := loadMetadataFileFS(os.DirFS(dir), getMetadataFileName("msg-2"))
+	require.NoError(t, err)
+	require.Equal(t, "msg-2", metadata.ID)
+
+	_, err = UnpackExport(context.Background(), dir)
+	require.Error(t, err)
+}
@@ -0,0 +1,626 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/klauspost/reedsolomon"
+	"github.com/sirupsen/logrus"
+)
+
+// Parity
+// ------
+// With ExportTask.SetParity, the export ends by writing Reed-Solomon parity data for the files of the checksum
+// manifest, so that an export kept for years on discs or disks that partially decay can be rebuilt without the
+// account, see RepairExportWithParity. The files are read as a single stream in the order of the manifest, cut in
+// shards of ShardSize bytes. Shard n belongs to stripe n % StripeCount, the stripes interleave the stream so that a
+// damaged area, e.g. a lost file, spreads over all the stripes: up to ParityPercent of the export can be rebuilt
+// whether the damage is scattered or in one place. The CRC-32 of every shard locates the damaged ones. The parity does
+// not cover parity.json, which carries the SHA-256 of its own content instead so that a damaged manifest is never used.
+//
+// <export>
+//  |- parity.json (the layout, the shard checksums and the checksum of the manifest)
+//  |- parity.dat  (the parity shards, stripe after stripe)
+
+const ParityManifestVersion = 2
+
+// MaxParityPercent is the largest size of the parity data, relative to the size of the export.
+const MaxParityPercent = 100
+
+const (
+	parityDataShards   = 100 // Data shards per stripe, the parity percentage gives the parity shards.
+	parityMinShardSize = 4 * 1024
+	parityMaxShardSize = 1 * MB
+	parityMaxStripes   = 1024 // Above this number of stripes the shards grow, up to parityMaxShardSize.
+)
+
+var (
+	ErrNoParity                = errors.New("the export has no parity data")
+	ErrInvalidParityAmount     = fmt.Errorf("the parity must be between 0 and %v percent", MaxParityPercent)
+	ErrParityManifestCorrupted = errors.New("the parity manifest does not match its checksum")
+)
+
+// ParityManifest describes the parity data of an export.
+type ParityManifest struct {
+	Time         time.Time
+	ShardSize    int
+	DataShards   int // Per stripe.
+	ParityShards int // Per stripe.
+	StripeCount  int
+	Files        []ChecksumFile // The files of the stream, in order.
+	DataCRCs     []byte         // Big endian CRC-32 of each data shard of the stream.
+	ParityCRCs   []byte         // Big endian CRC-32 of each parity shard, in the order of parity.dat.
+	Checksum     string         // Hex SHA-256 of the JSON encoding of the manifest with an empty checksum.
+}
+
+// getChecksum returns the checksum of the manifest, ignoring the one it holds.
+func (m ParityManifest) getChecksum() (string, error) {
+	m.Checksum = ""
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", fmt.Errorf("failed to json encode parity manifest: %w", err)
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func getParityManifestFileName() string {
+	return "parity.json"
+}
+
+func getParityDataFileName() string {
+	return "parity.dat"
+}
+
+// SetParity writes parity data amounting to percent of the size of the export, 0 disables it.
+func (e *ExportTask) SetParity(percent int) error {
+	if percent < 0 || percent > MaxParityPercent {
+		return ErrInvalidParityAmount
+	}
+
+	e.parityPercent = percent
+
+	return nil
+}
+
+func (e *ExportTask) GetParity() int {
+	return e.parityPercent
+}
+
+// LoadParityManifest returns ErrNoParity if the export at exportDir has no parity data, ErrParityManifestCorrupted if
+// the manifest is damaged.
+func LoadParityManifest(exportDir string) (ParityManifest, error) {
+	b, err := os.ReadFile(filepath.Join(exportDir, getParityManifestFileName())) //nolint:gosec
+	if errors.Is(err, os.ErrNotExist) {
+		return ParityManifest{}, ErrNoParity
+	} else if err != nil {
+		return ParityManifest{}, fmt.Errorf("failed to read parity manifest: %w", err)
+	}
+
+	manifest, err := utils.NewVersionedJSON[ParityManifest](ParityManifestVersion, b)
+	if err != nil {
+		return ParityManifest{}, fmt.Errorf("failed to parse parity manifest: %w", err)
+	}
+
+	checksum, err := manifest.Payload.getChecksum()
+	if err != nil {
+		return ParityManifest{}, err
+	}
+
+	if checksum != manifest.Payload.Checksum {
+		return ParityManifest{}, ErrParityManifestCorrupted
+	}
+
+	return manifest.Payload, nil
+}
+
+// getParityLayout returns the shard size and the number of stripes for a stream of size bytes.
+func getParityLayout(size int64) (shardSize int, stripeCount int) {
+	shardSize = parityMinShardSize
+	for shardSize < parityMaxShardSize && size > int64(shardSize)*parityDataShards*parityMaxStripes {
+		shardSize *= 2
+	}
+
+	shardCount := (size + int64(shardSize) - 1) / int64(shardSize)
+
+	return shardSize, int((shardCount + parityDataShards - 1) / parityDataShards)
+}
+
+// writeParity writes the parity data of the files of the checksum manifest, amounting to percent of their size.
+func writeParity(ctx context.Context, tmpDir, exportDir string, percent int, log *logrus.Entry) error {
+	checksums, err := LoadChecksumManifest(exportDir)
+	if err != nil {
+		return err
+	}
+
+	stream := newParityStream(exportDir, checksums.Files)
+	shardSize, stripeCount := getParityLayout(stream.size)
+	parityShards := (parityDataShards*percent + 99) / 100
+
+	codec, err := reedsolomon.New(parityDataShards, parityShards)
+	if err != nil {
+		return fmt.Errorf("failed to create parity encoder: %w", err)
+	}
+
+	manifest := ParityManifest{
+		Time:         time.Now().UTC(),
+		ShardSize:    shardSize,
+		DataShards:   parityDataShards,
+		ParityShards: parityShards,
+		StripeCount:  stripeCount,
+		Files:        checksums.Files,
+		DataCRCs:     make([]byte, 4*stripeCount*parityDataShards),
+		ParityCRCs:   make([]byte, 4*stripeCount*parityShards),
+	}
+
+	file, err := os.CreateTemp(tmpDir, "parity-*")
+	if err != nil {
+		return fmt.Errorf("failed to create parity data: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}()
+
+	data, parityData := newShardBuffers(parityDataShards, shardSize), newShardBuffers(parityShards, shardSize)
+	shards := append(append(make([][]byte, 0, len(data)+len(parityData)), data...), parityData...)
+
+	for stripe := 0; stripe < stripeCount; stripe++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		for i := range data {
+			n := i*stripeCount + stripe
+			if err := stream.readShard(data[i], n); err != nil {
+				return err
+			}
+
+			binary.BigEndian.PutUint32(manifest.DataCRCs[4*n:], crc32.ChecksumIEEE(data[i]))
+		}
+
+		if err := codec.Encode(shards); err != nil {
+			return fmt.Errorf("failed to encode parity data: %w", err)
+		}
+
+		for j := range parityData {
+			binary.BigEndian.PutUint32(manifest.ParityCRCs[4*(stripe*parityShards+j):], crc32.ChecksumIEEE(parityData[j]))
+
+			if _, err := file.Write(parityData[j]); err != nil {
+				return fmt.Errorf("failed to write parity data: %w", err)
+			}
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to write parity data: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write parity data: %w", err)
+	}
+
+	if err := os.Rename(file.Name(), filepath.Join(exportDir, getParityDataFileName())); err != nil {
+		return fmt.Errorf("failed to write parity data: %w", err)
+	}
+
+	if manifest.Checksum, err = manifest.getChecksum(); err != nil {
+		return err
+	}
+
+	b, err := utils.GenerateVersionedJSON(ParityManifestVersion, &manifest)
+	if err != nil {
+		return fmt.Errorf("failed to json encode parity manifest: %w", err)
+	}
+
+	if err := utils.WriteFileSafe(tmpDir, filepath.Join(exportDir, getParityManifestFileName()), b, &utils.Sha256IntegrityChecker{}); err != nil {
+		return fmt.Errorf("failed to write parity manifest: %w", err)
+	}
+
+	log.WithFields(logrus.Fields{"shard-size": shardSize, "stripes": stripeCount, "parity-shards": parityShards}).Info("Wrote parity data")
+
+	return nil
+}
+
+// removeParity removes the parity data written by a previous run of an incremental export, which no longer matches.
+func removeParity(exportDir string) error {
+	for _, name := range []string{getParityManifestFileName(), getParityDataFileName()} {
+		if err := os.Remove(filepath.Join(exportDir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove previous parity data: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// RepairExportWithParity rebuilds the corrupted and missing files of report from the parity data of the export. The
+// issues of the files rebuilt are marked as repaired, the others are left as they are when the damage exceeds what
+// the parity can rebuild. ErrNoParity is returned if the export has no parity data.
+func RepairExportWithParity(ctx context.Context, exportDir string, report *VerifyReport) error {
+	manifest, err := LoadParityManifest(exportDir)
+	if err != nil {
+		return err
+	}
+
+	log := logrus.WithField("repair", "parity").WithField("path", exportDir)
+
+	repairer, err := newParityRepairer(exportDir, &manifest)
+	if err != nil {
+		return err
+	}
+	defer repairer.close()
+
+	for i := range report.Issues {
+		if report.Issues[i].Type != VerifyIssueUnlisted {
+			repairer.addFile(report.Issues[i].Path)
+		}
+	}
+
+	if err := repairer.rebuild(ctx); err != nil {
+		return err
+	}
+
+	for i := range report.Issues {
+		issue := &report.Issues[i]
+		if issue.Type == VerifyIssueUnlisted {
+			continue
+		}
+
+		if err := repairer.commitFile(issue.Path); err != nil {
+			log.WithError(err).WithField("file", issue.Path).Warn("Failed to repair file with parity data")
+			issue.Detail = strings.TrimSpace(fmt.Sprintf("%v (not repaired: %v)", issue.Detail, err))
+
+			continue
+		}
+
+		log.WithField("file", issue.Path).Info("Repaired file with parity data")
+		issue.Repaired = true
+	}
+
+	return nil
+}
+
+// parityRepairer rebuilds the damaged files into temporary files, stripe after stripe so that only one stripe is in
+// memory.
+type parityRepairer struct {
+	manifest   *ParityManifest
+	codec      reedsolomon.Encoder
+	stream     *parityStream
+	parityFile *os.File
+	files      map[string]*parityRepairFile
+}
+
+type parityRepairFile struct {
+	entry *parityStreamFile
+	temp  *os.File
+	err   error
+}
+
+func newParityRepairer(exportDir string, manifest *ParityManifest) (*parityRepairer, error) {
+	codec, err := reedsolomon.New(manifest.DataShards, manifest.ParityShards)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create parity decoder: %w", err)
+	}
+
+	// Without the parity data, only the shards which are intact can be used.
+	parityFile, err := os.Open(filepath.Join(exportDir, getParityDataFileName())) //nolint:gosec
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to open parity data: %w", err)
+	}
+
+	return &parityRepairer{
+		manifest:   manifest,
+		codec:      codec,
+		stream:     newParityStream(exportDir, manifest.Files),
+		parityFile: parityFile,
+		files:      make(map[string]*parityRepairFile),
+	}, nil
+}
+
+func (p *parityRepairer) addFile(rel string) {
+	file := &parityRepairFile{}
+	p.files[rel] = file
+
+	index := p.stream.find(rel)
+	if index < 0 {
+		file.err = errors.New("the file is not protected by the parity data")
+		return
+	}
+
+	file.entry = &p.stream.files[index]
+
+	path := filepath.Join(p.stream.exportDir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		file.err = fmt.Errorf("failed to create folder: %w", err)
+		return
+	}
+
+	if file.temp, file.err = os.CreateTemp(filepath.Dir(path), "repair-*"); file.err != nil {
+		return
+	}
+
+	file.err = file.temp.Truncate(file.entry.Size)
+}
+
+// rebuild writes the content of the files added into their temporary file.
+func (p *parityRepairer) rebuild(ctx context.Context) error {
+	shardSize := int64(p.manifest.ShardSize)
+	stripes := make([]bool, p.manifest.StripeCount)
+
+	for _, file := range p.files {
+		if file.err != nil {
+			continue
+		}
+
+		for n := file.entry.offset / shardSize; n*shardSize < file.entry.offset+file.entry.Size; n++ {
+			stripes[n%int64(len(stripes))] = true
+		}
+	}
+
+	data := newShardBuffers(p.manifest.DataShards, p.manifest.ShardSize)
+	parityData := newShardBuffers(p.manifest.ParityShards, p.manifest.ShardSize)
+
+	for stripe, needed := range stripes {
+		if !needed {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// The files spanning a stripe with too much damage cannot be repaired, the others can.
+		stripeErr := p.rebuildStripe(stripe, data, parityData)
+		if stripeErr != nil && !errors.Is(stripeErr, reedsolomon.ErrTooFewShards) {
+			return stripeErr
+		}
+
+		for i := range data {
+			n := int64(i*p.manifest.StripeCount + stripe)
+			start, end := n*shardSize, (n+1)*shardSize
+
+			for _, file := range p.files {
+				if file.err != nil || file.entry.offset >= end || file.entry.offset+file.entry.Size <= start {
+					continue
+				}
+
+				if stripeErr != nil {
+					file.err = stripeErr
+					continue
+				}
+
+				from := max(start, file.entry.offset)
+				to := min(end, file.entry.offset+file.entry.Size)
+
+				if _, err := file.temp.WriteAt(data[i][from-start:to-start], from-file.entry.offset); err != nil {
+					file.err = fmt.Errorf("failed to write repaired file: %w", err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// rebuildStripe reads the data shards of stripe and rebuilds the damaged ones, reedsolomon.ErrTooFewShards if it
+// cannot.
+func (p *parityRepairer) rebuildStripe(stripe int, data, parityData [][]byte) error {
+	// The damaged shards are passed empty to the decoder, which rebuilds them in their capacity.
+	shards := make([][]byte, len(data)+len(parityData))
+
+	for i := range data {
+		shard := i*p.manifest.StripeCount + stripe
+		if err := p.stream.readShard(data[i], shard); err != nil {
+			return err
+		}
+
+		if shards[i] = data[i]; !checkShardCRC(p.manifest.DataCRCs, shard, data[i]) {
+			shards[i] = data[i][:0]
+		}
+	}
+
+	for j := range parityData {
+		shards[len(data)+j] = parityData[j][:0]
+
+		if p.parityFile == nil {
+			continue
+		}
+
+		shard := stripe*p.manifest.ParityShards + j
+
+		clear(parityData[j])
+
+		if _, err := p.parityFile.ReadAt(parityData[j], int64(shard)*int64(p.manifest.ShardSize)); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read parity data: %w", err)
+		}
+
+		if checkShardCRC(p.manifest.ParityCRCs, shard, parityData[j]) {
+			shards[len(data)+j] = parityData[j]
+		}
+	}
+
+	if err := p.codec.ReconstructData(shards); err != nil {
+		return err
+	}
+
+	for i := range data {
+		copy(data[i], shards[i])
+	}
+
+	return nil
+}
+
+// commitFile replaces the file at rel with its rebuilt content, once its checksum is verified.
+func (p *parityRepairer) commitFile(rel string) error {
+	file, ok := p.files[rel]
+	if !ok {
+		return errors.New("the file was not rebuilt")
+	}
+
+	if file.err != nil {
+		return file.err
+	}
+
+	if err := file.temp.Sync(); err != nil {
+		return fmt.Errorf("failed to write repaired file: %w", err)
+	}
+
+	hashed, err := hashFile(file.temp.Name())
+	if err != nil {
+		return err
+	}
+
+	if hashed.Size != file.entry.Size || hashed.SHA256 != file.entry.SHA256 {
+		return errors.New("the rebuilt content does not match its checksum")
+	}
+
+	if err := file.temp.Close(); err != nil {
+		return fmt.Errorf("failed to write repaired file: %w", err)
+	}
+
+	if err := os.Rename(file.temp.Name(), filepath.Join(p.stream.exportDir, filepath.FromSlash(rel))); err != nil {
+		return fmt.Errorf("failed to replace damaged file: %w", err)
+	}
+
+	file.temp = nil
+
+	return nil
+}
+
+// close removes the temporary files of the files which could not be repaired.
+func (p *parityRepairer) close() {
+	for _, file := range p.files {
+		if file.temp != nil {
+			_ = file.temp.Close()
+			_ = os.Remove(file.temp.Name())
+		}
+	}
+
+	if p.parityFile != nil {
+		_ = p.parityFile.Close()
+	}
+}
+
+func checkShardCRC(crcs []byte, shard int, data []byte) bool {
+	if 4*shard+4 > len(crcs) {
+		return false
+	}
+
+	return binary.BigEndian.Uint32(crcs[4*shard:]) == crc32.ChecksumIEEE(data)
+}
+
+func newShardBuffers(count, size int) [][]byte {
+	shards := make([][]byte, count)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+	}
+
+	return shards
+}
+
+// parityStream reads the files of the export as one stream. The missing parts of the files read as zeros.
+type parityStream struct {
+	exportDir string
+	files     []parityStreamFile
+	size      int64
+}
+
+type parityStreamFile struct {
+	ChecksumFile
+	offset int64
+}
+
+func newParityStream(exportDir string, files []ChecksumFile) *parityStream {
+	stream := &parityStream{exportDir: exportDir, files: make([]parityStreamFile, len(files))}
+
+	for i, file := range files {
+		stream.files[i] = parityStreamFile{ChecksumFile: file, offset: stream.size}
+		stream.size += file.Size
+	}
+
+	return stream
+}
+
+func (p *parityStream) find(rel string) int {
+	for i := range p.files {
+		if p.files[i].Path == rel {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// readShard fills shard with the data shard n of the stream, zero padded past its end.
+func (p *parityStream) readShard(shard []byte, n int) error {
+	clear(shard)
+
+	start := int64(n) * int64(len(shard))
+	end := start + int64(len(shard))
+
+	// The first file ending after the start of the shard.
+	first := sort.Search(len(p.files), func(i int) bool { return p.files[i].offset+p.files[i].Size > start })
+
+	for i := first; i < len(p.files) && p.files[i].offset < end; i++ {
+		file := &p.files[i]
+
+		from := max(start, file.offset)
+		to := min(end, file.offset+file.Size)
+
+		if err := p.readFile(file, shard[from-start:to-start], from-file.offset); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *parityStream) readFile(file *parityStreamFile, buffer []byte, offset int64) error {
+	f, err := os.Open(filepath.Join(p.exportDir, filepath.FromSlash(file.Path)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open '%v': %w", file.Path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	// A truncated file reads as zeros past its end, the checksum of the shard tells it is damaged.
+	if _, err := f.ReadAt(buffer, offset); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read '%v': %w", file.Path, err)
+	}
+
+	return nil
+}
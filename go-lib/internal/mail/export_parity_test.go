@@ -0,0 +1,160 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func writeParityTestExport(t *testing.T, sizes map[string]int) (string, map[string][]byte) {
+	t.Helper()
+
+	exportDir := t.TempDir()
+	tmpDir := t.TempDir()
+	rng := rand.New(rand.NewSource(1)) //nolint:gosec
+	contents := make(map[string][]byte, len(sizes))
+
+	for name, size := range sizes {
+		content := make([]byte, size)
+		rng.Read(content)
+		contents[name] = content
+
+		path := filepath.Join(exportDir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+		require.NoError(t, os.WriteFile(path, content, 0o600))
+	}
+
+	log := logrus.WithField("test", "parity")
+	require.NoError(t, writeChecksumManifest(context.Background(), tmpDir, exportDir, log))
+	require.NoError(t, writeParity(context.Background(), tmpDir, exportDir, 10, log))
+
+	return exportDir, contents
+}
+
+func TestParity_RepairDamagedFiles(t *testing.T) {
+	exportDir, contents := writeParityTestExport(t, map[string]int{
+		"labels.json":         1000,
+		"a.eml":               30 * 1024,
+		"b.eml":               100 * 1024,
+		"sub/c.metadata.json": 70 * 1024,
+	})
+
+	manifest, err := LoadParityManifest(exportDir)
+	require.NoError(t, err)
+	require.Equal(t, 1, manifest.StripeCount)
+	require.Equal(t, 10, manifest.ParityShards)
+
+	// Lose a file and flip a byte of another, 8 and 1 shards out of the 10 which can be rebuilt.
+	require.NoError(t, os.Remove(filepath.Join(exportDir, "a.eml")))
+
+	damaged := append([]byte(nil), contents["b.eml"]...)
+	damaged[5000] ^= 0xff
+	require.NoError(t, os.WriteFile(filepath.Join(exportDir, "b.eml"), damaged, 0o600))
+
+	report, err := VerifyExport(context.Background(), exportDir)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.GetDamagedCount())
+
+	require.NoError(t, RepairExportWithParity(context.Background(), exportDir, &report))
+	require.Zero(t, report.GetDamagedCount())
+
+	for _, name := range []string{"a.eml", "b.eml"} {
+		content, err := os.ReadFile(filepath.Join(exportDir, name))
+		require.NoError(t, err)
+		require.Equal(t, contents[name], content)
+	}
+
+	report, err = VerifyExport(context.Background(), exportDir)
+	require.NoError(t, err)
+	require.Empty(t, report.Issues)
+}
+
+func TestParity_TooMuchDamage(t *testing.T) {
+	exportDir, contents := writeParityTestExport(t, map[string]int{
+		"a.eml": 80 * 1024,
+		"b.eml": 120 * 1024,
+	})
+
+	require.NoError(t, os.Remove(filepath.Join(exportDir, "a.eml")))
+
+	report, err := VerifyExport(context.Background(), exportDir)
+	require.NoError(t, err)
+
+	require.NoError(t, RepairExportWithParity(context.Background(), exportDir, &report))
+	require.Equal(t, 1, report.GetDamagedCount())
+	require.Contains(t, report.Issues[0].Detail, "not repaired")
+
+	_, err = os.Stat(filepath.Join(exportDir, "a.eml"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	content, err := os.ReadFile(filepath.Join(exportDir, "b.eml"))
+	require.NoError(t, err)
+	require.Equal(t, contents["b.eml"], content)
+
+	entries, err := os.ReadDir(exportDir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.NotContains(t, entry.Name(), "repair-")
+	}
+}
+
+func TestParity_CorruptedManifest(t *testing.T) {
+	exportDir, _ := writeParityTestExport(t, map[string]int{"a.eml": 80 * 1024})
+
+	path := filepath.Join(exportDir, getParityManifestFileName())
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 1, bytes.Count(b, []byte(`"ShardSize": 4096`)))
+	require.NoError(t, os.WriteFile(path, bytes.Replace(b, []byte(`"ShardSize": 4096`), []byte(`"ShardSize": 8192`), 1), 0o600))
+
+	_, err = LoadParityManifest(exportDir)
+	require.ErrorIs(t, err, ErrParityManifestCorrupted)
+
+	report := VerifyReport{}
+	require.ErrorIs(t, RepairExportWithParity(context.Background(), exportDir, &report), ErrParityManifestCorrupted)
+}
+
+func TestParity_NoParity(t *testing.T) {
+	report := VerifyReport{}
+
+	require.ErrorIs(t, RepairExportWithParity(context.Background(), t.TempDir(), &report), ErrNoParity)
+}
+
+func TestParity_Layout(t *testing.T) {
+	shardSize, stripes := getParityLayout(0)
+	require.Equal(t, parityMinShardSize, shardSize)
+	require.Zero(t, stripes)
+
+	shardSize, stripes = getParityLayout(10 * 1024 * MB)
+	require.LessOrEqual(t, stripes, parityMaxStripes)
+	require.GreaterOrEqual(t, int64(shardSize)*int64(stripes)*parityDataShards, int64(10*1024*MB))
+
+	// The shards stop growing, the stripes take over.
+	shardSize, stripes = getParityLayout(1024 * 1024 * MB)
+	require.Equal(t, parityMaxShardSize, shardSize)
+	require.Greater(t, stripes, parityMaxStripes)
+}
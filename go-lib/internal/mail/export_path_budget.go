@@ -0,0 +1,315 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+)
+
+const PathTruncationsVersion = 1
+
+// PathBudget limits the length of the paths written by an export, so that it can be copied to a file system or a sync
+// service with stricter limits than the one it is written to. Lengths are counted in bytes of the absolute path, which
+// is never less than the UTF-16 units Windows and OneDrive count.
+type PathBudget struct {
+	Name         string
+	MaxPathBytes int // Zero for no limit.
+	MaxNameBytes int
+}
+
+// pathBudgetProfiles are the budgets selectable by name. Windows counts the terminating null in MAX_PATH.
+var pathBudgetProfiles = []PathBudget{ //nolint:gochecknoglobals
+	{Name: "none", MaxNameBytes: utils.MaxFileNameBytes},
+	{Name: "windows", MaxPathBytes: 259, MaxNameBytes: utils.MaxFileNameBytes},
+	{Name: "onedrive", MaxPathBytes: 400, MaxNameBytes: utils.MaxFileNameBytes},
+	{Name: "udf", MaxPathBytes: 1023, MaxNameBytes: utils.MaxFileNameBytes},
+}
+
+var ErrPathBudgetTooSmall = errors.New("path budget leaves no room for the export files")
+
+// DefaultPathBudget does not limit the paths.
+func DefaultPathBudget() PathBudget {
+	return pathBudgetProfiles[0]
+}
+
+// PathBudgetFromString accepts the name of a profile or a maximum path length in bytes.
+func PathBudgetFromString(s string) (PathBudget, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	for _, profile := range pathBudgetProfiles {
+		if profile.Name == s {
+			return profile, nil
+		}
+	}
+
+	maxPathBytes, err := strconv.Atoi(s)
+	if err != nil || maxPathBytes <= 0 {
+		names := make([]string, 0, len(pathBudgetProfiles))
+		for _, profile := range pathBudgetProfiles {
+			names = append(names, profile.Name)
+		}
+
+		return PathBudget{}, fmt.Errorf("unknown path budget '%v', expected one of %v or a number of bytes", s, strings.Join(names, ", "))
+	}
+
+	return PathBudget{Name: s, MaxPathBytes: maxPathBytes, MaxNameBytes: utils.MaxFileNameBytes}, nil
+}
+
+func (b PathBudget) String() string {
+	return b.Name
+}
+
+func (b PathBudget) isLimited() bool {
+	return b.MaxPathBytes > 0 || (b.MaxNameBytes > 0 && b.MaxNameBytes < utils.MaxFileNameBytes)
+}
+
+const (
+	// maxMessageIDBytes is the length of the message IDs, which name the metadata files and the folders of the messages
+	// that could not be assembled.
+	maxMessageIDBytes = 88
+
+	// minFittedNameBytes is the room needed to shorten a name: one byte of the name, the hash and a kept extension.
+	minFittedNameBytes = 1 + 9 + 16
+
+	// maxMaildirFileNameBytes is the longest name returned by getMaildirFileName.
+	maxMaildirFileNameBytes = 20 + 1 + maxMessageIDBytes + len(".proton") + len(":2,") + len("DFRS")
+
+	// maxTempFileNameBytes is the longest name of the files created by utils.WriteFileSafe.
+	maxTempFileNameBytes = len("export-tool-") + 20
+)
+
+// PathTruncation records a name that was shortened to fit the path budget.
+type PathTruncation struct {
+	Path     string // Relative to the export folder, with forward slashes.
+	Original string // The path the file or folder would have had without the budget.
+}
+
+// PathTruncations is the manifest of the names shortened by the exports written to a folder.
+type PathTruncations struct {
+	Budget      PathBudget
+	Truncations []PathTruncation
+}
+
+func getPathTruncationsFileName() string {
+	return "path_truncations.json"
+}
+
+// LoadPathTruncations reads the manifest of the shortened names of an export. The manifest only exists when names were
+// shortened.
+func LoadPathTruncations(exportDir string) (PathTruncations, error) {
+	b, err := os.ReadFile(filepath.Join(exportDir, getPathTruncationsFileName())) //nolint:gosec
+	if err != nil {
+		return PathTruncations{}, fmt.Errorf("failed to read path truncations: %w", err)
+	}
+
+	truncations, err := utils.NewVersionedJSON[PathTruncations](PathTruncationsVersion, b)
+	if err != nil {
+		return PathTruncations{}, fmt.Errorf("failed to parse path truncations: %w", err)
+	}
+
+	return truncations.Payload, nil
+}
+
+// pathNamer shortens the names written to the export folder so that the paths fit the budget. Names are shortened
+// deterministically, an export that is run again in the same folder uses the same names. A nil pathNamer does not
+// change the names. It is safe for concurrent use.
+type pathNamer struct {
+	budget  PathBudget
+	root    string
+	rootLen int // Length of the absolute path of root.
+	yearLen int // Length of the year folder the messages are written to, see SetSplitByYear.
+
+	lock        sync.Mutex
+	truncations map[string]PathTruncation
+}
+
+// newPathNamer returns nil if the budget does not limit the paths.
+func newPathNamer(budget PathBudget, root string) (*pathNamer, error) {
+	if !budget.isLimited() {
+		return nil, nil //nolint:nilnil
+	}
+
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve export path: %w", err)
+	}
+
+	return &pathNamer{
+		budget:      budget,
+		root:        root,
+		rootLen:     len(abs),
+		truncations: make(map[string]PathTruncation),
+	}, nil
+}
+
+// validate checks that the names which cannot be shortened fit the budget, and leave room to shorten the others.
+func (n *pathNamer) validate() error {
+	if n == nil || n.budget.MaxPathBytes == 0 {
+		return nil
+	}
+
+	autoGenerated := n.yearLen + len(getAutoGeneratedDirName()) + 1
+
+	longest := max(
+		autoGenerated+maxMessageIDBytes+len(jsonMetadataExtension)+len(sealedExtension),
+		autoGenerated+maxMessageIDBytes+1+minFittedNameBytes,
+		autoGenerated+len(getMaildirDirName())+1+minFittedNameBytes+len("/cur/")+maxMaildirFileNameBytes,
+		len("temp/")+maxTempFileNameBytes,
+	)
+
+	if n.rootLen+1+longest > n.budget.MaxPathBytes {
+		return fmt.Errorf(
+			"%w: paths in '%v' may need %v bytes, more than the %v bytes of the '%v' budget, choose a shorter export folder",
+			ErrPathBudgetTooSmall, n.root, n.rootLen+1+longest, n.budget.MaxPathBytes, n.budget,
+		)
+	}
+
+	return nil
+}
+
+func (n *pathNamer) setSplitByYear(enabled bool) {
+	if n != nil && enabled {
+		n.yearLen = yearDirNameBytes
+	}
+}
+
+// fitName returns name, shortened if needed for dir/name to fit the budget with reserve bytes left for the paths below
+// it. dir must be inside the export folder. The extension of name is kept when keepExtension is set.
+func (n *pathNamer) fitName(dir, name string, reserve int, keepExtension bool) string {
+	if n == nil {
+		return name
+	}
+
+	rel, err := filepath.Rel(n.root, dir)
+	if err != nil || rel == "." {
+		rel = ""
+	}
+
+	prefix := n.rootLen + 1
+	if rel != "" {
+		prefix += len(rel) + 1
+	}
+
+	limit := utils.MaxFileNameBytes
+	if n.budget.MaxNameBytes > 0 {
+		limit = min(limit, n.budget.MaxNameBytes)
+	}
+
+	if n.budget.MaxPathBytes > 0 {
+		limit = min(limit, n.budget.MaxPathBytes-prefix-reserve)
+	}
+
+	// The budget was validated before the export started, a name that cannot be shortened is kept as is and fails to be
+	// written rather than silently losing data.
+	fitted, ok := utils.TruncateName(name, name, limit, keepExtension)
+	if !ok || fitted == name {
+		return name
+	}
+
+	truncation := PathTruncation{
+		Path:     filepath.ToSlash(filepath.Join(rel, fitted)),
+		Original: filepath.ToSlash(filepath.Join(rel, name)),
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.truncations[truncation.Path] = truncation
+
+	return fitted
+}
+
+// fitLabelName is fitName for the files and folders named after labels in subDir. These are also written below the
+// folders of the years and of the auto-generated messages, room is left for them so that the names do not depend on
+// the message.
+func (n *pathNamer) fitLabelName(subDir, name string, reserve int, keepExtension bool) string {
+	if n == nil {
+		return name
+	}
+
+	return n.fitName(filepath.Join(n.root, subDir), name, reserve+n.yearLen+len(getAutoGeneratedDirName())+1, keepExtension)
+}
+
+func (n *pathNamer) getTruncationCount() int {
+	if n == nil {
+		return 0
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return len(n.truncations)
+}
+
+// write adds the shortened names to the manifest of the export folder, which lists those of the previous runs of an
+// incremental or resumed export.
+func (n *pathNamer) write(tmpDir string) error {
+	if n.getTruncationCount() == 0 {
+		return nil
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	merged := make(map[string]PathTruncation, len(n.truncations))
+
+	if previous, err := LoadPathTruncations(n.root); err == nil {
+		for _, truncation := range previous.Truncations {
+			merged[truncation.Path] = truncation
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	for path, truncation := range n.truncations {
+		merged[path] = truncation
+	}
+
+	manifest := PathTruncations{Budget: n.budget, Truncations: make([]PathTruncation, 0, len(merged))}
+	for _, truncation := range merged {
+		manifest.Truncations = append(manifest.Truncations, truncation)
+	}
+
+	sort.Slice(manifest.Truncations, func(i, j int) bool { return manifest.Truncations[i].Path < manifest.Truncations[j].Path })
+
+	data, err := utils.GenerateVersionedJSON(PathTruncationsVersion, &manifest)
+	if err != nil {
+		return fmt.Errorf("failed to json encode path truncations: %w", err)
+	}
+
+	return utils.WriteFileSafe(tmpDir, filepath.Join(n.root, getPathTruncationsFileName()), data, &utils.Sha256IntegrityChecker{})
+}
+
+// SetPathBudget limits the length of the paths of the export, see PathBudget. Names that do not fit are shortened and
+// listed in the path_truncations.json file of the export.
+func (e *ExportTask) SetPathBudget(budget PathBudget) {
+	e.pathBudget = budget
+}
+
+func (e *ExportTask) GetPathBudget() PathBudget {
+	return e.pathBudget
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathBudgetFromString(t *testing.T) {
+	budget, err := PathBudgetFromString("Windows")
+	require.NoError(t, err)
+	require.Equal(t, 259, budget.MaxPathBytes)
+
+	budget, err = PathBudgetFromString("300")
+	require.NoError(t, err)
+	require.Equal(t, 300, budget.MaxPathBytes)
+
+	_, err = PathBudgetFromString("floppy")
+	require.Error(t, err)
+
+	_, err = PathBudgetFromString("-1")
+	require.Error(t, err)
+
+	names, err := newPathNamer(DefaultPathBudget(), t.TempDir())
+	require.NoError(t, err)
+	require.Nil(t, names)
+}
+
+func TestPathNamer_FitName(t *testing.T) {
+	dir := t.TempDir()
+	abs, err := filepath.Abs(dir)
+	require.NoError(t, err)
+
+	budget := PathBudget{Name: "test", MaxPathBytes: len(abs) + 400}
+
+	names, err := newPathNamer(budget, dir)
+	require.NoError(t, err)
+	require.NoError(t, names.validate())
+
+	msgDir := filepath.Join(dir, strings.Repeat("m", maxMessageIDBytes))
+	name := attachmentFileNameEncrypted("att", strings.Repeat("a", 400)+".pdf")
+
+	fitted := names.fitName(msgDir, name, 0, true)
+	require.Less(t, len(fitted), len(name))
+	require.LessOrEqual(t, len(filepath.Join(abs, filepath.Base(msgDir), fitted)), budget.MaxPathBytes)
+	require.True(t, strings.HasSuffix(fitted, ".pgp"))
+	require.Equal(t, fitted, names.fitName(msgDir, name, 0, true))
+
+	require.Equal(t, "short.pdf", names.fitName(msgDir, "short.pdf", 0, true))
+
+	require.NoError(t, names.write(dir))
+
+	truncations, err := LoadPathTruncations(dir)
+	require.NoError(t, err)
+	require.Equal(t, budget, truncations.Budget)
+	require.Equal(t, []PathTruncation{{
+		Path:     filepath.Base(msgDir) + "/" + fitted,
+		Original: filepath.Base(msgDir) + "/" + name,
+	}}, truncations.Truncations)
+
+	// A later run adds its names to the manifest.
+	names, err = newPathNamer(budget, dir)
+	require.NoError(t, err)
+
+	names.fitName(dir, strings.Repeat("b", 500), 0, false)
+	require.NoError(t, names.write(dir))
+
+	truncations, err = LoadPathTruncations(dir)
+	require.NoError(t, err)
+	require.Len(t, truncations.Truncations, 2)
+}
+
+func TestPathNamer_LabelNames(t *testing.T) {
+	dir := t.TempDir()
+	abs, err := filepath.Abs(dir)
+	require.NoError(t, err)
+
+	names, err := newPathNamer(PathBudget{Name: "test", MaxPathBytes: len(abs) + 200}, dir)
+	require.NoError(t, err)
+
+	labels := []proton.Label{
+		{ID: "l1", Name: strings.Repeat("a", 240), Type: proton.LabelTypeFolder},
+		{ID: "l2", Name: strings.Repeat("a", 240) + "b", Type: proton.LabelTypeFolder},
+	}
+
+	writer := newMaildirWriter(labels, names)
+	require.NotEqual(t, writer.folderByID["l1"], writer.folderByID["l2"])
+
+	for _, id := range []string{"l1", "l2"} {
+		path := filepath.Join(abs, getAutoGeneratedDirName(), getMaildirDirName(), writer.folderByID[id], "cur")
+		require.LessOrEqual(t, len(path)+1+maxMaildirFileNameBytes, len(abs)+200)
+	}
+
+	mbox := newMBoxWriter(labels, names)
+	require.True(t, strings.HasSuffix(mbox.fileByName["l1"], mboxExtension))
+	require.LessOrEqual(t, len(mbox.fileByName["l1"]), len(abs)+200-len(filepath.Join(abs, getAutoGeneratedDirName(), getMBoxDirName()))-1)
+}
+
+func TestPathNamer_Validate(t *testing.T) {
+	names, err := newPathNamer(PathBudget{Name: "test", MaxPathBytes: 100}, t.TempDir())
+	require.NoError(t, err)
+	require.ErrorIs(t, names.validate(), ErrPathBudgetTooSmall)
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const ProgressFileVersion = 1
+
+// progressFileInterval is the minimum time between two writes of the progress file caused by message progress.
+const progressFileInterval = 5 * time.Second
+
+type ExportStage string
+
+const (
+	ExportStagePreparing ExportStage = "preparing"
+	ExportStageLabels    ExportStage = "labels"
+	ExportStageMessages  ExportStage = "messages"
+	ExportStageChecksums ExportStage = "checksums"
+	ExportStageParity    ExportStage = "parity"
+	ExportStageMirroring ExportStage = "mirroring"
+	ExportStageFinished  ExportStage = "finished"
+	ExportStageFailed    ExportStage = "failed"
+	ExportStageCancelled ExportStage = "cancelled"
+)
+
+// ExportProgress is the content of the progress file written in the export directory while an export runs. A run
+// whose UpdateTime does not change anymore while its stage is not final is stalled or was killed.
+type ExportProgress struct {
+	Stage                 ExportStage
+	Percent               float64
+	TotalMessageCount     uint64
+	ProcessedMessageCount uint64
+	StartTime             time.Time
+	UpdateTime            time.Time
+	Error                 string `json:",omitempty"`
+}
+
+func getProgressFileName() string {
+	return "progress.json"
+}
+
+// LoadExportProgress reads the progress file of an export directory.
+func LoadExportProgress(exportDir string) (ExportProgress, error) {
+	b, err := os.ReadFile(filepath.Join(exportDir, getProgressFileName())) //nolint:gosec
+	if err != nil {
+		return ExportProgress{}, fmt.Errorf("failed to read progress file: %w", err)
+	}
+
+	progress, err := utils.NewVersionedJSON[ExportProgress](ProgressFileVersion, b)
+	if err != nil {
+		return ExportProgress{}, fmt.Errorf("failed to parse progress file: %w", err)
+	}
+
+	return progress.Payload, nil
+}
+
+// progressFileReporter forwards the progress to the wrapped reporter and mirrors it in the progress file. The file is
+// replaced atomically so that it can be read at any time.
+type progressFileReporter struct {
+	Reporter
+	lock      sync.Mutex
+	tmpDir    string
+	exportDir string
+	log       *logrus.Entry
+	progress  ExportProgress
+	lastWrite time.Time
+	now       func() time.Time
+	heartbeat *heartbeat
+	events    *progressEvents
+	bus       *EventBus // Receives the stage changes, the heartbeat and the progress events subscribe to them.
+}
+
+func newProgressFileReporter(reporter Reporter, tmpDir, exportDir string, log *logrus.Entry) *progressFileReporter {
+	return &progressFileReporter{
+		Reporter:  reporter,
+		tmpDir:    tmpDir,
+		exportDir: exportDir,
+		log:       log,
+		progress:  ExportProgress{Stage: ExportStagePreparing, StartTime: time.Now().UTC()},
+		now:       time.Now,
+	}
+}
+
+func (p *progressFileReporter) SetMessageTotal(total uint64) {
+	p.Reporter.SetMessageTotal(total)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.progress.TotalMessageCount = total
+	p.write(false)
+	p.events.setTotal(total)
+}
+
+func (p *progressFileReporter) SetMessageProcessed(processed uint64) {
+	p.Reporter.SetMessageProcessed(processed)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.progress.ProcessedMessageCount = processed
+	p.write(false)
+	p.events.setProcessed(processed)
+}
+
+func (p *progressFileReporter) OnProgress(delta int) {
+	p.Reporter.OnProgress(delta)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.progress.ProcessedMessageCount += uint64(delta)
+	p.write(false)
+	p.heartbeat.onProgress()
+	p.events.onProgress(delta)
+}
+
+func (p *progressFileReporter) setStage(stage ExportStage) {
+	p.lock.Lock()
+	p.progress.Stage = stage
+	p.write(true)
+	p.lock.Unlock()
+
+	p.bus.Publish(StageChangedEvent{Stage: string(stage)})
+}
+
+// finish records the final stage of the export.
+func (p *progressFileReporter) finish(err error, cause CancelCause) {
+	p.lock.Lock()
+
+	switch {
+	case err == nil:
+		p.progress.Stage = ExportStageFinished
+	case cause == CancelCauseUser:
+		p.progress.Stage = ExportStageCancelled
+	default:
+		p.progress.Stage = ExportStageFailed
+		p.progress.Error = err.Error()
+	}
+
+	p.write(true)
+	stage := p.progress.Stage
+	p.lock.Unlock()
+
+	p.bus.Publish(StageChangedEvent{Stage: string(stage)})
+}
+
+// write updates the progress file, at most once per progressFileInterval unless force is set. The lock must be held.
+func (p *progressFileReporter) write(force bool) {
+	now := p.now()
+	if !force && now.Sub(p.lastWrite) < progressFileInterval {
+		return
+	}
+
+	p.lastWrite = now
+	p.progress.UpdateTime = now.UTC()
+
+	if p.progress.TotalMessageCount != 0 {
+		p.progress.Percent = min(100, float64(p.progress.ProcessedMessageCount)*100/float64(p.progress.TotalMessageCount))
+	}
+
+	data, err := utils.GenerateVersionedJSON(ProgressFileVersion, &p.progress)
+	if err != nil {
+		p.log.WithError(err).Warn("Failed to encode progress file")
+		return
+	}
+
+	if err := utils.WriteFileSafe(p.tmpDir, filepath.Join(p.exportDir, getProgressFileName()), data, nil); err != nil {
+		p.log.WithError(err).Warn("Failed to write progress file")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestProgressFileReporter(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	reporter := NewMockReporter(mockCtrl)
+	reporter.EXPECT().SetMessageTotal(uint64(10))
+	reporter.EXPECT().OnProgress(gomock.Any()).Times(3)
+
+	exportDir := t.TempDir()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	progress := newProgressFileReporter(reporter, t.TempDir(), exportDir, logrus.WithField("test", "progress"))
+	progress.now = func() time.Time { return now }
+
+	progress.setStage(ExportStageMessages)
+	progress.SetMessageTotal(10)
+	progress.OnProgress(2)
+
+	// Updates are throttled.
+	loaded, err := LoadExportProgress(exportDir)
+	require.NoError(t, err)
+	require.Equal(t, ExportStageMessages, loaded.Stage)
+	require.Zero(t, loaded.TotalMessageCount)
+
+	now = now.Add(progressFileInterval)
+	progress.OnProgress(3)
+
+	loaded, err = LoadExportProgress(exportDir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), loaded.TotalMessageCount)
+	require.Equal(t, uint64(5), loaded.ProcessedMessageCount)
+	require.Equal(t, 50.0, loaded.Percent)
+	require.Equal(t, now, loaded.UpdateTime)
+
+	progress.OnProgress(1)
+	progress.finish(errors.New("network error"), CancelCauseNone)
+
+	loaded, err = LoadExportProgress(exportDir)
+	require.NoError(t, err)
+	require.Equal(t, ExportStageFailed, loaded.Stage)
+	require.Equal(t, uint64(6), loaded.ProcessedMessageCount)
+	require.Equal(t, "network error", loaded.Error)
+}
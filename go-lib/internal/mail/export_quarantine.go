@@ -0,0 +1,136 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+
+	"github.com/ProtonMail/export-tool/internal/reporter"
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+)
+
+// errParserCrashed is returned when parsing a malformed file of a backup panics.
+var errParserCrashed = errors.New("parser crashed")
+
+// Quarantine is stored in the metadata of a message whose decryption or assembly crashed.
+type Quarantine struct {
+	Reason string
+}
+
+// quarantineList collects the quarantined messages of a BuildStage. It is safe for concurrent use.
+type quarantineList struct {
+	lock     sync.Mutex
+	failures []Failure
+}
+
+func (q *quarantineList) add(msgID, reason string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.failures = append(q.failures, Failure{MessageID: msgID, Reason: reason})
+}
+
+func (q *quarantineList) get() []Failure {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return append([]Failure(nil), q.failures...)
+}
+
+// quarantine returns the writer of a message whose build panicked with r. The message is written as received from the
+// server so that it can be decrypted later.
+func (b *BuildStage) quarantine(msg *proton.FullMessage, r any) MessageWriter {
+	reason := fmt.Sprintf("panic: %v", r)
+
+	b.log.WithFields(logrus.Fields{
+		"msgID": msg.ID,
+		"panic": r,
+		"stack": string(debug.Stack()),
+	}).Error("Message build crashed, quarantining the message")
+
+	b.reporter.ReportError(fmt.Errorf("message build crashed: %v", r), reporter.Context{
+		"msgID":  msg.ID,
+		"userID": b.userID,
+	})
+
+	b.quarantined.add(msg.ID, reason)
+
+	integrity := newTransferIntegrity(msg)
+	integrity.EncryptedOnly = true
+
+	return &QuarantinedMessageWriter{msg: *msg, integrity: integrity, reason: reason}
+}
+
+// GetQuarantined returns the messages quarantined because their build crashed.
+func (b *BuildStage) GetQuarantined() []Failure {
+	return b.quarantined.get()
+}
+
+// QuarantinedMessageWriter writes the encrypted body and attachments of a message whose build crashed.
+type QuarantinedMessageWriter struct {
+	msg       proton.FullMessage
+	integrity *MessageIntegrity
+	reason    string
+}
+
+func (q *QuarantinedMessageWriter) GetMetadata() MessageMetadata {
+	metadata := NewMessageMetadata(MessageWriterTypeQuarantined, &q.msg.Message)
+	metadata.Integrity = q.integrity
+	metadata.Quarantine = &Quarantine{Reason: q.reason}
+
+	return metadata
+}
+
+func (q *QuarantinedMessageWriter) WriteMessage(dir string, files *messageFiles, log *logrus.Entry, integrityChecker utils.IntegrityChecker) error {
+	exportDir := filepath.Join(dir, q.msg.ID)
+
+	if err := os.MkdirAll(exportDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create '%v': %w", exportDir, err)
+	}
+
+	bodyPath := filepath.Join(exportDir, bodyFileNameEncrypted())
+
+	if err := files.write(bodyPath, []byte(q.msg.Body), integrityChecker); err != nil {
+		log.WithField("msg-id", q.msg.ID).WithError(err).Errorf("Failed to write %v", bodyPath)
+		return fmt.Errorf("failed to write '%v': %w", bodyPath, err)
+	}
+
+	// The message is malformed, the attachment data may not match the attachment list.
+	for idx, attachment := range q.msg.Attachments {
+		if idx >= len(q.msg.AttData) {
+			log.WithField("msg-id", q.msg.ID).WithField("attID", attachment.ID).Warn("Quarantined message has no data for attachment")
+			continue
+		}
+
+		attachmentPath := filepath.Join(exportDir, files.fitName(exportDir, attachmentFileNameEncrypted(attachment.ID, attachment.Name)))
+
+		if err := files.write(attachmentPath, q.msg.AttData[idx], integrityChecker); err != nil {
+			log.WithField("msg-id", q.msg.ID).WithField("attID", attachment.ID).WithError(err).Errorf("Failed to write %v", attachmentPath)
+			return fmt.Errorf("failed to write '%v': %w", attachmentPath, err)
+		}
+	}
+
+	return nil
+}
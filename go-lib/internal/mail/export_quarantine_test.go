@@ -0,0 +1,132 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/export-tool/internal/reporter"
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// pathologicalMessages are malformed messages found while fuzzing the build stage.
+func pathologicalMessages() map[string]struct {
+	msg         proton.FullMessage
+	quarantined bool
+} {
+	attachments := []proton.Attachment{{ID: "att1", Name: "a.bin"}, {ID: "att2", Name: "b.bin"}}
+
+	return map[string]struct {
+		msg         proton.FullMessage
+		quarantined bool
+	}{
+		"attachment without data": {
+			msg: proton.FullMessage{
+				Message: proton.Message{MessageMetadata: proton.MessageMetadata{ID: "msg1"}, Attachments: attachments},
+				AttData: [][]byte{[]byte("data")},
+			},
+			quarantined: true,
+		},
+		"attachments and no data": {
+			msg: proton.FullMessage{
+				Message: proton.Message{MessageMetadata: proton.MessageMetadata{ID: "msg2"}, Attachments: attachments},
+			},
+			quarantined: true,
+		},
+		"garbage body": {
+			msg: proton.FullMessage{
+				Message: proton.Message{
+					MessageMetadata: proton.MessageMetadata{ID: "msg3"},
+					Header:          "Content-Type: multipart/mixed; boundary=\"\x00\"\r\n",
+					MIMEType:        "multipart/mixed",
+					Body:            "-----BEGIN PGP MESSAGE-----\n\x00\xff\n",
+				},
+			},
+		},
+		"invalid key packets": {
+			msg: proton.FullMessage{
+				Message: proton.Message{
+					MessageMetadata: proton.MessageMetadata{ID: "msg4"},
+					Attachments:     []proton.Attachment{{ID: "att1", Name: "a.bin", KeyPackets: "%%%"}},
+				},
+				AttData: [][]byte{nil},
+			},
+		},
+	}
+}
+
+func TestBuildStage_QuarantinesCrashingMessages(t *testing.T) {
+	key, err := crypto.GenerateKey("test", "test@proton.me", "x25519", 0)
+	require.NoError(t, err)
+	kr, err := crypto.NewKeyRing(key)
+	require.NoError(t, err)
+
+	stage := NewBuildStage(1, logrus.WithField("t", "t"), 0, nil, reporter.NullReporter{}, "userID")
+
+	var quarantined []string
+
+	for name, fixture := range pathologicalMessages() {
+		msg := fixture.msg
+
+		var writer MessageWriter
+		require.NotPanics(t, func() { writer = stage.buildMessage(kr, &msg) }, name)
+
+		_, ok := writer.(*QuarantinedMessageWriter)
+		require.Equal(t, fixture.quarantined, ok, name)
+
+		if ok {
+			quarantined = append(quarantined, msg.ID)
+		}
+	}
+
+	failures := stage.GetQuarantined()
+	require.Len(t, failures, len(quarantined))
+	for _, failure := range failures {
+		require.Contains(t, quarantined, failure.MessageID)
+		require.Contains(t, failure.Reason, "panic")
+	}
+}
+
+func TestQuarantinedMessageWriter(t *testing.T) {
+	fixture := pathologicalMessages()["attachment without data"]
+
+	writer := QuarantinedMessageWriter{msg: fixture.msg, integrity: newTransferIntegrity(&fixture.msg), reason: "panic: test"}
+	writeDir := t.TempDir()
+
+	require.NoError(t, writer.WriteMessage(writeDir, newMessageFiles(t.TempDir()), logrus.WithField("t", "t"), &utils.Sha256IntegrityChecker{}))
+
+	_, err := os.Stat(filepath.Join(writeDir, "msg1", bodyFileNameEncrypted()))
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(writeDir, "msg1", attachmentFileNameEncrypted("att1", "a.bin")))
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+
+	_, err = os.Stat(filepath.Join(writeDir, "msg1", attachmentFileNameEncrypted("att2", "b.bin")))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	metadata := writer.GetMetadata()
+	require.Equal(t, MessageWriterTypeQuarantined, metadata.WriterType)
+	require.Equal(t, "panic: test", metadata.Quarantine.Reason)
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/session"
+	"golang.org/x/exp/slices"
+)
+
+// Repair
+// ------
+// An export damaged after the fact, by a failing disk or a deleted file, is repaired by downloading again the messages
+// whose files are missing or fail their checksum, see VerifyExport, rather than running a full export. The repair is an
+// export of these messages only, run in the export directory with its layout, which rewrites their files, the labels
+// and the checksum manifest. The other damaged files cannot be repaired and are reported.
+
+var (
+	ErrRepairNotSupported = errors.New("only exports of EML files can be repaired, pack, archive, mbox and Maildir exports must be exported again")
+	ErrNothingToRepair    = errors.New("no damaged message to repair")
+)
+
+// RepairPlan lists what the repair of an export downloads again.
+type RepairPlan struct {
+	Time         time.Time
+	Report       VerifyReport
+	MessageIDs   []string      // Messages with a corrupted or missing file, sorted.
+	Unrepairable []VerifyIssue // Damaged files that do not belong to a message nor are rewritten by every export.
+
+	splitByYear   bool
+	autoGenerated bool // The export has folders of auto-generated messages, see AutoGeneratedModeSeparate.
+}
+
+// PlanRepair verifies the export at exportDir and returns the messages to download again. The directory is not
+// modified.
+func PlanRepair(ctx context.Context, exportDir string) (RepairPlan, error) {
+	manifest, err := LoadChecksumManifest(exportDir)
+	if err != nil {
+		return RepairPlan{}, err
+	}
+
+	listed := make(map[string]bool, len(manifest.Files))
+	plan := RepairPlan{Time: time.Now()}
+
+	for _, file := range manifest.Files {
+		listed[file.Path] = true
+
+		if !isRepairableExportFile(file.Path) {
+			return RepairPlan{}, ErrRepairNotSupported
+		}
+
+		segments := strings.Split(file.Path, "/")
+		plan.autoGenerated = plan.autoGenerated || slices.Contains(segments[:len(segments)-1], getAutoGeneratedDirName())
+		plan.splitByYear = plan.splitByYear || (len(segments) == 2 && segments[1] == getYearManifestFileName())
+	}
+
+	if plan.Report, err = VerifyExport(ctx, exportDir); err != nil {
+		return RepairPlan{}, err
+	}
+
+	ids := make(map[string]struct{})
+
+	for _, issue := range plan.Report.Issues {
+		if issue.Type == VerifyIssueUnlisted {
+			continue
+		}
+
+		if id, ok := getRepairMessageID(issue.Path, listed); ok {
+			ids[id] = struct{}{}
+		} else if base := path.Base(issue.Path); base != getLabelFileName() && base != getYearManifestFileName() {
+			plan.Unrepairable = append(plan.Unrepairable, issue)
+		}
+	}
+
+	for id := range ids {
+		plan.MessageIDs = append(plan.MessageIDs, id)
+	}
+
+	sort.Strings(plan.MessageIDs)
+
+	return plan, nil
+}
+
+// isRepairableExportFile returns false for the files of the output formats storing several messages in a file.
+func isRepairableExportFile(rel string) bool {
+	segments := strings.Split(rel, "/")
+
+	for _, segment := range segments[:len(segments)-1] {
+		if segment == getPackDirName() || segment == getMBoxDirName() || segment == getMaildirDirName() {
+			return false
+		}
+	}
+
+	base := segments[len(segments)-1]
+
+	return base != getArchiveFileName(OutputFormatZip) && base != getArchiveFileName(OutputFormatTarZst)
+}
+
+// getRepairMessageID returns the ID of the message a file of the export belongs to. The files of the messages that
+// could not be assembled or decrypted are in a folder named after the message, next to its metadata file, see
+// AssembleFailedMessageWriter.
+func getRepairMessageID(rel string, listed map[string]bool) (string, bool) {
+	rel = strings.TrimSuffix(rel, sealedExtension)
+	base := path.Base(rel)
+
+	if id, ok := strings.CutSuffix(base, jsonMetadataExtension); ok {
+		return id, true
+	}
+
+	if id, ok := strings.CutSuffix(base, emlExtension); ok {
+		return id, true
+	}
+
+	dir := path.Dir(rel)
+	if dir == "." {
+		return "", false
+	}
+
+	id := path.Base(dir)
+	metadataPath := path.Join(path.Dir(dir), getMetadataFileName(id))
+
+	return id, listed[metadataPath] || listed[metadataPath+sealedExtension]
+}
+
+// NewRepairTask returns the export downloading the messages of the plan again into the export at exportDir. It writes
+// them with the layout of the export. The key of an export encrypted at rest must be set, see SetAtRestEncryption.
+func NewRepairTask(ctx context.Context, exportDir string, plan *RepairPlan, session *session.Session) (*ExportTask, error) {
+	if len(plan.MessageIDs) == 0 {
+		return nil, ErrNothingToRepair
+	}
+
+	task := NewExportTask(ctx, exportDir, session)
+	task.exportDir = exportDir
+	task.tmpDir = filepath.Join(exportDir, "temp")
+	task.splitByYear = plan.splitByYear
+
+	if plan.autoGenerated {
+		task.autoGeneratedMode = AutoGeneratedModeSeparate
+	}
+
+	if err := task.SetFilter(Filter{MessageIDs: plan.MessageIDs}); err != nil {
+		task.Close()
+		return nil, err
+	}
+
+	return task, nil
+}
+
+// GetUnrepairedIDs returns the messages of the plan that the repair of exportDir did not write again, usually because
+// they were deleted from the account since the export.
+func (p *RepairPlan) GetUnrepairedIDs(exportDir string) ([]string, error) {
+	// FAT file systems store modification times with a resolution of 2 seconds.
+	startTime := p.Time.Truncate(2 * time.Second)
+	repaired := make(map[string]struct{}, len(p.MessageIDs))
+
+	if err := filepath.WalkDir(exportDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		id, ok := strings.CutSuffix(strings.TrimSuffix(entry.Name(), sealedExtension), jsonMetadataExtension)
+		if entry.IsDir() || !ok {
+			return nil
+		}
+
+		if info, err := entry.Info(); err == nil && !info.ModTime().Before(startTime) {
+			repaired[id] = struct{}{}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list repaired messages: %w", err)
+	}
+
+	var unrepaired []string
+
+	for _, id := range p.MessageIDs {
+		if _, ok := repaired[id]; !ok {
+			unrepaired = append(unrepaired, id)
+		}
+	}
+
+	return unrepaired, nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestExport(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	tmpDir := filepath.Join(dir, "temp")
+
+	require.NoError(t, os.MkdirAll(tmpDir, 0o700))
+
+	for name, content := range files {
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0o700))
+		require.NoError(t, os.WriteFile(filePath, []byte(content), 0o600))
+	}
+
+	require.NoError(t, writeChecksumManifest(context.Background(), tmpDir, dir, logrus.WithField("test", "test")))
+
+	return dir
+}
+
+func TestPlanRepair(t *testing.T) {
+	dir := writeTestExport(t, map[string]string{
+		getLabelFileName():                               "[]",
+		getSnapshotFileName():                            "{}",
+		getEMLFileName("msg-1"):                          "Subject: 1\r\n\r\n",
+		getMetadataFileName("msg-1"):                     "{}",
+		getEMLFileName("msg-2"):                          "Subject: 2\r\n\r\n",
+		getMetadataFileName("msg-2"):                     "{}",
+		getMetadataFileName("msg-3"):                     "{}",
+		"msg-3/" + bodyFileNameEncrypted():               "body",
+		"auto-generated/" + getEMLFileName("msg-4"):      "Subject: 4\r\n\r\n",
+		"auto-generated/" + getMetadataFileName("msg-4"): "{}",
+	})
+
+	plan, err := PlanRepair(context.Background(), dir)
+	require.NoError(t, err)
+	require.Empty(t, plan.MessageIDs)
+	require.True(t, plan.autoGenerated)
+	require.False(t, plan.splitByYear)
+
+	for _, name := range []string{getLabelFileName(), getSnapshotFileName(), getEMLFileName("msg-1"), "msg-3/" + bodyFileNameEncrypted()} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte("damaged"), 0o600))
+	}
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "auto-generated", getMetadataFileName("msg-4"))))
+
+	plan, err = PlanRepair(context.Background(), dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"msg-1", "msg-3", "msg-4"}, plan.MessageIDs)
+	require.Equal(t, []VerifyIssue{{Type: VerifyIssueCorrupted, Path: getSnapshotFileName(), Detail: plan.Unrepairable[0].Detail}}, plan.Unrepairable)
+
+	_, err = NewRepairTask(context.Background(), dir, &RepairPlan{}, nil)
+	require.ErrorIs(t, err, ErrNothingToRepair)
+}
+
+func TestPlanRepair_NotSupported(t *testing.T) {
+	dir := writeTestExport(t, map[string]string{
+		getLabelFileName():           "[]",
+		"packs/pack-0123.pack":       "pack",
+		getMetadataFileName("msg-1"): "{}",
+	})
+
+	_, err := PlanRepair(context.Background(), dir)
+	require.ErrorIs(t, err, ErrRepairNotSupported)
+}
+
+func TestRepairPlan_GetUnrepairedIDs(t *testing.T) {
+	dir := writeTestExport(t, map[string]string{
+		getMetadataFileName("msg-1"):                    "{}",
+		"2024/" + getMetadataFileName("msg-2") + ".gpg": "sealed",
+		getMetadataFileName("msg-3"):                    "{}",
+	})
+
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, getMetadataFileName("msg-3")), old, old))
+
+	plan := RepairPlan{Time: time.Now().Add(-time.Minute), MessageIDs: []string{"msg-1", "msg-2", "msg-3", "msg-4"}}
+
+	unrepaired, err := plan.GetUnrepairedIDs(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"msg-3", "msg-4"}, unrepaired)
+}
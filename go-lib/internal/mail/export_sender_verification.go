@@ -0,0 +1,216 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/go-proton-api"
+)
+
+// SenderVerificationStatus summarizes how much the sender of an inbound message can be trusted. It is derived from the
+// verification performed by Proton when the message was received: DKIM signature and SPF checks with the resulting
+// DMARC evaluation for external mail, and end-to-end encryption between Proton addresses for internal mail.
+type SenderVerificationStatus int
+
+const (
+	SenderVerificationUnverified SenderVerificationStatus = iota // No verification data is available.
+	SenderVerificationVerified                                   // Internal end-to-end encrypted message or DMARC pass.
+	SenderVerificationFailed                                     // SPF, DKIM or DMARC failed.
+	SenderVerificationSuspicious                                 // The message was flagged as phishing.
+)
+
+func (s SenderVerificationStatus) String() string {
+	switch s {
+	case SenderVerificationUnverified:
+		return "unverified"
+	case SenderVerificationVerified:
+		return "verified"
+	case SenderVerificationFailed:
+		return "failed"
+	case SenderVerificationSuspicious:
+		return "suspicious"
+	default:
+		return "unknown"
+	}
+}
+
+// SenderVerification is the per message verification result stored in the message metadata.
+type SenderVerification struct {
+	Status    SenderVerificationStatus
+	Internal  bool // Sent from a Proton address and end-to-end encrypted.
+	DMARCPass bool
+	DMARCFail bool
+	SPFFail   bool
+	DKIMFail  bool
+	Phishing  bool
+}
+
+// newSenderVerification returns nil for messages that were not received, e.g. sent messages and drafts.
+func newSenderVerification(flags proton.MessageFlag) *SenderVerification {
+	if !flags.Has(proton.MessageFlagReceived) {
+		return nil
+	}
+
+	result := &SenderVerification{
+		Internal:  flags.HasAll(proton.MessageFlagInternal, proton.MessageFlagE2E),
+		DMARCPass: flags.Has(proton.MessageFlagDMARCPass),
+		DMARCFail: flags.Has(proton.MessageFlagDMARCFail),
+		SPFFail:   flags.Has(proton.MessageFlagSPFFail),
+		DKIMFail:  flags.Has(proton.MessageFlagDKIMFail),
+		Phishing:  flags.HasAny(proton.MessageFlagPhishingAuto, proton.MessageFlagPhishingManual),
+	}
+
+	switch {
+	case result.Phishing:
+		result.Status = SenderVerificationSuspicious
+	case result.DMARCFail || result.SPFFail || result.DKIMFail:
+		result.Status = SenderVerificationFailed
+	case result.Internal || result.DMARCPass:
+		result.Status = SenderVerificationVerified
+	default:
+		result.Status = SenderVerificationUnverified
+	}
+
+	return result
+}
+
+// SenderVerificationSender lists the messages of a sender that could not be verified.
+type SenderVerificationSender struct {
+	Address         string
+	UnverifiedCount int
+	FailedCount     int
+	SuspiciousCount int
+	MessageIDs      []string
+}
+
+// SenderVerificationReport is the aggregated sender verification result of an export. Only the senders with at least
+// one message that is not verified are listed.
+type SenderVerificationReport struct {
+	ReceivedCount   int
+	VerifiedCount   int
+	UnverifiedCount int
+	FailedCount     int
+	SuspiciousCount int
+	Senders         []SenderVerificationSender
+	Authentication  *AuthenticationSummary `json:",omitempty"` // Headers of the received messages, see parseMessageAuthentication.
+}
+
+const SenderVerificationReportVersion = 1
+
+// senderVerificationCollector aggregates the verification results of the exported messages. It is safe for concurrent
+// use.
+type senderVerificationCollector struct {
+	lock           sync.Mutex
+	report         SenderVerificationReport
+	senders        map[string]*SenderVerificationSender
+	authentication *authenticationCollector
+}
+
+func newSenderVerificationCollector() *senderVerificationCollector {
+	return &senderVerificationCollector{
+		senders:        make(map[string]*SenderVerificationSender),
+		authentication: newAuthenticationCollector(),
+	}
+}
+
+func (c *senderVerificationCollector) add(metadata *MessageMetadata) {
+	verification := metadata.SenderVerification
+	if verification == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.report.ReceivedCount++
+	c.authentication.add(metadata.Headers)
+
+	if verification.Status == SenderVerificationVerified {
+		c.report.VerifiedCount++
+		return
+	}
+
+	var address string
+	if metadata.Sender != nil {
+		address = strings.ToLower(metadata.Sender.Address)
+	}
+
+	sender, ok := c.senders[address]
+	if !ok {
+		sender = &SenderVerificationSender{Address: address}
+		c.senders[address] = sender
+	}
+
+	sender.MessageIDs = append(sender.MessageIDs, metadata.ID)
+
+	switch verification.Status {
+	case SenderVerificationUnverified:
+		c.report.UnverifiedCount++
+		sender.UnverifiedCount++
+	case SenderVerificationFailed:
+		c.report.FailedCount++
+		sender.FailedCount++
+	case SenderVerificationSuspicious:
+		c.report.SuspiciousCount++
+		sender.SuspiciousCount++
+	case SenderVerificationVerified:
+	}
+}
+
+// get returns the report with the most suspicious senders first.
+func (c *senderVerificationCollector) get() SenderVerificationReport {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	report := c.report
+	report.Senders = make([]SenderVerificationSender, 0, len(c.senders))
+	report.Authentication = c.authentication.get()
+
+	for _, sender := range c.senders {
+		s := *sender
+		s.MessageIDs = append([]string(nil), sender.MessageIDs...)
+		sort.Strings(s.MessageIDs)
+		report.Senders = append(report.Senders, s)
+	}
+
+	sort.Slice(report.Senders, func(i, j int) bool {
+		a, b := report.Senders[i], report.Senders[j]
+		if a.SuspiciousCount != b.SuspiciousCount {
+			return a.SuspiciousCount > b.SuspiciousCount
+		}
+
+		if a.FailedCount != b.FailedCount {
+			return a.FailedCount > b.FailedCount
+		}
+
+		if a.UnverifiedCount != b.UnverifiedCount {
+			return a.UnverifiedCount > b.UnverifiedCount
+		}
+
+		return a.Address < b.Address
+	})
+
+	return report
+}
+
+func getSenderVerificationFileName() string {
+	return "sender_verification.json"
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"net/mail"
+	"testing"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSenderVerification(t *testing.T) {
+	require.Nil(t, newSenderVerification(proton.MessageFlagSent))
+
+	tests := []struct {
+		flags    proton.MessageFlag
+		expected SenderVerificationStatus
+	}{
+		{flags: proton.MessageFlagReceived, expected: SenderVerificationUnverified},
+		{flags: proton.MessageFlagReceived | proton.MessageFlagInternal, expected: SenderVerificationUnverified},
+		{flags: proton.MessageFlagReceived | proton.MessageFlagInternal | proton.MessageFlagE2E, expected: SenderVerificationVerified},
+		{flags: proton.MessageFlagReceived | proton.MessageFlagDMARCPass, expected: SenderVerificationVerified},
+		{flags: proton.MessageFlagReceived | proton.MessageFlagDMARCPass | proton.MessageFlagSPFFail, expected: SenderVerificationFailed},
+		{flags: proton.MessageFlagReceived | proton.MessageFlagDKIMFail, expected: SenderVerificationFailed},
+		{flags: proton.MessageFlagReceived | proton.MessageFlagDMARCFail | proton.MessageFlagPhishingAuto, expected: SenderVerificationSuspicious},
+	}
+
+	for _, test := range tests {
+		result := newSenderVerification(test.flags)
+		require.NotNil(t, result)
+		require.Equal(t, test.expected, result.Status, "flags %b", test.flags)
+	}
+}
+
+func TestSenderVerificationCollector(t *testing.T) {
+	newMetadata := func(id, sender string, flags proton.MessageFlag) *MessageMetadata {
+		metadata := NewMessageMetadata(MessageWriterTypeDecryptedAndBuilt, &proton.Message{
+			MessageMetadata: proton.MessageMetadata{ID: id, Sender: &mail.Address{Address: sender}, Flags: flags},
+		})
+
+		return &metadata
+	}
+
+	collector := newSenderVerificationCollector()
+	collector.add(newMetadata("1", "friend@proton.me", proton.MessageFlagReceived|proton.MessageFlagInternal|proton.MessageFlagE2E))
+	collector.add(newMetadata("2", "me@proton.me", proton.MessageFlagSent))
+	collector.add(newMetadata("3", "news@example.com", proton.MessageFlagReceived))
+	collector.add(newMetadata("4", "bank@examp1e.com", proton.MessageFlagReceived|proton.MessageFlagPhishingAuto))
+	collector.add(newMetadata("5", "News@Example.com", proton.MessageFlagReceived|proton.MessageFlagDKIMFail))
+
+	report := collector.get()
+	require.Equal(t, 4, report.ReceivedCount)
+	require.Equal(t, 1, report.VerifiedCount)
+	require.Equal(t, 1, report.UnverifiedCount)
+	require.Equal(t, 1, report.FailedCount)
+	require.Equal(t, 1, report.SuspiciousCount)
+
+	require.Len(t, report.Senders, 2)
+	require.Equal(t, "bank@examp1e.com", report.Senders[0].Address)
+	require.Equal(t, []string{"4"}, report.Senders[0].MessageIDs)
+	require.Equal(t, "news@example.com", report.Senders[1].Address)
+	require.Equal(t, []string{"3", "5"}, report.Senders[1].MessageIDs)
+}
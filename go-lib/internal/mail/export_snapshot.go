@@ -0,0 +1,176 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"golang.org/x/exp/slices"
+)
+
+const SnapshotVersion = 1
+
+const (
+	DefaultSnapshotMaxDeleted      = 1000
+	DefaultSnapshotMaxDeletedRatio = 0.25
+)
+
+// Snapshot lists the messages of the mailbox at the time of a full export. Consecutive snapshots of the same account
+// are compared to detect anomalous changes, e.g. a mass deletion following an account compromise.
+type Snapshot struct {
+	UserID     string
+	Time       time.Time
+	MessageIDs []string
+}
+
+// SnapshotDiff describes the changes of a mailbox between two full exports.
+type SnapshotDiff struct {
+	UserID        string
+	PreviousPath  string // Export directory of the previous snapshot.
+	PreviousTime  time.Time
+	PreviousCount int
+	CurrentCount  int
+	AddedCount    int
+	DeletedCount  int
+	Anomalous     bool
+}
+
+// GetAlertSubject returns a one line summary of the diff, e.g. for the subject of an alert email.
+func (d SnapshotDiff) GetAlertSubject() string {
+	return fmt.Sprintf("Proton Mail backup: %v of %v messages deleted since the previous backup", d.DeletedCount, d.PreviousCount)
+}
+
+// SnapshotThresholds control when a SnapshotDiff is anomalous. A zero value disables the corresponding check.
+type SnapshotThresholds struct {
+	MaxDeleted      int     // Maximum number of deleted messages.
+	MaxDeletedRatio float64 // Maximum ratio of the messages of the previous snapshot that were deleted.
+}
+
+func DefaultSnapshotThresholds() SnapshotThresholds {
+	return SnapshotThresholds{
+		MaxDeleted:      DefaultSnapshotMaxDeleted,
+		MaxDeletedRatio: DefaultSnapshotMaxDeletedRatio,
+	}
+}
+
+func (t SnapshotThresholds) isAnomalous(diff *SnapshotDiff) bool {
+	if t.MaxDeleted != 0 && diff.DeletedCount > t.MaxDeleted {
+		return true
+	}
+
+	return t.MaxDeletedRatio != 0 &&
+		diff.PreviousCount != 0 &&
+		float64(diff.DeletedCount)/float64(diff.PreviousCount) > t.MaxDeletedRatio
+}
+
+// SnapshotAlertFunc is called when the snapshot of an export differs anomalously from the previous one.
+type SnapshotAlertFunc func(ctx context.Context, diff SnapshotDiff) error
+
+// CompareSnapshots returns the changes from previous to current. The message IDs of both snapshots must be sorted.
+func CompareSnapshots(previous, current *Snapshot, thresholds SnapshotThresholds) SnapshotDiff {
+	diff := SnapshotDiff{
+		UserID:        current.UserID,
+		PreviousTime:  previous.Time,
+		PreviousCount: len(previous.MessageIDs),
+		CurrentCount:  len(current.MessageIDs),
+	}
+
+	for _, id := range previous.MessageIDs {
+		if _, found := slices.BinarySearch(current.MessageIDs, id); !found {
+			diff.DeletedCount++
+		}
+	}
+
+	diff.AddedCount = diff.CurrentCount - (diff.PreviousCount - diff.DeletedCount)
+	diff.Anomalous = thresholds.isAnomalous(&diff)
+
+	return diff
+}
+
+func getSnapshotFileName() string {
+	return "snapshot.json"
+}
+
+func writeSnapshot(tmpDir, exportDir string, snapshot *Snapshot) error {
+	sort.Strings(snapshot.MessageIDs)
+
+	data, err := utils.GenerateVersionedJSON(SnapshotVersion, snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to json encode snapshot: %w", err)
+	}
+
+	return utils.WriteFileSafe(tmpDir, filepath.Join(exportDir, getSnapshotFileName()), data, &utils.Sha256IntegrityChecker{})
+}
+
+// LoadSnapshot reads the snapshot from an export directory.
+func LoadSnapshot(exportDir string) (Snapshot, error) {
+	b, err := os.ReadFile(filepath.Join(exportDir, getSnapshotFileName())) //nolint:gosec
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	snapshot, err := utils.NewVersionedJSON[Snapshot](SnapshotVersion, b)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+
+	return snapshot.Payload, nil
+}
+
+// findPreviousSnapshot returns the most recent snapshot of userID among the other exports next to exportDir. The
+// returned path is empty if there is none.
+func findPreviousSnapshot(exportDir, userID string) (Snapshot, string, error) {
+	entries, err := os.ReadDir(filepath.Dir(exportDir))
+	if err != nil {
+		return Snapshot{}, "", fmt.Errorf("failed to list previous exports: %w", err)
+	}
+
+	// Export directory names embed their creation time, the most recent ones come last.
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "mail_") {
+			continue
+		}
+
+		path := filepath.Join(filepath.Dir(exportDir), entry.Name())
+		if path == filepath.Clean(exportDir) {
+			continue
+		}
+
+		snapshot, err := LoadSnapshot(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return Snapshot{}, "", err
+		}
+
+		if snapshot.UserID == userID {
+			return snapshot, path, nil
+		}
+	}
+
+	return Snapshot{}, "", nil
+}
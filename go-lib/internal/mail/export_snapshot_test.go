@@ -0,0 +1,70 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareSnapshots(t *testing.T) {
+	previous := Snapshot{UserID: "user", MessageIDs: []string{"a", "b", "c", "d"}}
+	current := Snapshot{UserID: "user", MessageIDs: []string{"a", "e", "f"}}
+
+	diff := CompareSnapshots(&previous, &current, SnapshotThresholds{MaxDeleted: 10})
+	require.Equal(t, 4, diff.PreviousCount)
+	require.Equal(t, 3, diff.CurrentCount)
+	require.Equal(t, 2, diff.AddedCount)
+	require.Equal(t, 3, diff.DeletedCount)
+	require.False(t, diff.Anomalous)
+
+	require.True(t, CompareSnapshots(&previous, &current, SnapshotThresholds{MaxDeleted: 2}).Anomalous)
+	require.True(t, CompareSnapshots(&previous, &current, SnapshotThresholds{MaxDeletedRatio: 0.5}).Anomalous)
+	require.False(t, CompareSnapshots(&previous, &current, SnapshotThresholds{}).Anomalous)
+}
+
+func TestFindPreviousSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	tmpDir := t.TempDir()
+
+	write := func(name, userID string) {
+		exportDir := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(exportDir, 0o700))
+		require.NoError(t, writeSnapshot(tmpDir, exportDir, &Snapshot{UserID: userID, Time: time.Now(), MessageIDs: []string{"b", "a"}}))
+	}
+
+	write("mail_20240101_120000", "user")
+	write("mail_20240102_120000", "other")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "mail_20240103_120000"), 0o700)) // Interrupted export.
+
+	current := filepath.Join(dir, "mail_20240104_120000")
+	require.NoError(t, os.MkdirAll(current, 0o700))
+
+	snapshot, path, err := findPreviousSnapshot(current, "user")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "mail_20240101_120000"), path)
+	require.Equal(t, []string{"a", "b"}, snapshot.MessageIDs)
+
+	_, path, err = findPreviousSnapshot(current, "unknown")
+	require.NoError(t, err)
+	require.Empty(t, path)
+}
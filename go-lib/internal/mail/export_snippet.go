@@ -0,0 +1,67 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"strings"
+	"unicode"
+)
+
+// MaxSnippetRunes is the length of the body preview stored in the metadata of the messages.
+const MaxSnippetRunes = 200
+
+// getSnippet returns the start of a message text as one line, to preview the message without opening its EML file.
+// It is cut at the last word boundary before MaxSnippetRunes.
+func getSnippet(text string) string {
+	var builder strings.Builder
+
+	count := 0
+	space := false
+
+	for _, r := range strings.ToValidUTF8(text, "") {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			space = builder.Len() != 0
+			continue
+		}
+
+		if space {
+			if count+1 >= MaxSnippetRunes {
+				break
+			}
+
+			builder.WriteRune(' ')
+			count++
+			space = false
+		}
+
+		if count == MaxSnippetRunes {
+			// Drop the word cut in the middle, unless it is the only one.
+			snippet := builder.String()
+			if i := strings.LastIndexByte(snippet, ' '); i > 0 {
+				return snippet[:i]
+			}
+
+			return snippet
+		}
+
+		builder.WriteRune(r)
+		count++
+	}
+
+	return builder.String()
+}
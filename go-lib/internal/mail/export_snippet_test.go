@@ -0,0 +1,39 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSnippet(t *testing.T) {
+	require.Equal(t, "", getSnippet(" \r\n\t "))
+	require.Equal(t, "Hello world, how are you?", getSnippet("  Hello\r\n\r\nworld,\thow are   you?\n"))
+	require.Equal(t, "invalid utf8", getSnippet("invalid \xff utf8"))
+
+	long := getSnippet(strings.Repeat("word ", 100))
+	require.LessOrEqual(t, utf8.RuneCountInString(long), MaxSnippetRunes)
+	require.True(t, strings.HasSuffix(long, "word"))
+
+	unbroken := getSnippet(strings.Repeat("é", 300))
+	require.Equal(t, MaxSnippetRunes, utf8.RuneCountInString(unbroken))
+}
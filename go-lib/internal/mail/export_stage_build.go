@@ -27,6 +27,7 @@ import (
 	"github.com/ProtonMail/export-tool/internal/reporter"
 	"github.com/ProtonMail/gluon/async"
 	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/ProtonMail/proton-bridge/v3/pkg/message"
 	"github.com/bradenaw/juniper/parallel"
 	"github.com/sirupsen/logrus"
@@ -45,6 +46,9 @@ type BuildStage struct {
 	maxBuildMemMB    uint64
 	reporter         reporter.Reporter
 	userID           string
+	quarantined      quarantineList
+	detectLanguage   bool
+	events           *EventBus
 }
 
 var ErrBuildNoAddrKey = errors.New("no key found for address")
@@ -68,6 +72,16 @@ func NewBuildStage(
 	}
 }
 
+// setDetectLanguage enables the detection of the language of the messages, stored in their metadata.
+func (b *BuildStage) setDetectLanguage(detect bool) {
+	b.detectLanguage = detect
+}
+
+// setEventBus publishes an AttachmentSkippedEvent for each attachment which could not be decrypted.
+func (b *BuildStage) setEventBus(events *EventBus) {
+	b.events = events
+}
+
 func (b *BuildStage) Run(
 	ctx context.Context,
 	inputs <-chan DownloadStageOutput,
@@ -92,29 +106,13 @@ func (b *BuildStage) Run(
 				kr, ok := keys.GetAddrKeyRing(addrID)
 				if !ok {
 					b.log.WithField("addrID", addrID).Warn("Address has no key ring")
-					results[i] = &AddrKeyRingMissingMessageWriter{msg: chunk[i]}
-					return nil
-				}
-
-				var buffer bytes.Buffer
-				buffer.Grow(chunk[i].Size)
-
-				decrypted := message.DecryptMessage(kr, chunk[i].Message, chunk[i].AttData)
-
-				if err := message.BuildRFC822Into(kr, &decrypted, defaultMessageJobOpts(), &buffer); err != nil {
-					b.log.WithError(err).WithField("addrID", addrID).Warn("Failed to build message")
-					b.reporter.ReportError(fmt.Errorf("failed to build message: %w", err), reporter.Context{
-						"msgID":  chunk[i].Message.ID,
-						"userID": b.userID,
-					})
-					results[i] = &AssembleFailedMessageWriter{decrypted: decrypted}
+					integrity := newTransferIntegrity(&chunk[i])
+					integrity.EncryptedOnly = true
+					results[i] = &AddrKeyRingMissingMessageWriter{msg: chunk[i], integrity: integrity}
 					return nil
 				}
 
-				results[i] = &DecryptedAndBuiltMessageWriter{
-					msg: chunk[i],
-					eml: buffer,
-				}
+				results[i] = b.buildMessage(kr, &chunk[i])
 
 				return nil
 			}); err != nil {
@@ -134,6 +132,63 @@ func (b *BuildStage) Run(
 	}
 }
 
+// buildMessage decrypts and assembles msg. A panic of the decryption or of the assembly of a pathological message is
+// recovered, the message is quarantined instead of taking down the export.
+func (b *BuildStage) buildMessage(kr *crypto.KeyRing, msg *proton.FullMessage) (writer MessageWriter) {
+	defer func() {
+		if r := recover(); r != nil {
+			writer = b.quarantine(msg, r)
+		}
+	}()
+
+	var buffer bytes.Buffer
+	buffer.Grow(msg.Size)
+
+	decrypted := message.DecryptMessage(kr, msg.Message, msg.AttData)
+	integrity := newMessageIntegrity(&decrypted, msg)
+	if !integrity.Verified {
+		b.log.WithField("msgID", msg.ID).Warn("Message integrity could not be verified")
+	}
+
+	for i, attachment := range decrypted.Attachments {
+		if attachment.Err != nil {
+			b.events.Publish(AttachmentSkippedEvent{
+				MessageID:    msg.ID,
+				AttachmentID: msg.Attachments[i].ID,
+				Name:         msg.Attachments[i].Name,
+				Reason:       attachment.Err.Error(),
+			})
+		}
+	}
+
+	var language, snippet string
+	if decrypted.BodyErr == nil {
+		text := getBodyText(decrypted.Body.Bytes(), msg.MIMEType)
+		snippet = getSnippet(text)
+
+		if b.detectLanguage {
+			language = DetectLanguage(msg.Subject + "\n" + text)
+		}
+	}
+
+	if err := message.BuildRFC822Into(kr, &decrypted, defaultMessageJobOpts(), &buffer); err != nil {
+		b.log.WithError(err).WithField("addrID", msg.AddressID).Warn("Failed to build message")
+		b.reporter.ReportError(fmt.Errorf("failed to build message: %w", err), reporter.Context{
+			"msgID":  msg.Message.ID,
+			"userID": b.userID,
+		})
+		return &AssembleFailedMessageWriter{decrypted: decrypted, integrity: integrity, language: language, snippet: snippet}
+	}
+
+	return &DecryptedAndBuiltMessageWriter{
+		msg:       *msg,
+		eml:       buffer,
+		integrity: integrity,
+		language:  language,
+		snippet:   snippet,
+	}
+}
+
 func defaultMessageJobOpts() message.JobOptions {
 	return message.JobOptions{
 		IgnoreDecryptionErrors: true, // Whether to ignore decryption errors and create a "custom message" instead.
@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"sync/atomic"
 
 	"github.com/ProtonMail/export-tool/internal/apiclient"
 	"github.com/ProtonMail/gluon/async"
@@ -41,6 +42,13 @@ type DownloadStage struct {
 	parallelWorkers  int
 	maxDownloadMemMB uint64
 	panicHandler     async.PanicHandler
+
+	bodyMatcher      BodyMatcher
+	progressReporter StageProgressReporter
+	filteredCount    atomic.Uint64
+	downloadedBytes  atomic.Uint64
+
+	checkpoint *checkpointTracker
 }
 
 func NewDownloadStage(
@@ -60,11 +68,34 @@ func NewDownloadStage(
 	}
 }
 
+// SetBodyMatcher enables the two pass download: the message body is downloaded first and the attachments are only
+// downloaded if matcher selects the message. The messages that are not selected are reported as processed.
+func (d *DownloadStage) SetBodyMatcher(matcher BodyMatcher, progressReporter StageProgressReporter) {
+	d.bodyMatcher = matcher
+	d.progressReporter = progressReporter
+}
+
+// setCheckpointTracker records the messages that do not match the body filter in the checkpoint of the export.
+func (d *DownloadStage) setCheckpointTracker(checkpoint *checkpointTracker) {
+	d.checkpoint = checkpoint
+}
+
+// GetDownloadedBytes returns the size of the encrypted bodies and attachments downloaded so far.
+func (d *DownloadStage) GetDownloadedBytes() uint64 {
+	return d.downloadedBytes.Load()
+}
+
+// GetFilteredCount returns the number of messages that were not selected by the BodyMatcher.
+func (d *DownloadStage) GetFilteredCount() uint64 {
+	return d.filteredCount.Load()
+}
+
 func (d *DownloadStage) Run(ctx context.Context, input <-chan []proton.MessageMetadata, errReporter StageErrorReporter) {
 	d.log.Debug("Starting")
 	defer d.log.Debug("Exiting")
 
 	const Failed422ID = "MsgFailed422"
+	const FilteredID = "MsgFiltered"
 
 	defer close(d.outputCh)
 	for metadata := range input {
@@ -81,7 +112,14 @@ func (d *DownloadStage) Run(ctx context.Context, input <-chan []proton.MessageMe
 			if err := parallel.DoContext(ctx, d.parallelWorkers, len(chunk), func(ctx context.Context, i int) error {
 				defer async.HandlePanic(d.panicHandler)
 
-				msg, err := downloadMessageAndAttachments(ctx, d.client, chunk[i])
+				msg, err := d.download(ctx, chunk[i])
+				if errors.Is(err, errBodyNotMatching) {
+					if d.checkpoint != nil {
+						d.checkpoint.markProcessed(chunk[i].ID)
+					}
+					result.messages[i].ID = FilteredID
+					return nil
+				}
 				if err != nil {
 					var apiErr *proton.APIError
 					if errors.As(err, &apiErr) && apiErr.Status == 422 {
@@ -95,6 +133,7 @@ func (d *DownloadStage) Run(ctx context.Context, input <-chan []proton.MessageMe
 				}
 
 				result.messages[i] = msg
+				d.downloadedBytes.Add(getDownloadedSize(&msg))
 
 				return nil
 			}); err != nil {
@@ -102,9 +141,16 @@ func (d *DownloadStage) Run(ctx context.Context, input <-chan []proton.MessageMe
 				return
 			}
 
-			// Remove any failed 422 downloads.
+			// Failed 422 downloads are skipped, the messages that do not match the body filter are reported as
+			// processed since they will not reach the write stage.
+			filtered := xslices.CountFunc(result.messages, func(t proton.FullMessage) bool { return t.ID == FilteredID })
+			if filtered != 0 {
+				d.filteredCount.Add(uint64(filtered))
+				d.progressReporter.OnProgress(filtered)
+			}
+
 			result.messages = xslices.Filter(result.messages, func(t proton.FullMessage) bool {
-				return t.ID != Failed422ID
+				return t.ID != Failed422ID && t.ID != FilteredID
 			})
 
 			select {
@@ -116,12 +162,37 @@ func (d *DownloadStage) Run(ctx context.Context, input <-chan []proton.MessageMe
 	}
 }
 
+var errBodyNotMatching = errors.New("message body does not match the filter")
+
+// download downloads the message and its attachments. With a BodyMatcher, errBodyNotMatching is returned for the
+// messages that are not selected, without downloading their attachments.
+func (d *DownloadStage) download(ctx context.Context, metadata proton.MessageMetadata) (proton.FullMessage, error) {
+	if d.bodyMatcher == nil {
+		return downloadMessageAndAttachments(ctx, d.client, metadata)
+	}
+
+	msg, err := d.client.GetMessage(ctx, metadata.ID)
+	if err != nil {
+		return proton.FullMessage{}, err
+	}
+
+	if !d.bodyMatcher(&msg) {
+		return proton.FullMessage{}, errBodyNotMatching
+	}
+
+	return downloadAttachments(ctx, d.client, msg)
+}
+
 func downloadMessageAndAttachments(ctx context.Context, client apiclient.Client, metadata proton.MessageMetadata) (proton.FullMessage, error) {
 	msg, err := client.GetMessage(ctx, metadata.ID)
 	if err != nil {
 		return proton.FullMessage{}, err
 	}
 
+	return downloadAttachments(ctx, client, msg)
+}
+
+func downloadAttachments(ctx context.Context, client apiclient.Client, msg proton.Message) (proton.FullMessage, error) {
 	full := proton.FullMessage{
 		Message: msg,
 		AttData: nil,
@@ -130,16 +201,13 @@ func downloadMessageAndAttachments(ctx context.Context, client apiclient.Client,
 	if len(msg.Attachments) != 0 {
 		attData := make([][]byte, len(msg.Attachments))
 
-		for i, a := range msg.Attachments {
-			buffer := bytes.Buffer{}
-
-			buffer.Grow(int(a.Size))
-
-			if err := client.GetAttachmentInto(ctx, a.ID, &buffer); err != nil {
+		for i := range msg.Attachments {
+			data, err := downloadAttachment(ctx, client, &msg.Attachments[i])
+			if err != nil {
 				return proton.FullMessage{}, err
 			}
 
-			attData[i] = buffer.Bytes()
+			attData[i] = data
 		}
 
 		full.AttData = attData
@@ -148,6 +216,43 @@ func downloadMessageAndAttachments(ctx context.Context, client apiclient.Client,
 	return full, nil
 }
 
+// downloadAttachment downloads the attachment and checks that the transfer is complete. An attachment whose size does
+// not match after maxTransferAttempts downloads is returned anyway, the mismatch is recorded in the message metadata.
+func downloadAttachment(ctx context.Context, client apiclient.Client, attachment *proton.Attachment) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	for attempt := 1; ; attempt++ {
+		buffer.Reset()
+		buffer.Grow(int(attachment.Size))
+
+		if err := client.GetAttachmentInto(ctx, attachment.ID, &buffer); err != nil {
+			return nil, err
+		}
+
+		err := verifyAttachmentTransfer(attachment, buffer.Bytes())
+		if err == nil {
+			return buffer.Bytes(), nil
+		}
+
+		log := logrus.WithError(err).WithField("attID", attachment.ID).WithField("attempt", attempt)
+		if attempt == maxTransferAttempts {
+			log.Error("Attachment transfer could not be verified")
+			return buffer.Bytes(), nil
+		}
+
+		log.Warn("Attachment transfer is corrupted, downloading again")
+	}
+}
+
+func getDownloadedSize(msg *proton.FullMessage) uint64 {
+	size := uint64(len(msg.Body))
+	for _, data := range msg.AttData {
+		size += uint64(len(data))
+	}
+
+	return size
+}
+
 func chunkMemLimitMetadata(batch []proton.MessageMetadata, maxMemory uint64) [][]proton.MessageMetadata {
 	// Message are alive for 4 stages. Even though there are technically 2 stages after this one
 	// Due to pipelining up to 4 batches can be in circulation at any given time.
@@ -113,6 +113,47 @@ func TestDownloadMessageAndAttachments_WithAttachments(t *testing.T) {
 	require.Equal(t, expected, fullMsg)
 }
 
+func TestDownloadMessageAndAttachments_TruncatedTransfer(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+
+	const msgID = "msgID"
+	const attID = "att1"
+	attData := []byte("hello world")
+
+	metaData := proton.MessageMetadata{ID: msgID}
+	msgData := proton.Message{
+		MessageMetadata: metaData,
+		Attachments:     []proton.Attachment{{ID: attID, Size: int64(len(attData))}},
+	}
+
+	client.EXPECT().GetMessage(gomock.Any(), gomock.Eq(msgID)).Return(msgData, nil)
+	first := client.EXPECT().GetAttachmentInto(gomock.Any(), gomock.Eq(attID), gomock.Any()).DoAndReturn(func(_ context.Context, _ string, b *bytes.Buffer) error {
+		_, err := b.Write(attData[:5])
+		require.NoError(t, err)
+		return nil
+	})
+	client.EXPECT().GetAttachmentInto(gomock.Any(), gomock.Eq(attID), gomock.Any()).After(first).DoAndReturn(func(_ context.Context, _ string, b *bytes.Buffer) error {
+		_, err := b.Write(attData)
+		require.NoError(t, err)
+		return nil
+	})
+
+	fullMsg, err := downloadMessageAndAttachments(context.Background(), client, metaData)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{attData}, fullMsg.AttData)
+
+	integrity := newTransferIntegrity(&fullMsg)
+	require.True(t, integrity.Verified)
+	require.Equal(t, sha256Hex(attData), integrity.Attachments[0].SHA256)
+
+	// A transfer that remains truncated is kept, but recorded as not verified.
+	fullMsg.AttData[0] = attData[:5]
+	integrity = newTransferIntegrity(&fullMsg)
+	require.False(t, integrity.Verified)
+	require.Equal(t, []string{attID}, integrity.SizeMismatchIDs)
+}
+
 func TestDownloadStage_Run(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	client := apiclient.NewMockClient(mockCtrl)
@@ -224,3 +265,47 @@ func TestDownloadStage_RunOtherErrorsReported(t *testing.T) {
 
 	<-stage.outputCh
 }
+
+func TestDownloadStage_RunBodyMatcher(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+	errReporter := NewMockStageErrorReporter(mockCtrl)
+	reporter := NewMockReporter(mockCtrl)
+	stage := NewDownloadStage(client, 2, logrus.WithField("test", "test"), MinDownloadMemMB, &async.NoopPanicHandler{})
+	stage.SetBodyMatcher(func(msg *proton.Message) bool { return msg.Body == "invoice" }, reporter)
+
+	input := make(chan []proton.MessageMetadata)
+	attData := []byte("hello")
+
+	newMessage := func(id, body string) proton.Message {
+		return proton.Message{
+			MessageMetadata: proton.MessageMetadata{ID: id},
+			Body:            body,
+			Attachments:     []proton.Attachment{{ID: id + "-att", Size: int64(len(attData))}},
+		}
+	}
+
+	matching := newMessage("msgID1", "invoice")
+	other := newMessage("msgID2", "holidays")
+
+	client.EXPECT().GetMessage(gomock.Any(), gomock.Eq(matching.ID)).Return(matching, nil)
+	client.EXPECT().GetMessage(gomock.Any(), gomock.Eq(other.ID)).Return(other, nil)
+	// Only the attachments of the matching message are downloaded.
+	client.EXPECT().GetAttachmentInto(gomock.Any(), gomock.Eq("msgID1-att"), gomock.Any()).DoAndReturn(func(_ context.Context, _ string, b *bytes.Buffer) error {
+		_, err := b.Write(attData)
+		return err
+	})
+	reporter.EXPECT().OnProgress(gomock.Eq(1))
+
+	go func() {
+		stage.Run(context.Background(), input, errReporter)
+	}()
+
+	input <- []proton.MessageMetadata{matching.MessageMetadata, other.MessageMetadata}
+	close(input)
+
+	result := <-stage.outputCh
+
+	require.Equal(t, []proton.FullMessage{{Message: matching, AttData: [][]byte{attData}}}, result.messages)
+	require.Equal(t, uint64(1), stage.GetFilteredCount())
+}
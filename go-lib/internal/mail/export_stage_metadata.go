@@ -19,6 +19,7 @@ package mail
 
 import (
 	"context"
+	"sync/atomic"
 
 	"github.com/ProtonMail/export-tool/internal/apiclient"
 	"github.com/ProtonMail/go-proton-api"
@@ -36,6 +37,19 @@ type MetadataStage struct {
 	outputCh  chan []proton.MessageMetadata
 	pageSize  int
 	splitSize int
+	shard     *ShardJob
+	filter    *Filter
+
+	filteredCount atomic.Uint64
+
+	collectIDs bool
+	messageIDs []string
+
+	incremental *incrementalTracker
+
+	stop <-chan struct{} // Nil unless the stage can be stopped gracefully.
+
+	checkpoint *checkpointTracker
 }
 
 func NewMetadataStage(
@@ -53,6 +67,56 @@ func NewMetadataStage(
 	}
 }
 
+// SetShard restricts the stage to the messages of the given shard.
+func (m *MetadataStage) SetShard(shard *ShardJob) {
+	m.shard = shard
+}
+
+// SetFilter restricts the stage to the messages matching the filter.
+func (m *MetadataStage) SetFilter(filter *Filter) {
+	m.filter = filter
+}
+
+// GetFilteredCount returns the number of messages that did not match the filter.
+func (m *MetadataStage) GetFilteredCount() uint64 {
+	return m.filteredCount.Load()
+}
+
+// SetCollectMessageIDs records the IDs of all the listed messages, see GetMessageIDs.
+func (m *MetadataStage) SetCollectMessageIDs(collect bool) {
+	m.collectIDs = collect
+}
+
+// setIncrementalTracker skips the messages that are up to date in an incremental export.
+func (m *MetadataStage) setIncrementalTracker(incremental *incrementalTracker) {
+	m.incremental = incremental
+}
+
+// setCheckpointTracker records the listed pages in the checkpoint of the export. The listing starts from the cursor of
+// the checkpoint.
+func (m *MetadataStage) setCheckpointTracker(checkpoint *checkpointTracker) {
+	m.checkpoint = checkpoint
+}
+
+// setStopSignal stops the listing when stop is closed. The pages already listed are still passed to the next stage.
+func (m *MetadataStage) setStopSignal(stop <-chan struct{}) {
+	m.stop = stop
+}
+
+func (m *MetadataStage) isStopped() bool {
+	select {
+	case <-m.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// GetMessageIDs returns the IDs of the listed messages. It must only be called once Run returned.
+func (m *MetadataStage) GetMessageIDs() []string {
+	return m.messageIDs
+}
+
 func (m *MetadataStage) Run(
 	ctx context.Context,
 	errReporter StageErrorReporter,
@@ -67,18 +131,43 @@ func (m *MetadataStage) Run(
 
 	var lastMessageID string
 
+	// The first message of an ID shard is included in the shard, unlike the EndID of the following pages.
+	includeLastMessage := false
+	if m.shard != nil && m.shard.Mode == ShardModeMessageID && m.shard.FirstID != "" {
+		lastMessageID = m.shard.FirstID
+		includeLastMessage = true
+	}
+
+	if m.checkpoint != nil {
+		if cursor, _ := m.checkpoint.getCursor(); cursor != "" {
+			lastMessageID = cursor
+			includeLastMessage = false
+		}
+	}
+
+	apiFilter := proton.MessageFilter{Desc: true}
+	var matches func(meta *proton.MessageMetadata) bool
+
+	if m.filter != nil {
+		var err error
+		if apiFilter, matches, err = m.filter.metadataMatcher(ctx, client, m.pageSize); err != nil {
+			errReporter.ReportStageError(err)
+			return
+		}
+	}
+
 	for {
-		if ctx.Err() != nil {
+		if ctx.Err() != nil || m.isStopped() {
 			return
 		}
 
 		var metadata []proton.MessageMetadata
 
 		if lastMessageID != "" {
-			meta, err := client.GetMessageMetadataPage(ctx, 0, m.pageSize, proton.MessageFilter{
-				EndID: lastMessageID,
-				Desc:  true,
-			})
+			pageFilter := apiFilter
+			pageFilter.EndID = lastMessageID
+
+			meta, err := client.GetMessageMetadataPage(ctx, 0, m.pageSize, pageFilter)
 
 			if err != nil {
 				errReporter.ReportStageError(err)
@@ -86,15 +175,15 @@ func (m *MetadataStage) Run(
 			}
 
 			// * There is only one message returned and it matches the EndID query.
-			if len(meta) != 0 && meta[0].ID == lastMessageID {
+			if len(meta) != 0 && meta[0].ID == lastMessageID && !includeLastMessage {
 				meta = meta[1:]
 			}
 
+			includeLastMessage = false
+
 			metadata = meta
 		} else {
-			meta, err := client.GetMessageMetadataPage(ctx, 0, m.pageSize, proton.MessageFilter{
-				Desc: true,
-			})
+			meta, err := client.GetMessageMetadataPage(ctx, 0, m.pageSize, apiFilter)
 			if err != nil {
 				errReporter.ReportStageError(err)
 				return
@@ -109,6 +198,36 @@ func (m *MetadataStage) Run(
 
 		lastMessageID = metadata[len(metadata)-1].ID
 
+		if m.collectIDs {
+			m.messageIDs = append(m.messageIDs, xslices.Map(metadata, func(t proton.MessageMetadata) string { return t.ID })...)
+		}
+
+		shardDone := false
+		if m.shard != nil {
+			metadata, shardDone = m.shard.clip(metadata)
+		}
+
+		pageIDs := xslices.Map(metadata, func(t proton.MessageMetadata) string { return t.ID })
+
+		if matches != nil {
+			pageLen := len(metadata)
+			metadata = xslices.Filter(metadata, func(t proton.MessageMetadata) bool { return matches(&t) })
+
+			if filtered := pageLen - len(metadata); filtered != 0 {
+				m.filteredCount.Add(uint64(filtered))
+				reporter.OnProgress(filtered)
+			}
+		}
+
+		if m.incremental != nil {
+			pageLen := len(metadata)
+			metadata = xslices.Filter(metadata, func(t proton.MessageMetadata) bool { return !m.incremental.isUpToDate(&t) })
+
+			if unchanged := pageLen - len(metadata); unchanged != 0 {
+				reporter.OnProgress(unchanged)
+			}
+		}
+
 		initialLen := len(metadata)
 		metadata = xslices.Filter(metadata, func(t proton.MessageMetadata) bool {
 			isPresent, err := mfc.HasMessage(t.ID)
@@ -124,17 +243,23 @@ func (m *MetadataStage) Run(
 			reporter.OnProgress(initialLen - len(metadata))
 		}
 
-		if len(metadata) == 0 {
-			continue
+		if m.checkpoint != nil {
+			m.checkpoint.listPage(lastMessageID, pageIDs, xslices.Map(metadata, func(t proton.MessageMetadata) string { return t.ID }))
 		}
 
 		for _, chunk := range xslices.Chunk(metadata, m.splitSize) {
 			select {
 			case <-ctx.Done():
 				return
+			case <-m.stop:
+				return
 			case m.outputCh <- chunk:
 			}
 		}
+
+		if shardDone {
+			return
+		}
 	}
 }
 
@@ -3,6 +3,7 @@ package mail
 import (
 	"context"
 	"fmt"
+	"net/mail"
 	"testing"
 
 	"github.com/ProtonMail/export-tool/internal/apiclient"
@@ -85,6 +86,78 @@ func TestMetadataStage_RunWithCached(t *testing.T) {
 	require.Equal(t, expectedFiltered, result)
 }
 
+func TestMetadataStage_RunShard(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+	errReporter := NewMockStageErrorReporter(mockCtrl)
+	fileChecker := NewMockMetadataFileChecker(mockCtrl)
+	reporter := NewMockReporter(mockCtrl)
+
+	const pageSize = 3
+
+	all := testMetadata(10)
+
+	client.EXPECT().GetMessageMetadataPage(gomock.Any(), gomock.Eq(0), gomock.Eq(pageSize), gomock.Eq(proton.MessageFilter{
+		EndID: all[3].ID,
+		Desc:  true,
+	})).Return(all[3:6], nil)
+	client.EXPECT().GetMessageMetadataPage(gomock.Any(), gomock.Eq(0), gomock.Eq(pageSize), gomock.Eq(proton.MessageFilter{
+		EndID: all[5].ID,
+		Desc:  true,
+	})).Return(all[5:8], nil)
+	fileChecker.EXPECT().HasMessage(gomock.Any()).AnyTimes().Return(false, nil)
+
+	metadata := NewMetadataStage(client, logrus.WithField("test", "test"), pageSize, 1)
+	metadata.SetShard(&ShardJob{Index: 1, Count: 3, Mode: ShardModeMessageID, FirstID: all[3].ID, LastID: all[6].ID})
+
+	go func() {
+		metadata.Run(context.Background(), errReporter, fileChecker, reporter)
+	}()
+
+	result := make([]proton.MessageMetadata, 0, 4)
+	for out := range metadata.outputCh {
+		result = append(result, out...)
+	}
+
+	require.Equal(t, all[3:7], result)
+}
+
+func TestMetadataStage_RunFilter(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+	errReporter := NewMockStageErrorReporter(mockCtrl)
+	fileChecker := NewMockMetadataFileChecker(mockCtrl)
+	reporter := NewMockReporter(mockCtrl)
+
+	const pageSize = 5
+
+	all := testMetadata(4)
+	all[0].Sender = &mail.Address{Address: "alice@examplecorp.com"}
+	all[1].Sender = &mail.Address{Address: "bob@other.com"}
+	all[2].Sender = &mail.Address{Address: "carol@other.com"}
+	all[2].CCList = []*mail.Address{{Address: "dave@EXAMPLECORP.com"}}
+	all[3].Sender = &mail.Address{Address: "erin@sub.examplecorp.com"}
+
+	encodeMetadataExpectations(client, all, pageSize)
+	fileChecker.EXPECT().HasMessage(gomock.Any()).AnyTimes().Return(false, nil)
+	reporter.EXPECT().OnProgress(gomock.Eq(2))
+
+	metadata := NewMetadataStage(client, logrus.WithField("test", "test"), pageSize, 1)
+	metadata.SetFilter(&Filter{Involving: []string{"@examplecorp.com"}})
+
+	go func() {
+		metadata.Run(context.Background(), errReporter, fileChecker, reporter)
+	}()
+
+	result := make([]proton.MessageMetadata, 0, 2)
+	for out := range metadata.outputCh {
+		result = append(result, out...)
+	}
+
+	require.Equal(t, []string{all[0].ID, all[2].ID}, xslices.Map(result, func(m proton.MessageMetadata) string { return m.ID }))
+	require.Equal(t, uint64(2), metadata.GetFilteredCount())
+}
+
 func testMetadata(count int) []proton.MessageMetadata {
 	result := make([]proton.MessageMetadata, count)
 
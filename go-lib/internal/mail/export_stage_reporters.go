@@ -17,6 +17,14 @@
 
 package mail
 
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+)
+
 type StageErrorReporter interface {
 	ReportStageError(err error)
 }
@@ -38,3 +46,88 @@ func (n NullProgressReporter) SetMessageTotal(_ uint64) {}
 func (n NullProgressReporter) SetMessageProcessed(_ uint64) {}
 
 func (n NullProgressReporter) OnProgress(_ int) {}
+
+// StageETAReporter can optionally be implemented by a StageProgressReporter to receive estimates of the time remaining
+// until the operation completes.
+type StageETAReporter interface {
+	OnETAUpdate(remaining time.Duration)
+}
+
+// StageHeartbeatReporter can optionally be implemented by a Reporter to receive a heartbeat every HeartbeatInterval
+// while the operation runs.
+type StageHeartbeatReporter interface {
+	OnHeartbeat(heartbeat Heartbeat)
+}
+
+// StageRateLimitReporter can optionally be implemented by a Reporter to be told when the Proton servers rate limit the
+// operation, and how long it waits before repeating the request. It is called from the goroutine of the request.
+type StageRateLimitReporter interface {
+	OnRateLimited(wait time.Duration)
+}
+
+// withRateLimitReporter returns ctx unchanged if the reporter doesn't implement StageRateLimitReporter.
+func withRateLimitReporter(ctx context.Context, reporter any) context.Context {
+	rateLimitReporter, ok := reporter.(StageRateLimitReporter)
+	if !ok {
+		return ctx
+	}
+
+	return apiclient.WithRateLimitObserver(ctx, rateLimitReporter.OnRateLimited)
+}
+
+// etaProgressReporter forwards progress to the wrapped reporter and recalibrates the estimated remaining time on
+// every update.
+type etaProgressReporter struct {
+	StageProgressReporter
+	etaReporter StageETAReporter
+	estimator   *etaEstimator
+}
+
+// newETAProgressReporter returns reporter unchanged if it doesn't implement StageETAReporter.
+func newETAProgressReporter(reporter StageProgressReporter, total uint64) StageProgressReporter {
+	etaReporter, ok := reporter.(StageETAReporter)
+	if !ok {
+		return reporter
+	}
+
+	return &etaProgressReporter{
+		StageProgressReporter: reporter,
+		etaReporter:           etaReporter,
+		estimator:             newETAEstimator(total, time.Now),
+	}
+}
+
+func (e *etaProgressReporter) OnProgress(delta int) {
+	e.StageProgressReporter.OnProgress(delta)
+
+	if remaining, ok := e.estimator.update(delta); ok {
+		e.etaReporter.OnETAUpdate(remaining)
+	}
+}
+
+// lockedProgressReporter serializes the progress reported by parallel workers.
+type lockedProgressReporter struct {
+	lock     sync.Mutex
+	reporter StageProgressReporter
+}
+
+func (l *lockedProgressReporter) SetMessageProcessed(total uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.reporter.SetMessageProcessed(total)
+}
+
+func (l *lockedProgressReporter) SetMessageTotal(total uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.reporter.SetMessageTotal(total)
+}
+
+func (l *lockedProgressReporter) OnProgress(delta int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.reporter.OnProgress(delta)
+}
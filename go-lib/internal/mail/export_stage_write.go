@@ -22,8 +22,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
 	"github.com/ProtonMail/export-tool/internal/utils"
 	"github.com/ProtonMail/gluon/async"
@@ -41,6 +43,22 @@ type WriteStage struct {
 	log              *logrus.Entry
 	progressReporter StageProgressReporter
 	parallelWriters  int
+	writtenCount     atomic.Uint64
+	writtenBytes     atomic.Uint64 // Metadata file sizes plus the message sizes reported by the API.
+	senders          *senderVerificationCollector
+	index            *messageIndexCollector
+
+	autoGeneratedMode  AutoGeneratedMode
+	autoGeneratedCount atomic.Uint64
+	excludedCount      atomic.Uint64
+
+	labelWriter labelFileWriter
+	files       *messageFiles
+	years       *yearDirs
+	incremental *incrementalTracker
+	checkpoint  *checkpointTracker
+	events      *EventBus
+	durable     bool
 }
 
 func NewWriteStage(
@@ -58,21 +76,126 @@ func NewWriteStage(
 		parallelWriters:  parallelWriters,
 		progressReporter: progressReporter,
 		log:              log.WithField("stage", "write"),
+		senders:          newSenderVerificationCollector(),
+		index:            newMessageIndexCollector(dirPath),
+		files:            newMessageFiles(tempPath),
 	}
 }
 
+func (w *WriteStage) SetAutoGeneratedMode(mode AutoGeneratedMode) {
+	w.autoGeneratedMode = mode
+}
+
+// setLabelFileWriter writes the messages with labelWriter instead of writing EML files. The messages that could not be
+// assembled are still written to a folder.
+func (w *WriteStage) setLabelFileWriter(labelWriter labelFileWriter) {
+	w.labelWriter = labelWriter
+}
+
+// setPathNamer shortens the names of the attachments that do not fit the path budget.
+func (w *WriteStage) setPathNamer(names *pathNamer) {
+	w.files.names = names
+}
+
+// setAtRestKey encrypts the message and metadata files, see ExportTask.SetAtRestEncryption.
+func (w *WriteStage) setAtRestKey(key *AtRestKey) {
+	w.files.atRest = key
+}
+
+// setIncrementalTracker records the written messages in the state of an incremental export.
+func (w *WriteStage) setYearDirs(years *yearDirs) {
+	w.years = years
+}
+
+func (w *WriteStage) setIncrementalTracker(incremental *incrementalTracker) {
+	w.incremental = incremental
+}
+
+// setCheckpointTracker records the written messages in the checkpoint of the export.
+func (w *WriteStage) setCheckpointTracker(checkpoint *checkpointTracker) {
+	w.checkpoint = checkpoint
+}
+
+// setEventBus publishes a MessageExportedEvent for each message written.
+func (w *WriteStage) setEventBus(events *EventBus) {
+	w.events = events
+}
+
+// setDurable flushes the written files to the disk before counting the messages as written, see ExportTask.SetDurable.
+func (w *WriteStage) setDurable(durable bool) {
+	w.durable = durable
+	w.files.sync = durable
+}
+
 func (w *WriteStage) Run(ctx context.Context, inputs <-chan BuildStageOutput, errReporter StageErrorReporter) {
 	w.log.Debug("Starting")
 	defer w.log.Debug("Exiting")
 
+	if w.labelWriter != nil {
+		defer func() {
+			if err := w.labelWriter.close(); err != nil {
+				errReporter.ReportStageError(err)
+			}
+		}()
+	}
+
+	// The year folders create their auto-generated folder when first written to.
+	if w.autoGeneratedMode == AutoGeneratedModeSeparate && w.years == nil {
+		if err := os.MkdirAll(filepath.Join(w.dirPath, getAutoGeneratedDirName()), 0o700); err != nil {
+			errReporter.ReportStageError(fmt.Errorf("failed to create auto-generated mail directory: %w", err))
+			return
+		}
+	}
+
+	// When durable, the messages are only counted as written once their files are on the disk, see syncQueue.
+	var queue *syncQueue
+	if w.durable {
+		queue = newSyncQueue(WriteSyncQueueSize, WriteSyncBatchSize, w.log, w.panicHandler)
+		defer func() {
+			if err := queue.close(); err != nil {
+				errReporter.ReportStageError(err)
+			}
+		}()
+	}
+
 	for input := range inputs {
 		if ctx.Err() != nil {
 			return
 		}
 
-		if err := parallel.DoContext(ctx, w.parallelWriters, len(input.messages), func(_ context.Context, i int) error {
+		if err := parallel.DoContext(ctx, w.parallelWriters, len(input.messages), func(ctx context.Context, i int) error {
 			metadata := input.messages[i].GetMetadata()
-			metadataPath := filepath.Join(w.dirPath, getMetadataFileName(metadata.ID))
+
+			dirPath := w.dirPath
+			if w.years != nil {
+				yearDir, err := w.years.getDir(metadata.Time)
+				if err != nil {
+					return err
+				}
+
+				dirPath = yearDir
+			}
+
+			if metadata.AutoGenerated != nil {
+				w.autoGeneratedCount.Add(1)
+
+				switch w.autoGeneratedMode {
+				case AutoGeneratedModeExclude:
+					w.excludedCount.Add(1)
+					if w.incremental != nil {
+						w.incremental.markWritten(&metadata.MessageMetadata)
+					}
+					if w.checkpoint != nil {
+						w.checkpoint.markProcessed(metadata.ID)
+					}
+					return nil
+				case AutoGeneratedModeSeparate:
+					dirPath = filepath.Join(dirPath, getAutoGeneratedDirName())
+				case AutoGeneratedModeInclude:
+				}
+			}
+
+			metadataPath := filepath.Join(dirPath, getMetadataFileName(metadata.ID))
 
 			integrityChecker := &utils.Sha256IntegrityChecker{}
 
@@ -82,12 +205,62 @@ func (w *WriteStage) Run(ctx context.Context, inputs <-chan BuildStageOutput, er
 				return fmt.Errorf("failed to generate message metadata: %w", err)
 			}
 
-			if err := utils.WriteFileSafe(w.tempPath, metadataPath, metadataBytes, integrityChecker); err != nil {
-				w.log.WithField("msg-id", metadata.ID).WithError(err).Errorf("Failed to write %v", metadataPath)
-				return fmt.Errorf("failed to write '%v': %w", metadata, err)
+			built, isBuilt := input.messages[i].(*DecryptedAndBuiltMessageWriter)
+
+			// The pack and archive writers store the metadata after the message.
+			if _, isBundled := w.labelWriter.(bundleWriter); !isBundled || !isBuilt {
+				if err := w.files.write(metadataPath, metadataBytes, integrityChecker); err != nil {
+					w.log.WithField("msg-id", metadata.ID).WithError(err).Errorf("Failed to write %v", metadataPath)
+					return fmt.Errorf("failed to write '%v': %w", metadata, err)
+				}
+
+				// An immediate cancellation does not wait for the message to be written, the metadata file is rolled
+				// back so that the export does not contain a message without its content.
+				if err := ctx.Err(); err != nil {
+					if err := os.Remove(w.files.getPath(metadataPath)); err != nil {
+						w.log.WithField("msg-id", metadata.ID).WithError(err).Error("Failed to roll back metadata file")
+					}
+
+					return err
+				}
+			}
+
+			if isBuilt && w.labelWriter != nil {
+				if err := w.labelWriter.write(dirPath, &metadata, built.eml.Bytes()); err != nil {
+					w.log.WithField("msg-id", metadata.ID).WithError(err).Error("Failed to write message")
+					return err
+				}
+			} else if err := input.messages[i].WriteMessage(dirPath, w.files, w.log, integrityChecker); err != nil {
+				return err
+			}
+
+			paths, err := w.getWrittenPaths(dirPath, &metadata, input.messages[i])
+			if err != nil {
+				return err
+			}
+
+			onWritten := func() {
+				if w.incremental != nil {
+					w.incremental.markWritten(&metadata.MessageMetadata)
+				}
+
+				if w.checkpoint != nil {
+					w.checkpoint.markProcessed(metadata.ID)
+				}
+
+				w.writtenCount.Add(1)
+				w.writtenBytes.Add(uint64(len(metadataBytes)) + uint64(metadata.Size))
+				w.senders.add(&metadata)
+				w.index.add(&metadata, paths)
+				w.events.Publish(MessageExportedEvent{MessageID: metadata.ID, Paths: paths, Size: uint64(metadata.Size)})
+			}
+
+			if queue == nil {
+				onWritten()
+				return nil
 			}
 
-			return input.messages[i].WriteMessage(w.dirPath, w.tempPath, w.log, integrityChecker)
+			return queue.push(ctx, syncItem{paths: paths, onSynced: onWritten})
 		}); err != nil {
 			errReporter.ReportStageError(err)
 			return
@@ -97,12 +270,121 @@ func (w *WriteStage) Run(ctx context.Context, inputs <-chan BuildStageOutput, er
 	}
 }
 
+// getWrittenPaths returns the files written for a message in dirPath.
+func (w *WriteStage) getWrittenPaths(dirPath string, metadata *MessageMetadata, writer MessageWriter) ([]string, error) {
+	paths := []string{w.files.getPath(filepath.Join(dirPath, getMetadataFileName(metadata.ID)))}
+
+	if _, ok := writer.(*DecryptedAndBuiltMessageWriter); ok {
+		if bundle, ok := w.labelWriter.(bundleWriter); ok {
+			bundlePath, ok := bundle.takeBundlePath(metadata.ID)
+			if !ok {
+				return nil, fmt.Errorf("message %v was not written to a pack or archive", metadata.ID)
+			}
+
+			return []string{bundlePath}, nil
+		}
+
+		if w.labelWriter == nil {
+			return append(paths, w.files.getPath(filepath.Join(dirPath, getEMLFileName(metadata.ID)))), nil
+		}
+
+		for _, path := range w.labelWriter.getFilePaths(&metadata.MessageMetadata) {
+			paths = append(paths, filepath.Join(dirPath, filepath.FromSlash(path)))
+		}
+
+		return paths, nil
+	}
+
+	// The other writers write the parts of the message in a folder named after its ID.
+	exportDir := filepath.Join(dirPath, metadata.ID)
+
+	entries, err := os.ReadDir(exportDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list '%v': %w", exportDir, err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			paths = append(paths, filepath.Join(exportDir, entry.Name()))
+		}
+	}
+
+	return paths, nil
+}
+
+func (w *WriteStage) GetWrittenCount() uint64 {
+	return w.writtenCount.Load()
+}
+
+func (w *WriteStage) GetWrittenBytes() uint64 {
+	return w.writtenBytes.Load()
+}
+
+// GetAutoGeneratedCount returns the number of auto-generated messages, whether they were written or not.
+func (w *WriteStage) GetAutoGeneratedCount() uint64 {
+	return w.autoGeneratedCount.Load()
+}
+
+// GetExcludedCount returns the number of messages that were not written because of the AutoGeneratedMode.
+func (w *WriteStage) GetExcludedCount() uint64 {
+	return w.excludedCount.Load()
+}
+
+// WriteSenderVerificationReport writes the aggregated sender verification result of the written messages. The report
+// lists the addresses of the senders, it is encrypted when the export is encrypted at rest.
+func (w *WriteStage) WriteSenderVerificationReport() (SenderVerificationReport, error) {
+	report := w.senders.get()
+
+	data, err := utils.GenerateVersionedJSON(SenderVerificationReportVersion, report)
+	if err != nil {
+		return report, fmt.Errorf("failed to json encode sender verification report: %w", err)
+	}
+
+	path := filepath.Join(w.dirPath, getSenderVerificationFileName())
+	if w.files.atRest != nil {
+		path += sealedExtension
+		err = utils.WriteFileSealed(w.tempPath, path, data, w.files.atRest.seal, true, true)
+	} else {
+		err = utils.WriteFileSafe(w.tempPath, path, data, &utils.Sha256IntegrityChecker{})
+	}
+
+	if err != nil {
+		return report, fmt.Errorf("failed to write '%v': %w", path, err)
+	}
+
+	return report, nil
+}
+
+// WriteMessageIndex writes the index of the exported messages and returns the number of indexed messages. Nothing is
+// written when the export is encrypted at rest.
+func (w *WriteStage) WriteMessageIndex() (int, error) {
+	if w.files.atRest != nil {
+		return 0, nil
+	}
+
+	// The index falls back to the system label names without the labels file.
+	labels, err := readExportLabels(w.dirPath)
+	if err != nil {
+		w.log.WithError(err).Warn("Failed to read labels for the message index")
+	}
+
+	return w.index.write(w.tempPath, labels)
+}
+
 type MessageMetadata struct {
 	proton.MessageMetadata
 	Attachments []proton.Attachment
 	MIMEType    rfc822.MIMEType
 	Headers     string
 	WriterType  MessageWriterType
+
+	SenderVerification *SenderVerification `json:",omitempty"`
+	Integrity          *MessageIntegrity   `json:",omitempty"`
+	AutoGenerated      *AutoGenerated      `json:",omitempty"`
+	Quarantine         *Quarantine         `json:",omitempty"` // The build of the message crashed, see QuarantinedMessageWriter.
+	Notes              []MessageNote       `json:",omitempty"` // Added offline, see AnnotateExport.
+	Language           string              `json:",omitempty"` // ISO 639-1 code, when detected during the export, see DetectLanguage.
+	Snippet            string              `json:",omitempty"` // Start of the decrypted body as plain text, see getSnippet.
 }
 
 func NewMessageMetadata(writerType MessageWriterType, msg *proton.Message) MessageMetadata {
@@ -112,6 +394,9 @@ func NewMessageMetadata(writerType MessageWriterType, msg *proton.Message) Messa
 		Attachments:     msg.Attachments,
 		MIMEType:        msg.MIMEType,
 		WriterType:      writerType,
+
+		SenderVerification: newSenderVerification(msg.Flags),
+		AutoGenerated:      classifyAutoGenerated(msg.Header),
 	}
 }
 
@@ -127,23 +412,71 @@ const (
 	MessageWriterTypeDecryptedAndBuilt MessageWriterType = iota
 	MessageWriterTypeFailedToAssemble
 	MessageWriterTypeNoAddrKey
+	MessageWriterTypeQuarantined
 )
 
+// messageFiles writes the files of the messages. The names that do not fit the path budget are shortened, and the files
+// are encrypted when the export is encrypted at rest.
+type messageFiles struct {
+	tempDir string
+	names   *pathNamer
+	atRest  *AtRestKey
+	sync    bool // Flush each file to the disk before moving it in place, see WriteStage.setDurable.
+}
+
+func newMessageFiles(tempDir string) *messageFiles {
+	return &messageFiles{tempDir: tempDir}
+}
+
+// getPath returns the path of the file written for path.
+func (f *messageFiles) getPath(path string) string {
+	if f.atRest == nil {
+		return path
+	}
+
+	return path + sealedExtension
+}
+
+// fitName shortens the name of a file of dir if it does not fit the path budget. The extension is kept.
+func (f *messageFiles) fitName(dir, name string) string {
+	var reserve int
+	if f.atRest != nil {
+		reserve = len(sealedExtension)
+	}
+
+	return f.names.fitName(dir, name, reserve, true)
+}
+
+func (f *messageFiles) write(path string, data []byte, integrityChecker utils.IntegrityChecker) error {
+	if f.atRest != nil {
+		return utils.WriteFileSealed(f.tempDir, f.getPath(path), data, f.atRest.seal, integrityChecker != nil, f.sync)
+	}
+
+	if f.sync {
+		return utils.WriteFileSafe(f.tempDir, path, data, integrityChecker)
+	}
+
+	return utils.WriteFileSafeUnsynced(f.tempDir, path, data, integrityChecker)
+}
+
 type MessageWriter interface {
-	WriteMessage(dir string, tempDir string, log *logrus.Entry, checker utils.IntegrityChecker) error
+	WriteMessage(dir string, files *messageFiles, log *logrus.Entry, checker utils.IntegrityChecker) error
 	GetMetadata() MessageMetadata
 }
 
 type DecryptedAndBuiltMessageWriter struct {
-	msg proton.FullMessage
-	eml bytes.Buffer
+	msg       proton.FullMessage
+	eml       bytes.Buffer
+	integrity *MessageIntegrity
+	language  string
+	snippet   string
 }
 
-func (d *DecryptedAndBuiltMessageWriter) WriteMessage(dir string, tempDir string, log *logrus.Entry, integrityChecker utils.IntegrityChecker) error {
+func (d *DecryptedAndBuiltMessageWriter) WriteMessage(dir string, files *messageFiles, log *logrus.Entry, integrityChecker utils.IntegrityChecker) error {
 	filePath := filepath.Join(dir, d.msg.ID)
 	filePath += emlExtension
 
-	if err := utils.WriteFileSafe(tempDir, filePath, d.eml.Bytes(), integrityChecker); err != nil {
+	if err := files.write(filePath, d.eml.Bytes(), integrityChecker); err != nil {
 		log.WithField("msg-id", d.msg.ID).WithError(err).Errorf("Failed to write file %v", filePath)
 		return fmt.Errorf("failed to write metadata '%v': %w", filePath, err)
 	}
@@ -152,14 +485,22 @@ func (d *DecryptedAndBuiltMessageWriter) WriteMessage(dir string, tempDir string
 }
 
 func (d *DecryptedAndBuiltMessageWriter) GetMetadata() MessageMetadata {
-	return NewMessageMetadata(MessageWriterTypeDecryptedAndBuilt, &d.msg.Message)
+	metadata := NewMessageMetadata(MessageWriterTypeDecryptedAndBuilt, &d.msg.Message)
+	metadata.Integrity = d.integrity
+	metadata.Language = d.language
+	metadata.Snippet = d.snippet
+
+	return metadata
 }
 
 type AssembleFailedMessageWriter struct {
 	decrypted message.DecryptedMessage
+	integrity *MessageIntegrity
+	language  string
+	snippet   string
 }
 
-func (a *AssembleFailedMessageWriter) WriteMessage(dir string, tempDir string, log *logrus.Entry, integrityChecker utils.IntegrityChecker) error {
+func (a *AssembleFailedMessageWriter) WriteMessage(dir string, files *messageFiles, log *logrus.Entry, integrityChecker utils.IntegrityChecker) error {
 	// Failed to assemble message, write body and attachments in a folder with the message id.
 	exportDir := filepath.Join(dir, a.decrypted.Msg.ID)
 	var bodyPath string
@@ -178,7 +519,7 @@ func (a *AssembleFailedMessageWriter) WriteMessage(dir string, tempDir string, l
 		bodyPath = filepath.Join(exportDir, bodyFileNameEncrypted())
 	}
 
-	if err := utils.WriteFileSafe(tempDir, bodyPath, bodyBytes, integrityChecker); err != nil {
+	if err := files.write(bodyPath, bodyBytes, integrityChecker); err != nil {
 		log.WithField("msg-id", a.decrypted.Msg.ID).WithError(err).Errorf("Failed to write %v", bodyPath)
 		return fmt.Errorf("failed to write '%v': %w", bodyPath, err)
 	}
@@ -191,13 +532,13 @@ func (a *AssembleFailedMessageWriter) WriteMessage(dir string, tempDir string, l
 		var attBytes []byte
 		if attachment.Err == nil {
 			attBytes = attachment.Data.Bytes()
-			attachmentPath = filepath.Join(exportDir, attachmentFileName(attachmentInfo.ID, attachmentInfo.Name))
+			attachmentPath = filepath.Join(exportDir, files.fitName(exportDir, attachmentFileName(attachmentInfo.ID, attachmentInfo.Name)))
 		} else {
 			attBytes = attachment.Encrypted
-			attachmentPath = filepath.Join(exportDir, attachmentFileNameEncrypted(attachmentInfo.ID, attachmentInfo.Name))
+			attachmentPath = filepath.Join(exportDir, files.fitName(exportDir, attachmentFileNameEncrypted(attachmentInfo.ID, attachmentInfo.Name)))
 		}
 
-		if err := utils.WriteFileSafe(tempDir, attachmentPath, attBytes, integrityChecker); err != nil {
+		if err := files.write(attachmentPath, attBytes, integrityChecker); err != nil {
 			log.WithField("msg-id", a.decrypted.Msg.ID).WithField("attID", attachmentInfo.ID).WithError(err).Errorf("Failed to write %v", attachmentPath)
 			return fmt.Errorf("failed to write '%v': %w", attachmentPath, err)
 		}
@@ -207,18 +548,27 @@ func (a *AssembleFailedMessageWriter) WriteMessage(dir string, tempDir string, l
 }
 
 func (a *AssembleFailedMessageWriter) GetMetadata() MessageMetadata {
-	return NewMessageMetadata(MessageWriterTypeFailedToAssemble, &a.decrypted.Msg)
+	metadata := NewMessageMetadata(MessageWriterTypeFailedToAssemble, &a.decrypted.Msg)
+	metadata.Integrity = a.integrity
+	metadata.Language = a.language
+	metadata.Snippet = a.snippet
+
+	return metadata
 }
 
 type AddrKeyRingMissingMessageWriter struct {
-	msg proton.FullMessage
+	msg       proton.FullMessage
+	integrity *MessageIntegrity
 }
 
 func (a *AddrKeyRingMissingMessageWriter) GetMetadata() MessageMetadata {
-	return NewMessageMetadata(MessageWriterTypeNoAddrKey, &a.msg.Message)
+	metadata := NewMessageMetadata(MessageWriterTypeNoAddrKey, &a.msg.Message)
+	metadata.Integrity = a.integrity
+
+	return metadata
 }
 
-func (a *AddrKeyRingMissingMessageWriter) WriteMessage(dir string, tempDir string, log *logrus.Entry, integrityChecker utils.IntegrityChecker) error {
+func (a *AddrKeyRingMissingMessageWriter) WriteMessage(dir string, files *messageFiles, log *logrus.Entry, integrityChecker utils.IntegrityChecker) error {
 	// Failed decrypt due to lack of addr keyring. Write everything as pgp files to disk.
 	exportDir := filepath.Join(dir, a.msg.ID)
 
@@ -229,16 +579,16 @@ func (a *AddrKeyRingMissingMessageWriter) WriteMessage(dir string, tempDir strin
 	// write body.
 	bodyPath := filepath.Join(exportDir, bodyFileNameEncrypted())
 
-	if err := utils.WriteFileSafe(tempDir, bodyPath, []byte(a.msg.Body), integrityChecker); err != nil {
+	if err := files.write(bodyPath, []byte(a.msg.Body), integrityChecker); err != nil {
 		log.WithField("msg-id", a.msg.ID).WithError(err).Errorf("Failed to write %v", bodyPath)
 		return fmt.Errorf("failed to write '%v': %w", bodyPath, err)
 	}
 
 	// Write attachments.
 	for idx, attachment := range a.msg.Attachments {
-		attachmentPath := filepath.Join(exportDir, attachmentFileNameEncrypted(attachment.ID, attachment.Name))
+		attachmentPath := filepath.Join(exportDir, files.fitName(exportDir, attachmentFileNameEncrypted(attachment.ID, attachment.Name)))
 
-		if err := utils.WriteFileSafe(tempDir, attachmentPath, a.msg.AttData[idx], integrityChecker); err != nil {
+		if err := files.write(attachmentPath, a.msg.AttData[idx], integrityChecker); err != nil {
 			log.WithField("msg-id", a.msg.ID).WithField("attID", attachment.ID).WithError(err).Errorf("Failed to write %v", attachmentPath)
 			return fmt.Errorf("failed to write '%v': %w", attachmentPath, err)
 		}
@@ -247,12 +597,14 @@ func (a *AddrKeyRingMissingMessageWriter) WriteMessage(dir string, tempDir strin
 	return nil
 }
 
+// attachmentFileName derives the file name of an attachment from its name chosen by the sender, which can contain path
+// separators or bidirectional formatting characters. The original name is kept in the metadata.
 func attachmentFileName(id, name string) string {
-	return fmt.Sprintf("%v_%v", id, name)
+	return utils.SafeFileName(fmt.Sprintf("%v_%v", id, name))
 }
 
 func attachmentFileNameEncrypted(id, name string) string {
-	return fmt.Sprintf("%v_%v.pgp", id, name)
+	return attachmentFileName(id, name) + ".pgp"
 }
 
 func bodyFileName() string {
@@ -285,6 +637,28 @@ func loadMetadataFile(metadataFilePath string) (MessageMetadata, error) {
 		return MessageMetadata{}, fmt.Errorf("failed to read metada file: %w", err)
 	}
 
+	return parseMetadataFile(b)
+}
+
+// loadMetadataFileFS is loadMetadataFile for backups read from an archive.
+func loadMetadataFileFS(fsys fs.FS, metadataFilePath string) (MessageMetadata, error) {
+	b, err := fs.ReadFile(fsys, metadataFilePath)
+	if err != nil {
+		return MessageMetadata{}, fmt.Errorf("failed to read metada file: %w", err)
+	}
+
+	return parseMetadataFile(b)
+}
+
+// parseMetadataFile parses the content of a metadata file. A crash of the parser on a malformed file is returned as an
+// error so that the message is skipped rather than aborting the restore.
+func parseMetadataFile(b []byte) (metadata MessageMetadata, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			metadata, err = MessageMetadata{}, fmt.Errorf("metadata %w: %v", errParserCrashed, r)
+		}
+	}()
+
 	m, err := utils.NewVersionedJSON[MessageMetadata](MessageMetadataVersion, b)
 	if err != nil {
 		return MessageMetadata{}, fmt.Errorf("failed to parse metadata file: %w", err)
@@ -0,0 +1,204 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/gluon/async"
+	"github.com/sirupsen/logrus"
+)
+
+// SetDurable flushes every file of the export to the disk before counting its message as exported, so that a power
+// failure cannot leave a truncated message behind an export or checkpoint that lists it. It is disabled by default:
+// flushing the files multiplies the export time on HDDs and network shares.
+func (e *ExportTask) SetDurable(durable bool) {
+	e.durable = durable
+}
+
+func (e *ExportTask) GetDurable() bool {
+	return e.durable
+}
+
+// WriteSyncBatchSize is the maximum number of messages whose files are flushed to the disk together.
+const WriteSyncBatchSize = 256
+
+// WriteSyncQueueSize is the number of written messages that can wait for their files to be flushed before the writers
+// block.
+const WriteSyncQueueSize = 2 * WriteSyncBatchSize
+
+// syncItem holds the files of a written message. onSynced is called once they and their directories are on the disk.
+type syncItem struct {
+	paths    []string
+	onSynced func()
+}
+
+// syncQueue flushes the files written by a durable export to the disk on a background goroutine, see
+// ExportTask.SetDurable. The files written through messageFiles are already flushed before they are moved in place,
+// the queue flushes the files appended to by the label writers, e.g. mbox files, and the directories. The files of all
+// the messages waiting in the queue are flushed together and each directory only once per batch. The queue is
+// bounded: when the disk can't keep up the writers block, which in turn blocks the build stage.
+type syncQueue struct {
+	items     chan syncItem
+	done      chan struct{}
+	batchSize int
+	log       *logrus.Entry
+
+	lock sync.Mutex
+	err  error
+}
+
+func newSyncQueue(queueSize, batchSize int, log *logrus.Entry, panicHandler async.PanicHandler) *syncQueue {
+	q := &syncQueue{
+		items:     make(chan syncItem, queueSize),
+		done:      make(chan struct{}),
+		batchSize: batchSize,
+		log:       log,
+	}
+
+	go func() {
+		defer async.HandlePanic(panicHandler)
+		defer close(q.done)
+
+		q.run()
+	}()
+
+	return q
+}
+
+// push queues the files of a message, waiting while the queue is full.
+func (q *syncQueue) push(ctx context.Context, item syncItem) error {
+	if err := q.getErr(); err != nil {
+		return err
+	}
+
+	select {
+	case q.items <- item:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close flushes the queued files and returns the first error met. The callbacks of the messages whose files could not
+// be flushed are not called.
+func (q *syncQueue) close() error {
+	close(q.items)
+	<-q.done
+
+	return q.getErr()
+}
+
+func (q *syncQueue) run() {
+	batch := make([]syncItem, 0, q.batchSize)
+
+	for item := range q.items {
+		batch = append(batch[:0], item)
+
+		// Only the messages already waiting are added, a batch is not held back to wait for more.
+	drain:
+		for len(batch) < q.batchSize {
+			select {
+			case item, ok := <-q.items:
+				if !ok {
+					break drain
+				}
+
+				batch = append(batch, item)
+			default:
+				break drain
+			}
+		}
+
+		q.flush(batch)
+	}
+}
+
+func (q *syncQueue) flush(batch []syncItem) {
+	// After an error the queue is still drained so that the writers don't block.
+	if q.getErr() != nil {
+		return
+	}
+
+	if err := syncFiles(batch); err != nil {
+		q.log.WithError(err).Error("Failed to flush written files")
+		q.setErr(err)
+
+		return
+	}
+
+	for _, item := range batch {
+		if item.onSynced != nil {
+			item.onSynced()
+		}
+	}
+}
+
+// syncFiles flushes the files of the batch, then their directories.
+func syncFiles(batch []syncItem) error {
+	synced := make(map[string]bool)
+
+	var dirs []string
+
+	for _, item := range batch {
+		for _, path := range item.paths {
+			if synced[path] {
+				continue
+			}
+
+			if err := utils.SyncFile(path); err != nil {
+				return fmt.Errorf("failed to flush '%v': %w", path, err)
+			}
+
+			synced[path] = true
+
+			if dir := filepath.Dir(path); !synced[dir] {
+				synced[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+
+	for _, dir := range dirs {
+		if err := utils.SyncDir(dir); err != nil {
+			return fmt.Errorf("failed to flush '%v': %w", dir, err)
+		}
+	}
+
+	return nil
+}
+
+func (q *syncQueue) getErr() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.err
+}
+
+func (q *syncQueue) setErr(err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.err == nil {
+		q.err = err
+	}
+}
@@ -19,16 +19,19 @@ package mail
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/gluon/async"
 	"github.com/ProtonMail/go-proton-api"
 	"github.com/ProtonMail/proton-bridge/v3/pkg/message"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
 )
 
 func TestAddrKeyRingMissingMessageWriter(t *testing.T) {
@@ -65,7 +68,7 @@ func TestAddrKeyRingMissingMessageWriter(t *testing.T) {
 	tmpDir := t.TempDir()
 
 	checker := &utils.Sha256IntegrityChecker{}
-	require.NoError(t, writer.WriteMessage(writeDir, tmpDir, logrus.WithField("t", "t"), checker))
+	require.NoError(t, writer.WriteMessage(writeDir, newMessageFiles(tmpDir), logrus.WithField("t", "t"), checker))
 
 	{
 		data, err := os.ReadFile(filepath.Join(writeDir, msg.ID, attachmentFileNameEncrypted(attID, "foo")))
@@ -129,7 +132,7 @@ func TestAssembleFailedMessageWriter_NotDecrypted(t *testing.T) {
 	tmpDir := t.TempDir()
 
 	checker := &utils.Sha256IntegrityChecker{}
-	require.NoError(t, writer.WriteMessage(writeDir, tmpDir, logrus.WithField("t", "t"), checker))
+	require.NoError(t, writer.WriteMessage(writeDir, newMessageFiles(tmpDir), logrus.WithField("t", "t"), checker))
 
 	{
 		data, err := os.ReadFile(filepath.Join(writeDir, msg.ID, attachmentFileNameEncrypted(attID, "foo")))
@@ -193,7 +196,7 @@ func TestAssembleFailedMessageWriter_AllDecrypted(t *testing.T) {
 	tmpDir := t.TempDir()
 
 	checker := &utils.Sha256IntegrityChecker{}
-	require.NoError(t, writer.WriteMessage(writeDir, tmpDir, logrus.WithField("t", "t"), checker))
+	require.NoError(t, writer.WriteMessage(writeDir, newMessageFiles(tmpDir), logrus.WithField("t", "t"), checker))
 
 	{
 		data, err := os.ReadFile(filepath.Join(writeDir, msg.ID, attachmentFileName(attID, "foo")))
@@ -208,6 +211,46 @@ func TestAssembleFailedMessageWriter_AllDecrypted(t *testing.T) {
 	}
 }
 
+func TestAssembleFailedMessageWriter_UnsafeAttachmentNames(t *testing.T) {
+	msg := proton.Message{
+		MessageMetadata: proton.MessageMetadata{ID: "msg_id"},
+		Attachments: []proton.Attachment{
+			{ID: "att1", Name: "../../escape.txt"},
+			{ID: "att2", Name: "invoice\u202Efdp.exe"},
+			{ID: "att3", Name: "🚀 launch: plan?.pdf"},
+		},
+	}
+
+	writer := AssembleFailedMessageWriter{decrypted: message.DecryptedMessage{Msg: msg}}
+	for range msg.Attachments {
+		writer.decrypted.Attachments = append(writer.decrypted.Attachments, message.DecryptedAttachment{})
+	}
+
+	writeDir := t.TempDir()
+
+	checker := &utils.Sha256IntegrityChecker{}
+	require.NoError(t, writer.WriteMessage(writeDir, newMessageFiles(t.TempDir()), logrus.WithField("t", "t"), checker))
+
+	entries, err := os.ReadDir(writeDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	entries, err = os.ReadDir(filepath.Join(writeDir, msg.ID))
+	require.NoError(t, err)
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	require.ElementsMatch(t, []string{
+		"att1_.._.._escape.txt",
+		"att2_invoice_fdp.exe",
+		"att3_🚀 launch_ plan_.pdf",
+		bodyFileName(),
+	}, names)
+}
+
 func TestFileMetadataFileChecker_HasMessage_MetadataMissing(t *testing.T) {
 	const messageID = "msg-1"
 	dir := t.TempDir()
@@ -359,6 +402,77 @@ func writeTestMetadata(t *testing.T, metadata MessageMetadata, path string) {
 	require.NoError(t, os.WriteFile(path, b, 0o600))
 }
 
+func TestSyncQueue(t *testing.T) {
+	dir := t.TempDir()
+
+	queue := newSyncQueue(4, 3, logrus.WithField("t", "t"), &async.NoopPanicHandler{})
+
+	var synced []int
+
+	for i := 0; i < 10; i++ {
+		i := i
+		path := filepath.Join(dir, fmt.Sprintf("%v.eml", i))
+		require.NoError(t, os.WriteFile(path, []byte("message"), 0o600))
+
+		// The same file may be written by several messages, e.g. an mbox file.
+		paths := []string{path, filepath.Join(dir, "shared")}
+		require.NoError(t, os.WriteFile(paths[1], []byte("shared"), 0o600))
+
+		require.NoError(t, queue.push(context.Background(), syncItem{paths: paths, onSynced: func() { synced = append(synced, i) }}))
+	}
+
+	require.NoError(t, queue.close())
+	require.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, synced)
+}
+
+func TestWriteStage_Durable(t *testing.T) {
+	for _, durable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("durable=%v", durable), func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			reporter := NewMockReporter(mockCtrl)
+			reporter.EXPECT().OnProgress(1)
+
+			dir := t.TempDir()
+			stage := NewWriteStage(t.TempDir(), dir, 2, logrus.WithField("test", "test"), reporter, &async.NoopPanicHandler{})
+			stage.setDurable(durable)
+
+			inputs := make(chan BuildStageOutput, 1)
+			inputs <- BuildStageOutput{messages: []MessageWriter{&DecryptedAndBuiltMessageWriter{
+				msg: proton.FullMessage{Message: proton.Message{MessageMetadata: proton.MessageMetadata{ID: "msg"}}},
+				eml: *bytes.NewBufferString("Subject: test\r\n\r\n"),
+			}}}
+			close(inputs)
+
+			stage.Run(context.Background(), inputs, NewMockStageErrorReporter(mockCtrl))
+
+			require.Equal(t, uint64(1), stage.GetWrittenCount())
+			require.FileExists(t, filepath.Join(dir, getMetadataFileName("msg")))
+			require.FileExists(t, filepath.Join(dir, "msg"+emlExtension))
+		})
+	}
+}
+
+func TestSyncQueue_Error(t *testing.T) {
+	dir := t.TempDir()
+
+	queue := newSyncQueue(4, 3, logrus.WithField("t", "t"), &async.NoopPanicHandler{})
+
+	var synced int
+
+	require.NoError(t, queue.push(context.Background(), syncItem{
+		paths:    []string{filepath.Join(dir, "missing.eml")},
+		onSynced: func() { synced++ },
+	}))
+
+	require.Error(t, queue.close())
+	require.Zero(t, synced)
+
+	queue = newSyncQueue(1, 1, logrus.WithField("t", "t"), &async.NoopPanicHandler{})
+	queue.setErr(os.ErrNotExist)
+	require.ErrorIs(t, queue.push(context.Background(), syncItem{}), os.ErrNotExist)
+	require.ErrorIs(t, queue.close(), os.ErrNotExist)
+}
+
 func getTestMessageMetadata() MessageMetadata {
 	return MessageMetadata{
 		MessageMetadata: proton.MessageMetadata{},
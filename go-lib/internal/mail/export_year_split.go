@@ -0,0 +1,248 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+)
+
+// Year split
+// ----------
+// With SetSplitByYear, the messages are written to a sub folder per calendar year of their date, in UTC:
+//
+// <export>
+//  |- labels.json
+//  |- 2023
+//  |   |- labels.json
+//  |   |- year.json
+//  |   |- msg-id.eml
+//  |   |- msg-id.metadata.json
+//  |- 2024
+//      |- ...
+//
+// Each year folder is a backup of its own which is restored separately, and the archive formats write one archive per
+// year. The manifest of a year tells whether the year had ended when the folder was last written to: such a folder
+// only changes again if older messages are added to the account, so it can be moved to cold storage while the next
+// runs of an incremental export keep updating the current year.
+
+var ErrSplitByYearNotSupported = errors.New("exports split by year do not support shards")
+var ErrSplitByYearBackup = errors.New("the backup is split by year, restore the folder of each year separately")
+
+const YearManifestVersion = 1
+
+// yearDirNameBytes is the length of the name of a year folder and its separator.
+const yearDirNameBytes = len("0000/")
+
+func getYearManifestFileName() string {
+	return "year.json"
+}
+
+func getYearDirName(year int) string {
+	return strconv.Itoa(year)
+}
+
+// YearManifest describes the messages of a year folder.
+type YearManifest struct {
+	Year         int
+	MessageCount int       // Messages in the folder, those of its auto-generated sub folder included.
+	Closed       bool      // Whether the year had ended when the folder was last written to.
+	UpdatedAt    time.Time // Last export run that wrote to the folder.
+}
+
+func LoadYearManifest(yearDir string) (YearManifest, error) {
+	b, err := os.ReadFile(filepath.Join(yearDir, getYearManifestFileName())) //nolint:gosec
+	if err != nil {
+		return YearManifest{}, fmt.Errorf("failed to read year manifest: %w", err)
+	}
+
+	manifest, err := utils.NewVersionedJSON[YearManifest](YearManifestVersion, b)
+	if err != nil {
+		return YearManifest{}, fmt.Errorf("failed to parse year manifest: %w", err)
+	}
+
+	return manifest.Payload, nil
+}
+
+// SetSplitByYear writes the messages to one sub folder per year, see YearManifest.
+func (e *ExportTask) SetSplitByYear(enabled bool) {
+	e.splitByYear = enabled
+}
+
+func (e *ExportTask) GetSplitByYear() bool {
+	return e.splitByYear
+}
+
+// yearDirs creates the year folders as the messages are written to them. It is safe for concurrent use.
+type yearDirs struct {
+	root          string
+	autoGenerated bool // Whether the auto-generated sub folder is created in each year folder.
+
+	lock  sync.Mutex
+	years map[int]struct{}
+}
+
+func newYearDirs(root string, autoGenerated bool) *yearDirs {
+	return &yearDirs{root: root, autoGenerated: autoGenerated, years: make(map[int]struct{})}
+}
+
+// getDir returns the folder of the messages dated timestamp.
+func (y *yearDirs) getDir(timestamp int64) (string, error) {
+	year := time.Unix(timestamp, 0).UTC().Year()
+	dir := filepath.Join(y.root, getYearDirName(year))
+
+	y.lock.Lock()
+	defer y.lock.Unlock()
+
+	if _, ok := y.years[year]; ok {
+		return dir, nil
+	}
+
+	created := dir
+	if y.autoGenerated {
+		created = filepath.Join(dir, getAutoGeneratedDirName())
+	}
+
+	if err := os.MkdirAll(created, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create year directory: %w", err)
+	}
+
+	y.years[year] = struct{}{}
+
+	return dir, nil
+}
+
+// getYears returns the years written to, in increasing order.
+func (y *yearDirs) getYears() []int {
+	y.lock.Lock()
+	defer y.lock.Unlock()
+
+	years := make([]int, 0, len(y.years))
+	for year := range y.years {
+		years = append(years, year)
+	}
+
+	sort.Ints(years)
+
+	return years
+}
+
+// finishYears makes the year folders written to standalone backups: the labels and the encryption marker of the export
+// are copied to them, then their manifest is updated.
+func (e *ExportTask) finishYears(years []int, now time.Time) error {
+	shared := []string{getLabelFileName(), getAtRestEncryptionFileName()}
+
+	for _, year := range years {
+		yearDir := filepath.Join(e.exportDir, getYearDirName(year))
+
+		for _, name := range shared {
+			data, err := os.ReadFile(filepath.Join(e.exportDir, name)) //nolint:gosec
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("failed to read '%v': %w", name, err)
+			}
+
+			if err := utils.WriteFileSafe(e.tmpDir, filepath.Join(yearDir, name), data, &utils.Sha256IntegrityChecker{}); err != nil {
+				return fmt.Errorf("failed to write '%v' of year %v: %w", name, year, err)
+			}
+		}
+
+		if previous, err := LoadYearManifest(yearDir); err == nil && previous.Closed {
+			e.log.WithField("year", year).Warn("Messages were written to a closed year, copies of its folder are outdated")
+		}
+
+		count, err := countYearMessages(yearDir)
+		if err != nil {
+			return err
+		}
+
+		manifest := YearManifest{
+			Year:         year,
+			MessageCount: count,
+			Closed:       year < now.UTC().Year(),
+			UpdatedAt:    now.UTC(),
+		}
+
+		data, err := utils.GenerateVersionedJSON(YearManifestVersion, &manifest)
+		if err != nil {
+			return fmt.Errorf("failed to json encode year manifest: %w", err)
+		}
+
+		manifestPath := filepath.Join(yearDir, getYearManifestFileName())
+		if err := utils.WriteFileSafe(e.tmpDir, manifestPath, data, &utils.Sha256IntegrityChecker{}); err != nil {
+			return fmt.Errorf("failed to write '%v': %w", manifestPath, err)
+		}
+	}
+
+	return nil
+}
+
+// countYearMessages counts the metadata files of a year folder, packed, archived and sealed files included.
+func countYearMessages(yearDir string) (int, error) {
+	fsys := newPackFS(os.DirFS(yearDir))
+	count := 0
+
+	for _, dir := range []string{".", getAutoGeneratedDirName()} {
+		entries, err := fs.ReadDir(fsys, dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to list year directory: %w", err)
+		}
+
+		for _, entry := range entries {
+			if strings.HasSuffix(strings.TrimSuffix(entry.Name(), sealedExtension), jsonMetadataExtension) {
+				count++
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// hasYearDirs returns whether dir of the backup holds year folders, see SetSplitByYear.
+func hasYearDirs(fsys fs.FS, dir string) bool {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return false
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		if _, err := fs.Stat(fsys, path.Join(dir, entry.Name(), getYearManifestFileName())); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/gluon/async"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestWriteStage_SplitByYear(t *testing.T) {
+	newMessage := func(id, header string, timestamp time.Time) MessageWriter {
+		return &DecryptedAndBuiltMessageWriter{
+			msg: proton.FullMessage{Message: proton.Message{
+				MessageMetadata: proton.MessageMetadata{ID: id, Time: timestamp.Unix()},
+				Header:          header,
+			}},
+			eml: *bytes.NewBufferString(header),
+		}
+	}
+
+	mockCtrl := gomock.NewController(t)
+	reporter := NewMockReporter(mockCtrl)
+	reporter.EXPECT().OnProgress(gomock.Any()).AnyTimes()
+	errReporter := NewMockStageErrorReporter(mockCtrl)
+
+	dir := t.TempDir()
+	years := newYearDirs(dir, true)
+	stage := NewWriteStage(t.TempDir(), dir, 2, logrus.WithField("test", "test"), reporter, &async.NoopPanicHandler{})
+	stage.SetAutoGeneratedMode(AutoGeneratedModeSeparate)
+	stage.setYearDirs(years)
+
+	inputs := make(chan BuildStageOutput, 1)
+	inputs <- BuildStageOutput{messages: []MessageWriter{
+		newMessage("old", "From: alice@example.com\r\n\r\n", time.Date(2019, 12, 31, 23, 0, 0, 0, time.UTC)),
+		newMessage("new", "From: alice@example.com\r\n\r\n", time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)),
+		newMessage("newsletter", "From: news@example.com\r\nList-Unsubscribe: <mailto:u@example.com>\r\n\r\n", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)),
+	}}
+	close(inputs)
+
+	stage.Run(context.Background(), inputs, errReporter)
+
+	require.Equal(t, uint64(3), stage.GetWrittenCount())
+	require.Equal(t, []int{2019, 2024}, years.getYears())
+	require.FileExists(t, filepath.Join(dir, "2019", getEMLFileName("old")))
+	require.FileExists(t, filepath.Join(dir, "2024", getMetadataFileName("new")))
+	require.FileExists(t, filepath.Join(dir, "2024", getAutoGeneratedDirName(), getMetadataFileName("newsletter")))
+	require.NoDirExists(t, filepath.Join(dir, getAutoGeneratedDirName()))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getLabelFileName()), []byte("{}"), 0o600))
+
+	task := &ExportTask{exportDir: dir, tmpDir: t.TempDir(), log: logrus.WithField("export", "mail")}
+	require.NoError(t, task.finishYears(years.getYears(), time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)))
+
+	require.FileExists(t, filepath.Join(dir, "2019", getLabelFileName()))
+	require.NoFileExists(t, filepath.Join(dir, "2019", getAtRestEncryptionFileName()))
+
+	manifest, err := LoadYearManifest(filepath.Join(dir, "2019"))
+	require.NoError(t, err)
+	require.Equal(t, 1, manifest.MessageCount)
+	require.True(t, manifest.Closed)
+
+	manifest, err = LoadYearManifest(filepath.Join(dir, "2024"))
+	require.NoError(t, err)
+	require.Equal(t, 2, manifest.MessageCount)
+	require.False(t, manifest.Closed)
+
+	require.True(t, hasYearDirs(os.DirFS(dir), "."))
+	require.False(t, hasYearDirs(os.DirFS(filepath.Join(dir, "2024")), "."))
+}
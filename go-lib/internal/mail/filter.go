@@ -0,0 +1,423 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/go-proton-api"
+	"golang.org/x/exp/slices"
+)
+
+// Filter describes the subset of a mailbox an operation applies to. All the criteria that are set must match for a
+// message to be selected. The zero value matches every message.
+type Filter struct {
+	LabelIDs   []string  `json:",omitempty"` // Message must carry at least one of these labels.
+	Labels     []string  `json:",omitempty"` // Same as LabelIDs, with labels and folders given by name, path or ID.
+	MessageIDs []string  `json:",omitempty"` // Message must be one of these.
+	After      time.Time `json:",omitempty"` // Message must have been received at or after this time.
+	Before     time.Time `json:",omitempty"` // Message must have been received strictly before this time.
+	MinSize    int64     `json:",omitempty"` // Minimum message size in bytes, 0 means no minimum.
+	MaxSize    int64     `json:",omitempty"` // Maximum message size in bytes, 0 means no maximum.
+	Addresses  []string  `json:",omitempty"` // Sender or any recipient must be one of these addresses.
+	From       []string  `json:",omitempty"` // Sender must match one of these address patterns.
+	To         []string  `json:",omitempty"` // Any recipient must match one of these address patterns.
+	Involving  []string  `json:",omitempty"` // Sender or any recipient must match one of these address patterns.
+
+	SubjectKeywords []string `json:",omitempty"` // Subject must contain one of these keywords, ignoring case.
+	BodyKeywords    []string `json:",omitempty"` // Decrypted body must contain one of these keywords, ignoring case.
+	Languages       []string `json:",omitempty"` // Language detected in the decrypted body must be one of these ISO 639-1 codes.
+
+	HasAttachments *bool `json:",omitempty"` // Message must have at least one attachment if true, none if false.
+
+	// ExpandConversations selects all the messages of the conversations with at least one message matching the other
+	// criteria, so that exported threads are complete. It cannot be combined with BodyKeywords. See conversationSet.
+	ExpandConversations bool `json:",omitempty"`
+}
+
+func NewFilterFromJSON(data []byte) (Filter, error) {
+	var filter Filter
+	if err := json.Unmarshal(data, &filter); err != nil {
+		return Filter{}, fmt.Errorf("failed to parse filter: %w", err)
+	}
+
+	if err := filter.Validate(); err != nil {
+		return Filter{}, err
+	}
+
+	return filter, nil
+}
+
+// ParseFilterDate parses a date given as YYYY-MM-DD, midnight UTC, or as RFC 3339.
+func ParseFilterDate(date string) (time.Time, error) {
+	return ParseFilterDateIn(date, time.UTC)
+}
+
+// ParseFilterDateIn parses a date given as YYYY-MM-DD, midnight in loc, as YYYY-MM-DDTHH:MM:SS in loc, or as RFC 3339
+// whose offset is kept. Bounds then match the days of the user rather than the days of UTC.
+func ParseFilterDateIn(date string, loc *time.Location) (time.Time, error) {
+	for _, layout := range []string{time.DateOnly, "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, date, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date '%v', use YYYY-MM-DD, YYYY-MM-DDTHH:MM:SS or RFC 3339", date)
+	}
+
+	return t, nil
+}
+
+// ParseTimeZone returns the location named 'local' (or empty) for the time zone of the computer, 'UTC', or an IANA
+// name such as 'Europe/Zurich'.
+func ParseTimeZone(name string) (*time.Location, error) {
+	switch strings.ToLower(name) {
+	case "", "local":
+		return time.Local, nil
+	case "utc":
+		return time.UTC, nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone '%v': %w", name, err)
+	}
+
+	return loc, nil
+}
+
+func (f *Filter) Validate() error {
+	if !f.After.IsZero() && !f.Before.IsZero() && !f.After.Before(f.Before) {
+		return fmt.Errorf("invalid filter: 'after' (%v) must be earlier than 'before' (%v)", f.After, f.Before)
+	}
+
+	if f.MinSize < 0 || f.MaxSize < 0 {
+		return fmt.Errorf("invalid filter: sizes cannot be negative")
+	}
+
+	if f.MaxSize != 0 && f.MinSize > f.MaxSize {
+		return fmt.Errorf("invalid filter: minimum size (%v) is larger than maximum size (%v)", f.MinSize, f.MaxSize)
+	}
+
+	if f.ExpandConversations && f.HasBodyCriteria() {
+		return fmt.Errorf("invalid filter: conversations cannot be expanded with body keywords or languages")
+	}
+
+	for _, language := range f.Languages {
+		if len(language) != 2 || strings.ToLower(language) != language {
+			return fmt.Errorf("invalid filter: language '%v' is not a lowercase ISO 639-1 code", language)
+		}
+	}
+
+	if slices.ContainsFunc(f.Labels, func(label string) bool { return len(strings.TrimSpace(label)) == 0 }) {
+		return fmt.Errorf("invalid filter: empty label")
+	}
+
+	for _, keywords := range [][]string{f.SubjectKeywords, f.BodyKeywords} {
+		if slices.ContainsFunc(keywords, func(keyword string) bool { return len(strings.TrimSpace(keyword)) == 0 }) {
+			return fmt.Errorf("invalid filter: empty keyword")
+		}
+	}
+
+	for _, patterns := range [][]string{f.From, f.To, f.Involving} {
+		for _, pattern := range patterns {
+			if _, err := normalizeAddressPattern(pattern); err != nil {
+				return fmt.Errorf("invalid filter: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// IsEmpty returns whether the filter selects every message. ExpandConversations alone does not restrict the selection.
+func (f *Filter) IsEmpty() bool {
+	return len(f.LabelIDs) == 0 &&
+		len(f.Labels) == 0 &&
+		len(f.MessageIDs) == 0 &&
+		f.After.IsZero() &&
+		f.Before.IsZero() &&
+		f.MinSize == 0 &&
+		f.MaxSize == 0 &&
+		len(f.Addresses) == 0 &&
+		len(f.From) == 0 &&
+		len(f.To) == 0 &&
+		len(f.Involving) == 0 &&
+		len(f.SubjectKeywords) == 0 &&
+		len(f.BodyKeywords) == 0 &&
+		len(f.Languages) == 0 &&
+		f.HasAttachments == nil
+}
+
+// resolveLabels returns a copy of the filter with the Labels converted to IDs and added to LabelIDs. The labels are
+// looked up among the system labels, folders and labels of the account, see resolveLabel.
+func (f *Filter) resolveLabels(ctx context.Context, client apiclient.Client) (Filter, error) {
+	if len(f.Labels) == 0 {
+		return *f, nil
+	}
+
+	labels, err := client.GetLabels(ctx, proton.LabelTypeSystem, proton.LabelTypeFolder, proton.LabelTypeLabel)
+	if err != nil {
+		return Filter{}, fmt.Errorf("failed to retrieve labels: %w", err)
+	}
+
+	return f.resolveLabelsFrom(labels)
+}
+
+// resolveLabelsFrom is resolveLabels with the labels to look the Labels up in.
+func (f *Filter) resolveLabelsFrom(labels []proton.Label) (Filter, error) {
+	resolved := *f
+	if len(f.Labels) == 0 {
+		return resolved, nil
+	}
+
+	resolved.LabelIDs = slices.Clone(f.LabelIDs)
+	resolved.Labels = nil
+
+	for _, ref := range f.Labels {
+		id, ok := resolveLabel(labels, strings.TrimSpace(ref))
+		if !ok {
+			return Filter{}, fmt.Errorf("%w: %v", ErrUnknownLabel, ref)
+		}
+
+		if !slices.Contains(resolved.LabelIDs, id) {
+			resolved.LabelIDs = append(resolved.LabelIDs, id)
+		}
+	}
+
+	return resolved, nil
+}
+
+// getEmptyLabels returns the labels selected by the filter, as they were given, without any message according to the
+// counts of the mailbox, and whether all the selected labels are empty.
+func (f *Filter) getEmptyLabels(labels []proton.Label, counts []proton.MessageGroupCount) ([]string, bool, error) {
+	totals := make(map[string]int, len(counts))
+	for _, count := range counts {
+		totals[count.LabelID] = count.Total
+	}
+
+	var empty []string
+
+	for _, id := range f.LabelIDs {
+		if totals[id] == 0 {
+			empty = append(empty, id)
+		}
+	}
+
+	for _, ref := range f.Labels {
+		id, ok := resolveLabel(labels, strings.TrimSpace(ref))
+		if !ok {
+			return nil, false, fmt.Errorf("%w: %v", ErrUnknownLabel, ref)
+		}
+
+		if totals[id] == 0 {
+			empty = append(empty, ref)
+		}
+	}
+
+	selected := len(f.LabelIDs) + len(f.Labels)
+
+	return empty, selected != 0 && len(empty) == selected, nil
+}
+
+// Matches checks the criteria that only require the message metadata. The BodyKeywords and Languages are checked once
+// the message is downloaded, see newBodyMatcher.
+func (f *Filter) Matches(meta *proton.MessageMetadata) bool {
+	if len(f.MessageIDs) != 0 && !slices.Contains(f.MessageIDs, meta.ID) {
+		return false
+	}
+
+	if len(f.LabelIDs) != 0 && !slices.ContainsFunc(meta.LabelIDs, func(id string) bool { return slices.Contains(f.LabelIDs, id) }) {
+		return false
+	}
+
+	msgTime := time.Unix(meta.Time, 0)
+
+	if !f.After.IsZero() && msgTime.Before(f.After) {
+		return false
+	}
+
+	if !f.Before.IsZero() && !msgTime.Before(f.Before) {
+		return false
+	}
+
+	if f.MinSize != 0 && int64(meta.Size) < f.MinSize {
+		return false
+	}
+
+	if f.MaxSize != 0 && int64(meta.Size) > f.MaxSize {
+		return false
+	}
+
+	if len(f.Addresses) != 0 && !f.matchesAnyAddress(meta) {
+		return false
+	}
+
+	if f.HasAttachments != nil && *f.HasAttachments != (meta.NumAttachments > 0) {
+		return false
+	}
+
+	if len(f.SubjectKeywords) != 0 && !containsAnyKeyword(meta.Subject, f.SubjectKeywords) {
+		return false
+	}
+
+	recipients := [][]*mail.Address{meta.ToList, meta.CCList, meta.BCCList}
+
+	if len(f.From) != 0 && !matchesAddressPatterns(f.From, []*mail.Address{meta.Sender}) {
+		return false
+	}
+
+	if len(f.To) != 0 && !matchesAddressPatterns(f.To, recipients...) {
+		return false
+	}
+
+	if len(f.Involving) != 0 && !matchesAddressPatterns(f.Involving, append(recipients, []*mail.Address{meta.Sender})...) {
+		return false
+	}
+
+	return true
+}
+
+// serverSideFilter returns the API filter that can be used to reduce the number of metadata pages to fetch. Only the
+// criteria supported by the API are included, the remaining ones still need to be checked with Matches.
+func (f *Filter) serverSideFilter() proton.MessageFilter {
+	filter := proton.MessageFilter{Desc: true}
+
+	if len(f.LabelIDs) == 1 {
+		filter.LabelID = f.LabelIDs[0]
+	}
+
+	// The API matches subjects containing the given text.
+	if len(f.SubjectKeywords) == 1 {
+		filter.Subject = f.SubjectKeywords[0]
+	}
+
+	return filter
+}
+
+func (f *Filter) matchesAnyAddress(meta *proton.MessageMetadata) bool {
+	matches := func(addr *mail.Address) bool {
+		return addr != nil && slices.ContainsFunc(f.Addresses, func(a string) bool { return strings.EqualFold(a, addr.Address) })
+	}
+
+	if matches(meta.Sender) {
+		return true
+	}
+
+	for _, list := range [][]*mail.Address{meta.ToList, meta.CCList, meta.BCCList} {
+		if slices.ContainsFunc(list, matches) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containsAnyKeyword returns whether text contains one of the keywords, ignoring case.
+func containsAnyKeyword(text string, keywords []string) bool {
+	text = strings.ToLower(text)
+
+	return slices.ContainsFunc(keywords, func(keyword string) bool {
+		return strings.Contains(text, strings.ToLower(strings.TrimSpace(keyword)))
+	})
+}
+
+// HasBodyCriteria returns whether the filter requires downloading the message bodies.
+func (f *Filter) HasBodyCriteria() bool {
+	return len(f.BodyKeywords) != 0 || len(f.Languages) != 0
+}
+
+// normalizeAddressPattern returns the wildcard pattern matching the addresses described by pattern. A pattern is
+// either an address, which can contain '*' and '?' wildcards, or a domain optionally prefixed with '@', e.g.
+// '@example.com' or '*.example.com', which matches all the addresses of that domain.
+func normalizeAddressPattern(pattern string) (string, error) {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if len(pattern) == 0 {
+		return "", fmt.Errorf("empty address pattern")
+	}
+
+	if !strings.Contains(pattern, "@") {
+		pattern = "@" + pattern
+	}
+
+	if strings.HasPrefix(pattern, "@") {
+		pattern = "*" + pattern
+	}
+
+	return pattern, nil
+}
+
+// matchesAddressPatterns returns whether any of the addresses matches any of the patterns. Matching is
+// case-insensitive. Invalid patterns, which are rejected by Validate, never match.
+func matchesAddressPatterns(patterns []string, lists ...[]*mail.Address) bool {
+	for _, pattern := range patterns {
+		pattern, err := normalizeAddressPattern(pattern)
+		if err != nil {
+			continue
+		}
+
+		for _, list := range lists {
+			if slices.ContainsFunc(list, func(addr *mail.Address) bool {
+				return addr != nil && matchWildcard(pattern, strings.ToLower(addr.Address))
+			}) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchWildcard matches s against a pattern where '*' matches any sequence of characters and '?' any single character.
+func matchWildcard(pattern, s string) bool {
+	p, str := []rune(pattern), []rune(s)
+
+	// Position of the last '*' of the pattern and of the character of s it is matched up to.
+	star, starMatch := -1, 0
+
+	i, j := 0, 0
+	for j < len(str) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == str[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			star, starMatch = i, j
+			i++
+		case star != -1:
+			starMatch++
+			i, j = star+1, starMatch
+		default:
+			return false
+		}
+	}
+
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+
+	return i == len(p)
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/gluon/rfc822"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// maxSearchPartDepth is the nesting of multipart parts below which the text parts are not searched.
+const maxSearchPartDepth = 8
+
+// BodyMatcher decides whether a downloaded message is exported. It is called before the attachments of the message
+// are downloaded, so that the messages that do not match only cost the download of their body.
+type BodyMatcher func(msg *proton.Message) bool
+
+// newBodyMatcher returns a BodyMatcher selecting the messages whose decrypted body contains one of the keywords of the
+// filter and is written in one of its languages. The keywords are searched in the decoded text, see getSearchText.
+// Messages that cannot be decrypted are kept, since their content cannot be checked.
+func newBodyMatcher(filter *Filter, keys *apiclient.UnlockedKeyRing, log *logrus.Entry) BodyMatcher {
+	return func(msg *proton.Message) bool {
+		kr, ok := keys.GetAddrKeyRing(msg.AddressID)
+		if !ok {
+			return true
+		}
+
+		body, err := msg.Decrypt(kr)
+		if err != nil {
+			log.WithError(err).WithField("msgID", msg.ID).Warn("Failed to decrypt body for body filter, keeping message")
+			return true
+		}
+
+		if len(filter.BodyKeywords) != 0 && !containsAnyKeyword(getSearchText(body, msg.MIMEType), filter.BodyKeywords) {
+			return false
+		}
+
+		if len(filter.Languages) != 0 {
+			language := DetectLanguage(msg.Subject + "\n" + getBodyText(body, msg.MIMEType))
+			if !slices.Contains(filter.Languages, language) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// getSearchText returns the text of a decrypted body: the text and HTML parts of MIME messages are decoded from their
+// transfer encoding and charset, and the HTML tags are removed. Unlike getBodyText the text is complete. A MIME body
+// that cannot be parsed is returned as is.
+func getSearchText(body []byte, mimeType rfc822.MIMEType) string {
+	switch mimeType {
+	case rfc822.TextPlain:
+		return string(body)
+
+	case rfc822.TextHTML:
+		return stripHTML(string(body))
+
+	default:
+		msg, err := mail.ReadMessage(bytes.NewReader(body))
+		if err != nil {
+			return string(body)
+		}
+
+		var text strings.Builder
+
+		if err := appendPartText(&text, msg.Header, msg.Body, 0); err != nil {
+			return string(body)
+		}
+
+		return text.String()
+	}
+}
+
+// appendPartText appends the decoded text of a part and of its sub parts to text. Attachments are skipped.
+func appendPartText(text *strings.Builder, header map[string][]string, body io.Reader, depth int) error {
+	get := func(key string) string {
+		if values := header[key]; len(values) != 0 {
+			return values[0]
+		}
+
+		return ""
+	}
+
+	mediaType, params, err := mime.ParseMediaType(get("Content-Type"))
+	if err != nil {
+		mediaType = string(rfc822.TextPlain)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxSearchPartDepth {
+			return nil
+		}
+
+		reader := multipart.NewReader(body, params["boundary"])
+
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF { //nolint:errorlint
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			if err := appendPartText(text, part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	if mediaType != string(rfc822.TextPlain) && mediaType != string(rfc822.TextHTML) {
+		return nil
+	}
+
+	if disposition, _, _ := mime.ParseMediaType(get("Content-Disposition")); disposition == "attachment" {
+		return nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	if charset := params["charset"]; len(charset) != 0 && !strings.EqualFold(charset, "utf-8") {
+		if encoding, err := htmlindex.Get(charset); err == nil {
+			if decoded, err := encoding.NewDecoder().Bytes(b); err == nil {
+				b = decoded
+			}
+		}
+	}
+
+	if mediaType == string(rfc822.TextHTML) {
+		text.WriteString(stripHTML(string(b)))
+	} else {
+		text.Write(b)
+	}
+
+	text.WriteByte('\n')
+
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/go-proton-api"
+)
+
+// The API client does not expose the conversation the messages belong to. Conversations are instead reconstructed from
+// the metadata: two messages are in the same conversation if their subjects are the same once the reply and forward
+// prefixes are removed, and if they have at least one participant in common.
+
+// replyPrefixRegExp matches the reply and forward prefixes of a subject, e.g. 'Re: ', 'FWD: ' or 'Re[2]: '.
+var replyPrefixRegExp = regexp.MustCompile(`(?i)^\s*(re|fw|fwd)(\[\d+\])?\s*:\s*`) //nolint:gochecknoglobals
+
+func normalizeConversationSubject(subject string) string {
+	for {
+		stripped := replyPrefixRegExp.ReplaceAllString(subject, "")
+		if stripped == subject {
+			return strings.ToLower(strings.TrimSpace(subject))
+		}
+
+		subject = stripped
+	}
+}
+
+func getParticipants(meta *proton.MessageMetadata) []string {
+	var result []string
+
+	for _, list := range [][]*mail.Address{{meta.Sender}, meta.ToList, meta.CCList, meta.BCCList} {
+		for _, addr := range list {
+			if addr != nil && len(addr.Address) != 0 {
+				result = append(result, strings.ToLower(addr.Address))
+			}
+		}
+	}
+
+	return result
+}
+
+// conversationSet records the conversations of the matching messages.
+type conversationSet map[string]map[string]struct{} // Normalized subject to participants.
+
+func (c conversationSet) add(meta *proton.MessageMetadata) {
+	subject := normalizeConversationSubject(meta.Subject)
+	// Messages without subject are not grouped, the subject alone would not identify a conversation.
+	if len(subject) == 0 {
+		return
+	}
+
+	participants, ok := c[subject]
+	if !ok {
+		participants = make(map[string]struct{})
+		c[subject] = participants
+	}
+
+	for _, addr := range getParticipants(meta) {
+		participants[addr] = struct{}{}
+	}
+}
+
+func (c conversationSet) contains(meta *proton.MessageMetadata) bool {
+	participants, ok := c[normalizeConversationSubject(meta.Subject)]
+	if !ok {
+		return false
+	}
+
+	for _, addr := range getParticipants(meta) {
+		if _, ok := participants[addr]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// metadataMatcher returns the API filter to list the candidate messages with and the function selecting the ones
+// matching the metadata criteria of the filter. With ExpandConversations, the mailbox is listed a first time to find
+// the conversations with at least one matching message, all the messages of these conversations are then selected.
+// The Labels are resolved to IDs first.
+func (f *Filter) metadataMatcher(
+	ctx context.Context,
+	client apiclient.Client,
+	pageSize int,
+) (proton.MessageFilter, func(meta *proton.MessageMetadata) bool, error) {
+	resolved, err := f.resolveLabels(ctx, client)
+	if err != nil {
+		return proton.MessageFilter{}, nil, err
+	}
+
+	f = &resolved
+
+	if !f.ExpandConversations {
+		return f.serverSideFilter(), f.Matches, nil
+	}
+
+	conversations := make(conversationSet)
+
+	if err := walkMetadataPages(ctx, client, pageSize, f.serverSideFilter(), func(page []proton.MessageMetadata) error {
+		for i := range page {
+			if f.Matches(&page[i]) {
+				conversations.add(&page[i])
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return proton.MessageFilter{}, nil, err
+	}
+
+	// The messages of a conversation do not necessarily match the server side criteria, e.g. replies are not in the
+	// inbox, all the messages have to be listed.
+	return proton.MessageFilter{Desc: true}, func(meta *proton.MessageMetadata) bool {
+		return f.Matches(meta) || conversations.contains(meta)
+	}, nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/go-proton-api"
+)
+
+// FilterPrediction is the outcome of applying a filter to the mailbox metadata.
+type FilterPrediction struct {
+	MessageCount   uint64
+	TotalSize      uint64 // Sum of the message sizes reported by the API.
+	EstimatedBytes uint64 // Approximate disk usage of the exported messages.
+}
+
+// PredictFilter computes the number and size of messages matching the filter using metadata calls only.
+func PredictFilter(ctx context.Context, client apiclient.Client, filter Filter, pageSize int) (FilterPrediction, error) {
+	var prediction FilterPrediction
+
+	apiFilter, matches, err := filter.metadataMatcher(ctx, client, pageSize)
+	if err != nil {
+		return FilterPrediction{}, err
+	}
+
+	if err := walkMetadataPages(ctx, client, pageSize, apiFilter, func(page []proton.MessageMetadata) error {
+		for i := range page {
+			if !matches(&page[i]) {
+				continue
+			}
+
+			prediction.MessageCount++
+			prediction.TotalSize += uint64(page[i].Size)
+		}
+
+		return nil
+	}); err != nil {
+		return FilterPrediction{}, err
+	}
+
+	prediction.EstimatedBytes = approximateDiskUsage(prediction.TotalSize)
+
+	return prediction, nil
+}
+
+// walkMetadataPages iterates over all the metadata pages matching apiFilter, from the most recent message to the oldest.
+func walkMetadataPages(
+	ctx context.Context,
+	client apiclient.Client,
+	pageSize int,
+	apiFilter proton.MessageFilter,
+	fn func(page []proton.MessageMetadata) error,
+) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		page, err := client.GetMessageMetadataPage(ctx, 0, pageSize, apiFilter)
+		if err != nil {
+			return err
+		}
+
+		// The first message of the page matches the EndID of the previous query.
+		if apiFilter.EndID != "" && len(page) != 0 && page[0].ID == apiFilter.EndID {
+			page = page[1:]
+		}
+
+		if len(page) == 0 {
+			return nil
+		}
+
+		apiFilter.EndID = page[len(page)-1].ID
+
+		if err := fn(page); err != nil {
+			return err
+		}
+	}
+}
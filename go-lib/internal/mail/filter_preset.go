@@ -0,0 +1,233 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+)
+
+const (
+	FilterPresetStarred    = "starred"
+	FilterPresetLast90Days = "last-90-days"
+	FilterPresetInboxSent  = "inbox-sent"
+)
+
+var ErrUnknownFilterPreset = errors.New("unknown filter preset")
+
+// FilterPreset is a named filter bundle. MaxAgeDays is resolved when the preset is used so that presets such as
+// 'last-90-days' do not go stale.
+type FilterPreset struct {
+	Filter
+	MaxAgeDays int `json:",omitempty"` // Message must have been received in the last MaxAgeDays days, 0 means no limit.
+}
+
+// Resolve returns the filter of the preset at time now.
+func (p *FilterPreset) Resolve(now time.Time) Filter {
+	filter := p.Filter
+	if p.MaxAgeDays != 0 {
+		filter.After = now.AddDate(0, 0, -p.MaxAgeDays)
+	}
+
+	return filter
+}
+
+func (p *FilterPreset) Validate() error {
+	if p.MaxAgeDays < 0 {
+		return fmt.Errorf("invalid filter preset: maximum age cannot be negative")
+	}
+
+	if p.MaxAgeDays != 0 && !p.After.IsZero() {
+		return fmt.Errorf("invalid filter preset: maximum age and 'after' cannot be used together")
+	}
+
+	return p.Filter.Validate()
+}
+
+// FilterPresets holds the built-in presets and the ones registered from the configuration. It is safe for concurrent
+// use.
+type FilterPresets struct {
+	lock    sync.RWMutex
+	presets map[string]FilterPreset
+}
+
+func NewFilterPresets() *FilterPresets {
+	return &FilterPresets{
+		presets: map[string]FilterPreset{
+			FilterPresetStarred:    {Filter: Filter{LabelIDs: []string{proton.StarredLabel}}},
+			FilterPresetLast90Days: {MaxAgeDays: 90},
+			FilterPresetInboxSent:  {Filter: Filter{LabelIDs: []string{proton.InboxLabel, proton.SentLabel}}},
+		},
+	}
+}
+
+// Register adds a preset or replaces the one with the same name, built-in presets included.
+func (p *FilterPresets) Register(name string, preset FilterPreset) error {
+	if len(name) == 0 {
+		return fmt.Errorf("invalid filter preset: empty name")
+	}
+
+	if err := preset.Validate(); err != nil {
+		return fmt.Errorf("filter preset '%v': %w", name, err)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.presets[name] = preset
+
+	return nil
+}
+
+// RegisterFromJSON registers the presets of a JSON object mapping the preset names to their specification. Nothing is
+// registered if one of the presets is invalid.
+func (p *FilterPresets) RegisterFromJSON(data []byte) error {
+	var presets map[string]FilterPreset
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return fmt.Errorf("failed to parse filter presets: %w", err)
+	}
+
+	for name, preset := range presets {
+		if len(name) == 0 {
+			return fmt.Errorf("invalid filter preset: empty name")
+		}
+
+		if err := preset.Validate(); err != nil {
+			return fmt.Errorf("filter preset '%v': %w", name, err)
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for name, preset := range presets {
+		p.presets[name] = preset
+	}
+
+	return nil
+}
+
+// RegisterFromFile registers the presets of a configuration file, see RegisterFromJSON.
+func (p *FilterPresets) RegisterFromFile(path string) error {
+	data, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("failed to read filter presets: %w", err)
+	}
+
+	return p.RegisterFromJSON(data)
+}
+
+// Get returns the filter of the preset name resolved at time now.
+func (p *FilterPresets) Get(name string, now time.Time) (Filter, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	preset, ok := p.presets[name]
+	if !ok {
+		return Filter{}, fmt.Errorf("%w '%v'", ErrUnknownFilterPreset, name)
+	}
+
+	return preset.Resolve(now), nil
+}
+
+// GetNames returns the sorted names of the presets.
+func (p *FilterPresets) GetNames() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	names := make([]string, 0, len(p.presets))
+	for name := range p.presets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Merge returns a copy of f with the criteria set in other added. Criteria set in both are taken from other.
+func (f Filter) Merge(other Filter) Filter {
+	// LabelIDs and Labels are the same criterion.
+	if len(other.LabelIDs) != 0 || len(other.Labels) != 0 {
+		f.LabelIDs = other.LabelIDs
+		f.Labels = other.Labels
+	}
+
+	if len(other.MessageIDs) != 0 {
+		f.MessageIDs = other.MessageIDs
+	}
+
+	if !other.After.IsZero() {
+		f.After = other.After
+	}
+
+	if !other.Before.IsZero() {
+		f.Before = other.Before
+	}
+
+	if other.MinSize != 0 {
+		f.MinSize = other.MinSize
+	}
+
+	if other.MaxSize != 0 {
+		f.MaxSize = other.MaxSize
+	}
+
+	if len(other.Addresses) != 0 {
+		f.Addresses = other.Addresses
+	}
+
+	if len(other.From) != 0 {
+		f.From = other.From
+	}
+
+	if len(other.To) != 0 {
+		f.To = other.To
+	}
+
+	if len(other.Involving) != 0 {
+		f.Involving = other.Involving
+	}
+
+	if len(other.SubjectKeywords) != 0 {
+		f.SubjectKeywords = other.SubjectKeywords
+	}
+
+	if len(other.BodyKeywords) != 0 {
+		f.BodyKeywords = other.BodyKeywords
+	}
+
+	if len(other.Languages) != 0 {
+		f.Languages = other.Languages
+	}
+
+	if other.HasAttachments != nil {
+		f.HasAttachments = other.HasAttachments
+	}
+
+	f.ExpandConversations = f.ExpandConversations || other.ExpandConversations
+
+	return f
+}
@@ -0,0 +1,375 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"encoding/base64"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/gluon/rfc822"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestFilter_Matches(t *testing.T) {
+	date := time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)
+	meta := proton.MessageMetadata{
+		LabelIDs: []string{proton.InboxLabel, "custom"},
+		Time:     date.Unix(),
+		Size:     1000,
+		Sender:   &mail.Address{Address: "alice@example.com"},
+		ToList:   []*mail.Address{{Address: "bob@example.com"}},
+	}
+
+	require.True(t, (&Filter{}).Matches(&meta))
+	require.True(t, (&Filter{LabelIDs: []string{"custom", "other"}}).Matches(&meta))
+	require.False(t, (&Filter{LabelIDs: []string{"other"}}).Matches(&meta))
+	require.True(t, (&Filter{After: date}).Matches(&meta))
+	require.False(t, (&Filter{After: date.Add(time.Second)}).Matches(&meta))
+	require.False(t, (&Filter{Before: date}).Matches(&meta))
+	require.True(t, (&Filter{Before: date.Add(time.Second)}).Matches(&meta))
+	require.True(t, (&Filter{MinSize: 1000, MaxSize: 1000}).Matches(&meta))
+	require.False(t, (&Filter{MinSize: 1001}).Matches(&meta))
+	require.False(t, (&Filter{MaxSize: 999}).Matches(&meta))
+	require.True(t, (&Filter{Addresses: []string{"BOB@example.com"}}).Matches(&meta))
+	require.False(t, (&Filter{Addresses: []string{"carol@example.com"}}).Matches(&meta))
+}
+
+func TestFilter_MatchesAddressPatterns(t *testing.T) {
+	meta := proton.MessageMetadata{
+		Sender:  &mail.Address{Address: "alice@examplecorp.com"},
+		ToList:  []*mail.Address{{Address: "bob@example.com"}},
+		BCCList: []*mail.Address{{Address: "carol@eu.partner.org"}},
+	}
+
+	require.True(t, (&Filter{From: []string{"@ExampleCorp.com"}}).Matches(&meta))
+	require.True(t, (&Filter{From: []string{"examplecorp.com"}}).Matches(&meta))
+	require.True(t, (&Filter{From: []string{"ali?e@*"}}).Matches(&meta))
+	require.False(t, (&Filter{From: []string{"@example.com"}}).Matches(&meta))
+	require.False(t, (&Filter{From: []string{"alice@example*.org"}}).Matches(&meta))
+
+	require.True(t, (&Filter{To: []string{"bob@example.com"}}).Matches(&meta))
+	require.True(t, (&Filter{To: []string{"*.partner.org"}}).Matches(&meta))
+	require.False(t, (&Filter{To: []string{"partner.org"}}).Matches(&meta))
+	require.False(t, (&Filter{To: []string{"@examplecorp.com"}}).Matches(&meta))
+
+	require.True(t, (&Filter{Involving: []string{"@examplecorp.com"}}).Matches(&meta))
+	require.True(t, (&Filter{Involving: []string{"nobody@example.net", "@example.com"}}).Matches(&meta))
+	require.False(t, (&Filter{Involving: []string{"@example.net"}}).Matches(&meta))
+
+	// All the criteria must match.
+	require.False(t, (&Filter{From: []string{"@examplecorp.com"}, To: []string{"@example.net"}}).Matches(&meta))
+}
+
+func TestFilter_MatchesSubjectKeywords(t *testing.T) {
+	meta := proton.MessageMetadata{Subject: "Your Invoice for March"}
+
+	require.True(t, (&Filter{SubjectKeywords: []string{"invoice"}}).Matches(&meta))
+	require.True(t, (&Filter{SubjectKeywords: []string{"receipt", "MARCH"}}).Matches(&meta))
+	require.False(t, (&Filter{SubjectKeywords: []string{"receipt"}}).Matches(&meta))
+
+	// Body keywords are checked once the message is downloaded.
+	require.True(t, (&Filter{BodyKeywords: []string{"receipt"}}).Matches(&meta))
+
+	require.Equal(t, "invoice", (&Filter{SubjectKeywords: []string{"invoice"}}).serverSideFilter().Subject)
+	require.Empty(t, (&Filter{SubjectKeywords: []string{"invoice", "receipt"}}).serverSideFilter().Subject)
+}
+
+func TestFilter_MatchesHasAttachments(t *testing.T) {
+	withAttachments := proton.MessageMetadata{NumAttachments: 2}
+	withoutAttachments := proton.MessageMetadata{}
+	yes, no := true, false
+
+	require.True(t, (&Filter{HasAttachments: &yes}).Matches(&withAttachments))
+	require.False(t, (&Filter{HasAttachments: &yes}).Matches(&withoutAttachments))
+	require.False(t, (&Filter{HasAttachments: &no}).Matches(&withAttachments))
+	require.True(t, (&Filter{HasAttachments: &no}).Matches(&withoutAttachments))
+	require.False(t, (&Filter{HasAttachments: &no}).IsEmpty())
+
+	filter, err := NewFilterFromJSON([]byte(`{"HasAttachments":false}`))
+	require.NoError(t, err)
+	require.Equal(t, &no, filter.HasAttachments)
+}
+
+func TestMatchWildcard(t *testing.T) {
+	require.True(t, matchWildcard("*", ""))
+	require.True(t, matchWildcard("a*c", "abbbc"))
+	require.True(t, matchWildcard("a*b*c", "aXbYbZc"))
+	require.True(t, matchWildcard("a?c", "abc"))
+	require.False(t, matchWildcard("a?c", "ac"))
+	require.False(t, matchWildcard("a*c", "abcd"))
+	require.True(t, matchWildcard("*@é.com", "ü@é.com"))
+}
+
+func TestFilter_Validate(t *testing.T) {
+	date := time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	require.NoError(t, (&Filter{}).Validate())
+	require.Error(t, (&Filter{After: date, Before: date}).Validate())
+	require.Error(t, (&Filter{MinSize: 10, MaxSize: 5}).Validate())
+	require.Error(t, (&Filter{MinSize: -1}).Validate())
+	require.Error(t, (&Filter{Involving: []string{" "}}).Validate())
+	require.Error(t, (&Filter{BodyKeywords: []string{""}}).Validate())
+
+	filter, err := NewFilterFromJSON([]byte(`{"LabelIDs":["0"],"After":"2023-06-15T12:00:00Z","MaxSize":4096}`))
+	require.NoError(t, err)
+	require.Equal(t, Filter{LabelIDs: []string{"0"}, After: date, MaxSize: 4096}, filter)
+}
+
+func TestPredictFilter(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+
+	const pageSize = 2
+
+	metadata := testMetadata(10)
+	for i := range metadata {
+		metadata[i].Size = 100
+		metadata[i].LabelIDs = []string{proton.AllMailLabel}
+		if i%2 == 0 {
+			metadata[i].LabelIDs = append(metadata[i].LabelIDs, proton.InboxLabel)
+		}
+	}
+
+	encodeMetadataExpectations(client, metadata, pageSize)
+
+	prediction, err := PredictFilter(context.Background(), client, Filter{LabelIDs: []string{proton.InboxLabel, proton.SentLabel}}, pageSize)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), prediction.MessageCount)
+	require.Equal(t, uint64(500), prediction.TotalSize)
+	require.Equal(t, approximateDiskUsage(500), prediction.EstimatedBytes)
+}
+
+func TestNormalizeConversationSubject(t *testing.T) {
+	require.Equal(t, "meeting notes", normalizeConversationSubject("Meeting notes"))
+	require.Equal(t, "meeting notes", normalizeConversationSubject("RE: Fwd: re[2]:  Meeting notes "))
+	require.Equal(t, "renewal: done", normalizeConversationSubject("Re: Renewal: done"))
+}
+
+func TestPredictFilter_ExpandConversations(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+
+	const pageSize = 2
+
+	alice := &mail.Address{Address: "alice@proton.me"}
+	bob := &mail.Address{Address: "bob@proton.me"}
+	carol := &mail.Address{Address: "carol@proton.me"}
+
+	metadata := testMetadata(5)
+	for i := range metadata {
+		metadata[i].Size = 100
+	}
+
+	metadata[0].Subject, metadata[0].Sender, metadata[0].ToList = "Project", alice, []*mail.Address{bob}
+	metadata[1].Subject, metadata[1].Sender, metadata[1].ToList = "Re: Project", bob, []*mail.Address{alice}
+	metadata[2].Subject, metadata[2].Sender, metadata[2].ToList = "Project", carol, []*mail.Address{carol} // Other participants.
+	metadata[3].Subject, metadata[3].Sender, metadata[3].ToList = "Other", bob, []*mail.Address{alice}
+	metadata[4].Subject, metadata[4].Sender, metadata[4].ToList = "", alice, []*mail.Address{bob}
+
+	// The mailbox is listed once to find the conversations and once to select their messages.
+	encodeMetadataExpectations(client, metadata, pageSize)
+	encodeMetadataExpectations(client, metadata, pageSize)
+
+	prediction, err := PredictFilter(context.Background(), client, Filter{From: []string{"alice@proton.me"}, ExpandConversations: true}, pageSize)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), prediction.MessageCount)
+
+	require.Error(t, (&Filter{BodyKeywords: []string{"a"}, ExpandConversations: true}).Validate())
+}
+
+func TestFilterPresets(t *testing.T) {
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+	presets := NewFilterPresets()
+
+	filter, err := presets.Get(FilterPresetStarred, now)
+	require.NoError(t, err)
+	require.Equal(t, Filter{LabelIDs: []string{proton.StarredLabel}}, filter)
+
+	filter, err = presets.Get(FilterPresetLast90Days, now)
+	require.NoError(t, err)
+	require.Equal(t, Filter{After: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}, filter)
+
+	_, err = presets.Get("work", now)
+	require.ErrorIs(t, err, ErrUnknownFilterPreset)
+
+	require.NoError(t, presets.RegisterFromJSON([]byte(`{"work":{"Involving":["proton.me"],"MaxAgeDays":7}}`)))
+	filter, err = presets.Get("work", now)
+	require.NoError(t, err)
+	require.Equal(t, Filter{Involving: []string{"proton.me"}, After: now.AddDate(0, 0, -7)}, filter)
+
+	require.Error(t, presets.RegisterFromJSON([]byte(`{"bad":{"MaxAgeDays":-1}}`)))
+	require.Error(t, presets.Register("", FilterPreset{}))
+	require.Equal(t, []string{FilterPresetInboxSent, FilterPresetLast90Days, FilterPresetStarred, "work"}, presets.GetNames())
+}
+
+func TestFilter_Merge(t *testing.T) {
+	yes := true
+
+	base := Filter{LabelIDs: []string{proton.StarredLabel}, From: []string{"proton.me"}}
+	merged := base.Merge(Filter{From: []string{"alice@proton.me"}, HasAttachments: &yes})
+
+	require.Equal(t, Filter{LabelIDs: []string{proton.StarredLabel}, From: []string{"alice@proton.me"}, HasAttachments: &yes}, merged)
+	require.Equal(t, []string{"proton.me"}, base.From)
+}
+
+func TestFilter_ResolveLabels(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+
+	labels := []proton.Label{
+		{ID: proton.ArchiveLabel, Name: "Archive", Path: []string{"Archive"}, Type: proton.LabelTypeSystem},
+		{ID: "work", Name: "Work", Path: []string{"Work"}, Type: proton.LabelTypeFolder},
+		{ID: "project", Name: "Project", Path: []string{"Work", "Project"}, Type: proton.LabelTypeFolder},
+		{ID: "important", Name: "Important", Path: []string{"Important"}, Type: proton.LabelTypeLabel},
+	}
+
+	client.EXPECT().GetLabels(gomock.Any(), gomock.Any()).Return(labels, nil).Times(2)
+
+	filter := Filter{LabelIDs: []string{proton.StarredLabel}, Labels: []string{"archive", "work/project", "important", "Archive"}}
+	require.NoError(t, filter.Validate())
+	require.False(t, filter.IsEmpty())
+
+	resolved, err := filter.resolveLabels(context.Background(), client)
+	require.NoError(t, err)
+	require.Equal(t, Filter{LabelIDs: []string{proton.StarredLabel, proton.ArchiveLabel, "project", "important"}}, resolved)
+	require.Equal(t, []string{proton.StarredLabel}, filter.LabelIDs)
+
+	_, err = (&Filter{Labels: []string{"Personal"}}).resolveLabels(context.Background(), client)
+	require.ErrorIs(t, err, ErrUnknownLabel)
+
+	require.Error(t, (&Filter{Labels: []string{" "}}).Validate())
+
+	merged := Filter{LabelIDs: []string{proton.StarredLabel}}.Merge(Filter{Labels: []string{"Archive"}})
+	require.Equal(t, Filter{Labels: []string{"Archive"}}, merged)
+}
+
+func TestFilter_GetEmptyLabels(t *testing.T) {
+	labels := []proton.Label{
+		{ID: proton.ArchiveLabel, Name: "Archive", Path: []string{"Archive"}, Type: proton.LabelTypeSystem},
+		{ID: "work", Name: "Work", Path: []string{"Work"}, Type: proton.LabelTypeFolder},
+		{ID: "old", Name: "Old", Path: []string{"Old"}, Type: proton.LabelTypeLabel},
+	}
+
+	counts := []proton.MessageGroupCount{{LabelID: proton.ArchiveLabel, Total: 3}, {LabelID: "old", Total: 0}}
+
+	empty, allEmpty, err := (&Filter{Labels: []string{"archive", "Work", "old"}}).getEmptyLabels(labels, counts)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Work", "old"}, empty)
+	require.False(t, allEmpty)
+
+	empty, allEmpty, err = (&Filter{LabelIDs: []string{proton.StarredLabel}, Labels: []string{"Work"}}).getEmptyLabels(labels, counts)
+	require.NoError(t, err)
+	require.Equal(t, []string{proton.StarredLabel, "Work"}, empty)
+	require.True(t, allEmpty)
+
+	_, allEmpty, err = (&Filter{}).getEmptyLabels(labels, counts)
+	require.NoError(t, err)
+	require.False(t, allEmpty)
+
+	_, _, err = (&Filter{Labels: []string{"Personal"}}).getEmptyLabels(labels, counts)
+	require.ErrorIs(t, err, ErrUnknownLabel)
+}
+
+func TestParseFilterDate(t *testing.T) {
+	date, err := ParseFilterDate("2023-06-15")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2023, 6, 15, 0, 0, 0, 0, time.UTC), date)
+
+	date, err = ParseFilterDate("2023-06-15T12:30:00+02:00")
+	require.NoError(t, err)
+	require.True(t, date.Equal(time.Date(2023, 6, 15, 10, 30, 0, 0, time.UTC)))
+
+	_, err = ParseFilterDate("15/06/2023")
+	require.Error(t, err)
+}
+
+func TestParseFilterDateIn(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+
+	date, err := ParseFilterDateIn("2023-06-15", loc)
+	require.NoError(t, err)
+	require.True(t, date.Equal(time.Date(2023, 6, 14, 22, 0, 0, 0, time.UTC)))
+
+	date, err = ParseFilterDateIn("2023-06-15T08:00:00", loc)
+	require.NoError(t, err)
+	require.True(t, date.Equal(time.Date(2023, 6, 15, 6, 0, 0, 0, time.UTC)))
+
+	// An explicit offset wins over the location.
+	date, err = ParseFilterDateIn("2023-06-15T12:30:00Z", loc)
+	require.NoError(t, err)
+	require.True(t, date.Equal(time.Date(2023, 6, 15, 12, 30, 0, 0, time.UTC)))
+}
+
+func TestParseTimeZone(t *testing.T) {
+	loc, err := ParseTimeZone("local")
+	require.NoError(t, err)
+	require.Equal(t, time.Local, loc)
+
+	loc, err = ParseTimeZone("UTC")
+	require.NoError(t, err)
+	require.Equal(t, time.UTC, loc)
+
+	_, err = ParseTimeZone("Not/AZone")
+	require.Error(t, err)
+}
+
+func TestGetSearchText_DecodesParts(t *testing.T) {
+	body := "Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Votre re=E7u est pr=EAt\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString([]byte("<p>Your <b>invoice</b> is ready</p>")) + "\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Disposition: attachment; filename=notes.txt\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString([]byte("confidential")) + "\r\n" +
+		"--outer--\r\n"
+
+	text := getSearchText([]byte(body), rfc822.MultipartMixed)
+
+	// The keywords of the base64 and quoted-printable parts are found once decoded.
+	require.True(t, containsAnyKeyword(text, []string{"invoice"}))
+	require.True(t, containsAnyKeyword(text, []string{"reçu"}))
+	require.False(t, containsAnyKeyword(body, []string{"invoice"}))
+
+	// The HTML tags are not searched, nor are the attachments.
+	require.False(t, containsAnyKeyword(text, []string{"<b>"}))
+	require.False(t, containsAnyKeyword(text, []string{"confidential"}))
+
+	require.Equal(t, []string{"Hello", "world"}, strings.Fields(getSearchText([]byte("<p>Hello</p> <p>world</p>"), rfc822.TextHTML)))
+}
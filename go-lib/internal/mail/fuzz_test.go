@@ -0,0 +1,147 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ProtonMail/export-tool/internal/reporter"
+	"github.com/ProtonMail/gluon/rfc822"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/sirupsen/logrus"
+)
+
+// The fuzz targets below run their seeds, from testdata/fuzz, with the other tests. Crashes found while fuzzing are
+// recovered by the tool, the message is quarantined or skipped, but the targets report them so that they can be fixed
+// and added to the seeds:
+//
+//	go test -run '^$' -fuzz FuzzBuildMessage ./internal/mail
+
+func FuzzBuildMessage(f *testing.F) {
+	f.Add("Content-Type: text/plain\r\n", []byte("Hello"), "text/plain", []byte{}, uint8(0))
+	f.Add("Content-Type: multipart/mixed; boundary=b\r\n", []byte("--b\r\n\r\nbody\r\n--b--\r\n"), "multipart/mixed", []byte("data"), uint8(1))
+
+	key, err := crypto.GenerateKey("fuzz", "fuzz@proton.me", "x25519", 0)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	kr, err := crypto.NewKeyRing(key)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	stage := NewBuildStage(1, logrus.WithField("t", "fuzz"), 0, nil, reporter.NullReporter{}, "userID")
+
+	f.Fuzz(func(t *testing.T, header string, body []byte, mimeType string, attData []byte, attCount uint8) {
+		encrypted, err := kr.Encrypt(crypto.NewPlainMessage(body), nil)
+		if err != nil {
+			t.Skip()
+		}
+
+		armored, err := encrypted.GetArmored()
+		if err != nil {
+			t.Skip()
+		}
+
+		msg := proton.FullMessage{
+			Message: proton.Message{
+				MessageMetadata: proton.MessageMetadata{ID: "fuzz"},
+				Header:          header,
+				MIMEType:        rfc822.MIMEType(mimeType),
+				Body:            armored,
+			},
+		}
+
+		for i := 0; i < int(attCount%4); i++ {
+			msg.Attachments = append(msg.Attachments, proton.Attachment{ID: "att", Name: "att.bin", Size: int64(len(attData))})
+			msg.AttData = append(msg.AttData, attData)
+		}
+
+		writer := stage.buildMessage(kr, &msg)
+		if quarantined, ok := writer.(*QuarantinedMessageWriter); ok {
+			t.Errorf("message quarantined: %v", quarantined.reason)
+		}
+
+		_ = writer.GetMetadata()
+	})
+}
+
+func FuzzParseMetadataFile(f *testing.F) {
+	f.Add([]byte(`{"Version":1,"Payload":{"ID":"id","LabelIDs":["0"]}}`))
+	f.Add([]byte(`{"Version":1,"Payload":null}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		metadata, err := parseMetadataFile(data)
+		if errors.Is(err, errParserCrashed) {
+			t.Fatal(err)
+		}
+
+		if err != nil {
+			return
+		}
+
+		// Metadata that was read must be written and read again, e.g. by a repaired or a merged export.
+		b, err := metadata.toBytes()
+		if err != nil {
+			t.Fatalf("failed to encode parsed metadata: %v", err)
+		}
+
+		if _, err := parseMetadataFile(b); err != nil {
+			t.Fatalf("failed to parse encoded metadata: %v", err)
+		}
+	})
+}
+
+func FuzzValidateBackupDir(f *testing.F) {
+	f.Add(
+		[]byte("Subject: hello\r\n\r\nbody\r\n"),
+		[]byte(`{"Version":1,"Payload":{"ID":"msg","LabelIDs":["label"]}}`),
+		[]byte(`{"Version":1,"Payload":[{"ID":"label","Name":"Label","Type":1}]}`),
+	)
+
+	f.Fuzz(func(t *testing.T, eml, metadata, labels []byte) {
+		r := &RestoreTask{
+			ctx:       context.Background(),
+			log:       logrus.WithField("t", "fuzz"),
+			backupDir: ".",
+			backupFS: fstest.MapFS{
+				"msg.eml":           {Data: eml},
+				"msg.metadata.json": {Data: metadata},
+				getLabelFileName():  {Data: labels},
+			},
+		}
+
+		messages, err := r.validateBackupDir(NullProgressReporter{})
+		if err != nil || len(messages) == 0 {
+			return
+		}
+
+		if backupLabels, err := r.readLabelFile(); err == nil {
+			_, _ = sortLabels(backupLabels)
+		}
+
+		if _, err := prepareImportLiteral(eml); errors.Is(err, errParserCrashed) {
+			t.Fatal(err)
+		}
+	})
+}
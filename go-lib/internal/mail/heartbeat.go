@@ -0,0 +1,140 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/gluon/async"
+)
+
+// HeartbeatInterval is the time between two heartbeats of a running task.
+const HeartbeatInterval = time.Second
+
+// Heartbeat is sent periodically while a task runs, whether it makes progress or not. The heartbeats stop when the
+// task is hung, while a LastProgressTime far behind Time means that the task is alive but slow.
+type Heartbeat struct {
+	Stage            string
+	Time             time.Time
+	LastProgressTime time.Time // Start time of the task until the first progress.
+}
+
+// heartbeat sends the heartbeats of a task from its own goroutine. All the methods accept a nil receiver, which is
+// returned when the reporter does not implement StageHeartbeatReporter.
+type heartbeat struct {
+	lock         sync.Mutex
+	reporter     StageHeartbeatReporter
+	stage        string
+	lastProgress time.Time
+	now          func() time.Time
+	stopCh       chan struct{}
+	doneCh       chan struct{}
+}
+
+func startHeartbeat(reporter any, interval time.Duration, stage string, panicHandler async.PanicHandler) *heartbeat {
+	heartbeatReporter, ok := reporter.(StageHeartbeatReporter)
+	if !ok {
+		return nil
+	}
+
+	h := &heartbeat{
+		reporter:     heartbeatReporter,
+		stage:        stage,
+		lastProgress: time.Now(),
+		now:          time.Now,
+		stopCh:       make(chan struct{}),
+		doneCh:       make(chan struct{}),
+	}
+
+	go func() {
+		defer async.HandlePanic(panicHandler)
+		defer close(h.doneCh)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-h.stopCh:
+				return
+			case <-ticker.C:
+				h.reporter.OnHeartbeat(h.get())
+			}
+		}
+	}()
+
+	return h
+}
+
+func (h *heartbeat) get() Heartbeat {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return Heartbeat{Stage: h.stage, Time: h.now(), LastProgressTime: h.lastProgress}
+}
+
+func (h *heartbeat) setStage(stage string) {
+	if h == nil {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.stage = stage
+	h.lastProgress = h.now()
+}
+
+func (h *heartbeat) onProgress() {
+	if h == nil {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.lastProgress = h.now()
+}
+
+// stop returns once the last heartbeat was sent, the reporter is not called afterwards.
+func (h *heartbeat) stop() {
+	if h == nil {
+		return
+	}
+
+	close(h.stopCh)
+	<-h.doneCh
+}
+
+// heartbeatProgressReporter records the progress in the heartbeat and forwards it to the wrapped reporter.
+type heartbeatProgressReporter struct {
+	Reporter
+	heartbeat *heartbeat
+}
+
+func (h *heartbeatProgressReporter) OnProgress(delta int) {
+	h.Reporter.OnProgress(delta)
+	h.heartbeat.onProgress()
+}
+
+func (h *heartbeatProgressReporter) OnETAUpdate(remaining time.Duration) {
+	if etaReporter, ok := h.Reporter.(StageETAReporter); ok {
+		etaReporter.OnETAUpdate(remaining)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/gluon/async"
+	"github.com/stretchr/testify/require"
+)
+
+type testHeartbeatReporter struct {
+	NullProgressReporter
+	lock       sync.Mutex
+	heartbeats []Heartbeat
+}
+
+func (r *testHeartbeatReporter) OnHeartbeat(heartbeat Heartbeat) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.heartbeats = append(r.heartbeats, heartbeat)
+}
+
+func (r *testHeartbeatReporter) get() []Heartbeat {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]Heartbeat{}, r.heartbeats...)
+}
+
+func TestHeartbeat(t *testing.T) {
+	reporter := &testHeartbeatReporter{}
+
+	h := startHeartbeat(reporter, 10*time.Millisecond, "validation", &async.NoopPanicHandler{})
+	require.NotNil(t, h)
+
+	require.Eventually(t, func() bool { return len(reporter.get()) != 0 }, time.Second, time.Millisecond)
+	require.Equal(t, "validation", reporter.get()[0].Stage)
+
+	start := reporter.get()[0].LastProgressTime
+	h.setStage("import")
+	h.onProgress()
+
+	require.Eventually(t, func() bool {
+		heartbeats := reporter.get()
+		last := heartbeats[len(heartbeats)-1]
+
+		return last.Stage == "import" && last.LastProgressTime.After(start) && !last.Time.Before(last.LastProgressTime)
+	}, time.Second, time.Millisecond)
+
+	// No heartbeat is sent once stopped.
+	h.stop()
+	count := len(reporter.get())
+	time.Sleep(30 * time.Millisecond)
+	require.Len(t, reporter.get(), count)
+}
+
+func TestHeartbeatNotSupported(t *testing.T) {
+	h := startHeartbeat(NullProgressReporter{}, time.Millisecond, "validation", &async.NoopPanicHandler{})
+	require.Nil(t, h)
+
+	// A nil heartbeat can be used.
+	h.setStage("import")
+	h.onProgress()
+	h.stop()
+}
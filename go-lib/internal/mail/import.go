@@ -0,0 +1,542 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/session"
+	"github.com/ProtonMail/export-tool/internal/tracing"
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/bradenaw/juniper/stream"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+// ImportTask imports the messages of mbox files and Maildir folders that were not created by the export, e.g. Gmail
+// Takeout or Thunderbird archives, see findImportSources. The folders of the source are recreated as folders and the
+// Gmail labels as labels. The usual folder names of mail clients are mapped to the system folders.
+type ImportTask struct {
+	ctx              context.Context
+	startTime        time.Time
+	ctxCancel        context.CancelCauseFunc
+	canceller        *taskCanceller
+	sourcePath       string
+	session          *session.Session
+	log              *logrus.Entry
+	noImportLabel    bool
+	importLabelID    string
+	remoteLabels     []proton.Label
+	labelIDs         map[string]string // Remote IDs of the folders and labels of the source, by type and path.
+	importableCount  int64
+	importedCount    int64
+	failedCount      int64
+	failures         []Failure
+	bytesTransferred uint64
+	timer            *stageTimer
+}
+
+// importSystemFolders maps the folder names used by mail clients to system labels. An empty label means the folder
+// holds the messages of every folder and is not mapped to any.
+var importSystemFolders = map[string]string{ //nolint:gochecknoglobals
+	"inbox":            proton.InboxLabel,
+	"sent":             proton.SentLabel,
+	"sent mail":        proton.SentLabel,
+	"sent items":       proton.SentLabel,
+	"sent messages":    proton.SentLabel,
+	"drafts":           proton.DraftsLabel,
+	"draft":            proton.DraftsLabel,
+	"trash":            proton.TrashLabel,
+	"bin":              proton.TrashLabel,
+	"deleted items":    proton.TrashLabel,
+	"deleted messages": proton.TrashLabel,
+	"spam":             proton.SpamLabel,
+	"junk":             proton.SpamLabel,
+	"junk e-mail":      proton.SpamLabel,
+	"junk email":       proton.SpamLabel,
+	"archive":          proton.ArchiveLabel,
+	"archived":         proton.ArchiveLabel,
+	"starred":          proton.StarredLabel,
+	"all mail":         "",
+}
+
+// gmailSystemLabelPrefix is the prefix of the Gmail system labels of IMAP clients, e.g. '[Gmail]/Sent Mail'.
+const gmailSystemLabelPrefix = "[Gmail]/"
+
+func NewImportTask(ctx context.Context, sourcePath string, session *session.Session) (*ImportTask, error) {
+	absPath, err := filepath.Abs(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+
+	log := logrus.WithField("import", "mail").WithField("userID", session.GetUser().ID)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	return &ImportTask{
+		ctx:        ctx,
+		ctxCancel:  cancel,
+		canceller:  newTaskCanceller(cancel, session.GetPanicHandler()),
+		sourcePath: absPath,
+		session:    session,
+		log:        log,
+		labelIDs:   make(map[string]string),
+		timer:      newStageTimer(),
+	}, nil
+}
+
+// SetImportLabel controls whether the imported messages are also given a new 'Import <date>' label, which is the
+// default.
+func (t *ImportTask) SetImportLabel(enabled bool) {
+	t.noImportLabel = !enabled
+}
+
+func (t *ImportTask) GetImportLabel() bool {
+	return !t.noImportLabel
+}
+
+func (t *ImportTask) GetSourcePath() string {
+	return t.sourcePath
+}
+
+// Run performs the import and returns its final report. The report is also filled when an error is returned.
+func (t *ImportTask) Run(reporter Reporter) (ImportResult, error) {
+	defer t.canceller.finish()
+
+	t.startTime = time.Now()
+	t.ctx = withRateLimitReporter(t.ctx, reporter)
+
+	ctx, span := traceTask(t.ctx, "import", t.timer)
+	t.ctx = ctx
+
+	err := t.run(reporter)
+	if err != nil && len(t.failures) == 0 {
+		t.failures = append(t.failures, Failure{Reason: err.Error()})
+	}
+
+	if err != nil && !errors.Is(err, context.Canceled) {
+		t.ctxCancel(&FatalError{Err: err})
+	}
+
+	result := ImportResult{
+		ImportableCount:  t.GetImportableCount(),
+		ImportedCount:    t.GetImportedCount(),
+		FailedCount:      t.GetFailedCount(),
+		BytesTransferred: t.bytesTransferred,
+		Duration:         time.Since(t.startTime),
+		StageDurations:   t.timer.get(),
+		Failures:         t.failures,
+		CancelCause:      t.GetCancelCause(),
+	}
+
+	recordImportResult(ctx, &result)
+	tracing.End(span, err)
+
+	return result, err
+}
+
+func (t *ImportTask) run(reporter Reporter) error {
+	defer func() { t.log.WithField("duration", time.Since(t.startTime)).Info("Finished") }()
+	t.log.WithField("sourcePath", t.sourcePath).Info("Starting")
+
+	var (
+		sources []importSource
+		err     error
+	)
+
+	t.timer.measure("validation", func() { sources, err = t.countMessages() })
+	if err != nil {
+		return err
+	}
+
+	reporter.SetMessageTotal(uint64(t.importableCount))
+	reporter.SetMessageProcessed(0)
+	t.log.WithFields(logrus.Fields{"sourceCount": len(sources), "messageCount": t.importableCount}).Info("Found messages to import")
+
+	t.timer.measure("labels", func() { err = t.prepareLabels() })
+	if err != nil {
+		return err
+	}
+
+	t.timer.measure("import", func() { err = t.importSources(sources, newETAProgressReporter(reporter, uint64(t.importableCount))) })
+
+	t.log.WithFields(logrus.Fields{
+		"importable": t.GetImportableCount(),
+		"imported":   t.GetImportedCount(),
+		"failed":     t.GetFailedCount(),
+	}).Info("Report")
+
+	return err
+}
+
+// countMessages finds the sources and counts their messages.
+func (t *ImportTask) countMessages() ([]importSource, error) {
+	sources, err := findImportSources(t.sourcePath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, source := range sources {
+		if err := t.ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var count int
+		if source.maildir {
+			count, err = countMaildir(source.path)
+		} else {
+			count, err = countMBoxFile(source.path)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.importableCount += int64(count)
+	}
+
+	return sources, nil
+}
+
+func (t *ImportTask) prepareLabels() error {
+	labels, err := t.session.GetClient().GetLabels(t.ctx, proton.LabelTypeFolder, proton.LabelTypeLabel)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve labels: %w", err)
+	}
+
+	t.remoteLabels = labels
+
+	if t.noImportLabel {
+		return nil
+	}
+
+	label, err := t.session.GetClient().CreateLabel(t.ctx, proton.CreateLabelReq{
+		Name:  "Import " + time.Now().Format("2006-01-02 15:04:05"),
+		Color: "#f66",
+		Type:  proton.LabelTypeLabel,
+	})
+	if err != nil {
+		return err
+	}
+
+	t.importLabelID = label.ID
+
+	return nil
+}
+
+func (t *ImportTask) importSources(sources []importSource, reporter Reporter) error {
+	return withPrimaryAddrKR(t.ctx, t.session, func(addrID string, addrKR *crypto.KeyRing) error {
+		batch := make([]proton.ImportReq, 0, messageBatchSize)
+		origins := make([]string, 0, messageBatchSize)
+
+		flush := func() {
+			t.importBatch(addrKR, batch, origins)
+			reporter.OnProgress(len(batch))
+			batch, origins = batch[:0], origins[:0]
+		}
+
+		for _, source := range sources {
+			t.log.WithField("folder", source.folder).Info("Importing source")
+
+			if err := readSource(source, func(message sourceMessage) error {
+				// The batch being imported finished, a graceful cancellation takes effect.
+				if t.canceller.isStopping() {
+					t.ctxCancel(ErrCancelledByUser)
+				}
+
+				if err := t.ctx.Err(); err != nil {
+					return err
+				}
+
+				req, err := t.newImportReq(addrID, &message)
+				if err != nil {
+					t.log.WithField("origin", message.origin).WithError(err).Error("Failed to prepare message")
+					t.recordFailure(message.origin, err)
+					reporter.OnProgress(1)
+					return nil
+				}
+
+				batch = append(batch, req)
+				origins = append(origins, message.origin)
+				if len(batch) >= messageBatchSize {
+					flush()
+				}
+
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		if len(batch) != 0 {
+			flush()
+		}
+
+		return nil
+	})
+}
+
+func (t *ImportTask) newImportReq(addrID string, message *sourceMessage) (proton.ImportReq, error) {
+	literal, repairs, err := repairImportHeaders(message.literal, 0, string(message.literal))
+	if err != nil {
+		return proton.ImportReq{}, err
+	}
+
+	for _, repair := range repairs {
+		t.log.WithField("origin", message.origin).WithField("header", repair.name).WithField("original", repair.original).Info("Replaced invalid header")
+	}
+
+	if literal, err = prepareImportLiteral(literal); err != nil {
+		return proton.ImportReq{}, err
+	}
+
+	labelIDs, err := t.getLabelIDs(message)
+	if err != nil {
+		return proton.ImportReq{}, err
+	}
+
+	var flags proton.MessageFlag
+
+	switch {
+	case slices.Contains(labelIDs, proton.DraftsLabel):
+	case slices.Contains(labelIDs, proton.SentLabel):
+		flags = proton.MessageFlagSent
+	default:
+		flags = proton.MessageFlagReceived
+	}
+
+	if message.replied {
+		flags |= proton.MessageFlagReplied
+	}
+
+	if message.forwarded {
+		flags |= proton.MessageFlagForwarded
+	}
+
+	return proton.ImportReq{
+		Metadata: proton.ImportMetadata{
+			AddressID: addrID,
+			LabelIDs:  labelIDs,
+			Unread:    proton.Bool(!message.seen),
+			Flags:     flags,
+		},
+		Message: literal,
+	}, nil
+}
+
+// getLabelIDs returns the remote labels of a message. The Gmail labels of a message replace the folder it was in, as
+// Gmail Takeout puts every message in a single mbox file. Messages without any folder are archived.
+func (t *ImportTask) getLabelIDs(message *sourceMessage) ([]string, error) {
+	var labelIDs []string
+	if len(t.importLabelID) != 0 {
+		labelIDs = append(labelIDs, t.importLabelID)
+	}
+
+	hasFolder := false
+
+	add := func(name string, labelType proton.LabelType) error {
+		name = strings.TrimPrefix(name, gmailSystemLabelPrefix)
+
+		if systemLabel, ok := importSystemFolders[strings.ToLower(name)]; ok {
+			if len(systemLabel) != 0 && !slices.Contains(labelIDs, systemLabel) {
+				labelIDs = append(labelIDs, systemLabel)
+				hasFolder = hasFolder || systemLabel != proton.StarredLabel
+			}
+
+			return nil
+		}
+
+		labelID, err := t.ensureLabel(name, labelType)
+		if err != nil {
+			return err
+		}
+
+		labelIDs = append(labelIDs, labelID)
+		hasFolder = hasFolder || labelType == proton.LabelTypeFolder
+
+		return nil
+	}
+
+	if len(message.labels) != 0 {
+		for _, label := range message.labels {
+			switch {
+			case strings.EqualFold(label, "Unread"):
+				message.seen = false
+			case strings.EqualFold(label, "Opened"), strings.EqualFold(label, "Important"), strings.HasPrefix(label, "Category "):
+			default:
+				if err := add(label, proton.LabelTypeLabel); err != nil {
+					return nil, err
+				}
+			}
+		}
+	} else if len(message.folder) == 0 {
+		labelIDs = append(labelIDs, proton.InboxLabel)
+		hasFolder = true
+	} else if err := add(message.folder, proton.LabelTypeFolder); err != nil {
+		return nil, err
+	}
+
+	if message.draft && !slices.Contains(labelIDs, proton.DraftsLabel) {
+		labelIDs = append(labelIDs, proton.DraftsLabel)
+		hasFolder = true
+	}
+
+	if message.flagged && !slices.Contains(labelIDs, proton.StarredLabel) {
+		labelIDs = append(labelIDs, proton.StarredLabel)
+	}
+
+	if !hasFolder {
+		labelIDs = append(labelIDs, proton.ArchiveLabel)
+	}
+
+	return labelIDs, nil
+}
+
+// ensureLabel returns the remote ID of the folder or label at labelPath, '/' separated, creating it and its parents
+// if they don't exist yet.
+func (t *ImportTask) ensureLabel(labelPath string, labelType proton.LabelType) (string, error) {
+	key := labelKey(labelType, labelPath)
+	if labelID, ok := t.labelIDs[key]; ok {
+		return labelID, nil
+	}
+
+	var parentID string
+
+	parentPath, name := "", labelPath
+	if index := strings.LastIndex(labelPath, "/"); index != -1 {
+		parentPath, name = labelPath[:index], labelPath[index+1:]
+
+		var err error
+		if parentID, err = t.ensureLabel(parentPath, labelType); err != nil {
+			return "", err
+		}
+	}
+
+	if index := slices.IndexFunc(t.remoteLabels, func(l proton.Label) bool {
+		return l.Type == labelType && l.ParentID == parentID && utils.NamesEqual(l.Name, name)
+	}); index != -1 {
+		t.labelIDs[key] = t.remoteLabels[index].ID
+		return t.remoteLabels[index].ID, nil
+	}
+
+	label, err := t.session.GetClient().CreateLabel(t.ctx, proton.CreateLabelReq{
+		Name:     name,
+		Color:    "#8080ff",
+		Type:     labelType,
+		ParentID: parentID,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create '%v': %w", labelPath, err)
+	}
+
+	t.log.WithFields(logrus.Fields{"path": labelPath, "remoteLabelID": label.ID}).Info("Created remote label")
+	t.remoteLabels = append(t.remoteLabels, label)
+	t.labelIDs[key] = label.ID
+
+	return label.ID, nil
+}
+
+func labelKey(labelType proton.LabelType, labelPath string) string {
+	return fmt.Sprintf("%v:%v", labelType, labelPath)
+}
+
+// importBatch imports a batch of messages, retrying them one by one if the batch fails.
+func (t *ImportTask) importBatch(addrKR *crypto.KeyRing, reqs []proton.ImportReq, origins []string) {
+	results, err := t.importRequests(addrKR, reqs...)
+	if err != nil {
+		t.log.WithError(err).Error("Failed to import message batch. Retrying one by one.")
+
+		for i := range reqs {
+			results, err := t.importRequests(addrKR, reqs[i])
+			if err != nil {
+				t.log.WithError(err).WithField("origin", origins[i]).Error("Failed to import message")
+				t.recordFailure(origins[i], err)
+				continue
+			}
+
+			t.recordResult(&reqs[i], &results[0], origins[i])
+		}
+
+		return
+	}
+
+	for i := range results {
+		t.recordResult(&reqs[i], &results[i], origins[i])
+	}
+}
+
+func (t *ImportTask) importRequests(addrKR *crypto.KeyRing, reqs ...proton.ImportReq) ([]proton.ImportRes, error) {
+	str, err := t.session.GetClient().ImportMessages(t.ctx, addrKR, -1, -1, reqs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream.Collect(t.ctx, stream.Stream[proton.ImportRes](str))
+}
+
+func (t *ImportTask) recordResult(req *proton.ImportReq, result *proton.ImportRes, origin string) {
+	if result.Code != proton.SuccessCode {
+		t.log.WithField("origin", origin).WithError(result.APIError).Error("Failed to import message")
+		t.recordFailure(origin, result.APIError)
+		return
+	}
+
+	t.bytesTransferred += uint64(len(req.Message))
+	t.importedCount++
+}
+
+// recordFailure records a message that could not be imported. Source messages have no ID, the file they were read from
+// is reported instead.
+func (t *ImportTask) recordFailure(origin string, err error) {
+	t.failedCount++
+	t.failures = append(t.failures, Failure{MessageID: origin, Reason: err.Error()})
+}
+
+// Cancel stops the import. A graceful cancellation lets the batch being imported finish.
+func (t *ImportTask) Cancel(ctx context.Context, mode CancelMode) {
+	t.log.WithField("mode", mode).Info("Cancellation requested")
+	t.canceller.cancel(ctx, mode)
+}
+
+func (t *ImportTask) Close() {
+	t.canceller.finish()
+}
+
+func (t *ImportTask) GetImportableCount() int64 {
+	return t.importableCount
+}
+
+func (t *ImportTask) GetImportedCount() int64 {
+	return t.importedCount
+}
+
+func (t *ImportTask) GetFailedCount() int64 {
+	return t.failedCount
+}
+
+// GetCancelCause returns why the task was cancelled, or CancelCauseNone if it wasn't.
+func (t *ImportTask) GetCancelCause() CancelCause {
+	return getCancelCause(t.ctx)
+}
@@ -0,0 +1,467 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Import sources
+// --------------
+// The import reads mbox files, e.g. from Gmail Takeout or Thunderbird, and Maildir folders. The source is an mbox file,
+// a Maildir folder, or a folder containing any number of them. The folder of each message is its path in the source:
+// the name of the mbox file without its extension, Thunderbird '.sbd' sub folders and Maildir++ '.Sub.Folder' folders
+// being turned into sub folders.
+
+var errNotImportSource = errors.New("the source contains no mbox file nor Maildir folder")
+
+// sourceMessage is a message read from an import source.
+type sourceMessage struct {
+	literal   []byte
+	folder    string   // Folder of the message in the source, '/' separated, empty for the root Maildir.
+	labels    []string // Gmail labels of the message, from the X-Gmail-Labels header.
+	seen      bool
+	flagged   bool
+	draft     bool
+	replied   bool
+	forwarded bool
+	origin    string // File the message was read from, for the logs.
+}
+
+// importSource is an mbox file or a Maildir folder of the source.
+type importSource struct {
+	path    string // Path of the mbox file or the Maildir folder.
+	folder  string
+	maildir bool
+}
+
+// findImportSources returns the mbox files and Maildir folders found at sourcePath.
+func findImportSources(sourcePath string) ([]importSource, error) {
+	stat, err := os.Stat(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !stat.IsDir() {
+		return []importSource{{path: sourcePath, folder: mboxFolderName(filepath.Base(sourcePath))}}, nil
+	}
+
+	var sources []importSource
+
+	if err := filepath.WalkDir(sourcePath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(sourcePath, filePath)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+
+		if entry.IsDir() {
+			if !isMaildir(filePath) {
+				return nil
+			}
+
+			sources = append(sources, importSource{path: filePath, folder: maildirFolderName(rel), maildir: true})
+
+			// Maildir++ sub folders are stored in the Maildir itself, the other folders are messages.
+			return walkMaildirSubFolders(filePath, rel, &sources)
+		}
+
+		if isMBoxFile(filePath) {
+			sources = append(sources, importSource{path: filePath, folder: mboxFolderName(rel)})
+		}
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list import source: %w", err)
+	}
+
+	if len(sources) == 0 {
+		return nil, errNotImportSource
+	}
+
+	return sources, nil
+}
+
+// walkMaildirSubFolders adds the Maildir++ sub folders of the Maildir at dirPath and skips the Maildir.
+func walkMaildirSubFolders(dirPath, rel string, sources *[]importSource) error {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		subPath := filepath.Join(dirPath, entry.Name())
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), ".") || !isMaildir(subPath) {
+			continue
+		}
+
+		folder := path.Join(maildirFolderName(rel), strings.ReplaceAll(strings.TrimPrefix(entry.Name(), "."), ".", "/"))
+		*sources = append(*sources, importSource{path: subPath, folder: folder, maildir: true})
+	}
+
+	return fs.SkipDir
+}
+
+func isMaildir(dirPath string) bool {
+	for _, sub := range []string{"cur", "new"} {
+		if stat, err := os.Stat(filepath.Join(dirPath, sub)); err != nil || !stat.IsDir() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isMBoxFile returns whether the file starts with an mbox 'From ' separator line. Thunderbird mbox files have no
+// extension, the content is checked rather than the name.
+func isMBoxFile(filePath string) bool {
+	file, err := os.Open(filePath) //nolint:gosec
+	if err != nil {
+		return false
+	}
+	defer file.Close() //nolint:errcheck
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return false
+	}
+
+	return string(header) == "From "
+}
+
+// mboxFolderName returns the folder of the messages of an mbox file at rel in the source.
+func mboxFolderName(rel string) string {
+	parts := strings.Split(strings.TrimSuffix(rel, mboxExtension), "/")
+	for i, part := range parts {
+		parts[i] = strings.TrimSuffix(part, ".sbd")
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// maildirFolderName returns the folder of the messages of a Maildir at rel in the source.
+func maildirFolderName(rel string) string {
+	if rel == "." {
+		return ""
+	}
+
+	return rel
+}
+
+// readSource calls fn with each message of the source.
+func readSource(source importSource, fn func(message sourceMessage) error) error {
+	if source.maildir {
+		return readMaildir(source, fn)
+	}
+
+	return readMBox(source, fn)
+}
+
+// readMaildir reads the messages of the new and cur folders of a Maildir.
+func readMaildir(source importSource, fn func(message sourceMessage) error) error {
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(source.path, sub))
+		if err != nil {
+			return fmt.Errorf("failed to list Maildir: %w", err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			filePath := filepath.Join(source.path, sub, entry.Name())
+
+			literal, err := os.ReadFile(filePath) //nolint:gosec
+			if err != nil {
+				return fmt.Errorf("failed to read Maildir message: %w", err)
+			}
+
+			message := sourceMessage{literal: literal, folder: source.folder, origin: filePath}
+			applyMaildirFlags(&message, entry.Name())
+			message.labels = readGmailLabels(literal)
+
+			if err := fn(message); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// countMaildir returns the number of messages of the new and cur folders of a Maildir.
+func countMaildir(dirPath string) (int, error) {
+	count := 0
+
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dirPath, sub))
+		if err != nil {
+			return 0, fmt.Errorf("failed to list Maildir: %w", err)
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				count++
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// applyMaildirFlags sets the flags of the info part of a Maildir file name. Both separators are accepted as the
+// messages may have been copied from another system.
+func applyMaildirFlags(message *sourceMessage, name string) {
+	index := strings.LastIndexAny(name, ":!")
+	if index == -1 || !strings.HasPrefix(name[index+1:], "2,") {
+		return
+	}
+
+	flags := name[index+3:]
+	message.seen = strings.ContainsRune(flags, 'S')
+	message.flagged = strings.ContainsRune(flags, 'F')
+	message.draft = strings.ContainsRune(flags, 'D')
+	message.replied = strings.ContainsRune(flags, 'R')
+	message.forwarded = strings.ContainsRune(flags, 'P')
+}
+
+// readMBox reads the messages of an mbox file one at a time. The 'From ' separator lines are removed and the quoted
+// '>From ' lines are unquoted (mboxrd).
+func readMBox(source importSource, fn func(message sourceMessage) error) error {
+	file, err := os.Open(source.path)
+	if err != nil {
+		return fmt.Errorf("failed to open mbox file: %w", err)
+	}
+	defer file.Close() //nolint:errcheck
+
+	return scanMBox(file, func(literal []byte) error {
+		message := sourceMessage{literal: literal, folder: source.folder, origin: source.path}
+		applyMBoxStatus(&message, literal)
+		message.labels = readGmailLabels(literal)
+
+		return fn(message)
+	})
+}
+
+// scanMBox calls fn with each message of the mbox read from r.
+func scanMBox(r io.Reader, fn func(literal []byte) error) error {
+	reader := bufio.NewReader(r)
+
+	var (
+		message   bytes.Buffer
+		started   bool
+		lastEmpty = true
+	)
+
+	flush := func() error {
+		if !started {
+			return nil
+		}
+
+		// The empty line before the next separator belongs to the mbox, not to the message.
+		literal := bytes.TrimSuffix(message.Bytes(), []byte("\n"))
+		literal = append([]byte(nil), bytes.TrimSuffix(literal, []byte("\r"))...)
+		message.Reset()
+
+		return fn(literal)
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) != 0 {
+			switch {
+			case lastEmpty && isMBoxSeparator(line):
+				if err := flush(); err != nil {
+					return err
+				}
+
+				started = true
+
+			case started:
+				if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) != len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+					line = line[1:]
+				}
+
+				message.Write(line)
+			}
+
+			lastEmpty = len(bytes.TrimRight(line, "\r\n")) == 0
+		}
+
+		if errors.Is(err, io.EOF) {
+			return flush()
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read mbox file: %w", err)
+		}
+	}
+}
+
+// isMBoxSeparator returns whether line is a 'From <sender> <date>' separator line. Writers that don't quote the 'From '
+// lines of the messages are common, the date tells them apart from the text of the messages.
+func isMBoxSeparator(line []byte) bool {
+	if !bytes.HasPrefix(line, []byte("From ")) {
+		return false
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 4 {
+		return false
+	}
+
+	for _, field := range fields[2:] {
+		if hour, _, ok := strings.Cut(field, ":"); ok && len(hour) == 2 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// countMBoxFile returns the number of messages of an mbox file.
+func countMBoxFile(filePath string) (int, error) {
+	file, err := os.Open(filePath) //nolint:gosec
+	if err != nil {
+		return 0, fmt.Errorf("failed to open mbox file: %w", err)
+	}
+	defer file.Close() //nolint:errcheck
+
+	count := 0
+	err = scanMBox(file, func([]byte) error {
+		count++
+		return nil
+	})
+
+	return count, err
+}
+
+// applyMBoxStatus sets the flags of the Status, X-Status and X-Mozilla-Status headers written by mail clients.
+func applyMBoxStatus(message *sourceMessage, literal []byte) {
+	if status, ok := readHeader(literal, "X-Mozilla-Status"); ok {
+		if flags, err := strconv.ParseUint(status, 16, 32); err == nil {
+			const mozillaRead, mozillaReplied, mozillaMarked, mozillaForwarded = 0x0001, 0x0002, 0x0004, 0x1000
+
+			message.seen = flags&mozillaRead != 0
+			message.replied = flags&mozillaReplied != 0
+			message.flagged = flags&mozillaMarked != 0
+			message.forwarded = flags&mozillaForwarded != 0
+
+			return
+		}
+	}
+
+	if status, ok := readHeader(literal, "X-Status"); ok {
+		message.replied = strings.ContainsRune(status, 'A')
+		message.flagged = strings.ContainsRune(status, 'F')
+	}
+
+	if status, ok := readHeader(literal, "Status"); ok {
+		message.seen = strings.ContainsRune(status, 'R')
+		return
+	}
+
+	// Messages of an mbox without status, e.g. from Gmail Takeout, are read unless labelled as unread.
+	message.seen = true
+}
+
+// readGmailLabels returns the labels of the X-Gmail-Labels header of Gmail Takeout messages. The labels are comma
+// separated, the ones containing a comma are quoted.
+func readGmailLabels(literal []byte) []string {
+	value, ok := readHeader(literal, "X-Gmail-Labels")
+	if !ok {
+		return nil
+	}
+
+	var (
+		labels []string
+		label  strings.Builder
+		quoted bool
+	)
+
+	add := func() {
+		if name := strings.TrimSpace(label.String()); len(name) != 0 {
+			labels = append(labels, name)
+		}
+
+		label.Reset()
+	}
+
+	for _, r := range value {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			add()
+		default:
+			label.WriteRune(r)
+		}
+	}
+
+	add()
+
+	return labels
+}
+
+// readHeader returns the unfolded value of the first header named name of the message.
+func readHeader(literal []byte, name string) (string, bool) {
+	header, _, _ := bytes.Cut(literal, []byte("\n\r\n"))
+	header, _, _ = bytes.Cut(header, []byte("\n\n"))
+
+	var (
+		value strings.Builder
+		found bool
+	)
+
+	for _, line := range strings.Split(string(header), "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		if found {
+			if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+				value.WriteString(" " + strings.TrimSpace(line))
+				continue
+			}
+
+			break
+		}
+
+		key, rest, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(key), name) {
+			value.WriteString(strings.TrimSpace(rest))
+			found = true
+		}
+	}
+
+	return value.String(), found
+}
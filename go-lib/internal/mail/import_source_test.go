@@ -0,0 +1,168 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanMBox(t *testing.T) {
+	const mbox = "From a@b.c Mon Jan  1 00:00:00 2024\n" +
+		"Subject: first\n\nhello\n>From the start\n>>From twice\n\n" +
+		"From a@b.c Tue Jan  2 00:00:00 2024\n" +
+		"Subject: second\n\nFrom within a paragraph is not a separator\nbye\n\n"
+
+	var literals []string
+	require.NoError(t, scanMBox(strings.NewReader(mbox), func(literal []byte) error {
+		literals = append(literals, string(literal))
+		return nil
+	}))
+
+	require.Equal(t, []string{
+		"Subject: first\n\nhello\nFrom the start\n>From twice\n",
+		"Subject: second\n\nFrom within a paragraph is not a separator\nbye\n",
+	}, literals)
+}
+
+func TestFindImportSources(t *testing.T) {
+	dir := t.TempDir()
+
+	writeFile := func(rel, content string) {
+		filePath := filepath.Join(dir, filepath.FromSlash(rel))
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0o700))
+		require.NoError(t, os.WriteFile(filePath, []byte(content), 0o600))
+	}
+
+	const message = "From a@b.c Mon Jan  1 00:00:00 2024\nSubject: s\n\nbody\n"
+
+	// Thunderbird profile.
+	writeFile("Local Folders/Inbox", message+"\n"+message)
+	writeFile("Local Folders/Inbox.msf", "// <!-- <mdb:mork:z v=\"1.4\"/> -->")
+	writeFile("Local Folders/Projects.sbd/Acme", message)
+
+	// Maildir++ with a sub folder.
+	writeFile("Maildir/cur/1.host:2,S", "Subject: s\n\nbody\n")
+	writeFile("Maildir/new/2.host", "Subject: s\n\nbody\n")
+	writeFile("Maildir/.Work.Reports/cur/3.host:2,FS", "Subject: s\n\nbody\n")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "Maildir", ".Work.Reports", "new"), 0o700))
+
+	sources, err := findImportSources(dir)
+	require.NoError(t, err)
+
+	folders := make(map[string]bool)
+	for _, source := range sources {
+		folders[source.folder] = source.maildir
+	}
+
+	require.Equal(t, map[string]bool{
+		"Local Folders/Inbox":         false,
+		"Local Folders/Projects/Acme": false,
+		"Maildir":                     true,
+		"Maildir/Work/Reports":        true,
+	}, folders)
+
+	count, err := countMBoxFile(filepath.Join(dir, "Local Folders", "Inbox"))
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	count, err = countMaildir(filepath.Join(dir, "Maildir"))
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	_, err = findImportSources(filepath.Join(dir, "Maildir", "cur"))
+	require.ErrorIs(t, err, errNotImportSource)
+}
+
+func TestApplyMaildirFlags(t *testing.T) {
+	var message sourceMessage
+	applyMaildirFlags(&message, "1700000000.M1P2.host:2,DFS")
+	require.Equal(t, sourceMessage{seen: true, flagged: true, draft: true}, message)
+
+	message = sourceMessage{}
+	applyMaildirFlags(&message, "1700000000.M1P2.host!2,PR")
+	require.Equal(t, sourceMessage{replied: true, forwarded: true}, message)
+
+	message = sourceMessage{}
+
+	applyMaildirFlags(&message, "1700000000.M1P2.host")
+	require.Equal(t, sourceMessage{}, message)
+}
+
+func TestApplyMBoxStatus(t *testing.T) {
+	status := func(header string) sourceMessage {
+		var message sourceMessage
+		applyMBoxStatus(&message, []byte(header+"Subject: s\r\n\r\nStatus: R\r\n"))
+		return message
+	}
+
+	require.Equal(t, sourceMessage{seen: true, flagged: true}, status("X-Mozilla-Status: 0005\r\n"))
+	require.Equal(t, sourceMessage{replied: true, forwarded: true}, status("X-Mozilla-Status: 1002\r\n"))
+	require.Equal(t, sourceMessage{seen: true, replied: true, flagged: true}, status("Status: RO\r\nX-Status: AF\r\n"))
+	require.Equal(t, sourceMessage{}, status("X-Mozilla-Status: 0000\r\nStatus: RO\r\n"))
+	require.Equal(t, sourceMessage{seen: true}, status("Status: RO\r\n"))
+	require.Equal(t, sourceMessage{}, status("Status: O\r\n"))
+	require.Equal(t, sourceMessage{seen: true}, status(""))
+}
+
+func TestReadGmailLabels(t *testing.T) {
+	literal := []byte("X-Gmail-Labels: Inbox,Important,\"Projects/Acme, Inc\",\r\n Unread\r\nSubject: s\r\n\r\nbody")
+	require.Equal(t, []string{"Inbox", "Important", "Projects/Acme, Inc", "Unread"}, readGmailLabels(literal))
+	require.Nil(t, readGmailLabels([]byte("Subject: s\r\n\r\nX-Gmail-Labels: Inbox")))
+}
+
+func TestImportTask_LabelIDs(t *testing.T) {
+	task := &ImportTask{
+		importLabelID: "import",
+		labelIDs: map[string]string{
+			labelKey(proton.LabelTypeFolder, "Projects/Acme"): "acme",
+			labelKey(proton.LabelTypeLabel, "Receipts"):       "receipts",
+		},
+	}
+
+	labelIDs := func(message sourceMessage) []string {
+		ids, err := task.getLabelIDs(&message)
+		require.NoError(t, err)
+		return ids
+	}
+
+	require.Equal(t, []string{"import", proton.InboxLabel}, labelIDs(sourceMessage{}))
+	require.Equal(t, []string{"import", proton.SentLabel}, labelIDs(sourceMessage{folder: "Sent Items"}))
+	require.Equal(t, []string{"import", proton.SpamLabel}, labelIDs(sourceMessage{folder: "JUNK"}))
+	require.Equal(t, []string{"import", "acme", proton.StarredLabel}, labelIDs(sourceMessage{folder: "Projects/Acme", flagged: true}))
+	require.Equal(t, []string{"import", proton.DraftsLabel}, labelIDs(sourceMessage{folder: "Maildir", labels: []string{"Drafts"}}))
+
+	// Gmail: the labels replace the folder, messages only in 'All Mail' are archived.
+	require.Equal(t, []string{"import", proton.ArchiveLabel},
+		labelIDs(sourceMessage{folder: "All mail Including Spam and Trash", labels: []string{"Opened", "Category Updates"}}))
+	require.Equal(t, []string{"import", proton.SentLabel, "receipts"},
+		labelIDs(sourceMessage{labels: []string{"[Gmail]/Sent Mail", "Receipts", "Important"}}))
+
+	message := sourceMessage{seen: true, labels: []string{"Inbox", "Unread", "Starred"}}
+	require.Equal(t, []string{"import", proton.InboxLabel, proton.StarredLabel}, labelIDs(message))
+
+	ids, err := task.getLabelIDs(&message)
+	require.NoError(t, err)
+	require.Equal(t, []string{"import", proton.InboxLabel, proton.StarredLabel}, ids)
+	require.False(t, message.seen)
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+)
+
+// MailboxStats describes the size of a mailbox when an export starts. Recorded over successive backups, they show how
+// the mailbox grows, see history.AnalyzeGrowth.
+type MailboxStats struct {
+	Time         time.Time
+	MessageCount uint64
+	MailSpace    uint64       // Storage used by the mail product, in bytes.
+	UsedSpace    uint64       // Storage used by all the products of the account, in bytes.
+	MaxSpace     uint64       // Storage quota shared by all the products of the account, in bytes.
+	Labels       []LabelStats `json:",omitempty"` // Labels holding at least one message, the largest first.
+}
+
+// LabelStats is the number of messages of a system label, folder or label.
+type LabelStats struct {
+	ID           string
+	Name         string
+	Type         proton.LabelType
+	MessageCount uint64
+	UnreadCount  uint64
+}
+
+// newMailboxStats builds the statistics of the mailbox of user from the message count of each label. The aggregated
+// system labels, e.g. all mail, are left out since their messages are also in another label. Folders and labels are
+// named after their path, labels missing from labels are named after their ID.
+func newMailboxStats(user *proton.User, counts []proton.MessageGroupCount, labels []proton.Label, now time.Time) MailboxStats {
+	stats := MailboxStats{
+		Time:      now.UTC(),
+		MailSpace: user.ProductUsedSpace.Mail,
+		UsedSpace: user.UsedSpace,
+		MaxSpace:  user.MaxSpace,
+	}
+
+	labelByID := make(map[string]proton.Label, len(labels))
+	for _, label := range labels {
+		labelByID[label.ID] = label
+	}
+
+	for _, count := range counts {
+		if count.LabelID == proton.AllMailLabel {
+			stats.MessageCount = uint64(count.Total)
+			continue
+		}
+
+		if count.Total <= 0 {
+			continue
+		}
+
+		labelStats := LabelStats{ID: count.LabelID, MessageCount: uint64(count.Total), UnreadCount: uint64(max(count.Unread, 0))}
+
+		if name, ok := mboxSystemLabelNames[count.LabelID]; ok {
+			labelStats.Name = name
+			labelStats.Type = proton.LabelTypeSystem
+		} else if label, ok := labelByID[count.LabelID]; ok {
+			labelStats.Name = strings.Join(label.Path, "/")
+			labelStats.Type = label.Type
+		} else if isSystemLabel(count.LabelID) {
+			continue
+		} else {
+			labelStats.Name = count.LabelID
+		}
+
+		stats.Labels = append(stats.Labels, labelStats)
+	}
+
+	sort.SliceStable(stats.Labels, func(i, j int) bool {
+		return stats.Labels[i].MessageCount > stats.Labels[j].MessageCount
+	})
+
+	return stats
+}
+
+// readExportLabels returns the folders and labels written in the labels file of exportDir.
+func readExportLabels(exportDir string) ([]proton.Label, error) {
+	data, err := os.ReadFile(filepath.Join(exportDir, getLabelFileName())) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to read labels file: %w", err)
+	}
+
+	labels, err := utils.NewVersionedJSON[[]proton.Label](LabelMetadataVersion, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse labels file: %w", err)
+	}
+
+	return labels.Payload, nil
+}
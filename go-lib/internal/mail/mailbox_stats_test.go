@@ -0,0 +1,59 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMailboxStats(t *testing.T) {
+	user := &proton.User{UsedSpace: 3000, MaxSpace: 10000, ProductUsedSpace: proton.ProductUsedSpace{Mail: 2000}}
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	counts := []proton.MessageGroupCount{
+		{LabelID: proton.AllMailLabel, Total: 120},
+		{LabelID: proton.AllSentLabel, Total: 30},
+		{LabelID: proton.InboxLabel, Total: 50, Unread: 4},
+		{LabelID: proton.ArchiveLabel, Total: 40},
+		{LabelID: proton.SpamLabel, Total: 0},
+		{LabelID: "project-id", Total: 60, Unread: 1},
+		{LabelID: "unknown-id", Total: 2},
+		{LabelID: "15", Total: 110},
+	}
+
+	labels := []proton.Label{{ID: "project-id", Name: "Project", Path: []string{"Work", "Project"}, Type: proton.LabelTypeFolder}}
+
+	stats := newMailboxStats(user, counts, labels, now)
+	require.Equal(t, MailboxStats{
+		Time:         now,
+		MessageCount: 120,
+		MailSpace:    2000,
+		UsedSpace:    3000,
+		MaxSpace:     10000,
+		Labels: []LabelStats{
+			{ID: "project-id", Name: "Work/Project", Type: proton.LabelTypeFolder, MessageCount: 60, UnreadCount: 1},
+			{ID: proton.InboxLabel, Name: "Inbox", Type: proton.LabelTypeSystem, MessageCount: 50, UnreadCount: 4},
+			{ID: proton.ArchiveLabel, Name: "Archive", Type: proton.LabelTypeSystem, MessageCount: 40},
+			{ID: "unknown-id", Name: "unknown-id", MessageCount: 2},
+		},
+	}, stats)
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/gluon/async"
+)
+
+// ProgressEventInterval is the time between two progress events of a running task.
+const ProgressEventInterval = time.Second
+
+// rateSmoothingFactor is the weight given to the latest sample of the transfer rates.
+const rateSmoothingFactor = 0.3
+
+// ProgressEvent describes the state of a running task, for frontends showing more than a percentage.
+type ProgressEvent struct {
+	Stage                 string
+	ProcessedMessageCount uint64
+	TotalMessageCount     uint64 // Zero while unknown.
+	TransferredBytes      uint64 // Downloaded by backups, uploaded by restores.
+	BytesPerSecond        float64
+	MessagesPerSecond     float64
+	ETA                   time.Duration // Negative while unknown.
+	Time                  time.Time
+}
+
+// StageProgressEventReporter can optionally be implemented by a Reporter to receive a ProgressEvent every
+// ProgressEventInterval while the operation runs, and once more when it ends.
+type StageProgressEventReporter interface {
+	OnProgressEvent(event ProgressEvent)
+}
+
+// progressEvents sends the progress events of a task from its own goroutine. The rates are smoothed over the events so
+// that they don't jump with every batch. All the methods accept a nil receiver, which is returned when the reporter
+// does not implement StageProgressEventReporter.
+type progressEvents struct {
+	lock          sync.Mutex
+	reporter      StageProgressEventReporter
+	stage         string
+	processed     uint64
+	total         uint64
+	bytes         func() uint64
+	estimator     *etaEstimator
+	lastTime      time.Time
+	lastProcessed uint64
+	lastBytes     uint64
+	byteRate      float64
+	messageRate   float64
+	now           func() time.Time
+	stopCh        chan struct{}
+	doneCh        chan struct{}
+}
+
+func startProgressEvents(reporter any, interval time.Duration, stage string, panicHandler async.PanicHandler) *progressEvents {
+	eventReporter, ok := reporter.(StageProgressEventReporter)
+	if !ok {
+		return nil
+	}
+
+	p := &progressEvents{
+		reporter: eventReporter,
+		stage:    stage,
+		lastTime: time.Now(),
+		now:      time.Now,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+
+	go func() {
+		defer async.HandlePanic(panicHandler)
+		defer close(p.doneCh)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.stopCh:
+				p.reporter.OnProgressEvent(p.sample())
+				return
+			case <-ticker.C:
+				p.reporter.OnProgressEvent(p.sample())
+			}
+		}
+	}()
+
+	return p
+}
+
+// sample returns the current event and updates the rates.
+func (p *progressEvents) sample() ProgressEvent {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := p.now()
+
+	var bytes uint64
+	if p.bytes != nil {
+		bytes = p.bytes()
+	}
+
+	if elapsed := now.Sub(p.lastTime).Seconds(); elapsed > 0 {
+		// The counters can go back when a stage restarts them.
+		byteSample := float64(max(bytes, p.lastBytes)-p.lastBytes) / elapsed
+		messageSample := float64(max(p.processed, p.lastProcessed)-p.lastProcessed) / elapsed
+
+		p.byteRate = rateSmoothingFactor*byteSample + (1-rateSmoothingFactor)*p.byteRate
+		p.messageRate = rateSmoothingFactor*messageSample + (1-rateSmoothingFactor)*p.messageRate
+	}
+
+	p.lastTime = now
+	p.lastBytes = bytes
+	p.lastProcessed = p.processed
+
+	eta := time.Duration(-1)
+	if p.estimator != nil {
+		if remaining, ok := p.estimator.remaining(); ok {
+			eta = remaining
+		}
+	}
+
+	return ProgressEvent{
+		Stage:                 p.stage,
+		ProcessedMessageCount: p.processed,
+		TotalMessageCount:     p.total,
+		TransferredBytes:      bytes,
+		BytesPerSecond:        p.byteRate,
+		MessagesPerSecond:     p.messageRate,
+		ETA:                   eta,
+		Time:                  now,
+	}
+}
+
+func (p *progressEvents) setStage(stage string) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stage = stage
+}
+
+// setBytesSource sets the function returning the number of bytes transferred so far.
+func (p *progressEvents) setBytesSource(bytes func() uint64) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.bytes = bytes
+}
+
+func (p *progressEvents) setTotal(total uint64) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.total = total
+	p.estimator = newETAEstimator(total, p.now)
+	p.estimator.processed = p.processed
+}
+
+func (p *progressEvents) setProcessed(processed uint64) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.processed = processed
+	p.lastProcessed = min(p.lastProcessed, processed)
+
+	if p.estimator != nil {
+		p.estimator.processed = processed
+	}
+}
+
+func (p *progressEvents) onProgress(delta int) {
+	if p == nil || delta <= 0 {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.processed += uint64(delta)
+
+	if p.estimator != nil {
+		p.estimator.update(delta)
+	}
+}
+
+// stop returns once the last event was sent, the reporter is not called afterwards.
+func (p *progressEvents) stop() {
+	if p == nil {
+		return
+	}
+
+	close(p.stopCh)
+	<-p.doneCh
+}
+
+// progressEventsReporter records the progress in the progress events and forwards it to the wrapped reporter.
+type progressEventsReporter struct {
+	Reporter
+	events *progressEvents
+}
+
+func (p *progressEventsReporter) SetMessageTotal(total uint64) {
+	p.Reporter.SetMessageTotal(total)
+	p.events.setTotal(total)
+}
+
+func (p *progressEventsReporter) SetMessageProcessed(processed uint64) {
+	p.Reporter.SetMessageProcessed(processed)
+	p.events.setProcessed(processed)
+}
+
+func (p *progressEventsReporter) OnProgress(delta int) {
+	p.Reporter.OnProgress(delta)
+	p.events.onProgress(delta)
+}
+
+func (p *progressEventsReporter) OnETAUpdate(remaining time.Duration) {
+	if etaReporter, ok := p.Reporter.(StageETAReporter); ok {
+		etaReporter.OnETAUpdate(remaining)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/gluon/async"
+	"github.com/stretchr/testify/require"
+)
+
+type testProgressEventReporter struct {
+	NullProgressReporter
+	lock   sync.Mutex
+	events []ProgressEvent
+}
+
+func (r *testProgressEventReporter) OnProgressEvent(event ProgressEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.events = append(r.events, event)
+}
+
+func (r *testProgressEventReporter) get() []ProgressEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]ProgressEvent{}, r.events...)
+}
+
+func TestProgressEvents(t *testing.T) {
+	reporter := &testProgressEventReporter{}
+
+	// The interval is long enough for the events to be sampled by the test only.
+	p := startProgressEvents(reporter, time.Hour, "preparing", &async.NoopPanicHandler{})
+	require.NotNil(t, p)
+
+	now := time.Now()
+	p.lock.Lock()
+	p.now = func() time.Time { return now }
+	p.lastTime = now
+	p.lock.Unlock()
+
+	var bytes uint64
+	p.setBytesSource(func() uint64 { return bytes })
+
+	event := p.sample()
+	require.Equal(t, "preparing", event.Stage)
+	require.Negative(t, event.ETA)
+
+	p.setStage("messages")
+	p.setTotal(100)
+	p.setProcessed(10)
+
+	now = now.Add(time.Second)
+	p.onProgress(10)
+	bytes = 1000
+
+	now = now.Add(time.Second)
+	event = p.sample()
+	require.Equal(t, "messages", event.Stage)
+	require.Equal(t, uint64(20), event.ProcessedMessageCount)
+	require.Equal(t, uint64(100), event.TotalMessageCount)
+	require.Equal(t, uint64(1000), event.TransferredBytes)
+	require.InDelta(t, rateSmoothingFactor*1000/2, event.BytesPerSecond, 0.001)
+	require.InDelta(t, rateSmoothingFactor*20/2, event.MessagesPerSecond, 0.001)
+
+	// 10 messages in one second, 80 remaining.
+	require.Equal(t, 8*time.Second, event.ETA)
+
+	// Without progress, the rates decrease.
+	now = now.Add(time.Second)
+	require.Less(t, p.sample().BytesPerSecond, event.BytesPerSecond)
+
+	// A last event is sent when stopped.
+	p.stop()
+	require.Len(t, reporter.get(), 1)
+	require.Equal(t, uint64(20), reporter.get()[0].ProcessedMessageCount)
+}
+
+func TestProgressEventsNotSupported(t *testing.T) {
+	p := startProgressEvents(NullProgressReporter{}, time.Millisecond, "preparing", &async.NoopPanicHandler{})
+	require.Nil(t, p)
+
+	// Nil progress events can be used.
+	p.setStage("messages")
+	p.setBytesSource(func() uint64 { return 0 })
+	p.setTotal(1)
+	p.setProcessed(0)
+	p.onProgress(1)
+	p.stop()
+}
@@ -0,0 +1,426 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Relocation
+// ----------
+// An export is relocated by copying its files one by one to the destination, a local folder or an S3 bucket. Every
+// copy is read back and its SHA-256 digest compared with the one of the source file. Files already present in the
+// destination with the same digest are not copied again, so an interrupted relocation can be resumed by running it
+// again. The source is only removed, when moving, once all the files were verified.
+//
+// All the manifests of an export refer to files relative to the export directory and remain valid. The relocation
+// manifest written last in the destination lists the verified files and the locations the export was relocated from.
+
+const RelocationManifestVersion = 1
+
+var ErrRelocationOverlap = errors.New("the source and destination of a relocation cannot contain each other")
+
+// Relocation records one relocation of an export.
+type Relocation struct {
+	Source      string
+	Destination string
+	Time        time.Time
+	Moved       bool
+}
+
+// RelocatedFile is a verified file of a relocated export.
+type RelocatedFile struct {
+	Path   string // Relative to the export directory, with forward slashes.
+	Size   int64
+	SHA256 string
+}
+
+type RelocationManifest struct {
+	History []Relocation // Oldest first.
+	Files   []RelocatedFile
+}
+
+// RelocationReport is the outcome of a relocation.
+type RelocationReport struct {
+	Manifest     RelocationManifest
+	CopiedCount  int // Files copied during this run.
+	ResumedCount int // Files that were already present in the destination.
+	Duration     time.Duration
+}
+
+func getRelocationManifestFileName() string {
+	return "relocation.json"
+}
+
+// LoadRelocationManifest reads the relocation manifest of an export directory.
+func LoadRelocationManifest(exportDir string) (RelocationManifest, error) {
+	b, err := os.ReadFile(filepath.Join(exportDir, getRelocationManifestFileName())) //nolint:gosec
+	if err != nil {
+		return RelocationManifest{}, fmt.Errorf("failed to read relocation manifest: %w", err)
+	}
+
+	manifest, err := utils.NewVersionedJSON[RelocationManifest](RelocationManifestVersion, b)
+	if err != nil {
+		return RelocationManifest{}, fmt.Errorf("failed to parse relocation manifest: %w", err)
+	}
+
+	return manifest.Payload, nil
+}
+
+// RelocateExport copies the export in srcDir to dst, a local folder or an s3://bucket/path URL, and verifies the copy.
+// If move is set, srcDir is removed once the copy is verified.
+func RelocateExport(ctx context.Context, srcDir, dst string, move bool) (RelocationReport, error) {
+	startTime := time.Now()
+	log := logrus.WithField("relocate", "mail").WithField("source", srcDir).WithField("destination", dst)
+
+	srcDir, target, err := newRelocationTarget(srcDir, dst)
+	if err != nil {
+		return RelocationReport{}, err
+	}
+
+	defer func() {
+		if err := target.close(); err != nil {
+			log.WithError(err).Error("Failed to remove temp directory")
+		}
+	}()
+
+	var report RelocationReport
+
+	if manifest, err := LoadRelocationManifest(srcDir); err == nil {
+		report.Manifest.History = manifest.History
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return RelocationReport{}, err
+	}
+
+	log.Info("Starting relocation")
+
+	if err := filepath.WalkDir(srcDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if rel == "temp" {
+				return filepath.SkipDir
+			}
+
+			return target.mkdir(filepath.ToSlash(rel))
+		}
+
+		if rel == getRelocationManifestFileName() || !entry.Type().IsRegular() {
+			return nil
+		}
+
+		file, resumed, err := relocateFile(ctx, target, path, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+
+		file.Path = filepath.ToSlash(rel)
+		report.Manifest.Files = append(report.Manifest.Files, file)
+
+		if resumed {
+			report.ResumedCount++
+		} else {
+			report.CopiedCount++
+		}
+
+		return nil
+	}); err != nil {
+		return RelocationReport{}, fmt.Errorf("failed to relocate export: %w", err)
+	}
+
+	sort.Slice(report.Manifest.Files, func(i, j int) bool { return report.Manifest.Files[i].Path < report.Manifest.Files[j].Path })
+
+	report.Manifest.History = append(report.Manifest.History, Relocation{
+		Source:      srcDir,
+		Destination: target.getLocation(),
+		Time:        time.Now().UTC(),
+		Moved:       move,
+	})
+
+	data, err := utils.GenerateVersionedJSON(RelocationManifestVersion, &report.Manifest)
+	if err != nil {
+		return RelocationReport{}, fmt.Errorf("failed to json encode relocation manifest: %w", err)
+	}
+
+	if err := target.writeFile(ctx, getRelocationManifestFileName(), data); err != nil {
+		return RelocationReport{}, fmt.Errorf("failed to write relocation manifest: %w", err)
+	}
+
+	if move {
+		if err := os.RemoveAll(srcDir); err != nil {
+			return RelocationReport{}, fmt.Errorf("failed to remove relocated export: %w", err)
+		}
+	}
+
+	report.Duration = time.Since(startTime)
+
+	log.WithFields(logrus.Fields{"copied": report.CopiedCount, "resumed": report.ResumedCount}).Info("Relocation finished")
+
+	return report, nil
+}
+
+// relocationTarget is the destination of a relocation. Names are relative to the export directory, with forward
+// slashes.
+type relocationTarget interface {
+	// getLocation returns the path or the URL of the destination.
+	getLocation() string
+
+	mkdir(name string) error
+
+	// hash returns the size and digest of the file name, an error wrapping fs.ErrNotExist if there is none.
+	hash(ctx context.Context, name string) (RelocatedFile, error)
+
+	// copy copies the local file src to name and returns the size and digest of the copied content.
+	copy(ctx context.Context, src, name string) (RelocatedFile, error)
+
+	writeFile(ctx context.Context, name string, data []byte) error
+
+	close() error
+}
+
+// newRelocationTarget returns the absolute path of srcDir and the target of the relocation to dst.
+func newRelocationTarget(srcDir, dst string) (string, relocationTarget, error) {
+	if IsRemoteBackup(dst) {
+		srcDir, err := checkRelocationSource(srcDir)
+		if err != nil {
+			return "", nil, err
+		}
+
+		target, err := newS3RelocationTarget(dst)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return srcDir, target, nil
+	}
+
+	srcDir, dstDir, err := checkRelocationDirs(srcDir, dst)
+	if err != nil {
+		return "", nil, err
+	}
+
+	target, err := newLocalRelocationTarget(dstDir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return srcDir, target, nil
+}
+
+func checkRelocationSource(srcDir string) (string, error) {
+	srcDir, err := filepath.Abs(srcDir)
+	if err != nil {
+		return "", err
+	}
+
+	if stat, err := os.Stat(srcDir); err != nil {
+		return "", fmt.Errorf("failed to access relocation source: %w", err)
+	} else if !stat.IsDir() {
+		return "", fmt.Errorf("relocation source '%v' is not a directory", srcDir)
+	}
+
+	return srcDir, nil
+}
+
+func checkRelocationDirs(srcDir, dstDir string) (string, string, error) {
+	srcDir, err := checkRelocationSource(srcDir)
+	if err != nil {
+		return "", "", err
+	}
+
+	dstDir, err = filepath.Abs(dstDir)
+	if err != nil {
+		return "", "", err
+	}
+
+	if isSubPath(srcDir, dstDir) || isSubPath(dstDir, srcDir) {
+		return "", "", ErrRelocationOverlap
+	}
+
+	return srcDir, dstDir, nil
+}
+
+// isSubPath returns true if path is dir or is inside dir. Both paths must be absolute and clean.
+func isSubPath(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// relocateFile copies src to name, unless the target already has the same content, and verifies the copy. The second
+// return value is true if the file was already present.
+func relocateFile(ctx context.Context, target relocationTarget, src, name string) (RelocatedFile, bool, error) {
+	if dstFile, err := target.hash(ctx, name); err == nil {
+		srcFile, err := hashFile(src)
+		if err != nil {
+			return RelocatedFile{}, false, err
+		}
+
+		if srcFile == dstFile {
+			return srcFile, true, nil
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return RelocatedFile{}, false, err
+	}
+
+	srcFile, err := target.copy(ctx, src, name)
+	if err != nil {
+		return RelocatedFile{}, false, err
+	}
+
+	// Read the copy back, the digest computed while writing does not cover what was stored.
+	dstFile, err := target.hash(ctx, name)
+	if err != nil {
+		return RelocatedFile{}, false, err
+	}
+
+	if srcFile != dstFile {
+		return RelocatedFile{}, false, fmt.Errorf("'%v': %w", name, utils.ErrIntegrityCheckFailed)
+	}
+
+	return srcFile, false, nil
+}
+
+// localRelocationTarget copies the files to a local folder through temporary files.
+type localRelocationTarget struct {
+	dir    string
+	tmpDir string
+}
+
+func newLocalRelocationTarget(dir string) (*localRelocationTarget, error) {
+	tmpDir := filepath.Join(dir, "temp")
+	if err := os.MkdirAll(tmpDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create relocation tmp directory: %w", err)
+	}
+
+	return &localRelocationTarget{dir: dir, tmpDir: tmpDir}, nil
+}
+
+func (l *localRelocationTarget) getLocation() string {
+	return l.dir
+}
+
+func (l *localRelocationTarget) getPath(name string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(name))
+}
+
+func (l *localRelocationTarget) mkdir(name string) error {
+	return os.MkdirAll(l.getPath(name), 0o700)
+}
+
+func (l *localRelocationTarget) hash(_ context.Context, name string) (RelocatedFile, error) {
+	return hashFile(l.getPath(name))
+}
+
+func (l *localRelocationTarget) copy(_ context.Context, src, name string) (RelocatedFile, error) {
+	return copyFileHashed(l.tmpDir, src, l.getPath(name))
+}
+
+func (l *localRelocationTarget) writeFile(_ context.Context, name string, data []byte) error {
+	return utils.WriteFileSafe(l.tmpDir, l.getPath(name), data, &utils.Sha256IntegrityChecker{})
+}
+
+func (l *localRelocationTarget) close() error {
+	return os.RemoveAll(l.tmpDir)
+}
+
+// copyFileHashed copies src to dst through a temporary file and returns the size and digest of the copied content.
+func copyFileHashed(tmpDir, src, dst string) (RelocatedFile, error) {
+	in, err := os.Open(src) //nolint:gosec
+	if err != nil {
+		return RelocatedFile{}, fmt.Errorf("failed to open '%v': %w", src, err)
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.CreateTemp(tmpDir, "export-tool-*")
+	if err != nil {
+		return RelocatedFile{}, fmt.Errorf("failed to create tmp file: %w", err)
+	}
+
+	hash := sha256.New()
+
+	size, err := io.Copy(out, io.TeeReader(in, hash))
+	if err != nil {
+		_ = out.Close()
+		return RelocatedFile{}, fmt.Errorf("failed to copy '%v': %w", src, err)
+	}
+
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return RelocatedFile{}, fmt.Errorf("failed to sync tmp file: %w", err)
+	}
+
+	if err := out.Close(); err != nil {
+		return RelocatedFile{}, fmt.Errorf("failed to close tmp file: %w", err)
+	}
+
+	if err := os.Rename(out.Name(), dst); err != nil {
+		return RelocatedFile{}, fmt.Errorf("failed to move file to location: %w", err)
+	}
+
+	return RelocatedFile{Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+func hashFile(path string) (RelocatedFile, error) {
+	file, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return RelocatedFile{}, fmt.Errorf("failed to open '%v': %w", path, err)
+	}
+	defer func() { _ = file.Close() }()
+
+	return hashReader(path, file)
+}
+
+func hashReader(name string, r io.Reader) (RelocatedFile, error) {
+	hash := sha256.New()
+
+	size, err := io.Copy(hash, r)
+	if err != nil {
+		return RelocatedFile{}, fmt.Errorf("failed to read '%v': %w", name, err)
+	}
+
+	return RelocatedFile{Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var ErrRelocationTargetNotSupported = errors.New("exports can only be relocated to a local folder or to s3://bucket/path")
+
+// s3RelocationTarget uploads the files to an S3 bucket, or to an S3 compatible service selected with
+// RemoteS3EndpointEnvVar, with the credentials of the usual AWS env vars. Every upload is signed with the digest of the
+// file, which the service checks, and is downloaded again to be verified.
+type s3RelocationTarget struct {
+	backend  *s3Backend
+	location string // URL of the export, without trailing slash.
+}
+
+func newS3RelocationTarget(location string) (*s3RelocationTarget, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relocation destination: %w", err)
+	}
+
+	if u.User != nil {
+		return nil, ErrRemoteCredentialsInURL
+	}
+
+	if !strings.EqualFold(u.Scheme, "s3") || len(u.Host) == 0 {
+		return nil, ErrRelocationTargetNotSupported
+	}
+
+	backend, err := newS3Backend(u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3RelocationTarget{backend: backend, location: strings.TrimSuffix(u.String(), "/")}, nil
+}
+
+func (s *s3RelocationTarget) getLocation() string {
+	return s.location
+}
+
+// mkdir does nothing, folders only exist in S3 as the prefix of the keys of their files.
+func (s *s3RelocationTarget) mkdir(string) error {
+	return nil
+}
+
+func (s *s3RelocationTarget) hash(ctx context.Context, name string) (RelocatedFile, error) {
+	body, err := s.backend.getRange(ctx, name, 0, -1)
+	if err != nil {
+		return RelocatedFile{}, fmt.Errorf("failed to download '%v': %w", name, err)
+	}
+	defer body.Close() //nolint:errcheck
+
+	return hashReader(name, body)
+}
+
+func (s *s3RelocationTarget) copy(ctx context.Context, src, name string) (RelocatedFile, error) {
+	// The digest signs the upload, it is computed before sending the file.
+	file, err := hashFile(src)
+	if err != nil {
+		return RelocatedFile{}, err
+	}
+
+	in, err := os.Open(src) //nolint:gosec
+	if err != nil {
+		return RelocatedFile{}, fmt.Errorf("failed to open '%v': %w", src, err)
+	}
+	defer func() { _ = in.Close() }()
+
+	if err := s.backend.putObject(ctx, name, in, file.Size, file.SHA256); err != nil {
+		return RelocatedFile{}, err
+	}
+
+	return file, nil
+}
+
+func (s *s3RelocationTarget) writeFile(ctx context.Context, name string, data []byte) error {
+	hash := sha256.Sum256(data)
+
+	return s.backend.putObject(ctx, name, bytes.NewReader(data), int64(len(data)), hex.EncodeToString(hash[:]))
+}
+
+func (s *s3RelocationTarget) close() error {
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelocateExport(t *testing.T) {
+	srcDir := filepath.Join(t.TempDir(), "mail_20240101_120000")
+	dstDir := filepath.Join(t.TempDir(), "archive")
+
+	files := map[string]string{
+		"labels.json":             `[]`,
+		"msg1.eml":                "Subject: test\r\n\r\nHello",
+		"msg1.metadata.json":      `{"Version":1}`,
+		"msg2/body.txt":           "Body",
+		"auto-generated/msg3.eml": "Subject: newsletter\r\n\r\nNews",
+	}
+
+	for path, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(srcDir, path)), 0o700))
+		require.NoError(t, os.WriteFile(filepath.Join(srcDir, path), []byte(content), 0o600))
+	}
+
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "temp"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "temp", "leftover"), []byte("x"), 0o600))
+
+	// Simulate an interrupted relocation.
+	require.NoError(t, os.MkdirAll(dstDir, 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dstDir, "labels.json"), []byte(`[]`), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dstDir, "msg1.eml"), []byte("truncated"), 0o600))
+
+	report, err := RelocateExport(context.Background(), srcDir, dstDir, true)
+	require.NoError(t, err)
+	require.Len(t, report.Manifest.Files, len(files))
+	require.Equal(t, 1, report.ResumedCount)
+	require.Equal(t, len(files)-1, report.CopiedCount)
+	require.Equal(t, "auto-generated/msg3.eml", report.Manifest.Files[0].Path)
+
+	for path, content := range files {
+		data, err := os.ReadFile(filepath.Join(dstDir, path))
+		require.NoError(t, err)
+		require.Equal(t, content, string(data))
+	}
+
+	_, err = os.Stat(filepath.Join(dstDir, "temp"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = os.Stat(srcDir)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// Relocating again keeps the history.
+	otherDir := filepath.Join(t.TempDir(), "other")
+	_, err = RelocateExport(context.Background(), dstDir, otherDir, false)
+	require.NoError(t, err)
+
+	manifest, err := LoadRelocationManifest(otherDir)
+	require.NoError(t, err)
+	require.Len(t, manifest.History, 2)
+	require.Equal(t, srcDir, manifest.History[0].Source)
+	require.Equal(t, otherDir, manifest.History[1].Destination)
+}
+
+func TestRelocateExport_Overlap(t *testing.T) {
+	srcDir := t.TempDir()
+
+	_, err := RelocateExport(context.Background(), srcDir, filepath.Join(srcDir, "sub"), false)
+	require.ErrorIs(t, err, ErrRelocationOverlap)
+
+	_, err = RelocateExport(context.Background(), srcDir, srcDir, false)
+	require.ErrorIs(t, err, ErrRelocationOverlap)
+
+	_, err = RelocateExport(context.Background(), filepath.Join(srcDir, "missing"), t.TempDir(), false)
+	require.Error(t, err)
+}
+
+func TestRelocateExport_S3(t *testing.T) {
+	server := &testRemoteServer{files: make(map[string]string), gets: make(map[string]int)}
+	httpServer := httptest.NewServer(http.HandlerFunc(server.serveS3))
+	defer httpServer.Close()
+
+	t.Setenv(RemoteS3EndpointEnvVar, httpServer.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	srcDir := filepath.Join(t.TempDir(), "mail_20240101_120000")
+
+	files := map[string]string{
+		"labels.json":   `[]`,
+		"msg1.eml":      "Subject: test\r\n\r\nHello",
+		"msg2/body.txt": "Body",
+	}
+
+	for path, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(srcDir, path)), 0o700))
+		require.NoError(t, os.WriteFile(filepath.Join(srcDir, path), []byte(content), 0o600))
+	}
+
+	// Simulate an interrupted relocation.
+	server.setFile("archive/mail_20240101_120000/labels.json", `[]`)
+	server.setFile("archive/mail_20240101_120000/msg1.eml", "truncated")
+
+	report, err := RelocateExport(context.Background(), srcDir, "s3://bucket/archive/mail_20240101_120000/", false)
+	require.NoError(t, err)
+	require.Len(t, report.Manifest.Files, len(files))
+	require.Equal(t, 1, report.ResumedCount)
+	require.Equal(t, len(files)-1, report.CopiedCount)
+	require.Equal(t, "s3://bucket/archive/mail_20240101_120000", report.Manifest.History[0].Destination)
+
+	for path, content := range files {
+		require.Equal(t, content, server.files["archive/mail_20240101_120000/"+path])
+	}
+
+	require.Contains(t, server.files, "archive/mail_20240101_120000/"+getRelocationManifestFileName())
+
+	// The source is kept when copying.
+	_, err = os.Stat(srcDir)
+	require.NoError(t, err)
+
+	_, err = RelocateExport(context.Background(), srcDir, "webdav://host/archive", false)
+	require.ErrorIs(t, err, ErrRelocationTargetNotSupported)
+}
@@ -21,12 +21,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"path/filepath"
 	"regexp"
+	"sync"
 	"time"
 
 	"github.com/ProtonMail/export-tool/internal/apiclient"
 	"github.com/ProtonMail/export-tool/internal/session"
+	"github.com/ProtonMail/export-tool/internal/tracing"
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/sirupsen/logrus"
 )
@@ -34,60 +38,158 @@ import (
 var mailFolderRegExp = regexp.MustCompile(`^mail_\d{8}_\d{6}$`)
 
 type RestoreTask struct {
-	ctx             context.Context
-	startTime       time.Time
-	ctxCancel       func()
-	backupDir       string
-	session         *session.Session
-	log             *logrus.Entry
-	labelMapping    map[string]string // map of [backup labelIDs] to remoteLabelIDs
-	importLabelID   string
-	importableCount int64
-	importedCount   int64
-	failedCount     int64
-	cancelledByUser bool
+	ctx              context.Context
+	startTime        time.Time
+	ctxCancel        context.CancelCauseFunc
+	canceller        *taskCanceller
+	backupPath       string // Folder, archive or remote URL given by the user.
+	backupFS         fs.FS
+	backupCloser     io.Closer // Nil unless the backup is an archive or a remote backup.
+	backupDir        string    // Path of the backup folder in backupFS.
+	remote           *remoteFS // Nil unless the backup is a remote backup, see IsRemoteBackup.
+	session          *session.Session
+	log              *logrus.Entry
+	labelMapping     map[string]string // map of [backup labelIDs] to remoteLabelIDs
+	labelReuseMode   LabelReuseMode
+	importLabelID    string
+	noImportLabel    bool // Messages are only placed in their original folders and labels, see SetImportLabel.
+	filter           *Filter
+	filteredCount    int64
+	usedLabelIDs     map[string]bool // Labels of the messages selected by the filter, nil if the restore is not filtered.
+	skipDuplicates   bool
+	duplicateCount   int64
+	resume           bool
+	resumedCount     int64
+	restoreState     *restoreStateTracker // Nil for transactional restores.
+	concurrency      int                  // Number of parallel import batches, 0 to select it from the plan, see SetConcurrency.
+	resultLock       sync.Mutex           // Guards the counts, failures and imported messages updated by the import workers.
+	importableCount  int64
+	importedCount    int64
+	failedCount      int64
+	failures         []Failure
+	bytesTransferred uint64
+	timer            *stageTimer
+	heartbeat        *heartbeat
+	events           *progressEvents
+	guardrails       RestoreGuardrails
+	guardrail        *restoreGuardrail // Nil unless the guardrails are enabled, see SetGuardrails.
+
+	transactional      bool
+	rolledBack         bool
+	createdLabelIDs    []string // remote IDs of the labels created by the restore, in creation order.
+	importedMessageIDs []string
+	restoredMessages   []restoredMessage
+
+	atRestKey *AtRestKey // Nil unless the backup is encrypted at rest, see SetAtRestKey.
 }
 
 func NewRestoreTask(ctx context.Context, backupDir string, session *session.Session) (*RestoreTask, error) {
-	absPath, err := filepath.Abs(backupDir)
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	backupFS, backupCloser, absPath, err := openBackupLocation(ctx, backupDir)
 	if err != nil {
+		cancel(err)
 		return nil, err
 	}
 
 	log := logrus.WithField("backup", "mail").WithField("userID", session.GetUser().ID)
-
-	ctx, cancel := context.WithCancel(ctx)
+	remote, _ := backupCloser.(*remoteFS)
 
 	return &RestoreTask{
 		ctx:          ctx,
 		ctxCancel:    cancel,
-		backupDir:    absPath,
+		canceller:    newTaskCanceller(cancel, session.GetPanicHandler()),
+		backupPath:   absPath,
+		backupFS:     backupFS,
+		backupCloser: backupCloser,
+		backupDir:    ".",
+		remote:       remote,
 		session:      session,
 		log:          log,
 		labelMapping: make(map[string]string),
+		timer:        newStageTimer(),
 	}, nil
 }
 
-func (r *RestoreTask) Run(reporter Reporter) error {
+// Run performs the restore and returns its final report. The report is also filled when an error is returned.
+func (r *RestoreTask) Run(reporter Reporter) (RestoreResult, error) {
+	defer r.canceller.finish()
+
+	r.ctx = withRateLimitReporter(r.ctx, reporter)
+
+	ctx, span := traceTask(r.ctx, "restore", r.timer)
+	r.ctx = ctx
+
+	r.heartbeat = startHeartbeat(reporter, HeartbeatInterval, "validation", r.session.GetPanicHandler())
+	defer r.heartbeat.stop()
+
+	if r.heartbeat != nil {
+		reporter = &heartbeatProgressReporter{Reporter: reporter, heartbeat: r.heartbeat}
+	}
+
+	r.events = startProgressEvents(reporter, ProgressEventInterval, "validation", r.session.GetPanicHandler())
+	defer r.events.stop()
+
+	if r.events != nil {
+		r.events.setBytesSource(r.getBytesTransferred)
+		reporter = &progressEventsReporter{Reporter: reporter, events: r.events}
+	}
+
+	err := r.run(reporter)
+	if err != nil && len(r.failures) == 0 {
+		r.failures = append(r.failures, Failure{Reason: err.Error()})
+	}
+
+	result := RestoreResult{
+		ImportableCount:  r.GetImportableCount(),
+		ImportedCount:    r.GetImportedCount(),
+		FailedCount:      r.GetFailedCount(),
+		SkippedCount:     r.GetSkippedCount(),
+		FilteredCount:    r.GetFilteredCount(),
+		DuplicateCount:   r.GetDuplicateCount(),
+		ResumedCount:     r.GetResumedCount(),
+		BytesTransferred: r.bytesTransferred,
+		Duration:         time.Since(r.startTime),
+		StageDurations:   r.timer.get(),
+		Failures:         r.failures,
+		CancelCause:      r.GetCancelCause(),
+		RolledBack:       r.rolledBack,
+	}
+
+	recordRestoreResult(ctx, &result)
+	tracing.End(span, err)
+
+	return result, err
+}
+
+func (r *RestoreTask) run(reporter Reporter) error {
 	r.startTime = time.Now()
 	defer func() { r.log.WithField("duration", time.Since(r.startTime)).Info("Finished") }()
-	r.log.WithField("backupDir", r.backupDir).Info("Starting")
+	r.log.WithField("backupPath", r.backupPath).Info("Starting")
+
+	var (
+		messageInfoList []messageInfo
+		err             error
+	)
 
-	messageInfoList, err := r.validateBackupDir(reporter)
+	r.measureStage("validation", func() { messageInfoList, err = r.validateBackupDir(reporter) })
 	if err != nil {
-		return err
+		return r.markFatal(err)
 	}
-	r.log.WithField("messageCount", len(messageInfoList)).Info("Found messages to import")
-
-	if err := r.restoreLabels(); err != nil {
-		return err
+	if err := r.startRestoreState(); err != nil {
+		return r.markFatal(err)
 	}
-
-	if err := r.createImportLabel(); err != nil {
-		return err
+	messageInfoList = r.skipImported(messageInfoList, reporter)
+	if r.skipDuplicates {
+		r.measureStage("dedupe", func() { messageInfoList, err = r.removeDuplicates(messageInfoList, reporter) })
+		if err != nil {
+			return r.markFatal(err)
+		}
 	}
 
-	err = r.importMails(messageInfoList, reporter)
+	r.log.WithField("messageCount", len(messageInfoList)).Info("Found messages to import")
+
+	err = r.restore(messageInfoList, reporter)
 
 	r.log.WithFields(logrus.Fields{
 		"importable": r.GetImportableCount(),
@@ -96,20 +198,89 @@ func (r *RestoreTask) Run(reporter Reporter) error {
 		"skipped":    r.GetSkippedCount(),
 	}).Info("Report")
 
+	r.finishRestoreState(err)
+	r.measureStage("rollback", func() { err = r.finishTransaction(err) })
+	r.logRollbackState()
+
+	return r.markFatal(err)
+}
+
+// markFatal records err as the cancellation cause of the task, unless the task was cancelled.
+func (r *RestoreTask) markFatal(err error) error {
+	if err != nil && !errors.Is(err, context.Canceled) {
+		r.ctxCancel(&FatalError{Err: err})
+	}
+
+	return err
+}
+
+func (r *RestoreTask) restore(messageInfoList []messageInfo, reporter Reporter) error {
+	var err error
+
+	r.measureStage("labels", func() { err = r.restoreLabels() })
+	if err != nil {
+		return err
+	}
+
+	// A resumed restore reuses the import label of the previous runs, see applyRestoreState.
+	if !r.noImportLabel && len(r.importLabelID) == 0 {
+		if err := r.createImportLabel(); err != nil {
+			return err
+		}
+	}
+
+	r.saveRestoreState(true)
+
+	r.measureStage("import", func() { err = r.importMails(messageInfoList, reporter) })
+
 	return err
 }
 
-func (r *RestoreTask) Cancel() {
-	r.cancelledByUser = true
-	r.ctxCancel()
+// measureStage records the duration of a stage and reports it in the heartbeats and progress events.
+func (r *RestoreTask) measureStage(stage string, fn func()) {
+	r.heartbeat.setStage(stage)
+	r.events.setStage(stage)
+	r.timer.measure(stage, fn)
+}
+
+func (r *RestoreTask) recordFailure(messageID string, err error) {
+	r.resultLock.Lock()
+	defer r.resultLock.Unlock()
+
+	r.failedCount++
+	r.failures = append(r.failures, Failure{MessageID: messageID, Reason: err.Error()})
+	r.guardrail.record(true)
+}
+
+// Cancel stops the restore. A graceful cancellation lets the batch being imported finish, it is escalated to an
+// immediate cancellation when ctx is done first.
+func (r *RestoreTask) Cancel(ctx context.Context, mode CancelMode) {
+	r.log.WithField("mode", mode).Info("Cancellation requested")
+	r.canceller.cancel(ctx, mode)
 }
 
 func (r *RestoreTask) Close() {
-	// Nothing to do so far.
+	r.canceller.finish()
+
+	if r.backupCloser == nil {
+		return
+	}
+
+	if err := r.backupCloser.Close(); err != nil {
+		r.log.WithError(err).Error("Failed to close backup archive")
+	}
+
+	r.backupCloser = nil
 }
 
+// GetBackupPath returns the path of the backup folder. For archives, the path of the folder inside the archive is
+// appended to the path of the archive, and for remote backups to their URL.
 func (r *RestoreTask) GetBackupPath() string {
-	return r.backupDir
+	if r.remote != nil {
+		return joinRemotePath(r.backupPath, r.backupDir)
+	}
+
+	return filepath.Join(r.backupPath, filepath.FromSlash(r.backupDir))
 }
 
 func (r *RestoreTask) GetImportableCount() int64 {
@@ -117,24 +288,52 @@ func (r *RestoreTask) GetImportableCount() int64 {
 }
 
 func (r *RestoreTask) GetImportedCount() int64 {
+	r.resultLock.Lock()
+	defer r.resultLock.Unlock()
+
 	return r.importedCount
 }
 
+// getBytesTransferred returns the size of the messages imported so far.
+func (r *RestoreTask) getBytesTransferred() uint64 {
+	r.resultLock.Lock()
+	defer r.resultLock.Unlock()
+
+	return r.bytesTransferred
+}
+
 func (r *RestoreTask) GetFailedCount() int64 {
+	r.resultLock.Lock()
+	defer r.resultLock.Unlock()
+
 	return r.failedCount
 }
 
 func (r *RestoreTask) GetSkippedCount() int64 {
+	r.resultLock.Lock()
+	defer r.resultLock.Unlock()
+
 	return r.importableCount - r.importedCount - r.failedCount
 }
 
 func (r *RestoreTask) GetOperationCancelledByUser() bool {
-	return r.cancelledByUser
+	return r.GetCancelCause() == CancelCauseUser
+}
+
+// GetCancelCause returns why the task was cancelled, or CancelCauseNone if it wasn't.
+func (r *RestoreTask) GetCancelCause() CancelCause {
+	return getCancelCause(r.ctx)
 }
 
 func (r *RestoreTask) withAddrKR(fn func(addrID string, addrKR *crypto.KeyRing) error) error {
-	client := r.session.GetClient()
-	addresses, err := client.GetAddresses(r.ctx)
+	return withPrimaryAddrKR(r.ctx, r.session, fn)
+}
+
+// withPrimaryAddrKR calls fn with the primary key of the first address of the account, the messages are imported
+// with it.
+func withPrimaryAddrKR(ctx context.Context, session *session.Session, fn func(addrID string, addrKR *crypto.KeyRing) error) error {
+	client := session.GetClient()
+	addresses, err := client.GetAddresses(ctx)
 	if err != nil {
 		return err
 	}
@@ -144,10 +343,9 @@ func (r *RestoreTask) withAddrKR(fn func(addrID string, addrKR *crypto.KeyRing)
 	}
 
 	addrID := addresses[0].ID
-	user := r.session.GetUser()
-	salts := r.session.GetUserSalts()
+	user := session.GetUser()
 
-	saltedKeyPass, err := salts.SaltForKey(r.session.GetMailboxPassword(), user.Keys.Primary().ID)
+	saltedKeyPass, err := session.GetSaltedKeyPass()
 	if err != nil {
 		return fmt.Errorf("failed to salt key password: %w", err)
 	}
@@ -0,0 +1,348 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+var ErrUnsupportedBackupArchive = errors.New("encrypted zip archives cannot be read without extraction, encrypt a tar archive instead")
+
+var backupArchiveExtensions = []string{".zip", ".tar"}                             //nolint:gochecknoglobals
+var compressedTarExtensions = []string{".tar.gz", ".tgz", ".tar.zst", ".tar.zstd"} //nolint:gochecknoglobals
+
+// IsBackupArchive returns true if path names an archive the restore can read directly, possibly encrypted as a whole
+// with the at rest key, see streamTarFS.
+func IsBackupArchive(path string) bool {
+	plainPath, _ := cutSealedArchiveExtension(path)
+
+	return hasExtension(plainPath, backupArchiveExtensions) || hasExtension(plainPath, compressedTarExtensions)
+}
+
+// cutSealedArchiveExtension returns path without its .gpg extension, and whether it had one.
+func cutSealedArchiveExtension(path string) (string, bool) {
+	return strings.CutSuffix(strings.ToLower(path), sealedExtension)
+}
+
+func hasExtension(path string, extensions []string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range extensions {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// openBackupFS returns the file system a backup is read from, and the closer of the archive if any. Folders are read in
+// place. Zip and tar archives are read without extraction: the entries are located once and each file is read from the
+// archive on demand. Compressed and encrypted tar archives are read sequentially, see streamTarFS. When the archive was
+// created from a parent folder of the backup, the single top level folders are skipped. The files stored in packs are
+// shown as regular files, see packFS.
+func openBackupFS(backupPath string) (fs.FS, io.Closer, error) {
+	if plainPath, encrypted := cutSealedArchiveExtension(backupPath); IsBackupArchive(backupPath) &&
+		(encrypted || hasExtension(plainPath, compressedTarExtensions)) {
+		if hasExtension(plainPath, []string{".zip"}) {
+			return nil, nil, ErrUnsupportedBackupArchive
+		}
+
+		stream := newStreamTarFS(backupPath, getTarCompression(plainPath), encrypted)
+
+		return newPackFS(stream), stream, nil
+	}
+
+	var (
+		fsys   fs.FS
+		closer io.Closer
+	)
+
+	switch {
+	case hasExtension(backupPath, []string{".zip"}):
+		reader, err := zip.OpenReader(backupPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open zip archive: %w", err)
+		}
+
+		fsys, closer = reader, reader
+
+	case hasExtension(backupPath, []string{".tar"}):
+		tarFS, err := newTarFS(backupPath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		fsys, closer = tarFS, tarFS
+
+	default:
+		return newPackFS(os.DirFS(backupPath)), nil, nil
+	}
+
+	sub, err := skipWrapperDirs(fsys)
+	if err != nil {
+		_ = closer.Close()
+		return nil, nil, err
+	}
+
+	return newPackFS(sub), closer, nil
+}
+
+// skipWrapperDirs descends into the root folder while it only contains a single folder that is not a backup folder.
+func skipWrapperDirs(fsys fs.FS) (fs.FS, error) {
+	root, err := findBackupRoot(fsys)
+	if err != nil || root == "." {
+		return fsys, err
+	}
+
+	sub, err := fs.Sub(fsys, root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive folder: %w", err)
+	}
+
+	return sub, nil
+}
+
+// findBackupRoot returns the folder skipWrapperDirs descends into.
+func findBackupRoot(fsys fs.FS) (string, error) {
+	root := "."
+
+	for {
+		entries, err := fs.ReadDir(fsys, root)
+		if err != nil {
+			return "", fmt.Errorf("failed to list archive: %w", err)
+		}
+
+		if len(entries) != 1 || !entries[0].IsDir() || mailFolderRegExp.MatchString(entries[0].Name()) {
+			return root, nil
+		}
+
+		root = path.Join(root, entries[0].Name())
+	}
+}
+
+// tarFS gives random access to the files of an uncompressed tar archive. The archive is scanned once to record the
+// offset of each file, the content is not read until the file is opened.
+type tarFS struct {
+	file    *os.File // The archive, or the spill file of a streamed archive.
+	entries map[string]*tarEntry
+	stream  *tarStream // Reads the files that were not spilled, set for streamed archives, see streamTarFS.
+}
+
+type tarEntry struct {
+	name     string
+	info     fs.FileInfo
+	offset   int64    // Offset of the content in file, -1 when it is read from the stream.
+	position int      // Position of the entry in a streamed archive.
+	children []string // Names of the direct children, for folders.
+}
+
+func newTarFS(archivePath string) (*tarFS, error) {
+	file, err := os.Open(archivePath) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tar archive: %w", err)
+	}
+
+	t := newEmptyTarFS(file)
+
+	if err := t.index(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *tarFS) index() error {
+	reader := tar.NewReader(t.file)
+
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read tar archive: %w", err)
+		}
+
+		name := path.Clean(strings.TrimPrefix(header.Name, "/"))
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			t.addDir(name).info = header.FileInfo()
+
+		case tar.TypeReg:
+			// The tar reader does not read ahead, the file position is the start of the content.
+			offset, err := t.file.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return fmt.Errorf("failed to locate tar entry: %w", err)
+			}
+
+			t.addFile(name, header.FileInfo()).offset = offset
+		}
+	}
+
+	t.sortChildren()
+
+	return nil
+}
+
+func newEmptyTarFS(file *os.File) *tarFS {
+	return &tarFS{
+		file:    file,
+		entries: map[string]*tarEntry{".": {name: ".", info: tarDirInfo(".")}},
+	}
+}
+
+// addFile records a regular file and its folders. A file found twice is the last one, like when it is extracted.
+func (t *tarFS) addFile(name string, info fs.FileInfo) *tarEntry {
+	if _, ok := t.entries[name]; !ok {
+		parent := t.addDir(path.Dir(name))
+		parent.children = append(parent.children, path.Base(name))
+	}
+
+	entry := &tarEntry{name: name, info: info}
+	t.entries[name] = entry
+
+	return entry
+}
+
+func (t *tarFS) sortChildren() {
+	for _, entry := range t.entries {
+		sort.Strings(entry.children)
+	}
+}
+
+// addDir records the folder and its parents, folders do not need their own entry in the archive.
+func (t *tarFS) addDir(name string) *tarEntry {
+	if entry, ok := t.entries[name]; ok {
+		return entry
+	}
+
+	entry := &tarEntry{name: name, info: tarDirInfo(name)}
+	t.entries[name] = entry
+
+	parent := t.addDir(path.Dir(name))
+	parent.children = append(parent.children, path.Base(name))
+
+	return entry
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	entry, ok := t.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if entry.info.IsDir() {
+		return &tarDir{fs: t, entry: entry}, nil
+	}
+
+	if entry.offset < 0 {
+		data, err := t.stream.read(entry)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		return &tarFile{entry: entry, reader: io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))}, nil
+	}
+
+	return &tarFile{entry: entry, reader: io.NewSectionReader(t.file, entry.offset, entry.info.Size())}, nil
+}
+
+func (t *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	file, err := t.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, ok := file.(*tarDir)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	return dir.ReadDir(-1)
+}
+
+func (t *tarFS) Close() error {
+	return t.file.Close()
+}
+
+type tarFile struct {
+	entry  *tarEntry
+	reader *io.SectionReader
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.entry.info, nil }
+func (f *tarFile) Read(b []byte) (int, error) { return f.reader.Read(b) }
+func (f *tarFile) Close() error               { return nil }
+
+func (f *tarFile) ReadAt(b []byte, off int64) (int, error) { return f.reader.ReadAt(b, off) }
+
+type tarDir struct {
+	fs     *tarFS
+	entry  *tarEntry
+	offset int
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.entry.info, nil }
+func (d *tarDir) Close() error               { return nil }
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.name, Err: errors.New("is a directory")}
+}
+
+func (d *tarDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	remaining := d.entry.children[d.offset:]
+	if count > 0 && len(remaining) == 0 {
+		return nil, io.EOF
+	}
+
+	if count > 0 && count < len(remaining) {
+		remaining = remaining[:count]
+	}
+
+	result := make([]fs.DirEntry, 0, len(remaining))
+	for _, child := range remaining {
+		result = append(result, fs.FileInfoToDirEntry(d.fs.entries[path.Join(d.entry.name, child)].info))
+	}
+
+	d.offset += len(remaining)
+
+	return result, nil
+}
+
+// tarDirInfo describes the folders that have no entry of their own in the archive.
+func tarDirInfo(name string) fs.FileInfo {
+	return (&tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: 0o700}).FileInfo()
+}
@@ -0,0 +1,421 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+)
+
+// Streamed archives
+// -----------------
+// Compressed tar archives, and tar archives encrypted as a whole with the at rest key (e.g. backup.tar.zst.gpg made
+// with gpg), can only be read from the start. They are read once when first used to list their entries: the files
+// other than the messages, such as the metadata files, are copied to a temporary spill file, which gives them random
+// access. The messages are left in the archive and read from the stream when they are opened.
+//
+// The restore imports the messages in the order of the archive, see getArchivePosition, so that the messages are read
+// in a single pass whatever the size of the archive. Opening a message that comes before the last one read starts the
+// stream over from the beginning.
+
+type tarCompression int
+
+const (
+	tarUncompressed tarCompression = iota
+	tarGzip
+	tarZstd
+)
+
+func getTarCompression(path string) tarCompression {
+	switch {
+	case hasExtension(path, []string{".tar.gz", ".tgz"}):
+		return tarGzip
+	case hasExtension(path, []string{".tar.zst", ".tar.zstd"}):
+		return tarZstd
+	default:
+		return tarUncompressed
+	}
+}
+
+// isStreamedEntry returns whether a file of a streamed archive is read from the stream instead of being spilled.
+func isStreamedEntry(name string) bool {
+	return strings.HasSuffix(name, emlExtension) || strings.HasSuffix(name, emlExtension+sealedExtension)
+}
+
+// streamTarFS is the file system of a streamed archive. The archive is listed when first used, so that the key of an
+// encrypted archive can be set after it is opened, see setKey. It is safe for concurrent use.
+type streamTarFS struct {
+	lock        sync.Mutex
+	path        string
+	compression tarCompression
+	encrypted   bool
+	key         *AtRestKey
+	archive     *tarFS // Nil until the archive is listed.
+	root        string // Folder of the backup in the archive, see findBackupRoot.
+	fsys        fs.FS  // Files of the root folder.
+	indexErr    error
+}
+
+func newStreamTarFS(archivePath string, compression tarCompression, encrypted bool) *streamTarFS {
+	return &streamTarFS{path: archivePath, compression: compression, encrypted: encrypted}
+}
+
+// setKey sets the key decrypting an encrypted archive. It must be called before the archive is used.
+func (s *streamTarFS) setKey(key *AtRestKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.key = key
+}
+
+func (s *streamTarFS) Open(name string) (fs.File, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.index(); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return s.fsys.Open(name)
+}
+
+func (s *streamTarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.index(); err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	return fs.ReadDir(s.fsys, name)
+}
+
+// getArchivePosition returns the position of a file in the archive, which is also the one of its encrypted version
+// when the backup is encrypted at rest.
+func (s *streamTarFS) getArchivePosition(name string) (int, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.archive == nil {
+		return 0, false
+	}
+
+	for _, candidate := range []string{name, name + sealedExtension} {
+		if entry, ok := s.archive.entries[path.Join(s.root, candidate)]; ok {
+			return entry.position, true
+		}
+	}
+
+	return 0, false
+}
+
+func (s *streamTarFS) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.archive == nil {
+		return nil
+	}
+
+	s.archive.stream.close()
+
+	err := s.archive.Close()
+	if removeErr := os.Remove(s.archive.file.Name()); err == nil {
+		err = removeErr
+	}
+
+	return err
+}
+
+// index lists the archive on first use. The lock must be held.
+func (s *streamTarFS) index() error {
+	if s.archive != nil || s.indexErr != nil {
+		return s.indexErr
+	}
+
+	if s.encrypted && s.key == nil {
+		return ErrAtRestKeyRequired
+	}
+
+	spill, err := os.CreateTemp("", "export-tool-archive-*")
+	if err != nil {
+		return fmt.Errorf("failed to create archive spill file: %w", err)
+	}
+
+	archive := newEmptyTarFS(spill)
+	archive.stream = &tarStream{open: s.openCursor}
+
+	if s.indexErr = s.spill(archive); s.indexErr != nil {
+		_ = spill.Close()
+		_ = os.Remove(spill.Name())
+
+		return s.indexErr
+	}
+
+	root, err := findBackupRoot(archive)
+	if err == nil {
+		s.fsys, err = fs.Sub(archive, root)
+	}
+
+	if err != nil {
+		s.indexErr = err
+		archive.stream.close()
+		_ = spill.Close()
+		_ = os.Remove(spill.Name())
+
+		return err
+	}
+
+	s.archive, s.root = archive, root
+
+	return nil
+}
+
+// spill reads the whole archive, recording its entries and copying the files that are not read from the stream.
+func (s *streamTarFS) spill(archive *tarFS) error {
+	logrus.WithField("archive", s.path).Info("Listing the files of the archive")
+
+	cursor, err := s.openCursor()
+	if err != nil {
+		return err
+	}
+	defer cursor.close()
+
+	var offset int64
+
+	for {
+		header, err := cursor.next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read tar archive: %w", err)
+		}
+
+		name := path.Clean(strings.TrimPrefix(header.Name, "/"))
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			archive.addDir(name).info = header.FileInfo()
+
+		case tar.TypeReg:
+			entry := archive.addFile(name, header.FileInfo())
+			entry.position = cursor.position
+
+			if isStreamedEntry(name) {
+				entry.offset = -1
+				continue
+			}
+
+			n, err := io.Copy(archive.file, cursor.reader)
+			if err != nil {
+				return fmt.Errorf("failed to copy '%v' from the archive: %w", name, err)
+			}
+
+			entry.offset = offset
+			offset += n
+		}
+	}
+
+	// The integrity of an encrypted archive is only checked at the end of the OpenPGP message.
+	if _, err := io.Copy(io.Discard, cursor.stream); err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	archive.sortChildren()
+
+	return nil
+}
+
+// openCursor starts reading the archive from the beginning.
+func (s *streamTarFS) openCursor() (*tarCursor, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+
+	var key *AtRestKey
+	if s.encrypted {
+		key = s.key
+	}
+
+	cursor := &tarCursor{file: file, position: -1}
+
+	if err := cursor.init(s.compression, key); err != nil {
+		cursor.close()
+		return nil, err
+	}
+
+	return cursor, nil
+}
+
+// tarStream reads the files of a streamed archive that were not spilled. It is not safe for concurrent use, the
+// streamTarFS lock protects it.
+type tarStream struct {
+	open   func() (*tarCursor, error)
+	cursor *tarCursor
+}
+
+func (t *tarStream) read(entry *tarEntry) ([]byte, error) {
+	if t.cursor != nil && t.cursor.position >= entry.position {
+		logrus.WithField("file", entry.name).Debug("File is behind the archive stream, reading the archive again")
+		t.close()
+	}
+
+	if t.cursor == nil {
+		cursor, err := t.open()
+		if err != nil {
+			return nil, err
+		}
+
+		t.cursor = cursor
+	}
+
+	for t.cursor.position < entry.position {
+		if _, err := t.cursor.next(); err != nil {
+			t.close()
+			return nil, fmt.Errorf("failed to read tar archive: %w", err)
+		}
+	}
+
+	data, err := io.ReadAll(t.cursor.reader)
+	if err != nil {
+		t.close()
+		return nil, fmt.Errorf("failed to read tar archive: %w", err)
+	}
+
+	return data, nil
+}
+
+func (t *tarStream) close() {
+	if t.cursor != nil {
+		t.cursor.close()
+		t.cursor = nil
+	}
+}
+
+// tarCursor is a position in the stream of an archive.
+type tarCursor struct {
+	file     *os.File
+	decoder  *zstd.Decoder // Set for zstd archives, it must be closed.
+	stream   io.Reader     // Decrypted and decompressed archive.
+	reader   *tar.Reader
+	position int // Position of the current entry.
+}
+
+func (c *tarCursor) init(compression tarCompression, key *AtRestKey) error {
+	c.stream = bufio.NewReaderSize(c.file, 1<<20)
+
+	if key != nil {
+		decrypted, err := key.openStream(c.stream)
+		if err != nil {
+			return err
+		}
+
+		c.stream = decrypted
+	}
+
+	switch compression {
+	case tarGzip:
+		decompressed, err := gzip.NewReader(c.stream)
+		if err != nil {
+			return fmt.Errorf("failed to read gzip archive: %w", err)
+		}
+
+		c.stream = decompressed
+
+	case tarZstd:
+		decoder, err := zstd.NewReader(c.stream)
+		if err != nil {
+			return fmt.Errorf("failed to read zstd archive: %w", err)
+		}
+
+		c.decoder, c.stream = decoder, decoder
+
+	case tarUncompressed:
+	}
+
+	c.reader = tar.NewReader(c.stream)
+
+	return nil
+}
+
+func (c *tarCursor) next() (*tar.Header, error) {
+	header, err := c.reader.Next()
+	if err == nil {
+		c.position++
+	}
+
+	return header, err
+}
+
+func (c *tarCursor) close() {
+	if c.decoder != nil {
+		c.decoder.Close()
+	}
+
+	_ = c.file.Close()
+}
+
+// openStream returns the decrypted content of an OpenPGP message encrypted with the key, which is read as it goes. The
+// integrity of the message is checked when its end is read.
+func (k *AtRestKey) openStream(r io.Reader) (io.Reader, error) {
+	if !k.canDecrypt {
+		return nil, fmt.Errorf("a public key cannot decrypt the backup, use the private key")
+	}
+
+	var keyRing openpgp.EntityList
+
+	if k.keyRing != nil {
+		for _, key := range k.keyRing.GetKeys() {
+			keyRing = append(keyRing, key.GetEntity())
+		}
+	}
+
+	prompted := false
+
+	message, err := openpgp.ReadMessage(r, keyRing, func(_ []openpgp.Key, symmetric bool) ([]byte, error) {
+		if !symmetric || len(k.passphrase) == 0 || prompted {
+			return nil, errors.New("the archive is not encrypted with this key or passphrase")
+		}
+
+		prompted = true
+
+		return k.passphrase, nil
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt archive: %w", err)
+	}
+
+	return message.UnverifiedBody, nil
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+var testArchiveFiles = map[string]string{ //nolint:gochecknoglobals
+	"user@proton.me/mail_20240102_030405/labels.json":                    "[]",
+	"user@proton.me/mail_20240102_030405/msg.eml":                        "Subject: test\r\n\r\nBody",
+	"user@proton.me/mail_20240102_030405/msg.metadata.json":              "{}",
+	"user@proton.me/mail_20240102_030405/attachments/0123456789abcdef00": "content",
+}
+
+func TestOpenBackupFS_Tar(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "backup.tar")
+	require.NoError(t, os.WriteFile(archivePath, newTestTarArchive(t), 0o600))
+
+	checkBackupArchive(t, archivePath, nil)
+}
+
+func newTestTarArchive(t *testing.T) []byte {
+	var buffer bytes.Buffer
+
+	writer := tar.NewWriter(&buffer)
+	require.NoError(t, writer.WriteHeader(&tar.Header{Name: "user@proton.me/", Typeflag: tar.TypeDir, Mode: 0o700}))
+
+	for name, content := range testArchiveFiles {
+		require.NoError(t, writer.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o600, Size: int64(len(content))}))
+		_, err := writer.Write([]byte(content))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Close())
+
+	return buffer.Bytes()
+}
+
+func TestOpenBackupFS_Zip(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "backup.ZIP")
+
+	file, err := os.Create(archivePath)
+	require.NoError(t, err)
+
+	writer := zip.NewWriter(file)
+
+	for name, content := range testArchiveFiles {
+		entry, err := writer.Create(name)
+		require.NoError(t, err)
+		_, err = entry.Write([]byte(content))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Close())
+	require.NoError(t, file.Close())
+
+	checkBackupArchive(t, archivePath, nil)
+}
+
+func TestOpenBackupFS_CompressedTar(t *testing.T) {
+	dir := t.TempDir()
+
+	var gzipped bytes.Buffer
+
+	gzipWriter := gzip.NewWriter(&gzipped)
+	_, err := gzipWriter.Write(newTestTarArchive(t))
+	require.NoError(t, err)
+	require.NoError(t, gzipWriter.Close())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "backup.tgz"), gzipped.Bytes(), 0o600))
+	checkBackupArchive(t, filepath.Join(dir, "backup.tgz"), nil)
+
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "backup.tar.zst"), encoder.EncodeAll(newTestTarArchive(t), nil), 0o600))
+	checkBackupArchive(t, filepath.Join(dir, "backup.tar.zst"), nil)
+}
+
+func TestOpenBackupFS_EncryptedTar(t *testing.T) {
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "backup.tar.gpg")
+
+	encrypted, err := crypto.EncryptMessageWithPassword(crypto.NewPlainMessage(newTestTarArchive(t)), []byte("hunter2"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(archivePath, encrypted.GetBinary(), 0o600))
+
+	key, err := NewAtRestPassphrase([]byte("hunter2"))
+	require.NoError(t, err)
+
+	checkBackupArchive(t, archivePath, key)
+
+	// The archive cannot be listed without the key, nor with another one.
+	fsys, closer, err := openBackupFS(archivePath)
+	require.NoError(t, err)
+
+	_, err = fs.ReadDir(fsys, ".")
+	require.ErrorIs(t, err, ErrAtRestKeyRequired)
+	require.NoError(t, closer.Close())
+
+	wrongKey, err := NewAtRestPassphrase([]byte("wrong"))
+	require.NoError(t, err)
+
+	fsys, closer, err = openBackupFS(archivePath)
+	require.NoError(t, err)
+	closer.(*streamTarFS).setKey(wrongKey) //nolint:forcetypeassert
+
+	_, err = fs.ReadDir(fsys, ".")
+	require.Error(t, err)
+	require.NoError(t, closer.Close())
+
+	_, _, err = openBackupFS(filepath.Join(dir, "backup.zip.gpg"))
+	require.ErrorIs(t, err, ErrUnsupportedBackupArchive)
+}
+
+func TestStreamTarFS_ArchivePosition(t *testing.T) {
+	var buffer bytes.Buffer
+
+	writer := tar.NewWriter(&buffer)
+
+	for _, name := range []string{"backup/b.eml", "backup/b.metadata.json", "backup/a.eml", "backup/a.metadata.json"} {
+		require.NoError(t, writer.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o600, Size: int64(len(name))}))
+		_, err := writer.Write([]byte(name))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Close())
+
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+
+	archivePath := filepath.Join(t.TempDir(), "backup.tar.zst")
+	require.NoError(t, os.WriteFile(archivePath, encoder.EncodeAll(buffer.Bytes(), nil), 0o600))
+
+	fsys, closer, err := openBackupFS(archivePath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, closer.Close()) }()
+
+	stream := closer.(*streamTarFS) //nolint:forcetypeassert
+
+	// The wrapper folder is skipped.
+	content, err := fs.ReadFile(fsys, "a.eml")
+	require.NoError(t, err)
+	require.Equal(t, "backup/a.eml", string(content))
+
+	// Reading a message before the last one read starts over.
+	content, err = fs.ReadFile(fsys, "b.eml")
+	require.NoError(t, err)
+	require.Equal(t, "backup/b.eml", string(content))
+
+	positionA, ok := stream.getArchivePosition("a.eml")
+	require.True(t, ok)
+
+	positionB, ok := stream.getArchivePosition("b.eml")
+	require.True(t, ok)
+	require.Less(t, positionB, positionA)
+
+	_, ok = stream.getArchivePosition("c.eml")
+	require.False(t, ok)
+}
+
+func checkBackupArchive(t *testing.T, archivePath string, key *AtRestKey) {
+	require.True(t, IsBackupArchive(archivePath))
+
+	fsys, closer, err := openBackupFS(archivePath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, closer.Close()) }()
+
+	if stream, ok := closer.(*streamTarFS); ok {
+		stream.setKey(key)
+	}
+
+	// The user@proton.me wrapper folder is skipped.
+	require.NoError(t, fstest.TestFS(fsys,
+		"mail_20240102_030405/labels.json",
+		"mail_20240102_030405/msg.eml",
+		"mail_20240102_030405/msg.metadata.json",
+		"mail_20240102_030405/attachments/0123456789abcdef00",
+	))
+
+	content, err := fs.ReadFile(fsys, "mail_20240102_030405/msg.eml")
+	require.NoError(t, err)
+	require.Equal(t, "Subject: test\r\n\r\nBody", string(content))
+
+	store := newFileDetachedAttachmentStore(fsys, "mail_20240102_030405")
+	require.NotNil(t, store)
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/ProtonMail/export-tool/internal/session"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	calendarBackupDir  = "calendar"
+	iCalendarExtension = ".ics"
+	maxICSLineSize     = 32 * 1024 * 1024
+)
+
+// ErrCalendarRestoreUnsupported is returned by the restore of the calendar events, the API client cannot create events.
+var ErrCalendarRestoreUnsupported = errors.New("calendar events cannot be restored by the export tool yet, import the ICS files from the Calendar settings")
+
+// CalendarRestoreTask checks the ICS files of a backup and counts their events. Creating the events requires the
+// calendar keys and the event endpoints, which the API client does not support: the events are reported as skipped
+// and Restore returns ErrCalendarRestoreUnsupported so that the user can import the files from the Calendar app.
+type CalendarRestoreTask struct {
+	ctx       context.Context
+	ctxCancel context.CancelCauseFunc
+	canceller *taskCanceller
+	backupFS  fs.FS
+	closeFS   func()
+	files     []string
+	log       *logrus.Entry
+}
+
+// newCalendarRestoreTask returns nil when the backup has no 'calendar' folder holding ICS files.
+func newCalendarRestoreTask(ctx context.Context, backupPath string, session *session.Session) (Restorer, error) {
+	backupFS, closeFS, files, err := openBackupFolder(ctx, backupPath, calendarBackupDir, iCalendarExtension)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	return &CalendarRestoreTask{
+		ctx:       ctx,
+		ctxCancel: cancel,
+		canceller: newTaskCanceller(cancel, session.GetPanicHandler()),
+		backupFS:  backupFS,
+		closeFS:   closeFS,
+		files:     files,
+		log:       logrus.WithField("restore", "calendar").WithField("userID", session.GetUser().ID),
+	}, nil
+}
+
+func (t *CalendarRestoreTask) Kind() string {
+	return "calendar"
+}
+
+func (t *CalendarRestoreTask) Restore(reporter Reporter) (RestoreSummary, error) {
+	defer t.canceller.finish()
+
+	var summary RestoreSummary
+
+	for _, file := range t.files {
+		if err := t.ctx.Err(); err != nil {
+			summary.CancelCause = getCancelCause(t.ctx)
+			return summary, err
+		}
+
+		count, err := countICSEvents(t.backupFS, file)
+		if err != nil {
+			return summary, err
+		}
+
+		summary.ImportableCount += int64(count)
+		summary.Failures = append(summary.Failures, Failure{MessageID: file, Reason: ErrCalendarRestoreUnsupported.Error()})
+	}
+
+	summary.SkippedCount = summary.ImportableCount
+	reporter.SetMessageTotal(uint64(summary.ImportableCount))
+	reporter.SetMessageProcessed(uint64(summary.ImportableCount))
+
+	t.log.WithFields(logrus.Fields{"fileCount": len(t.files), "eventCount": summary.ImportableCount}).Warn("Calendar events not restored")
+
+	return summary, ErrCalendarRestoreUnsupported
+}
+
+// countICSEvents checks that file is an iCalendar file and counts its events.
+func countICSEvents(fsys fs.FS, file string) (int, error) {
+	f, err := fsys.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	var (
+		count    int
+		calendar bool
+	)
+
+	// The events can hold attachments, the lines are not limited to the default size.
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxICSLineSize)
+
+	for scanner.Scan() {
+		switch line := strings.ToUpper(strings.TrimSpace(scanner.Text())); line {
+		case "BEGIN:VCALENDAR":
+			calendar = true
+		case "BEGIN:VEVENT":
+			count++
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read '%v': %w", file, err)
+	}
+
+	if !calendar {
+		return 0, fmt.Errorf("'%v' is not an iCalendar file", file)
+	}
+
+	return count, nil
+}
+
+func (t *CalendarRestoreTask) Cancel(ctx context.Context, mode CancelMode) {
+	t.canceller.cancel(ctx, mode)
+}
+
+func (t *CalendarRestoreTask) Close() {
+	t.canceller.finish()
+
+	if t.closeFS != nil {
+		t.closeFS()
+		t.closeFS = nil
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/session"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/emersion/go-vcard"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	contactsBackupDir = "contacts"
+	vCardExtension    = ".vcf"
+
+	// contactBatchSize is the number of contacts created per request.
+	contactBatchSize = 10
+)
+
+// contactSignedFields are the vCard fields of the signed card, readable by the server to look up the contacts by
+// address. The other fields are encrypted.
+//
+//nolint:gochecknoglobals
+var contactSignedFields = map[string]bool{
+	vcard.FieldVersion:       true,
+	vcard.FieldFormattedName: true,
+	vcard.FieldUID:           true,
+	vcard.FieldEmail:         true,
+}
+
+// ContactsRestoreTask creates the contacts of the vCard files of a backup. The contacts are added to the existing ones,
+// they are not merged with the contacts having the same address.
+type ContactsRestoreTask struct {
+	ctx       context.Context
+	ctxCancel context.CancelCauseFunc
+	canceller *taskCanceller
+	backupFS  fs.FS
+	closeFS   func()
+	files     []string
+	session   *session.Session
+	log       *logrus.Entry
+	summary   RestoreSummary
+}
+
+// newContactsRestoreTask returns nil when the backup has no 'contacts' folder holding vCard files.
+func newContactsRestoreTask(ctx context.Context, backupPath string, session *session.Session) (Restorer, error) {
+	backupFS, closeFS, files, err := openBackupFolder(ctx, backupPath, contactsBackupDir, vCardExtension)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	return &ContactsRestoreTask{
+		ctx:       ctx,
+		ctxCancel: cancel,
+		canceller: newTaskCanceller(cancel, session.GetPanicHandler()),
+		backupFS:  backupFS,
+		closeFS:   closeFS,
+		files:     files,
+		session:   session,
+		log:       logrus.WithField("restore", "contacts").WithField("userID", session.GetUser().ID),
+	}, nil
+}
+
+func (t *ContactsRestoreTask) Kind() string {
+	return "contacts"
+}
+
+func (t *ContactsRestoreTask) Restore(reporter Reporter) (RestoreSummary, error) {
+	defer t.canceller.finish()
+
+	startTime := time.Now()
+	t.log.WithField("fileCount", len(t.files)).Info("Starting")
+
+	err := t.run(reporter)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		t.ctxCancel(&FatalError{Err: err})
+	}
+
+	t.summary.CancelCause = getCancelCause(t.ctx)
+	t.summary.SkippedCount = t.summary.ImportableCount - t.summary.ImportedCount - t.summary.FailedCount
+
+	t.log.WithFields(logrus.Fields{
+		"importable": t.summary.ImportableCount,
+		"imported":   t.summary.ImportedCount,
+		"failed":     t.summary.FailedCount,
+		"duration":   time.Since(startTime),
+	}).Info("Finished")
+
+	return t.summary, err
+}
+
+func (t *ContactsRestoreTask) run(reporter Reporter) error {
+	cards, origins, err := t.readCards()
+	if err != nil {
+		return err
+	}
+
+	t.summary.ImportableCount = int64(len(cards))
+	reporter.SetMessageTotal(uint64(len(cards)))
+	reporter.SetMessageProcessed(0)
+
+	userKR, err := unlockUserKR(t.session)
+	if err != nil {
+		return err
+	}
+	defer userKR.ClearPrivateParams()
+
+	for start := 0; start < len(cards); start += contactBatchSize {
+		// The batch being created finished, a graceful cancellation takes effect.
+		if t.canceller.isStopping() {
+			t.ctxCancel(ErrCancelledByUser)
+		}
+
+		if err := t.ctx.Err(); err != nil {
+			return err
+		}
+
+		end := min(start+contactBatchSize, len(cards))
+		t.createContacts(userKR, cards[start:end], origins[start:end])
+		reporter.OnProgress(end - start)
+	}
+
+	return nil
+}
+
+// readCards decodes the cards of the vCard files. A file can hold several cards. The origin of a card is its file and
+// its position in the file.
+func (t *ContactsRestoreTask) readCards() ([]vcard.Card, []string, error) {
+	var (
+		cards   []vcard.Card
+		origins []string
+	)
+
+	for _, file := range t.files {
+		fileCards, err := readVCardFile(t.backupFS, file)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i, card := range fileCards {
+			cards = append(cards, card)
+			origins = append(origins, fmt.Sprintf("%v#%v", file, i+1))
+		}
+	}
+
+	return cards, origins, nil
+}
+
+func readVCardFile(fsys fs.FS, file string) ([]vcard.Card, error) {
+	f, err := fsys.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	var cards []vcard.Card
+
+	decoder := vcard.NewDecoder(f)
+
+	for {
+		card, err := decoder.Decode()
+		if errors.Is(err, io.EOF) {
+			return cards, nil
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read '%v': %w", file, err)
+		}
+
+		cards = append(cards, card)
+	}
+}
+
+func (t *ContactsRestoreTask) createContacts(userKR *crypto.KeyRing, cards []vcard.Card, origins []string) {
+	req := proton.CreateContactsReq{Contacts: make([]proton.ContactCards, 0, len(cards))}
+	reqOrigins := make([]string, 0, len(cards))
+
+	for i, card := range cards {
+		contact, err := newContactCards(userKR, card)
+		if err != nil {
+			t.log.WithField("origin", origins[i]).WithError(err).Error("Failed to prepare contact")
+			t.recordFailure(origins[i], err)
+
+			continue
+		}
+
+		req.Contacts = append(req.Contacts, contact)
+		reqOrigins = append(reqOrigins, origins[i])
+	}
+
+	if len(req.Contacts) == 0 {
+		return
+	}
+
+	results, err := t.session.GetClient().CreateContacts(t.ctx, req)
+	if err != nil {
+		t.log.WithError(err).Error("Failed to create contact batch")
+
+		for _, origin := range reqOrigins {
+			t.recordFailure(origin, err)
+		}
+
+		return
+	}
+
+	for _, result := range results {
+		if result.Index < 0 || result.Index >= len(reqOrigins) {
+			continue
+		}
+
+		if result.Response.Code != proton.SuccessCode {
+			t.log.WithField("origin", reqOrigins[result.Index]).WithError(result.Response.APIError).Error("Failed to create contact")
+			t.recordFailure(reqOrigins[result.Index], result.Response.APIError)
+
+			continue
+		}
+
+		t.summary.ImportedCount++
+	}
+}
+
+func (t *ContactsRestoreTask) recordFailure(origin string, err error) {
+	t.summary.FailedCount++
+	t.summary.Failures = append(t.summary.Failures, Failure{MessageID: origin, Reason: err.Error()})
+}
+
+// Cancel stops the restore. A graceful cancellation lets the batch being created finish.
+func (t *ContactsRestoreTask) Cancel(ctx context.Context, mode CancelMode) {
+	t.log.WithField("mode", mode).Info("Cancellation requested")
+	t.canceller.cancel(ctx, mode)
+}
+
+func (t *ContactsRestoreTask) Close() {
+	t.canceller.finish()
+
+	if t.closeFS != nil {
+		t.closeFS()
+		t.closeFS = nil
+	}
+}
+
+// newContactCards splits card like the Proton apps: the name, the addresses and the UID are in a signed card, the
+// other fields in a signed and encrypted card. Both are signed with the primary user key.
+func newContactCards(userKR *crypto.KeyRing, card vcard.Card) (proton.ContactCards, error) {
+	vcard.ToV4(card)
+
+	if len(card.Value(vcard.FieldUID)) == 0 {
+		card.SetValue(vcard.FieldUID, "proton-export-"+uuid.NewString())
+	}
+
+	if len(strings.TrimSpace(card.Value(vcard.FieldFormattedName))) == 0 {
+		name := card.Value(vcard.FieldEmail)
+		if len(name) == 0 {
+			return proton.ContactCards{}, errors.New("the contact has no name and no address")
+		}
+
+		card.SetValue(vcard.FieldFormattedName, name)
+	}
+
+	signed := vcard.Card{}
+	encrypted := vcard.Card{}
+
+	for key, fields := range card {
+		target := encrypted
+		if contactSignedFields[key] {
+			target = signed
+		}
+
+		for _, field := range fields {
+			target.Add(key, field)
+		}
+	}
+
+	signedCard, err := newContactCard(userKR, proton.CardTypeSigned, signed)
+	if err != nil {
+		return proton.ContactCards{}, err
+	}
+
+	cards := proton.Cards{signedCard}
+
+	if len(encrypted) != 0 {
+		encrypted.SetValue(vcard.FieldVersion, "4.0")
+
+		encryptedCard, err := newContactCard(userKR, proton.CardTypeEncrypted|proton.CardTypeSigned, encrypted)
+		if err != nil {
+			return proton.ContactCards{}, err
+		}
+
+		cards = append(cards, encryptedCard)
+	}
+
+	return proton.ContactCards{Cards: cards}, nil
+}
+
+func newContactCard(userKR *crypto.KeyRing, cardType proton.CardType, card vcard.Card) (*proton.Card, error) {
+	var data strings.Builder
+
+	if err := vcard.NewEncoder(&data).Encode(card); err != nil {
+		return nil, fmt.Errorf("failed to encode contact: %w", err)
+	}
+
+	result := &proton.Card{Type: cardType, Data: data.String()}
+	message := crypto.NewPlainMessageFromString(result.Data)
+
+	if cardType&proton.CardTypeSigned != 0 {
+		signature, err := userKR.SignDetached(message)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign contact: %w", err)
+		}
+
+		if result.Signature, err = signature.GetArmored(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cardType&proton.CardTypeEncrypted != 0 {
+		encrypted, err := userKR.Encrypt(message, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt contact: %w", err)
+		}
+
+		if result.Data, err = encrypted.GetArmored(); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// unlockUserKR unlocks the primary user key of the account, the contacts are signed and encrypted with it.
+func unlockUserKR(session *session.Session) (*crypto.KeyRing, error) {
+	user := session.GetUser()
+
+	saltedKeyPass, err := session.GetSaltedKeyPass()
+	if err != nil {
+		return nil, fmt.Errorf("failed to salt key password: %w", err)
+	}
+
+	userKR, err := user.Keys.Unlock(saltedKeyPass, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlock user keys: %w", err)
+	}
+	defer userKR.ClearPrivateParams()
+
+	if userKR.CountDecryptionEntities() == 0 {
+		return nil, errors.New("failed to unlock user keys")
+	}
+
+	return userKR.FirstKey()
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/emersion/go-vcard"
+	"github.com/stretchr/testify/require"
+)
+
+const testVCards = `BEGIN:VCARD
+VERSION:3.0
+FN:Alice
+EMAIL;TYPE=INTERNET:alice@proton.me
+TEL:+41 22 000 00 00
+NOTE:Met at the conference
+END:VCARD
+BEGIN:VCARD
+VERSION:4.0
+EMAIL:bob@proton.me
+END:VCARD
+`
+
+func TestReadVCardFile(t *testing.T) {
+	fsys := fstest.MapFS{"contacts/all.vcf": {Data: []byte(testVCards)}}
+
+	cards, err := readVCardFile(fsys, "contacts/all.vcf")
+	require.NoError(t, err)
+	require.Len(t, cards, 2)
+	require.Equal(t, "Alice", cards[0].Value(vcard.FieldFormattedName))
+	require.Equal(t, "bob@proton.me", cards[1].Value(vcard.FieldEmail))
+}
+
+func TestNewContactCards(t *testing.T) {
+	key, err := crypto.GenerateKey("user", "user@proton.me", "x25519", 0)
+	require.NoError(t, err)
+
+	userKR, err := crypto.NewKeyRing(key)
+	require.NoError(t, err)
+
+	cards, err := vcard.NewDecoder(strings.NewReader(testVCards)).Decode()
+	require.NoError(t, err)
+
+	contact, err := newContactCards(userKR, cards)
+	require.NoError(t, err)
+	require.Len(t, contact.Cards, 2)
+
+	signed, ok := contact.Cards.Get(proton.CardTypeSigned)
+	require.True(t, ok)
+	require.Contains(t, signed.Data, "FN:Alice")
+	require.NotContains(t, signed.Data, "NOTE")
+
+	uid, err := signed.Get(userKR, vcard.FieldUID)
+	require.NoError(t, err)
+	require.NotEmpty(t, uid)
+
+	encrypted, ok := contact.Cards.Get(proton.CardTypeEncrypted | proton.CardTypeSigned)
+	require.True(t, ok)
+	require.NotContains(t, encrypted.Data, "conference")
+
+	merged, err := contact.Cards.Merge(userKR)
+	require.NoError(t, err)
+	require.Equal(t, "Met at the conference", merged.Value(vcard.FieldNote))
+	require.Equal(t, "alice@proton.me", merged.Value(vcard.FieldEmail))
+}
+
+func TestNewContactCards_NameFromAddress(t *testing.T) {
+	key, err := crypto.GenerateKey("user", "user@proton.me", "x25519", 0)
+	require.NoError(t, err)
+
+	userKR, err := crypto.NewKeyRing(key)
+	require.NoError(t, err)
+
+	card := vcard.Card{}
+	card.SetValue(vcard.FieldVersion, "4.0")
+	card.SetValue(vcard.FieldEmail, "bob@proton.me")
+
+	contact, err := newContactCards(userKR, card)
+	require.NoError(t, err)
+	require.Len(t, contact.Cards, 1)
+	require.Contains(t, contact.Cards[0].Data, "FN:bob@proton.me")
+
+	_, err = newContactCards(userKR, vcard.Card{})
+	require.Error(t, err)
+}
+
+func TestCountICSEvents(t *testing.T) {
+	fsys := fstest.MapFS{
+		"calendar/work.ics": {Data: []byte("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nEND:VEVENT\r\nBEGIN:VEVENT\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n")},
+		"calendar/bad.ics":  {Data: []byte("not a calendar")},
+	}
+
+	count, err := countICSEvents(fsys, "calendar/work.ics")
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	_, err = countICSEvents(fsys, "calendar/bad.ics")
+	require.Error(t, err)
+}
+
+func TestOpenBackupFolder(t *testing.T) {
+	dir := t.TempDir()
+
+	_, _, files, err := openBackupFolder(context.Background(), dir, contactsBackupDir, vCardExtension)
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, contactsBackupDir), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, contactsBackupDir, "b.VCF"), []byte(testVCards), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, contactsBackupDir, "a.vcf"), []byte(testVCards), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, contactsBackupDir, "notes.txt"), nil, 0o600))
+
+	_, closeFS, files, err := openBackupFolder(context.Background(), dir, contactsBackupDir, vCardExtension)
+	require.NoError(t, err)
+	defer closeFS()
+
+	require.Equal(t, []string{"contacts/a.vcf", "contacts/b.VCF"}, files)
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+)
+
+// SetSkipDuplicates enables the deduplication of the restore: the messages of the backup that are already in the
+// account are not imported and are counted as skipped. This avoids duplicates when restoring into an account that
+// still contains some of the backed-up messages, or when running a restore again. See removeDuplicates.
+func (r *RestoreTask) SetSkipDuplicates(enabled bool) {
+	r.skipDuplicates = enabled
+}
+
+func (r *RestoreTask) GetSkipDuplicates() bool {
+	return r.skipDuplicates
+}
+
+// GetDuplicateCount returns the number of messages of the backup skipped because they are already in the account.
+func (r *RestoreTask) GetDuplicateCount() int64 {
+	return r.duplicateCount
+}
+
+// removeDuplicates returns the messages that are not in the account yet. The metadata of every message of the account
+// is listed to find them, see dedupeKeys. The metadata of the messages must have been loaded, see validateBackupDir.
+func (r *RestoreTask) removeDuplicates(messages []messageInfo, reporter Reporter) ([]messageInfo, error) {
+	remoteKeys := make(map[string]struct{})
+
+	if err := walkMetadataPages(
+		r.ctx,
+		r.session.GetClient(),
+		MetadataPageSize,
+		proton.MessageFilter{Desc: true},
+		func(page []proton.MessageMetadata) error {
+			for i := range page {
+				for _, key := range dedupeKeys(&page[i], true) {
+					remoteKeys[key] = struct{}{}
+				}
+			}
+
+			return nil
+		},
+	); err != nil {
+		return nil, err
+	}
+
+	result := make([]messageInfo, 0, len(messages))
+
+	for _, message := range messages {
+		if !containsAnyKey(remoteKeys, dedupeKeys(message.metadata, false)) {
+			result = append(result, message)
+			continue
+		}
+
+		r.log.WithField("messageID", message.messageID).Debug("Message already in the account, skipping")
+		r.duplicateCount++
+	}
+
+	r.log.WithFields(logrus.Fields{
+		"remoteCount":    len(remoteKeys),
+		"duplicateCount": r.duplicateCount,
+	}).Info("Removed the messages already in the account")
+
+	// Duplicates are skipped, they are already processed.
+	reporter.OnProgress(int(r.duplicateCount))
+
+	return result, nil
+}
+
+// dedupeKeys returns the keys identifying a message across accounts and restores: its ID, for restores into the account
+// the backup was made from, and its ExternalID, the Message-ID header. Messages without ExternalID are identified by
+// their fingerprint instead, see messageFingerprint, with their time and size: recurring notifications often share
+// the subject, sender and recipients. Remote messages always get a fingerprint key, in case the backup message they
+// are compared with has no ExternalID.
+//
+// A message whose size changed when it was imported is not recognized, it is imported again: a duplicate is preferred
+// to a message missing from the restore.
+func dedupeKeys(meta *proton.MessageMetadata, remote bool) []string {
+	keys := []string{"id:" + meta.ID}
+
+	if len(meta.ExternalID) != 0 {
+		keys = append(keys, "external:"+meta.ExternalID)
+	}
+
+	if remote || len(meta.ExternalID) == 0 {
+		fingerprint := messageFingerprint(&proton.MessageMetadata{
+			Subject: meta.Subject,
+			Sender:  meta.Sender,
+			ToList:  meta.ToList,
+			CCList:  meta.CCList,
+		})
+
+		keys = append(keys, fmt.Sprintf("fingerprint:%v:%v:%v", hex.EncodeToString(fingerprint[:]), meta.Time, meta.Size))
+	}
+
+	return keys
+}
+
+func containsAnyKey(set map[string]struct{}, keys []string) bool {
+	for _, key := range keys {
+		if _, ok := set[key]; ok {
+			return true
+		}
+	}
+
+	return false
+}
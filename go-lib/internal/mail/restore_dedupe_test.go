@@ -0,0 +1,66 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"net/mail"
+	"testing"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupeKeys(t *testing.T) {
+	alice := &mail.Address{Address: "alice@proton.me"}
+	bob := &mail.Address{Address: "bob@proton.me"}
+
+	remote := []proton.MessageMetadata{
+		{ID: "same-account", ExternalID: "<1@proton.me>", Subject: "Hello", Sender: alice},
+		{ID: "restored", ExternalID: "<2@proton.me>", Subject: "Invoice", Sender: alice},
+		{ID: "restored-no-header", ExternalID: "<generated@proton.me>", Subject: "Draft", Sender: bob, ToList: []*mail.Address{alice}, Time: 1700000000, Size: 2048},
+		{ID: "report-monday", ExternalID: "<generated-2@proton.me>", Subject: "Daily report", Sender: bob, Time: 1700000000, Size: 4096},
+	}
+
+	remoteKeys := make(map[string]struct{})
+	for i := range remote {
+		for _, key := range dedupeKeys(&remote[i], true) {
+			remoteKeys[key] = struct{}{}
+		}
+	}
+
+	isDuplicate := func(meta proton.MessageMetadata) bool {
+		return containsAnyKey(remoteKeys, dedupeKeys(&meta, false))
+	}
+
+	// Still in the account the backup was made from.
+	require.True(t, isDuplicate(proton.MessageMetadata{ID: "same-account", ExternalID: "<1@proton.me>", Subject: "Hello", Sender: alice}))
+	// Restored before, found by Message-ID.
+	require.True(t, isDuplicate(proton.MessageMetadata{ID: "backup", ExternalID: "<2@proton.me>", Subject: "Invoice", Sender: alice}))
+	// No Message-ID, found by fingerprint.
+	require.True(t, isDuplicate(proton.MessageMetadata{ID: "backup-draft", Subject: "Draft", Sender: bob, ToList: []*mail.Address{alice}, Time: 1700000000, Size: 2048}))
+	require.True(t, isDuplicate(proton.MessageMetadata{ID: "backup-monday", Subject: "Daily report", Sender: bob, Time: 1700000000, Size: 4096}))
+
+	// Same subject and sender but a different Message-ID.
+	require.False(t, isDuplicate(proton.MessageMetadata{ID: "other", ExternalID: "<3@proton.me>", Subject: "Hello", Sender: alice}))
+	// No Message-ID and different recipients.
+	require.False(t, isDuplicate(proton.MessageMetadata{ID: "other-draft", Subject: "Draft", Sender: bob, ToList: []*mail.Address{bob}, Time: 1700000000, Size: 2048}))
+	// No Message-ID, same headers as a message of the account but sent on another day.
+	require.False(t, isDuplicate(proton.MessageMetadata{ID: "backup-tuesday", Subject: "Daily report", Sender: bob, Time: 1700086400, Size: 4096}))
+	// No Message-ID, same headers and time but a different size.
+	require.False(t, isDuplicate(proton.MessageMetadata{ID: "backup-other", Subject: "Daily report", Sender: bob, Time: 1700000000, Size: 5120}))
+}
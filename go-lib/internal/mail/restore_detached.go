@@ -0,0 +1,206 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/ProtonMail/gluon/rfc822"
+)
+
+// Detached attachment layout
+// --------------------------
+// A backup may store attachment contents outside the EML files, in a content-addressed directory shared by all the
+// messages of the backup:
+//
+// <backup>
+//  |- attachments
+//  |   |- <sha256 of the decoded content>
+//  |- msg-id.eml
+//
+// In the EML file, the body of a detached part is left empty and the part header carries a reference to the content:
+//
+//	X-Pm-Detached-Attachment: sha256=<hex digest>
+//
+// Several parts, possibly from different messages, can reference the same content. Before a message is imported, every
+// detached part is re-inlined as a base64 encoded body.
+
+const (
+	detachedAttachmentDir    = "attachments"
+	detachedAttachmentHeader = "X-Pm-Detached-Attachment"
+	detachedAttachmentPrefix = "sha256="
+	base64LineLength         = 76
+)
+
+var errDetachedAttachmentIntegrity = errors.New("detached attachment content does not match its digest")
+
+// DetachedAttachmentStore gives access to the content of detached attachments.
+type DetachedAttachmentStore interface {
+	Get(digest string) ([]byte, error)
+}
+
+// fileDetachedAttachmentStore reads detached attachments from the attachments folder of a backup.
+type fileDetachedAttachmentStore struct {
+	fs  fs.FS
+	dir string
+}
+
+// newFileDetachedAttachmentStore returns nil if the backup has no detached attachments.
+func newFileDetachedAttachmentStore(fsys fs.FS, backupDir string) *fileDetachedAttachmentStore {
+	dir := path.Join(backupDir, detachedAttachmentDir)
+	if stat, err := fs.Stat(fsys, dir); err != nil || !stat.IsDir() {
+		return nil
+	}
+
+	return &fileDetachedAttachmentStore{fs: fsys, dir: dir}
+}
+
+func (f *fileDetachedAttachmentStore) Get(digest string) ([]byte, error) {
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != sha256.Size*2 {
+		return nil, fmt.Errorf("invalid detached attachment digest '%v'", digest)
+	}
+
+	content, err := fs.ReadFile(f.fs, path.Join(f.dir, digest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read detached attachment: %w", err)
+	}
+
+	if sum := sha256.Sum256(content); hex.EncodeToString(sum[:]) != digest {
+		return nil, fmt.Errorf("%w: %v", errDetachedAttachmentIntegrity, digest)
+	}
+
+	return content, nil
+}
+
+// reinlineDetachedAttachments returns the literal with the body of every detached part replaced by its content. The
+// literal is returned unchanged if it does not reference any detached attachment. Only the detached parts are modified,
+// the bytes of the other parts, including boundaries, preambles and epilogues, are preserved.
+func reinlineDetachedAttachments(literal []byte, store DetachedAttachmentStore) ([]byte, error) {
+	if !bytes.Contains(literal, []byte(detachedAttachmentHeader)) {
+		return literal, nil
+	}
+
+	return reinlinePart(literal, store)
+}
+
+func reinlinePart(part []byte, store DetachedAttachmentStore) ([]byte, error) {
+	headerBytes, body := rfc822.Split(part)
+
+	header, err := rfc822.NewHeader(headerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse part header: %w", err)
+	}
+
+	if ref, ok := header.GetChecked(detachedAttachmentHeader); ok {
+		return inlineDetachedPart(header, ref, store)
+	}
+
+	mimeType, params, err := rfc822.ParseMIMEType(header.Get("Content-Type"))
+	if err != nil {
+		// Parts with an invalid content type cannot contain detached attachments.
+		return part, nil //nolint:nilerr
+	}
+
+	switch {
+	case mimeType == rfc822.MessageRFC822:
+		newBody, err := reinlinePart(body, store)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(headerBytes[:len(headerBytes):len(headerBytes)], newBody...), nil
+
+	case mimeType.IsMultiPart():
+		newBody, err := reinlineMultipartBody(body, []byte(params["boundary"]), store)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(headerBytes[:len(headerBytes):len(headerBytes)], newBody...), nil
+
+	default:
+		return part, nil
+	}
+}
+
+func reinlineMultipartBody(body, boundary []byte, store DetachedAttachmentStore) ([]byte, error) {
+	scanner, err := rfc822.NewByteScanner(body, boundary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan multipart body: %w", err)
+	}
+
+	var (
+		result bytes.Buffer
+		offset int
+	)
+
+	for _, child := range scanner.ScanAll() {
+		newChild, err := reinlinePart(child.Data, store)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Write(body[offset:child.Offset])
+		result.Write(newChild)
+		offset = child.Offset + len(child.Data)
+	}
+
+	result.Write(body[offset:])
+
+	return result.Bytes(), nil
+}
+
+func inlineDetachedPart(header *rfc822.Header, ref string, store DetachedAttachmentStore) ([]byte, error) {
+	digest, ok := strings.CutPrefix(strings.TrimSpace(ref), detachedAttachmentPrefix)
+	if !ok {
+		return nil, fmt.Errorf("unsupported detached attachment reference '%v'", ref)
+	}
+
+	content, err := store.Get(strings.ToLower(digest))
+	if err != nil {
+		return nil, err
+	}
+
+	header.Del(detachedAttachmentHeader)
+	header.Del("Content-Transfer-Encoding")
+	header.Set("Content-Transfer-Encoding", "base64")
+
+	var result bytes.Buffer
+
+	result.Write(header.Raw())
+
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > base64LineLength {
+		result.WriteString(encoded[:base64LineLength])
+		result.WriteString("\r\n")
+		encoded = encoded[base64LineLength:]
+	}
+
+	// The line break preceding the next boundary belongs to the boundary delimiter, not to the part.
+	result.WriteString(encoded)
+
+	return result.Bytes(), nil
+}
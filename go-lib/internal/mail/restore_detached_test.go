@@ -0,0 +1,153 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/gluon/rfc822"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReinlineDetachedAttachments_NestedMultipart(t *testing.T) {
+	dir := t.TempDir()
+	pdf := []byte(strings.Repeat("%PDF shared content ", 10))
+	png := []byte("\x89PNG inner content")
+	pdfDigest := writeDetachedAttachment(t, dir, pdf)
+	pngDigest := writeDetachedAttachment(t, dir, png)
+
+	literal := strings.Join([]string{
+		"From: alice@example.com",
+		"Subject: nested",
+		`Content-Type: multipart/mixed; boundary="outer"`,
+		"",
+		"preamble",
+		"--outer",
+		`Content-Type: multipart/alternative; boundary="alt"`,
+		"",
+		"--alt",
+		"Content-Type: text/plain",
+		"",
+		"hello",
+		"--alt",
+		"Content-Type: text/html",
+		"",
+		"<p>hello</p>",
+		"--alt--",
+		"--outer",
+		`Content-Type: application/pdf; name="a.pdf"`,
+		`Content-Disposition: attachment; filename="a.pdf"`,
+		"X-Pm-Detached-Attachment: sha256=" + pdfDigest,
+		"",
+		"",
+		"--outer",
+		"Content-Type: message/rfc822",
+		"",
+		"Subject: forwarded",
+		`Content-Type: multipart/mixed; boundary="inner"`,
+		"",
+		"--inner",
+		"Content-Type: text/plain",
+		"",
+		"see attached",
+		"--inner",
+		`Content-Type: image/png; name="b.png"`,
+		"Content-Transfer-Encoding: 7bit",
+		"X-Pm-Detached-Attachment: sha256=" + pngDigest,
+		"",
+		"",
+		"--inner",
+		`Content-Type: application/pdf; name="same.pdf"`,
+		"X-Pm-Detached-Attachment: sha256=" + pdfDigest,
+		"",
+		"",
+		"--inner--",
+		"--outer--",
+		"epilogue",
+		"",
+	}, "\r\n")
+
+	result, err := reinlineDetachedAttachments([]byte(literal), newFileDetachedAttachmentStore(os.DirFS(dir), "."))
+	require.NoError(t, err)
+	require.NotContains(t, string(result), detachedAttachmentHeader)
+	require.Contains(t, string(result), "preamble")
+	require.Contains(t, string(result), "epilogue")
+	require.Contains(t, string(result), "<p>hello</p>")
+
+	var decoded [][]byte
+	require.NoError(t, rfc822.Parse(result).Walk(func(section *rfc822.Section) error {
+		header, err := section.ParseHeader()
+		if err != nil {
+			return err
+		}
+
+		if header.Get("Content-Transfer-Encoding") == "base64" {
+			body, err := section.DecodedBody()
+			if err != nil {
+				return err
+			}
+			decoded = append(decoded, body)
+		}
+
+		return nil
+	}))
+
+	// The PDF is referenced twice, once in the message itself and once in the forwarded message.
+	require.Equal(t, [][]byte{pdf, png, pdf}, decoded)
+}
+
+func TestReinlineDetachedAttachments_Errors(t *testing.T) {
+	dir := t.TempDir()
+	store := newFileDetachedAttachmentStore(os.DirFS(dir), ".")
+	require.Nil(t, store, "store must be nil when the backup has no attachments folder")
+
+	content := []byte("content")
+	digest := writeDetachedAttachment(t, dir, content)
+	store = newFileDetachedAttachmentStore(os.DirFS(dir), ".")
+	require.NotNil(t, store)
+
+	plain := []byte("Subject: plain\r\nContent-Type: text/plain\r\n\r\nbody\r\n")
+	result, err := reinlineDetachedAttachments(plain, store)
+	require.NoError(t, err)
+	require.Equal(t, plain, result)
+
+	missing := []byte("Content-Type: text/plain\r\nX-Pm-Detached-Attachment: sha256=" + strings.Repeat("0", 64) + "\r\n\r\n")
+	_, err = reinlineDetachedAttachments(missing, store)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, detachedAttachmentDir, digest), []byte("tampered"), 0o600))
+	tampered := []byte("Content-Type: text/plain\r\nX-Pm-Detached-Attachment: sha256=" + digest + "\r\n\r\n")
+	_, err = reinlineDetachedAttachments(tampered, store)
+	require.ErrorIs(t, err, errDetachedAttachmentIntegrity)
+}
+
+func writeDetachedAttachment(t *testing.T, backupDir string, content []byte) string {
+	dir := filepath.Join(backupDir, detachedAttachmentDir)
+	require.NoError(t, os.MkdirAll(dir, 0o700))
+
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+	require.NoError(t, os.WriteFile(filepath.Join(dir, digest), content, 0o600))
+
+	return digest
+}
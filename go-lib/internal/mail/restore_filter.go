@@ -0,0 +1,128 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"fmt"
+
+	"github.com/ProtonMail/go-proton-api"
+)
+
+// SetFilter restricts the restore to the messages of the backup matching the filter, e.g. the messages of a label
+// received during a given year. The criteria are checked against the metadata files of the backup, and the Labels are
+// looked up in the labels file of the backup, see resolveBackupLabels. Only the labels and folders of the selected
+// messages are restored. Body keywords, languages and conversation expansion are not supported.
+func (r *RestoreTask) SetFilter(filter Filter) error {
+	if err := filter.Validate(); err != nil {
+		return err
+	}
+
+	if filter.HasBodyCriteria() {
+		return fmt.Errorf("invalid restore filter: body keywords and languages are not supported")
+	}
+
+	if filter.ExpandConversations {
+		return fmt.Errorf("invalid restore filter: conversations cannot be expanded")
+	}
+
+	if filter.IsEmpty() {
+		r.filter = nil
+	} else {
+		r.filter = &filter
+	}
+
+	return nil
+}
+
+// GetFilter returns nil if the restore is not filtered.
+func (r *RestoreTask) GetFilter() *Filter {
+	return r.filter
+}
+
+// GetFilteredCount returns the number of messages of the backup left out by the filter.
+func (r *RestoreTask) GetFilteredCount() int64 {
+	return r.filteredCount
+}
+
+// filterMessages returns the messages of the backup matching the filter of the task, and the IDs of the labels they
+// carry. The metadata of the messages must have been loaded, see validateBackupDir.
+func (r *RestoreTask) filterMessages(messages []messageInfo) ([]messageInfo, map[string]bool, error) {
+	backupLabels, err := r.readLabelFile()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read labels file: %w", err)
+	}
+
+	filter, err := r.filter.resolveLabelsFrom(withSystemLabels(backupLabels))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selected := make([]messageInfo, 0, len(messages))
+	usedLabelIDs := make(map[string]bool)
+
+	for _, message := range messages {
+		if !filter.Matches(message.metadata) {
+			continue
+		}
+
+		selected = append(selected, message)
+
+		for _, id := range message.metadata.LabelIDs {
+			usedLabelIDs[id] = true
+		}
+	}
+
+	return selected, usedLabelIDs, nil
+}
+
+// withSystemLabels returns the labels of a backup with the system labels, which the labels file leaves out, so that
+// filters can refer to them by name.
+func withSystemLabels(backupLabels []proton.Label) []proton.Label {
+	labels := make([]proton.Label, 0, len(backupLabels)+len(mboxSystemLabelNames))
+	labels = append(labels, backupLabels...)
+
+	for id, name := range mboxSystemLabelNames {
+		labels = append(labels, proton.Label{ID: id, Name: name, Path: []string{name}, Type: proton.LabelTypeSystem})
+	}
+
+	return labels
+}
+
+// keepUsedLabels returns the backup labels carried by the selected messages, with all their parent folders.
+func keepUsedLabels(backupLabels []proton.Label, usedLabelIDs map[string]bool) []proton.Label {
+	parents := make(map[string]string, len(backupLabels))
+	for _, label := range backupLabels {
+		parents[label.ID] = label.ParentID
+	}
+
+	kept := make(map[string]bool, len(usedLabelIDs))
+	for id := range usedLabelIDs {
+		for ; len(id) != 0 && !kept[id]; id = parents[id] {
+			kept[id] = true
+		}
+	}
+
+	result := make([]proton.Label, 0, len(kept))
+	for _, label := range backupLabels {
+		if kept[label.ID] {
+			result = append(result, label)
+		}
+	}
+
+	return result
+}
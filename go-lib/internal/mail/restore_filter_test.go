@@ -0,0 +1,100 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/maps"
+)
+
+func TestRestoreTask_SetFilter(t *testing.T) {
+	r := &RestoreTask{}
+
+	require.NoError(t, r.SetFilter(Filter{}))
+	require.Nil(t, r.GetFilter())
+
+	require.NoError(t, r.SetFilter(Filter{Labels: []string{"Invoices"}}))
+	require.NotNil(t, r.GetFilter())
+
+	require.Error(t, r.SetFilter(Filter{BodyKeywords: []string{"invoice"}}))
+	require.Error(t, r.SetFilter(Filter{LabelIDs: []string{"work"}, ExpandConversations: true}))
+}
+
+func TestRestoreTask_FilterMessages(t *testing.T) {
+	backupLabels := []proton.Label{
+		{ID: "work", Name: "Work", Path: []string{"Work"}, Type: proton.LabelTypeFolder},
+		{ID: "invoices", Name: "Invoices", Path: []string{"Work", "Invoices"}, ParentID: "work", Type: proton.LabelTypeFolder},
+		{ID: "family", Name: "Family", Path: []string{"Family"}, Type: proton.LabelTypeLabel},
+	}
+
+	labelData, err := utils.GenerateVersionedJSON(LabelMetadataVersion, backupLabels)
+	require.NoError(t, err)
+
+	newMessage := func(id string, date time.Time, labelIDs ...string) messageInfo {
+		return messageInfo{
+			messageID: id,
+			timestamp: date.Unix(),
+			metadata:  &proton.MessageMetadata{ID: id, Time: date.Unix(), LabelIDs: labelIDs},
+		}
+	}
+
+	messages := []messageInfo{
+		newMessage("2021-invoice", time.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC), "invoices", proton.AllMailLabel),
+		newMessage("2022-invoice", time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC), "invoices", proton.AllMailLabel),
+		newMessage("2022-family", time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC), proton.InboxLabel, "family", proton.AllMailLabel),
+	}
+
+	r := &RestoreTask{backupFS: fstest.MapFS{getLabelFileName(): {Data: labelData}}, backupDir: "."}
+
+	require.NoError(t, r.SetFilter(Filter{
+		Labels: []string{"work/invoices"},
+		After:  time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		Before: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+	}))
+
+	selected, usedLabelIDs, err := r.filterMessages(messages)
+	require.NoError(t, err)
+	require.Equal(t, []messageInfo{messages[1]}, selected)
+	require.ElementsMatch(t, []string{"invoices", proton.AllMailLabel}, maps.Keys(usedLabelIDs))
+	require.Equal(t, backupLabels[:2], keepUsedLabels(backupLabels, usedLabelIDs))
+
+	require.NoError(t, r.SetFilter(Filter{Labels: []string{"Inbox"}}))
+
+	selected, usedLabelIDs, err = r.filterMessages(messages)
+	require.NoError(t, err)
+	require.Len(t, selected, 1)
+	require.Equal(t, "2022-family", selected[0].messageID)
+	require.Equal(t, backupLabels[2:], keepUsedLabels(backupLabels, usedLabelIDs))
+
+	require.NoError(t, r.SetFilter(Filter{MessageIDs: []string{"2021-invoice", "2022-family"}}))
+
+	selected, _, err = r.filterMessages(messages)
+	require.NoError(t, err)
+	require.Len(t, selected, 2)
+
+	require.NoError(t, r.SetFilter(Filter{Labels: []string{"Unknown"}}))
+
+	_, _, err = r.filterMessages(messages)
+	require.ErrorIs(t, err, ErrUnknownLabel)
+}
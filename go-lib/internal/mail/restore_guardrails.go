@@ -0,0 +1,255 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultGuardrailFailureWindow is the number of messages the failure rate is measured over by default.
+	DefaultGuardrailFailureWindow = 500
+
+	// DefaultGuardrailThroughputWindow is the duration the throughput is measured over by default.
+	DefaultGuardrailThroughputWindow = 30 * time.Minute
+
+	// guardrailCheckInterval is how often the throughput is checked, at most.
+	guardrailCheckInterval = time.Minute
+)
+
+// RestoreGuardrails abort an unattended restore which is going nowhere, so that it fails within minutes instead of
+// running for days against a broken account or network. The zero value disables them.
+type RestoreGuardrails struct {
+	// MaxFailureRate aborts the restore when the failed messages exceed this fraction of the last FailureWindow
+	// messages, e.g. 0.2. 0 disables the check.
+	MaxFailureRate float64
+	FailureWindow  int // DefaultGuardrailFailureWindow if 0.
+
+	// MinThroughput aborts the restore when fewer messages per minute than this were imported during the last
+	// ThroughputWindow. 0 disables the check.
+	MinThroughput    float64
+	ThroughputWindow time.Duration // DefaultGuardrailThroughputWindow if 0.
+}
+
+func (g RestoreGuardrails) enabled() bool {
+	return g.MaxFailureRate > 0 || g.MinThroughput > 0
+}
+
+func (g RestoreGuardrails) validate() error {
+	if g.MaxFailureRate < 0 || g.MaxFailureRate >= 1 {
+		return fmt.Errorf("invalid maximum failure rate %v, expected a fraction between 0 and 1", g.MaxFailureRate)
+	}
+
+	if g.FailureWindow < 0 {
+		return fmt.Errorf("invalid failure window of %v messages", g.FailureWindow)
+	}
+
+	if g.MinThroughput < 0 {
+		return fmt.Errorf("invalid minimum throughput of %v messages per minute", g.MinThroughput)
+	}
+
+	if g.ThroughputWindow < 0 || (g.ThroughputWindow > 0 && g.ThroughputWindow < guardrailCheckInterval) {
+		return fmt.Errorf("invalid throughput window %v, expected at least %v", g.ThroughputWindow, guardrailCheckInterval)
+	}
+
+	return nil
+}
+
+// GuardrailError is the error of a restore aborted by its guardrails, see RestoreGuardrails.
+type GuardrailError struct {
+	Reason string
+}
+
+func (e *GuardrailError) Error() string {
+	return "restore aborted by guardrail: " + e.Reason
+}
+
+// SetGuardrails sets the conditions aborting the restore, see RestoreGuardrails.
+func (r *RestoreTask) SetGuardrails(guardrails RestoreGuardrails) error {
+	if err := guardrails.validate(); err != nil {
+		return err
+	}
+
+	r.guardrails = guardrails
+
+	return nil
+}
+
+// GetGuardrails returns the conditions aborting the restore, the zero value when disabled.
+func (r *RestoreTask) GetGuardrails() RestoreGuardrails {
+	return r.guardrails
+}
+
+// throughputSample is the number of messages imported at a time.
+type throughputSample struct {
+	time     time.Time
+	imported int64
+}
+
+// restoreGuardrail applies the RestoreGuardrails of a restore. It is safe for concurrent use.
+type restoreGuardrail struct {
+	guardrails RestoreGuardrails
+	onTrip     func(err error)
+
+	lock     sync.Mutex
+	outcomes []bool // Ring buffer of the last messages, true for failures.
+	next     int
+	count    int // Messages in outcomes.
+	failures int // Failures in outcomes.
+	samples  []throughputSample
+	err      error // Set once tripped.
+}
+
+// newRestoreGuardrail returns the guardrail of a restore, nil if its guardrails are disabled. onTrip is called once,
+// with the GuardrailError, when they trip.
+func newRestoreGuardrail(guardrails RestoreGuardrails, onTrip func(err error)) *restoreGuardrail {
+	if !guardrails.enabled() {
+		return nil
+	}
+
+	if guardrails.FailureWindow == 0 {
+		guardrails.FailureWindow = DefaultGuardrailFailureWindow
+	}
+
+	if guardrails.ThroughputWindow == 0 {
+		guardrails.ThroughputWindow = DefaultGuardrailThroughputWindow
+	}
+
+	return &restoreGuardrail{
+		guardrails: guardrails,
+		onTrip:     onTrip,
+		outcomes:   make([]bool, guardrails.FailureWindow),
+	}
+}
+
+// record adds the outcome of the import of a message. The failure rate is only checked once the window is full, so
+// that the first failures of a restore do not abort it.
+func (g *restoreGuardrail) record(failed bool) {
+	if g == nil || g.guardrails.MaxFailureRate == 0 {
+		return
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.count == len(g.outcomes) {
+		if g.outcomes[g.next] {
+			g.failures--
+		}
+	} else {
+		g.count++
+	}
+
+	g.outcomes[g.next] = failed
+	g.next = (g.next + 1) % len(g.outcomes)
+
+	if failed {
+		g.failures++
+	}
+
+	if g.count < len(g.outcomes) {
+		return
+	}
+
+	if rate := float64(g.failures) / float64(g.count); rate > g.guardrails.MaxFailureRate {
+		g.tripLocked(fmt.Sprintf("%v of the last %v messages failed to import, more than the maximum of %.0f%%",
+			g.failures, g.count, g.guardrails.MaxFailureRate*100))
+	}
+}
+
+// sample records the number of messages imported at now, and checks the throughput once the window has elapsed since
+// the first sample.
+func (g *restoreGuardrail) sample(now time.Time, imported int64) {
+	if g == nil || g.guardrails.MinThroughput == 0 {
+		return
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.samples = append(g.samples, throughputSample{time: now, imported: imported})
+
+	// The reference is the latest sample at least a window old, the older ones are no longer needed.
+	reference := -1
+
+	for i, sample := range g.samples {
+		if now.Sub(sample.time) >= g.guardrails.ThroughputWindow {
+			reference = i
+		}
+	}
+
+	if reference < 0 {
+		return
+	}
+
+	g.samples = g.samples[reference:]
+
+	elapsed := now.Sub(g.samples[0].time)
+	throughput := float64(imported-g.samples[0].imported) / elapsed.Minutes()
+
+	if throughput < g.guardrails.MinThroughput {
+		g.tripLocked(fmt.Sprintf("%.1f messages per minute imported over the last %v, below the minimum of %v",
+			throughput, elapsed.Round(time.Minute), g.guardrails.MinThroughput))
+	}
+}
+
+// watchThroughput samples the imported messages until stop is closed.
+func (g *restoreGuardrail) watchThroughput(stop <-chan struct{}, imported func() int64) {
+	if g == nil || g.guardrails.MinThroughput == 0 {
+		return
+	}
+
+	interval := min(guardrailCheckInterval, g.guardrails.ThroughputWindow/10)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	g.sample(time.Now(), imported())
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			g.sample(now, imported())
+		}
+	}
+}
+
+func (g *restoreGuardrail) tripLocked(reason string) {
+	if g.err != nil {
+		return
+	}
+
+	g.err = &GuardrailError{Reason: reason}
+	g.onTrip(g.err)
+}
+
+// getError returns the GuardrailError once tripped, nil otherwise.
+func (g *restoreGuardrail) getError() error {
+	if g == nil {
+		return nil
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.err
+}
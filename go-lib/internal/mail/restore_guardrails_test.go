@@ -0,0 +1,115 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreGuardrails_Validate(t *testing.T) {
+	require.NoError(t, RestoreGuardrails{}.validate())
+	require.NoError(t, RestoreGuardrails{MaxFailureRate: 0.2, FailureWindow: 500, MinThroughput: 10, ThroughputWindow: time.Hour}.validate())
+
+	require.Error(t, RestoreGuardrails{MaxFailureRate: 20}.validate())
+	require.Error(t, RestoreGuardrails{FailureWindow: -1}.validate())
+	require.Error(t, RestoreGuardrails{MinThroughput: -1}.validate())
+	require.Error(t, RestoreGuardrails{MinThroughput: 1, ThroughputWindow: time.Second}.validate())
+}
+
+func TestRestoreGuardrail_Disabled(t *testing.T) {
+	guardrail := newRestoreGuardrail(RestoreGuardrails{}, func(error) { t.Fatal("tripped") })
+	require.Nil(t, guardrail)
+
+	// The nil guardrail accepts every call.
+	guardrail.record(true)
+	guardrail.sample(time.Now(), 0)
+	require.NoError(t, guardrail.getError())
+}
+
+func TestRestoreGuardrail_FailureRate(t *testing.T) {
+	var trips []error
+
+	guardrails := RestoreGuardrails{MaxFailureRate: 0.2, FailureWindow: 10}
+	onTrip := func(err error) { trips = append(trips, err) }
+
+	// The rate is only checked once the window is full.
+	guardrail := newRestoreGuardrail(guardrails, onTrip)
+	for i := 0; i < 9; i++ {
+		guardrail.record(true)
+	}
+
+	require.Empty(t, trips)
+
+	guardrail.record(false)
+	require.Len(t, trips, 1)
+
+	// Two failures out of the last ten is the limit, a third trips the guardrail.
+	trips = nil
+	guardrail = newRestoreGuardrail(guardrails, onTrip)
+
+	for i := 0; i < 20; i++ {
+		guardrail.record(i%5 == 0)
+	}
+
+	guardrail.record(true)
+	require.Empty(t, trips)
+
+	guardrail.record(true)
+	require.Len(t, trips, 1)
+
+	var guardrailErr *GuardrailError
+	require.True(t, errors.As(guardrail.getError(), &guardrailErr))
+	require.Contains(t, guardrailErr.Reason, "3 of the last 10 messages")
+
+	// It only trips once.
+	guardrail.record(true)
+	require.Len(t, trips, 1)
+}
+
+func TestRestoreGuardrail_Throughput(t *testing.T) {
+	var tripped error
+
+	guardrail := newRestoreGuardrail(RestoreGuardrails{MinThroughput: 10, ThroughputWindow: 30 * time.Minute}, func(err error) {
+		tripped = err
+	})
+
+	start := time.Now()
+
+	// 20 messages per minute for an hour, then the restore stalls.
+	for minute := 0; minute <= 60; minute++ {
+		guardrail.sample(start.Add(time.Duration(minute)*time.Minute), int64(minute*20))
+	}
+
+	require.NoError(t, tripped)
+
+	for minute := 61; minute <= 75; minute++ {
+		guardrail.sample(start.Add(time.Duration(minute)*time.Minute), 1200)
+	}
+
+	// 15 minutes without progress over the last 30 is still 10 messages per minute.
+	require.NoError(t, tripped)
+
+	guardrail.sample(start.Add(76*time.Minute), 1200)
+	require.Error(t, tripped)
+	require.ErrorIs(t, guardrail.getError(), tripped)
+	require.LessOrEqual(t, len(guardrail.samples), 32)
+}
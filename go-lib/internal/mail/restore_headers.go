@@ -0,0 +1,134 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/gluon/rfc822"
+)
+
+// The import API rejects or mangles the messages without a valid Date or Message-ID header, which old or broken
+// clients sometimes produced. Such headers are replaced before the import with values derived deterministically from
+// the message, so that importing the same backup twice yields the same messages. The original value, if any, is kept
+// in an X-Original- header.
+
+const originalHeaderPrefix = "X-Original-"
+
+// messageIDRegExp matches a msg-id of RFC 5322, without the obsolete forms.
+var messageIDRegExp = regexp.MustCompile(`^<[^<>@\s]+@[^<>@\s]+>$`)
+
+// headerRepair records a header replaced before the import.
+type headerRepair struct {
+	name     string
+	original string // Empty if the header was missing.
+	value    string
+}
+
+// repairImportHeaders adds or replaces the Date and Message-ID headers of literal when they are missing or invalid. The
+// date is fallbackTime, a Unix time, or the date of the last Received header if fallbackTime is 0. The Message-ID is
+// derived from seed, which identifies the message.
+func repairImportHeaders(literal []byte, fallbackTime int64, seed string) ([]byte, []headerRepair, error) {
+	headerBytes, body := rfc822.Split(literal)
+
+	header, err := rfc822.NewHeader(headerBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse message header: %w", err)
+	}
+
+	var repairs []headerRepair
+
+	if date, ok := header.GetChecked("Date"); !ok || !isValidDate(date) {
+		repairs = append(repairs, headerRepair{
+			name:     "Date",
+			original: date,
+			value:    getFallbackDate(header, fallbackTime).Format(time.RFC1123Z),
+		})
+	}
+
+	if id, ok := header.GetChecked("Message-Id"); !ok || !messageIDRegExp.MatchString(strings.TrimSpace(id)) {
+		repairs = append(repairs, headerRepair{
+			name:     "Message-Id",
+			original: id,
+			value:    newMessageID(header, seed),
+		})
+	}
+
+	if len(repairs) == 0 {
+		return literal, nil, nil
+	}
+
+	for _, repair := range repairs {
+		for header.Has(repair.name) {
+			header.Del(repair.name)
+		}
+
+		if original := strings.Join(strings.Fields(repair.original), " "); len(original) != 0 {
+			header.Set(originalHeaderPrefix+repair.name, original)
+		}
+
+		header.Set(repair.name, repair.value)
+	}
+
+	return append(header.Raw(), body...), repairs, nil
+}
+
+func isValidDate(value string) bool {
+	date, err := mail.ParseDate(value)
+
+	return err == nil && date.Year() >= 1970
+}
+
+// getFallbackDate returns fallbackTime, or the date the last hop received the message. The Unix epoch is returned if
+// neither is known.
+func getFallbackDate(header *rfc822.Header, fallbackTime int64) time.Time {
+	if fallbackTime > 0 {
+		return time.Unix(fallbackTime, 0).UTC()
+	}
+
+	if received, ok := header.GetChecked("Received"); ok {
+		if index := strings.LastIndex(received, ";"); index >= 0 {
+			if date, err := mail.ParseDate(strings.TrimSpace(received[index+1:])); err == nil && date.Year() >= 1970 {
+				return date
+			}
+		}
+	}
+
+	return time.Unix(0, 0).UTC()
+}
+
+// newMessageID returns a Message-ID derived from seed in the domain of the sender.
+func newMessageID(header *rfc822.Header, seed string) string {
+	domain := "unknown.invalid"
+
+	if from, err := mail.ParseAddress(header.Get("From")); err == nil {
+		if _, fromDomain, ok := strings.Cut(from.Address, "@"); ok && len(fromDomain) != 0 {
+			domain = fromDomain
+		}
+	}
+
+	sum := sha256.Sum256([]byte(seed))
+
+	return "<" + hex.EncodeToString(sum[:16]) + "@" + domain + ">"
+}
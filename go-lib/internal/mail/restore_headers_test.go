@@ -0,0 +1,85 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepairImportHeaders(t *testing.T) {
+	valid := "Date: Tue, 02 Jan 2024 03:04:05 +0000\r\nMessage-ID: <abc@example.com>\r\nFrom: a@example.com\r\n\r\nBody\r\n"
+
+	literal, repairs, err := repairImportHeaders([]byte(valid), 1704164645, "msg-id")
+	require.NoError(t, err)
+	require.Empty(t, repairs)
+	require.Equal(t, valid, string(literal))
+
+	broken := "Date: yesterday\r\nMessage-ID: not-an-id\r\nFrom: Alice <alice@example.org>\r\n\r\nBody\r\n"
+
+	literal, repairs, err = repairImportHeaders([]byte(broken), 1704164645, "msg-id")
+	require.NoError(t, err)
+	require.Len(t, repairs, 2)
+
+	date, ok := readHeader(literal, "Date")
+	require.True(t, ok)
+	require.Equal(t, "Tue, 02 Jan 2024 03:04:05 +0000", date)
+
+	original, ok := readHeader(literal, "X-Original-Date")
+	require.True(t, ok)
+	require.Equal(t, "yesterday", original)
+
+	id, ok := readHeader(literal, "Message-Id")
+	require.True(t, ok)
+	require.Regexp(t, `^<[0-9a-f]{32}@example\.org>$`, id)
+
+	original, ok = readHeader(literal, "X-Original-Message-Id")
+	require.True(t, ok)
+	require.Equal(t, "not-an-id", original)
+	require.Contains(t, string(literal), "\r\n\r\nBody\r\n")
+
+	// The repairs are deterministic.
+	again, _, err := repairImportHeaders([]byte(broken), 1704164645, "msg-id")
+	require.NoError(t, err)
+	require.Equal(t, literal, again)
+
+	other, _, err := repairImportHeaders([]byte(broken), 1704164645, "other-id")
+	require.NoError(t, err)
+	require.NotEqual(t, literal, other)
+}
+
+func TestRepairImportHeaders_Missing(t *testing.T) {
+	missing := "Received: from mx.example.com; Mon, 01 Jan 2024 10:00:00 +0100\r\nSubject: test\r\n\r\nBody\r\n"
+
+	literal, repairs, err := repairImportHeaders([]byte(missing), 0, "seed")
+	require.NoError(t, err)
+	require.Len(t, repairs, 2)
+	require.Empty(t, repairs[0].original)
+
+	date, ok := readHeader(literal, "Date")
+	require.True(t, ok)
+	require.Equal(t, "Mon, 01 Jan 2024 10:00:00 +0100", date)
+
+	id, ok := readHeader(literal, "Message-Id")
+	require.True(t, ok)
+	require.Regexp(t, `^<[0-9a-f]{32}@unknown\.invalid>$`, id)
+
+	_, ok = readHeader(literal, "X-Original-Date")
+	require.False(t, ok)
+}
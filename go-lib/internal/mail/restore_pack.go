@@ -0,0 +1,428 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/klauspost/compress/zstd"
+)
+
+var ErrPackCorrupted = errors.New("pack file is corrupted")
+
+// packFS shows the files stored in the packs and archives of an export as regular files of the folder holding them, so
+// that a pack or archive export is read like any other export, see OutputFormatPack and OutputFormatZip. The packs of a
+// folder are loaded the first time a file of the folder is looked up.
+type packFS struct {
+	fsys fs.FS
+
+	lock sync.Mutex
+	dirs map[string]map[string]packLocation // Packed files by folder and name.
+}
+
+// packLocation is a file stored in a pack or an archive.
+type packLocation struct {
+	packPath string
+	entry    PackIndexEntry
+	archive  *ArchiveIndexEntry // Set for the files stored in an archive, packPath is then the path of the archive.
+}
+
+func newPackFS(fsys fs.FS) *packFS {
+	return &packFS{fsys: fsys, dirs: make(map[string]map[string]packLocation)}
+}
+
+func (p *packFS) Open(name string) (fs.File, error) {
+	file, err := p.fsys.Open(name)
+	if !errors.Is(err, fs.ErrNotExist) || name == "." {
+		return file, err
+	}
+
+	packed, loadErr := p.getPackedFiles(path.Dir(name))
+	if loadErr != nil {
+		return nil, loadErr
+	}
+
+	location, ok := packed[path.Base(name)]
+	if !ok {
+		return nil, err
+	}
+
+	data, err := readPackEntry(p.fsys, location)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &packedFile{info: packedFileInfo{name: path.Base(name), size: int64(len(data))}, reader: bytes.NewReader(data)}, nil
+}
+
+// ReadDir lists the files of the folder, packed files included.
+func (p *packFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(p.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	packed, err := p.getPackedFiles(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(packed) == 0 {
+		return entries, nil
+	}
+
+	names := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = struct{}{}
+	}
+
+	for fileName, location := range packed {
+		if _, ok := names[fileName]; !ok {
+			entries = append(entries, fs.FileInfoToDirEntry(packedFileInfo{name: fileName, size: location.entry.Size}))
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, nil
+}
+
+// getPackedFiles loads the index of the packs of dir.
+func (p *packFS) getPackedFiles(dir string) (map[string]packLocation, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if packed, ok := p.dirs[dir]; ok {
+		return packed, nil
+	}
+
+	packed, err := loadPackedFiles(p.fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	p.dirs[dir] = packed
+
+	return packed, nil
+}
+
+// loadPackedFiles returns the files stored in the packs and archives of dir. The packs without a valid index are
+// scanned.
+func loadPackedFiles(fsys fs.FS, dir string) (map[string]packLocation, error) {
+	packed := make(map[string]packLocation)
+
+	if err := loadArchivedFiles(fsys, dir, packed); err != nil {
+		return nil, err
+	}
+
+	packDir := path.Join(dir, getPackDirName())
+
+	entries, err := fs.ReadDir(fsys, packDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return packed, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list packs: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), packExtension) {
+			continue
+		}
+
+		packPath := path.Join(packDir, entry.Name())
+
+		index, err := loadPackIndex(fsys, packPath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, indexEntry := range index.Entries {
+			packed[indexEntry.Name] = packLocation{packPath: packPath, entry: indexEntry}
+		}
+	}
+
+	return packed, nil
+}
+
+// loadArchivedFiles adds the files stored in the archives of dir to packed. An archive without an index is incomplete.
+func loadArchivedFiles(fsys fs.FS, dir string, packed map[string]packLocation) error {
+	for _, format := range []OutputFormat{OutputFormatZip, OutputFormatTarZst} {
+		archivePath := path.Join(dir, getArchiveFileName(format))
+
+		if _, err := fs.Stat(fsys, archivePath); errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to access archive: %w", err)
+		}
+
+		data, err := fs.ReadFile(fsys, getArchiveIndexPath(archivePath))
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: '%v'", ErrArchiveIncomplete, archivePath)
+		} else if err != nil {
+			return fmt.Errorf("failed to read archive index: %w", err)
+		}
+
+		index, err := utils.NewVersionedJSON[ArchiveIndex](ArchiveIndexVersion, data)
+		if err != nil {
+			return fmt.Errorf("failed to read the index of '%v': %w", archivePath, err)
+		}
+
+		for i := range index.Payload.Entries {
+			entry := &index.Payload.Entries[i]
+			if !isValidPackEntryName(entry.Name) || entry.Offset < 0 || entry.CompressedSize < 0 || entry.DataOffset < 0 || entry.Size < 0 {
+				return fmt.Errorf("%w: invalid index of '%v'", ErrPackCorrupted, archivePath)
+			}
+
+			packed[entry.Name] = packLocation{
+				packPath: archivePath,
+				entry:    PackIndexEntry{Name: entry.Name, Offset: entry.Offset, Size: entry.Size, SHA256: entry.SHA256},
+				archive:  entry,
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadPackIndex reads the index of a pack, or scans the pack if it has no valid index.
+func loadPackIndex(fsys fs.FS, packPath string) (PackIndex, error) {
+	if index, err := readPackIndexFile(fsys, packPath); err == nil {
+		return index, nil
+	}
+
+	file, err := fsys.Open(packPath)
+	if err != nil {
+		return PackIndex{}, fmt.Errorf("failed to open pack: %w", err)
+	}
+	defer file.Close() //nolint:errcheck
+
+	return scanPack(file)
+}
+
+// readPackIndexFile reads the index written next to a pack.
+func readPackIndexFile(fsys fs.FS, packPath string) (PackIndex, error) {
+	data, err := fs.ReadFile(fsys, getPackIndexPath(packPath))
+	if err != nil {
+		return PackIndex{}, err
+	}
+
+	index, err := utils.NewVersionedJSON[PackIndex](PackIndexVersion, data)
+	if err != nil {
+		return PackIndex{}, err
+	}
+
+	if err := validatePackIndex(&index.Payload); err != nil {
+		return PackIndex{}, err
+	}
+
+	return index.Payload, nil
+}
+
+func validatePackIndex(index *PackIndex) error {
+	for _, entry := range index.Entries {
+		if !isValidPackEntryName(entry.Name) || entry.Offset < int64(len(packMagic)) || entry.Size < 0 {
+			return ErrPackCorrupted
+		}
+	}
+
+	return nil
+}
+
+// isValidPackEntryName returns whether name can be the name of a file of the export folder.
+func isValidPackEntryName(name string) bool {
+	return fs.ValidPath(name) && name != "." && !strings.ContainsAny(name, `/\`)
+}
+
+// scanPack rebuilds the index of a pack from its entries. A truncated entry at the end of the pack, left by an
+// interrupted export, is ignored.
+func scanPack(r io.Reader) (PackIndex, error) {
+	reader := bufio.NewReader(r)
+
+	magic := make([]byte, len(packMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != packMagic {
+		return PackIndex{}, fmt.Errorf("%w: invalid header", ErrPackCorrupted)
+	}
+
+	var (
+		index  PackIndex
+		offset = int64(len(packMagic))
+	)
+
+	for {
+		var nameLen uint16
+		if err := binary.Read(reader, binary.BigEndian, &nameLen); err != nil {
+			return index, nil //nolint:nilerr // End of the pack or truncated entry.
+		}
+
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return index, nil //nolint:nilerr
+		}
+
+		var size uint64
+
+		hash := make([]byte, sha256.Size)
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return index, nil //nolint:nilerr
+		}
+
+		if _, err := io.ReadFull(reader, hash); err != nil {
+			return index, nil //nolint:nilerr
+		}
+
+		if !isValidPackEntryName(string(name)) || size > uint64(PackFileMaxSize)*4 {
+			return PackIndex{}, fmt.Errorf("%w: invalid entry at offset %v", ErrPackCorrupted, offset)
+		}
+
+		offset += int64(2 + len(name) + 8 + sha256.Size)
+
+		if copied, err := io.CopyN(io.Discard, reader, int64(size)); err != nil || copied != int64(size) {
+			return index, nil //nolint:nilerr
+		}
+
+		index.Entries = append(index.Entries, PackIndexEntry{
+			Name:   string(name),
+			Offset: offset,
+			Size:   int64(size),
+			SHA256: hex.EncodeToString(hash),
+		})
+		offset += int64(size)
+	}
+}
+
+// readPackEntry reads a file stored in a pack or an archive and checks its checksum.
+func readPackEntry(fsys fs.FS, location packLocation) ([]byte, error) {
+	var (
+		data []byte
+		err  error
+	)
+
+	if location.archive != nil {
+		data, err = readArchiveEntry(fsys, location.packPath, location.archive)
+	} else {
+		data, err = readFileRange(fsys, location.packPath, location.entry.Offset, location.entry.Size)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if hash := sha256.Sum256(data); hex.EncodeToString(hash[:]) != location.entry.SHA256 {
+		return nil, fmt.Errorf("%w: checksum mismatch of '%v'", ErrPackCorrupted, location.entry.Name)
+	}
+
+	return data, nil
+}
+
+// readArchiveEntry decompresses a file stored in an archive.
+func readArchiveEntry(fsys fs.FS, archivePath string, entry *ArchiveIndexEntry) ([]byte, error) {
+	compressed, err := readFileRange(fsys, archivePath, entry.Offset, entry.CompressedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if path.Base(archivePath) == getArchiveFileName(OutputFormatZip) {
+		data := make([]byte, entry.Size)
+		if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(compressed)), data); err != nil {
+			return nil, fmt.Errorf("%w: failed to decompress '%v': %v", ErrPackCorrupted, entry.Name, err)
+		}
+
+		return data, nil
+	}
+
+	decoder, err := getArchiveDecoder()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+
+	frame, err := decoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decompress '%v': %v", ErrPackCorrupted, entry.Name, err)
+	}
+
+	if entry.DataOffset+entry.Size > int64(len(frame)) {
+		return nil, fmt.Errorf("%w: '%v' is out of bounds", ErrPackCorrupted, entry.Name)
+	}
+
+	return frame[entry.DataOffset : entry.DataOffset+entry.Size], nil
+}
+
+// getArchiveDecoder returns the decoder shared by the reads of tar.zst archives.
+var getArchiveDecoder = sync.OnceValues(func() (*zstd.Decoder, error) { //nolint:gochecknoglobals
+	return zstd.NewReader(nil)
+})
+
+// readFileRange reads size bytes at offset of a file.
+func readFileRange(fsys fs.FS, filePath string, offset, size int64) ([]byte, error) {
+	file, err := fsys.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open '%v': %w", filePath, err)
+	}
+	defer file.Close() //nolint:errcheck
+
+	data := make([]byte, size)
+
+	// Files read from a backup archive may not support random access, they are read up to the range.
+	if readerAt, ok := file.(io.ReaderAt); ok {
+		_, err = readerAt.ReadAt(data, offset)
+	} else if _, err = io.CopyN(io.Discard, file, offset); err == nil {
+		_, err = io.ReadFull(file, data)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%v': %w", filePath, err)
+	}
+
+	return data, nil
+}
+
+type packedFile struct {
+	info   packedFileInfo
+	reader *bytes.Reader
+}
+
+func (f *packedFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *packedFile) Read(b []byte) (int, error) { return f.reader.Read(b) }
+func (f *packedFile) Close() error               { return nil }
+
+type packedFileInfo struct {
+	name string
+	size int64
+}
+
+func (i packedFileInfo) Name() string       { return i.name }
+func (i packedFileInfo) Size() int64        { return i.size }
+func (i packedFileInfo) Mode() fs.FileMode  { return 0o400 }
+func (i packedFileInfo) ModTime() time.Time { return time.Time{} }
+func (i packedFileInfo) IsDir() bool        { return false }
+func (i packedFileInfo) Sys() any           { return nil }
@@ -0,0 +1,693 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"golang.org/x/exp/slices"
+)
+
+// Remote backups
+// --------------
+// A backup stored on S3, on a WebDAV server or on an SFTP server is restored without being downloaded first. The URL names the backup
+// folder, or a folder holding it, and the files are fetched as the restore reads them. Packs and archives are read with
+// range requests, so only the messages being restored are transferred. The small files read at the start of every run,
+// the labels, the indexes and the checksum manifests, are cached locally and downloaded again only when they changed on
+// the server. A file read in full is checked against the checksum manifest of its export, the files stored in packs
+// and archives against their index.
+
+const (
+	RemoteWebDAVUserEnvVar     = "ET_WEBDAV_USER"
+	RemoteWebDAVPasswordEnvVar = "ET_WEBDAV_PASSWORD"
+	RemoteS3EndpointEnvVar     = "ET_S3_ENDPOINT"
+	RemoteSFTPUserEnvVar       = "ET_SFTP_USER"
+	RemoteSFTPPasswordEnvVar   = "ET_SFTP_PASSWORD"
+	RemoteSFTPKeyEnvVar        = "ET_SFTP_KEY" // Path of a private key file.
+	RemoteSFTPKnownHostsEnvVar = "ET_SFTP_KNOWN_HOSTS"
+
+	remoteCacheMaxSize = 16 * MB // Larger files are never cached.
+)
+
+var (
+	ErrRemoteBackupNotSupported = errors.New("remote backups can only be read from s3://bucket/path, webdav://host/path, webdav+http://host/path or sftp://host/path")
+	ErrRemoteCredentialsInURL   = errors.New("the credentials of a remote backup must be given with env vars, not in the URL")
+	ErrRemoteAccessDenied       = errors.New("access to the remote backup was denied")
+	ErrRemoteRequestFailed      = errors.New("remote backup request failed")
+	ErrRemoteRangeNotSupported  = errors.New("the server of the remote backup does not support range requests")
+	ErrRemoteChecksumMismatch   = errors.New("remote file does not match the checksum manifest")
+)
+
+var remoteSchemes = []string{"s3", "webdav", "webdav+http", "sftp"} //nolint:gochecknoglobals
+
+// IsRemoteBackup returns true if backupPath is the URL of a backup on a remote storage backend.
+func IsRemoteBackup(backupPath string) bool {
+	scheme, _, ok := strings.Cut(backupPath, "://")
+	return ok && slices.Contains(remoteSchemes, strings.ToLower(scheme))
+}
+
+// remoteBackend reads the files of a remote backup location. Names are relative to the location, "." is the location.
+type remoteBackend interface {
+	// listDir returns the files and folders of dir, fs.ErrNotExist if there is no such folder.
+	listDir(ctx context.Context, dir string) ([]remoteObject, error)
+
+	// getRange returns length bytes of the file at offset, the rest of the file if length is negative.
+	getRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+}
+
+// remoteObject is a file or a folder of a remote backup.
+type remoteObject struct {
+	name    string
+	size    int64
+	modTime time.Time
+	etag    string // Identifies the content of the file, may be empty.
+	isDir   bool
+}
+
+func (o remoteObject) Name() string       { return o.name }
+func (o remoteObject) Size() int64        { return o.size }
+func (o remoteObject) ModTime() time.Time { return o.modTime }
+func (o remoteObject) IsDir() bool        { return o.isDir }
+func (o remoteObject) Sys() any           { return nil }
+
+func (o remoteObject) Mode() fs.FileMode {
+	if o.isDir {
+		return fs.ModeDir | 0o500
+	}
+
+	return 0o400
+}
+
+// openBackupLocation opens the backup at backupPath, a local path or the URL of a remote backup, and returns the path
+// of the backup shown to the user, see openBackupFS.
+func openBackupLocation(ctx context.Context, backupPath string) (fs.FS, io.Closer, string, error) {
+	if !IsRemoteBackup(backupPath) {
+		absPath, err := filepath.Abs(backupPath)
+		if err != nil {
+			return nil, nil, "", err
+		}
+
+		fsys, closer, err := openBackupFS(absPath)
+
+		return fsys, closer, absPath, err
+	}
+
+	remote, err := openRemoteBackup(ctx, backupPath)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	sub, err := skipWrapperDirs(remote)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return newPackFS(sub), remote, remote.location, nil
+}
+
+// openRemoteBackup returns the file system of the backup at location. The credentials are read from the env:
+// RemoteWebDAVUserEnvVar and RemoteWebDAVPasswordEnvVar for WebDAV, the usual AWS env vars for S3, see sftpBackend for
+// SFTP. An S3 compatible service is selected with RemoteS3EndpointEnvVar.
+func openRemoteBackup(ctx context.Context, location string) (*remoteFS, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote backup location: %w", err)
+	}
+
+	if u.User != nil {
+		return nil, ErrRemoteCredentialsInURL
+	}
+
+	if len(u.Host) == 0 {
+		return nil, ErrRemoteBackupNotSupported
+	}
+
+	var backend remoteBackend
+
+	switch strings.ToLower(u.Scheme) {
+	case "s3":
+		if backend, err = newS3Backend(u); err != nil {
+			return nil, err
+		}
+
+	case "webdav", "webdav+http":
+		backend = newWebDAVBackend(u)
+
+	case "sftp":
+		if backend, err = newSFTPBackend(ctx, u); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, ErrRemoteBackupNotSupported
+	}
+
+	location = strings.TrimSuffix(u.String(), "/")
+
+	fsys := newRemoteFS(ctx, location, backend, "")
+
+	if fsys.cacheDir, err = getRemoteCacheDir(location); err != nil {
+		_ = fsys.Close()
+		return nil, err
+	}
+
+	return fsys, nil
+}
+
+// getRemoteCacheDir returns the folder caching the files of the backup at location. It also holds the state of the
+// restores of the backup.
+func getRemoteCacheDir(location string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate the cache folder: %w", err)
+	}
+
+	hash := sha256.Sum256([]byte(location))
+	dir = filepath.Join(dir, "proton-mail-export-cli", "remote", hex.EncodeToString(hash[:8]))
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create the cache folder: %w", err)
+	}
+
+	return dir, nil
+}
+
+// joinRemotePath appends the path of a file of the backup to its URL.
+func joinRemotePath(location, name string) string {
+	if name == "." {
+		return location
+	}
+
+	return location + "/" + name
+}
+
+// remoteFS is the file system of a remote backup. Folder listings are fetched once. The files are not downloaded when
+// they are opened but when they are read, except the small files read by every restore that are served from the local
+// cache, see isRemoteCachedFile.
+type remoteFS struct {
+	ctx      context.Context
+	location string // URL of the backup location, without credentials.
+	backend  remoteBackend
+	cacheDir string
+
+	lock      sync.Mutex
+	dirs      map[string][]remoteObject    // Listings by folder, sorted by name.
+	checksums map[string]map[string]string // Digests of the checksum manifest of a folder by relative path, nil if none.
+}
+
+func newRemoteFS(ctx context.Context, location string, backend remoteBackend, cacheDir string) *remoteFS {
+	return &remoteFS{
+		ctx:       ctx,
+		location:  location,
+		backend:   backend,
+		cacheDir:  cacheDir,
+		dirs:      make(map[string][]remoteObject),
+		checksums: make(map[string]map[string]string),
+	}
+}
+
+// Close closes the connection of the backends keeping one, it makes the remote file system the closer of the backup,
+// see RestoreTask.getRemoteFS.
+func (r *remoteFS) Close() error {
+	if closer, ok := r.backend.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+func (r *remoteFS) Open(name string) (fs.File, error) {
+	object, err := r.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if object.isDir {
+		return &remoteDir{fsys: r, name: name, info: object}, nil
+	}
+
+	if isRemoteCachedFile(name) && object.size <= remoteCacheMaxSize {
+		data, err := r.readCached(name, object)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		return &remoteCachedFile{info: object, reader: bytes.NewReader(data)}, nil
+	}
+
+	digest, err := r.getDigest(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &remoteFile{fsys: r, name: name, info: object, digest: digest, hash: sha256.New()}, nil
+}
+
+func (r *remoteFS) Stat(name string) (fs.FileInfo, error) {
+	object, err := r.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	return object, nil
+}
+
+func (r *remoteFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if object, err := r.stat(name); err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	} else if !object.isDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	objects, err := r.listDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(objects))
+	for _, object := range objects {
+		entries = append(entries, fs.FileInfoToDirEntry(object))
+	}
+
+	return entries, nil
+}
+
+// stat looks up a file or a folder in the listing of its folder.
+func (r *remoteFS) stat(name string) (remoteObject, error) {
+	if !fs.ValidPath(name) {
+		return remoteObject{}, fs.ErrInvalid
+	}
+
+	if name == "." {
+		return remoteObject{name: ".", isDir: true}, nil
+	}
+
+	objects, err := r.listDir(path.Dir(name))
+	if err != nil {
+		return remoteObject{}, err
+	}
+
+	base := path.Base(name)
+
+	i := sort.Search(len(objects), func(i int) bool { return objects[i].name >= base })
+	if i == len(objects) || objects[i].name != base {
+		return remoteObject{}, fs.ErrNotExist
+	}
+
+	return objects[i], nil
+}
+
+func (r *remoteFS) listDir(dir string) ([]remoteObject, error) {
+	r.lock.Lock()
+	objects, ok := r.dirs[dir]
+	r.lock.Unlock()
+
+	if ok {
+		return objects, nil
+	}
+
+	objects, err := r.backend.listDir(r.ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].name < objects[j].name })
+
+	r.lock.Lock()
+	r.dirs[dir] = objects
+	r.lock.Unlock()
+
+	return objects, nil
+}
+
+// isRemoteCachedFile returns whether the file is read by every restore of the backup and should be cached locally.
+func isRemoteCachedFile(name string) bool {
+	switch base := path.Base(name); base {
+	case getLabelFileName(), getChecksumManifestFileName(), getAtRestEncryptionFileName(), getYearManifestFileName():
+		return true
+	default:
+		return strings.HasSuffix(base, packIndexExtension)
+	}
+}
+
+// readCached returns the content of a file from the local cache, or downloads it. The cached copy is keyed by the size,
+// modification time and entity tag of the file, so that a file changed on the server is downloaded again.
+func (r *remoteFS) readCached(name string, object remoteObject) ([]byte, error) {
+	key := sha256.Sum256([]byte(strings.Join([]string{
+		name, strconv.FormatInt(object.size, 10), object.modTime.UTC().Format(time.RFC3339Nano), object.etag,
+	}, "\x00")))
+	cachePath := filepath.Join(r.cacheDir, hex.EncodeToString(key[:]))
+
+	if data, err := os.ReadFile(cachePath); err == nil && r.checkDigest(name, data) == nil { //nolint:gosec
+		return data, nil
+	}
+
+	body, err := r.backend.getRange(r.ctx, name, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close() //nolint:errcheck
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download '%v': %w", name, err)
+	}
+
+	if err := r.checkDigest(name, data); err != nil {
+		return nil, err
+	}
+
+	// The cache only saves downloads, the file is still returned if it cannot be written.
+	tmpPath := cachePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err == nil {
+		if err := os.Rename(tmpPath, cachePath); err != nil {
+			_ = os.Remove(tmpPath)
+		}
+	}
+
+	return data, nil
+}
+
+func (r *remoteFS) checkDigest(name string, data []byte) error {
+	digest, err := r.getDigest(name)
+	if err != nil || len(digest) == 0 {
+		return err
+	}
+
+	if hash := sha256.Sum256(data); hex.EncodeToString(hash[:]) != digest {
+		return fmt.Errorf("%w: '%v'", ErrRemoteChecksumMismatch, name)
+	}
+
+	return nil
+}
+
+// getDigest returns the SHA-256 digest of a file from the checksum manifest of the closest folder holding one, see
+// ChecksumManifest. It is empty if the file is not listed.
+func (r *remoteFS) getDigest(name string) (string, error) {
+	if path.Base(name) == getChecksumManifestFileName() {
+		return "", nil
+	}
+
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		digests, err := r.getChecksums(dir)
+		if err != nil {
+			return "", err
+		}
+
+		if digests != nil {
+			rel := name
+			if dir != "." {
+				rel = strings.TrimPrefix(name, dir+"/")
+			}
+
+			return digests[rel], nil
+		}
+
+		if dir == "." {
+			return "", nil
+		}
+	}
+}
+
+// getChecksums loads the checksum manifest of dir. It returns nil if dir has none.
+func (r *remoteFS) getChecksums(dir string) (map[string]string, error) {
+	r.lock.Lock()
+	digests, ok := r.checksums[dir]
+	r.lock.Unlock()
+
+	if ok {
+		return digests, nil
+	}
+
+	data, err := fs.ReadFile(r, path.Join(dir, getChecksumManifestFileName()))
+	if errors.Is(err, fs.ErrNotExist) {
+		data = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if data != nil {
+		manifest, err := utils.NewVersionedJSON[ChecksumManifest](ChecksumManifestVersion, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the checksum manifest of '%v': %w", dir, err)
+		}
+
+		digests = make(map[string]string, len(manifest.Payload.Files))
+		for _, file := range manifest.Payload.Files {
+			digests[file.Path] = file.SHA256
+		}
+	}
+
+	r.lock.Lock()
+	r.checksums[dir] = digests
+	r.lock.Unlock()
+
+	return digests, nil
+}
+
+// remoteFile is a file of a remote backup. Read streams the file from a single request, ReadAt fetches the requested
+// range. A file read in full with Read is checked against its digest when the end is reached.
+type remoteFile struct {
+	fsys   *remoteFS
+	name   string
+	info   remoteObject
+	digest string // Empty if the file is not listed in a checksum manifest.
+
+	body   io.ReadCloser // Nil until the first Read.
+	offset int64
+	hash   hash.Hash
+	err    error // Returned by the reads after the end of the file or a failure.
+}
+
+func (f *remoteFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *remoteFile) Read(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	if f.offset >= f.info.size {
+		f.err = f.verify()
+		return 0, f.err
+	}
+
+	if f.body == nil {
+		body, err := f.fsys.backend.getRange(f.fsys.ctx, f.name, f.offset, f.info.size-f.offset)
+		if err != nil {
+			return 0, err
+		}
+
+		f.body = body
+	}
+
+	n, err := f.body.Read(p)
+	f.hash.Write(p[:n])
+	f.offset += int64(n)
+
+	switch {
+	case errors.Is(err, io.EOF) && f.offset < f.info.size:
+		f.err = fmt.Errorf("failed to download '%v': %w", f.name, io.ErrUnexpectedEOF)
+		return n, f.err
+
+	case errors.Is(err, io.EOF) || f.offset == f.info.size:
+		f.err = f.verify()
+		return n, f.err
+
+	case err != nil:
+		f.err = fmt.Errorf("failed to download '%v': %w", f.name, err)
+		return n, f.err
+	}
+
+	return n, nil
+}
+
+// verify compares the digest of the file read in full to the checksum manifest. It returns io.EOF if they match.
+func (f *remoteFile) verify() error {
+	if len(f.digest) != 0 && hex.EncodeToString(f.hash.Sum(nil)) != f.digest {
+		return fmt.Errorf("%w: '%v'", ErrRemoteChecksumMismatch, f.name)
+	}
+
+	return io.EOF
+}
+
+func (f *remoteFile) ReadAt(p []byte, offset int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if offset >= f.info.size {
+		return 0, io.EOF
+	}
+
+	length := min(int64(len(p)), f.info.size-offset)
+
+	body, err := f.fsys.backend.getRange(f.fsys.ctx, f.name, offset, length)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close() //nolint:errcheck
+
+	n, err := io.ReadFull(body, p[:length])
+	if err != nil {
+		return n, fmt.Errorf("failed to download '%v': %w", f.name, err)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *remoteFile) Close() error {
+	if f.body == nil {
+		return nil
+	}
+
+	return f.body.Close()
+}
+
+// remoteCachedFile is a file of a remote backup served from the local cache.
+type remoteCachedFile struct {
+	info   remoteObject
+	reader *bytes.Reader
+}
+
+func (f *remoteCachedFile) Stat() (fs.FileInfo, error)              { return f.info, nil }
+func (f *remoteCachedFile) Read(b []byte) (int, error)              { return f.reader.Read(b) }
+func (f *remoteCachedFile) ReadAt(b []byte, off int64) (int, error) { return f.reader.ReadAt(b, off) }
+func (f *remoteCachedFile) Close() error                            { return nil }
+
+// remoteDir is a folder of a remote backup.
+type remoteDir struct {
+	fsys    *remoteFS
+	name    string
+	info    remoteObject
+	entries []fs.DirEntry // Nil until the first ReadDir.
+}
+
+func (d *remoteDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *remoteDir) Close() error               { return nil }
+
+func (d *remoteDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *remoteDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+
+		d.entries = entries
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = d.entries[len(d.entries):]
+
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+
+	return entries, nil
+}
+
+// getRemoteResponse sends a request for a file of a remote backup and checks the status of the response.
+func getRemoteResponse(client *http.Client, req *http.Request, expectedStatus ...int) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRemoteRequestFailed, err)
+	}
+
+	if slices.Contains(expectedStatus, resp.StatusCode) {
+		return resp, nil
+	}
+
+	_ = resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, fs.ErrNotExist
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, ErrRemoteAccessDenied
+	case http.StatusOK:
+		return nil, ErrRemoteRangeNotSupported
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrRemoteRequestFailed, resp.Status)
+	}
+}
+
+// setRangeHeader selects length bytes at offset of the requested file, the rest of the file if length is negative. It
+// returns the statuses of a valid response: a server ignoring the range returns the whole file, which is only what was
+// asked for if the range starts at 0.
+func setRangeHeader(req *http.Request, offset, length int64) []int {
+	switch {
+	case length < 0 && offset == 0:
+		return []int{http.StatusOK}
+	case length < 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+	default:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", offset, offset+length-1))
+	}
+
+	if offset == 0 {
+		return []int{http.StatusPartialContent, http.StatusOK}
+	}
+
+	return []int{http.StatusPartialContent}
+}
+
+// limitRemoteBody returns the body of the response to a range request of length bytes, see setRangeHeader.
+func limitRemoteBody(resp *http.Response, length int64) io.ReadCloser {
+	if length < 0 {
+		return resp.Body
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, length), resp.Body}
+}
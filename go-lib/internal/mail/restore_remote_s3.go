@@ -0,0 +1,371 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadSHA256 is the digest of the empty body of the GET requests.
+const emptyPayloadSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Backend reads a backup from an S3 bucket, or from an S3 compatible service selected with RemoteS3EndpointEnvVar.
+// Folders are listed with ListObjectsV2 and files are read with ranged GET requests. The requests are signed with
+// Signature Version 4 when AWS_ACCESS_KEY_ID is set, the bucket is read anonymously otherwise. It also uploads the
+// exports relocated to the bucket, see putObject.
+type s3Backend struct {
+	client      *http.Client
+	endpoint    url.URL // Scheme and host of the service.
+	pathStyle   bool    // The bucket is in the path of the URLs rather than in the host.
+	bucket      string
+	prefix      string // Key of the backup location, without trailing slash.
+	region      string
+	credentials s3Credentials
+	now         func() time.Time
+}
+
+type s3Credentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+func newS3Backend(location *url.URL) (*s3Backend, error) {
+	region := os.Getenv("AWS_REGION")
+	if len(region) == 0 {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+
+	b := &s3Backend{
+		client: http.DefaultClient,
+		bucket: location.Host,
+		prefix: strings.Trim(location.Path, "/"),
+		region: region,
+		credentials: s3Credentials{
+			accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		},
+		now: time.Now,
+	}
+
+	if endpoint := os.Getenv(RemoteS3EndpointEnvVar); len(endpoint) != 0 {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("invalid %v: '%v'", RemoteS3EndpointEnvVar, endpoint)
+		}
+
+		b.endpoint = url.URL{Scheme: u.Scheme, Host: u.Host}
+		b.pathStyle = true
+	} else {
+		b.endpoint = url.URL{Scheme: "https", Host: "s3." + region + ".amazonaws.com"}
+
+		// The certificate of the service does not cover the virtual hosts of the buckets with a dot in their name.
+		b.pathStyle = strings.Contains(b.bucket, ".")
+	}
+
+	return b, nil
+}
+
+type s3ListBucketResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+		ETag         string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+func (b *s3Backend) getKey(name string) string {
+	if name == "." {
+		return b.prefix
+	}
+
+	return path.Join(b.prefix, name)
+}
+
+// newRequest creates a request for the object key, the bucket if key is empty. The path and the query are encoded as
+// they are signed, payloadSHA256 is the digest of body.
+func (b *s3Backend) newRequest(
+	ctx context.Context,
+	method, key string,
+	query url.Values,
+	body io.Reader,
+	payloadSHA256 string,
+) (*http.Request, error) {
+	u := b.endpoint
+	u.Path = "/" + key
+
+	if b.pathStyle {
+		u.Path = "/" + b.bucket + u.Path
+	} else {
+		u.Host = b.bucket + "." + u.Host
+	}
+
+	u.RawPath = s3URIEncode(u.Path, false)
+	u.RawQuery = getS3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Amz-Content-Sha256", payloadSHA256)
+
+	return req, nil
+}
+
+func (b *s3Backend) send(req *http.Request, expectedStatus ...int) (*http.Response, error) {
+	if len(b.credentials.accessKeyID) != 0 {
+		if len(b.credentials.sessionToken) != 0 {
+			req.Header.Set("X-Amz-Security-Token", b.credentials.sessionToken)
+		}
+
+		signS3Request(req, b.credentials, b.region, b.now())
+	}
+
+	return getRemoteResponse(b.client, req, expectedStatus...)
+}
+
+func (b *s3Backend) listDir(ctx context.Context, dir string) ([]remoteObject, error) {
+	prefix := b.getKey(dir)
+	if len(prefix) != 0 {
+		prefix += "/"
+	}
+
+	var (
+		objects []remoteObject
+		token   string
+	)
+
+	for {
+		query := url.Values{"list-type": {"2"}, "delimiter": {"/"}, "prefix": {prefix}}
+		if len(token) != 0 {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := b.newRequest(ctx, http.MethodGet, "", query, nil, emptyPayloadSHA256)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := b.getListBucketResult(req)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, commonPrefix := range result.CommonPrefixes {
+			if name := strings.TrimSuffix(strings.TrimPrefix(commonPrefix.Prefix, prefix), "/"); isValidPackEntryName(name) {
+				objects = append(objects, remoteObject{name: name, isDir: true})
+			}
+		}
+
+		for _, content := range result.Contents {
+			if name := strings.TrimPrefix(content.Key, prefix); isValidPackEntryName(name) {
+				objects = append(objects, remoteObject{
+					name:    name,
+					size:    content.Size,
+					modTime: content.LastModified,
+					etag:    content.ETag,
+				})
+			}
+		}
+
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			break
+		}
+
+		token = result.NextContinuationToken
+	}
+
+	// Folders only exist in S3 as the prefix of the keys of their files.
+	if len(objects) == 0 {
+		return nil, fs.ErrNotExist
+	}
+
+	return objects, nil
+}
+
+func (b *s3Backend) getListBucketResult(req *http.Request) (s3ListBucketResult, error) {
+	resp, err := b.send(req, http.StatusOK)
+	if err != nil {
+		return s3ListBucketResult{}, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	var result s3ListBucketResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return s3ListBucketResult{}, fmt.Errorf("%w: invalid listing: %v", ErrRemoteRequestFailed, err)
+	}
+
+	return result, nil
+}
+
+func (b *s3Backend) getRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	req, err := b.newRequest(ctx, http.MethodGet, b.getKey(name), nil, nil, emptyPayloadSHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	expectedStatus := setRangeHeader(req, offset, length)
+
+	resp, err := b.send(req, expectedStatus...)
+	if err != nil {
+		return nil, err
+	}
+
+	return limitRemoteBody(resp, length), nil
+}
+
+// putObject uploads size bytes of body to the file name. The service refuses the upload if the content it received does
+// not have the SHA-256 digest given.
+func (b *s3Backend) putObject(ctx context.Context, name string, body io.Reader, size int64, digest string) error {
+	req, err := b.newRequest(ctx, http.MethodPut, b.getKey(name), nil, body, digest)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+
+	resp, err := b.send(req, http.StatusOK)
+	if err != nil {
+		return fmt.Errorf("failed to upload '%v': %w", name, err)
+	}
+
+	return resp.Body.Close()
+}
+
+// signS3Request adds the Signature Version 4 authorization of the request. The host, the range and the x-amz-* headers
+// are signed.
+func signS3Request(req *http.Request, credentials s3Credentials, region string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+
+	headers := map[string]string{"host": req.URL.Host}
+
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + credentials.secretAccessKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		credentials.accessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// s3URIEncode percent-encodes all the bytes but the unreserved characters, and the slashes unless encodeSlash is set.
+func s3URIEncode(s string, encodeSlash bool) string {
+	var builder strings.Builder
+
+	for _, c := range []byte(s) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			builder.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			builder.WriteByte(c)
+		default:
+			fmt.Fprintf(&builder, "%%%02X", c)
+		}
+	}
+
+	return builder.String()
+}
+
+// getS3CanonicalQuery encodes the query sorted by name, as it is signed.
+func getS3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var parts []string
+
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, s3URIEncode(name, true)+"="+s3URIEncode(value, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const sftpDialTimeout = 30 * time.Second
+
+// sftpBackend reads a backup from an SFTP server. The path of the URL is an absolute path on the server. The user is
+// given with RemoteSFTPUserEnvVar and authenticates with the private key file of RemoteSFTPKeyEnvVar, the password of
+// RemoteSFTPPasswordEnvVar, or both. The key of the server must be listed in the known_hosts file of the user, or in
+// the one given with RemoteSFTPKnownHostsEnvVar.
+type sftpBackend struct {
+	conn   io.Closer // SSH connection of the client, nil if it is not owned by the backend.
+	client *sftp.Client
+	root   string // Path of the backup location.
+}
+
+func newSFTPBackend(ctx context.Context, location *url.URL) (*sftpBackend, error) {
+	config, err := getSFTPClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	address := location.Host
+	if len(location.Port()) == 0 {
+		address = net.JoinHostPort(location.Hostname(), "22")
+	}
+
+	dialer := net.Dialer{Timeout: sftpDialTimeout}
+
+	netConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRemoteRequestFailed, err)
+	}
+
+	sshConn, channels, requests, err := ssh.NewClientConn(netConn, address, config)
+	if err != nil {
+		_ = netConn.Close()
+		return nil, fmt.Errorf("%w: %v", ErrRemoteAccessDenied, err)
+	}
+
+	conn := ssh.NewClient(sshConn, channels, requests)
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: %v", ErrRemoteRequestFailed, err)
+	}
+
+	return &sftpBackend{conn: conn, client: client, root: path.Clean("/" + location.Path)}, nil
+}
+
+func getSFTPClientConfig() (*ssh.ClientConfig, error) {
+	user := os.Getenv(RemoteSFTPUserEnvVar)
+	if len(user) == 0 {
+		return nil, fmt.Errorf("the user of the SFTP server must be given with %v", RemoteSFTPUserEnvVar)
+	}
+
+	var auth []ssh.AuthMethod
+
+	if keyPath := os.Getenv(RemoteSFTPKeyEnvVar); len(keyPath) != 0 {
+		b, err := os.ReadFile(keyPath) //nolint:gosec
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SFTP private key: %w", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SFTP private key: %w", err)
+		}
+
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	if password := os.Getenv(RemoteSFTPPasswordEnvVar); len(password) != 0 {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no SFTP credentials, set %v or %v", RemoteSFTPKeyEnvVar, RemoteSFTPPasswordEnvVar)
+	}
+
+	knownHostsPath := os.Getenv(RemoteSFTPKnownHostsEnvVar)
+	if len(knownHostsPath) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate the known_hosts file: %w", err)
+		}
+
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the known_hosts file: %w", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sftpDialTimeout,
+	}, nil
+}
+
+func (s *sftpBackend) getPath(name string) string {
+	return path.Join(s.root, name)
+}
+
+func (s *sftpBackend) listDir(_ context.Context, dir string) ([]remoteObject, error) {
+	infos, err := s.client.ReadDir(s.getPath(dir))
+	if err != nil {
+		return nil, getSFTPError(err)
+	}
+
+	objects := make([]remoteObject, 0, len(infos))
+
+	for _, info := range infos {
+		if !isValidPackEntryName(info.Name()) || (!info.IsDir() && !info.Mode().IsRegular()) {
+			continue
+		}
+
+		objects = append(objects, remoteObject{
+			name:    info.Name(),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			isDir:   info.IsDir(),
+		})
+	}
+
+	return objects, nil
+}
+
+func (s *sftpBackend) getRange(_ context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	file, err := s.client.Open(s.getPath(name))
+	if err != nil {
+		return nil, getSFTPError(err)
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, getSFTPError(err)
+	}
+
+	if length < 0 {
+		return file, nil
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+// Close closes the SFTP session and its connection.
+func (s *sftpBackend) Close() error {
+	err := s.client.Close()
+
+	if s.conn != nil {
+		if connErr := s.conn.Close(); err == nil {
+			err = connErr
+		}
+	}
+
+	return err
+}
+
+// getSFTPError maps the errors of the SFTP client to those of the other backends.
+func getSFTPError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fs.ErrNotExist
+	case errors.Is(err, fs.ErrPermission):
+		return ErrRemoteAccessDenied
+	default:
+		return fmt.Errorf("%w: %v", ErrRemoteRequestFailed, err)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+const webDAVPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/><getetag/></prop></propfind>`
+
+// webDAVBackend reads a backup from a WebDAV server. Folders are listed with PROPFIND requests of depth 1 and files are
+// read with ranged GET requests. The webdav scheme is served over HTTPS, webdav+http over plain HTTP.
+type webDAVBackend struct {
+	client   *http.Client
+	root     url.URL // URL of the backup location, with a trailing slash.
+	user     string
+	password string
+}
+
+func newWebDAVBackend(location *url.URL) *webDAVBackend {
+	root := *location
+	root.Scheme = "https"
+
+	if strings.EqualFold(location.Scheme, "webdav+http") {
+		root.Scheme = "http"
+	}
+
+	root.Path = strings.TrimSuffix(root.Path, "/") + "/"
+	root.RawPath = ""
+
+	return &webDAVBackend{
+		client:   http.DefaultClient,
+		root:     root,
+		user:     os.Getenv(RemoteWebDAVUserEnvVar),
+		password: os.Getenv(RemoteWebDAVPasswordEnvVar),
+	}
+}
+
+type webDAVMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"href"`
+		Propstats []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength int64  `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+				ETag          string `xml:"getetag"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func (w *webDAVBackend) getURL(name string, isDir bool) *url.URL {
+	u := w.root
+	if name != "." {
+		u.Path += name
+
+		if isDir {
+			u.Path += "/"
+		}
+	}
+
+	return &u
+}
+
+func (w *webDAVBackend) newRequest(ctx context.Context, method string, u *url.URL, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(w.user) != 0 {
+		req.SetBasicAuth(w.user, w.password)
+	}
+
+	return req, nil
+}
+
+func (w *webDAVBackend) listDir(ctx context.Context, dir string) ([]remoteObject, error) {
+	dirURL := w.getURL(dir, true)
+
+	req, err := w.newRequest(ctx, "PROPFIND", dirURL, strings.NewReader(webDAVPropfindBody))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := getRemoteResponse(w.client, req, http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	var multistatus webDAVMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return nil, fmt.Errorf("%w: invalid listing of '%v': %v", ErrRemoteRequestFailed, dir, err)
+	}
+
+	dirPath := strings.TrimSuffix(dirURL.Path, "/")
+
+	var objects []remoteObject
+
+	for _, response := range multistatus.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			continue
+		}
+
+		// The listing includes the folder itself.
+		hrefPath := strings.TrimSuffix(href.Path, "/")
+		if hrefPath == dirPath || path.Dir(hrefPath) != dirPath {
+			continue
+		}
+
+		for _, propstat := range response.Propstats {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+
+			object := remoteObject{
+				name:  path.Base(hrefPath),
+				size:  propstat.Prop.ContentLength,
+				etag:  propstat.Prop.ETag,
+				isDir: propstat.Prop.ResourceType.Collection != nil,
+			}
+
+			if modTime, err := http.ParseTime(propstat.Prop.LastModified); err == nil {
+				object.modTime = modTime
+			}
+
+			objects = append(objects, object)
+
+			break
+		}
+	}
+
+	return objects, nil
+}
+
+func (w *webDAVBackend) getRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	req, err := w.newRequest(ctx, http.MethodGet, w.getURL(name, false), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := getRemoteResponse(w.client, req, setRangeHeader(req, offset, length)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return limitRemoteBody(resp, length), nil
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+// Restore state
+// -------------
+// The progress of a restore is written periodically in the backup folder: the remote labels the backup labels were
+// mapped to, the import label and the messages imported so far. A resumed restore does not import these messages
+// again and reuses the labels instead of creating them again. The state is removed once every message was imported.
+// For archives, the state is written next to the archive. Transactional restores are rolled back when they fail, they
+// have no state.
+
+const RestoreStateVersion = 1
+
+var ErrResumeTransactional = errors.New("a transactional restore cannot be resumed")
+
+type RestoreState struct {
+	UserID        string
+	LabelMapping  map[string]string // Backup label IDs to remote label IDs.
+	ImportLabelID string            `json:",omitempty"`
+	ImportedIDs   map[string]string // Backup message IDs to the remote IDs of the imported messages.
+	UpdateTime    time.Time
+}
+
+func getRestoreStateFileName() string {
+	return "restore_state.json"
+}
+
+// LoadRestoreState reads the restore state at path.
+func LoadRestoreState(path string) (RestoreState, error) {
+	b, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return RestoreState{}, fmt.Errorf("failed to read restore state: %w", err)
+	}
+
+	state, err := utils.NewVersionedJSON[RestoreState](RestoreStateVersion, b)
+	if err != nil {
+		return RestoreState{}, fmt.Errorf("failed to parse restore state: %w", err)
+	}
+
+	return state.Payload, nil
+}
+
+// restoreStateTracker holds the state of a restore and writes it.
+type restoreStateTracker struct {
+	state     RestoreState
+	path      string
+	log       *logrus.Entry
+	lastWrite time.Time
+	now       func() time.Time
+}
+
+// SetResume makes the restore continue from the state of an interrupted restore of the same backup into the same
+// account, see RestoreState. The restore starts from scratch if there is none.
+func (r *RestoreTask) SetResume(enabled bool) {
+	r.resume = enabled
+}
+
+func (r *RestoreTask) GetResume() bool {
+	return r.resume
+}
+
+// GetResumedCount returns the number of messages imported by the previous runs of a resumed restore. They are included
+// in the imported count.
+func (r *RestoreTask) GetResumedCount() int64 {
+	return r.resumedCount
+}
+
+// getRestoreStatePath returns the path of the state of the restore. The backup folder must have been validated. The
+// state of the restore of a remote backup is kept in its cache folder.
+func (r *RestoreTask) getRestoreStatePath() string {
+	if r.remote != nil {
+		return filepath.Join(r.remote.cacheDir, getRestoreStateFileName())
+	}
+
+	if r.backupCloser != nil {
+		return r.backupPath + "." + getRestoreStateFileName()
+	}
+
+	return filepath.Join(r.GetBackupPath(), getRestoreStateFileName())
+}
+
+// startRestoreState loads the state of a resumed restore, or creates a new one.
+func (r *RestoreTask) startRestoreState() error {
+	if r.transactional {
+		if r.resume {
+			return ErrResumeTransactional
+		}
+
+		return nil
+	}
+
+	userID := r.session.GetUser().ID
+	tracker := &restoreStateTracker{
+		state: RestoreState{
+			UserID:       userID,
+			LabelMapping: make(map[string]string),
+			ImportedIDs:  make(map[string]string),
+		},
+		path:      r.getRestoreStatePath(),
+		log:       r.log,
+		lastWrite: time.Now(),
+		now:       time.Now,
+	}
+
+	if r.resume {
+		previous, err := LoadRestoreState(tracker.path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			r.log.Info("No restore state found, starting from scratch")
+		case err != nil:
+			return err
+		case previous.UserID != userID:
+			r.log.Warn("The restore state belongs to another account, starting from scratch")
+		default:
+			if previous.LabelMapping == nil {
+				previous.LabelMapping = make(map[string]string)
+			}
+			if previous.ImportedIDs == nil {
+				previous.ImportedIDs = make(map[string]string)
+			}
+
+			tracker.state = previous
+			r.log.WithField("importedCount", len(previous.ImportedIDs)).Info("Resuming restore")
+		}
+	}
+
+	r.restoreState = tracker
+
+	return nil
+}
+
+// skipImported returns the messages that were not imported by the previous runs of the restore. The imported ones are
+// counted as imported.
+func (r *RestoreTask) skipImported(messages []messageInfo, reporter Reporter) []messageInfo {
+	if r.restoreState == nil || len(r.restoreState.state.ImportedIDs) == 0 {
+		return messages
+	}
+
+	result := make([]messageInfo, 0, len(messages))
+	for _, message := range messages {
+		if _, ok := r.restoreState.state.ImportedIDs[message.messageID]; ok {
+			r.resumedCount++
+			continue
+		}
+
+		result = append(result, message)
+	}
+
+	r.importedCount += r.resumedCount
+	reporter.SetMessageProcessed(uint64(r.resumedCount))
+	r.log.WithField("resumedCount", r.resumedCount).Info("Skipping the messages imported by the previous runs")
+
+	return result
+}
+
+// applyRestoreState reuses the labels created by the previous runs of the restore that still exist on the server.
+func (r *RestoreTask) applyRestoreState(plan []LabelPlanEntry, remoteLabels []proton.Label) []LabelPlanEntry {
+	if r.restoreState == nil {
+		return plan
+	}
+
+	exists := func(id string) bool {
+		return slices.ContainsFunc(remoteLabels, func(l proton.Label) bool { return l.ID == id })
+	}
+
+	for i := range plan {
+		entry := &plan[i]
+		if entry.Action == LabelPlanActionMap {
+			continue
+		}
+
+		if remoteID, ok := r.restoreState.state.LabelMapping[entry.BackupLabel.ID]; ok && exists(remoteID) {
+			entry.Action = LabelPlanActionMap
+			entry.RemoteLabelID = remoteID
+		}
+	}
+
+	if importLabelID := r.restoreState.state.ImportLabelID; len(importLabelID) != 0 && exists(importLabelID) {
+		r.importLabelID = importLabelID
+	}
+
+	return plan
+}
+
+// markImported records a message imported by the restore. resultLock must be held.
+func (r *RestoreTask) markImported(backupID, remoteID string) {
+	if r.restoreState != nil {
+		r.restoreState.state.ImportedIDs[backupID] = remoteID
+	}
+}
+
+// saveRestoreState writes the state of the restore, at most once per checkpointInterval unless force is set.
+func (r *RestoreTask) saveRestoreState(force bool) {
+	if r.restoreState == nil {
+		return
+	}
+
+	r.resultLock.Lock()
+	defer r.resultLock.Unlock()
+
+	for backupID, remoteID := range r.labelMapping {
+		r.restoreState.state.LabelMapping[backupID] = remoteID
+	}
+
+	r.restoreState.state.ImportLabelID = r.importLabelID
+
+	if err := r.restoreState.write(force); err != nil {
+		r.log.WithError(err).Warn("Failed to update restore state")
+	}
+}
+
+// finishRestoreState removes the state of a restore that imported every message and writes it otherwise.
+func (r *RestoreTask) finishRestoreState(err error) {
+	if r.restoreState == nil {
+		return
+	}
+
+	if err != nil || r.ctx.Err() != nil || r.failedCount != 0 {
+		r.saveRestoreState(true)
+		return
+	}
+
+	if err := os.Remove(r.restoreState.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		r.log.WithError(err).Warn("Failed to remove restore state")
+	}
+}
+
+func (t *restoreStateTracker) write(force bool) error {
+	now := t.now()
+	if !force && now.Sub(t.lastWrite) < checkpointInterval {
+		return nil
+	}
+
+	t.lastWrite = now
+	t.state.UpdateTime = now.UTC()
+
+	data, err := utils.GenerateVersionedJSON(RestoreStateVersion, &t.state)
+	if err != nil {
+		return fmt.Errorf("failed to json encode restore state: %w", err)
+	}
+
+	if err := utils.WriteFileSafe(filepath.Dir(t.path), t.path, data, nil); err != nil {
+		return fmt.Errorf("failed to write restore state: %w", err)
+	}
+
+	return nil
+}
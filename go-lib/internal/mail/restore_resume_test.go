@@ -0,0 +1,90 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreState_Resume(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), getRestoreStateFileName())
+
+	newTask := func(state RestoreState) *RestoreTask {
+		return &RestoreTask{
+			ctx:          context.Background(),
+			log:          logrus.WithField("t", "t"),
+			labelMapping: make(map[string]string),
+			restoreState: &restoreStateTracker{state: state, path: statePath, log: logrus.WithField("t", "t"), now: time.Now},
+		}
+	}
+
+	// First run, interrupted after importing a message.
+	first := newTask(RestoreState{UserID: "alice", LabelMapping: map[string]string{}, ImportedIDs: map[string]string{}})
+	first.labelMapping["backup-label"] = "remote-label"
+	first.importLabelID = "import-label"
+	first.markImported("msg1", "remote1")
+	first.finishRestoreState(context.Canceled)
+
+	state, err := LoadRestoreState(statePath)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"backup-label": "remote-label"}, state.LabelMapping)
+	require.Equal(t, "import-label", state.ImportLabelID)
+	require.Equal(t, map[string]string{"msg1": "remote1"}, state.ImportedIDs)
+
+	// Second run, resumed from the state.
+	second := newTask(state)
+
+	messages := second.skipImported([]messageInfo{{messageID: "msg1"}, {messageID: "msg2"}}, NullProgressReporter{})
+	require.Equal(t, []messageInfo{{messageID: "msg2"}}, messages)
+	require.Equal(t, int64(1), second.GetResumedCount())
+	require.Equal(t, int64(1), second.GetImportedCount())
+
+	plan := []LabelPlanEntry{
+		{BackupLabel: proton.Label{ID: "backup-label"}, Action: LabelPlanActionCreate},
+		{BackupLabel: proton.Label{ID: "other-label"}, Action: LabelPlanActionCreate},
+	}
+	plan = second.applyRestoreState(plan, []proton.Label{{ID: "remote-label"}, {ID: "import-label"}})
+	require.Equal(t, LabelPlanActionMap, plan[0].Action)
+	require.Equal(t, "remote-label", plan[0].RemoteLabelID)
+	require.Equal(t, LabelPlanActionCreate, plan[1].Action)
+	require.Equal(t, "import-label", second.importLabelID)
+
+	// The state is removed once every message was imported.
+	second.finishRestoreState(nil)
+	_, err = os.Stat(statePath)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRestoreState_DeletedLabels(t *testing.T) {
+	r := &RestoreTask{restoreState: &restoreStateTracker{state: RestoreState{
+		LabelMapping:  map[string]string{"backup-label": "deleted-label"},
+		ImportLabelID: "deleted-import-label",
+	}}}
+
+	plan := r.applyRestoreState([]LabelPlanEntry{{BackupLabel: proton.Label{ID: "backup-label"}, Action: LabelPlanActionCreate}}, nil)
+	require.Equal(t, LabelPlanActionCreate, plan[0].Action)
+	require.Empty(t, r.importLabelID)
+}
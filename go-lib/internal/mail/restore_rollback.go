@@ -0,0 +1,136 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const rollbackTimeout = 10 * time.Minute
+
+var ErrRestoreRolledBack = errors.New("restore was rolled back")
+
+// SetTransactional enables the all-or-nothing mode. When enabled, every message imported and every label created
+// by the restore is deleted if the restore fails, is cancelled or if any message could not be imported. The messages
+// skipped because they are already in the account, see SetSkipDuplicates, do not count as not imported.
+func (r *RestoreTask) SetTransactional(transactional bool) {
+	r.transactional = transactional
+}
+
+func (r *RestoreTask) IsTransactional() bool {
+	return r.transactional
+}
+
+func (r *RestoreTask) GetRolledBack() bool {
+	return r.rolledBack
+}
+
+func (r *RestoreTask) trackCreatedLabel(labelID string) {
+	if r.transactional {
+		r.createdLabelIDs = append(r.createdLabelIDs, labelID)
+	}
+}
+
+func (r *RestoreTask) trackImportedMessage(messageID string) {
+	if r.transactional {
+		r.importedMessageIDs = append(r.importedMessageIDs, messageID)
+	}
+}
+
+// finishTransaction rolls back the changes made to the account if the restore did not fully succeed.
+func (r *RestoreTask) finishTransaction(err error) error {
+	if !r.transactional {
+		return err
+	}
+
+	// Cancellation during the import is not always reported as an error as failed batches are retried one by one.
+	if err == nil {
+		err = r.ctx.Err()
+	}
+
+	// The messages already in the account are skipped on purpose, see SetSkipDuplicates.
+	if notImported := r.failedCount + r.GetSkippedCount() - r.GetDuplicateCount(); err == nil && notImported != 0 {
+		err = fmt.Errorf("%v message(s) could not be imported", notImported)
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	r.log.WithError(err).Warn("Restore did not complete, rolling back")
+
+	if rollbackErr := r.Rollback(); rollbackErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to roll back restore: %w", rollbackErr))
+	}
+
+	// Preserve the cancellation so callers can still report it as such.
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", ErrRestoreRolledBack, err)
+}
+
+// Rollback deletes the messages imported and the labels created by the restore. Labels are deleted in reverse
+// creation order so that children are removed before their parents.
+func (r *RestoreTask) Rollback() error {
+	// The task context may already be cancelled, the rollback must still be able to reach the server.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.ctx), rollbackTimeout)
+	defer cancel()
+
+	client := r.session.GetClient()
+
+	if len(r.importedMessageIDs) != 0 {
+		r.log.WithField("count", len(r.importedMessageIDs)).Info("Deleting imported messages")
+		if err := client.DeleteMessage(ctx, r.importedMessageIDs...); err != nil {
+			return fmt.Errorf("failed to delete imported messages: %w", err)
+		}
+		r.importedMessageIDs = nil
+	}
+
+	for len(r.createdLabelIDs) != 0 {
+		labelID := r.createdLabelIDs[len(r.createdLabelIDs)-1]
+		if err := client.DeleteLabel(ctx, labelID); err != nil {
+			return fmt.Errorf("failed to delete label %v: %w", labelID, err)
+		}
+
+		r.log.WithField("remoteLabelID", labelID).Info("Deleted label")
+		r.createdLabelIDs = r.createdLabelIDs[:len(r.createdLabelIDs)-1]
+	}
+
+	r.rolledBack = true
+
+	return nil
+}
+
+func (r *RestoreTask) logRollbackState() {
+	if !r.transactional {
+		return
+	}
+
+	r.log.WithFields(logrus.Fields{
+		"rolledBack":           r.rolledBack,
+		"pendingMessageDelete": len(r.importedMessageIDs),
+		"pendingLabelDelete":   len(r.createdLabelIDs),
+	}).Info("Transaction state")
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/export-tool/internal/reporter"
+	"github.com/ProtonMail/export-tool/internal/session"
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/gluon/async"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestRestoreTask_FinishTransaction_PartialImport(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+	r := newTransactionalRestoreTask(t, context.Background(), mockCtrl, client)
+
+	r.trackCreatedLabel("parent")
+	r.trackCreatedLabel("child")
+	r.importableCount = 3
+	r.recordImported(&proton.MessageMetadata{ID: "b1"}, "r1", 10)
+	r.recordImported(&proton.MessageMetadata{ID: "b2"}, "r2", 10)
+	r.recordFailure("b3", errors.New("import failed"))
+
+	// Children are deleted before their parents.
+	gomock.InOrder(
+		client.EXPECT().DeleteMessage(gomock.Any(), "r1", "r2").Return(nil),
+		client.EXPECT().DeleteLabel(gomock.Any(), "child").Return(nil),
+		client.EXPECT().DeleteLabel(gomock.Any(), "parent").Return(nil),
+	)
+
+	err := r.finishTransaction(nil)
+	require.ErrorIs(t, err, ErrRestoreRolledBack)
+	require.ErrorContains(t, err, "1 message(s) could not be imported")
+	require.True(t, r.GetRolledBack())
+	require.Empty(t, r.importedMessageIDs)
+	require.Empty(t, r.createdLabelIDs)
+}
+
+func TestRestoreTask_FinishTransaction_Cancelled(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newTransactionalRestoreTask(t, ctx, mockCtrl, client)
+
+	r.trackCreatedLabel("label")
+	r.importableCount = 1
+	r.recordImported(&proton.MessageMetadata{ID: "b1"}, "r1", 10)
+
+	cancel()
+
+	// The rollback still reaches the server once the task is cancelled.
+	client.EXPECT().DeleteMessage(gomock.Any(), "r1").DoAndReturn(func(ctx context.Context, _ ...string) error {
+		return ctx.Err()
+	})
+	client.EXPECT().DeleteLabel(gomock.Any(), "label").DoAndReturn(func(ctx context.Context, _ string) error {
+		return ctx.Err()
+	})
+
+	err := r.finishTransaction(nil)
+	require.ErrorIs(t, err, context.Canceled)
+	require.NotErrorIs(t, err, ErrRestoreRolledBack)
+	require.True(t, r.GetRolledBack())
+}
+
+func TestRestoreTask_FinishTransaction_LabelDeletionFailure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+	r := newTransactionalRestoreTask(t, context.Background(), mockCtrl, client)
+
+	r.trackCreatedLabel("parent")
+	r.trackCreatedLabel("child")
+
+	errDelete := errors.New("delete failed")
+
+	gomock.InOrder(
+		client.EXPECT().DeleteLabel(gomock.Any(), "child").Return(nil),
+		client.EXPECT().DeleteLabel(gomock.Any(), "parent").Return(errDelete),
+	)
+
+	errRestore := errors.New("restore failed")
+
+	err := r.finishTransaction(errRestore)
+	require.ErrorIs(t, err, errRestore)
+	require.ErrorIs(t, err, errDelete)
+	require.False(t, r.GetRolledBack())
+
+	// The label left behind is deleted by the next rollback.
+	require.Equal(t, []string{"parent"}, r.createdLabelIDs)
+
+	client.EXPECT().DeleteLabel(gomock.Any(), "parent").Return(nil)
+	require.NoError(t, r.Rollback())
+	require.True(t, r.GetRolledBack())
+}
+
+func TestRestoreTask_FinishTransaction_Complete(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+	r := newTransactionalRestoreTask(t, context.Background(), mockCtrl, client)
+
+	r.trackCreatedLabel("label")
+	r.importableCount = 1
+	r.recordImported(&proton.MessageMetadata{ID: "b1"}, "r1", 10)
+
+	// Nothing is deleted when every message was imported.
+	require.NoError(t, r.finishTransaction(nil))
+	require.False(t, r.GetRolledBack())
+
+	// Nor when the restore is not transactional.
+	r.transactional = false
+	errRestore := errors.New("restore failed")
+	require.Equal(t, errRestore, r.finishTransaction(errRestore))
+}
+
+func TestRestoreTask_Rollback_KeepsExistingLabelsAndMessages(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+	r := newTransactionalRestoreTask(t, context.Background(), mockCtrl, client)
+
+	labels, err := utils.GenerateVersionedJSON(LabelMetadataVersion, []proton.Label{
+		{ID: "backup-work", Name: "Work", Type: proton.LabelTypeFolder},
+		{ID: "backup-personal", Name: "Personal", Type: proton.LabelTypeFolder},
+		{ID: "backup-archive", Name: "Archive", Type: proton.LabelTypeLabel},
+	})
+	require.NoError(t, err)
+
+	r.backupFS = fstest.MapFS{getLabelFileName(): &fstest.MapFile{Data: labels}}
+
+	client.EXPECT().GetLabels(gomock.Any(), gomock.Any()).Return([]proton.Label{
+		{ID: "remote-inbox", Name: "Inbox", Type: proton.LabelTypeSystem},
+		{ID: "remote-work", Name: "Work", Type: proton.LabelTypeFolder},
+	}, nil)
+	client.EXPECT().CreateLabel(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req proton.CreateLabelReq) (proton.Label, error) {
+			return proton.Label{ID: "created-" + req.Name, Name: req.Name, Type: req.Type}, nil
+		},
+	).Times(3)
+
+	require.NoError(t, r.restoreLabels())
+	require.NoError(t, r.createImportLabel())
+	require.Equal(t, "remote-work", r.labelMapping["backup-work"])
+
+	// One message is imported, the messages already in the account are never part of the rollback.
+	r.importableCount = 2
+	r.recordImported(&proton.MessageMetadata{ID: "b1"}, "r1", 10)
+
+	client.EXPECT().DeleteMessage(gomock.Any(), "r1").Return(nil)
+	for _, id := range []string{"created-Personal", "created-Archive", r.importLabelID} {
+		client.EXPECT().DeleteLabel(gomock.Any(), id).Return(nil)
+	}
+
+	require.ErrorIs(t, r.finishTransaction(nil), ErrRestoreRolledBack)
+}
+
+// newTransactionalRestoreTask returns a transactional restore task whose session uses client.
+func newTransactionalRestoreTask(
+	t *testing.T,
+	ctx context.Context, //nolint:revive
+	mockCtrl *gomock.Controller,
+	client *apiclient.MockClient,
+) *RestoreTask {
+	t.Helper()
+
+	return &RestoreTask{
+		ctx:           ctx,
+		backupDir:     ".",
+		session:       newMockSession(t, mockCtrl, client),
+		log:           logrus.WithField("test", "test"),
+		labelMapping:  make(map[string]string),
+		transactional: true,
+	}
+}
+
+// newMockSession returns a session logged in with client.
+func newMockSession(t *testing.T, mockCtrl *gomock.Controller, client *apiclient.MockClient) *session.Session {
+	t.Helper()
+
+	return newMockSessionWithUser(t, mockCtrl, client, proton.User{ID: "user-id"}, proton.Salts{})
+}
+
+// newMockSessionWithUser returns a session of user logged in with client and the password "password".
+func newMockSessionWithUser(
+	t *testing.T,
+	mockCtrl *gomock.Controller,
+	client *apiclient.MockClient,
+	user proton.User,
+	salts proton.Salts,
+) *session.Session {
+	t.Helper()
+
+	builder := apiclient.NewMockBuilder(mockCtrl)
+	builder.EXPECT().NewClient(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(client, proton.Auth{}, nil)
+	builder.EXPECT().Close()
+	client.EXPECT().GetUserWithHV(gomock.Any(), gomock.Any()).Return(user, nil)
+	client.EXPECT().GetSalts(gomock.Any()).Return(salts, nil)
+	client.EXPECT().GetOrganizationData(gomock.Any()).Return(proton.OrganizationResponse{}, nil)
+	client.EXPECT().AuthDelete(gomock.Any()).Return(nil)
+	client.EXPECT().Close()
+
+	s := session.NewSession(builder, nil, &async.NoopPanicHandler{}, &reporter.NullReporter{}, true)
+	require.NoError(t, s.Login(context.Background(), "user@proton.me", []byte("password")))
+	t.Cleanup(func() { s.Close(context.Background()) })
+
+	return s
+}
@@ -20,9 +20,11 @@ package mail
 import (
 	"bytes"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io/fs"
+	"path"
+	"sync"
 
+	"github.com/ProtonMail/gluon/async"
 	"github.com/ProtonMail/go-proton-api"
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/ProtonMail/proton-bridge/v3/pkg/message/parser"
@@ -38,112 +40,296 @@ type Message struct {
 
 const messageBatchSize = 10 // max batch size supported by go-proton-api (larger batches will be split).
 
+// NumParallelImports is the number of import batches submitted in parallel by paid accounts, see SetConcurrency.
+const NumParallelImports = 4
+
+// SetConcurrency overrides the number of import batches encrypted and submitted in parallel. With 0, the concurrency is
+// selected from the plan of the account.
+func (r *RestoreTask) SetConcurrency(concurrency int) error {
+	if err := validateConcurrency(concurrency); err != nil {
+		return err
+	}
+
+	r.concurrency = concurrency
+
+	return nil
+}
+
+// GetConcurrency returns the number of import batches the restore submits in parallel.
+func (r *RestoreTask) GetConcurrency() int {
+	if r.concurrency != 0 {
+		return r.concurrency
+	}
+
+	return DetectPlanTier(r.session.GetUser()).GetImportConcurrency()
+}
+
 func (r *RestoreTask) importMails(messageInfoList []messageInfo, reporter Reporter) error {
-	return r.withAddrKR(func(addrID string, addrKR *crypto.KeyRing) error {
-		messages := make([]Message, 0, messageBatchSize)
-		for _, info := range messageInfoList {
-			emlPath := filepath.Join(r.backupDir, info.messageID+emlExtension)
-			literal, err := os.ReadFile(emlPath) //nolint:gosec
-			if err != nil {
-				logrus.WithField("path", emlPath).Error("Could not read EML file. Skipping.")
-				reporter.OnProgress(1)
-				continue
+	reporter = &lockedProgressReporter{reporter: newETAProgressReporter(reporter, uint64(len(messageInfoList)))}
+
+	var attachmentStore DetachedAttachmentStore
+	if store := newFileDetachedAttachmentStore(r.backupFS, r.backupDir); store != nil {
+		r.log.Info("Backup contains detached attachments")
+		attachmentStore = store
+	}
+
+	// A tripped guardrail stops the restore as a fatal error: the batches being imported are interrupted.
+	r.guardrail = newRestoreGuardrail(r.guardrails, func(err error) {
+		r.log.WithError(err).Error("Aborting restore")
+		r.ctxCancel(&FatalError{Err: err})
+	})
+
+	stopGuardrail := make(chan struct{})
+	defer close(stopGuardrail)
+
+	go func() {
+		defer async.HandlePanic(r.session.GetPanicHandler())
+
+		r.guardrail.watchThroughput(stopGuardrail, r.GetImportedCount)
+	}()
+
+	err := r.withAddrKR(func(addrID string, addrKR *crypto.KeyRing) error {
+		concurrency := r.GetConcurrency()
+		r.log.WithField("concurrency", concurrency).Info("Importing messages")
+
+		// The batches are read from the backup sequentially and encrypted and submitted by the workers. The channel is
+		// unbuffered so that at most one batch per worker is held in memory while waiting.
+		batches := make(chan []Message)
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+				defer async.HandlePanic(r.session.GetPanicHandler())
+
+				for batch := range batches {
+					r.importMailBatch(addrID, addrKR, batch, reporter)
+					r.saveRestoreState(false)
+				}
+			}()
+		}
+
+		err := r.readMailBatches(messageInfoList, attachmentStore, reporter, func(batch []Message) error {
+			select {
+			case batches <- batch:
+				return nil
+			case <-r.ctx.Done():
+				return r.ctx.Err()
 			}
+		})
 
-			metadataPath := emlToMetadataFilename(emlPath)
-			metadata, err := loadMetadataFile(metadataPath)
-			if err != nil {
-				logrus.WithField("path", metadataPath).Error("Could not load metadata file. Skipping.")
+		close(batches)
+		wg.Wait()
+
+		return err
+	})
+
+	if guardrailErr := r.guardrail.getError(); guardrailErr != nil {
+		return guardrailErr
+	}
+
+	return err
+}
+
+// readMailBatches reads the messages of the backup and calls fn with batches of up to messageBatchSize of them.
+func (r *RestoreTask) readMailBatches(
+	messageInfoList []messageInfo,
+	attachmentStore DetachedAttachmentStore,
+	reporter Reporter,
+	fn func(batch []Message) error,
+) error {
+	messages := make([]Message, 0, messageBatchSize)
+	for _, info := range messageInfoList {
+		// The batches being imported finish, a graceful cancellation takes effect.
+		if r.canceller.isStopping() {
+			r.ctxCancel(ErrCancelledByUser)
+		}
+
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+
+		emlPath := path.Join(r.backupDir, info.messageID+emlExtension)
+		literal, err := fs.ReadFile(r.backupFS, emlPath)
+		if err != nil {
+			logrus.WithField("path", emlPath).Error("Could not read EML file. Skipping.")
+			reporter.OnProgress(1)
+			continue
+		}
+
+		if attachmentStore != nil {
+			if literal, err = reinlineDetachedAttachments(literal, attachmentStore); err != nil {
+				logrus.WithField("path", emlPath).WithError(err).Error("Could not re-inline detached attachments.")
+				r.recordFailure(info.messageID, err)
 				reporter.OnProgress(1)
+				continue
 			}
+		}
 
-			messages = append(messages, Message{literal: literal, metadata: metadata.MessageMetadata})
-			if len(messages) >= messageBatchSize {
-				if err := r.importMailBatch(addrID, addrKR, messages, reporter); err != nil {
-					return err
-				}
-				messages = messages[:0]
-			}
+		metadataPath := emlToMetadataFilename(emlPath)
+		metadata, err := loadMetadataFileFS(r.backupFS, metadataPath)
+		if err != nil {
+			logrus.WithField("path", metadataPath).Error("Could not load metadata file. Skipping.")
+			reporter.OnProgress(1)
 		}
 
-		if len(messages) > 0 {
-			if err := r.importMailBatch(addrID, addrKR, messages, reporter); err != nil {
+		messages = append(messages, Message{literal: literal, metadata: metadata.MessageMetadata})
+		if len(messages) >= messageBatchSize {
+			if err := fn(messages); err != nil {
 				return err
 			}
+
+			messages = make([]Message, 0, messageBatchSize)
 		}
-		return nil
-	})
+	}
+
+	if len(messages) > 0 {
+		return fn(messages)
+	}
+
+	return nil
 }
 
-func (r *RestoreTask) importMailBatch(addrID string, addrKR *crypto.KeyRing, messages []Message, reporter Reporter) error {
+func (r *RestoreTask) importMailBatch(addrID string, addrKR *crypto.KeyRing, messages []Message, reporter Reporter) {
 	defer reporter.OnProgress(len(messages))
 
 	reqs := make([]proton.ImportReq, 0, len(messages))
+	reqMessages := make([]Message, 0, len(messages)) // messages matching each entry of reqs.
 	for _, message := range messages {
 		log := r.log.WithField("messageID", message.metadata.AddressID)
 		labelIDs, err := r.getLabelList(message.metadata.LabelIDs)
 		if err != nil {
 			log.WithField("messageID", message.metadata.ID).WithError(err).Error("Could not map label to remote labels.")
-			r.failedCount++
+			r.recordFailure(message.metadata.ID, err)
 			continue
 		}
 
-		msgParser, err := parser.New(bytes.NewReader(message.literal))
+		literal, repairs, err := repairImportHeaders(message.literal, message.metadata.Time, message.metadata.ID)
 		if err != nil {
-			log.WithField(message.metadata.ID, message.metadata).WithError(err).Error("Failed to parse literal for message.")
-			r.failedCount++
+			log.WithField("messageID", message.metadata.ID).WithError(err).Error("Failed to repair the headers of the message.")
+			r.recordFailure(message.metadata.ID, err)
 			continue
 		}
 
-		// multipart body requires at least one text part to be properly encrypted.
-		if msgParser.AttachEmptyTextPartIfNoneExists() {
-			buf := new(bytes.Buffer)
-			if err := msgParser.NewWriter().Write(buf); err != nil {
-				log.WithError(err).Error("failed to add an empty text body.")
-				continue
-			}
-			message.literal = buf.Bytes()
+		for _, repair := range repairs {
+			log.WithField("messageID", message.metadata.ID).WithField("header", repair.name).WithField("original", repair.original).Info("Replaced invalid header")
+		}
+
+		literal, err = prepareImportLiteral(literal)
+		if err != nil {
+			log.WithField(message.metadata.ID, message.metadata).WithError(err).Error("Failed to parse literal for message.")
+			r.recordFailure(message.metadata.ID, err)
+			continue
 		}
+		message.literal = literal
 
 		reqs = append(reqs, proton.ImportReq{
 			Metadata: proton.ImportMetadata{
 				AddressID: addrID,
 				LabelIDs:  labelIDs,
 				Unread:    message.metadata.Unread,
-				Flags:     message.metadata.Flags,
+				Flags:     getImportFlags(&message.metadata),
 			},
 			Message: message.literal,
 		})
+		reqMessages = append(reqMessages, message)
 	}
 
 	if len(reqs) == 0 {
-		return nil
+		return
 	}
 
 	str, err := r.session.GetClient().ImportMessages(r.ctx, addrKR, -1, -1, reqs...)
 	if err != nil {
 		r.log.WithError(err).Error("Failed to prepare message batch for import. Retrying one by one.")
-		r.importOneByOne(reqs, messages, addrKR)
-		return nil
+		r.importOneByOne(reqs, reqMessages, addrKR)
+		return
 	}
 
 	results, err := stream.Collect(r.ctx, stream.Stream[proton.ImportRes](str))
 	if err != nil {
 		r.log.WithError(err).Error("An error occurred while importing a batch of messages. Retrying one by one.")
-		r.importOneByOne(reqs, messages, addrKR)
-		return nil
+		r.importOneByOne(reqs, reqMessages, addrKR)
+		return
 	}
 
 	for i, result := range results {
 		if result.Code != 1000 {
-			r.log.WithField("messageID", messages[i].metadata.ID).WithError(result.APIError).Error("Failed to import message")
-			r.failedCount++
+			r.log.WithField("messageID", reqMessages[i].metadata.ID).WithError(result.APIError).Error("Failed to import message")
+			r.recordFailure(reqMessages[i].metadata.ID, result.APIError)
 		} else {
-			r.importedCount++
+			r.recordImported(&reqMessages[i].metadata, result.MessageID, len(reqs[i].Message))
 		}
 	}
+}
 
-	return nil
+// recordImported records a message imported by a worker.
+func (r *RestoreTask) recordImported(backup *proton.MessageMetadata, remoteID string, size int) {
+	r.resultLock.Lock()
+	defer r.resultLock.Unlock()
+
+	r.trackImportedMessage(remoteID)
+	r.markImported(backup.ID, remoteID)
+	r.recordRestoredMessage(backup, remoteID)
+	r.bytesTransferred += uint64(size)
+	r.importedCount++
+	r.guardrail.record(false)
+}
+
+// getImportFlags returns the flags a message is imported with, so that it is restored as replied or forwarded as it was
+// in the account. The answered state is also read from the IsReplied, IsRepliedAll and IsForwarded fields as the flags
+// of older backups may lack it. The read and starred states are carried by the Unread field and the starred label.
+func getImportFlags(metadata *proton.MessageMetadata) proton.MessageFlag {
+	flags := metadata.Flags
+
+	if metadata.IsReplied {
+		flags |= proton.MessageFlagReplied
+	}
+
+	if metadata.IsRepliedAll {
+		flags |= proton.MessageFlagRepliedAll
+	}
+
+	if metadata.IsForwarded {
+		flags |= proton.MessageFlagForwarded
+	}
+
+	// Without direction the server imports the message as received, sent messages would be shown in the inbox.
+	if !flags.HasAny(proton.MessageFlagReceived, proton.MessageFlagSent) && slices.Contains(metadata.LabelIDs, proton.SentLabel) {
+		flags |= proton.MessageFlagSent
+	}
+
+	return flags
+}
+
+// prepareImportLiteral returns the literal of a message ready to be imported. A crash of the parser on a malformed
+// message is returned as an error so that the message is recorded as failed rather than aborting the restore.
+func prepareImportLiteral(literal []byte) (result []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("message %w: %v", errParserCrashed, r)
+		}
+	}()
+
+	msgParser, err := parser.New(bytes.NewReader(literal))
+	if err != nil {
+		return nil, err
+	}
+
+	// multipart body requires at least one text part to be properly encrypted.
+	if msgParser.AttachEmptyTextPartIfNoneExists() {
+		buf := new(bytes.Buffer)
+		if err := msgParser.NewWriter().Write(buf); err != nil {
+			return nil, fmt.Errorf("failed to add an empty text body: %w", err)
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	return literal, nil
 }
 
 func (r *RestoreTask) importOneByOne(requests []proton.ImportReq, messages []Message, addrKR *crypto.KeyRing) {
@@ -151,35 +337,43 @@ func (r *RestoreTask) importOneByOne(requests []proton.ImportReq, messages []Mes
 		resultStream, err := r.session.GetClient().ImportMessages(r.ctx, addrKR, -1, -1, request)
 		if err != nil {
 			r.log.WithError(err).WithField("messageID", messages[i].metadata.ID).Error("Failed to import message")
-			r.failedCount++
+			r.recordFailure(messages[i].metadata.ID, err)
 			continue
 		}
 
 		results, err := stream.Collect(r.ctx, stream.Stream[proton.ImportRes](resultStream))
 		if err != nil {
 			r.log.WithError(err).WithField("messageID", messages[i].metadata.ID).Error("Failed to import message")
-			r.failedCount++
+			r.recordFailure(messages[i].metadata.ID, err)
 			continue
 		}
 
 		if results[0].Code != 1000 {
 			r.log.WithField("messageID", messages[i].metadata.ID).WithError(results[0].APIError).Error("Failed to import message")
-			r.failedCount++
+			r.recordFailure(messages[i].metadata.ID, results[0].APIError)
 		} else {
-			r.importedCount++
+			r.recordImported(&messages[i].metadata, results[0].MessageID, len(request.Message))
 		}
 	}
 }
 
+// getLabelList returns the remote labels of a message with the given backup labels. System labels have the same ID on
+// every account. Without import label, messages left without any label are placed in the archive rather than only
+// being reachable from all mail.
 func (r *RestoreTask) getLabelList(labels []string) ([]string, error) {
 	var result = make([]string, 0, len(labels)+1)
-	result = append(result, r.importLabelID)
+	if len(r.importLabelID) != 0 {
+		result = append(result, r.importLabelID)
+	}
 
 	for _, label := range labels {
 		if !IsAcceptableLabel(label) {
 			continue
 		}
 		remoteLabel, ok := r.labelMapping[label]
+		if !ok && isSystemLabel(label) {
+			remoteLabel, ok = label, true
+		}
 		if !ok {
 			return nil, fmt.Errorf("could not find a remote label matching backup label %v", label)
 		}
@@ -187,6 +381,10 @@ func (r *RestoreTask) getLabelList(labels []string) ([]string, error) {
 		result = append(result, remoteLabel)
 	}
 
+	if len(result) == 0 {
+		result = append(result, proton.ArchiveLabel)
+	}
+
 	return result, nil
 }
 
@@ -20,9 +20,8 @@ package mail
 import (
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
-	"strings"
+	"io/fs"
+	"path"
 	"time"
 
 	"github.com/ProtonMail/export-tool/internal/utils"
@@ -34,72 +33,196 @@ import (
 var errCircularLabelReference = errors.New("unable to sort labels because of a circular reference")
 
 func (r *RestoreTask) restoreLabels() error {
-	backupLabels, err := r.readLabelFile()
+	plan, err := r.planLabels()
 	if err != nil {
 		return err
 	}
 
+	for _, entry := range plan {
+		select {
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		default:
+		}
+
+		if entry.Action == LabelPlanActionMap {
+			r.labelMapping[entry.BackupLabel.ID] = entry.RemoteLabelID
+			continue
+		}
+
+		label := entry.BackupLabel
+		label.Name = entry.Name
+		if err = r.createAndMapLabel(label); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type LabelPlanAction int
+
+const (
+	LabelPlanActionMap           LabelPlanAction = iota // The backup label is mapped to an existing remote label.
+	LabelPlanActionCreate                               // The label will be created with its original name.
+	LabelPlanActionCreateRenamed                        // A label of another type uses the name, the label will be created under a new name.
+)
+
+// LabelPlanEntry describes what the restore will do for a label of the backup.
+type LabelPlanEntry struct {
+	BackupLabel   proton.Label
+	Action        LabelPlanAction
+	RemoteLabelID string // Only set for LabelPlanActionMap.
+	Name          string // Name of the label on the server once the restore is complete.
+	Path          string // Full path of the label on the server, with parent names separated by '/'.
+}
+
+// PreviewLabels returns the label tree the restore will create or reuse, without modifying the account.
+func (r *RestoreTask) PreviewLabels() ([]LabelPlanEntry, error) {
+	if _, err := r.validateBackupDir(NullProgressReporter{}); err != nil {
+		return nil, err
+	}
+
+	return r.planLabels()
+}
+
+func (r *RestoreTask) planLabels() ([]LabelPlanEntry, error) {
+	backupLabels, err := r.readLabelFile()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.usedLabelIDs != nil {
+		backupLabels = keepUsedLabels(backupLabels, r.usedLabelIDs)
+	}
+
 	backupLabels, err = sortLabels(backupLabels)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	remoteLabels, err := r.session.GetClient().GetLabels(r.ctx, proton.LabelTypeFolder, proton.LabelTypeLabel, proton.LabelTypeSystem)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	return r.applyRestoreState(planLabels(backupLabels, remoteLabels, r.labelReuseMode), remoteLabels), nil
+}
+
+// LabelReuseMode controls whether the restore maps backup labels to existing remote labels.
+type LabelReuseMode int
+
+const (
+	LabelReuseModeReuseExisting LabelReuseMode = iota // Reuse remote labels with the same name, type and parent.
+	LabelReuseModeAlwaysCreate                        // Always create new labels, renaming them if the name is taken.
+)
+
+func (r *RestoreTask) SetLabelReuseMode(mode LabelReuseMode) {
+	r.labelReuseMode = mode
+}
+
+func (r *RestoreTask) GetLabelReuseMode() LabelReuseMode {
+	return r.labelReuseMode
+}
+
+// planLabels computes the restore action for each of the backup labels. backupLabels must be sorted with sortLabels.
+func planLabels(backupLabels, remoteLabels []proton.Label, mode LabelReuseMode) []LabelPlanEntry {
+	plan := make([]LabelPlanEntry, 0, len(backupLabels))
+	paths := make(map[string]string, len(backupLabels))
+
+	// remoteParents holds, for each backup label, the remote ID its children must have as parent to be reused. Labels
+	// that are going to be created have no remote ID yet, and their children can never be reused.
+	remoteParents := make(map[string]string, len(backupLabels))
+
 	for _, label := range backupLabels {
-		select {
-		case <-r.ctx.Done():
-			return r.ctx.Err()
-		default:
+		entry := LabelPlanEntry{BackupLabel: label}
+
+		var remoteParentID string
+		if len(label.ParentID) > 0 {
+			var ok bool
+			if remoteParentID, ok = remoteParents[label.ParentID]; !ok {
+				remoteParentID = newLabelParentID
+			}
 		}
 
-		labelID, name := matchLocalLabelWithRemote(label, remoteLabels)
-		if len(labelID) > 0 {
-			r.labelMapping[label.ID] = labelID
-			continue
+		var labelID, name string
+		if mode == LabelReuseModeAlwaysCreate && !isSystemLabel(label.ID) {
+			name = label.Name
+			if slices.ContainsFunc(remoteLabels, func(l proton.Label) bool { return utils.NamesEqual(l.Name, label.Name) }) {
+				name = findFirstAvailableLabelIncrementalName(label.Name, remoteLabels)
+			}
+		} else {
+			labelID, name = matchLocalLabelWithRemote(label, remoteParentID, remoteLabels)
 		}
 
-		label.Name = name
-		if err = r.createAndMapLabel(label); err != nil {
-			return err
+		switch {
+		case len(labelID) > 0:
+			entry.Action = LabelPlanActionMap
+			entry.RemoteLabelID = labelID
+			entry.Name = label.Name
+			if index := slices.IndexFunc(remoteLabels, func(l proton.Label) bool { return l.ID == labelID }); index != -1 {
+				entry.Name = remoteLabels[index].Name
+			}
+			remoteParents[label.ID] = labelID
+		case name != label.Name:
+			entry.Action = LabelPlanActionCreateRenamed
+			entry.Name = name
+		default:
+			entry.Action = LabelPlanActionCreate
+			entry.Name = name
 		}
+
+		entry.Path = entry.Name
+		if parentPath, ok := paths[label.ParentID]; ok && len(label.ParentID) > 0 {
+			entry.Path = parentPath + "/" + entry.Name
+		}
+		paths[label.ID] = entry.Path
+
+		plan = append(plan, entry)
 	}
 
-	return nil
+	return plan
 }
 
+// newLabelParentID is used as the remote parent ID of labels whose parent does not exist yet on the server.
+const newLabelParentID = "\x00new"
+
 // matchLocalLabelWithRemote match a label from a backup with remote labels.
-// if a label of the same name and type is found, its labelID and returned, otherwise and empty labelID and the name of the matching
-// label to create on the server is returned as newName. The name of the label to create will be the name of the label in the backup, unless
+// if a label with the same ID, or a label of the same name, type and parent is found, its labelID is returned. remoteParentID is the remote
+// ID of the parent of the label, or an empty string if the label is at the root. Otherwise an empty labelID and the name of the label to
+// create on the server is returned as newName. The name of the label to create will be the name of the label in the backup, unless
 // a label of the same name but different type already exists, in which case a number in appended at the end of the name.
-func matchLocalLabelWithRemote(label proton.Label, remoteLabels []proton.Label) (labelID, newName string) {
+func matchLocalLabelWithRemote(label proton.Label, remoteParentID string, remoteLabels []proton.Label) (labelID, newName string) {
 	if isSystemLabel(label.ID) {
 		return label.ID, ""
 	}
 
-	index := slices.IndexFunc(remoteLabels, func(remoteLabel proton.Label) bool {
-		return (label.ID == remoteLabel.ID) || strings.EqualFold(label.Name, remoteLabel.Name)
-	})
-
-	// label does not exist.
-	if index == -1 {
-		return "", label.Name
+	if index := slices.IndexFunc(remoteLabels, func(remoteLabel proton.Label) bool {
+		return label.ID == remoteLabel.ID && label.Type == remoteLabel.Type
+	}); index != -1 {
+		return remoteLabels[index].ID, ""
 	}
 
-	// label exists remotely and is of the correct type. We map it.
-	if remoteLabels[index].Type == label.Type {
+	// label exists remotely with the same hierarchy and is of the correct type. We map it.
+	if index := slices.IndexFunc(remoteLabels, func(remoteLabel proton.Label) bool {
+		return utils.NamesEqual(label.Name, remoteLabel.Name) && remoteLabel.Type == label.Type && remoteLabel.ParentID == remoteParentID
+	}); index != -1 {
 		return remoteLabels[index].ID, ""
 	}
 
 	// label exists remotely but not of the right type, we need a new name
-	return "", findFirstAvailableLabelIncrementalName(label.Name, remoteLabels)
+	if slices.ContainsFunc(remoteLabels, func(remoteLabel proton.Label) bool {
+		return utils.NamesEqual(label.Name, remoteLabel.Name) && remoteLabel.Type != label.Type
+	}) {
+		return "", findFirstAvailableLabelIncrementalName(label.Name, remoteLabels)
+	}
+
+	// label does not exist, or exists with the same type under another parent.
+	return "", label.Name
 }
 
 func (r *RestoreTask) readLabelFile() ([]proton.Label, error) {
-	data, err := os.ReadFile(filepath.Join(r.backupDir, getLabelFileName()))
+	data, err := fs.ReadFile(r.backupFS, path.Join(r.backupDir, getLabelFileName()))
 	if err != nil {
 		return nil, err
 	}
@@ -137,11 +260,23 @@ func (r *RestoreTask) createAndMapLabel(label proton.Label) error {
 		return err
 	}
 
+	r.trackCreatedLabel(newLabel.ID)
 	r.labelMapping[label.ID] = newLabel.ID
 	r.log.WithFields(logrus.Fields{"backupLabelID": label.ID, "remoteLabelID": newLabel.ID}).Info("Recreated remote label")
 	return nil
 }
 
+// SetImportLabel controls whether the restored messages are also given a new 'Import <date>' label, which is the
+// default. Without it, the messages are only placed in their original system folders, folders and labels, so that the
+// restored mailbox looks exactly like the backed up one.
+func (r *RestoreTask) SetImportLabel(enabled bool) {
+	r.noImportLabel = !enabled
+}
+
+func (r *RestoreTask) GetImportLabel() bool {
+	return !r.noImportLabel
+}
+
 func (r *RestoreTask) createImportLabel() error {
 	label, err := r.session.GetClient().CreateLabel(
 		r.ctx,
@@ -157,6 +292,7 @@ func (r *RestoreTask) createImportLabel() error {
 		return err
 	}
 
+	r.trackCreatedLabel(label.ID)
 	r.importLabelID = label.ID
 	return nil
 }
@@ -213,7 +349,7 @@ func sortLabels(labels []proton.Label) ([]proton.Label, error) {
 func findFirstAvailableLabelIncrementalName(name string, remoteLabels []proton.Label) string {
 	for i := 1; ; i++ {
 		candidate := fmt.Sprintf("%s (%d)", name, i)
-		index := slices.IndexFunc(remoteLabels, func(label proton.Label) bool { return strings.EqualFold(label.Name, candidate) })
+		index := slices.IndexFunc(remoteLabels, func(label proton.Label) bool { return utils.NamesEqual(label.Name, candidate) })
 		if index == -1 {
 			return candidate
 		}
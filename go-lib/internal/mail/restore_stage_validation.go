@@ -20,28 +20,40 @@ package mail
 import (
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io/fs"
+	"path"
 
+	"github.com/ProtonMail/go-proton-api"
 	"golang.org/x/exp/slices"
 )
 
 type messageInfo struct {
 	messageID string
 	timestamp int64
+	metadata  *proton.MessageMetadata // Only loaded when the messages are filtered or deduplicated.
 }
 
 func (r *RestoreTask) validateBackupDir(reporter Reporter) ([]messageInfo, error) {
 	r.log.Info("Verifying backup folder")
 
+	if err := r.checkAtRestEncryption(); err != nil {
+		return nil, err
+	}
+
 	messageList := make([]messageInfo, 0)
 	err := r.walkBackupDir(func(path string) {
-		metadata, err := loadMetadataFile(emlToMetadataFilename(path))
+		metadata, err := loadMetadataFileFS(r.backupFS, emlToMetadataFilename(path))
 		if err == nil {
-			messageList = append(messageList, messageInfo{
+			info := messageInfo{
 				messageID: metadata.ID,
 				timestamp: metadata.Time,
-			})
+			}
+
+			if r.filter != nil || r.skipDuplicates {
+				info.metadata = &metadata.MessageMetadata
+			}
+
+			messageList = append(messageList, info)
 		}
 	})
 
@@ -52,10 +64,20 @@ func (r *RestoreTask) validateBackupDir(reporter Reporter) ([]messageInfo, error
 	messageCount := len(messageList)
 	if messageCount > 0 {
 		labelsFilename := getLabelFileName()
-		if _, err := os.Stat(filepath.Join(r.backupDir, labelsFilename)); errors.Is(err, os.ErrNotExist) {
+		if _, err := fs.Stat(r.backupFS, path.Join(r.backupDir, labelsFilename)); errors.Is(err, fs.ErrNotExist) {
 			return nil, fmt.Errorf("the labels file '%v' could not be found", labelsFilename)
 		}
 
+		if r.filter != nil {
+			if messageList, r.usedLabelIDs, err = r.filterMessages(messageList); err != nil {
+				return nil, err
+			}
+
+			r.filteredCount = int64(messageCount - len(messageList))
+			messageCount = len(messageList)
+			r.log.WithField("filteredCount", r.filteredCount).Info("Messages left out by the filter")
+		}
+
 		reporter.SetMessageTotal(uint64(messageCount))
 		reporter.SetMessageProcessed(0)
 		r.importableCount = int64(messageCount)
@@ -63,6 +85,11 @@ func (r *RestoreTask) validateBackupDir(reporter Reporter) ([]messageInfo, error
 
 		slices.SortFunc(messageList, func(lhs, rhs messageInfo) bool { return lhs.timestamp < rhs.timestamp })
 
+		if stream, ok := r.backupCloser.(*streamTarFS); ok {
+			r.log.Info("The backup is a compressed or encrypted archive, the messages are imported in the order of the archive")
+			r.sortByArchivePosition(stream, messageList)
+		}
+
 		return messageList, nil
 	}
 
@@ -72,6 +99,10 @@ func (r *RestoreTask) validateBackupDir(reporter Reporter) ([]messageInfo, error
 	}
 
 	if len(subDirs) == 0 {
+		if hasYearDirs(r.backupFS, r.backupDir) {
+			return nil, ErrSplitByYearBackup
+		}
+
 		return nil, errors.New("no importable mail found")
 	}
 
@@ -84,3 +115,19 @@ func (r *RestoreTask) validateBackupDir(reporter Reporter) ([]messageInfo, error
 
 	return r.validateBackupDir(reporter)
 }
+
+// sortByArchivePosition sorts the messages in the order of a streamed archive, so that the archive is read once. The
+// order of the messages missing from the archive is kept.
+func (r *RestoreTask) sortByArchivePosition(stream *streamTarFS, messageList []messageInfo) {
+	positions := make(map[string]int, len(messageList))
+
+	for _, message := range messageList {
+		if position, ok := stream.getArchivePosition(path.Join(r.backupDir, message.messageID+emlExtension)); ok {
+			positions[message.messageID] = position
+		}
+	}
+
+	slices.SortStableFunc(messageList, func(lhs, rhs messageInfo) bool {
+		return positions[lhs.messageID] < positions[rhs.messageID]
+	})
+}
@@ -1,9 +1,16 @@
 package mail
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"testing/fstest"
 
+	"github.com/ProtonMail/gluon/async"
 	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 )
 
@@ -102,37 +109,301 @@ func TestMatchLocalLabelWithRemote(t *testing.T) {
 
 	// folder with name does not exist
 	folder := proton.Label{ID: "localID_F", Name: "F", Type: proton.LabelTypeFolder}
-	labelID, newName := matchLocalLabelWithRemote(folder, remoteLabels)
+	labelID, newName := matchLocalLabelWithRemote(folder, "", remoteLabels)
 	require.Len(t, labelID, 0)
 	require.Equal(t, newName, "F")
 
 	// folder with name exists and is of the right type
 	folder = proton.Label{ID: "localID_F1", Name: "F1", Type: proton.LabelTypeFolder}
-	labelID, newName = matchLocalLabelWithRemote(folder, remoteLabels)
+	labelID, newName = matchLocalLabelWithRemote(folder, "", remoteLabels)
 	require.Equal(t, labelID, "remoteID_F1")
 	require.Len(t, newName, 0)
 
 	// folder with name exists but is not of the right type
 	folder = proton.Label{ID: "localID_F1", Name: "F1", Type: proton.LabelTypeLabel}
-	labelID, newName = matchLocalLabelWithRemote(folder, remoteLabels)
+	labelID, newName = matchLocalLabelWithRemote(folder, "", remoteLabels)
 	require.Len(t, labelID, 0)
 	require.Equal(t, newName, "F1 (2)")
 
 	// label with name does not exist
 	label := proton.Label{ID: "localID_L", Name: "l", Type: proton.LabelTypeLabel}
-	labelID, newName = matchLocalLabelWithRemote(label, remoteLabels)
+	labelID, newName = matchLocalLabelWithRemote(label, "", remoteLabels)
 	require.Len(t, labelID, 0)
 	require.Equal(t, newName, "l")
 
 	// label with name exists and is of the right type
 	label = proton.Label{ID: "localID_L1", Name: "l1", Type: proton.LabelTypeLabel}
-	labelID, newName = matchLocalLabelWithRemote(label, remoteLabels)
+	labelID, newName = matchLocalLabelWithRemote(label, "", remoteLabels)
 	require.Equal(t, labelID, "remoteID_L1")
 	require.Len(t, newName, 0)
 
 	// folder with name exists but is not of the right type
 	label = proton.Label{ID: "localID_L1", Name: "l1", Type: proton.LabelTypeFolder}
-	labelID, newName = matchLocalLabelWithRemote(label, remoteLabels)
+	labelID, newName = matchLocalLabelWithRemote(label, "", remoteLabels)
 	require.Len(t, labelID, 0)
 	require.Equal(t, newName, "l1 (1)")
 }
+
+func TestPlanLabels(t *testing.T) {
+	remoteLabels := []proton.Label{
+		{ID: "remoteID_F1", Name: "F1", Type: proton.LabelTypeFolder},
+		{ID: "remoteID_L1", Name: "L1", Type: proton.LabelTypeLabel},
+	}
+
+	backupLabels := []proton.Label{
+		{ID: "0", Name: "Inbox", Type: proton.LabelTypeSystem},
+		{ID: "localID_F1", Name: "f1", Type: proton.LabelTypeFolder},
+		{ID: "localID_F2", Name: "F2", Type: proton.LabelTypeFolder, ParentID: "localID_F1"},
+		{ID: "localID_L1", Name: "L1", Type: proton.LabelTypeFolder, ParentID: "localID_F1"},
+	}
+
+	plan := planLabels(backupLabels, remoteLabels, LabelReuseModeReuseExisting)
+	require.Len(t, plan, 4)
+
+	require.Equal(t, LabelPlanActionMap, plan[0].Action)
+	require.Equal(t, "0", plan[0].RemoteLabelID)
+
+	require.Equal(t, LabelPlanActionMap, plan[1].Action)
+	require.Equal(t, "remoteID_F1", plan[1].RemoteLabelID)
+	require.Equal(t, "F1", plan[1].Path)
+
+	require.Equal(t, LabelPlanActionCreate, plan[2].Action)
+	require.Equal(t, "F1/F2", plan[2].Path)
+
+	require.Equal(t, LabelPlanActionCreateRenamed, plan[3].Action)
+	require.Equal(t, "L1 (1)", plan[3].Name)
+	require.Equal(t, "F1/L1 (1)", plan[3].Path)
+
+	plan = planLabels(backupLabels, remoteLabels, LabelReuseModeAlwaysCreate)
+	require.Equal(t, LabelPlanActionMap, plan[0].Action)
+	require.Equal(t, LabelPlanActionCreateRenamed, plan[1].Action)
+	require.Equal(t, "f1 (1)", plan[1].Name)
+	require.Equal(t, LabelPlanActionCreate, plan[2].Action)
+	require.Equal(t, "f1 (1)/F2", plan[2].Path)
+	require.Equal(t, LabelPlanActionCreateRenamed, plan[3].Action)
+}
+
+func TestPlanLabels_Hierarchy(t *testing.T) {
+	remoteLabels := []proton.Label{
+		{ID: "remoteID_Work", Name: "Work", Type: proton.LabelTypeFolder},
+		{ID: "remoteID_Home", Name: "Home", Type: proton.LabelTypeFolder},
+		{ID: "remoteID_Work_Notes", Name: "Notes", Type: proton.LabelTypeFolder, ParentID: "remoteID_Work"},
+	}
+
+	backupLabels := []proton.Label{
+		{ID: "localID_Work", Name: "Work", Type: proton.LabelTypeFolder},
+		{ID: "localID_Home", Name: "Home", Type: proton.LabelTypeFolder},
+		{ID: "localID_New", Name: "New", Type: proton.LabelTypeFolder},
+		{ID: "localID_Work_Notes", Name: "notes", Type: proton.LabelTypeFolder, ParentID: "localID_Work"},
+		{ID: "localID_Home_Notes", Name: "Notes", Type: proton.LabelTypeFolder, ParentID: "localID_Home"},
+		{ID: "localID_New_Notes", Name: "Notes", Type: proton.LabelTypeFolder, ParentID: "localID_New"},
+	}
+
+	plan := planLabels(backupLabels, remoteLabels, LabelReuseModeReuseExisting)
+	require.Len(t, plan, 6)
+
+	// Identical name and hierarchy, the existing folder is reused.
+	require.Equal(t, LabelPlanActionMap, plan[3].Action)
+	require.Equal(t, "remoteID_Work_Notes", plan[3].RemoteLabelID)
+	require.Equal(t, "Work/Notes", plan[3].Path)
+
+	// Same name under another parent, a new folder is created without renaming it.
+	require.Equal(t, LabelPlanActionCreate, plan[4].Action)
+	require.Equal(t, "Home/Notes", plan[4].Path)
+	require.Equal(t, LabelPlanActionCreate, plan[5].Action)
+	require.Equal(t, "New/Notes", plan[5].Path)
+}
+
+func TestPlanLabels_UnicodeNames(t *testing.T) {
+	remoteLabels := []proton.Label{
+		{ID: "remoteID_Cafe", Name: "Caf\u00e9 \u2615", Type: proton.LabelTypeFolder},
+		{ID: "remoteID_Hebrew", Name: "\u05e2\u05d1\u05d5\u05d3\u05d4", Type: proton.LabelTypeLabel},
+	}
+
+	backupLabels := []proton.Label{
+		{ID: "localID_Cafe", Name: "Cafe\u0301 \u2615", Type: proton.LabelTypeFolder}, // Decomposed accent.
+		{ID: "localID_Hebrew", Name: "\u05e2\u05d1\u05d5\u05d3\u05d4", Type: proton.LabelTypeLabel},
+		{ID: "localID_Rocket", Name: "\U0001F680 Launch", Type: proton.LabelTypeLabel},
+	}
+
+	plan := planLabels(backupLabels, remoteLabels, LabelReuseModeReuseExisting)
+	require.Len(t, plan, 3)
+	require.Equal(t, LabelPlanActionMap, plan[0].Action)
+	require.Equal(t, "remoteID_Cafe", plan[0].RemoteLabelID)
+	require.Equal(t, LabelPlanActionMap, plan[1].Action)
+	require.Equal(t, "remoteID_Hebrew", plan[1].RemoteLabelID)
+	require.Equal(t, LabelPlanActionCreate, plan[2].Action)
+	require.Equal(t, "\U0001F680 Launch", plan[2].Name)
+}
+
+func TestVerifyRestoredMessages(t *testing.T) {
+	backup := []proton.MessageMetadata{
+		{ID: "b1", ExternalID: "<1@example.com>", Subject: "one"},
+		{ID: "b2", ExternalID: "<2@example.com>", Subject: "two"},
+		{ID: "b3", ExternalID: "<3@example.com>", Subject: "three"},
+	}
+
+	restored := make([]restoredMessage, 0, len(backup))
+	for i, remoteID := range []string{"r1", "r2", "r3"} {
+		restored = append(restored, restoredMessage{backupID: backup[i].ID, remoteID: remoteID, fingerprint: messageFingerprint(&backup[i])})
+	}
+
+	remote := map[string]proton.MessageMetadata{
+		"r1": {ID: "r1", ExternalID: "<1@example.com>", Subject: "one"},
+		"r2": {ID: "r2", ExternalID: "<2@example.com>", Subject: "two"},
+		"r3": {ID: "r3", ExternalID: "<3@example.com>", Subject: "three"},
+	}
+
+	report := verifyRestoredMessages(restored, remote, 10)
+	require.True(t, report.IsComplete())
+	require.Equal(t, VerificationReport{ExpectedCount: 3, FoundCount: 3, SampledCount: 3}, report)
+
+	remote["r2"] = proton.MessageMetadata{ID: "r2", ExternalID: "<2@example.com>", Subject: "altered"}
+	delete(remote, "r3")
+	remote["r4"] = proton.MessageMetadata{ID: "r4"}
+
+	report = verifyRestoredMessages(restored, remote, 10)
+	require.False(t, report.IsComplete())
+	require.Equal(t, int64(2), report.FoundCount)
+	require.Equal(t, int64(1), report.UnexpectedCount)
+	require.Equal(t, []string{"b3"}, report.MissingIDs)
+	require.Equal(t, []string{"b2"}, report.MismatchedIDs)
+
+	report = verifyRestoredMessages(restored, remote, 1)
+	require.Equal(t, int64(1), report.SampledCount)
+}
+
+func TestGetImportFlags(t *testing.T) {
+	require.Equal(t, proton.MessageFlagReceived|proton.MessageFlagReplied|proton.MessageFlagForwarded, getImportFlags(&proton.MessageMetadata{
+		Flags:       proton.MessageFlagReceived | proton.MessageFlagReplied,
+		IsForwarded: true,
+	}))
+
+	require.Equal(t, proton.MessageFlagSent|proton.MessageFlagRepliedAll, getImportFlags(&proton.MessageMetadata{
+		LabelIDs:     []string{proton.AllMailLabel, proton.SentLabel},
+		IsRepliedAll: true,
+	}))
+
+	require.Equal(t, proton.MessageFlag(0), getImportFlags(&proton.MessageMetadata{LabelIDs: []string{proton.InboxLabel}}))
+}
+
+func TestGetLabelList(t *testing.T) {
+	r := &RestoreTask{labelMapping: map[string]string{"backup-folder": "remote-folder"}, importLabelID: "import"}
+
+	labels, err := r.getLabelList([]string{proton.AllMailLabel, proton.InboxLabel, "backup-folder"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"import", proton.InboxLabel, "remote-folder"}, labels)
+
+	labels, err = r.getLabelList([]string{proton.AllMailLabel})
+	require.NoError(t, err)
+	require.Equal(t, []string{"import"}, labels)
+
+	_, err = r.getLabelList([]string{"unknown"})
+	require.Error(t, err)
+
+	r.importLabelID = ""
+	r.SetImportLabel(false)
+	require.False(t, r.GetImportLabel())
+
+	labels, err = r.getLabelList([]string{proton.AllMailLabel, proton.SentLabel, "backup-folder"})
+	require.NoError(t, err)
+	require.Equal(t, []string{proton.SentLabel, "remote-folder"}, labels)
+
+	labels, err = r.getLabelList([]string{proton.AllMailLabel})
+	require.NoError(t, err)
+	require.Equal(t, []string{proton.ArchiveLabel}, labels)
+}
+
+func TestRestoreTask_ReadMailBatches(t *testing.T) {
+	backupFS := fstest.MapFS{}
+	infos := make([]messageInfo, 0, 25)
+
+	for i := 0; i < 25; i++ {
+		metadata := MessageMetadata{MessageMetadata: proton.MessageMetadata{ID: fmt.Sprintf("msg%02d", i)}}
+		data, err := metadata.toBytes()
+		require.NoError(t, err)
+
+		backupFS[getMetadataFileName(metadata.ID)] = &fstest.MapFile{Data: data}
+		backupFS[getEMLFileName(metadata.ID)] = &fstest.MapFile{Data: []byte("Subject: s\r\n\r\nbody")}
+		infos = append(infos, messageInfo{messageID: metadata.ID})
+	}
+
+	// The EML file of a message is missing, it is skipped.
+	infos = append(infos, messageInfo{messageID: "missing"})
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	r := &RestoreTask{
+		ctx:       ctx,
+		ctxCancel: cancel,
+		canceller: newTaskCanceller(cancel, &async.NoopPanicHandler{}),
+		backupFS:  backupFS,
+		backupDir: ".",
+		log:       logrus.WithField("t", "t"),
+	}
+
+	var sizes []int
+	var ids []string
+
+	require.NoError(t, r.readMailBatches(infos, nil, NullProgressReporter{}, func(batch []Message) error {
+		sizes = append(sizes, len(batch))
+		for _, message := range batch {
+			ids = append(ids, message.metadata.ID)
+		}
+
+		return nil
+	}))
+
+	require.Equal(t, []int{10, 10, 5}, sizes)
+	require.Len(t, ids, 25)
+	require.Equal(t, "msg24", ids[24])
+
+	errStop := errors.New("stop")
+	require.ErrorIs(t, r.readMailBatches(infos, nil, NullProgressReporter{}, func([]Message) error { return errStop }), errStop)
+}
+
+func TestRestoreTask_ParallelResults(t *testing.T) {
+	r := &RestoreTask{transactional: true}
+
+	var wg sync.WaitGroup
+
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				id := fmt.Sprintf("%v-%v", worker, i)
+				if i%5 == 0 {
+					r.recordFailure(id, errors.New("failed"))
+				} else {
+					r.recordImported(&proton.MessageMetadata{ID: id}, "remote-"+id, 10)
+				}
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+
+	require.Equal(t, int64(320), r.GetImportedCount())
+	require.Equal(t, int64(80), r.GetFailedCount())
+	require.Len(t, r.failures, 80)
+	require.Len(t, r.importedMessageIDs, 320)
+	require.Len(t, r.restoredMessages, 320)
+	require.Equal(t, uint64(3200), r.bytesTransferred)
+}
+
+func TestRestoreTask_SetConcurrency(t *testing.T) {
+	r := &RestoreTask{}
+
+	require.NoError(t, r.SetConcurrency(6))
+	require.Equal(t, 6, r.GetConcurrency())
+	require.Error(t, r.SetConcurrency(MaxConcurrency+1))
+	require.Error(t, r.SetConcurrency(-1))
+	require.Equal(t, 6, r.GetConcurrency())
+
+	require.Equal(t, 2, PlanTierFree.GetImportConcurrency())
+	require.Equal(t, NumParallelImports, PlanTierPaid.GetImportConcurrency())
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/mail"
+	"strings"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/bradenaw/juniper/xslices"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+const verificationSampleSize = 200
+
+var ErrNothingToVerify = errors.New("the restore has not imported any message")
+
+// restoredMessage links a message of the backup to the message created on the server.
+type restoredMessage struct {
+	backupID    string
+	remoteID    string
+	fingerprint [sha256.Size]byte
+}
+
+// VerificationReport is the outcome of the comparison between the backup and the restored messages.
+type VerificationReport struct {
+	ExpectedCount   int64    // Number of messages the restore reported as imported.
+	FoundCount      int64    // Number of messages found on the server under the import label.
+	SampledCount    int64    // Number of messages whose content fingerprint was compared.
+	MissingIDs      []string `json:",omitempty"` // Backup IDs of sampled messages that could not be found on the server.
+	MismatchedIDs   []string `json:",omitempty"` // Backup IDs of sampled messages whose fingerprint differs from the backup.
+	UnexpectedCount int64    // Number of messages found under the import label that the restore did not create.
+}
+
+// IsComplete returns true if every imported message was found on the server and no sampled message differs.
+func (v *VerificationReport) IsComplete() bool {
+	return v.ExpectedCount == v.FoundCount &&
+		v.UnexpectedCount == 0 &&
+		len(v.MissingIDs) == 0 &&
+		len(v.MismatchedIDs) == 0
+}
+
+func (r *RestoreTask) recordRestoredMessage(backup *proton.MessageMetadata, remoteID string) {
+	r.restoredMessages = append(r.restoredMessages, restoredMessage{
+		backupID:    backup.ID,
+		remoteID:    remoteID,
+		fingerprint: messageFingerprint(backup),
+	})
+}
+
+// Verify lists the messages under the import label and compares them with the messages of the backup. Counts are
+// checked for every message, fingerprints only for a sample of them. Without import label, the restored messages are
+// looked up by ID and no unexpected message can be found. Must be called after a successful Run.
+func (r *RestoreTask) Verify() (VerificationReport, error) {
+	if len(r.restoredMessages) == 0 {
+		return VerificationReport{}, ErrNothingToVerify
+	}
+
+	r.log.WithField("importLabelID", r.importLabelID).Info("Verifying restored messages")
+
+	remote := make(map[string]proton.MessageMetadata, len(r.restoredMessages))
+	addPage := func(page []proton.MessageMetadata) {
+		for _, m := range page {
+			remote[m.ID] = m
+		}
+	}
+
+	if len(r.importLabelID) != 0 {
+		if err := walkMetadataPages(
+			r.ctx,
+			r.session.GetClient(),
+			MetadataPageSize,
+			proton.MessageFilter{LabelID: r.importLabelID, Desc: true},
+			func(page []proton.MessageMetadata) error {
+				addPage(page)
+				return nil
+			},
+		); err != nil {
+			return VerificationReport{}, err
+		}
+	} else {
+		for _, chunk := range xslices.Chunk(r.restoredMessages, MetadataPageSize) {
+			page, err := r.session.GetClient().GetMessageMetadataPage(r.ctx, 0, len(chunk), proton.MessageFilter{
+				ID: xslices.Map(chunk, func(m restoredMessage) string { return m.remoteID }),
+			})
+			if err != nil {
+				return VerificationReport{}, err
+			}
+
+			addPage(page)
+		}
+	}
+
+	report := verifyRestoredMessages(r.restoredMessages, remote, verificationSampleSize)
+
+	r.log.WithFields(logrus.Fields{
+		"expected":   report.ExpectedCount,
+		"found":      report.FoundCount,
+		"sampled":    report.SampledCount,
+		"missing":    len(report.MissingIDs),
+		"mismatched": len(report.MismatchedIDs),
+		"unexpected": report.UnexpectedCount,
+	}).Info("Verification report")
+
+	return report, nil
+}
+
+// verifyRestoredMessages compares the restored messages with the remote metadata. The sample is spread evenly across
+// the restored messages so that every batch of the import is represented.
+func verifyRestoredMessages(restored []restoredMessage, remote map[string]proton.MessageMetadata, sampleSize int) VerificationReport {
+	report := VerificationReport{ExpectedCount: int64(len(restored))}
+
+	known := make(map[string]struct{}, len(restored))
+	for _, m := range restored {
+		known[m.remoteID] = struct{}{}
+	}
+
+	for id := range remote {
+		if _, ok := known[id]; ok {
+			report.FoundCount++
+		} else {
+			report.UnexpectedCount++
+		}
+	}
+
+	step := 1
+	if sampleSize > 0 && len(restored) > sampleSize {
+		step = len(restored) / sampleSize
+	}
+
+	for i := 0; i < len(restored); i += step {
+		report.SampledCount++
+
+		m := restored[i]
+		remoteMeta, ok := remote[m.remoteID]
+		if !ok {
+			report.MissingIDs = append(report.MissingIDs, m.backupID)
+			continue
+		}
+
+		if messageFingerprint(&remoteMeta) != m.fingerprint {
+			report.MismatchedIDs = append(report.MismatchedIDs, m.backupID)
+		}
+	}
+
+	return report
+}
+
+// messageFingerprint hashes the message properties that are preserved by an import. The body cannot be compared as
+// it is re-encrypted by the server, so the fingerprint relies on the headers that identify the message.
+func messageFingerprint(meta *proton.MessageMetadata) [sha256.Size]byte {
+	addresses := func(list []*mail.Address) string {
+		result := make([]string, 0, len(list))
+		for _, addr := range list {
+			if addr != nil {
+				result = append(result, strings.ToLower(addr.Address))
+			}
+		}
+		slices.Sort(result)
+		return strings.Join(result, ",")
+	}
+
+	var sender string
+	if meta.Sender != nil {
+		sender = strings.ToLower(meta.Sender.Address)
+	}
+
+	return sha256.Sum256([]byte(strings.Join([]string{
+		meta.ExternalID,
+		meta.Subject,
+		sender,
+		addresses(meta.ToList),
+		addresses(meta.CCList),
+	}, "\x00")))
+}
@@ -3,15 +3,14 @@ package mail
 import (
 	"errors"
 	"io/fs"
-	"os"
-	"path/filepath"
+	"path"
 	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
 func (r *RestoreTask) walkBackupDir(fn func(emlPath string)) error {
-	return filepath.Walk(r.backupDir, func(path string, info fs.FileInfo, err error) error {
+	return fs.WalkDir(r.backupFS, r.backupDir, func(filePath string, entry fs.DirEntry, err error) error {
 		select {
 		case <-r.ctx.Done():
 			return r.ctx.Err()
@@ -19,20 +18,20 @@ func (r *RestoreTask) walkBackupDir(fn func(emlPath string)) error {
 		}
 
 		if err != nil {
-			logrus.WithError(err).WithField("path", path).Warn("Cannot inspect path. Skipping.")
+			logrus.WithError(err).WithField("path", filePath).Warn("Cannot inspect path. Skipping.")
 			return nil
 		}
 
-		if info.IsDir() && (path != r.backupDir) { // we skip any dir that is not the root dir.
-			return filepath.SkipDir
+		if entry.IsDir() && (filePath != r.backupDir) { // we skip any dir that is not the root dir.
+			return fs.SkipDir
 		}
 
-		emlPath := filepath.Join(r.backupDir, info.Name())
+		emlPath := path.Join(r.backupDir, entry.Name())
 		if !strings.HasSuffix(emlPath, emlExtension) {
 			return nil
 		}
 
-		if _, err := os.Stat(emlToMetadataFilename(emlPath)); errors.Is(err, os.ErrNotExist) {
+		if _, err := fs.Stat(r.backupFS, emlToMetadataFilename(emlPath)); errors.Is(err, fs.ErrNotExist) {
 			logrus.WithField("path", emlPath).Warn("Skipping EML file with no associated metadata file.")
 			return nil
 		}
@@ -44,32 +43,23 @@ func (r *RestoreTask) walkBackupDir(fn func(emlPath string)) error {
 }
 
 func (r *RestoreTask) getTimestampedBackupDirs() ([]string, error) {
-	var result []string
-	err := filepath.Walk(r.backupDir, func(path string, info fs.FileInfo, err error) error {
-		select {
-		case <-r.ctx.Done():
-			return r.ctx.Err()
-		default:
-		}
+	select {
+	case <-r.ctx.Done():
+		return nil, r.ctx.Err()
+	default:
+	}
 
-		if err != nil {
-			return nil //nolint:nilerr // we proceed in case of errors
-		}
+	entries, err := fs.ReadDir(r.backupFS, r.backupDir)
+	if err != nil {
+		return nil, nil //nolint:nilerr // we proceed in case of errors
+	}
 
-		name := info.Name()
-		if (err != nil) || !info.IsDir() || (path == r.backupDir) {
-			return nil //nolint:nilerr // ignore errors, files, and the walk's root folder
-		}
+	var result []string
 
-		if mailFolderRegExp.MatchString(name) {
-			result = append(result, filepath.Join(r.backupDir, name))
+	for _, entry := range entries {
+		if entry.IsDir() && mailFolderRegExp.MatchString(entry.Name()) {
+			result = append(result, path.Join(r.backupDir, entry.Name()))
 		}
-
-		return fs.SkipDir // we do not recurse into dirs
-	})
-
-	if err != nil {
-		return nil, err
 	}
 
 	return result, nil
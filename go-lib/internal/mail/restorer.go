@@ -0,0 +1,147 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/export-tool/internal/session"
+)
+
+// Restorer restores one kind of data of a backup: the messages, the contacts or the calendar events.
+type Restorer interface {
+	// Kind names the restored data, e.g. "contacts".
+	Kind() string
+	// Restore runs the restore and returns its summary, which is also filled when an error is returned.
+	Restore(reporter Reporter) (RestoreSummary, error)
+	Cancel(ctx context.Context, mode CancelMode)
+	Close()
+}
+
+// RestoreSummary is the report of a Restorer, the items are messages, contacts or events depending on its kind.
+type RestoreSummary struct {
+	ImportableCount int64
+	ImportedCount   int64
+	FailedCount     int64
+	SkippedCount    int64
+	Failures        []Failure `json:",omitempty"`
+	CancelCause     CancelCause
+}
+
+// restorerFactory creates the restorer of a kind of data for the backup at backupPath. It returns nil when the backup
+// holds no data of this kind.
+type restorerFactory func(ctx context.Context, backupPath string, session *session.Session) (Restorer, error)
+
+// additionalRestorers are the restorers of the data that a backup can hold besides the messages. The messages are
+// restored by a RestoreTask, which is created with NewRestoreTask as it has its own options.
+//
+//nolint:gochecknoglobals
+var additionalRestorers = []restorerFactory{
+	newContactsRestoreTask,
+	newCalendarRestoreTask,
+}
+
+// NewAdditionalRestorers returns the restorers of the contacts and the calendar events found in the backup at
+// backupPath. They are read from the 'contacts' folder for vCard files and the 'calendar' folder for ICS files, such
+// as the ones exported from the Proton Contacts and Calendar apps.
+func NewAdditionalRestorers(ctx context.Context, backupPath string, session *session.Session) ([]Restorer, error) {
+	var restorers []Restorer
+
+	for _, factory := range additionalRestorers {
+		restorer, err := factory(ctx, backupPath, session)
+		if err != nil {
+			for _, r := range restorers {
+				r.Close()
+			}
+
+			return nil, err
+		}
+
+		if restorer != nil {
+			restorers = append(restorers, restorer)
+		}
+	}
+
+	return restorers, nil
+}
+
+func (r *RestoreTask) Kind() string {
+	return "mail"
+}
+
+// Restore runs the restore, see Run.
+func (r *RestoreTask) Restore(reporter Reporter) (RestoreSummary, error) {
+	result, err := r.Run(reporter)
+
+	return RestoreSummary{
+		ImportableCount: result.ImportableCount,
+		ImportedCount:   result.ImportedCount,
+		FailedCount:     result.FailedCount,
+		SkippedCount:    result.SkippedCount,
+		Failures:        result.Failures,
+		CancelCause:     result.CancelCause,
+	}, err
+}
+
+// openBackupFolder opens the backup at backupPath and lists the files of its folder dir with the given extension,
+// sorted by name. The backup is closed and no file is returned if there are none.
+func openBackupFolder(ctx context.Context, backupPath, dir, extension string) (fs.FS, func(), []string, error) {
+	backupFS, backupCloser, _, err := openBackupLocation(ctx, backupPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	closeFS := func() {
+		if backupCloser != nil {
+			_ = backupCloser.Close()
+		}
+	}
+
+	entries, err := fs.ReadDir(backupFS, dir)
+	if err != nil {
+		closeFS()
+
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, nil, nil
+		}
+
+		return nil, nil, nil, err
+	}
+
+	var files []string
+
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(path.Ext(entry.Name()), extension) {
+			files = append(files, path.Join(dir, entry.Name()))
+		}
+	}
+
+	if len(files) == 0 {
+		closeFS()
+		return nil, nil, nil, nil
+	}
+
+	sort.Strings(files)
+
+	return backupFS, closeFS, files, nil
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/tracing"
+)
+
+// Failure describes an error encountered while processing a message, or the task as a whole if MessageID is empty.
+type Failure struct {
+	MessageID string `json:",omitempty"`
+	Reason    string
+}
+
+// ExportStatus is the outcome of an ExportTask run.
+type ExportStatus string
+
+const (
+	ExportStatusCompleted       ExportStatus = "completed"
+	ExportStatusNothingToExport ExportStatus = "nothing-to-export" // The account, or the messages selected by the filter, are empty.
+	ExportStatusCancelled       ExportStatus = "cancelled"
+	ExportStatusFailed          ExportStatus = "failed"
+)
+
+// ExportResult is the final report of an ExportTask run.
+type ExportResult struct {
+	Status                ExportStatus
+	TotalMessageCount     uint64
+	ExportedMessageCount  uint64
+	BytesWritten          uint64                 // Metadata file sizes plus the message sizes reported by the API.
+	AutoGeneratedCount    uint64                 // Messages classified as auto-generated, see AutoGeneratedMode.
+	ExcludedMessageCount  uint64                 // Auto-generated messages that were not exported.
+	FilteredMessageCount  uint64                 // Messages that did not match the filter of the export.
+	UnchangedMessageCount uint64                 // Messages of an incremental export that were already up to date.
+	DeletedMessageCount   uint64                 // Messages of an incremental export that were deleted on the server since the last run.
+	Quarantined           []Failure              `json:",omitempty"` // Messages whose build crashed, written encrypted.
+	SnapshotDiff          *SnapshotDiff          `json:",omitempty"` // Changes since the previous export, see SetSnapshotAlert.
+	MailboxStats          *MailboxStats          `json:",omitempty"` // Size of the mailbox when the export started.
+	Authentication        *AuthenticationSummary `json:",omitempty"` // Authentication results of the received messages.
+	Mirrors               []MirrorResult         `json:",omitempty"` // Copies of the export, see AddMirror.
+	EmptyLabels           []string               `json:",omitempty"` // Labels selected by the filter without any message.
+	Duration              time.Duration
+	StageDurations        map[string]time.Duration
+	Failures              []Failure `json:",omitempty"`
+	CancelCause           CancelCause
+}
+
+// setStatus derives the status of the run from its counts and error. A run selecting no message at all, not even one
+// already up to date, had nothing to export.
+func (r *ExportResult) setStatus(err error) {
+	switch {
+	case err != nil && r.CancelCause != CancelCauseNone:
+		r.Status = ExportStatusCancelled
+	case err != nil:
+		r.Status = ExportStatusFailed
+	case r.ExportedMessageCount+r.UnchangedMessageCount+r.DeletedMessageCount+r.ExcludedMessageCount == 0 && len(r.Quarantined) == 0:
+		r.Status = ExportStatusNothingToExport
+	default:
+		r.Status = ExportStatusCompleted
+	}
+}
+
+// RestoreResult is the final report of a RestoreTask run.
+type RestoreResult struct {
+	ImportableCount  int64
+	ImportedCount    int64
+	FailedCount      int64
+	SkippedCount     int64
+	FilteredCount    int64  // Messages of the backup left out by the filter, see RestoreTask.SetFilter.
+	DuplicateCount   int64  // Messages already in the account, counted as skipped, see RestoreTask.SetSkipDuplicates.
+	ResumedCount     int64  // Messages imported by the previous runs, counted as imported, see RestoreTask.SetResume.
+	BytesTransferred uint64 // Size of the message literals sent to the server.
+	Duration         time.Duration
+	StageDurations   map[string]time.Duration
+	Failures         []Failure `json:",omitempty"`
+	CancelCause      CancelCause
+	RolledBack       bool
+}
+
+// ImportResult is the final report of an ImportTask run.
+type ImportResult struct {
+	ImportableCount  int64
+	ImportedCount    int64
+	FailedCount      int64
+	BytesTransferred uint64 // Size of the message literals sent to the server.
+	Duration         time.Duration
+	StageDurations   map[string]time.Duration
+	Failures         []Failure `json:",omitempty"` // MessageID is the file the message was read from.
+	CancelCause      CancelCause
+}
+
+// stageTimer records the duration of the stages of a task. It is safe for concurrent use.
+type stageTimer struct {
+	lock      sync.Mutex
+	durations map[string]time.Duration
+
+	// Set by traceTask, the stages are recorded as children spans of the task span of ctx.
+	ctx  context.Context //nolint:containedctx
+	task string
+}
+
+func newStageTimer() *stageTimer {
+	return &stageTimer{durations: make(map[string]time.Duration)}
+}
+
+// measure runs fn and records its duration under the given stage name.
+func (s *stageTimer) measure(stage string, fn func()) {
+	if s.ctx != nil {
+		_, span := tracing.StartStage(s.ctx, stage)
+		defer span.End()
+	}
+
+	start := time.Now()
+	defer func() {
+		duration := time.Since(start)
+
+		if s.ctx != nil {
+			tracing.RecordStage(s.ctx, s.task, stage, duration)
+		}
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		s.durations[stage] += duration
+	}()
+
+	fn()
+}
+
+func (s *stageTimer) get() map[string]time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make(map[string]time.Duration, len(s.durations))
+	for k, v := range s.durations {
+		result[k] = v
+	}
+
+	return result
+}
@@ -0,0 +1,292 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/gluon/rfc822"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/bradenaw/juniper/iterator"
+	"github.com/bradenaw/juniper/stream"
+	"github.com/bradenaw/juniper/xslices"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestExportResult_SetStatus(t *testing.T) {
+	tests := []struct {
+		result   ExportResult
+		err      error
+		expected ExportStatus
+	}{
+		{result: ExportResult{}, expected: ExportStatusNothingToExport},
+		{result: ExportResult{TotalMessageCount: 10, FilteredMessageCount: 10}, expected: ExportStatusNothingToExport},
+		{result: ExportResult{TotalMessageCount: 10, ExportedMessageCount: 1}, expected: ExportStatusCompleted},
+		{result: ExportResult{TotalMessageCount: 10, UnchangedMessageCount: 10}, expected: ExportStatusCompleted},
+		{result: ExportResult{TotalMessageCount: 10, ExcludedMessageCount: 10}, expected: ExportStatusCompleted},
+		{result: ExportResult{}, err: errors.New("failed"), expected: ExportStatusFailed},
+		{result: ExportResult{CancelCause: CancelCauseUser}, err: errors.New("cancelled"), expected: ExportStatusCancelled},
+	}
+
+	for _, test := range tests {
+		test.result.setStatus(test.err)
+		require.Equal(t, test.expected, test.result.Status, "%+v", test.result)
+	}
+}
+
+func TestExportTask_Run_Result(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+
+	task, messages := newMockExportTask(t, mockCtrl, client)
+	defer task.Close()
+
+	result, err := task.Run(context.Background(), &NullProgressReporter{})
+	require.NoError(t, err)
+	require.Equal(t, ExportStatusCompleted, result.Status)
+	require.Equal(t, uint64(len(messages)), result.TotalMessageCount)
+	require.Equal(t, uint64(len(messages)), result.ExportedMessageCount)
+	require.NotZero(t, result.BytesWritten)
+	require.Empty(t, result.Failures)
+	require.Equal(t, CancelCauseNone, result.CancelCause)
+
+	requireStageDurations(t, result.Duration, result.StageDurations, "labels", "metadata", "download", "build", "write", "checksums")
+
+	for _, message := range messages {
+		_, err := os.Stat(filepath.Join(task.exportDir, getEMLFileName(message.ID)))
+		require.NoError(t, err)
+	}
+}
+
+func TestRestoreTask_Run_Result(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+
+	exportTask, messages := newMockExportTask(t, mockCtrl, client)
+	defer exportTask.Close()
+
+	_, err := exportTask.Run(context.Background(), &NullProgressReporter{})
+	require.NoError(t, err)
+
+	client.EXPECT().CreateLabel(gomock.Any(), gomock.Any()).Return(proton.Label{ID: "import-label-id"}, nil)
+	client.EXPECT().ImportMessages(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ *crypto.KeyRing, _, _ int, reqs ...proton.ImportReq) (proton.ImportResStream, error) {
+			results := make([]proton.ImportRes, 0, len(reqs))
+			for i := range reqs {
+				results = append(results, proton.ImportRes{APIError: proton.APIError{Code: proton.SuccessCode}, MessageID: fmt.Sprintf("imported-%v", i)})
+			}
+
+			return stream.FromIterator(iterator.Slice(results)), nil
+		},
+	).AnyTimes()
+
+	task, err := NewRestoreTask(context.Background(), exportTask.exportDir, exportTask.session)
+	require.NoError(t, err)
+	defer task.Close()
+
+	result, err := task.Run(&NullProgressReporter{})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(messages)), result.ImportableCount)
+	require.Equal(t, int64(len(messages)), result.ImportedCount)
+	require.Zero(t, result.FailedCount)
+	require.Zero(t, result.SkippedCount)
+	require.NotZero(t, result.BytesTransferred)
+	require.Empty(t, result.Failures)
+	require.False(t, result.RolledBack)
+
+	requireStageDurations(t, result.Duration, result.StageDurations, "validation", "labels", "import", "rollback")
+}
+
+func TestRestoreTask_Run_TransactionalSkipDuplicates(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	client := apiclient.NewMockClient(mockCtrl)
+
+	exportTask, messages := newMockExportTask(t, mockCtrl, client)
+	defer exportTask.Close()
+
+	_, err := exportTask.Run(context.Background(), &NullProgressReporter{})
+	require.NoError(t, err)
+
+	// The backup is restored into an account which already holds its first message.
+	restoreClient := apiclient.NewMockClient(mockCtrl)
+	user, salts, address, _ := newMockUser(t)
+
+	restoreClient.EXPECT().GetAddresses(gomock.Any()).Return([]proton.Address{address}, nil).AnyTimes()
+	restoreClient.EXPECT().GetLabels(gomock.Any(), gomock.Any()).Return([]proton.Label{
+		{ID: proton.InboxLabel, Name: "Inbox", Type: proton.LabelTypeSystem},
+	}, nil).AnyTimes()
+	restoreClient.EXPECT().GetMessageMetadataPage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _, _ int, filter proton.MessageFilter) ([]proton.MessageMetadata, error) {
+			if len(filter.EndID) != 0 {
+				return nil, nil
+			}
+
+			return []proton.MessageMetadata{messages[0].MessageMetadata}, nil
+		},
+	).AnyTimes()
+	restoreClient.EXPECT().CreateLabel(gomock.Any(), gomock.Any()).Return(proton.Label{ID: "import-label-id"}, nil)
+	restoreClient.EXPECT().ImportMessages(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ *crypto.KeyRing, _, _ int, reqs ...proton.ImportReq) (proton.ImportResStream, error) {
+			require.Len(t, reqs, 1)
+			results := []proton.ImportRes{{APIError: proton.APIError{Code: proton.SuccessCode}, MessageID: "imported-1"}}
+
+			return stream.FromIterator(iterator.Slice(results)), nil
+		},
+	)
+
+	task, err := NewRestoreTask(context.Background(), exportTask.exportDir, newMockSessionWithUser(t, mockCtrl, restoreClient, user, salts))
+	require.NoError(t, err)
+	defer task.Close()
+
+	task.SetTransactional(true)
+	task.SetSkipDuplicates(true)
+
+	// The duplicate is not a failure, nothing is rolled back.
+	result, err := task.Run(&NullProgressReporter{})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(messages)), result.ImportableCount)
+	require.Equal(t, int64(1), result.ImportedCount)
+	require.Equal(t, int64(1), result.DuplicateCount)
+	require.Zero(t, result.FailedCount)
+	require.False(t, result.RolledBack)
+}
+
+// requireStageDurations checks that the stages were measured within the whole run. The stages of an export run
+// concurrently, their durations do not add up.
+func requireStageDurations(t *testing.T, total time.Duration, durations map[string]time.Duration, stages ...string) {
+	t.Helper()
+
+	require.Positive(t, total)
+
+	for _, stage := range stages {
+		duration, ok := durations[stage]
+		require.True(t, ok, "stage %v was not measured", stage)
+		require.GreaterOrEqual(t, duration, time.Duration(0), stage)
+		require.LessOrEqual(t, duration, total, stage)
+	}
+}
+
+// newMockExportTask returns an export task of a user with a single address whose mailbox holds the returned messages.
+// The client serves the account, the labels, the metadata and the messages.
+func newMockExportTask(t *testing.T, mockCtrl *gomock.Controller, client *apiclient.MockClient) (*ExportTask, []proton.Message) {
+	t.Helper()
+
+	user, salts, address, addrKR := newMockUser(t)
+
+	messages := make([]proton.Message, 0, 2)
+
+	for i, body := range []string{"Hello", "World"} {
+		encrypted, err := addrKR.Encrypt(crypto.NewPlainMessageFromString(body), nil)
+		require.NoError(t, err)
+
+		armored, err := encrypted.GetArmored()
+		require.NoError(t, err)
+
+		messages = append(messages, proton.Message{
+			MessageMetadata: proton.MessageMetadata{
+				ID:        fmt.Sprintf("msg-%v", i),
+				AddressID: address.ID,
+				LabelIDs:  []string{proton.AllMailLabel, proton.InboxLabel},
+				Subject:   fmt.Sprintf("Message %v", i),
+				Sender:    &mail.Address{Address: "sender@proton.me"},
+				ToList:    []*mail.Address{{Address: address.Email}},
+				Time:      time.Date(2024, 1, 1+i, 0, 0, 0, 0, time.UTC).Unix(),
+				Size:      len(body),
+			},
+			Header:   fmt.Sprintf("Subject: Message %v\r\nFrom: sender@proton.me\r\nTo: %v\r\n", i, address.Email),
+			MIMEType: rfc822.TextPlain,
+			Body:     armored,
+		})
+	}
+
+	client.EXPECT().GetAddresses(gomock.Any()).Return([]proton.Address{address}, nil).AnyTimes()
+	client.EXPECT().GetLabels(gomock.Any(), gomock.Any()).Return([]proton.Label{
+		{ID: proton.InboxLabel, Name: "Inbox", Type: proton.LabelTypeSystem},
+	}, nil).AnyTimes()
+	client.EXPECT().GetGroupedMessageCount(gomock.Any()).Return([]proton.MessageGroupCount{
+		{LabelID: proton.AllMailLabel, Total: len(messages)},
+		{LabelID: proton.InboxLabel, Total: len(messages)},
+	}, nil)
+	client.EXPECT().GetMessageMetadataPage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _, _ int, filter proton.MessageFilter) ([]proton.MessageMetadata, error) {
+			if len(filter.EndID) != 0 {
+				return nil, nil
+			}
+
+			return xslices.Map(messages, func(m proton.Message) proton.MessageMetadata { return m.MessageMetadata }), nil
+		},
+	).AnyTimes()
+
+	for _, message := range messages {
+		client.EXPECT().GetMessage(gomock.Any(), message.ID).Return(message, nil)
+	}
+
+	s := newMockSessionWithUser(t, mockCtrl, client, user, salts)
+
+	return NewExportTask(context.Background(), t.TempDir(), s), messages
+}
+
+// newMockUser returns a user whose keys are unlocked by the password "password", and its address.
+func newMockUser(t *testing.T) (proton.User, proton.Salts, proton.Address, *crypto.KeyRing) {
+	t.Helper()
+
+	salts := proton.Salts{{ID: "user-key-id", KeySalt: base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))}}
+
+	saltedKeyPass, err := salts.SaltForKey([]byte("password"), "user-key-id")
+	require.NoError(t, err)
+
+	newKey := func(id, email string) (proton.Key, *crypto.Key) {
+		key, err := crypto.GenerateKey("test", email, "x25519", 0)
+		require.NoError(t, err)
+
+		locked, err := key.Lock(saltedKeyPass)
+		require.NoError(t, err)
+
+		serialized, err := locked.Serialize()
+		require.NoError(t, err)
+
+		return proton.Key{ID: id, PrivateKey: serialized, Primary: true, Active: true}, key
+	}
+
+	userKey, _ := newKey("user-key-id", "user@proton.me")
+	addrKey, key := newKey("address-key-id", "user@proton.me")
+
+	addrKR, err := crypto.NewKeyRing(key)
+	require.NoError(t, err)
+
+	user := proton.User{ID: "user-id", Name: "user", Email: "user@proton.me", Keys: proton.Keys{userKey}}
+	address := proton.Address{
+		ID:     "address-id",
+		Email:  "user@proton.me",
+		Status: proton.AddressStatusEnabled,
+		Keys:   proton.Keys{addrKey},
+	}
+
+	return user, salts, address, addrKR
+}
@@ -0,0 +1,431 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+)
+
+// Sharding
+// --------
+// A large mailbox can be exported by several machines or processes in parallel. A coordinator first splits the mailbox
+// into shards holding roughly the same number of messages and writes one job descriptor per shard. Each worker exports
+// a single shard and writes a shard manifest next to the exported messages. The manifests are merged afterwards.
+//
+// Shards are contiguous ranges of the mailbox, either in the order the API returns the messages (most recent first) or
+// by reception date. Date shards are not affected by messages being added or removed after the plan was made. ID shards
+// are exact at planning time and new messages end up in the first shard.
+
+// ShardMode tells how a mailbox is split into shards.
+type ShardMode int
+
+const (
+	ShardModeDate      ShardMode = iota // Shards are ranges of reception dates.
+	ShardModeMessageID                  // Shards are ranges of message IDs in API order.
+)
+
+func (s ShardMode) String() string {
+	switch s {
+	case ShardModeDate:
+		return "date"
+	case ShardModeMessageID:
+		return "id"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(s))
+	}
+}
+
+func ShardModeFromString(str string) (ShardMode, error) {
+	switch strings.ToLower(str) {
+	case "date":
+		return ShardModeDate, nil
+	case "id":
+		return ShardModeMessageID, nil
+	default:
+		return ShardModeDate, fmt.Errorf("unknown shard mode '%v'", str)
+	}
+}
+
+// ShardJob describes the part of a mailbox a worker must export.
+type ShardJob struct {
+	UserID string
+	Index  int // Zero based.
+	Count  int
+	Mode   ShardMode
+
+	// ShardModeDate: messages received in [After, Before). A zero value means unbounded.
+	After  time.Time `json:",omitempty"`
+	Before time.Time `json:",omitempty"`
+
+	// ShardModeMessageID: messages from FirstID to LastID included, most recent first. An empty value means unbounded.
+	FirstID string `json:",omitempty"`
+	LastID  string `json:",omitempty"`
+
+	// Number and size of the messages in the shard when the plan was made.
+	MessageCount uint64
+	TotalSize    uint64
+}
+
+const ShardJobVersion = 1
+
+var ErrInvalidShardCount = errors.New("shard count must be at least 1")
+
+func (s *ShardJob) Validate() error {
+	if s.Count < 1 {
+		return ErrInvalidShardCount
+	}
+
+	if s.Index < 0 || s.Index >= s.Count {
+		return fmt.Errorf("invalid shard index %v for %v shards", s.Index, s.Count)
+	}
+
+	if s.Mode == ShardModeDate && !s.After.IsZero() && !s.Before.IsZero() && !s.After.Before(s.Before) {
+		return fmt.Errorf("invalid shard: 'after' (%v) must be earlier than 'before' (%v)", s.After, s.Before)
+	}
+
+	return nil
+}
+
+func (s *ShardJob) String() string {
+	return fmt.Sprintf("%v/%v", s.Index+1, s.Count)
+}
+
+// clip returns the messages of the page that belong to the shard. The second return value is true when no later page
+// can contain messages of the shard.
+func (s *ShardJob) clip(page []proton.MessageMetadata) ([]proton.MessageMetadata, bool) {
+	if len(page) == 0 {
+		return page, false
+	}
+
+	switch s.Mode {
+	case ShardModeMessageID:
+		if s.LastID == "" {
+			return page, false
+		}
+
+		for i := range page {
+			if page[i].ID == s.LastID {
+				return page[:i+1], true
+			}
+		}
+
+		return page, false
+
+	case ShardModeDate:
+		filter := Filter{After: s.After, Before: s.Before}
+		result := make([]proton.MessageMetadata, 0, len(page))
+
+		for i := range page {
+			if filter.Matches(&page[i]) {
+				result = append(result, page[i])
+			}
+		}
+
+		// Pages are sorted from the most recent message to the oldest.
+		done := !s.After.IsZero() && time.Unix(page[len(page)-1].Time, 0).Before(s.After)
+
+		return result, done
+	}
+
+	return page, false
+}
+
+func getShardJobFileName(job *ShardJob) string {
+	return fmt.Sprintf("shard_%03d_of_%03d.json", job.Index+1, job.Count)
+}
+
+// LoadShardJob reads a job descriptor written by WriteShardJobs.
+func LoadShardJob(path string) (ShardJob, error) {
+	b, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return ShardJob{}, fmt.Errorf("failed to read shard job: %w", err)
+	}
+
+	job, err := utils.NewVersionedJSON[ShardJob](ShardJobVersion, b)
+	if err != nil {
+		return ShardJob{}, fmt.Errorf("failed to parse shard job: %w", err)
+	}
+
+	if err := job.Payload.Validate(); err != nil {
+		return ShardJob{}, err
+	}
+
+	return job.Payload, nil
+}
+
+// WriteShardJobs writes one job descriptor per shard in dir and returns the paths of the files.
+func WriteShardJobs(dir string, jobs []ShardJob) ([]string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create shard directory: %w", err)
+	}
+
+	paths := make([]string, 0, len(jobs))
+
+	for i := range jobs {
+		data, err := utils.GenerateVersionedJSON(ShardJobVersion, &jobs[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to json encode shard job: %w", err)
+		}
+
+		path := filepath.Join(dir, getShardJobFileName(&jobs[i]))
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return nil, fmt.Errorf("failed to write '%v': %w", path, err)
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
+
+// PlanShards splits the mailbox of the user into count shards of roughly the same number of messages. Fewer shards are
+// returned if the mailbox has less than count messages.
+func PlanShards(
+	ctx context.Context,
+	client apiclient.Client,
+	userID string,
+	mode ShardMode,
+	count int,
+	pageSize int,
+) ([]ShardJob, error) {
+	if count < 1 {
+		return nil, ErrInvalidShardCount
+	}
+
+	var messages []proton.MessageMetadata
+
+	if err := walkMetadataPages(ctx, client, pageSize, proton.MessageFilter{Desc: true}, func(page []proton.MessageMetadata) error {
+		for i := range page {
+			// Only keep what is needed to compute the ranges.
+			messages = append(messages, proton.MessageMetadata{ID: page[i].ID, Time: page[i].Time, Size: page[i].Size})
+		}
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+
+	jobs := splitShards(messages, mode, count)
+	for i := range jobs {
+		jobs[i].UserID = userID
+	}
+
+	return jobs, nil
+}
+
+// splitShards computes the shard ranges of messages, which must be sorted from the most recent to the oldest. The first
+// and last shards are unbounded on their outer side so that messages received or found after planning are not lost.
+func splitShards(messages []proton.MessageMetadata, mode ShardMode, count int) []ShardJob {
+	if count > len(messages) {
+		count = len(messages)
+	}
+
+	if count <= 1 {
+		job := ShardJob{Count: 1, Mode: mode, MessageCount: uint64(len(messages))}
+		for i := range messages {
+			job.TotalSize += uint64(messages[i].Size)
+		}
+
+		return []ShardJob{job}
+	}
+
+	var chunks [][]proton.MessageMetadata
+
+	for start := 0; start < len(messages); {
+		remainingShards := count - len(chunks)
+		end := start + (len(messages)-start+remainingShards-1)/remainingShards
+
+		// A date boundary cannot split messages received at the same second.
+		if mode == ShardModeDate {
+			for end < len(messages) && messages[end].Time == messages[end-1].Time {
+				end++
+			}
+		}
+
+		chunks = append(chunks, messages[start:end])
+		start = end
+	}
+
+	jobs := make([]ShardJob, len(chunks))
+
+	for i, chunk := range chunks {
+		job := ShardJob{Index: i, Count: len(chunks), Mode: mode, MessageCount: uint64(len(chunk))}
+		for j := range chunk {
+			job.TotalSize += uint64(chunk[j].Size)
+		}
+
+		isFirst, isLast := i == 0, i == len(chunks)-1
+
+		switch mode {
+		case ShardModeMessageID:
+			if !isFirst {
+				job.FirstID = chunk[0].ID
+			}
+
+			if !isLast {
+				job.LastID = chunk[len(chunk)-1].ID
+			}
+
+		case ShardModeDate:
+			if !isFirst {
+				job.Before = jobs[i-1].After
+			}
+
+			if !isLast {
+				job.After = time.Unix(chunk[len(chunk)-1].Time, 0).UTC()
+			}
+		}
+
+		jobs[i] = job
+	}
+
+	return jobs
+}
+
+// ShardManifest is written in the export directory of a shard once its export is finished.
+type ShardManifest struct {
+	Job        ShardJob
+	Complete   bool // Whether the export of the shard finished without error.
+	MessageIDs []string
+}
+
+const ShardManifestVersion = 1
+
+func getShardManifestFileName() string {
+	return "shard_manifest.json"
+}
+
+// writeShardManifest lists the messages present in the export directory, packed messages included, and writes the
+// manifest of the shard.
+func writeShardManifest(tmpDir, exportDir string, job *ShardJob, complete bool) error {
+	entries, err := fs.ReadDir(newPackFS(os.DirFS(exportDir)), ".")
+	if err != nil {
+		return fmt.Errorf("failed to list export directory: %w", err)
+	}
+
+	manifest := ShardManifest{Job: *job, Complete: complete, MessageIDs: []string{}}
+
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), jsonMetadataExtension); ok && !entry.IsDir() {
+			manifest.MessageIDs = append(manifest.MessageIDs, id)
+		}
+	}
+
+	sort.Strings(manifest.MessageIDs)
+
+	data, err := utils.GenerateVersionedJSON(ShardManifestVersion, &manifest)
+	if err != nil {
+		return fmt.Errorf("failed to json encode shard manifest: %w", err)
+	}
+
+	return utils.WriteFileSafe(tmpDir, filepath.Join(exportDir, getShardManifestFileName()), data, &utils.Sha256IntegrityChecker{})
+}
+
+// LoadShardManifest reads the manifest from the export directory of a shard.
+func LoadShardManifest(exportDir string) (ShardManifest, error) {
+	b, err := os.ReadFile(filepath.Join(exportDir, getShardManifestFileName())) //nolint:gosec
+	if err != nil {
+		return ShardManifest{}, fmt.Errorf("failed to read shard manifest: %w", err)
+	}
+
+	manifest, err := utils.NewVersionedJSON[ShardManifest](ShardManifestVersion, b)
+	if err != nil {
+		return ShardManifest{}, fmt.Errorf("failed to parse shard manifest: %w", err)
+	}
+
+	return manifest.Payload, nil
+}
+
+// MergedShardManifest combines the manifests of all the shards of a mailbox.
+type MergedShardManifest struct {
+	UserID           string
+	Mode             ShardMode
+	ShardCount       int
+	Shards           []ShardManifest
+	MessageIDs       []string
+	MissingShards    []int `json:",omitempty"` // Indices of the shards without a manifest.
+	IncompleteShards []int `json:",omitempty"` // Indices of the shards whose export did not finish.
+}
+
+// IsComplete returns true if all the shards were exported successfully.
+func (m *MergedShardManifest) IsComplete() bool {
+	return len(m.MissingShards) == 0 && len(m.IncompleteShards) == 0
+}
+
+// MergeShardManifests combines the manifests of the shards of a single plan.
+func MergeShardManifests(manifests []ShardManifest) (MergedShardManifest, error) {
+	if len(manifests) == 0 {
+		return MergedShardManifest{}, errors.New("no shard manifest to merge")
+	}
+
+	first := manifests[0].Job
+	result := MergedShardManifest{UserID: first.UserID, Mode: first.Mode, ShardCount: first.Count}
+	byIndex := make(map[int]ShardManifest, len(manifests))
+
+	for _, manifest := range manifests {
+		job := manifest.Job
+		if job.UserID != first.UserID || job.Mode != first.Mode || job.Count != first.Count {
+			return MergedShardManifest{}, fmt.Errorf("shard %v does not belong to the same plan as shard %v", job.String(), first.String())
+		}
+
+		if _, ok := byIndex[job.Index]; ok {
+			return MergedShardManifest{}, fmt.Errorf("shard %v is present more than once", job.String())
+		}
+
+		byIndex[job.Index] = manifest
+	}
+
+	seen := make(map[string]struct{})
+
+	for i := 0; i < result.ShardCount; i++ {
+		manifest, ok := byIndex[i]
+		if !ok {
+			result.MissingShards = append(result.MissingShards, i)
+			continue
+		}
+
+		if !manifest.Complete {
+			result.IncompleteShards = append(result.IncompleteShards, i)
+		}
+
+		result.Shards = append(result.Shards, manifest)
+
+		for _, id := range manifest.MessageIDs {
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				result.MessageIDs = append(result.MessageIDs, id)
+			}
+		}
+	}
+
+	sort.Strings(result.MessageIDs)
+
+	return result, nil
+}
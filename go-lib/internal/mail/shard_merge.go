@@ -0,0 +1,505 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Shard merge
+// -----------
+// The exports of all the shards of a plan are assembled into a single archive with the same layout as a regular export,
+// plus a unified manifest:
+//
+// <output>
+//  |- labels.json
+//  |- sender_verification.json
+//  |- manifest.json
+//  |- msg-id.eml
+//  |- msg-id.metadata.json
+//
+// Files are written atomically, so an interrupted merge can be resumed by running it again: files already present in
+// the output are not copied again. The manifest is written last and only describes a finished merge.
+
+// ShardIssueType tells what is wrong with the shards being merged.
+type ShardIssueType int
+
+const (
+	ShardIssueMissingShard     ShardIssueType = iota // No export was provided for a shard of the plan.
+	ShardIssueIncompleteShard                        // The export of the shard did not finish successfully.
+	ShardIssueRangeGap                               // Part of the mailbox is not covered by any shard.
+	ShardIssueRangeOverlap                           // Part of the mailbox is covered by more than one shard.
+	ShardIssueDuplicateMessage                       // A message was exported by more than one shard.
+	ShardIssueMissingFiles                           // A message listed in a shard manifest has no file on disk.
+)
+
+func (s ShardIssueType) String() string {
+	switch s {
+	case ShardIssueMissingShard:
+		return "missing shard"
+	case ShardIssueIncompleteShard:
+		return "incomplete shard"
+	case ShardIssueRangeGap:
+		return "range gap"
+	case ShardIssueRangeOverlap:
+		return "range overlap"
+	case ShardIssueDuplicateMessage:
+		return "duplicate message"
+	case ShardIssueMissingFiles:
+		return "missing files"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(s))
+	}
+}
+
+// ShardIssue describes a gap or an overlap found while merging shards.
+type ShardIssue struct {
+	Type      ShardIssueType
+	Shards    []int  // Zero based indices of the shards involved.
+	MessageID string `json:",omitempty"`
+	Detail    string `json:",omitempty"`
+}
+
+// IsGap returns true if the issue means that messages may be missing from the merged archive.
+func (s *ShardIssue) IsGap() bool {
+	return s.Type != ShardIssueRangeOverlap && s.Type != ShardIssueDuplicateMessage
+}
+
+// ShardMergeReport is the outcome of a merge. It is also stored in the unified manifest.
+type ShardMergeReport struct {
+	Manifest     MergedShardManifest
+	Issues       []ShardIssue `json:",omitempty"`
+	CopiedCount  int          // Messages copied during this run.
+	ResumedCount int          // Messages that were already present in the output.
+	Duration     time.Duration
+}
+
+// HasGaps returns true if messages may be missing from the merged archive.
+func (s *ShardMergeReport) HasGaps() bool {
+	for i := range s.Issues {
+		if s.Issues[i].IsGap() {
+			return true
+		}
+	}
+
+	return false
+}
+
+const ShardMergeManifestVersion = 1
+
+var ErrShardMergeOutputInShard = errors.New("the merge output directory cannot be a shard directory")
+
+func getMergeManifestFileName() string {
+	return "manifest.json"
+}
+
+// MergeShards assembles the exports of the shards found in shardDirs into outputDir and verifies that together they
+// cover the whole mailbox exactly once. Gaps and overlaps do not stop the merge, they are listed in the report.
+func MergeShards(ctx context.Context, shardDirs []string, outputDir string) (ShardMergeReport, error) {
+	startTime := time.Now()
+	log := logrus.WithField("merge", "shards")
+
+	manifests := make([]ShardManifest, 0, len(shardDirs))
+	dirByIndex := make(map[int]string, len(shardDirs))
+
+	for _, dir := range shardDirs {
+		if filepath.Clean(dir) == filepath.Clean(outputDir) {
+			return ShardMergeReport{}, ErrShardMergeOutputInShard
+		}
+
+		manifest, err := LoadShardManifest(dir)
+		if err != nil {
+			return ShardMergeReport{}, fmt.Errorf("failed to load shard in '%v': %w", dir, err)
+		}
+
+		manifests = append(manifests, manifest)
+		dirByIndex[manifest.Job.Index] = dir
+	}
+
+	merged, err := MergeShardManifests(manifests)
+	if err != nil {
+		return ShardMergeReport{}, err
+	}
+
+	report := ShardMergeReport{Manifest: merged, Issues: findShardIssues(&merged)}
+
+	tmpDir := filepath.Join(outputDir, "temp")
+	if err := os.MkdirAll(tmpDir, 0o700); err != nil {
+		return ShardMergeReport{}, fmt.Errorf("failed to create merge directory: %w", err)
+	}
+
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.WithError(err).Error("Failed to remove temp directory")
+		}
+	}()
+
+	// Each message is copied from the first shard that exported it and has its files, the next shards are tried when the
+	// files are missing.
+	copied := make(map[string]struct{}, len(merged.MessageIDs))
+	missing := make(map[string][]int)
+
+	var missingIDs []string
+
+	for _, shard := range merged.Shards {
+		dir := dirByIndex[shard.Job.Index]
+
+		for _, id := range shard.MessageIDs {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+
+			if _, ok := copied[id]; ok {
+				continue
+			}
+
+			resumed, err := copyExportedMessage(tmpDir, dir, outputDir, id)
+			if errors.Is(err, os.ErrNotExist) {
+				if _, ok := missing[id]; !ok {
+					missingIDs = append(missingIDs, id)
+				}
+
+				missing[id] = append(missing[id], shard.Job.Index)
+
+				continue
+			} else if err != nil {
+				return report, fmt.Errorf("failed to copy message '%v': %w", id, err)
+			}
+
+			copied[id] = struct{}{}
+
+			if resumed {
+				report.ResumedCount++
+			} else {
+				report.CopiedCount++
+			}
+		}
+	}
+
+	for _, id := range missingIDs {
+		if _, ok := copied[id]; ok {
+			continue
+		}
+
+		report.Issues = append(report.Issues, ShardIssue{
+			Type:      ShardIssueMissingFiles,
+			Shards:    missing[id],
+			MessageID: id,
+		})
+	}
+
+	if err := mergeLabelMetadata(tmpDir, merged.Shards, dirByIndex, outputDir, log); err != nil {
+		return report, err
+	}
+
+	if err := mergeSenderVerificationReports(tmpDir, merged.Shards, dirByIndex, outputDir); err != nil {
+		return report, err
+	}
+
+	report.Duration = time.Since(startTime)
+
+	data, err := utils.GenerateVersionedJSON(ShardMergeManifestVersion, &report)
+	if err != nil {
+		return report, fmt.Errorf("failed to json encode merge manifest: %w", err)
+	}
+
+	if err := utils.WriteFileSafe(tmpDir, filepath.Join(outputDir, getMergeManifestFileName()), data, &utils.Sha256IntegrityChecker{}); err != nil {
+		return report, fmt.Errorf("failed to write merge manifest: %w", err)
+	}
+
+	log.WithFields(logrus.Fields{
+		"messages": len(merged.MessageIDs),
+		"copied":   report.CopiedCount,
+		"resumed":  report.ResumedCount,
+		"issues":   len(report.Issues),
+	}).Info("Shards merged")
+
+	return report, nil
+}
+
+// findShardIssues checks that the shards of the manifest cover the mailbox exactly once.
+func findShardIssues(merged *MergedShardManifest) []ShardIssue {
+	var issues []ShardIssue
+
+	for _, index := range merged.MissingShards {
+		issues = append(issues, ShardIssue{Type: ShardIssueMissingShard, Shards: []int{index}})
+	}
+
+	for _, index := range merged.IncompleteShards {
+		issues = append(issues, ShardIssue{Type: ShardIssueIncompleteShard, Shards: []int{index}})
+	}
+
+	shards := merged.Shards
+
+	switch merged.Mode {
+	case ShardModeDate:
+		issues = append(issues, findDateRangeIssues(shards, merged.ShardCount)...)
+	case ShardModeMessageID:
+		issues = append(issues, findIDRangeIssues(shards)...)
+	}
+
+	owners := make(map[string][]int)
+
+	for _, shard := range shards {
+		for _, id := range shard.MessageIDs {
+			owners[id] = append(owners[id], shard.Job.Index)
+		}
+	}
+
+	for _, id := range merged.MessageIDs {
+		if len(owners[id]) > 1 {
+			issues = append(issues, ShardIssue{Type: ShardIssueDuplicateMessage, Shards: owners[id], MessageID: id})
+		}
+	}
+
+	return issues
+}
+
+// findDateRangeIssues checks that each shard starts where the previous, more recent, one ends. Shards must be sorted
+// by index.
+func findDateRangeIssues(shards []ShardManifest, count int) []ShardIssue {
+	var issues []ShardIssue
+
+	for i, shard := range shards {
+		job := shard.Job
+
+		if job.Index == 0 && !job.Before.IsZero() {
+			issues = append(issues, ShardIssue{
+				Type:   ShardIssueRangeGap,
+				Shards: []int{job.Index},
+				Detail: fmt.Sprintf("messages received at or after %v are not covered", job.Before.UTC()),
+			})
+		}
+
+		if job.Index == count-1 && !job.After.IsZero() {
+			issues = append(issues, ShardIssue{
+				Type:   ShardIssueRangeGap,
+				Shards: []int{job.Index},
+				Detail: fmt.Sprintf("messages received before %v are not covered", job.After.UTC()),
+			})
+		}
+
+		if i == 0 || shards[i-1].Job.Index != job.Index-1 {
+			// Gaps caused by missing shards are already reported.
+			continue
+		}
+
+		newer := shards[i-1].Job
+
+		switch {
+		case job.Before.Before(newer.After):
+			issues = append(issues, ShardIssue{
+				Type:   ShardIssueRangeGap,
+				Shards: []int{newer.Index, job.Index},
+				Detail: fmt.Sprintf("messages received from %v to %v are not covered", job.Before.UTC(), newer.After.UTC()),
+			})
+		case job.Before.After(newer.After):
+			issues = append(issues, ShardIssue{
+				Type:   ShardIssueRangeOverlap,
+				Shards: []int{newer.Index, job.Index},
+				Detail: fmt.Sprintf("messages received from %v to %v are covered twice", newer.After.UTC(), job.Before.UTC()),
+			})
+		}
+	}
+
+	return issues
+}
+
+// findIDRangeIssues checks that the boundary messages of the ID ranges were exported. A missing boundary message means
+// the shard could not start or stop where it was planned, either because the message was deleted in the meantime or
+// because the export of the shard did not reach it.
+func findIDRangeIssues(shards []ShardManifest) []ShardIssue {
+	var issues []ShardIssue
+
+	for _, shard := range shards {
+		job := shard.Job
+
+		for _, boundary := range []string{job.FirstID, job.LastID} {
+			if boundary == "" {
+				continue
+			}
+
+			if index := sort.SearchStrings(shard.MessageIDs, boundary); index == len(shard.MessageIDs) || shard.MessageIDs[index] != boundary {
+				issues = append(issues, ShardIssue{
+					Type:      ShardIssueRangeGap,
+					Shards:    []int{job.Index},
+					MessageID: boundary,
+					Detail:    "boundary message of the shard was not exported",
+				})
+			}
+		}
+	}
+
+	return issues
+}
+
+// copyExportedMessage copies the files of a message from a shard export to the output. The first return value is true
+// if the message was already present in the output.
+func copyExportedMessage(tmpDir, srcDir, dstDir, id string) (bool, error) {
+	metadataName := getMetadataFileName(id)
+
+	if exists, err := fileExists(filepath.Join(dstDir, metadataName)); err != nil {
+		return false, err
+	} else if exists {
+		return true, nil
+	}
+
+	if exists, err := fileExists(filepath.Join(srcDir, metadataName)); err != nil {
+		return false, err
+	} else if !exists {
+		return false, fmt.Errorf("metadata of message '%v': %w", id, os.ErrNotExist)
+	}
+
+	// Messages that could not be assembled are exported as a folder instead of an EML file.
+	if emlExists, err := fileExists(filepath.Join(srcDir, getEMLFileName(id))); err != nil {
+		return false, err
+	} else if emlExists {
+		if err := copyFileSafe(tmpDir, filepath.Join(srcDir, getEMLFileName(id)), filepath.Join(dstDir, getEMLFileName(id))); err != nil {
+			return false, err
+		}
+	} else if err := copyDirSafe(tmpDir, filepath.Join(srcDir, id), filepath.Join(dstDir, id)); err != nil {
+		return false, err
+	}
+
+	// The metadata file is copied last, its presence in the output marks the message as merged.
+	if err := copyFileSafe(tmpDir, filepath.Join(srcDir, metadataName), filepath.Join(dstDir, metadataName)); err != nil {
+		return false, err
+	}
+
+	return false, nil
+}
+
+func copyFileSafe(tmpDir, src, dst string) error {
+	data, err := os.ReadFile(src) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("failed to read '%v': %w", src, err)
+	}
+
+	return utils.WriteFileSafe(tmpDir, dst, data, &utils.Sha256IntegrityChecker{})
+}
+
+func copyDirSafe(tmpDir, src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return fmt.Errorf("failed to list '%v': %w", src, err)
+	}
+
+	if err := os.MkdirAll(dst, 0o700); err != nil {
+		return fmt.Errorf("failed to create '%v': %w", dst, err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		if err := copyFileSafe(tmpDir, filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeLabelMetadata copies the label file of the first shard. The label files of the shards are expected to be
+// identical, unless the labels were modified while the shards were being exported.
+func mergeLabelMetadata(tmpDir string, shards []ShardManifest, dirByIndex map[int]string, outputDir string, log *logrus.Entry) error {
+	var reference []byte
+
+	for _, shard := range shards {
+		data, err := os.ReadFile(filepath.Join(dirByIndex[shard.Job.Index], getLabelFileName())) //nolint:gosec
+		if err != nil {
+			return fmt.Errorf("failed to read label metadata of shard %v: %w", shard.Job.String(), err)
+		}
+
+		if reference == nil {
+			reference = data
+		} else if !bytes.Equal(reference, data) {
+			log.WithField("shard", shard.Job.String()).Warn("Label metadata differs between shards, using the first shard")
+		}
+	}
+
+	if reference == nil {
+		return nil
+	}
+
+	return utils.WriteFileSafe(tmpDir, filepath.Join(outputDir, getLabelFileName()), reference, &utils.Sha256IntegrityChecker{})
+}
+
+// mergeSenderVerificationReports sums the sender verification reports of the shards.
+func mergeSenderVerificationReports(tmpDir string, shards []ShardManifest, dirByIndex map[int]string, outputDir string) error {
+	result := SenderVerificationReport{}
+	senders := make(map[string]*SenderVerificationSender)
+	authentication := newAuthenticationCollector()
+
+	for _, shard := range shards {
+		data, err := os.ReadFile(filepath.Join(dirByIndex[shard.Job.Index], getSenderVerificationFileName())) //nolint:gosec
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to read sender verification report: %w", err)
+		}
+
+		report, err := utils.NewVersionedJSON[SenderVerificationReport](SenderVerificationReportVersion, data)
+		if err != nil {
+			return fmt.Errorf("failed to parse sender verification report: %w", err)
+		}
+
+		result.ReceivedCount += report.Payload.ReceivedCount
+		result.VerifiedCount += report.Payload.VerifiedCount
+		result.UnverifiedCount += report.Payload.UnverifiedCount
+		result.FailedCount += report.Payload.FailedCount
+		result.SuspiciousCount += report.Payload.SuspiciousCount
+
+		if report.Payload.Authentication != nil {
+			authentication.merge(report.Payload.Authentication)
+		}
+
+		for _, sender := range report.Payload.Senders {
+			merged, ok := senders[sender.Address]
+			if !ok {
+				merged = &SenderVerificationSender{Address: sender.Address}
+				senders[sender.Address] = merged
+			}
+
+			merged.UnverifiedCount += sender.UnverifiedCount
+			merged.FailedCount += sender.FailedCount
+			merged.SuspiciousCount += sender.SuspiciousCount
+			merged.MessageIDs = append(merged.MessageIDs, sender.MessageIDs...)
+		}
+	}
+
+	collector := &senderVerificationCollector{report: result, senders: senders, authentication: authentication}
+
+	data, err := utils.GenerateVersionedJSON(SenderVerificationReportVersion, collector.get())
+	if err != nil {
+		return fmt.Errorf("failed to json encode sender verification report: %w", err)
+	}
+
+	return utils.WriteFileSafe(tmpDir, filepath.Join(outputDir, getSenderVerificationFileName()), data, &utils.Sha256IntegrityChecker{})
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestShard(t *testing.T, job ShardJob, ids []string, withFiles []string) string {
+	dir := t.TempDir()
+
+	for _, id := range withFiles {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, getMetadataFileName(id)), []byte("{}"), 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, getEMLFileName(id)), []byte("eml "+id), 0o600))
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getLabelFileName()), []byte("[]"), 0o600))
+
+	data, err := utils.GenerateVersionedJSON(ShardManifestVersion, &ShardManifest{Job: job, Complete: true, MessageIDs: ids})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getShardManifestFileName()), data, 0o600))
+
+	return dir
+}
+
+func TestMergeShards(t *testing.T) {
+	boundary := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	shard1 := writeTestShard(t,
+		ShardJob{UserID: "user", Index: 0, Count: 2, Mode: ShardModeDate, After: boundary},
+		[]string{"a", "b", "c"},
+		[]string{"a", "b"}, // Files of 'c' are missing.
+	)
+	shard2 := writeTestShard(t,
+		ShardJob{UserID: "user", Index: 1, Count: 2, Mode: ShardModeDate, Before: boundary.Add(time.Hour)},
+		[]string{"b", "d"},
+		[]string{"b", "d"},
+	)
+
+	output := t.TempDir()
+
+	report, err := MergeShards(context.Background(), []string{shard1, shard2}, output)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c", "d"}, report.Manifest.MessageIDs)
+	require.Equal(t, 3, report.CopiedCount)
+	require.True(t, report.HasGaps())
+
+	issueTypes := make([]ShardIssueType, 0, len(report.Issues))
+	for _, issue := range report.Issues {
+		issueTypes = append(issueTypes, issue.Type)
+	}
+	require.ElementsMatch(t, []ShardIssueType{ShardIssueRangeOverlap, ShardIssueDuplicateMessage, ShardIssueMissingFiles}, issueTypes)
+
+	for _, id := range []string{"a", "b", "d"} {
+		eml, err := os.ReadFile(filepath.Join(output, getEMLFileName(id)))
+		require.NoError(t, err)
+		require.Equal(t, "eml "+id, string(eml))
+	}
+
+	for _, name := range []string{getLabelFileName(), getSenderVerificationFileName(), getMergeManifestFileName()} {
+		_, err := os.Stat(filepath.Join(output, name))
+		require.NoError(t, err, name)
+	}
+
+	// Running the merge again resumes it.
+	report, err = MergeShards(context.Background(), []string{shard1, shard2}, output)
+	require.NoError(t, err)
+	require.Equal(t, 0, report.CopiedCount)
+	require.Equal(t, 3, report.ResumedCount)
+}
+
+func TestMergeShards_MissingFilesInFirstShard(t *testing.T) {
+	boundary := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	shard1 := writeTestShard(t,
+		ShardJob{UserID: "user", Index: 0, Count: 2, Mode: ShardModeDate, After: boundary},
+		[]string{"a", "b", "c"},
+		[]string{"a"}, // Files of 'b' and 'c' are missing.
+	)
+	shard2 := writeTestShard(t,
+		ShardJob{UserID: "user", Index: 1, Count: 2, Mode: ShardModeDate, Before: boundary.Add(time.Hour)},
+		[]string{"b", "c", "d"},
+		[]string{"b", "d"},
+	)
+
+	output := t.TempDir()
+
+	report, err := MergeShards(context.Background(), []string{shard1, shard2}, output)
+	require.NoError(t, err)
+	require.Equal(t, 3, report.CopiedCount)
+
+	// 'b' is copied from the second shard, only 'c' is missing from both.
+	eml, err := os.ReadFile(filepath.Join(output, getEMLFileName("b")))
+	require.NoError(t, err)
+	require.Equal(t, "eml b", string(eml))
+
+	var missing []ShardIssue
+
+	for _, issue := range report.Issues {
+		if issue.Type == ShardIssueMissingFiles {
+			missing = append(missing, issue)
+		}
+	}
+
+	require.Equal(t, []ShardIssue{{Type: ShardIssueMissingFiles, Shards: []int{0, 1}, MessageID: "c"}}, missing)
+}
+
+func TestFindShardIssues_DateGap(t *testing.T) {
+	boundary := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	merged, err := MergeShardManifests([]ShardManifest{
+		{Job: ShardJob{UserID: "user", Index: 0, Count: 2, After: boundary}, Complete: true},
+		{Job: ShardJob{UserID: "user", Index: 1, Count: 2, Before: boundary.Add(-time.Hour)}, Complete: true},
+	})
+	require.NoError(t, err)
+
+	issues := findShardIssues(&merged)
+	require.Len(t, issues, 1)
+	require.Equal(t, ShardIssueRangeGap, issues[0].Type)
+	require.Equal(t, []int{0, 1}, issues[0].Shards)
+}
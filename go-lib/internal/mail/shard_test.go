@@ -0,0 +1,122 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+// testShardMetadata returns count messages sorted from the most recent to the oldest, one per hour.
+func testShardMetadata(count int) []proton.MessageMetadata {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	result := make([]proton.MessageMetadata, count)
+
+	for i := range result {
+		result[i] = proton.MessageMetadata{
+			ID:   fmt.Sprintf("msg-%02d", i),
+			Time: start.Add(time.Duration(count-i) * time.Hour).Unix(),
+			Size: 10,
+		}
+	}
+
+	return result
+}
+
+func collectShard(job *ShardJob, messages []proton.MessageMetadata) []string {
+	start := 0
+	if job.Mode == ShardModeMessageID && job.FirstID != "" {
+		for start < len(messages) && messages[start].ID != job.FirstID {
+			start++
+		}
+	}
+
+	var ids []string
+
+	clipped, _ := job.clip(messages[start:])
+	for _, m := range clipped {
+		ids = append(ids, m.ID)
+	}
+
+	return ids
+}
+
+func TestSplitShards(t *testing.T) {
+	messages := testShardMetadata(10)
+
+	for _, mode := range []ShardMode{ShardModeDate, ShardModeMessageID} {
+		jobs := splitShards(messages, mode, 3)
+		require.Len(t, jobs, 3, mode.String())
+
+		var all []string
+		for i := range jobs {
+			require.NoError(t, jobs[i].Validate())
+			require.Equal(t, i, jobs[i].Index)
+
+			ids := collectShard(&jobs[i], messages)
+			require.Len(t, ids, int(jobs[i].MessageCount), mode.String())
+			require.Equal(t, jobs[i].MessageCount*10, jobs[i].TotalSize)
+			all = append(all, ids...)
+		}
+
+		// Every message belongs to exactly one shard.
+		require.Len(t, all, len(messages), mode.String())
+		for i := range messages {
+			require.Equal(t, messages[i].ID, all[i])
+		}
+	}
+}
+
+func TestSplitShards_SameSecond(t *testing.T) {
+	messages := testShardMetadata(6)
+	messages[3].Time = messages[2].Time
+
+	jobs := splitShards(messages, ShardModeDate, 2)
+	require.Len(t, jobs, 2)
+	require.Equal(t, []string{"msg-00", "msg-01", "msg-02", "msg-03"}, collectShard(&jobs[0], messages))
+	require.Equal(t, []string{"msg-04", "msg-05"}, collectShard(&jobs[1], messages))
+}
+
+func TestSplitShards_Small(t *testing.T) {
+	require.Len(t, splitShards(nil, ShardModeDate, 4), 1)
+	require.Len(t, splitShards(testShardMetadata(2), ShardModeMessageID, 4), 2)
+}
+
+func TestMergeShardManifests(t *testing.T) {
+	job := ShardJob{UserID: "user", Count: 3, Mode: ShardModeDate}
+	manifests := []ShardManifest{
+		{Job: job, Complete: true, MessageIDs: []string{"a", "b"}},
+		{Job: job, Complete: false, MessageIDs: []string{"b", "c"}},
+	}
+	manifests[1].Job.Index = 2
+
+	merged, err := MergeShardManifests(manifests)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, merged.MessageIDs)
+	require.Equal(t, []int{1}, merged.MissingShards)
+	require.Equal(t, []int{2}, merged.IncompleteShards)
+	require.False(t, merged.IsComplete())
+
+	manifests[1].Job.UserID = "other"
+	_, err = MergeShardManifests(manifests)
+	require.Error(t, err)
+}
@@ -0,0 +1,377 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+)
+
+// Starter packs
+// -------------
+// A starter pack is a small backup cut from a full one, by default the messages of the last days, the starred
+// messages and the contacts. It is restored first to a new account so that the account is usable within minutes, while
+// the full backup is restored later with duplicate detection, see SetSkipDuplicates. The starter pack is written with
+// the regular layout whatever the format of the full backup.
+
+const StarterPackManifestVersion = 1
+
+// DefaultStarterPackDays is the age of the most recent messages included by DefaultStarterPackSpec.
+const DefaultStarterPackDays = 30
+
+var ErrStarterPackEncrypted = errors.New("starter packs cannot be cut from backups encrypted at rest")
+
+// StarterPackSpec selects the content of a starter pack. A message is included if it matches any of the filters.
+type StarterPackSpec struct {
+	Filters  []Filter
+	Contacts bool
+	MaxBytes int64 // Maximum size of the selected messages, the most recent ones are kept. 0 means no limit.
+}
+
+// DefaultStarterPackSpec selects the messages received in the last days, the starred messages and the contacts.
+func DefaultStarterPackSpec(now time.Time, days int) StarterPackSpec {
+	return StarterPackSpec{
+		Filters: []Filter{
+			{After: now.AddDate(0, 0, -days)},
+			{LabelIDs: []string{proton.StarredLabel}},
+		},
+		Contacts: true,
+	}
+}
+
+func (s *StarterPackSpec) Validate() error {
+	if len(s.Filters) == 0 {
+		return fmt.Errorf("invalid starter pack: no filter")
+	}
+
+	if s.MaxBytes < 0 {
+		return fmt.Errorf("invalid starter pack: maximum size cannot be negative")
+	}
+
+	for i := range s.Filters {
+		if err := s.Filters[i].Validate(); err != nil {
+			return err
+		}
+
+		if s.Filters[i].HasBodyCriteria() || s.Filters[i].ExpandConversations {
+			return fmt.Errorf("invalid starter pack: body keywords, languages and conversations are not supported")
+		}
+	}
+
+	return nil
+}
+
+// StarterPackManifest is written in the starter pack to record where it comes from.
+type StarterPackManifest struct {
+	Source           string
+	Time             time.Time
+	Spec             StarterPackSpec
+	MessageCount     int
+	TotalSize        int64 // Sum of the message sizes reported by the API.
+	LeftOutCount     int   // Selected messages left out to fit Spec.MaxBytes.
+	ContactFileCount int
+}
+
+type StarterPackReport struct {
+	Manifest StarterPackManifest
+	Duration time.Duration
+}
+
+func getStarterPackManifestFileName() string {
+	return "starter_pack.json"
+}
+
+// starterPackMessage is a message of the backup selected for the starter pack.
+type starterPackMessage struct {
+	emlPath  string
+	metadata MessageMetadata
+}
+
+// CreateStarterPack writes the starter pack of the backup at backupPath, a folder or an archive, to dstDir, which must
+// not exist or be empty.
+func CreateStarterPack(ctx context.Context, backupPath, dstDir string, spec StarterPackSpec) (StarterPackReport, error) {
+	startTime := time.Now()
+	log := logrus.WithField("starter", "mail").WithField("source", backupPath).WithField("destination", dstDir)
+
+	if err := spec.Validate(); err != nil {
+		return StarterPackReport{}, err
+	}
+
+	if entries, err := os.ReadDir(dstDir); err == nil && len(entries) != 0 {
+		return StarterPackReport{}, fmt.Errorf("starter pack directory '%v' is not empty", dstDir)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return StarterPackReport{}, fmt.Errorf("failed to access starter pack directory: %w", err)
+	}
+
+	absPath, err := filepath.Abs(backupPath)
+	if err != nil {
+		return StarterPackReport{}, err
+	}
+
+	fsys, closer, err := openBackupFS(absPath)
+	if err != nil {
+		return StarterPackReport{}, err
+	}
+
+	if closer != nil {
+		defer closer.Close() //nolint:errcheck
+	}
+
+	dir, err := findBackupMailDir(fsys)
+	if err != nil {
+		return StarterPackReport{}, err
+	}
+
+	if _, err := fs.Stat(fsys, path.Join(dir, getAtRestEncryptionFileName())); err == nil {
+		return StarterPackReport{}, ErrStarterPackEncrypted
+	}
+
+	labelData, err := fs.ReadFile(fsys, path.Join(dir, getLabelFileName()))
+	if err != nil {
+		return StarterPackReport{}, fmt.Errorf("failed to read labels file: %w", err)
+	}
+
+	labels, err := utils.NewVersionedJSON[[]proton.Label](LabelMetadataVersion, labelData)
+	if err != nil {
+		return StarterPackReport{}, fmt.Errorf("failed to parse labels file: %w", err)
+	}
+
+	filters := make([]Filter, 0, len(spec.Filters))
+
+	for i := range spec.Filters {
+		filter, err := spec.Filters[i].resolveLabelsFrom(withSystemLabels(labels.Payload))
+		if err != nil {
+			return StarterPackReport{}, err
+		}
+
+		filters = append(filters, filter)
+	}
+
+	log.Info("Selecting starter pack messages")
+
+	selected, err := selectStarterPackMessages(ctx, fsys, dir, filters)
+	if err != nil {
+		return StarterPackReport{}, err
+	}
+
+	report := StarterPackReport{Manifest: StarterPackManifest{Source: absPath, Time: time.Now().UTC(), Spec: spec}}
+
+	// The most recent messages are kept when the selection does not fit the maximum size.
+	sort.Slice(selected, func(i, j int) bool { return selected[i].metadata.Time > selected[j].metadata.Time })
+
+	if spec.MaxBytes != 0 {
+		var size int64
+
+		for i := range selected {
+			if size += int64(selected[i].metadata.Size); size > spec.MaxBytes {
+				report.Manifest.LeftOutCount = len(selected) - i
+				selected = selected[:i]
+
+				break
+			}
+		}
+	}
+
+	tmpDir := filepath.Join(dstDir, "temp")
+	if err := os.MkdirAll(tmpDir, 0o700); err != nil {
+		return StarterPackReport{}, fmt.Errorf("failed to create starter pack tmp directory: %w", err)
+	}
+
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.WithError(err).Error("Failed to remove temp directory")
+		}
+	}()
+
+	write := func(name string, data []byte) error {
+		if err := utils.WriteFileSafe(tmpDir, filepath.Join(dstDir, filepath.FromSlash(name)), data, &utils.Sha256IntegrityChecker{}); err != nil {
+			return fmt.Errorf("failed to write '%v': %w", name, err)
+		}
+
+		return nil
+	}
+
+	if err := write(getLabelFileName(), labelData); err != nil {
+		return StarterPackReport{}, err
+	}
+
+	for _, message := range selected {
+		if err := ctx.Err(); err != nil {
+			return StarterPackReport{}, err
+		}
+
+		eml, err := fs.ReadFile(fsys, message.emlPath)
+		if err != nil {
+			return StarterPackReport{}, fmt.Errorf("failed to read '%v': %w", message.emlPath, err)
+		}
+
+		// The message is written before its metadata, which marks it as complete.
+		if err := write(path.Base(message.emlPath), eml); err != nil {
+			return StarterPackReport{}, err
+		}
+
+		metadata, err := message.metadata.toBytes()
+		if err != nil {
+			return StarterPackReport{}, fmt.Errorf("failed to generate message metadata: %w", err)
+		}
+
+		if err := write(getMetadataFileName(message.metadata.ID), metadata); err != nil {
+			return StarterPackReport{}, err
+		}
+
+		report.Manifest.MessageCount++
+		report.Manifest.TotalSize += int64(message.metadata.Size)
+	}
+
+	if spec.Contacts {
+		if report.Manifest.ContactFileCount, err = copyStarterPackContacts(fsys, dstDir, write); err != nil {
+			return StarterPackReport{}, err
+		}
+	}
+
+	manifest, err := utils.GenerateVersionedJSON(StarterPackManifestVersion, &report.Manifest)
+	if err != nil {
+		return StarterPackReport{}, fmt.Errorf("failed to json encode starter pack manifest: %w", err)
+	}
+
+	if err := write(getStarterPackManifestFileName(), manifest); err != nil {
+		return StarterPackReport{}, err
+	}
+
+	report.Duration = time.Since(startTime)
+
+	log.WithFields(logrus.Fields{
+		"messages": report.Manifest.MessageCount,
+		"leftOut":  report.Manifest.LeftOutCount,
+		"contacts": report.Manifest.ContactFileCount,
+	}).Info("Starter pack written")
+
+	return report, nil
+}
+
+// findBackupMailDir returns the folder of the backup holding the messages, the root folder or its single timestamped
+// sub folder.
+func findBackupMailDir(fsys fs.FS) (string, error) {
+	if _, err := fs.Stat(fsys, getLabelFileName()); err == nil {
+		return ".", nil
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return "", fmt.Errorf("failed to list backup: %w", err)
+	}
+
+	var dirs []string
+
+	for _, entry := range entries {
+		if entry.IsDir() && mailFolderRegExp.MatchString(entry.Name()) {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+
+	if len(dirs) != 1 {
+		return "", errors.New("no single backup folder with a labels file found")
+	}
+
+	return dirs[0], nil
+}
+
+// selectStarterPackMessages returns the messages of dir matching any of the filters.
+func selectStarterPackMessages(ctx context.Context, fsys fs.FS, dir string, filters []Filter) ([]starterPackMessage, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup: %w", err)
+	}
+
+	var selected []starterPackMessage
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), emlExtension) {
+			continue
+		}
+
+		emlPath := path.Join(dir, entry.Name())
+
+		metadata, err := loadMetadataFileFS(fsys, emlToMetadataFilename(emlPath))
+		if err != nil {
+			logrus.WithError(err).WithField("path", emlPath).Warn("Skipping message without valid metadata")
+			continue
+		}
+
+		for i := range filters {
+			if filters[i].Matches(&metadata.MessageMetadata) {
+				selected = append(selected, starterPackMessage{emlPath: emlPath, metadata: metadata})
+				break
+			}
+		}
+	}
+
+	return selected, nil
+}
+
+// copyStarterPackContacts copies the vCard files of the contacts folder of the backup, see ContactsRestoreTask, and
+// returns their number.
+func copyStarterPackContacts(fsys fs.FS, dstDir string, write func(name string, data []byte) error) (int, error) {
+	entries, err := fs.ReadDir(fsys, contactsBackupDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to list contacts: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dstDir, contactsBackupDir), 0o700); err != nil {
+		return 0, fmt.Errorf("failed to create contacts directory: %w", err)
+	}
+
+	count := 0
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.EqualFold(path.Ext(entry.Name()), vCardExtension) {
+			continue
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(contactsBackupDir, entry.Name()))
+		if err != nil {
+			return 0, fmt.Errorf("failed to read contacts: %w", err)
+		}
+
+		if err := write(contactsBackupDir+"/"+entry.Name(), data); err != nil {
+			return 0, err
+		}
+
+		count++
+	}
+
+	return count, nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+)
+
+func writeStarterPackTestBackup(t *testing.T, now time.Time) string {
+	dir := t.TempDir()
+
+	labels, err := utils.GenerateVersionedJSON(LabelMetadataVersion, []proton.Label{{ID: "label-1", Name: "Work", Type: proton.LabelTypeLabel}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, getLabelFileName()), labels, 0o600))
+
+	for _, message := range []proton.MessageMetadata{
+		{ID: "recent", Time: now.AddDate(0, 0, -1).Unix(), Size: 100, LabelIDs: []string{proton.InboxLabel}},
+		{ID: "older", Time: now.AddDate(0, 0, -10).Unix(), Size: 100, LabelIDs: []string{proton.InboxLabel}},
+		{ID: "starred", Time: now.AddDate(-2, 0, 0).Unix(), Size: 100, LabelIDs: []string{proton.InboxLabel, proton.StarredLabel}},
+		{ID: "old", Time: now.AddDate(-1, 0, 0).Unix(), Size: 100, LabelIDs: []string{proton.InboxLabel, "label-1"}},
+	} {
+		metadata := MessageMetadata{MessageMetadata: message}
+		data, err := metadata.toBytes()
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, getMetadataFileName(message.ID)), data, 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, getEMLFileName(message.ID)), []byte("Subject: "+message.ID+"\r\n\r\n"), 0o600))
+	}
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, contactsBackupDir), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, contactsBackupDir, "contacts.vcf"), []byte("BEGIN:VCARD\r\nEND:VCARD\r\n"), 0o600))
+
+	return dir
+}
+
+func TestCreateStarterPack(t *testing.T) {
+	now := time.Now()
+	backupDir := writeStarterPackTestBackup(t, now)
+	dstDir := filepath.Join(t.TempDir(), "starter")
+
+	report, err := CreateStarterPack(context.Background(), backupDir, dstDir, DefaultStarterPackSpec(now, 30))
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Manifest.MessageCount)
+	require.Equal(t, 1, report.Manifest.ContactFileCount)
+	require.Zero(t, report.Manifest.LeftOutCount)
+
+	for _, id := range []string{"recent", "older", "starred"} {
+		require.FileExists(t, filepath.Join(dstDir, getEMLFileName(id)))
+		require.FileExists(t, filepath.Join(dstDir, getMetadataFileName(id)))
+	}
+
+	require.NoFileExists(t, filepath.Join(dstDir, getEMLFileName("old")))
+	require.FileExists(t, filepath.Join(dstDir, getLabelFileName()))
+	require.FileExists(t, filepath.Join(dstDir, contactsBackupDir, "contacts.vcf"))
+	require.FileExists(t, filepath.Join(dstDir, getStarterPackManifestFileName()))
+	require.NoDirExists(t, filepath.Join(dstDir, "temp"))
+
+	// The destination must be empty.
+	_, err = CreateStarterPack(context.Background(), backupDir, dstDir, DefaultStarterPackSpec(now, 30))
+	require.Error(t, err)
+}
+
+func TestCreateStarterPack_MaxBytes(t *testing.T) {
+	now := time.Now()
+	backupDir := writeStarterPackTestBackup(t, now)
+	dstDir := t.TempDir()
+
+	spec := StarterPackSpec{Filters: []Filter{{Labels: []string{"Work"}}, {After: now.AddDate(0, 0, -30)}}, MaxBytes: 250}
+
+	report, err := CreateStarterPack(context.Background(), backupDir, dstDir, spec)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Manifest.MessageCount)
+	require.Equal(t, 1, report.Manifest.LeftOutCount)
+	require.Zero(t, report.Manifest.ContactFileCount)
+
+	require.FileExists(t, filepath.Join(dstDir, getEMLFileName("recent")))
+	require.FileExists(t, filepath.Join(dstDir, getEMLFileName("older")))
+	require.NoFileExists(t, filepath.Join(dstDir, getEMLFileName("old")))
+	require.NoDirExists(t, filepath.Join(dstDir, contactsBackupDir))
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package mail
+
+import (
+	"context"
+
+	"github.com/ProtonMail/export-tool/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceTask starts the span of a task and makes timer record a child span and the duration metric of each stage. It
+// must be called before the stages start.
+func traceTask(ctx context.Context, task string, timer *stageTimer) (context.Context, trace.Span) {
+	ctx, span := tracing.StartTask(ctx, task)
+
+	timer.ctx = ctx
+	timer.task = task
+
+	return ctx, span
+}
+
+func recordExportResult(ctx context.Context, result *ExportResult) {
+	const task = "export"
+
+	tracing.RecordMessages(ctx, task, "exported", result.ExportedMessageCount)
+	tracing.RecordMessages(ctx, task, "excluded", result.ExcludedMessageCount)
+	tracing.RecordMessages(ctx, task, "filtered", result.FilteredMessageCount)
+	tracing.RecordMessages(ctx, task, "unchanged", result.UnchangedMessageCount)
+	tracing.RecordMessages(ctx, task, "quarantined", uint64(len(result.Quarantined)))
+	tracing.RecordBytes(ctx, task, result.BytesWritten)
+}
+
+func recordRestoreResult(ctx context.Context, result *RestoreResult) {
+	const task = "restore"
+
+	tracing.RecordMessages(ctx, task, "imported", toUint64(result.ImportedCount))
+	tracing.RecordMessages(ctx, task, "failed", toUint64(result.FailedCount))
+	tracing.RecordMessages(ctx, task, "skipped", toUint64(result.SkippedCount))
+	tracing.RecordMessages(ctx, task, "filtered", toUint64(result.FilteredCount))
+	tracing.RecordBytes(ctx, task, result.BytesTransferred)
+}
+
+func recordImportResult(ctx context.Context, result *ImportResult) {
+	const task = "import"
+
+	tracing.RecordMessages(ctx, task, "imported", toUint64(result.ImportedCount))
+	tracing.RecordMessages(ctx, task, "failed", toUint64(result.FailedCount))
+	tracing.RecordBytes(ctx, task, result.BytesTransferred)
+}
+
+func toUint64(count int64) uint64 {
+	if count < 0 {
+		return 0
+	}
+
+	return uint64(count)
+}
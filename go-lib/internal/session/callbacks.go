@@ -17,9 +17,12 @@
 
 package session
 
+import "time"
+
 type Callbacks interface {
 	OnNetworkRestored()
 	OnNetworkLost()
+	OnClockSkew(skew time.Duration)
 }
 
 type NullCallbacks struct{}
@@ -27,3 +30,5 @@ type NullCallbacks struct{}
 func (n NullCallbacks) OnNetworkRestored() {}
 
 func (n NullCallbacks) OnNetworkLost() {}
+
+func (n NullCallbacks) OnClockSkew(_ time.Duration) {}
@@ -0,0 +1,137 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+)
+
+// FIDO2Challenge is what a security key signs to complete the login. AuthenticationOptions are the WebAuthn
+// PublicKeyCredentialRequestOptions sent by the server, with the challenge and the relying party ID, they are passed
+// as is to the WebAuthn implementation, e.g. libfido2 or a browser.
+type FIDO2Challenge struct {
+	AuthenticationOptions any
+	RegisteredKeys        []proton.RegisteredKey
+}
+
+// FIDO2Assertion is the WebAuthn assertion produced by a security key for a FIDO2Challenge. The fields are the raw
+// bytes, base64 encoded in JSON.
+type FIDO2Assertion struct {
+	ClientData        []byte // The client data JSON.
+	AuthenticatorData []byte
+	Signature         []byte
+	CredentialID      []byte
+}
+
+// FIDO2Provider asks a security key to sign the challenge of the login. When it is set, Login completes the second
+// factor with it for the accounts without TOTP, or when no TOTPProvider is set.
+type FIDO2Provider func(ctx context.Context, challenge FIDO2Challenge) (FIDO2Assertion, error)
+
+// SetFIDO2Provider sets the provider of the security key assertions used by Login, nil to wait for SubmitFIDO2.
+func (s *Session) SetFIDO2Provider(provider FIDO2Provider) {
+	s.fido2Provider = provider
+}
+
+// GetFIDO2Challenge returns the challenge to sign with a security key, when the account has one and the login awaits
+// its second factor.
+func (s *Session) GetFIDO2Challenge() (FIDO2Challenge, error) {
+	if !s.HasFIDO2() {
+		return FIDO2Challenge{}, ErrInvalidLoginState
+	}
+
+	return *s.fido2, nil
+}
+
+// SubmitFIDO2 submits the assertion of a security key for the challenge returned by GetFIDO2Challenge.
+func (s *Session) SubmitFIDO2(ctx context.Context, assertion FIDO2Assertion) error {
+	if !s.HasFIDO2() {
+		return ErrInvalidLoginState
+	}
+
+	logrus.Debugf("Submitting FIDO2 assertion")
+
+	if err := s.client.Auth2FA(ctx, proton.Auth2FAReq{FIDO2: proton.FIDO2Req{
+		AuthenticationOptions: s.fido2.AuthenticationOptions,
+		ClientData:            base64.StdEncoding.EncodeToString(assertion.ClientData),
+		AuthenticatorData:     base64.StdEncoding.EncodeToString(assertion.AuthenticatorData),
+		Signature:             base64.StdEncoding.EncodeToString(assertion.Signature),
+		CredentialID:          base64.StdEncoding.EncodeToString(assertion.CredentialID),
+	}}); err != nil {
+		logrus.WithError(err).Error("Failed to submit FIDO2 assertion")
+		return err
+	}
+
+	return s.onSecondFactorAccepted(ctx)
+}
+
+// HasFIDO2 returns whether the login awaits a second factor that a security key can complete.
+func (s *Session) HasFIDO2() bool {
+	return s.fido2 != nil && (s.loginState == LoginStateAwaitingTOTP || s.loginState == LoginStateAwaitingFIDO2)
+}
+
+func (s *Session) submitProvidedFIDO2(ctx context.Context) error {
+	assertion, err := s.fido2Provider(ctx, *s.fido2)
+	if err != nil {
+		return fmt.Errorf("failed to get security key assertion: %w", err)
+	}
+
+	if err := s.SubmitFIDO2(ctx, assertion); err != nil {
+		return fmt.Errorf("failed to submit security key assertion: %w", err)
+	}
+
+	return nil
+}
+
+// NewFIDO2CommandProvider returns a FIDO2Provider delegating the signature to a program, e.g. a script around libfido2.
+// The program reads the FIDO2Challenge as JSON on its standard input and writes the FIDO2Assertion as JSON, with
+// base64 fields, on its standard output. Its error output is shown to the user, a PIN must be read from the terminal.
+func NewFIDO2CommandProvider(name string, args ...string) FIDO2Provider {
+	return func(ctx context.Context, challenge FIDO2Challenge) (FIDO2Assertion, error) {
+		input, err := json.Marshal(challenge)
+		if err != nil {
+			return FIDO2Assertion{}, err
+		}
+
+		var output bytes.Buffer
+
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stdout = &output
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			return FIDO2Assertion{}, fmt.Errorf("security key command failed: %w", err)
+		}
+
+		var assertion FIDO2Assertion
+		if err := json.Unmarshal(output.Bytes(), &assertion); err != nil {
+			return FIDO2Assertion{}, fmt.Errorf("invalid output of security key command: %w", err)
+		}
+
+		return assertion, nil
+	}
+}
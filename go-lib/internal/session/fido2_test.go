@@ -0,0 +1,113 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/export-tool/internal/reporter"
+	"github.com/ProtonMail/gluon/async"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestSessionLogin_FIDO2(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+
+	client := apiclient.NewMockClient(mockCtrl)
+	clientBuilder := apiclient.NewMockBuilder(mockCtrl)
+	options := map[string]any{"publicKey": map[string]any{"challenge": "abc"}}
+	clientAuth := proton.Auth{
+		TwoFA: proton.TwoFAInfo{
+			Enabled: proton.HasFIDO2,
+			FIDO2:   proton.FIDO2Info{AuthenticationOptions: options},
+		},
+	}
+
+	clientBuilder.EXPECT().NewClient(gomock.Any(), gomock.Eq(TestUserEmail), gomock.Eq(TestUserPassword), gomock.Any()).Return(
+		client,
+		clientAuth,
+		nil,
+	)
+	clientBuilder.EXPECT().Close()
+	client.EXPECT().Auth2FA(gomock.Any(), gomock.Eq(proton.Auth2FAReq{FIDO2: proton.FIDO2Req{
+		AuthenticationOptions: options,
+		ClientData:            "Y2xpZW50",
+		AuthenticatorData:     "YXV0aA==",
+		Signature:             "c2ln",
+		CredentialID:          "aWQ=",
+	}})).Return(nil)
+	client.EXPECT().GetUserWithHV(gomock.Any(), gomock.Any()).Return(proton.User{}, nil)
+	client.EXPECT().GetSalts(gomock.Any()).Return(proton.Salts{}, nil)
+	client.EXPECT().GetUserSettings(gomock.Any()).Return(proton.UserSettings{}, nil)
+	client.EXPECT().GetOrganizationData(gomock.Any()).Return(proton.OrganizationResponse{}, nil)
+	client.EXPECT().AuthDelete(gomock.Any()).Return(nil)
+	client.EXPECT().Close()
+
+	ctx := context.Background()
+	session := NewSession(clientBuilder, nil, &async.NoopPanicHandler{}, &reporter.NullReporter{}, false)
+	defer session.Close(ctx)
+
+	require.NoError(t, session.Login(ctx, TestUserEmail, TestUserPassword))
+	require.Equal(t, LoginStateAwaitingFIDO2, session.LoginState())
+	require.ErrorIs(t, session.SubmitTOTP(ctx, "123456"), ErrInvalidLoginState)
+
+	challenge, err := session.GetFIDO2Challenge()
+	require.NoError(t, err)
+	require.Equal(t, options, challenge.AuthenticationOptions)
+
+	require.NoError(t, session.SubmitFIDO2(ctx, FIDO2Assertion{
+		ClientData:        []byte("client"),
+		AuthenticatorData: []byte("auth"),
+		Signature:         []byte("sig"),
+		CredentialID:      []byte("id"),
+	}))
+	require.Equal(t, LoginStateLoggedIn, session.LoginState())
+	require.False(t, session.HasFIDO2())
+}
+
+func TestSessionLogin_TOTPWithoutFIDO2(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+
+	client := apiclient.NewMockClient(mockCtrl)
+	clientBuilder := apiclient.NewMockBuilder(mockCtrl)
+	clientAuth := proton.Auth{TwoFA: proton.TwoFAInfo{Enabled: proton.HasTOTP}}
+
+	clientBuilder.EXPECT().NewClient(gomock.Any(), gomock.Eq(TestUserEmail), gomock.Eq(TestUserPassword), gomock.Any()).Return(
+		client,
+		clientAuth,
+		nil,
+	)
+	clientBuilder.EXPECT().Close()
+	client.EXPECT().AuthDelete(gomock.Any()).Return(nil)
+	client.EXPECT().Close()
+
+	ctx := context.Background()
+	session := NewSession(clientBuilder, nil, &async.NoopPanicHandler{}, &reporter.NullReporter{}, false)
+	defer session.Close(ctx)
+
+	require.NoError(t, session.Login(ctx, TestUserEmail, TestUserPassword))
+	require.Equal(t, LoginStateAwaitingTOTP, session.LoginState())
+	require.False(t, session.HasFIDO2())
+
+	_, err := session.GetFIDO2Challenge()
+	require.ErrorIs(t, err, ErrInvalidLoginState)
+}
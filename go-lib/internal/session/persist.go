@@ -0,0 +1,219 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/export-tool/internal/keychain"
+	"github.com/ProtonMail/export-tool/internal/utils"
+	"github.com/ProtonMail/export-tool/internal/vault"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/sirupsen/logrus"
+)
+
+// PersistedSessionVersion 1 stored the mailbox password, which is the login password of single password accounts.
+const PersistedSessionVersion = 2
+
+var ErrPersistedSessionUserMismatch = errors.New("the persisted session belongs to another user")
+
+// PersistedSession lets a later run resume a session without the password and the second factor, see Resume. Only the
+// salted passphrase of the user key is kept to unlock the keys of the account, never a password. It must still be
+// stored encrypted, see SavePersistedSession.
+type PersistedSession struct {
+	UserID        string
+	Email         string
+	UID           string
+	RefreshToken  string
+	SaltedKeyPass []byte
+}
+
+// SetPersistent keeps the session open on the server when it is closed, so that it can be resumed by a later run with
+// GetPersistedSession and Resume. It must be set before logging in.
+func (s *Session) SetPersistent(persistent bool) {
+	s.persistent = persistent
+}
+
+// SetPersistedSessionHandler calls handler with the new tokens each time a logged in persistent session is refreshed,
+// so that they can be saved.
+func (s *Session) SetPersistedSessionHandler(handler func(PersistedSession)) {
+	s.persistedHandler = handler
+}
+
+// trackAuth records the tokens of a persistent session, which change each time the session is refreshed.
+func (s *Session) trackAuth(client apiclient.Client, auth proton.Auth) {
+	if !s.persistent {
+		return
+	}
+
+	s.setAuth(auth)
+	client.AddAuthHandler(s.setAuth)
+}
+
+func (s *Session) setAuth(auth proton.Auth) {
+	s.authLock.Lock()
+	s.auth = auth
+	s.authLock.Unlock()
+
+	if s.persistedHandler == nil {
+		return
+	}
+
+	if persisted, err := s.GetPersistedSession(); err == nil {
+		s.persistedHandler(persisted)
+	}
+}
+
+// GetPersistedSession returns what resumes the session in a later run. The refresh token is replaced while the session
+// is in use, it must be saved when the run ends.
+func (s *Session) GetPersistedSession() (PersistedSession, error) {
+	if !s.persistent || s.loginState != LoginStateLoggedIn {
+		return PersistedSession{}, ErrInvalidLoginState
+	}
+
+	saltedKeyPass, err := s.GetSaltedKeyPass()
+	if err != nil {
+		return PersistedSession{}, fmt.Errorf("failed to salt key password: %w", err)
+	}
+
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+
+	return PersistedSession{
+		UserID:        s.user.ID,
+		Email:         s.user.Email,
+		UID:           s.auth.UID,
+		RefreshToken:  s.auth.RefreshToken,
+		SaltedKeyPass: append([]byte(nil), saltedKeyPass...),
+	}, nil
+}
+
+// Resume logs in with a session persisted by a previous run. The session is persistent.
+func (s *Session) Resume(ctx context.Context, persisted PersistedSession) error {
+	if s.loginState != LoginStateLoggedOut {
+		return ErrInvalidLoginState
+	}
+
+	logrus.Debugf("Resuming session")
+
+	client, auth, err := s.clientBuilder.NewClientWithRefresh(ctx, persisted.UID, persisted.RefreshToken)
+	if err != nil {
+		return fmt.Errorf("failed to resume session: %w", err)
+	}
+
+	s.persistent = true
+	s.client = apiclient.NewAutoRetryClient(client, &apiclient.SleepRetryStrategyBuilder{})
+	s.trackAuth(s.client, auth)
+	s.setSaltedKeyPass(append([]byte(nil), persisted.SaltedKeyPass...))
+	s.scopes = DescribeScopes(auth.Scope)
+	s.loginState = LoginStateLoggedIn
+
+	err = s.loadUser(ctx)
+	if err == nil && len(persisted.UserID) != 0 && s.user.ID != persisted.UserID {
+		err = ErrPersistedSessionUserMismatch
+	}
+
+	if err != nil {
+		// The tokens are still valid, the session must not be closed on the server.
+		s.client.Close()
+		s.client = nil
+		s.loginState = LoginStateLoggedOut
+		s.setSaltedKeyPass(nil)
+		s.scopes = nil
+
+		return fmt.Errorf("failed to resume session: %w", err)
+	}
+
+	return nil
+}
+
+// SavePersistedSession writes a persisted session to a file only readable by the current user, sealed with the vault
+// of the local files.
+func SavePersistedSession(path string, persisted PersistedSession, v *vault.Vault) error {
+	if v == nil {
+		return vault.ErrLocked
+	}
+
+	b, err := utils.GenerateVersionedJSON(PersistedSessionVersion, persisted)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := vault.Encode(v, b)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt session: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create session directory: %w", err)
+	}
+
+	return utils.WriteFileSafe(filepath.Dir(path), path, sealed, nil)
+}
+
+// LoadPersistedSession reads a session saved by SavePersistedSession.
+func LoadPersistedSession(path string, v *vault.Vault) (PersistedSession, error) {
+	sealed, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return PersistedSession{}, fmt.Errorf("failed to read session: %w", err)
+	}
+
+	b, err := vault.Decode(v, sealed)
+	if err != nil {
+		return PersistedSession{}, fmt.Errorf("failed to decrypt session: %w", err)
+	}
+
+	persisted, err := utils.NewVersionedJSON[PersistedSession](PersistedSessionVersion, b)
+	if err != nil {
+		return PersistedSession{}, fmt.Errorf("failed to parse session: %w", err)
+	}
+
+	return persisted.Payload, nil
+}
+
+// SavePersistedSessionToKeychain stores a persisted session in the keychain of the operating system instead of a file,
+// the CLI and the GUI share it.
+func SavePersistedSessionToKeychain(store keychain.Store, persisted PersistedSession) error {
+	b, err := utils.GenerateVersionedJSON(PersistedSessionVersion, persisted)
+	if err != nil {
+		return err
+	}
+
+	return store.Set(keychain.ItemSession, b)
+}
+
+// LoadPersistedSessionFromKeychain reads a session saved by SavePersistedSessionToKeychain, keychain.ErrNotFound if
+// there is none.
+func LoadPersistedSessionFromKeychain(store keychain.Store) (PersistedSession, error) {
+	b, err := store.Get(keychain.ItemSession)
+	if err != nil {
+		return PersistedSession{}, err
+	}
+
+	persisted, err := utils.NewVersionedJSON[PersistedSession](PersistedSessionVersion, b)
+	if err != nil {
+		return PersistedSession{}, fmt.Errorf("failed to parse session: %w", err)
+	}
+
+	return persisted.Payload, nil
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/export-tool/internal/keychain"
+	"github.com/ProtonMail/export-tool/internal/reporter"
+	"github.com/ProtonMail/export-tool/internal/vault"
+	"github.com/ProtonMail/gluon/async"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestPersistedSession_SaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "session", "session.json")
+	persisted := PersistedSession{
+		UserID:        "user-id",
+		Email:         TestUserEmail,
+		UID:           "uid",
+		RefreshToken:  "refresh",
+		SaltedKeyPass: []byte("salted-key-pass"),
+	}
+
+	require.ErrorIs(t, SavePersistedSession(path, persisted, nil), vault.ErrLocked)
+
+	v, err := vault.Open(dir, []byte("passphrase"))
+	require.NoError(t, err)
+
+	require.NoError(t, SavePersistedSession(path, persisted, v))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "refresh")
+	require.NotContains(t, string(b), TestUserEmail)
+
+	loaded, err := LoadPersistedSession(path, v)
+	require.NoError(t, err)
+	require.Equal(t, persisted, loaded)
+
+	_, err = LoadPersistedSession(path, nil)
+	require.ErrorIs(t, err, vault.ErrLocked)
+}
+
+type memoryKeychain map[string][]byte
+
+func (m memoryKeychain) Get(name string) ([]byte, error) {
+	secret, ok := m[name]
+	if !ok {
+		return nil, keychain.ErrNotFound
+	}
+
+	return secret, nil
+}
+
+func (m memoryKeychain) Set(name string, secret []byte) error {
+	m[name] = secret
+	return nil
+}
+
+func (m memoryKeychain) Delete(name string) error {
+	delete(m, name)
+	return nil
+}
+
+func TestPersistedSession_Keychain(t *testing.T) {
+	store := memoryKeychain{}
+
+	_, err := LoadPersistedSessionFromKeychain(store)
+	require.ErrorIs(t, err, keychain.ErrNotFound)
+
+	persisted := PersistedSession{UserID: "user-id", UID: "uid", RefreshToken: "refresh", SaltedKeyPass: []byte("salted-key-pass")}
+	require.NoError(t, SavePersistedSessionToKeychain(store, persisted))
+
+	loaded, err := LoadPersistedSessionFromKeychain(store)
+	require.NoError(t, err)
+	require.Equal(t, persisted, loaded)
+}
+
+func TestSessionResume_KeepsSessionOpen(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+
+	client := apiclient.NewMockClient(mockCtrl)
+	clientBuilder := apiclient.NewMockBuilder(mockCtrl)
+
+	var authHandler proton.AuthHandler
+
+	clientBuilder.EXPECT().NewClientWithRefresh(gomock.Any(), gomock.Eq("uid"), gomock.Eq("refresh")).Return(
+		client,
+		proton.Auth{UID: "uid", RefreshToken: "refresh-2"},
+		nil,
+	)
+	clientBuilder.EXPECT().Close()
+	client.EXPECT().AddAuthHandler(gomock.Any()).Do(func(handler proton.AuthHandler) { authHandler = handler })
+	client.EXPECT().GetUserWithHV(gomock.Any(), gomock.Any()).Return(proton.User{ID: "user-id", Email: TestUserEmail}, nil)
+	client.EXPECT().GetSalts(gomock.Any()).Return(proton.Salts{}, nil)
+	client.EXPECT().GetUserSettings(gomock.Any()).Return(proton.UserSettings{}, nil)
+	client.EXPECT().GetOrganizationData(gomock.Any()).Return(proton.OrganizationResponse{}, nil)
+	client.EXPECT().Close()
+
+	ctx := context.Background()
+	session := NewSession(clientBuilder, nil, &async.NoopPanicHandler{}, &reporter.NullReporter{}, false)
+	defer session.Close(ctx)
+
+	require.NoError(t, session.Resume(ctx, PersistedSession{
+		UserID:        "user-id",
+		UID:           "uid",
+		RefreshToken:  "refresh",
+		SaltedKeyPass: []byte("salted-key-pass"),
+	}))
+	require.Nil(t, session.GetMailboxPassword())
+	require.Equal(t, LoginStateLoggedIn, session.LoginState())
+
+	var saved PersistedSession
+
+	session.SetPersistedSessionHandler(func(persisted PersistedSession) { saved = persisted })
+	authHandler(proton.Auth{UID: "uid", RefreshToken: "refresh-3"})
+
+	require.Equal(t, PersistedSession{
+		UserID:        "user-id",
+		Email:         TestUserEmail,
+		UID:           "uid",
+		RefreshToken:  "refresh-3",
+		SaltedKeyPass: []byte("salted-key-pass"),
+	}, saved)
+}
+
+func TestSessionResume_OtherUserIsError(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+
+	client := apiclient.NewMockClient(mockCtrl)
+	clientBuilder := apiclient.NewMockBuilder(mockCtrl)
+
+	clientBuilder.EXPECT().NewClientWithRefresh(gomock.Any(), gomock.Any(), gomock.Any()).Return(client, proton.Auth{}, nil)
+	clientBuilder.EXPECT().Close()
+	client.EXPECT().AddAuthHandler(gomock.Any())
+	client.EXPECT().GetUserWithHV(gomock.Any(), gomock.Any()).Return(proton.User{ID: "other-id"}, nil)
+	client.EXPECT().GetSalts(gomock.Any()).Return(proton.Salts{}, nil)
+	client.EXPECT().GetUserSettings(gomock.Any()).Return(proton.UserSettings{}, nil)
+	client.EXPECT().GetOrganizationData(gomock.Any()).Return(proton.OrganizationResponse{}, nil)
+	client.EXPECT().Close()
+
+	ctx := context.Background()
+	session := NewSession(clientBuilder, nil, &async.NoopPanicHandler{}, &reporter.NullReporter{}, false)
+	defer session.Close(ctx)
+
+	err := session.Resume(ctx, PersistedSession{UserID: "user-id"})
+	require.ErrorIs(t, err, ErrPersistedSessionUserMismatch)
+	require.Equal(t, LoginStateLoggedOut, session.LoginState())
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scope is a permission the server grants to a session, with a description users can understand.
+type Scope struct {
+	Name        string
+	Description string
+}
+
+// scopeDescriptions describes the scopes the API can grant. Unknown scopes are still shown, see DescribeScopes.
+var scopeDescriptions = map[string]string{ //nolint:gochecknoglobals
+	"full":          "Full access to the account, including changing its settings and keys",
+	"self":          "Read and modify the user profile and account settings",
+	"user":          "Access the user profile",
+	"loggedin":      "Perform the actions available to any logged in user",
+	"nondelinquent": "Perform the actions available to accounts without unpaid invoices",
+	"verified":      "Perform the actions available to verified accounts",
+	"settings":      "Read and modify the account settings",
+	"keys":          "Read the encryption keys of the account",
+	"mail":          "Read, import, label and delete messages",
+	"contacts":      "Read and modify contacts",
+	"calendar":      "Read and modify calendars",
+	"drive":         "Read and modify Drive files",
+	"pass":          "Read and modify Pass vaults",
+	"vpn":           "Access the VPN",
+	"payments":      "Read the subscription and payment methods",
+	"organization":  "Manage the organization the account belongs to",
+	"parent":        "Manage the sub-accounts of the organization",
+	"password":      "Change the account password",
+	"locked":        "Change sensitive settings, only granted shortly after entering the password",
+	"twofactor":     "Submit the second authentication factor, nothing else until it is accepted",
+}
+
+// DescribeScopes returns the space separated scopes granted at login with their description, in the order given.
+func DescribeScopes(scopes string) []Scope {
+	names := strings.Fields(scopes)
+	result := make([]Scope, 0, len(names))
+
+	for _, name := range names {
+		description, ok := scopeDescriptions[strings.ToLower(name)]
+		if !ok {
+			description = "Not documented by the export tool"
+		}
+
+		result = append(result, Scope{Name: name, Description: description})
+	}
+
+	return result
+}
+
+// FormatScopes returns the scopes as one indented 'name: description' line each.
+func FormatScopes(scopes []Scope) string {
+	var builder strings.Builder
+
+	for _, scope := range scopes {
+		_, _ = fmt.Fprintf(&builder, "  %v: %v\n", scope.Name, scope.Description)
+	}
+
+	return builder.String()
+}
@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/ProtonMail/export-tool/internal/apiclient"
 	"github.com/ProtonMail/export-tool/internal/reporter"
@@ -41,6 +42,7 @@ const (
 	LoginStateAwaitingMailboxPassword
 	LoginStateAwaitingHV
 	LoginStateLoggedIn
+	LoginStateAwaitingFIDO2 // The account only has security keys as second factor, see SubmitFIDO2.
 )
 
 type Session struct {
@@ -51,12 +53,21 @@ type Session struct {
 	prevLoginState   LoginState
 	passwordMode     proton.PasswordMode
 	mailboxPassword  []byte
+	saltedKeyPass    []byte // Set instead of the mailbox password when the session was resumed, see Resume.
 	callbacks        Callbacks
 	reporter         reporter.Reporter
 	hvDetails        *proton.APIHVDetails
 	user             proton.User
 	userSalts        proton.Salts
+	scopes           []Scope
 	telemetryService *telemetry.Service
+	totpProvider     TOTPProvider
+	fido2Provider    FIDO2Provider
+	fido2            *FIDO2Challenge // Set while a security key can complete the login.
+	persistent       bool
+	authLock         sync.Mutex
+	auth             proton.Auth // Latest tokens of a persistent session, see trackAuth.
+	persistedHandler func(PersistedSession)
 }
 
 func NewSession(
@@ -82,14 +93,18 @@ func (s *Session) Close(ctx context.Context) {
 	defer async.HandlePanic(s.panicHandler)
 
 	if s.client != nil {
-		if err := s.Logout(ctx); err != nil {
-			logrus.WithError(err).Error("Failed to logout")
+		// A persistent session stays open on the server, to be resumed by the next run.
+		if !s.persistent || s.loginState != LoginStateLoggedIn {
+			if err := s.Logout(ctx); err != nil {
+				logrus.WithError(err).Error("Failed to logout")
+			}
 		}
 
 		s.client.Close()
 	}
 	s.clientBuilder.Close()
 	s.setMailboxPassword(nil)
+	s.setSaltedKeyPass(nil)
 }
 
 func (s *Session) Login(ctx context.Context, email string, password []byte) error {
@@ -115,11 +130,35 @@ func (s *Session) Login(ctx context.Context, email string, password []byte) erro
 
 	client = apiclient.NewAutoRetryClient(client, &apiclient.SleepRetryStrategyBuilder{})
 	s.client = client
+	s.trackAuth(client, auth)
 	s.setMailboxPassword(password)
 	s.passwordMode = auth.PasswordMode
+	s.scopes = DescribeScopes(auth.Scope)
+
+	if auth.TwoFA.Enabled&(proton.HasTOTP|proton.HasFIDO2) != 0 {
+		s.fido2 = nil
+		if auth.TwoFA.Enabled&proton.HasFIDO2 != 0 {
+			s.fido2 = &FIDO2Challenge{
+				AuthenticationOptions: auth.TwoFA.FIDO2.AuthenticationOptions,
+				RegisteredKeys:        auth.TwoFA.FIDO2.RegisteredKeys,
+			}
+		}
+
+		hasTOTP := auth.TwoFA.Enabled&proton.HasTOTP != 0
+		if hasTOTP {
+			s.loginState = LoginStateAwaitingTOTP
+		} else {
+			s.loginState = LoginStateAwaitingFIDO2
+		}
+
+		// On error, the session stays awaiting the second factor so that it can still be submitted.
+		switch {
+		case hasTOTP && s.totpProvider != nil:
+			return s.submitProvidedTOTP(ctx)
+		case s.fido2 != nil && s.fido2Provider != nil:
+			return s.submitProvidedFIDO2(ctx)
+		}
 
-	if auth.TwoFA.Enabled&proton.HasTOTP != 0 {
-		s.loginState = LoginStateAwaitingTOTP
 		return nil
 	}
 
@@ -157,6 +196,8 @@ func (s *Session) Logout(ctx context.Context) error {
 	s.loginState = LoginStateLoggedOut
 	s.prevLoginState = LoginStateLoggedOut
 	s.setMailboxPassword(nil)
+	s.scopes = nil
+	s.fido2 = nil
 
 	return nil
 }
@@ -173,6 +214,13 @@ func (s *Session) SubmitTOTP(ctx context.Context, totp string) error {
 		return err
 	}
 
+	return s.onSecondFactorAccepted(ctx)
+}
+
+// onSecondFactorAccepted continues the login once the TOTP code or the security key was accepted.
+func (s *Session) onSecondFactorAccepted(ctx context.Context) error {
+	s.fido2 = nil
+
 	if s.passwordMode == proton.TwoPasswordMode {
 		s.loginState = LoginStateAwaitingMailboxPassword
 	} else {
@@ -237,6 +285,13 @@ func (s *Session) LoginState() LoginState {
 	return s.loginState
 }
 
+// GetScopes returns the permissions granted to the session when the password was accepted. They are known before
+// the second factor and the mailbox password are submitted. With two-factor authentication enabled, the server only
+// grants the remaining scopes once the second factor is accepted.
+func (s *Session) GetScopes() []Scope {
+	return s.scopes
+}
+
 func (s *Session) GetClient() apiclient.Client {
 	return s.client
 }
@@ -245,6 +300,20 @@ func (s *Session) GetMailboxPassword() []byte {
 	return s.mailboxPassword
 }
 
+// GetSaltedKeyPass returns the passphrase unlocking the primary key of the user. A resumed session only knows this
+// passphrase, not the mailbox password.
+func (s *Session) GetSaltedKeyPass() ([]byte, error) {
+	if s.saltedKeyPass != nil {
+		return s.saltedKeyPass, nil
+	}
+
+	if len(s.user.Keys) == 0 {
+		return nil, errors.New("the user has no keys")
+	}
+
+	return s.userSalts.SaltForKey(s.mailboxPassword, s.user.Keys.Primary().ID)
+}
+
 func (s *Session) GetPanicHandler() async.PanicHandler {
 	return s.panicHandler
 }
@@ -288,6 +357,14 @@ func (s *Session) setMailboxPassword(p []byte) {
 	s.mailboxPassword = p
 }
 
+func (s *Session) setSaltedKeyPass(p []byte) {
+	if s.saltedKeyPass != nil {
+		zeroSlice(s.saltedKeyPass)
+	}
+
+	s.saltedKeyPass = p
+}
+
 func (s *Session) loadUser(ctx context.Context) error {
 	logrus.Debug("Getting user info")
 	u, err := s.client.GetUserWithHV(ctx, s.hvDetails)
@@ -25,6 +25,7 @@ import (
 	"github.com/ProtonMail/export-tool/internal/reporter"
 	"github.com/ProtonMail/gluon/async"
 	"github.com/ProtonMail/go-proton-api"
+	"github.com/bradenaw/juniper/xslices"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/mock/gomock"
 )
@@ -281,3 +282,40 @@ type AlwaysValidMailboxPasswordValidator struct{}
 func (a AlwaysValidMailboxPasswordValidator) IsValid(_ []byte) bool {
 	return true
 }
+
+func TestSessionLogin_Scopes(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+
+	client := apiclient.NewMockClient(mockCtrl)
+	clientBuilder := apiclient.NewMockBuilder(mockCtrl)
+	clientAuth := proton.Auth{
+		Scope: "full self mail unknown",
+		TwoFA: proton.TwoFAInfo{
+			Enabled: proton.HasTOTP,
+		},
+	}
+
+	clientBuilder.EXPECT().NewClient(gomock.Any(), gomock.Eq(TestUserEmail), gomock.Eq(TestUserPassword), gomock.Any()).Return(
+		client,
+		clientAuth,
+		nil,
+	)
+	clientBuilder.EXPECT().Close()
+	client.EXPECT().AuthDelete(gomock.Any()).Return(nil)
+	client.EXPECT().Close()
+
+	ctx := context.Background()
+	session := NewSession(clientBuilder, nil, &async.NoopPanicHandler{}, &reporter.NullReporter{}, false)
+	defer session.Close(ctx)
+
+	require.Empty(t, session.GetScopes())
+
+	require.NoError(t, session.Login(ctx, TestUserEmail, TestUserPassword))
+	require.Equal(t, LoginStateAwaitingTOTP, session.LoginState())
+
+	scopes := session.GetScopes()
+	require.Equal(t, []string{"full", "self", "mail", "unknown"}, xslices.Map(scopes, func(s Scope) string { return s.Name }))
+	require.Equal(t, scopeDescriptions["mail"], scopes[2].Description)
+	require.NotEmpty(t, scopes[3].Description)
+	require.Contains(t, FormatScopes(scopes), "  mail: "+scopeDescriptions["mail"]+"\n")
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1" //nolint:gosec
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TOTPProvider returns the current code of the authenticator app of the account. When it is set, Login submits the
+// code itself instead of stopping in LoginStateAwaitingTOTP.
+type TOTPProvider func(ctx context.Context) (string, error)
+
+var ErrInvalidTOTPSecret = errors.New("invalid TOTP secret")
+
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+)
+
+// GenerateTOTP computes the code of a TOTP secret at the given time, as described by RFC 6238 with the parameters of
+// the Proton accounts: SHA-1, 6 digits and 30 second periods. The secret is the base32 key shown when the
+// authenticator app is set up, spaces and padding are ignored.
+func GenerateTOTP(secret string, at time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(at.Unix()/int64(totpPeriod/time.Second)))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// NewTOTPSecretProvider returns a TOTPProvider computing the codes of a TOTP secret.
+func NewTOTPSecretProvider(secret string) (TOTPProvider, error) {
+	if _, err := decodeTOTPSecret(secret); err != nil {
+		return nil, err
+	}
+
+	return func(context.Context) (string, error) {
+		return GenerateTOTP(secret, time.Now())
+	}, nil
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "="))
+	if len(secret) == 0 {
+		return nil, ErrInvalidTOTPSecret
+	}
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTOTPSecret, err)
+	}
+
+	return key, nil
+}
+
+// SetTOTPProvider sets the provider of the TOTP codes used by Login, nil to wait for SubmitTOTP.
+func (s *Session) SetTOTPProvider(provider TOTPProvider) {
+	s.totpProvider = provider
+}
+
+func (s *Session) submitProvidedTOTP(ctx context.Context) error {
+	code, err := s.totpProvider(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get TOTP code: %w", err)
+	}
+
+	if err := s.SubmitTOTP(ctx, code); err != nil {
+		return fmt.Errorf("failed to submit TOTP code: %w", err)
+	}
+
+	return nil
+}
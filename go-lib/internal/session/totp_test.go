@@ -0,0 +1,96 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal/apiclient"
+	"github.com/ProtonMail/export-tool/internal/reporter"
+	"github.com/ProtonMail/gluon/async"
+	"github.com/ProtonMail/go-proton-api"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestGenerateTOTP(t *testing.T) {
+	// Test vectors of RFC 6238, truncated to 6 digits.
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	for at, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		totp, err := GenerateTOTP(secret, time.Unix(at, 0))
+		require.NoError(t, err)
+		require.Equal(t, code, totp)
+	}
+
+	totp, err := GenerateTOTP("gezd gnbv gy3t qojq gezd gnbv gy3t qojq", time.Unix(59, 0))
+	require.NoError(t, err)
+	require.Equal(t, "287082", totp)
+
+	_, err = GenerateTOTP("not base32!", time.Now())
+	require.ErrorIs(t, err, ErrInvalidTOTPSecret)
+
+	_, err = NewTOTPSecretProvider("")
+	require.ErrorIs(t, err, ErrInvalidTOTPSecret)
+}
+
+func TestSessionLogin_TOTPProvider(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+
+	client := apiclient.NewMockClient(mockCtrl)
+	clientBuilder := apiclient.NewMockBuilder(mockCtrl)
+	clientAuth := proton.Auth{
+		TwoFA: proton.TwoFAInfo{
+			Enabled: proton.HasTOTP,
+		},
+	}
+
+	const totpCode = "123456"
+
+	clientBuilder.EXPECT().NewClient(gomock.Any(), gomock.Eq(TestUserEmail), gomock.Eq(TestUserPassword), gomock.Any()).Return(
+		client,
+		clientAuth,
+		nil,
+	)
+	clientBuilder.EXPECT().Close()
+	client.EXPECT().Auth2FA(gomock.Any(), gomock.Eq(proton.Auth2FAReq{TwoFactorCode: totpCode})).Return(nil)
+	client.EXPECT().GetUserWithHV(gomock.Any(), gomock.Any()).Return(proton.User{}, nil)
+	client.EXPECT().GetSalts(gomock.Any()).Return(proton.Salts{}, nil)
+	client.EXPECT().GetUserSettings(gomock.Any()).Return(proton.UserSettings{}, nil)
+	client.EXPECT().GetOrganizationData(gomock.Any()).Return(proton.OrganizationResponse{}, nil)
+	client.EXPECT().AuthDelete(gomock.Any()).Return(nil)
+	client.EXPECT().Close()
+
+	ctx := context.Background()
+	session := NewSession(clientBuilder, nil, &async.NoopPanicHandler{}, &reporter.NullReporter{}, false)
+	defer session.Close(ctx)
+
+	session.SetTOTPProvider(func(context.Context) (string, error) {
+		return totpCode, nil
+	})
+
+	require.NoError(t, session.Login(ctx, TestUserEmail, TestUserPassword))
+	require.Equal(t, LoginStateLoggedIn, session.LoginState())
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package tracing instruments the API client and the tasks with OpenTelemetry spans and metrics. They are sent to the
+// global providers of the otel package, which discard them unless the application embedding go-lib installs its own
+// providers with otel.SetTracerProvider and otel.SetMeterProvider.
+//
+// The trace context is never propagated to the Proton servers: no tracing header is added to the API requests.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/export-tool/internal"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName is the name of the tracer and meter of go-lib.
+const InstrumentationName = "github.com/ProtonMail/export-tool"
+
+// Attribute keys of the spans and metrics.
+const (
+	TaskKey      = attribute.Key("export_tool.task")
+	StageKey     = attribute.Key("export_tool.stage")
+	OutcomeKey   = attribute.Key("export_tool.outcome")
+	MethodKey    = attribute.Key("http.request.method")
+	StatusKey    = attribute.Key("http.response.status_code")
+	ServerKey    = attribute.Key("server.address")
+	ErrorTypeKey = attribute.Key("error.type")
+)
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(InstrumentationName, trace.WithInstrumentationVersion(internal.ETVersionString))
+}
+
+// StartTask starts the span of a task. The spans of its stages and API requests are its children when they use the
+// returned context.
+func StartTask(ctx context.Context, task string) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, task, trace.WithAttributes(TaskKey.String(task)))
+}
+
+// StartStage starts the span of a stage of a task.
+func StartStage(ctx context.Context, stage string) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, stage, trace.WithAttributes(StageKey.String(stage)))
+}
+
+// End records err on span and ends it. A cancellation is not an error.
+func End(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, context.Canceled) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+type instruments struct {
+	requestCount    metric.Int64Counter
+	requestDuration metric.Float64Histogram
+	stageDuration   metric.Float64Histogram
+	messageCount    metric.Int64Counter
+	bytes           metric.Int64Counter
+}
+
+//nolint:gochecknoglobals
+var (
+	instrumentsOnce  sync.Once
+	meterInstruments instruments
+)
+
+// getInstruments creates the instruments once. The global meter provider forwards them to the provider installed
+// later by the embedding application.
+func getInstruments() *instruments {
+	instrumentsOnce.Do(func() {
+		meter := otel.Meter(InstrumentationName, metric.WithInstrumentationVersion(internal.ETVersionString))
+
+		// The errors only report invalid instrument names, the instruments are usable anyway.
+		meterInstruments.requestCount, _ = meter.Int64Counter(
+			"export_tool.api.requests",
+			metric.WithDescription("Number of requests sent to the Proton API."),
+		)
+		meterInstruments.requestDuration, _ = meter.Float64Histogram(
+			"export_tool.api.request.duration",
+			metric.WithDescription("Duration of the requests sent to the Proton API."),
+			metric.WithUnit("s"),
+		)
+		meterInstruments.stageDuration, _ = meter.Float64Histogram(
+			"export_tool.stage.duration",
+			metric.WithDescription("Duration of the stages of the tasks."),
+			metric.WithUnit("s"),
+		)
+		meterInstruments.messageCount, _ = meter.Int64Counter(
+			"export_tool.messages",
+			metric.WithDescription("Number of messages processed by the tasks, by outcome."),
+		)
+		meterInstruments.bytes, _ = meter.Int64Counter(
+			"export_tool.bytes",
+			metric.WithDescription("Number of bytes written by the exports and uploaded by the restores and imports."),
+			metric.WithUnit("By"),
+		)
+	})
+
+	return &meterInstruments
+}
+
+// RecordRequest records an API request, status is 0 when no response was received.
+func RecordRequest(ctx context.Context, method string, status int, duration time.Duration) {
+	attrs := metric.WithAttributes(MethodKey.String(method), StatusKey.Int(status))
+	getInstruments().requestCount.Add(ctx, 1, attrs)
+	getInstruments().requestDuration.Record(ctx, duration.Seconds(), attrs)
+}
+
+func RecordStage(ctx context.Context, task, stage string, duration time.Duration) {
+	getInstruments().stageDuration.Record(ctx, duration.Seconds(), metric.WithAttributes(TaskKey.String(task), StageKey.String(stage)))
+}
+
+// RecordMessages adds count messages with the given outcome, such as "exported" or "failed". Zero counts are skipped.
+func RecordMessages(ctx context.Context, task, outcome string, count uint64) {
+	if count == 0 {
+		return
+	}
+
+	getInstruments().messageCount.Add(ctx, int64(count), metric.WithAttributes(TaskKey.String(task), OutcomeKey.String(outcome)))
+}
+
+func RecordBytes(ctx context.Context, task string, count uint64) {
+	if count == 0 {
+		return
+	}
+
+	getInstruments().bytes.Add(ctx, int64(count), metric.WithAttributes(TaskKey.String(task)))
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxFileNameBytes is the maximum length of a file name on the most common file systems.
+const MaxFileNameBytes = 255
+
+// reservedWindowsNames cannot be used as file names on Windows, regardless of the extension.
+var reservedWindowsNames = map[string]struct{}{ //nolint:gochecknoglobals
+	"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
+	"COM1": {}, "COM2": {}, "COM3": {}, "COM4": {}, "COM5": {}, "COM6": {}, "COM7": {}, "COM8": {}, "COM9": {},
+	"LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {}, "LPT5": {}, "LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
+}
+
+// NormalizeName returns the NFC form of name. Names typed on different platforms may use different, but canonically
+// equivalent, sequences of code points (e.g. macOS uses decomposed accents).
+func NormalizeName(name string) string {
+	return norm.NFC.String(name)
+}
+
+// NamesEqual reports whether two user visible names are equal, ignoring case and Unicode normalization differences.
+func NamesEqual(a, b string) bool {
+	return strings.EqualFold(NormalizeName(a), NormalizeName(b))
+}
+
+// SafeFileName derives a file or directory name that is valid on Windows, macOS and Linux from a user visible name.
+// Emoji and non-Latin scripts are kept, but path separators, reserved characters, control characters and bidirectional
+// formatting characters (which can make a name display differently from what it is) are replaced with '_'. The result
+// is never empty and never longer than MaxFileNameBytes, long names keep their extension. The original name must be
+// kept elsewhere, e.g. in metadata.
+func SafeFileName(name string) string {
+	var builder strings.Builder
+
+	for _, r := range NormalizeName(name) {
+		switch {
+		case r == utf8.RuneError,
+			unicode.IsControl(r),
+			unicode.Is(unicode.Bidi_Control, r),
+			strings.ContainsRune(`<>:"/\|?*`, r):
+			builder.WriteRune('_')
+		default:
+			builder.WriteRune(r)
+		}
+	}
+
+	// Windows silently drops trailing dots and spaces.
+	result := strings.TrimRight(builder.String(), ". ")
+
+	if stem, _, _ := strings.Cut(result, "."); isReservedWindowsName(stem) {
+		result = "_" + result
+	}
+
+	if len(result) > MaxFileNameBytes {
+		result = truncateWithHash(result, name)
+	}
+
+	if len(strings.Trim(result, "_")) == 0 {
+		sum := sha256.Sum256([]byte(name))
+		result = "_" + hex.EncodeToString(sum[:8])
+	}
+
+	return result
+}
+
+func isReservedWindowsName(name string) bool {
+	_, ok := reservedWindowsNames[strings.ToUpper(strings.TrimSpace(name))]
+	return ok
+}
+
+// truncateWithHash shortens name on a rune boundary and appends a hash of the original so that long names sharing the
+// same prefix do not collide.
+func truncateWithHash(name, original string) string {
+	result, _ := TruncateName(name, original, MaxFileNameBytes, true)
+	return result
+}
+
+// maxKeptExtensionBytes is the longest extension kept by TruncateName, longer ones are likely not extensions.
+const maxKeptExtensionBytes = 16
+
+// TruncateName shortens name to at most maxBytes on a rune boundary, appending a hash of original so that the names
+// sharing a prefix do not collide. The extension of name is kept after the hash when keepExtension is set. The result
+// only depends on the arguments. Names that already fit are returned unchanged. It returns false when maxBytes is too
+// short to hold the hash, the extension and at least one byte of name.
+func TruncateName(name, original string, maxBytes int, keepExtension bool) (string, bool) {
+	if len(name) <= maxBytes {
+		return name, true
+	}
+
+	var ext string
+	if keepExtension {
+		if ext = filepath.Ext(name); len(ext) > maxKeptExtensionBytes || len(ext) == len(name) {
+			ext = ""
+		}
+	}
+
+	sum := sha256.Sum256([]byte(original))
+	suffix := "_" + hex.EncodeToString(sum[:4]) + ext
+
+	limit := maxBytes - len(suffix)
+	for limit > 0 && !utf8.RuneStart(name[limit]) {
+		limit--
+	}
+
+	if limit <= 0 {
+		return "", false
+	}
+
+	return strings.TrimRight(name[:limit], ". ") + suffix, true
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSafeFileName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "Inbox", expected: "Inbox"},
+		{name: "\U0001F680 Launch", expected: "\U0001F680 Launch"},
+		{name: "עבודה", expected: "עבודה"},
+		{name: "Café", expected: "Café"},
+		{name: "Work/Notes", expected: "Work_Notes"},
+		{name: "a<b>c:d\"e\\f|g?h*", expected: "a_b_c_d_e_f_g_h_"},
+		{name: "evil‮txt.exe", expected: "evil_txt.exe"},
+		{name: "tab\there", expected: "tab_here"},
+		{name: "trailing. ", expected: "trailing"},
+		{name: "CON", expected: "_CON"},
+		{name: "com1.txt", expected: "_com1.txt"},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.expected, SafeFileName(test.name), test.name)
+	}
+}
+
+func TestSafeFileName_Fallback(t *testing.T) {
+	for _, name := range []string{"", "...", "///", "‮"} {
+		result := SafeFileName(name)
+		require.NotEmpty(t, strings.Trim(result, "_"), name)
+	}
+
+	require.NotEqual(t, SafeFileName("/"), SafeFileName("\\"))
+}
+
+func TestSafeFileName_Truncate(t *testing.T) {
+	long := strings.Repeat("\U0001F4E7", 100) // 400 bytes.
+
+	result := SafeFileName(long)
+	require.LessOrEqual(t, len(result), MaxFileNameBytes)
+	require.True(t, utf8.ValidString(result))
+	require.NotEqual(t, result, SafeFileName(long+"x"))
+
+	result = SafeFileName(long + ".pdf")
+	require.LessOrEqual(t, len(result), MaxFileNameBytes)
+	require.True(t, strings.HasSuffix(result, ".pdf"))
+}
+
+func TestTruncateName(t *testing.T) {
+	name, ok := TruncateName("short.pdf", "short.pdf", 64, true)
+	require.True(t, ok)
+	require.Equal(t, "short.pdf", name)
+
+	long := strings.Repeat("é", 40) + ".pdf"
+
+	name, ok = TruncateName(long, long, 32, true)
+	require.True(t, ok)
+	require.LessOrEqual(t, len(name), 32)
+	require.True(t, utf8.ValidString(name))
+	require.True(t, strings.HasSuffix(name, ".pdf"))
+
+	again, _ := TruncateName(long, long, 32, true)
+	require.Equal(t, name, again)
+
+	other, _ := TruncateName(long+"x", long+"x", 32, true)
+	require.NotEqual(t, name, other)
+
+	name, ok = TruncateName(long, long, 32, false)
+	require.True(t, ok)
+	require.False(t, strings.HasSuffix(name, ".pdf"))
+
+	_, ok = TruncateName(long, long, 12, true)
+	require.False(t, ok)
+}
+
+func TestNamesEqual(t *testing.T) {
+	require.True(t, NamesEqual("Café", "CAFÉ"))
+	require.True(t, NamesEqual("\U0001F680 launch", "\U0001F680 Launch"))
+	require.False(t, NamesEqual("\U0001F680", "\U0001F681"))
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"runtime"
 
 	"github.com/sirupsen/logrus"
 )
@@ -35,8 +36,20 @@ type IntegrityChecker interface {
 	Check(path string) error
 }
 
-// WriteFileSafe writes the contents to a temporary location first, before moving to the designated location.
+// WriteFileSafe writes the contents to a temporary location first, before moving to the designated location. The
+// temporary file is flushed to the disk before it is moved, so that a crash never leaves an empty or partial file at
+// dstPath.
 func WriteFileSafe(tempPath, dstPath string, data []byte, integrityChecker IntegrityChecker) error {
+	return writeFileSafe(tempPath, dstPath, data, integrityChecker, true)
+}
+
+// WriteFileSafeUnsynced is WriteFileSafe without flushing the file to the disk, for the files the caller flushes in
+// batches or not at all. The file is still replaced atomically, but a crash may leave it empty.
+func WriteFileSafeUnsynced(tempPath, dstPath string, data []byte, integrityChecker IntegrityChecker) error {
+	return writeFileSafe(tempPath, dstPath, data, integrityChecker, false)
+}
+
+func writeFileSafe(tempPath, dstPath string, data []byte, integrityChecker IntegrityChecker, sync bool) error {
 	if integrityChecker != nil {
 		integrityChecker.Initialize(data)
 	}
@@ -63,6 +76,13 @@ func WriteFileSafe(tempPath, dstPath string, data []byte, integrityChecker Integ
 		return fmt.Errorf("not all contents written to file")
 	}
 
+	if sync {
+		if err := file.Sync(); err != nil {
+			_ = file.Close()
+			return fmt.Errorf("failed to flush tmp file: %w", err)
+		}
+	}
+
 	if err := file.Close(); err != nil {
 		return fmt.Errorf("failed to close tmp file: %w", err)
 	}
@@ -80,6 +100,107 @@ func WriteFileSafe(tempPath, dstPath string, data []byte, integrityChecker Integ
 	return nil
 }
 
+// SealFunc returns a writer encrypting the data written to it to w. Closing the writer must not close w.
+type SealFunc func(w io.Writer) (io.WriteCloser, error)
+
+// WriteFileSealed is WriteFileSafe for contents encrypted by seal while they are written. The data is not copied, only
+// the encrypted file is written. When checkIntegrity is set, the file is checked against the hash of the encrypted data.
+// Unless sync is set, the file is not flushed to the disk before it is moved, see WriteFileSafeUnsynced.
+func WriteFileSealed(tempPath, dstPath string, data []byte, seal SealFunc, checkIntegrity, sync bool) error {
+	file, err := os.CreateTemp(tempPath, "export-tool-*")
+	if err != nil {
+		return fmt.Errorf("failed to create tmp file: %w", err)
+	}
+
+	filePath := file.Name()
+	hasher := sha256.New()
+
+	if err := writeSealed(io.MultiWriter(file, hasher), data, seal); err != nil {
+		if err := file.Close(); err != nil {
+			logrus.WithField("dstPath", filePath).WithError(err).Error("Failed to close tmp file after io error")
+		}
+		return err
+	}
+
+	if sync {
+		if err := file.Sync(); err != nil {
+			_ = file.Close()
+			return fmt.Errorf("failed to flush tmp file: %w", err)
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close tmp file: %w", err)
+	}
+
+	if checkIntegrity {
+		checker := &Sha256IntegrityChecker{hash: hasher.Sum(nil)}
+		if err := checker.Check(filePath); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(filePath, dstPath); err != nil {
+		return fmt.Errorf("failed to move file to location: %w", err)
+	}
+
+	return nil
+}
+
+func writeSealed(w io.Writer, data []byte, seal SealFunc) error {
+	sealed, err := seal(w)
+	if err != nil {
+		return fmt.Errorf("failed to start encryption: %w", err)
+	}
+
+	if _, err := sealed.Write(data); err != nil {
+		_ = sealed.Close()
+		return fmt.Errorf("failed to write contents: %w", err)
+	}
+
+	if err := sealed.Close(); err != nil {
+		return fmt.Errorf("failed to finish encryption: %w", err)
+	}
+
+	return nil
+}
+
+// SyncFile flushes the content of the file at path to the disk. The file is opened for writing as Windows does not
+// flush files opened read-only.
+func SyncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0) //nolint:gosec
+	if err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// SyncDir flushes the entries of the directory at path to the disk, so that the files moved into it are not lost on a
+// power failure. Windows does not support it, the call does nothing there.
+func SyncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	dir, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return err
+	}
+
+	if err := dir.Sync(); err != nil {
+		_ = dir.Close()
+		return err
+	}
+
+	return dir.Close()
+}
+
 type Sha256IntegrityChecker struct {
 	hash []byte
 }
@@ -0,0 +1,105 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ProtonMail/export-tool/internal/keychain"
+	"github.com/ProtonMail/export-tool/internal/utils"
+)
+
+// SecretStore keeps secrets sealed with the vault in the files of its directory. It stands in for the keychain on the
+// systems that have none. The secrets are never written in the clear, the methods return ErrLocked without a vault.
+type SecretStore struct {
+	dir   string
+	vault *Vault
+}
+
+var _ keychain.Store = (*SecretStore)(nil)
+
+func NewSecretStore(dir string, v *Vault) *SecretStore {
+	return &SecretStore{dir: dir, vault: v}
+}
+
+func (s *SecretStore) Get(name string) ([]byte, error) {
+	path, err := s.getPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(path) //nolint:gosec
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, keychain.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret: %w", err)
+	}
+
+	var sealed sealedDocument
+	if err := json.Unmarshal(b, &sealed); err != nil || len(sealed.Sealed) == 0 {
+		return nil, fmt.Errorf("secret '%v' is not sealed", name)
+	}
+
+	return s.vault.Unseal(sealed.Sealed)
+}
+
+func (s *SecretStore) Set(name string, secret []byte) error {
+	path, err := s.getPath(name)
+	if err != nil {
+		return err
+	}
+
+	b, err := Encode(s.vault, secret)
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileSafe(s.dir, path, b, nil)
+}
+
+func (s *SecretStore) Delete(name string) error {
+	path, err := s.getPath(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); errors.Is(err, os.ErrNotExist) {
+		return keychain.ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to remove secret: %w", err)
+	}
+
+	return nil
+}
+
+func (s *SecretStore) getPath(name string) (string, error) {
+	if s.vault == nil {
+		return "", ErrLocked
+	}
+
+	if len(name) == 0 || filepath.Base(name) != name || name == "." || name == ".." {
+		return "", fmt.Errorf("%w: '%v'", keychain.ErrInvalidName, name)
+	}
+
+	return filepath.Join(s.dir, name+".sealed"), nil
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package vault protects the files the tool keeps about its own operation, such as the run history, with a master
+// passphrase, so that a copy of the operation directory does not leak the accounts and folders that were backed up.
+//
+// A random key is generated once and stored in the directory, encrypted with the passphrase (OpenPGP S2K). The records
+// are encrypted with that key, so the slow passphrase derivation only happens when the vault is unlocked.
+package vault
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+)
+
+// KeyFileName is the key of the vault, encrypted with the passphrase. Its presence marks the directory as protected.
+const KeyFileName = "local_key.pgp"
+
+var (
+	ErrLocked           = errors.New("local files are passphrase protected, the passphrase is required")
+	ErrWrongPassphrase  = errors.New("wrong passphrase for the local files")
+	ErrEmptyPassphrase  = errors.New("the passphrase of the local files cannot be empty")
+	errAlreadyProtected = errors.New("local files are already passphrase protected")
+)
+
+// Vault encrypts and decrypts records with the key of a directory. It is safe for concurrent use.
+type Vault struct {
+	key *crypto.SessionKey
+}
+
+// IsProtected returns whether the files of dir are protected by a passphrase.
+func IsProtected(dir string) (bool, error) {
+	_, err := os.Stat(filepath.Join(dir, KeyFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check local key: %w", err)
+	}
+
+	return true, nil
+}
+
+// Create generates the key of dir and protects it with passphrase.
+func Create(dir string, passphrase []byte) (*Vault, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrEmptyPassphrase
+	}
+
+	key, err := crypto.GenerateSessionKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate local key: %w", err)
+	}
+
+	keyPacket, err := crypto.EncryptSessionKeyWithPassword(key, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt local key: %w", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, KeyFileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return nil, errAlreadyProtected
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local key: %w", err)
+	}
+
+	if _, err := file.Write(keyPacket); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to write local key: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close local key: %w", err)
+	}
+
+	return &Vault{key: key}, nil
+}
+
+// Unlock decrypts the key of dir with passphrase.
+func Unlock(dir string, passphrase []byte) (*Vault, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrEmptyPassphrase
+	}
+
+	keyPacket, err := os.ReadFile(filepath.Join(dir, KeyFileName)) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local key: %w", err)
+	}
+
+	key, err := crypto.DecryptSessionKeyWithPassword(keyPacket, passphrase)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	return &Vault{key: key}, nil
+}
+
+// Open unlocks the key of dir, or creates it if the directory is not protected yet.
+func Open(dir string, passphrase []byte) (*Vault, error) {
+	protected, err := IsProtected(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if protected {
+		return Unlock(dir, passphrase)
+	}
+
+	return Create(dir, passphrase)
+}
+
+// Seal encrypts data and returns it base64 encoded, so that it can be stored in a JSON document.
+func (v *Vault) Seal(data []byte) (string, error) {
+	encrypted, err := v.key.Encrypt(crypto.NewPlainMessage(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt local record: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(encrypted), nil
+}
+
+// Unseal decrypts data sealed by Seal.
+func (v *Vault) Unseal(sealed string) ([]byte, error) {
+	encrypted, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode local record: %w", err)
+	}
+
+	decrypted, err := v.key.Decrypt(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt local record: %w", err)
+	}
+
+	return decrypted.GetBinary(), nil
+}
+
+// sealedDocument is a file encrypted with the vault, see Encode.
+type sealedDocument struct {
+	Sealed string
+}
+
+// Encode seals data with v when the directory is protected, v is then not nil, so that it can be written to a file.
+// Otherwise data is returned as is.
+func Encode(v *Vault, data []byte) ([]byte, error) {
+	if v == nil {
+		return data, nil
+	}
+
+	sealed, err := v.Seal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(sealedDocument{Sealed: sealed})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode local record: %w", err)
+	}
+
+	return b, nil
+}
+
+// Decode returns the data of a file written by Encode, ErrLocked if it is sealed and v is nil. The files written before
+// the directory was protected are returned as is.
+func Decode(v *Vault, b []byte) ([]byte, error) {
+	var sealed sealedDocument
+	if err := json.Unmarshal(b, &sealed); err != nil || len(sealed.Sealed) == 0 {
+		return b, nil //nolint:nilerr
+	}
+
+	if v == nil {
+		return nil, ErrLocked
+	}
+
+	return v.Unseal(sealed.Sealed)
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2024 Proton AG
+//
+// This file is part of Proton Export Tool.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Export Tool.  If not, see <https://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/export-tool/internal/keychain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVault_CreateAndUnlock(t *testing.T) {
+	dir := t.TempDir()
+
+	protected, err := IsProtected(dir)
+	require.NoError(t, err)
+	require.False(t, protected)
+
+	_, err = Open(dir, nil)
+	require.ErrorIs(t, err, ErrEmptyPassphrase)
+
+	v, err := Open(dir, []byte("hunter2"))
+	require.NoError(t, err)
+
+	protected, err = IsProtected(dir)
+	require.NoError(t, err)
+	require.True(t, protected)
+
+	_, err = Create(dir, []byte("other"))
+	require.ErrorIs(t, err, errAlreadyProtected)
+
+	_, err = Unlock(dir, []byte("wrong"))
+	require.ErrorIs(t, err, ErrWrongPassphrase)
+
+	sealed, err := v.Seal([]byte("secret record"))
+	require.NoError(t, err)
+	require.NotContains(t, sealed, "secret")
+
+	unlocked, err := Open(dir, []byte("hunter2"))
+	require.NoError(t, err)
+
+	data, err := unlocked.Unseal(sealed)
+	require.NoError(t, err)
+	require.Equal(t, "secret record", string(data))
+}
+
+func TestVault_EncodeDecode(t *testing.T) {
+	v, err := Create(t.TempDir(), []byte("hunter2"))
+	require.NoError(t, err)
+
+	plain, err := Encode(nil, []byte(`{"Version":1}`))
+	require.NoError(t, err)
+	require.Equal(t, `{"Version":1}`, string(plain))
+
+	sealed, err := Encode(v, []byte(`{"Version":1}`))
+	require.NoError(t, err)
+	require.NotContains(t, string(sealed), "Version")
+
+	_, err = Decode(nil, sealed)
+	require.ErrorIs(t, err, ErrLocked)
+
+	data, err := Decode(v, sealed)
+	require.NoError(t, err)
+	require.Equal(t, `{"Version":1}`, string(data))
+
+	// Files written before the directory was protected stay readable.
+	data, err = Decode(v, plain)
+	require.NoError(t, err)
+	require.Equal(t, `{"Version":1}`, string(data))
+}
+
+func TestSecretStore(t *testing.T) {
+	dir := t.TempDir()
+
+	v, err := Open(dir, []byte("hunter2"))
+	require.NoError(t, err)
+
+	store := NewSecretStore(dir, v)
+
+	_, err = store.Get("audit-key")
+	require.ErrorIs(t, err, keychain.ErrNotFound)
+
+	require.NoError(t, store.Set("audit-key", []byte("secret seed")))
+
+	b, err := os.ReadFile(filepath.Join(dir, "audit-key.sealed"))
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "secret seed")
+
+	secret, err := store.Get("audit-key")
+	require.NoError(t, err)
+	require.Equal(t, "secret seed", string(secret))
+
+	require.ErrorIs(t, store.Set("../audit-key", nil), keychain.ErrInvalidName)
+	require.ErrorIs(t, NewSecretStore(dir, nil).Set("audit-key", nil), ErrLocked)
+
+	require.NoError(t, store.Delete("audit-key"))
+	require.ErrorIs(t, store.Delete("audit-key"), keychain.ErrNotFound)
+}
@@ -17,9 +17,11 @@
 
 #pragma once
 
+#include <chrono>
 #include <exception>
 #include <filesystem>
 #include <string>
+#include <string_view>
 
 #include "etexception.hpp"
 
@@ -36,12 +38,40 @@ public:
     explicit BackupException(std::string_view what) : Exception(what) {}
 };
 
+/// Must match mail.AutoGeneratedMode.
+enum class AutoGeneratedMode {
+    Include,  // Export newsletters and notifications with the other messages.
+    Exclude,  // Do not export them.
+    Separate, // Export them in the auto-generated sub folder.
+};
+
+/// Must match mail.OutputFormat.
+enum class OutputFormat {
+    EML,     // One EML file per message.
+    MBox,    // One mbox file per label and folder.
+    Maildir, // One Maildir++ folder per label and folder.
+    Pack,    // Messages appended to large pack files.
+    Zip,     // One zip archive per export folder.
+    TarZst,  // One zstd compressed tar archive per export folder.
+};
+
 class BackupCallback {
 public:
     BackupCallback() = default;
     virtual ~BackupCallback() = default;
 
     virtual void onProgress(float progress) = 0;
+
+    /// Called every second while the backup runs, even without progress. The timestamps are Unix times in milliseconds. A stale
+    /// lastProgressMs means the backup is slow, missing heartbeats mean it is hung.
+    virtual void onHeartbeat(std::string_view /*stage*/, int64_t /*timestampMs*/, int64_t /*lastProgressMs*/) {}
+
+    /// Called when the Proton servers rate limit a request, which is repeated after waitSeconds. Can be called from several
+    /// threads.
+    virtual void onRateLimited(int64_t /*waitSeconds*/) {}
+
+    /// Called every second while the backup runs, and once more when it ends.
+    virtual void onProgressEvent(const ProgressEvent& /*event*/) {}
 };
 
 class Backup final {
@@ -65,10 +95,79 @@ public:
 
     void cancel();
 
+    /// A graceful cancellation is escalated to an immediate one after gracePeriod, unless it is zero.
+    void cancel(CancelMode mode, std::chrono::milliseconds gracePeriod = std::chrono::milliseconds::zero());
+
+    void setAutoGeneratedMode(AutoGeneratedMode mode);
+
+    void setOutputFormat(OutputFormat format);
+
+    /// Updates the previous incremental export of the account instead of creating a new one, only downloading the new and the
+    /// changed messages. Must be called before getExportPath().
+    void setIncremental(bool recordTombstones);
+
+    /// Continues the most recent interrupted export of the account from its checkpoint instead of creating a new one. The export
+    /// must be configured with the same options. Must be called before getExportPath().
+    void setResume();
+
+    /// Copies the finished export to path as well. Each copy is verified independently.
+    void addMirror(const std::filesystem::path& path);
+
+    /// Writes the mirrors at the same time instead of one after the other.
+    void setMirrorParallel(bool parallel);
+
+    /// Shortens the file names so that the paths fit the budget, a profile name such as 'windows' or a number of bytes.
+    void setPathBudget(const std::string& budget);
+
+    /// Writes the messages to one folder per calendar year, each year folder is restored separately.
+    void setSplitByYear(bool enabled);
+
+    /// Encrypts the message and metadata files on disk to the armored OpenPGP key if set, with the passphrase otherwise.
+    void setEncryption(const std::string& passphrase, const std::string& armoredKey);
+
+    /// Restricts the export to the messages matching the JSON encoded filter specification.
+    void setFilter(const std::string& filterJSON);
+
+    /// Restricts the export to the messages selected by a named filter preset. The filter set before, if any, refines
+    /// the preset.
+    void setFilterPreset(const std::string& name);
+
+    /// Restricts the export to the messages received in [after, before), dates given as YYYY-MM-DD or RFC 3339. An empty
+    /// date leaves that side of the window open. The other criteria of the current filter are kept.
+    void setDateRange(const std::string& after, const std::string& before);
+
+    /// Posts the changes since the previous backup to webhookURL and emails them to email when more than maxDeleted
+    /// messages were deleted. The SMTP server is read from ET_SMTP_SERVER, ET_SMTP_USER, ET_SMTP_PASSWORD and
+    /// ET_SMTP_FROM. Empty webhookURL and email only report the changes in the result.
+    void setSnapshotAlert(const std::string& webhookURL, const std::string& email, int maxDeleted);
+
+    /// Overrides the number of parallel downloads. 0 selects a value suited to the plan of the account.
+    void setConcurrency(int concurrency);
+
+    /// Overrides the number of messages decrypted and assembled in parallel. 0 selects the default.
+    void setBuildConcurrency(int concurrency);
+
+    /// Returns why the last run was stopped, to distinguish a user cancellation from a failure.
+    CancelCause getCancelCause() const;
+
+    /// Returns the JSON encoded plan of the export: destination, messages and files, without downloading any message.
+    std::string dryRun() const;
+
+    /// Returns the JSON encoded final report of the last run.
+    std::string getResultJSON() const;
+
     std::filesystem::path getExportPath() const;
 
     std::uint64_t getExpectedDiskUsage() const;
 
+    struct FilterPrediction {
+        std::uint64_t messageCount;
+        std::uint64_t expectedDiskUsage;
+    };
+
+    /// Filter is expected to be a JSON encoded filter specification.
+    FilterPrediction predictFilter(const std::string& filterJSON) const;
+
 private:
     template<class F>
     void wrapCCall(F func);
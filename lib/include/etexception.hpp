@@ -17,6 +17,7 @@
 
 #pragma once
 
+#include <cstdint>
 #include <exception>
 #include <string>
 #include <string_view>
@@ -43,4 +44,31 @@ class CancelledException final : public Exception {
 public:
     inline CancelledException() : Exception("Operation Cancelled") {}
 };
+
+/// Reason why an operation was stopped before completion.
+enum class CancelCause {
+    None,     // The operation was not cancelled.
+    User,     // The user requested the cancellation.
+    Deadline, // A deadline was exceeded.
+    Fatal,    // The operation ran into an unrecoverable error.
+    Parent,   // The session the operation belongs to was cancelled.
+};
+
+/// Structured progress of a running backup or restore. Must match mail.ProgressEvent.
+struct ProgressEvent {
+    std::string stage;
+    uint64_t processedMessageCount = 0;
+    uint64_t totalMessageCount = 0; // 0 while unknown.
+    uint64_t transferredBytes = 0;  // Downloaded by backups, uploaded by restores.
+    double bytesPerSecond = 0;
+    double messagesPerSecond = 0;
+    int64_t etaSeconds = -1; // -1 while unknown.
+    int64_t timestampMs = 0;
+};
+
+/// How a running operation stops when it is cancelled. Must match mail.CancelMode.
+enum class CancelMode {
+    Immediate, // Abort the in-flight requests and remove the partially written files.
+    Graceful,  // Stop starting new work and let the in-flight messages finish.
+};
 } // namespace etcpp
@@ -17,9 +17,11 @@
 
 #pragma once
 
+#include <chrono>
 #include <exception>
 #include <filesystem>
 #include <string>
+#include <string_view>
 
 #include "etexception.hpp"
 
@@ -42,6 +44,20 @@ public:
     virtual ~RestoreCallback() = default;
 
     virtual void onProgress(float progress) = 0;
+
+    /// Called whenever the estimated remaining time of the restore is recalibrated.
+    virtual void onETA(int64_t /*remainingSeconds*/) {}
+
+    /// Called every second while the restore runs, even without progress. The timestamps are Unix times in milliseconds. A stale
+    /// lastProgressMs means the restore is slow, missing heartbeats mean it is hung.
+    virtual void onHeartbeat(std::string_view /*stage*/, int64_t /*timestampMs*/, int64_t /*lastProgressMs*/) {}
+
+    /// Called when the Proton servers rate limit a request, which is repeated after waitSeconds. Can be called from several
+    /// threads.
+    virtual void onRateLimited(int64_t /*waitSeconds*/) {}
+
+    /// Called every second while the restore runs, and once more when it ends.
+    virtual void onProgressEvent(const ProgressEvent& /*event*/) {}
 };
 
 class Restore final {
@@ -65,12 +81,67 @@ public:
 
     void cancel();
 
+    /// A graceful cancellation is escalated to an immediate one after gracePeriod, unless it is zero.
+    void cancel(CancelMode mode, std::chrono::milliseconds gracePeriod = std::chrono::milliseconds::zero());
+
+    /// Returns why the last run was stopped, to distinguish a user cancellation from a failure.
+    CancelCause getCancelCause() const;
+
+    /// Returns the JSON encoded final report of the last run.
+    std::string getResultJSON() const;
+
     std::filesystem::path getBackupPath() const;
     int64_t getImportableCount() const;
     int64_t getImportedCount() const;
     int64_t getFailedCount() const;
     int64_t getSkippedCount() const;
 
+    /// When enabled, all imported messages and created labels are deleted if the restore does not fully succeed.
+    void setTransactional(bool transactional);
+    bool wasRolledBack() const;
+
+    /// When enabled, new labels are always created instead of reusing existing labels with the same name and hierarchy.
+    void setAlwaysCreateLabels(bool alwaysCreate);
+
+    /// When disabled, the messages are only placed in their original folders and labels, without the 'Import' label
+    /// added by default.
+    void setImportLabel(bool enabled);
+
+    /// When enabled, the messages of the backup already in the account, matched by ID, Message-ID or content, are not
+    /// imported and are counted as skipped.
+    void setSkipDuplicates(bool enabled);
+
+    /// When enabled, the restore continues from the state of an interrupted restore of the backup: the messages
+    /// imported by the previous runs are not imported again and the labels they created are reused.
+    void setResume(bool enabled);
+
+    /// Decrypts a backup encrypted on disk with the armored private key if set, unlocked with the passphrase if needed,
+    /// with the passphrase otherwise.
+    void setEncryption(const std::string& passphrase, const std::string& armoredKey);
+
+    /// Sets the number of import batches encrypted and submitted in parallel, 0 selects a value suited to the plan of the
+    /// account.
+    void setConcurrency(int concurrency);
+
+    /// Aborts the restore when more than maxFailureRate (a fraction, e.g. 0.2) of the last failureWindow messages failed
+    /// to import, or when fewer than minThroughput messages per minute were imported during the last
+    /// throughputWindowMinutes. A rate or throughput of 0 disables the check, a window of 0 selects the default.
+    void setGuardrails(double maxFailureRate, int failureWindow, double minThroughput, int throughputWindowMinutes);
+
+    /// Restricts the restore to the messages of the backup matching the JSON encoded filter specification. Body keywords
+    /// and conversation expansion are not supported.
+    void setFilter(const std::string& filterJSON);
+
+    /// Restricts the restore to the messages received in [after, before), dates given as YYYY-MM-DD or RFC 3339. An
+    /// empty date leaves that side of the window open. The other criteria of the current filter are kept.
+    void setDateRange(const std::string& after, const std::string& before);
+
+    /// Compares the restored messages with the backup and returns the JSON encoded verification report.
+    std::string verifyJSON();
+
+    /// Returns the JSON encoded list of labels the restore will create or reuse.
+    std::string getLabelPreviewJSON() const;
+
 private:
     template<class F>
     void wrapCCall(F func);
@@ -17,6 +17,7 @@
 
 #pragma once
 
+#include <cstdint>
 #include <memory>
 #include <string>
 
@@ -45,6 +46,8 @@ public:
     virtual ~SessionCallback() = default;
     virtual void onNetworkRestored() = 0;
     virtual void onNetworkLost() = 0;
+    /// Called once if the local clock differs from the time of the servers by more than a few minutes.
+    virtual void onClockSkew(int64_t skewSeconds) = 0;
 };
 
 class Session final {
@@ -53,7 +56,7 @@ private:
     std::shared_ptr<SessionCallback> mCallbacks;
 
 public:
-    enum class LoginState { LoggedOut, AwaitingTOTP, AwaitingHV, AwaitingMailboxPassword, LoggedIn };
+    enum class LoginState { LoggedOut, AwaitingTOTP, AwaitingHV, AwaitingMailboxPassword, LoggedIn, AwaitingFIDO2 };
 
     inline explicit Session(const char* serverURL) : Session(serverURL, false, {}) {}
     explicit Session(const char* serverURL, const bool telemetryDisabled, const std::shared_ptr<SessionCallback>& mCallbacks);
@@ -65,12 +68,31 @@ public:
 
     [[nodiscard]] LoginState login(const char* email, std::string_view password);
     [[nodiscard]] LoginState loginTOTP(const char* totp);
+    /// Submits the JSON encoded WebAuthn assertion of a security key for the challenge of getFIDO2ChallengeJSON. The
+    /// fields ClientData, AuthenticatorData, Signature and CredentialID are base64 encoded.
+    [[nodiscard]] LoginState loginFIDO2(const char* assertionJSON);
     [[nodiscard]] LoginState loginMailboxPassword(std::string_view password);
+    /// Logs in with the session saved in the keychain of the operating system, shared with the CLI. Returns false when
+    /// there is none or it expired, the session then needs a login. Must be called before login for saveToKeychain to
+    /// be possible.
+    [[nodiscard]] bool resumeFromKeychain();
+    /// Saves the logged in session in the keychain of the operating system, and again each time its tokens are
+    /// refreshed.
+    void saveToKeychain();
 
     [[nodiscard]] LoginState getLoginState() const;
     [[nodiscard]] std::string getEmail() const;
     [[nodiscard]] std::string getHVSolveURL() const;
     [[nodiscard]] LoginState markHVSolved();
+    /// Returns the JSON encoded WebAuthn challenge to sign with a security key, when the login awaits the second factor
+    /// of an account with one.
+    [[nodiscard]] std::string getFIDO2ChallengeJSON() const;
+
+    /// Returns the JSON encoded list of the permissions granted to the session, with their description. They are known
+    /// once the password is accepted, before the second factor and the mailbox password are submitted.
+    [[nodiscard]] std::string getScopesJSON() const;
+    /// Returns the permissions granted to the session as one indented 'name: description' line each.
+    [[nodiscard]] std::string getScopeSummary() const;
 
     [[nodiscard]] Backup newBackup(const char* exportPath) const;
     [[nodiscard]] Restore newRestore(const char* backupPath) const;
@@ -58,4 +58,172 @@ bool GlobalScope::newVersionAvailable() const {
     return etNewVersionAvailable() == 1;
 }
 
+void GlobalScope::setAuditRecipientKey(const std::filesystem::path& keyPath) {
+    auto cpath = keyPath.u8string();
+    if (etSetAuditRecipientKey(cpath.c_str()) != 0) {
+        const char* lastErr = etGetLastError();
+        if (lastErr == nullptr) {
+            lastErr = "unknown error";
+        }
+
+        throw Exception(lastErr);
+    }
+}
+
+void GlobalScope::setHoldMode(const std::string& reason) {
+    if (etSetHoldMode(reason.c_str()) != 0) {
+        const char* lastErr = etGetLastError();
+        if (lastErr == nullptr) {
+            lastErr = "unknown error";
+        }
+
+        throw Exception(lastErr);
+    }
+}
+
+void GlobalScope::setClockSkewCompensation(bool enabled) {
+    etSetClockSkewCompensation(enabled ? 1 : 0);
+}
+
+void GlobalScope::setAlternativeRouting(bool enabled) {
+    etSetAlternativeRouting(enabled ? 1 : 0);
+}
+
+void GlobalScope::setAPICACert(const std::filesystem::path& caCertPath) {
+    auto cpath = caCertPath.u8string();
+    etSetAPICACert(cpath.c_str());
+}
+
+void GlobalScope::setLogFormat(const std::string& format) {
+    if (etSetLogFormat(format.c_str()) != 0) {
+        const char* lastErr = etGetLastError();
+        if (lastErr == nullptr) {
+            lastErr = "unknown error";
+        }
+
+        throw Exception(lastErr);
+    }
+}
+
+void GlobalScope::enablePrivacyLogs() {
+    etEnablePrivacyLogs();
+}
+
+void GlobalScope::setLogRotation(std::optional<int> maxSizeMB, std::optional<int> maxFiles, std::optional<bool> compress) {
+    const int compressValue = compress.has_value() ? (*compress ? 1 : 0) : -1;
+    if (etSetLogRotation(maxSizeMB.value_or(-1), maxFiles.value_or(-1), compressValue) != 0) {
+        const char* lastErr = etGetLastError();
+        if (lastErr == nullptr) {
+            lastErr = "unknown error";
+        }
+
+        throw Exception(lastErr);
+    }
+}
+
+void GlobalScope::setIPPreference(const std::string& preference) {
+    if (etSetIPPreference(preference.c_str()) != 0) {
+        const char* lastErr = etGetLastError();
+        if (lastErr == nullptr) {
+            lastErr = "unknown error";
+        }
+
+        throw Exception(lastErr);
+    }
+}
+
+void GlobalScope::setProxy(const std::string& proxy) {
+    if (etSetProxy(proxy.c_str()) != 0) {
+        const char* lastErr = etGetLastError();
+        if (lastErr == nullptr) {
+            lastErr = "unknown error";
+        }
+
+        throw Exception(lastErr);
+    }
+}
+
+void GlobalScope::loadHoldPolicy(const std::filesystem::path& policyPath) {
+    auto cpath = policyPath.u8string();
+    if (etLoadHoldPolicy(cpath.c_str()) != 0) {
+        const char* lastErr = etGetLastError();
+        if (lastErr == nullptr) {
+            lastErr = "unknown error";
+        }
+
+        throw Exception(lastErr);
+    }
+}
+
+bool GlobalScope::isLocalFilesProtected() const {
+    int protectedFiles = 0;
+    if (etLocalFilesProtected(&protectedFiles) != 0) {
+        const char* lastErr = etGetLastError();
+        if (lastErr == nullptr) {
+            lastErr = "unknown error";
+        }
+
+        throw Exception(lastErr);
+    }
+
+    return protectedFiles != 0;
+}
+
+void GlobalScope::unlockLocalFiles(const std::string& passphrase) {
+    if (etUnlockLocalFiles(passphrase.c_str()) != 0) {
+        const char* lastErr = etGetLastError();
+        if (lastErr == nullptr) {
+            lastErr = "unknown error";
+        }
+
+        throw Exception(lastErr);
+    }
+}
+
+void GlobalScope::loadFilterPresets(const std::filesystem::path& presetsPath) {
+    auto cpath = presetsPath.u8string();
+    if (etLoadFilterPresets(cpath.c_str()) != 0) {
+        const char* lastErr = etGetLastError();
+        if (lastErr == nullptr) {
+            lastErr = "unknown error";
+        }
+
+        throw Exception(lastErr);
+    }
+}
+
+std::string GlobalScope::queryHistory(const std::string& queryJSON) const {
+    char* outJSON = nullptr;
+    if (etHistoryQuery(queryJSON.c_str(), &outJSON) != 0) {
+        const char* lastErr = etGetLastError();
+        if (lastErr == nullptr) {
+            lastErr = "unknown error";
+        }
+
+        throw Exception(lastErr);
+    }
+
+    auto result = std::string(outJSON);
+    etFree(outJSON);
+
+    return result;
+}
+
+std::string GlobalScope::analyzeGrowth(const std::string& account) const {
+    char* outJSON = nullptr;
+    if (etHistoryAnalyzeGrowth(account.c_str(), &outJSON) != 0) {
+        const char* lastErr = etGetLastError();
+        if (lastErr == nullptr) {
+            lastErr = "unknown error";
+        }
+
+        throw Exception(lastErr);
+    }
+
+    auto result = std::string(outJSON);
+    etFree(outJSON);
+
+    return result;
+}
+
 } // namespace etcpp
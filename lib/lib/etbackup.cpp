@@ -45,6 +45,22 @@ etBackupCallbacks makeETCallback(BackupCallback& cb) {
     auto r = etBackupCallbacks{};
     r.ptr = &cb;
     r.onProgress = [](void* p, float progress) { reinterpret_cast<BackupCallback*>(p)->onProgress(progress); };
+    r.onHeartbeat = [](void* p, const char* stage, int64_t timestampMs, int64_t lastProgressMs) {
+        reinterpret_cast<BackupCallback*>(p)->onHeartbeat(stage, timestampMs, lastProgressMs);
+    };
+    r.onRateLimited = [](void* p, int64_t waitSeconds) { reinterpret_cast<BackupCallback*>(p)->onRateLimited(waitSeconds); };
+    r.onProgressEvent = [](void* p, const etProgressEvent* event) {
+        reinterpret_cast<BackupCallback*>(p)->onProgressEvent(ProgressEvent{
+            event->stage,
+            event->processedMessageCount,
+            event->totalMessageCount,
+            event->transferredBytes,
+            event->bytesPerSecond,
+            event->messagesPerSecond,
+            event->etaSeconds,
+            event->timestampMs,
+        });
+    };
 
     return r;
 }
@@ -66,6 +82,73 @@ void Backup::cancel() {
     wrapCCall([&](etBackup* ptr) { return etBackupCancel(ptr); });
 }
 
+void Backup::cancel(CancelMode mode, std::chrono::milliseconds gracePeriod) {
+    wrapCCall([&](etBackup* ptr) {
+        return etBackupCancelWithMode(ptr, static_cast<int>(mode), static_cast<uint64_t>(gracePeriod.count()));
+    });
+}
+
+void Backup::setAutoGeneratedMode(AutoGeneratedMode mode) {
+    wrapCCall([&](etBackup* ptr) { return etBackupSetAutoGeneratedMode(ptr, static_cast<int>(mode)); });
+}
+
+void Backup::setOutputFormat(OutputFormat format) {
+    wrapCCall([&](etBackup* ptr) { return etBackupSetOutputFormat(ptr, static_cast<int>(format)); });
+}
+
+void Backup::setIncremental(bool recordTombstones) {
+    wrapCCall([&](etBackup* ptr) { return etBackupSetIncremental(ptr, recordTombstones ? 1 : 0); });
+}
+
+void Backup::setResume() {
+    wrapCCall([&](etBackup* ptr) { return etBackupSetResume(ptr); });
+}
+
+void Backup::addMirror(const std::filesystem::path& path) {
+    auto cpath = path.u8string();
+    wrapCCall([&](etBackup* ptr) { return etBackupAddMirror(ptr, cpath.c_str()); });
+}
+
+void Backup::setMirrorParallel(bool parallel) {
+    wrapCCall([&](etBackup* ptr) { return etBackupSetMirrorParallel(ptr, parallel ? 1 : 0); });
+}
+
+void Backup::setSplitByYear(bool enabled) {
+    wrapCCall([&](etBackup* ptr) { return etBackupSetSplitByYear(ptr, enabled ? 1 : 0); });
+}
+
+void Backup::setPathBudget(const std::string& budget) {
+    wrapCCall([&](etBackup* ptr) { return etBackupSetPathBudget(ptr, budget.c_str()); });
+}
+
+void Backup::setEncryption(const std::string& passphrase, const std::string& armoredKey) {
+    wrapCCall([&](etBackup* ptr) { return etBackupSetEncryption(ptr, passphrase.c_str(), armoredKey.c_str()); });
+}
+
+void Backup::setFilter(const std::string& filterJSON) {
+    wrapCCall([&](etBackup* ptr) { return etBackupSetFilter(ptr, filterJSON.c_str()); });
+}
+
+void Backup::setFilterPreset(const std::string& name) {
+    wrapCCall([&](etBackup* ptr) { return etBackupSetFilterPreset(ptr, name.c_str()); });
+}
+
+void Backup::setDateRange(const std::string& after, const std::string& before) {
+    wrapCCall([&](etBackup* ptr) { return etBackupSetDateRange(ptr, after.c_str(), before.c_str()); });
+}
+
+void Backup::setSnapshotAlert(const std::string& webhookURL, const std::string& email, int maxDeleted) {
+    wrapCCall([&](etBackup* ptr) { return etBackupSetSnapshotAlert(ptr, webhookURL.c_str(), email.c_str(), maxDeleted); });
+}
+
+void Backup::setConcurrency(int concurrency) {
+    wrapCCall([&](etBackup* ptr) { return etBackupSetConcurrency(ptr, concurrency); });
+}
+
+void Backup::setBuildConcurrency(int concurrency) {
+    wrapCCall([&](etBackup* ptr) { return etBackupSetBuildConcurrency(ptr, concurrency); });
+}
+
 std::filesystem::path Backup::getExportPath() const {
     char* outPath = nullptr;
     wrapCCall([&](etBackup* ptr) { return etBackupGetExportPath(ptr, &outPath); });
@@ -82,6 +165,41 @@ std::uint64_t Backup::getExpectedDiskUsage() const {
     return usage;
 }
 
+Backup::FilterPrediction Backup::predictFilter(const std::string& filterJSON) const {
+    auto result = FilterPrediction{};
+    wrapCCall([&](etBackup* ptr) {
+        return etBackupPredictFilter(ptr, filterJSON.c_str(), &result.messageCount, &result.expectedDiskUsage);
+    });
+    return result;
+}
+
+CancelCause Backup::getCancelCause() const {
+    etCancelCause result = ET_CANCEL_CAUSE_NONE;
+    wrapCCall([&](etBackup* ptr) { return etBackupGetCancelCause(ptr, &result); });
+
+    return static_cast<CancelCause>(result);
+}
+
+std::string Backup::dryRun() const {
+    char* outJSON = nullptr;
+    wrapCCall([&](etBackup* ptr) { return etBackupDryRun(ptr, &outJSON); });
+
+    auto result = std::string(outJSON);
+    etFree(outJSON);
+
+    return result;
+}
+
+std::string Backup::getResultJSON() const {
+    char* outJSON = nullptr;
+    wrapCCall([&](etBackup* ptr) { return etBackupGetResult(ptr, &outJSON); });
+
+    auto result = std::string(outJSON);
+    etFree(outJSON);
+
+    return result;
+}
+
 template<class F>
 void Backup::wrapCCall(F func) {
     static_assert(std::is_invocable_r_v<etBackupStatus, F, etBackup*>, "invalid function/lambda signature");
@@ -44,6 +44,23 @@ etRestoreCallbacks makeETRestoreCallback(RestoreCallback& cb) {
     auto r = etRestoreCallbacks{};
     r.ptr = &cb;
     r.onProgress = [](void* p, float progress) { reinterpret_cast<RestoreCallback*>(p)->onProgress(progress); };
+    r.onETA = [](void* p, int64_t remainingSeconds) { reinterpret_cast<RestoreCallback*>(p)->onETA(remainingSeconds); };
+    r.onHeartbeat = [](void* p, const char* stage, int64_t timestampMs, int64_t lastProgressMs) {
+        reinterpret_cast<RestoreCallback*>(p)->onHeartbeat(stage, timestampMs, lastProgressMs);
+    };
+    r.onRateLimited = [](void* p, int64_t waitSeconds) { reinterpret_cast<RestoreCallback*>(p)->onRateLimited(waitSeconds); };
+    r.onProgressEvent = [](void* p, const etProgressEvent* event) {
+        reinterpret_cast<RestoreCallback*>(p)->onProgressEvent(ProgressEvent{
+            event->stage,
+            event->processedMessageCount,
+            event->totalMessageCount,
+            event->transferredBytes,
+            event->bytesPerSecond,
+            event->messagesPerSecond,
+            event->etaSeconds,
+            event->timestampMs,
+        });
+    };
 
     return r;
 }
@@ -65,6 +82,12 @@ void Restore::cancel() {
     wrapCCall([&](etRestore* ptr) { return etRestoreCancel(ptr); });
 }
 
+void Restore::cancel(CancelMode mode, std::chrono::milliseconds gracePeriod) {
+    wrapCCall([&](etRestore* ptr) {
+        return etRestoreCancelWithMode(ptr, static_cast<int>(mode), static_cast<uint64_t>(gracePeriod.count()));
+    });
+}
+
 std::filesystem::path Restore::getBackupPath() const {
     char* outPath = nullptr;
     wrapCCall([&](etRestore* ptr) { return etRestoreGetBackupPath(ptr, &outPath); });
@@ -103,6 +126,92 @@ int64_t Restore::getSkippedCount() const {
     return result;
 }
 
+void Restore::setTransactional(bool transactional) {
+    wrapCCall([&](etRestore* ptr) { return etRestoreSetTransactional(ptr, transactional); });
+}
+
+void Restore::setAlwaysCreateLabels(bool alwaysCreate) {
+    wrapCCall([&](etRestore* ptr) { return etRestoreSetAlwaysCreateLabels(ptr, alwaysCreate); });
+}
+
+void Restore::setImportLabel(bool enabled) {
+    wrapCCall([&](etRestore* ptr) { return etRestoreSetImportLabel(ptr, enabled); });
+}
+
+void Restore::setSkipDuplicates(bool enabled) {
+    wrapCCall([&](etRestore* ptr) { return etRestoreSetSkipDuplicates(ptr, enabled); });
+}
+
+void Restore::setResume(bool enabled) {
+    wrapCCall([&](etRestore* ptr) { return etRestoreSetResume(ptr, enabled); });
+}
+
+void Restore::setEncryption(const std::string& passphrase, const std::string& armoredKey) {
+    wrapCCall([&](etRestore* ptr) { return etRestoreSetEncryption(ptr, passphrase.c_str(), armoredKey.c_str()); });
+}
+
+void Restore::setConcurrency(int concurrency) {
+    wrapCCall([&](etRestore* ptr) { return etRestoreSetConcurrency(ptr, concurrency); });
+}
+
+void Restore::setGuardrails(double maxFailureRate, int failureWindow, double minThroughput, int throughputWindowMinutes) {
+    wrapCCall([&](etRestore* ptr) {
+        return etRestoreSetGuardrails(ptr, maxFailureRate, failureWindow, minThroughput, throughputWindowMinutes);
+    });
+}
+
+void Restore::setFilter(const std::string& filterJSON) {
+    wrapCCall([&](etRestore* ptr) { return etRestoreSetFilter(ptr, filterJSON.c_str()); });
+}
+
+void Restore::setDateRange(const std::string& after, const std::string& before) {
+    wrapCCall([&](etRestore* ptr) { return etRestoreSetDateRange(ptr, after.c_str(), before.c_str()); });
+}
+
+bool Restore::wasRolledBack() const {
+    int result = 0;
+    wrapCCall([&](etRestore* ptr) { return etRestoreGetRolledBack(ptr, &result); });
+
+    return result != 0;
+}
+
+std::string Restore::verifyJSON() {
+    char* outJSON = nullptr;
+    wrapCCall([&](etRestore* ptr) { return etRestoreVerify(ptr, &outJSON); });
+
+    auto result = std::string(outJSON);
+    etFree(outJSON);
+
+    return result;
+}
+
+std::string Restore::getLabelPreviewJSON() const {
+    char* outJSON = nullptr;
+    wrapCCall([&](etRestore* ptr) { return etRestoreGetLabelPreview(ptr, &outJSON); });
+
+    auto result = std::string(outJSON);
+    etFree(outJSON);
+
+    return result;
+}
+
+CancelCause Restore::getCancelCause() const {
+    etCancelCause result = ET_CANCEL_CAUSE_NONE;
+    wrapCCall([&](etRestore* ptr) { return etRestoreGetCancelCause(ptr, &result); });
+
+    return static_cast<CancelCause>(result);
+}
+
+std::string Restore::getResultJSON() const {
+    char* outJSON = nullptr;
+    wrapCCall([&](etRestore* ptr) { return etRestoreGetResult(ptr, &outJSON); });
+
+    auto result = std::string(outJSON);
+    etFree(outJSON);
+
+    return result;
+}
+
 template<class F>
 void Restore::wrapCCall(F func) {
     static_assert(std::is_invocable_r_v<etRestoreStatus, F, etRestore*>, "invalid function/lambda signature");
@@ -55,6 +55,7 @@ etSessionCallbacks makeCCallback(SessionCallback* ptr) {
     cb.ptr = ptr;
     cb.onNetworkLost = [](void* p) { reinterpret_cast<SessionCallback*>(p)->onNetworkLost(); };
     cb.onNetworkRestored = [](void* p) { reinterpret_cast<SessionCallback*>(p)->onNetworkRestored(); };
+    cb.onClockSkew = [](void* p, int64_t skewSeconds) { reinterpret_cast<SessionCallback*>(p)->onClockSkew(skewSeconds); };
 
     return cb;
 }
@@ -123,6 +124,34 @@ Session::LoginState Session::loginTOTP(const char* totp) {
     return ls;
 }
 
+Session::LoginState Session::loginFIDO2(const char* assertionJSON) {
+    LoginState ls = LoginState::LoggedOut;
+    wrapCCall([&](etSession* ptr) {
+        etSessionLoginState els = ET_SESSION_LOGIN_STATE_LOGGED_OUT;
+        auto status = etSessionSubmitFIDO2(ptr, assertionJSON, &els);
+        if (status == ET_SESSION_STATUS_OK) {
+            ls = mapLoginState(els);
+        }
+        return status;
+    });
+
+    return ls;
+}
+
+bool Session::resumeFromKeychain() {
+    int resumed = 0;
+    wrapCCall([&](etSession* ptr) {
+        etSessionLoginState els = ET_SESSION_LOGIN_STATE_LOGGED_OUT;
+        return etSessionResumeFromKeychain(ptr, &resumed, &els);
+    });
+
+    return resumed != 0;
+}
+
+void Session::saveToKeychain() {
+    wrapCCall([&](etSession* ptr) { return etSessionSaveToKeychain(ptr); });
+}
+
 Session::LoginState Session::loginMailboxPassword(std::string_view password) {
     LoginState ls = LoginState::LoggedOut;
     wrapCCall([&](etSession* ptr) {
@@ -200,6 +229,36 @@ std::string Session::getHVSolveURL() const {
     return result;
 }
 
+std::string Session::getFIDO2ChallengeJSON() const {
+    char* outJSON = nullptr;
+    wrapCCall([&](etSession* ptr) -> etSessionStatus { return etSessionGetFIDO2Challenge(ptr, &outJSON); });
+
+    auto result = std::string(outJSON);
+    etFree(outJSON);
+
+    return result;
+}
+
+std::string Session::getScopesJSON() const {
+    char* outJSON = nullptr;
+    wrapCCall([&](etSession* ptr) -> etSessionStatus { return etSessionGetScopes(ptr, &outJSON); });
+
+    auto result = std::string(outJSON);
+    etFree(outJSON);
+
+    return result;
+}
+
+std::string Session::getScopeSummary() const {
+    char* outSummary = nullptr;
+    wrapCCall([&](etSession* ptr) -> etSessionStatus { return etSessionGetScopeSummary(ptr, &outSummary); });
+
+    auto result = std::string(outSummary);
+    etFree(outSummary);
+
+    return result;
+}
+
 Session::LoginState Session::markHVSolved() {
     LoginState ls = LoginState::LoggedOut;
     wrapCCall([&](etSession* ptr) -> etSessionStatus {
@@ -237,6 +296,8 @@ Session::LoginState mapLoginState(etSessionLoginState s) {
         return Session::LoginState::LoggedIn;
     case ET_SESSION_LOGIN_STATE_AWAITING_TOTP:
         return Session::LoginState::AwaitingTOTP;
+    case ET_SESSION_LOGIN_STATE_AWAITING_FIDO2:
+        return Session::LoginState::AwaitingFIDO2;
     }
 
     return Session::LoginState::LoggedOut;